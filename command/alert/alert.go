@@ -17,9 +17,15 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
+	multierror "github.com/hashicorp/go-multierror"
+	"golang.org/x/xerrors"
 )
 
 // Field represents a summary of the query results that
@@ -33,6 +39,51 @@ type Field struct {
 
 	// Count is the number of fields which match a filter
 	Count int `json:"doc_count" mapstructure:"doc_count"`
+
+	// Value, if not empty, is the rendered value of a field of the
+	// bucket (e.g. an average latency) which is shown in place of
+	// Count. See the 'value_field' field of the rule configuration
+	// file
+	Value string `json:"value,omitempty" mapstructure:"-"`
+
+	// Number, if not nil, is the numeric value from which Value was
+	// rendered. It is only set if the field has a Unit or a Threshold
+	Number *float64 `json:"number,omitempty" mapstructure:"-"`
+
+	// Unit, if not empty, is the unit of Number (see FormatUnit)
+	// with which it is shown in place of Value. See the 'value_unit'
+	// field of the rule configuration file
+	Unit string `json:"unit,omitempty" mapstructure:"-"`
+
+	// Threshold, if not nil, is the value above which Number is
+	// flagged by the outputs (see Exceeds). See the
+	// 'value_threshold' field of the rule configuration file
+	Threshold *float64 `json:"threshold,omitempty" mapstructure:"-"`
+
+	// TopHit, if not nil, is the first document of a top_hits
+	// sub-aggregation of the bucket, i.e. a sample of the documents
+	// it counts. Templates may show its fields (e.g.
+	// {{.TopHit.message}}) alongside Count
+	TopHit map[string]interface{} `json:"top_hit,omitempty" mapstructure:"-"`
+}
+
+// Display returns the value shown for the field, which is Number
+// formatted with Unit if both are set, Value if it is not empty and
+// Count otherwise.
+func (f *Field) Display() string {
+	if f.Number != nil && f.Unit != "" {
+		return FormatUnit(*f.Number, f.Unit)
+	}
+	if f.Value != "" {
+		return f.Value
+	}
+	return strconv.Itoa(f.Count)
+}
+
+// Exceeds returns whether the field has both a Number and a
+// Threshold and the former is greater than the latter.
+func (f *Field) Exceeds() bool {
+	return f.Number != nil && f.Threshold != nil && *f.Number > *f.Threshold
 }
 
 // Record is used to send the results of an Elasticsearch query
@@ -56,6 +107,12 @@ type Record struct {
 	// Elasticsearch response JSON
 	BodyField bool `json:"-"`
 
+	// Documents are the JSON objects found at the body field, in
+	// the order they were found, so that outputs can render each
+	// of them individually rather than using Text. It is only
+	// non-empty if BodyField is true
+	Documents []map[string]interface{} `json:"-"`
+
 	// Fields is the collection of elements of the
 	// Elasticsearch response JSON that match the filter.
 	// This will be non-empty only when the Filter is not
@@ -74,6 +131,28 @@ type Alert struct {
 	// this alert
 	RuleName string
 
+	// AlertID is a stable identifier of the firing of the rule
+	// that generated this alert, shared by the alert and any
+	// reminders of it. If not empty, it is passed to the Methods
+	// in the context of Write (see AlertIDFromContext) so that
+	// they can include it in their notifications
+	AlertID string
+
+	// FireCount is the number of consecutive runs of the rule which
+	// produced exactly the same records as this alert, and FirstFired
+	// is when the first of them ran. If FireCount is positive, they
+	// are passed to the Methods in the context of Write (see
+	// FireCountFromContext) so that they can include them in their
+	// notifications
+	FireCount  int
+	FirstFired time.Time
+
+	// Query is the body of the Elasticsearch query which produced
+	// this alert. If not nil, it is passed to the Methods in the
+	// context of Write (see QueryFromContext) so that they can
+	// include it in their notifications
+	Query map[string]interface{}
+
 	// Method is a set of alert.AlertMethod instances
 	// which that the AlertHAndler will use to send
 	// alerts
@@ -82,24 +161,134 @@ type Alert struct {
 	// Records are the processed response data from an
 	// Elasticsearch query
 	Records []*Record
+
+	// RequireAllOutputs is whether delivery of this alert fails
+	// if any of its Methods fails. If true, the Handler reports
+	// the combined errors of the Methods, or nil if all of them
+	// succeeded, on Result once it is done sending the alert
+	RequireAllOutputs bool
+
+	// Result, if not nil, receives the outcome of delivering the
+	// alert once the Handler is done sending it. If
+	// RequireAllOutputs is false, it is an error only if none of
+	// the Methods delivered the alert (or spooled it for retry). It
+	// should be buffered
+	Result chan error
+
+	// Concurrency is the maximum number of Methods with which the
+	// alert is sent at the same time. The Methods are still started
+	// in the order in which they appear. If less than 2, the alert
+	// is sent with one Method at a time
+	Concurrency int
+}
+
+// alertIDKey is the context key of the ID of an alert.
+type alertIDKey struct{}
+
+// WithAlertID returns a copy of ctx which carries the given
+// alert ID.
+func WithAlertID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, alertIDKey{}, id)
+}
+
+// AlertIDFromContext returns the alert ID carried by ctx (see
+// Alert.AlertID), or an empty string if there is none.
+func AlertIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(alertIDKey{}).(string)
+	return id
+}
+
+// fireCountKey is the context key of the fire count of an alert.
+type fireCountKey struct{}
+
+// fireCount is the value carried by a context with WithFireCount.
+type fireCount struct {
+	count int
+	since time.Time
+}
+
+// WithFireCount returns a copy of ctx which carries the number of
+// consecutive runs which produced an alert and when the first of
+// them ran.
+func WithFireCount(ctx context.Context, count int, since time.Time) context.Context {
+	return context.WithValue(ctx, fireCountKey{}, fireCount{count: count, since: since})
+}
+
+// FireCountFromContext returns the fire count carried by ctx and
+// when the rule first fired (see Alert.FireCount), or zero values
+// if there are none.
+func FireCountFromContext(ctx context.Context) (int, time.Time) {
+	fc, _ := ctx.Value(fireCountKey{}).(fireCount)
+	return fc.count, fc.since
+}
+
+// context returns a copy of ctx which carries the ID, the fire
+// count and the query of the alert, if it has them.
+func (a *Alert) context(ctx context.Context) context.Context {
+	if a.AlertID != "" {
+		ctx = WithAlertID(ctx, a.AlertID)
+	}
+	if a.FireCount > 0 {
+		ctx = WithFireCount(ctx, a.FireCount, a.FirstFired)
+	}
+	if a.Query != nil {
+		ctx = WithQuery(ctx, a.Query)
+	}
+	return ctx
 }
 
 // Method is used to send alerts to some output.
 type Method interface {
+	// Write sends the records generated by the given rule
+	// to the output
 	Write(context.Context, string, []*Record) error
+
+	// Name returns the type of the output (e.g. "slack")
+	// for use in logs and errors
+	Name() string
+}
+
+// Retrier persists an alert which could not be sent with the output
+// at the given index of its Methods so that it is retried later.
+type Retrier interface {
+	Write(alert *Alert, output int) error
 }
 
 // HandlerConfig is used to provide the logger
 // with which the alert handlers will log messages.
 type HandlerConfig struct {
 	Logger hclog.Logger
+
+	// Spool, if not nil, persists the alerts which Run fails to
+	// send with one of their outputs so that they are retried
+	// later
+	Spool *Spool
+
+	// RetryQueue, if not nil, is used in place of Spool to persist
+	// the alerts which Run fails to send, e.g. a queue kept in
+	// Elasticsearch
+	RetryQueue Retrier
+
+	// ErrorOutput, if not nil, is sent the failures of the outputs
+	// which could not send an alert after every attempt
+	ErrorOutput *ErrorOutput
 }
 
 // Handler is used to send alerts to various outputs.
 type Handler struct {
-	logger hclog.Logger
+	logger      hclog.Logger
+	spool       Retrier
+	errorOutput *ErrorOutput
+
+	// randMu guards rand, which backoffs are drawn from by
+	// concurrent sends
+	randMu sync.Mutex
 	rand   *rand.Rand
 
+	// hookRuns holds a token for each alert whose hooks are running
+	// (see startHooks)
+	hookRuns chan struct{}
+
 	// StopCh is used to terminate the Run() loop
 	StopCh chan struct{}
 
@@ -111,22 +300,46 @@ type Handler struct {
 // NewHandler creates a new *Handler instance.
 func NewHandler(config *HandlerConfig) *Handler {
 	return &Handler{
-		logger: config.Logger,
-		rand:   rand.New(rand.NewSource(int64(time.Now().Nanosecond()))), // nolint: gosec
-		StopCh: make(chan struct{}),
-		DoneCh: make(chan struct{}),
-	}
-}
-
-// Run starts the *AlertHandler running. Once started, it
-// waits to receive a new *Alert from outputCh. When it
-// receives the alert, it will attempt to send the alert
-// with the AlertMethods included in the alert. If it fails,
-// it will backoff for a few seconds before trying to send
-// the alert twice more. If it fails all three attempts, it
-// will quit trying to send the alert. Run will return if
-// ctx.Done() or StopCh becomes unblocked. Before returning,
-// it will close the DoneCh. Once DoneCh is closed, Run
+		logger:      config.Logger,
+		rand:        rand.New(rand.NewSource(int64(time.Now().Nanosecond()))), // nolint: gosec
+		spool:       retrier(config),
+		errorOutput: config.ErrorOutput,
+		hookRuns:    make(chan struct{}, maxHookRuns),
+		StopCh:      make(chan struct{}),
+		DoneCh:      make(chan struct{}),
+	}
+}
+
+// retrier returns the retry queue of the config, or its spool if
+// it has none. It returns a nil Retrier rather than a nil *Spool if
+// it has neither.
+func retrier(config *HandlerConfig) Retrier {
+	switch {
+	case config.RetryQueue != nil:
+		return config.RetryQueue
+	case config.Spool != nil:
+		return config.Spool
+	}
+	return nil
+}
+
+// Run starts the *AlertHandler running. Once started, it waits to
+// receive a new *Alert from outputCh. When it receives the alert, it
+// will attempt to send the alert with the AlertMethods included in
+// the alert, in the order in which they appear. If a method fails,
+// it will backoff for a few seconds before trying to send the alert
+// twice more, without delaying the other methods. If it fails all
+// three attempts, it will quit trying to send the alert, writing it
+// to the spool if there is one. The registered hooks (see
+// RegisterHook) are called with each alert in the background, so
+// that a slow hook does not delay the alerts. Alerts which require
+// all of their outputs to succeed are sent with Send() instead, so
+// that the outcome can be reported, and are not spooled since the
+// rule alerts again on its next run. Alerts with a Concurrency
+// greater than one are sent in the background with up to that many
+// of their methods at once, each retried and spooled as above. Run
+// will return if ctx.Done() or StopCh becomes unblocked. Before
+// returning, it will close the DoneCh. Once DoneCh is closed, Run
 // should not be called again.
 func (a *Handler) Run(ctx context.Context, outputCh <-chan *Alert) { // nolint: gocyclo
 	defer func() {
@@ -138,15 +351,32 @@ func (a *Handler) Run(ctx context.Context, outputCh <-chan *Alert) { // nolint:
 	alertCh := make(chan func() (int, error), 8)
 	active := newInventory()
 
-	alertFunc := func(ctx context.Context, alertID, rule string, method Method, records []*Record) func() (int, error) {
+	alertFunc := func(ctx context.Context, alertID string, alert *Alert, output int, o *outcome) func() (int, error) {
+		method := alert.Methods[output]
+		// The attempts share a Progress as in write
+		ctx = WithProgress(ctx, new(Progress))
 		return func() (int, error) {
 			if active.remaining(alertID) < 1 {
 				active.deregister(alertID)
 				return 0, nil
 			}
 			active.decrement(alertID)
-			err := method.Write(ctx, rule, records)
-			return active.remaining(alertID), err
+			if err := method.Write(ctx, alert.RuleName, alert.Records); err != nil {
+				n := active.remaining(alertID)
+				err = xerrors.Errorf("error writing alert to %s output: %w", method.Name(), err)
+				if n < 1 {
+					if a.spoolAlert(alert, output) {
+						o.done(nil)
+					} else {
+						o.done(err)
+					}
+					a.errorOutput.Report(alert.RuleName, method.Name(), err)
+				}
+				return n, err
+			}
+			a.logSent(ctx, alert.RuleName, method)
+			o.done(nil)
+			return active.remaining(alertID), nil
 		}
 	}
 
@@ -158,10 +388,44 @@ func (a *Handler) Run(ctx context.Context, outputCh <-chan *Alert) { // nolint:
 			return
 		case alert := <-outputCh:
 			a.logger.Info(fmt.Sprintf("new query results received from rule %q", alert.RuleName))
+			if alert.RequireAllOutputs {
+				// Send logs the unrouted records itself
+				go func(alert *Alert) {
+					err := a.Send(ctx, alert)
+					if alert.Result != nil {
+						alert.Result <- err
+					}
+				}(alert)
+				continue
+			}
+			a.startHooks(alert.context(ctx), alert)
+			a.logUnrouted(alert)
+			if alert.Concurrency > 1 {
+				go func(alert *Alert) {
+					delivered, err := a.sendAll(alert.context(ctx), alert, true)
+					if err != nil {
+						a.logger.Error(fmt.Sprintf("error sending alert from rule %q", alert.RuleName), "error", err)
+					}
+					if alert.Result != nil {
+						if delivered {
+							err = nil
+						}
+						alert.Result <- err
+					}
+				}(alert)
+				continue
+			}
+			var outputs []int
 			for i, method := range alert.Methods {
+				if a.shouldSend(alert, method) {
+					outputs = append(outputs, i)
+				}
+			}
+			o := newOutcome(alert.Result, len(outputs))
+			for _, i := range outputs {
 				alertMethodID := fmt.Sprintf("%d|%s", i, alert.ID)
 				active.register(alertMethodID)
-				alertCh <- alertFunc(ctx, alertMethodID, alert.RuleName, method, alert.Records)
+				alertCh <- alertFunc(alert.context(ctx), alertMethodID, alert, i, o)
 			}
 		case writeAlert := <-alertCh:
 			select {
@@ -175,17 +439,207 @@ func (a *Handler) Run(ctx context.Context, outputCh <-chan *Alert) { // nolint:
 				backoff := a.newBackoff()
 				a.logger.Error("error returned by alert function", "error", err,
 					"remaining_retries", n, "backoff", backoff.String())
-				select {
-				case <-ctx.Done():
-					return
-				case <-time.After(backoff):
-					alertCh <- writeAlert
-				}
+				// Back off in the background so that the remaining
+				// outputs are not held up by the one being retried
+				go a.retry(ctx, alertCh, writeAlert, backoff)
 			}
 		}
 	}
 }
 
+// retry queues writeAlert on alertCh once backoff has elapsed,
+// unless ctx is canceled or Run returns in the meantime.
+func (a *Handler) retry(ctx context.Context, alertCh chan<- func() (int, error),
+	writeAlert func() (int, error), backoff time.Duration) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-a.DoneCh:
+		return
+	case <-time.After(backoff):
+	}
+	select {
+	case <-ctx.Done():
+	case <-a.DoneCh:
+	case alertCh <- writeAlert:
+	}
+}
+
+// Send synchronously sends the alert with each of its enabled
+// AlertMethods, in the order in which they appear, while calling
+// the registered hooks (see RegisterHook). Up to Concurrency of the
+// methods are sent at the same time. Like Run, it tries each method
+// up to three times, backing off for a few seconds between
+// attempts. It returns once the alert has been sent and the hooks
+// have returned or been abandoned, with a non-nil error if any
+// method failed every attempt.
+func (a *Handler) Send(ctx context.Context, alert *Alert) error {
+	ctx = alert.context(ctx)
+	hooksDone := a.startHooks(ctx, alert)
+	a.logUnrouted(alert)
+	_, err := a.sendAll(ctx, alert, false)
+	<-hooksDone
+	return err
+}
+
+// sendAll sends the alert with each of its enabled methods, with up
+// to alert.Concurrency of them at once, and returns the combined
+// errors of the methods which failed every attempt in the order in
+// which the methods appear. If spool is true, the alert is spooled
+// for a method which failed every attempt. Once ctx is canceled, no
+// more methods are started. It also returns false if the alert was
+// sent with at least one method and none of them delivered (or
+// spooled) it.
+func (a *Handler) sendAll(ctx context.Context, alert *Alert, spool bool) (bool, error) {
+	workers := alert.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	errs := make([]error, len(alert.Methods))
+	var (
+		wg      sync.WaitGroup
+		sent    int32
+		handled int32
+	)
+	for i, method := range alert.Methods {
+		if !a.shouldSend(alert, method) {
+			continue
+		}
+		sem <- struct{}{}
+		if err := ctx.Err(); err != nil {
+			<-sem
+			errs[i] = xerrors.Errorf("error writing alert to %s output: %w", method.Name(), err)
+			break
+		}
+		wg.Add(1)
+		atomic.AddInt32(&sent, 1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = a.write(ctx, alert, i)
+			if errs[i] == nil {
+				atomic.AddInt32(&handled, 1)
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if spool && a.spoolAlert(alert, i) {
+				atomic.AddInt32(&handled, 1)
+			}
+			a.errorOutput.Report(alert.RuleName, alert.Methods[i].Name(), errs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	// The module targets Go 1.13, which predates errors.Join, so the
+	// errors are combined with go-multierror like everywhere else
+	var allErrors *multierror.Error
+	for _, err := range errs {
+		if err != nil {
+			allErrors = multierror.Append(allErrors, err)
+		}
+	}
+	return sent == 0 || handled > 0, allErrors.ErrorOrNil()
+}
+
+// write sends the alert with the method at the given index of its
+// Methods, trying up to three times and backing off for a few
+// seconds between attempts, and returns the error of the last
+// attempt if all of them failed. The attempts share a Progress so
+// that the method may resume where the previous attempt failed.
+func (a *Handler) write(ctx context.Context, alert *Alert, output int) error {
+	method := alert.Methods[output]
+	ctx = WithProgress(ctx, new(Progress))
+	for attempt := 1; ; attempt++ {
+		err := method.Write(ctx, alert.RuleName, alert.Records)
+		if err == nil {
+			a.logSent(ctx, alert.RuleName, method)
+			return nil
+		}
+		err = xerrors.Errorf("error writing alert to %s output: %w", method.Name(), err)
+		if attempt >= defaultNumAttempts {
+			return err
+		}
+		backoff := a.newBackoff()
+		a.logger.Error("error returned by alert function", "error", err,
+			"remaining_retries", defaultNumAttempts-attempt, "backoff", backoff.String())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// shouldSend returns false, logging why, if the alert should not be
+// sent with the method because the method is disabled, none of the
+// records of the alert are routed to it or it would leave out all of
+// them (see ContentFilter).
+func (a *Handler) shouldSend(alert *Alert, method Method) bool {
+	if !Enabled(method) {
+		a.logger.Info(fmt.Sprintf("skipping disabled output of rule %q", alert.RuleName), "method", method.Name())
+		return false
+	}
+	if len(RouteRecords(method, alert.Records)) == 0 {
+		a.logger.Debug(fmt.Sprintf("no records of rule %q match output", alert.RuleName), "method", method.Name())
+		return false
+	}
+	if !HasContent(method, alert.Records) {
+		a.logger.Debug(fmt.Sprintf("no content of rule %q left to send with output", alert.RuleName),
+			"method", method.Name())
+		return false
+	}
+	return true
+}
+
+// logUnrouted warns of the records of the alert which match none
+// of its outputs (see Route) and hence are not sent at all.
+func (a *Handler) logUnrouted(alert *Alert) {
+	unrouted := Unrouted(alert.Methods, alert.Records)
+	if len(unrouted) == 0 {
+		return
+	}
+	var fields int
+	filters := make([]string, 0, len(unrouted))
+	for _, record := range unrouted {
+		fields += len(record.Fields)
+		filters = append(filters, record.Filter)
+	}
+	a.logger.Warn(fmt.Sprintf("records of rule %q match none of its outputs", alert.RuleName),
+		"filters", strings.Join(filters, ", "), "fields", fields)
+}
+
+// spoolAlert writes the alert, which could not be sent with the
+// output at the given index of its Methods, to the spool or the
+// retry queue. It returns whether the alert was written.
+func (a *Handler) spoolAlert(alert *Alert, output int) bool {
+	if a.spool == nil {
+		return false
+	}
+	if err := a.spool.Write(alert, output); err != nil {
+		a.logger.Error(fmt.Sprintf("error spooling alert from rule %q", alert.RuleName),
+			"method", alert.Methods[output].Name(), "error", err)
+		return false
+	}
+	a.logger.Warn(fmt.Sprintf("alert from rule %q spooled for retry", alert.RuleName),
+		"method", alert.Methods[output].Name())
+	return true
+}
+
+// logSent logs that the alert of the given rule was sent with the
+// method, including the alert ID carried by ctx if there is one.
+func (a *Handler) logSent(ctx context.Context, rule string, method Method) {
+	args := []interface{}{"method", method.Name()}
+	if id := AlertIDFromContext(ctx); id != "" {
+		args = append(args, "alert_id", id)
+	}
+	a.logger.Info(fmt.Sprintf("alert from rule %q sent", rule), args...)
+}
+
 func (a *Handler) newBackoff() time.Duration {
+	a.randMu.Lock()
+	defer a.randMu.Unlock()
 	return 2*time.Second + time.Duration(a.rand.Int63()%int64(time.Second*2)-int64(time.Second))
 }
@@ -17,13 +17,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	hclog "github.com/hashicorp/go-hclog"
+	multierror "github.com/hashicorp/go-multierror"
 	uuid "github.com/hashicorp/go-uuid"
 	"golang.org/x/xerrors"
 )
@@ -59,6 +62,10 @@ func (f *fileAlertMethod) Write(ctx context.Context, rule string, records []*Rec
 	return json.NewEncoder(outfile).Encode(&entry)
 }
 
+func (f *fileAlertMethod) Name() string {
+	return "file"
+}
+
 // errorAlertMethod is a mock alert.AlertMethod used to simulate an
 // even where AlertMethod.Write() return an error.
 type errorAlertMethod struct{}
@@ -67,6 +74,14 @@ func (e *errorAlertMethod) Write(ctx context.Context, rule string, records []*Re
 	return xerrors.Errorf("test error")
 }
 
+func (e *errorAlertMethod) Check(ctx context.Context) error {
+	return xerrors.Errorf("test error")
+}
+
+func (e *errorAlertMethod) Name() string {
+	return "error"
+}
+
 func TestRun(t *testing.T) {
 	outputCh := make(chan *Alert, 1)
 
@@ -197,7 +212,7 @@ func TestRunError(t *testing.T) {
 	time.Sleep(7 * time.Second)
 
 	// Should attempt to execute Write() 3 times (see logs)
-	expected := `[ERROR] error returned by alert function: error="test error" remaining_retries=0`
+	expected := `[ERROR] error returned by alert function: error="error writing alert to error output: test error" remaining_retries=0`
 	if !strings.Contains(buf.String(), expected) {
 		t.Fatalf("Expected errors to contain:\n\t%s\nGot:\n\t%s", expected, buf.String())
 	}
@@ -210,3 +225,430 @@ func randomUUID(t *testing.T) string {
 	}
 	return id
 }
+
+func TestSend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler := NewHandler(&HandlerConfig{
+		Logger: hclog.NewNullLogger(),
+	})
+	records := []*Record{{Filter: "hits.hits._source", Text: "test"}}
+
+	fm := &fileAlertMethod{outputFilepath: filepath.Join(dir, "alerts.log")}
+	err = handler.Send(context.Background(), &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		Records:  records,
+		Methods:  []Method{fm, Disable(&errorAlertMethod{})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(fm.outputFilepath); err != nil {
+		t.Fatalf("alert was not written: %v", err)
+	}
+
+	// Fail fast rather than waiting out every backoff
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = handler.Send(ctx, &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		Records:  records,
+		Methods:  []Method{&errorAlertMethod{}},
+	})
+	if err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if !strings.Contains(err.Error(), "error writing alert to error output") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+type idAlertMethod struct {
+	id string
+}
+
+func (m *idAlertMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	m.id = AlertIDFromContext(ctx)
+	return nil
+}
+
+func (m *idAlertMethod) Name() string {
+	return "id"
+}
+
+func TestSendAlertID(t *testing.T) {
+	handler := NewHandler(&HandlerConfig{
+		Logger: hclog.NewNullLogger(),
+	})
+	records := []*Record{{Filter: "hits.hits._source", Text: "test"}}
+
+	cases := []struct {
+		name string
+		id   string
+	}{
+		{"with-id", "0123abcd"},
+		{"without-id", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &idAlertMethod{}
+			err := handler.Send(context.Background(), &Alert{
+				ID:       randomUUID(t),
+				AlertID:  tc.id,
+				RuleName: "test-rule",
+				Records:  records,
+				Methods:  []Method{m},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.id != tc.id {
+				t.Fatalf("unexpected alert ID (got %q, expected %q)", m.id, tc.id)
+			}
+		})
+	}
+}
+
+func TestRunRequireAllOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fm := &fileAlertMethod{outputFilepath: filepath.Join(dir, "alerts.log")}
+	cases := []struct {
+		name    string
+		methods []Method
+		err     bool
+	}{
+		{"all-succeed", []Method{fm, fm}, false},
+		{"one-fails", []Method{fm, &errorAlertMethod{}}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// Fail fast rather than waiting out every backoff
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			handler := NewHandler(&HandlerConfig{
+				Logger: hclog.NewNullLogger(),
+			})
+			outputCh := make(chan *Alert, 1)
+			go handler.Run(ctx, outputCh)
+
+			a := &Alert{
+				ID:                randomUUID(t),
+				RuleName:          "test-rule",
+				Records:           []*Record{{Filter: "hits.hits._source", Text: "test"}},
+				Methods:           tc.methods,
+				RequireAllOutputs: true,
+				Result:            make(chan error, 1),
+			}
+			outputCh <- a
+
+			select {
+			case err := <-a.Result:
+				if tc.err && err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				if !tc.err && err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the result of sending the alert")
+			}
+		})
+	}
+}
+
+func TestRunBestEffortResult(t *testing.T) {
+	rm := &recordsMethod{writes: make(chan []*Record, 8)}
+	cases := []struct {
+		name        string
+		methods     []Method
+		concurrency int
+		err         bool
+	}{
+		{"one-fails", []Method{rm, &errorAlertMethod{}}, 0, false},
+		{"all-fail", []Method{&errorAlertMethod{}, &errorAlertMethod{}}, 0, true},
+		{"all-fail-concurrently", []Method{&errorAlertMethod{}, &errorAlertMethod{}}, 2, true},
+		{"none-sent", []Method{Disable(&errorAlertMethod{})}, 0, false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// Each failing output backs off twice
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			handler := NewHandler(&HandlerConfig{
+				Logger: hclog.NewNullLogger(),
+			})
+			outputCh := make(chan *Alert, 1)
+			go handler.Run(ctx, outputCh)
+
+			a := &Alert{
+				ID:          randomUUID(t),
+				RuleName:    "test-rule",
+				Records:     []*Record{{Filter: "hits.hits._source", Text: "test"}},
+				Methods:     tc.methods,
+				Concurrency: tc.concurrency,
+				Result:      make(chan error, 1),
+			}
+			outputCh <- a
+
+			select {
+			case err := <-a.Result:
+				if tc.err && err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				if !tc.err && err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(20 * time.Second):
+				t.Fatal("timed out waiting for the result of sending the alert")
+			}
+		})
+	}
+}
+
+// orderedAlertMethod records each of its writes in a shared log,
+// failing the first `fails` of them.
+// resumingAlertMethod delivers one part of the alert per attempt
+// and fails the first attempt, recording where each attempt resumed.
+type resumingAlertMethod struct {
+	resumed []int
+}
+
+func (m *resumingAlertMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	p := ProgressFromContext(ctx)
+	m.resumed = append(m.resumed, p.Done())
+	p.SetDone(p.Done() + 1)
+	if len(m.resumed) == 1 {
+		return xerrors.New("test error")
+	}
+	return nil
+}
+
+func (m *resumingAlertMethod) Name() string {
+	return "resuming"
+}
+
+func TestSendProgress(t *testing.T) {
+	handler := NewHandler(&HandlerConfig{
+		Logger: hclog.NewNullLogger(),
+	})
+
+	m := &resumingAlertMethod{}
+	err := handler.Send(context.Background(), &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		Records:  []*Record{{Filter: "hits.hits._source", Text: "test"}},
+		Methods:  []Method{m},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{0, 1}; !reflect.DeepEqual(m.resumed, expected) {
+		t.Fatalf("unexpected progress of the attempts (got %v, expected %v)", m.resumed, expected)
+	}
+}
+
+type orderedAlertMethod struct {
+	name  string
+	fails int
+	log   chan<- string
+}
+
+func (m *orderedAlertMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	m.log <- m.name
+	if m.fails > 0 {
+		m.fails--
+		return xerrors.New("test error")
+	}
+	return nil
+}
+
+func (m *orderedAlertMethod) Name() string {
+	return m.name
+}
+
+func TestRunOutputOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := NewHandler(&HandlerConfig{
+		Logger: hclog.NewNullLogger(),
+	})
+	outputCh := make(chan *Alert, 1)
+	go handler.Run(ctx, outputCh)
+
+	writes := make(chan string, 8)
+	outputCh <- &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		Records:  []*Record{{Filter: "hits.hits._source", Text: "test"}},
+		Methods: []Method{
+			&orderedAlertMethod{name: "page", fails: 1, log: writes},
+			&orderedAlertMethod{name: "chat-1", log: writes},
+			&orderedAlertMethod{name: "chat-2", log: writes},
+		},
+	}
+
+	// The retry of the failed output comes after the other outputs
+	// rather than holding them up
+	expected := []string{"page", "chat-1", "chat-2", "page"}
+	for i, name := range expected {
+		select {
+		case got := <-writes:
+			if got != name {
+				t.Fatalf("unexpected output at dispatch %d (got %q, expected %q)", i+1, got, name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for dispatch %d", i+1)
+		}
+	}
+}
+
+// blockingAlertMethod signals that each of its writes started
+// and then blocks until ctx is canceled.
+type blockingAlertMethod struct {
+	name    string
+	started chan<- string
+}
+
+func (m *blockingAlertMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	m.started <- m.name
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (m *blockingAlertMethod) Name() string {
+	return m.name
+}
+
+func TestSendConcurrency(t *testing.T) {
+	cases := []struct {
+		name        string
+		concurrency int
+		started     int
+		errors      int
+	}{
+		// The method which would be started next fails as well
+		{"serial", 0, 1, 2},
+		{"bounded", 2, 2, 3},
+		{"unbounded", 5, 3, 3},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			handler := NewHandler(&HandlerConfig{
+				Logger: hclog.NewNullLogger(),
+			})
+			started := make(chan string, 3)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- handler.Send(ctx, &Alert{
+					ID:       randomUUID(t),
+					RuleName: "test-rule",
+					Records:  []*Record{{Filter: "hits.hits._source", Text: "test"}},
+					Methods: []Method{
+						&blockingAlertMethod{name: "page", started: started},
+						&blockingAlertMethod{name: "chat-1", started: started},
+						&blockingAlertMethod{name: "chat-2", started: started},
+					},
+					Concurrency: tc.concurrency,
+				})
+			}()
+
+			// None of the writes returns until ctx is canceled, so
+			// only those sent concurrently start
+			for i := 0; i < tc.started; i++ {
+				select {
+				case <-started:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for write %d to start", i+1)
+				}
+			}
+			select {
+			case name := <-started:
+				t.Fatalf("write to %s output started beyond the concurrency of %d", name, tc.concurrency)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			// Canceling ctx stops the writes in flight and no more
+			// methods are started
+			cancel()
+			select {
+			case err := <-errCh:
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				merr, ok := err.(*multierror.Error)
+				if !ok {
+					t.Fatalf("unexpected error type %T", err)
+				}
+				if len(merr.Errors) != tc.errors {
+					t.Fatalf("expected %d errors, got %d: %v", tc.errors, len(merr.Errors), err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for Send to return")
+			}
+			if len(started) > 0 {
+				t.Fatal("a write started after ctx was canceled")
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name   string
+		method Method
+		err    bool
+	}{
+		{
+			"not-a-checker",
+			&fileAlertMethod{},
+			false,
+		},
+		{
+			"failed",
+			&errorAlertMethod{},
+			true,
+		},
+		{
+			"disabled",
+			Disable(&errorAlertMethod{}),
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := Check(context.Background(), tc.method)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alertmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"github.com/mitchellh/mapstructure"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/tlsutil"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultResolveAfter is how long after it is sent an alert
+	// is resolved unless it is sent again
+	defaultResolveAfter = 15 * time.Minute
+
+	// alertsPath and statusPath are the paths of the endpoints of
+	// the Alertmanager API to which alerts are sent and with which
+	// Alertmanager is checked
+	alertsPath = "/api/v2/alerts"
+	statusPath = "/api/v2/status"
+
+	// maxErrorBody is the number of bytes of the body of an
+	// unsuccessful response included in the error
+	maxErrorBody = 512
+)
+
+// labelName matches valid Alertmanager label names.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Ensure AlertMethod adheres to the alert.Method interface.
+var _ alert.Method = (*AlertMethod)(nil)
+
+// AlertMethodConfig configures to which Alertmanager alerts will
+// be sent and how they are labeled.
+type AlertMethodConfig struct {
+	// URL is the base URL of Alertmanager (e.g.
+	// http://alertmanager:9093)
+	URL string `mapstructure:"url"`
+
+	// Labels are added to the labels of every alert
+	Labels map[string]string `mapstructure:"labels"`
+
+	// ResolveAfter is how long after it is sent an alert is resolved
+	// by Alertmanager unless the rule fires again and sends it anew.
+	// It should be longer than the interval between executions of
+	// the rule. If empty, alerts are resolved after 15 minutes
+	ResolveAfter string `mapstructure:"resolve_after"`
+
+	// GeneratorURL is the URL linked from each alert in the
+	// Alertmanager UI, e.g. a Kibana dashboard
+	GeneratorURL string `mapstructure:"generator_url"`
+
+	// Username and Password, if set, authenticate the requests to
+	// Alertmanager with Basic auth
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+
+	UserAgent string `mapstructure:"user_agent"`
+
+	// CACert is the path to a PEM-encoded CA certificate file used
+	// to verify the certificate of Alertmanager, e.g. if it is
+	// signed by a private CA. ClientCert and ClientKey are the paths
+	// to a PEM-encoded client certificate and private key presented
+	// to hosts which require mutual TLS
+	CACert             string `mapstructure:"ca_cert"`
+	ClientCert         string `mapstructure:"client_cert"`
+	ClientKey          string `mapstructure:"client_key"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+
+	Client *http.Client
+}
+
+// AlertMethod implements the alert.Method interface for sending
+// new alerts to a Prometheus Alertmanager.
+type AlertMethod struct {
+	alertsURL    string
+	statusURL    string
+	labels       map[string]string
+	resolveAfter time.Duration
+	generatorURL string
+	username     string
+	password     string
+	userAgent    string
+	client       *http.Client
+
+	// now returns the current time. It is replaced in tests
+	now func() time.Time
+}
+
+// postableAlert is an alert as accepted by the Alertmanager API.
+type postableAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     string            `json:"startsAt"`
+	EndsAt       string            `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+func init() {
+	alert.Register("alertmanager", newFromConfig)
+	alert.RegisterConfig("alertmanager", AlertMethodConfig{})
+}
+
+// newFromConfig decodes the output configuration and creates
+// a new *AlertMethod.
+func newFromConfig(raw map[string]interface{}, opts *alert.FactoryOptions) (alert.Method, error) {
+	config := new(AlertMethodConfig)
+	if err := mapstructure.Decode(raw, config); err != nil {
+		return nil, xerrors.Errorf("error decoding Alertmanager output configuration: %v", err)
+	}
+	if config.Client == nil && opts != nil {
+		config.Client = opts.Client
+	}
+	return NewAlertMethod(config)
+}
+
+// NewAlertMethod creates a new *AlertMethod or a
+// non-nil error if there was an error.
+func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
+	if config == nil {
+		return nil, xerrors.New("no config provided")
+	}
+	if config.URL == "" {
+		return nil, xerrors.New("field 'output.config.url' must not be empty when using the Alertmanager output method")
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, xerrors.Errorf("field 'output.config.url' must be an absolute http(s) URL (got %q)", config.URL)
+	}
+	base := strings.TrimSuffix(u.String(), "/")
+
+	for name := range config.Labels {
+		if !labelName.MatchString(name) {
+			return nil, xerrors.Errorf("field 'output.config.labels' contains invalid label name %q", name)
+		}
+	}
+
+	resolveAfter := defaultResolveAfter
+	if config.ResolveAfter != "" {
+		if resolveAfter, err = time.ParseDuration(config.ResolveAfter); err != nil {
+			return nil, xerrors.Errorf("error parsing field 'output.config.resolve_after': %v", err)
+		}
+		if resolveAfter <= 0 {
+			return nil, xerrors.New("field 'output.config.resolve_after' must be positive")
+		}
+	}
+
+	if config.Client == nil {
+		config.Client = cleanhttp.DefaultClient()
+	}
+
+	tlsConfig := &tlsutil.Config{
+		CACert:             config.CACert,
+		ClientCert:         config.ClientCert,
+		ClientKey:          config.ClientKey,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if !tlsConfig.Empty() {
+		client, err := tlsutil.NewClient(config.Client, tlsConfig)
+		if err != nil {
+			return nil, xerrors.Errorf("error configuring TLS: %v", err)
+		}
+		config.Client = client
+	}
+	config.UserAgent = version.UserAgentWith(config.UserAgent)
+
+	return &AlertMethod{
+		alertsURL:    base + alertsPath,
+		statusURL:    base + statusPath,
+		labels:       config.Labels,
+		resolveAfter: resolveAfter,
+		generatorURL: config.GeneratorURL,
+		username:     config.Username,
+		password:     config.Password,
+		userAgent:    config.UserAgent,
+		client:       config.Client,
+		now:          time.Now,
+	}, nil
+}
+
+// Name returns the type of this output method.
+func (a *AlertMethod) Name() string {
+	return "alertmanager"
+}
+
+// Check requests the status of Alertmanager in order to verify
+// that it is reachable.
+func (a *AlertMethod) Check(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, a.statusURL, nil)
+	if err != nil {
+		return xerrors.Errorf("error creating HTTP request: %v", err)
+	}
+	resp, err := a.do(ctx, req)
+	if err != nil {
+		return xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return xerrors.Errorf("received unexpected status code: %s", resp.Status)
+	}
+	return nil
+}
+
+// Write sends an Alertmanager alert per field of each record, or a
+// single alert for a record without fields, in one request. Every
+// alert ends a.resolveAfter from now, so Alertmanager resolves the
+// alerts which are not sent again by the next firing of the rule.
+func (a *AlertMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
+	if records == nil || len(records) < 1 {
+		return nil
+	}
+
+	body, err := json.Marshal(a.buildAlerts(rule, alert.AlertIDFromContext(ctx), records))
+	if err != nil {
+		return xerrors.Errorf("error JSON-encoding alerts: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.alertsURL, bytes.NewReader(body))
+	if err != nil {
+		return xerrors.Errorf("error creating HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.do(ctx, req)
+	if err != nil {
+		return xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		if msg := strings.TrimSpace(string(data)); msg != "" {
+			return xerrors.Errorf("received unsuccessful status code: %s: %s", resp.Status, msg)
+		}
+		return xerrors.Errorf("received unsuccessful status code: %s", resp.Status)
+	}
+	return nil
+}
+
+// buildAlerts creates the Alertmanager alerts of the records. Each
+// alert is labeled with the rule ('alertname'), the filter of the
+// record ('filter') and, if it is the alert of a field, the key of
+// the field ('key'), in addition to a.labels, so that Alertmanager
+// can tell apart and group the alerts of each entity. The count of
+// each field, the text of each record and the alert ID, if there is
+// one, are included as annotations.
+func (a *AlertMethod) buildAlerts(rule, alertID string, records []*alert.Record) []postableAlert {
+	now := a.now().UTC()
+	startsAt := now.Format(time.RFC3339)
+	endsAt := now.Add(a.resolveAfter).Format(time.RFC3339)
+
+	newAlert := func(record *alert.Record) postableAlert {
+		labels := make(map[string]string, len(a.labels)+3)
+		for k, v := range a.labels {
+			labels[k] = v
+		}
+		labels["alertname"] = rule
+		labels["filter"] = record.Filter
+
+		annotations := make(map[string]string)
+		if alertID != "" {
+			annotations["alert_id"] = alertID
+		}
+		if record.Text != "" {
+			annotations["description"] = record.Text
+		}
+		return postableAlert{
+			Labels:       labels,
+			Annotations:  annotations,
+			StartsAt:     startsAt,
+			EndsAt:       endsAt,
+			GeneratorURL: a.generatorURL,
+		}
+	}
+
+	var alerts []postableAlert
+	for _, record := range records {
+		if len(record.Fields) == 0 {
+			alerts = append(alerts, newAlert(record))
+			continue
+		}
+		for _, f := range record.Fields {
+			pa := newAlert(record)
+			pa.Labels["key"] = f.Key
+			pa.Annotations["count"] = strconv.Itoa(f.Count)
+			if f.Value != "" {
+				pa.Annotations["value"] = f.Value
+			}
+			alerts = append(alerts, pa)
+		}
+	}
+	return alerts
+}
+
+// do sets the User-Agent header and any credentials on the request
+// and sends it.
+func (a *AlertMethod) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if a.userAgent != "" {
+		req.Header.Set("User-Agent", a.userAgent)
+	}
+	if a.username != "" {
+		req.SetBasicAuth(a.username, a.password)
+	}
+	return a.client.Do(req.WithContext(ctx))
+}
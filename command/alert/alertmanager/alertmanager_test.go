@@ -0,0 +1,291 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alertmanager
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestNewAlertMethod(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *AlertMethodConfig
+		err    bool
+	}{
+		{
+			"success",
+			&AlertMethodConfig{
+				URL:          "http://alertmanager:9093/",
+				Labels:       map[string]string{"severity": "page"},
+				ResolveAfter: "1h",
+			},
+			false,
+		},
+		{
+			"nil-config",
+			nil,
+			true,
+		},
+		{
+			"no-url",
+			&AlertMethodConfig{},
+			true,
+		},
+		{
+			"relative-url",
+			&AlertMethodConfig{URL: "alertmanager:9093"},
+			true,
+		},
+		{
+			"invalid-label-name",
+			&AlertMethodConfig{
+				URL:    "http://alertmanager:9093",
+				Labels: map[string]string{"team-name": "ops"},
+			},
+			true,
+		},
+		{
+			"bad-resolve-after",
+			&AlertMethodConfig{
+				URL:          "http://alertmanager:9093",
+				ResolveAfter: "soon",
+			},
+			true,
+		},
+		{
+			"negative-resolve-after",
+			&AlertMethodConfig{
+				URL:          "http://alertmanager:9093",
+				ResolveAfter: "-5m",
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAlertMethod(tc.config)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			am, ok := a.(*AlertMethod)
+			if !ok {
+				t.Fatal("expected type *AlertMethod")
+			}
+			if am.alertsURL != "http://alertmanager:9093/api/v2/alerts" {
+				t.Fatalf("got unexpected alerts URL %q", am.alertsURL)
+			}
+			if am.resolveAfter != time.Hour {
+				t.Fatalf("got unexpected resolve_after %s", am.resolveAfter)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var (
+		received []postableAlert
+		username string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != alertsPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		username, _, _ = r.BasicAuth()
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}))
+	defer ts.Close()
+
+	a, err := NewAlertMethod(&AlertMethodConfig{
+		URL:          ts.URL,
+		Labels:       map[string]string{"severity": "page"},
+		ResolveAfter: "10m",
+		GeneratorURL: "https://kibana.example.com",
+		Username:     "user",
+		Password:     "pass",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.(*AlertMethod).now = func() time.Time { return now }
+
+	ctx := alert.WithAlertID(context.Background(), "abc")
+	err = a.Write(ctx, "Test Rule", []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{{Key: "web-1", Count: 3}, {Key: "web-2", Count: 1}},
+		},
+		{
+			Filter:    "hits.hits._source",
+			Text:      `{"message": "error"}`,
+			BodyField: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newAlert := func(labels, annotations map[string]string) postableAlert {
+		return postableAlert{
+			Labels:       labels,
+			Annotations:  annotations,
+			StartsAt:     "2019-03-01T12:00:00Z",
+			EndsAt:       "2019-03-01T12:10:00Z",
+			GeneratorURL: "https://kibana.example.com",
+		}
+	}
+	expected := []postableAlert{
+		newAlert(
+			map[string]string{
+				"alertname": "Test Rule",
+				"filter":    "aggregations.hostname.buckets",
+				"key":       "web-1",
+				"severity":  "page",
+			},
+			map[string]string{"alert_id": "abc", "count": "3"},
+		),
+		newAlert(
+			map[string]string{
+				"alertname": "Test Rule",
+				"filter":    "aggregations.hostname.buckets",
+				"key":       "web-2",
+				"severity":  "page",
+			},
+			map[string]string{"alert_id": "abc", "count": "1"},
+		),
+		newAlert(
+			map[string]string{
+				"alertname": "Test Rule",
+				"filter":    "hits.hits._source",
+				"severity":  "page",
+			},
+			map[string]string{"alert_id": "abc", "description": `{"message": "error"}`},
+		),
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("unexpected alerts:\nGot:\n\t%+v\nExpected:\n\t%+v", received, expected)
+	}
+	if username != "user" {
+		t.Fatalf("expected the request to be authenticated as %q (got %q)", "user", username)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("start must be before end")) // nolint: errcheck
+	}))
+	defer ts.Close()
+
+	a, err := NewAlertMethod(&AlertMethodConfig{URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Write(context.Background(), "Test Rule", []*alert.Record{{Filter: "hits.hits._source"}})
+	if err == nil || !strings.Contains(err.Error(), "400 Bad Request: start must be before end") {
+		t.Fatalf("expected an error including the response body, got: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != statusPath {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	a, err := NewAlertMethod(&AlertMethodConfig{URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = alert.Check(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err = NewAlertMethod(&AlertMethodConfig{URL: ts.URL + "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = alert.Check(context.Background(), a); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+}
+
+func TestWriteCustomCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(``)) // nolint: errcheck
+	}))
+	defer ts.Close()
+
+	caFile, err := ioutil.TempFile("", "alertmanager-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	if err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	caFile.Close()
+
+	records := []*alert.Record{
+		{Filter: "aggregations.hosts.buckets", Fields: []*alert.Field{{Key: "foo", Count: 1}}},
+	}
+
+	untrusted, err := NewAlertMethod(&AlertMethodConfig{URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = untrusted.Write(context.Background(), "Test Rule", records); err == nil {
+		t.Fatal("expected an error writing to a host signed by an unknown CA")
+	}
+
+	trusted, err := NewAlertMethod(&AlertMethodConfig{URL: ts.URL, CACert: caFile.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = trusted.Write(context.Background(), "Test Rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewAlertMethod(&AlertMethodConfig{URL: ts.URL, ClientCert: caFile.Name()}); err == nil {
+		t.Fatal("expected an error configuring a client certificate without a key")
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import "context"
+
+// Checker is implemented by a Method which can verify that its
+// output is reachable without sending an alert, e.g. so that a
+// misconfigured output can be reported at startup.
+type Checker interface {
+	// Check makes a lightweight connection to the output and
+	// returns a non-nil error if it could not be reached
+	Check(context.Context) error
+}
+
+// Check invokes the Check method of method if it implements
+// Checker. It returns nil if method is disabled or if it does
+// not implement Checker.
+func Check(ctx context.Context, method Method) error {
+	if !Enabled(method) {
+		return nil
+	}
+	c, ok := method.(Checker)
+	if !ok {
+		return nil
+	}
+	return c.Check(ctx)
+}
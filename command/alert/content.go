@@ -0,0 +1,37 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+// ContentFilter is implemented by a Method which may leave out some
+// of the records it is given, e.g. those with no fields once fields
+// with a count of zero are hidden, so that alerts of which nothing
+// would be left are not sent with it at all.
+type ContentFilter interface {
+	// HasContent returns whether any of the records would be sent
+	HasContent(records []*Record) bool
+}
+
+// HasContent returns false if method implements ContentFilter and
+// would leave out every one of the records. Otherwise, it returns
+// whether there are any records.
+func HasContent(method Method, records []*Record) bool {
+	if len(records) == 0 {
+		return false
+	}
+	f, ok := method.(ContentFilter)
+	if !ok {
+		return true
+	}
+	return f.HasContent(records)
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import "context"
+
+// disabledMethod is an output which was disabled in the rule
+// configuration file. The Handler skips disabled outputs.
+type disabledMethod struct {
+	Method
+}
+
+// Disable returns a Method which the Handler will skip rather
+// than write alerts to.
+func Disable(method Method) Method {
+	return &disabledMethod{Method: method}
+}
+
+// Write discards the records.
+func (d *disabledMethod) Write(context.Context, string, []*Record) error {
+	return nil
+}
+
+// Enabled returns false if method was disabled with Disable.
+func Enabled(method Method) bool {
+	_, disabled := method.(*disabledMethod)
+	return !disabled
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+// base64LineLength is the length of the lines of base64-encoded
+// attachments, per RFC 2045.
+const base64LineLength = 76
+
+// unsafeFilenameChars matches the characters of a rule name which
+// are replaced in the name of its CSV attachment.
+var unsafeFilenameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// fieldsCSV renders the fields of the records as CSV with a row per
+// field and the columns Filter, Key and Count, plus Value if any
+// field has a value (see alert.Field.Value). Values beginning with a
+// character which spreadsheets treat as the start of a formula are
+// prefixed with a single quote so that they are shown as text.
+func fieldsCSV(records []*alert.Record) ([]byte, error) {
+	var values bool
+	for _, record := range records {
+		for _, f := range record.Fields {
+			values = values || f.Value != ""
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.UseCRLF = true
+
+	header := []string{"Filter", "Key", "Count"}
+	if values {
+		header = append(header, "Value")
+	}
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		for _, f := range record.Fields {
+			row := []string{csvText(record.Filter), csvText(f.Key), strconv.Itoa(f.Count)}
+			if values {
+				row = append(row, csvText(f.Value))
+			}
+			if err := w.Write(row); err != nil {
+				return nil, err
+			}
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// csvText returns s prefixed with a single quote if it would be
+// interpreted as a formula when the CSV is opened in a spreadsheet.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// csvFilename returns the name of the CSV attachment of the alerts
+// of the rule, e.g. "filebeat-errors.csv".
+func csvFilename(rule string) string {
+	name := strings.Trim(unsafeFilenameChars.ReplaceAllString(strings.ToLower(rule), "-"), "-")
+	if name == "" {
+		name = "alert"
+	}
+	return name + ".csv"
+}
+
+// multipartMessage creates a multipart/mixed email message made of
+// the HTML body followed by the CSV attachment.
+func multipartMessage(rule, html string, attachment []byte) (string, error) {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("text/html", map[string]string{"charset": "utf-8"})},
+	})
+	if err != nil {
+		return "", xerrors.Errorf("error creating HTML part: %v", err)
+	}
+	if _, err = part.Write([]byte(html)); err != nil {
+		return "", xerrors.Errorf("error writing HTML part: %v", err)
+	}
+
+	filename := csvFilename(rule)
+	part, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("text/csv", map[string]string{
+			"charset": "utf-8",
+			"name":    filename,
+		})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return "", xerrors.Errorf("error creating CSV part: %v", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(attachment)
+	for len(encoded) > 0 {
+		n := base64LineLength
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		if _, err = part.Write([]byte(encoded[:n] + "\r\n")); err != nil {
+			return "", xerrors.Errorf("error writing CSV part: %v", err)
+		}
+		encoded = encoded[n:]
+	}
+	if err = w.Close(); err != nil {
+		return "", xerrors.Errorf("error closing multipart message: %v", err)
+	}
+
+	headers := "MIME-Version: 1.0\r\n" +
+		"Content-Type: " + mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()}) + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", "Go Elasticsearch Alerts: "+rule) + "\r\n\r\n"
+	return headers + body.String(), nil
+}
@@ -16,14 +16,18 @@ package email
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"html/template"
+	"net"
 	"net/smtp"
-	"os"
 	"strings"
+	"time"
 
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/mitchellh/mapstructure"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
 	"golang.org/x/xerrors"
 )
 
@@ -48,6 +52,19 @@ type AlertMethodConfig struct {
 	To       []string `mapstructure:"to"`
 	Username string   `mapstructure:"username"`
 	Password string   `mapstructure:"password"`
+
+	// IncludeQuery is whether the body of the Elasticsearch query
+	// which produced the alert is appended to the message. The
+	// values of any fields of the query named in RedactQuery are
+	// replaced with "[REDACTED]"
+	IncludeQuery bool     `mapstructure:"include_query"`
+	RedactQuery  []string `mapstructure:"redact_query"`
+
+	// AttachCSV is whether the fields of the records are attached
+	// to the message as a CSV file. InlineTable is whether they are
+	// also shown as a table in the message itself. If nil, they are
+	AttachCSV   bool  `mapstructure:"attach_csv"`
+	InlineTable *bool `mapstructure:"inline_table"`
 }
 
 // AlertMethod implements the alert.Method interface
@@ -58,6 +75,27 @@ type AlertMethod struct {
 	from string
 	auth smtp.Auth
 	to   []string
+
+	includeQuery bool
+	redactQuery  []string
+
+	attachCSV bool
+	noTable   bool
+}
+
+func init() {
+	alert.Register("email", newFromConfig)
+	alert.RegisterConfig("email", AlertMethodConfig{})
+}
+
+// newFromConfig decodes the output configuration and creates
+// a new *AlertMethod.
+func newFromConfig(raw map[string]interface{}, opts *alert.FactoryOptions) (alert.Method, error) {
+	config := new(AlertMethodConfig)
+	if err := mapstructure.Decode(raw, config); err != nil {
+		return nil, xerrors.Errorf("error decoding email output configuration: %v", err)
+	}
+	return NewAlertMethod(config)
 }
 
 // NewAlertMethod creates a new *AlertMethod or a
@@ -71,11 +109,19 @@ func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
 		return nil, err
 	}
 
-	if u := os.Getenv(EnvEmailAuthUsername); u != "" {
+	u, err := utils.Getenv(EnvEmailAuthUsername)
+	if err != nil {
+		return nil, err
+	}
+	if u != "" {
 		config.Username = u
 	}
 
-	if p := os.Getenv(EnvEmailAuthPassword); p != "" {
+	p, err := utils.Getenv(EnvEmailAuthPassword)
+	if err != nil {
+		return nil, err
+	}
+	if p != "" {
 		config.Password = p
 	}
 
@@ -90,6 +136,12 @@ func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
 		from: config.From,
 		to:   config.To,
 		auth: auth,
+
+		includeQuery: config.IncludeQuery,
+		redactQuery:  config.RedactQuery,
+
+		attachCSV: config.AttachCSV,
+		noTable:   config.InlineTable != nil && !*config.InlineTable,
 	}, nil
 }
 
@@ -113,12 +165,65 @@ func validateConfig(config *AlertMethodConfig) error {
 	return allErrors.ErrorOrNil()
 }
 
+// Name returns the type of this output method.
+func (e *AlertMethod) Name() string {
+	return "email"
+}
+
+// IncludedQuery returns the query with the fields of redact_query
+// redacted if include_query is set, or nil otherwise.
+func (e *AlertMethod) IncludedQuery(query map[string]interface{}) map[string]interface{} {
+	if !e.includeQuery {
+		return nil
+	}
+	return alert.RedactQuery(query, e.redactQuery)
+}
+
+// Check connects to the SMTP server and performs the same
+// handshake as Write (including STARTTLS and authentication, if
+// supported by the server) without sending a message.
+func (e *AlertMethod) Check(ctx context.Context) error {
+	addr := fmt.Sprintf("%s:%d", e.host, e.port)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return xerrors.Errorf("error connecting to SMTP server: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline) // nolint: errcheck
+	}
+
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return xerrors.Errorf("error creating SMTP client: %v", err)
+	}
+	defer c.Close()
+
+	if err = c.Hello("localhost"); err != nil {
+		return xerrors.Errorf("error greeting SMTP server: %v", err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: e.host}); err != nil { // nolint: gosec
+			return xerrors.Errorf("error starting TLS: %v", err)
+		}
+	}
+	if e.auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err = c.Auth(e.auth); err != nil {
+				return xerrors.Errorf("error authenticating to SMTP server: %v", err)
+			}
+		}
+	}
+	return c.Quit()
+}
+
 // Write creates an email message from the records and sends
 // it to the email address(es) specified at the creation of the
 // AlertMethod. If there was an error sending the email,
 // it returns a non-nil error.
 func (e *AlertMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
-	body, err := e.buildMessage(rule, records)
+	body, err := e.buildMessage(ctx, rule, records)
 	if err != nil {
 		return xerrors.Errorf("error creating email message: %v", err)
 	}
@@ -126,14 +231,40 @@ func (e *AlertMethod) Write(ctx context.Context, rule string, records []*alert.R
 }
 
 // buildMessage creates an email message from the provided
-// records. It will return a non-nil error if an error occurs.
-func (e *AlertMethod) buildMessage(rule string, records []*alert.Record) (string, error) { // nolint: funlen
+// records. If ctx carries an alert ID or a fire count, they are
+// shown above the records. If e.includeQuery is true, the query carried by ctx
+// is shown below them. If e.attachCSV is true, the message is a
+// multipart message with the fields of the records attached as a
+// CSV file (see fieldsCSV). It will return a non-nil error if an
+// error occurs.
+func (e *AlertMethod) buildMessage(ctx context.Context, rule string, records []*alert.Record) (string, error) { // nolint: funlen
+	var query string
+	if e.includeQuery {
+		var err error
+		if query, err = alert.RenderQuery(alert.QueryFromContext(ctx), e.redactQuery); err != nil {
+			return "", xerrors.Errorf("error rendering query: %v", err)
+		}
+	}
+
+	fireCount, since := alert.FireCountFromContext(ctx)
 	alert := struct {
-		Name    string
-		Records []*alert.Record
+		Name      string
+		AlertID   string
+		FireCount int
+		Since     string
+		Records   []*alert.Record
+		Query     string
+		Headers   bool
+		Table     bool
 	}{
 		rule,
+		alert.AlertIDFromContext(ctx),
+		fireCount,
+		since.UTC().Format(time.RFC822),
 		records,
+		query,
+		!e.attachCSV,
+		!e.noTable,
 	}
 
 	funcs := template.FuncMap{
@@ -143,10 +274,10 @@ func (e *AlertMethod) buildMessage(rule string, records []*alert.Record) (string
 		},
 	}
 
-	tpl := `Content-Type: text/html
+	tpl := `{{ if .Headers }}Content-Type: text/html
 Subject: Go Elasticsearch Alerts: {{ .Name }}
 
-<!DOCTYPE html>
+{{ end }}<!DOCTYPE html>
 <html>
 <head>
 <style>
@@ -167,7 +298,9 @@ tr:nth-child(even) {
 </style>
 </head>
 <body>
-{{ range .Records }}<h4>Filter path: {{ .Filter }}</h4>{{ if .Fields }}
+{{ if .AlertID }}<p>Alert ID: {{ .AlertID }}</p>
+{{ end }}{{ if gt .FireCount 1 }}<p>Fired {{ .FireCount }} times since {{ .Since }}</p>
+{{ end }}{{ range .Records }}<h4>Filter path: {{ .Filter }}</h4>{{ if and .Fields $.Table }}
 <table>
   <tr>
     <th>Key</th>
@@ -175,12 +308,14 @@ tr:nth-child(even) {
   </tr>{{ range .Fields }}
   <tr>
     <td>{{ .Key }}</td>
-    <td>{{ .Count }}</td>
+    <td>{{ .Display }}</td>
   </tr>{{ end }}
 </table>{{ end }}
 {{ tabsAndLines .Text }}
 <br>{{ end }}
-</body>
+{{ if .Query }}<h4>Query</h4>
+<pre>{{ .Query }}</pre>
+{{ end }}</body>
 </html>`
 	t, err := template.New("email").Funcs(funcs).Parse(tpl)
 	if err != nil {
@@ -192,5 +327,13 @@ tr:nth-child(even) {
 	if err != nil {
 		return "", xerrors.Errorf("error executing email template: %v", err)
 	}
-	return buf.String(), nil
+	if !e.attachCSV {
+		return buf.String(), nil
+	}
+
+	attachment, err := fieldsCSV(records)
+	if err != nil {
+		return "", xerrors.Errorf("error creating CSV attachment: %v", err)
+	}
+	return multipartMessage(rule, buf.String(), attachment)
 }
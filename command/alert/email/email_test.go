@@ -14,9 +14,21 @@
 package email
 
 import (
+	"bufio"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
 )
@@ -218,7 +230,7 @@ tr:nth-child(even) {
 </html>`
 
 	eh := &AlertMethod{}
-	msg, err := eh.buildMessage("Test Error", records)
+	msg, err := eh.buildMessage(context.Background(), "Test Error", records)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -227,6 +239,203 @@ tr:nth-child(even) {
 	}
 }
 
+func TestBuildMessageQuery(t *testing.T) {
+	records := []*alert.Record{{Filter: "hits.hits._source", Text: "test"}}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"password": "secret", "host": "<db-1>"},
+		},
+	}
+	ctx := alert.WithQuery(context.Background(), query)
+
+	cases := []struct {
+		name     string
+		include  bool
+		redact   []string
+		contains []string
+		excludes []string
+	}{
+		{
+			"disabled",
+			false,
+			nil,
+			nil,
+			[]string{"<h4>Query</h4>", "secret"},
+		},
+		{
+			"enabled",
+			true,
+			nil,
+			[]string{"<h4>Query</h4>", "&#34;password&#34;: &#34;secret&#34;", "&lt;db-1&gt;"},
+			nil,
+		},
+		{
+			"redacted",
+			true,
+			[]string{"password"},
+			[]string{"<h4>Query</h4>", "&#34;password&#34;: &#34;[REDACTED]&#34;"},
+			[]string{"secret"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			e := &AlertMethod{includeQuery: tc.include, redactQuery: tc.redact}
+			msg, err := e.buildMessage(ctx, "Test Rule", records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.contains {
+				if !strings.Contains(msg, s) {
+					t.Fatalf("message does not contain %q:\n%s", s, msg)
+				}
+			}
+			for _, s := range tc.excludes {
+				if strings.Contains(msg, s) {
+					t.Fatalf("message should not contain %q:\n%s", s, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildMessageCSV(t *testing.T) {
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{
+				{Key: "foo", Count: 10},
+				{Key: "bar, baz", Count: 8},
+			},
+		},
+		{
+			Filter: "aggregations.message.buckets",
+			Fields: []*alert.Field{
+				{Key: `disk "sda" full`, Count: 3},
+				{Key: "=HYPERLINK(\"http://example.com\")", Count: 1},
+			},
+		},
+		{
+			Filter: "hits.hits._source",
+			Text:   "test",
+		},
+	}
+	expectedCSV := "Filter,Key,Count\r\n" +
+		"aggregations.hostname.buckets,foo,10\r\n" +
+		"aggregations.hostname.buckets,\"bar, baz\",8\r\n" +
+		"aggregations.message.buckets,\"disk \"\"sda\"\" full\",3\r\n" +
+		"aggregations.message.buckets,\"'=HYPERLINK(\"\"http://example.com\"\")\",1\r\n"
+
+	cases := []struct {
+		name  string
+		table bool
+	}{
+		{"inline-table", true},
+		{"no-inline-table", false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			e := &AlertMethod{attachCSV: true, noTable: !tc.table}
+			raw, err := e.buildMessage(context.Background(), "Test Rule: Disk", records)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := mail.ReadMessage(strings.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := msg.Header.Get("MIME-Version"); v != "1.0" {
+				t.Fatalf("unexpected MIME-Version (got %q, expected %q)", v, "1.0")
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != "Go Elasticsearch Alerts: Test Rule: Disk" {
+				t.Fatalf("unexpected subject %q", subject)
+			}
+			mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mediaType != "multipart/mixed" {
+				t.Fatalf("unexpected Content-Type (got %q, expected %q)", mediaType, "multipart/mixed")
+			}
+
+			mr := multipart.NewReader(msg.Body, params["boundary"])
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct := part.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+				t.Fatalf("unexpected Content-Type of HTML part %q", ct)
+			}
+			html, err := ioutil.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(html), "<table>") != tc.table {
+				t.Fatalf("unexpected inline table (expected table: %t):\n%s", tc.table, html)
+			}
+			if !strings.Contains(string(html), "<h4>Filter path: hits.hits._source</h4>") {
+				t.Fatalf("HTML part does not contain the records:\n%s", html)
+			}
+
+			part, err = mr.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers := map[string]string{
+				"Content-Type":              "text/csv; charset=utf-8; name=test-rule-disk.csv",
+				"Content-Disposition":       "attachment; filename=test-rule-disk.csv",
+				"Content-Transfer-Encoding": "base64",
+			}
+			for k, v := range headers {
+				if got := part.Header.Get(k); got != v {
+					t.Errorf("unexpected %s header of CSV part (got %q, expected %q)", k, got, v)
+				}
+			}
+			data, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != expectedCSV {
+				t.Fatalf("unexpected CSV:\ngot:\n%s\nexpected:\n%s", data, expectedCSV)
+			}
+
+			if _, err = mr.NextPart(); err != io.EOF {
+				t.Fatalf("expected no more parts (got error %v)", err)
+			}
+		})
+	}
+}
+
+func TestFieldsCSVValues(t *testing.T) {
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{
+				{Key: "foo", Count: 10, Value: "12.5 ms"},
+				{Key: "bar", Count: 8},
+			},
+		},
+	}
+	data, err := fieldsCSV(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Filter,Key,Count,Value\r\n" +
+		"aggregations.hostname.buckets,foo,10,12.5 ms\r\n" +
+		"aggregations.hostname.buckets,bar,8,\r\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected CSV:\ngot:\n%s\nexpected:\n%s", data, expected)
+	}
+}
+
 func ExampleAlertMethod_buildMessage() {
 	records := []*alert.Record{
 		{
@@ -273,7 +482,7 @@ func ExampleAlertMethod_buildMessage() {
 
 	em := &AlertMethod{}
 
-	msg, _ := em.buildMessage("Test Rule", records)
+	msg, _ := em.buildMessage(context.Background(), "Test Rule", records)
 
 	fmt.Println(msg)
 
@@ -348,3 +557,85 @@ func ExampleAlertMethod_buildMessage() {
 	// </body>
 	// </html>
 }
+
+func TestCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	commands := make(chan []string, 1)
+	go serveSMTP(ln, commands)
+
+	host, portRaw, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &AlertMethodConfig{
+		Host: host,
+		Port: port,
+		From: "test@gmail.com",
+		To:   []string{"test_recipient_1@gmail.com"},
+	}
+	e, err := NewAlertMethod(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = e.(alert.Checker).Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(<-commands, ",")
+	if got != "EHLO localhost,QUIT" {
+		t.Fatalf("unexpected SMTP commands (got %q, expected %q)", got, "EHLO localhost,QUIT")
+	}
+
+	ln.Close()
+	if err = e.(alert.Checker).Check(ctx); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+}
+
+// serveSMTP accepts a single connection and responds to it as a
+// minimal SMTP server, then sends the commands it received on
+// commands.
+func serveSMTP(ln net.Listener, commands chan<- []string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var received []string
+	defer func() { commands <- received }()
+
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		received = append(received, line)
+		switch {
+		case strings.HasPrefix(line, "EHLO"):
+			fmt.Fprint(conn, "250-localhost\r\n250 HELP\r\n")
+		case line == "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "502 not implemented\r\n")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultErrorOutputInterval = 15 * time.Minute
+
+	// errorOutputTimeout bounds how long sending an error alert
+	// may take, since it does not wait for the failed rule
+	errorOutputTimeout = 30 * time.Second
+
+	// ErrorFilter is the filter of the records describing the
+	// failures which are sent to an ErrorOutput
+	ErrorFilter = "error"
+
+	// ErrorSourceQuery is the source of the failures of the query
+	// of a rule reported to an ErrorOutput. The failures of the
+	// outputs of a rule are reported with the name of the output
+	// as their source
+	ErrorSourceQuery = "query"
+)
+
+// ErrorOutputConfig is used to create a new *ErrorOutput.
+type ErrorOutputConfig struct {
+	// Method is the output to which the failures are sent
+	Method Method
+
+	// Interval is the minimum time between two alerts about the
+	// failures of the same source of a rule. If zero, a default of
+	// 15 minutes will be used
+	Interval time.Duration
+
+	Logger hclog.Logger
+
+	// Clock is the source of the current time. If nil, the system
+	// clock will be used
+	Clock clock.Clock
+}
+
+// ErrorOutput sends alerts about the failures of the rules
+// themselves, such as a query which could not be executed or an
+// output which could not send an alert, to an output of their own
+// so that they are not only logged. The alerts about each source of
+// failure of a rule are rate limited (see Report).
+type ErrorOutput struct {
+	method   Method
+	interval time.Duration
+	logger   hclog.Logger
+	clock    clock.Clock
+
+	mu      sync.Mutex
+	reports map[string]*errorReport
+}
+
+// errorReport is the last alert about the failures of a source of
+// a rule.
+type errorReport struct {
+	sent       time.Time
+	suppressed int
+}
+
+// NewErrorOutput creates a new *ErrorOutput instance.
+func NewErrorOutput(config *ErrorOutputConfig) (*ErrorOutput, error) {
+	if config.Method == nil {
+		return nil, xerrors.New("no error output method provided")
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultErrorOutputInterval
+	}
+	if config.Logger == nil {
+		config.Logger = hclog.Default()
+	}
+	if config.Clock == nil {
+		config.Clock = clock.Real()
+	}
+	return &ErrorOutput{
+		method:   config.Method,
+		interval: config.Interval,
+		logger:   config.Logger,
+		clock:    config.Clock,
+		reports:  make(map[string]*errorReport),
+	}, nil
+}
+
+// Method returns the output to which the failures are sent.
+func (e *ErrorOutput) Method() Method {
+	return e.method
+}
+
+// Report sends an alert describing the failure of the given source
+// (ErrorSourceQuery or the name of an output) of the rule in the
+// background, unless one was sent for the same source less than the
+// interval ago, in which case the failure is only counted and
+// included in the next alert. It does nothing if e is nil.
+func (e *ErrorOutput) Report(rule, source string, err error) {
+	if e == nil {
+		return
+	}
+	now := e.clock.Now()
+	key := rule + "|" + source
+
+	e.mu.Lock()
+	report, ok := e.reports[key]
+	if ok && now.Sub(report.sent) < e.interval {
+		report.suppressed++
+		e.mu.Unlock()
+		return
+	}
+	var suppressed int
+	if ok {
+		suppressed = report.suppressed
+	}
+	e.reports[key] = &errorReport{sent: now}
+	e.mu.Unlock()
+
+	records := []*Record{{
+		Filter: ErrorFilter,
+		Text:   errorText(rule, source, err, now, suppressed),
+	}}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), errorOutputTimeout)
+		defer cancel()
+		if werr := e.method.Write(ctx, rule, records); werr != nil {
+			e.logger.Error(fmt.Sprintf("error sending failure of rule %q to error output", rule),
+				"method", e.method.Name(), "source", source, "error", werr)
+		}
+	}()
+}
+
+// errorText describes the failure of the source of the rule.
+func errorText(rule, source string, err error, at time.Time, suppressed int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rule: %s\nSource: %s\nTime: %s\nError: %v", rule, source, at.UTC().Format(time.RFC3339), err)
+	if suppressed > 0 {
+		fmt.Fprintf(&b, "\n(%d more failures since the previous alert)", suppressed)
+	}
+	return b.String()
+}
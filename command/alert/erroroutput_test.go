@@ -0,0 +1,139 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"golang.org/x/xerrors"
+)
+
+// recordsMethod sends the records of each of its writes on a
+// channel.
+type recordsMethod struct {
+	writes chan []*Record
+}
+
+func (m *recordsMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	m.writes <- records
+	return nil
+}
+
+func (m *recordsMethod) Name() string {
+	return "records"
+}
+
+func TestErrorOutputReport(t *testing.T) {
+	clk := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	m := &recordsMethod{writes: make(chan []*Record, 8)}
+	e, err := NewErrorOutput(&ErrorOutputConfig{
+		Method:   m,
+		Interval: 10 * time.Minute,
+		Logger:   hclog.NewNullLogger(),
+		Clock:    clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(expected string) {
+		t.Helper()
+		select {
+		case records := <-m.writes:
+			if len(records) != 1 || records[0].Filter != ErrorFilter {
+				t.Fatalf("unexpected records: %+v", records)
+			}
+			if !strings.Contains(records[0].Text, expected) {
+				t.Fatalf("Expected error alert to contain:\n\t%s\nGot:\n\t%s", expected, records[0].Text)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the error alert")
+		}
+	}
+	none := func() {
+		t.Helper()
+		select {
+		case records := <-m.writes:
+			t.Fatalf("unexpected error alert: %s", records[0].Text)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	queryErr := xerrors.New("connection refused")
+	e.Report("test-rule", ErrorSourceQuery, queryErr)
+	receive("Rule: test-rule\nSource: query\nTime: 2019-01-01T00:00:00Z\nError: connection refused")
+
+	// Further failures within the interval are only counted
+	clk.Advance(time.Minute)
+	e.Report("test-rule", ErrorSourceQuery, queryErr)
+	e.Report("test-rule", ErrorSourceQuery, queryErr)
+	none()
+
+	// Other sources and rules are rate limited separately
+	e.Report("test-rule", "slack", xerrors.New("webhook returned 500"))
+	receive("Source: slack")
+	e.Report("other-rule", ErrorSourceQuery, queryErr)
+	receive("Rule: other-rule")
+
+	clk.Advance(10 * time.Minute)
+	e.Report("test-rule", ErrorSourceQuery, queryErr)
+	receive("(2 more failures since the previous alert)")
+
+	// A nil *ErrorOutput reports nothing
+	var disabled *ErrorOutput
+	disabled.Report("test-rule", ErrorSourceQuery, queryErr)
+
+	if _, err = NewErrorOutput(&ErrorOutputConfig{}); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+}
+
+func TestSendErrorOutput(t *testing.T) {
+	m := &recordsMethod{writes: make(chan []*Record, 8)}
+	e, err := NewErrorOutput(&ErrorOutputConfig{
+		Method: m,
+		Logger: hclog.NewNullLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(&HandlerConfig{
+		Logger:      hclog.NewNullLogger(),
+		ErrorOutput: e,
+	})
+
+	// The failure is reported once the output failed every attempt
+	if err = handler.Send(context.Background(), &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		Records:  []*Record{{Filter: "hits.hits._source", Text: "test"}},
+		Methods:  []Method{&errorAlertMethod{}},
+	}); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+
+	select {
+	case records := <-m.writes:
+		if expected := "Source: error\n"; !strings.Contains(records[0].Text, expected) {
+			t.Fatalf("Expected error alert to contain:\n\t%s\nGot:\n\t%s", expected, records[0].Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error alert")
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package eventbridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/mitchellh/mapstructure"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// maxEntrySize is the maximum size of a PutEvents request,
+	// and hence of any one event, as calculated by EventBridge
+	maxEntrySize = 256 * 1024
+
+	// maxBatchEntries is the maximum number of events in a
+	// single PutEvents request
+	maxBatchEntries = 10
+)
+
+// Ensure AlertMethod adheres to the alert.Method interface.
+var _ alert.Method = (*AlertMethod)(nil)
+
+// AlertMethodConfig configures to which EventBridge event bus
+// alerts will be sent and how the events are labeled.
+type AlertMethodConfig struct {
+	// Region is the AWS region of the event bus. If empty, the
+	// region is resolved from the environment or the shared AWS
+	// configuration file
+	Region string `mapstructure:"region"`
+
+	// EventBusName is the name or ARN of the event bus. If empty,
+	// the default event bus of the account is used
+	EventBusName string `mapstructure:"event_bus_name"`
+
+	// Source is the 'source' field of the events
+	Source string `mapstructure:"source"`
+
+	// DetailType is the 'detail-type' field of the events
+	DetailType string `mapstructure:"detail_type"`
+}
+
+// AlertMethod implements the alert.Method interface for
+// sending new alerts to an Amazon EventBridge event bus.
+type AlertMethod struct {
+	client       eventbridgeiface.EventBridgeAPI
+	eventBusName string
+	source       string
+	detailType   string
+}
+
+func init() {
+	alert.Register("eventbridge", newFromConfig)
+	alert.RegisterConfig("eventbridge", AlertMethodConfig{})
+}
+
+// newFromConfig decodes the output configuration and creates
+// a new *AlertMethod.
+func newFromConfig(raw map[string]interface{}, opts *alert.FactoryOptions) (alert.Method, error) {
+	config := new(AlertMethodConfig)
+	if err := mapstructure.Decode(raw, config); err != nil {
+		return nil, xerrors.Errorf("error decoding EventBridge output configuration: %v", err)
+	}
+	return NewAlertMethod(config)
+}
+
+// NewAlertMethod creates a new *AlertMethod or a non-nil error
+// if there was an error. AWS credentials and, unless set in the
+// config, the region are resolved in the standard way (e.g. from
+// the environment or the shared AWS configuration files).
+func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
+	if config == nil {
+		return nil, xerrors.New("no config provided")
+	}
+	if config.Source == "" {
+		return nil, xerrors.New("field 'output.config.source' must not be empty when using the EventBridge output method")
+	}
+	if config.DetailType == "" {
+		return nil, xerrors.New("field 'output.config.detail_type' must not be empty when using the EventBridge output method")
+	}
+
+	awsConfig := aws.Config{}
+	if config.Region != "" {
+		awsConfig.Region = aws.String(config.Region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error creating new EventBridge alert method: %w", err)
+	}
+	return &AlertMethod{
+		client:       eventbridge.New(sess),
+		eventBusName: config.EventBusName,
+		source:       config.Source,
+		detailType:   config.DetailType,
+	}, nil
+}
+
+// Name returns the type of this output method.
+func (a *AlertMethod) Name() string {
+	return "eventbridge"
+}
+
+// Check verifies that the event bus exists and can be described
+// with the configured AWS credentials.
+func (a *AlertMethod) Check(ctx context.Context) error {
+	input := &eventbridge.DescribeEventBusInput{}
+	if a.eventBusName != "" {
+		input.Name = aws.String(a.eventBusName)
+	}
+	if _, err := a.client.DescribeEventBusWithContext(ctx, input); err != nil {
+		return xerrors.Errorf("error describing EventBridge event bus: %w", err)
+	}
+	return nil
+}
+
+// Write sends the records to the event bus. The 'detail' of each
+// event is a JSON object with the fields "rule", "records" and,
+// if ctx carries an alert ID, "alert_id".
+// The records are split across as many events as necessary to
+// keep each event under the EventBridge size limit, and the events
+// are sent in batches of at most ten. If any record cannot fit in
+// an event, or if EventBridge rejects any of the events, the
+// remaining events are still sent and a non-nil error describing
+// each failure is returned. The events accepted by EventBridge are
+// recorded in the Progress of ctx so that a retry of the alert only
+// sends the events which were not.
+func (a *AlertMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
+	if records == nil || len(records) < 1 {
+		return nil
+	}
+
+	entries, allErrors := a.buildEntries(rule, alert.AlertIDFromContext(ctx), records)
+
+	// The events of an alert are the same on every attempt to send
+	// it, so they are identified by position
+	progress := alert.ProgressFromContext(ctx)
+	keys := make(map[*eventbridge.PutEventsRequestEntry]string, len(entries))
+	pending := make([]*eventbridge.PutEventsRequestEntry, 0, len(entries))
+	for i, entry := range entries {
+		key := fmt.Sprintf("event %d", i)
+		if progress.Sent(key) {
+			continue
+		}
+		keys[entry] = key
+		pending = append(pending, entry)
+	}
+
+	for _, batch := range batchEntries(pending) {
+		accepted, err := a.put(ctx, batch)
+		for _, entry := range accepted {
+			progress.SetSent(keys[entry])
+		}
+		if err != nil {
+			allErrors = multierror.Append(allErrors, err)
+		}
+	}
+	return allErrors.ErrorOrNil()
+}
+
+// put sends a single batch of events and returns those which were
+// accepted by EventBridge. Events rejected by EventBridge are
+// reported in the returned error. If it does not say which events
+// were rejected, none of them are considered accepted.
+func (a *AlertMethod) put(
+	ctx context.Context,
+	batch []*eventbridge.PutEventsRequestEntry,
+) ([]*eventbridge.PutEventsRequestEntry, error) {
+	resp, err := a.client.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{
+		Entries: batch,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error sending %d event(s) to EventBridge: %w", len(batch), err)
+	}
+	if aws.Int64Value(resp.FailedEntryCount) < 1 {
+		return batch, nil
+	}
+
+	var (
+		allErrors *multierror.Error
+		accepted  []*eventbridge.PutEventsRequestEntry
+	)
+	for i, entry := range resp.Entries {
+		if aws.StringValue(entry.ErrorCode) == "" {
+			if i < len(batch) {
+				accepted = append(accepted, batch[i])
+			}
+			continue
+		}
+		allErrors = multierror.Append(allErrors, xerrors.Errorf("event %d of %d was rejected by EventBridge (%s): %s",
+			i+1, len(batch), aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage)))
+	}
+	if allErrors == nil {
+		return nil, xerrors.Errorf("%d of %d event(s) were rejected by EventBridge",
+			aws.Int64Value(resp.FailedEntryCount), len(batch))
+	}
+	return accepted, allErrors
+}
+
+// buildEntries groups the records into as few events as possible
+// without exceeding maxEntrySize. If alertID is not empty, it is
+// included in each event. Records which are too large to fit in an
+// event on their own are omitted and reported in the returned error.
+func (a *AlertMethod) buildEntries(
+	rule string,
+	alertID string,
+	records []*alert.Record,
+) ([]*eventbridge.PutEventsRequestEntry, *multierror.Error) {
+	// JSON-encoding a string cannot fail
+	ruleJSON, _ := json.Marshal(rule) // nolint: errcheck
+	prefix := `{"rule":` + string(ruleJSON) + `,`
+	if alertID != "" {
+		idJSON, _ := json.Marshal(alertID) // nolint: errcheck
+		prefix += `"alert_id":` + string(idJSON) + `,`
+	}
+	prefix += `"records":[`
+	const suffix = `]}`
+	overhead := len(a.source) + len(a.detailType) + len(prefix) + len(suffix)
+
+	var (
+		allErrors *multierror.Error
+		entries   []*eventbridge.PutEventsRequestEntry
+		current   []string
+		size      = overhead
+	)
+	flush := func() {
+		if len(current) < 1 {
+			return
+		}
+		var detail bytes.Buffer
+		detail.WriteString(prefix)
+		for i, r := range current {
+			if i > 0 {
+				detail.WriteString(",")
+			}
+			detail.WriteString(r)
+		}
+		detail.WriteString(suffix)
+		entries = append(entries, a.newEntry(detail.String()))
+		current = nil
+		size = overhead
+	}
+
+	for i, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			allErrors = multierror.Append(allErrors, xerrors.Errorf("error JSON-encoding record %d: %v", i+1, err))
+			continue
+		}
+		if overhead+len(data) > maxEntrySize {
+			allErrors = multierror.Append(allErrors, xerrors.Errorf("record %d (filter: %q) is too large to send to EventBridge (%d bytes)",
+				i+1, record.Filter, len(data)))
+			continue
+		}
+
+		n := len(data)
+		if len(current) > 0 {
+			n++ // The separating comma
+		}
+		if size+n > maxEntrySize {
+			flush()
+			n = len(data)
+		}
+		current = append(current, string(data))
+		size += n
+	}
+	flush()
+	return entries, allErrors
+}
+
+func (a *AlertMethod) newEntry(detail string) *eventbridge.PutEventsRequestEntry {
+	entry := &eventbridge.PutEventsRequestEntry{
+		Source:     aws.String(a.source),
+		DetailType: aws.String(a.detailType),
+		Detail:     aws.String(detail),
+	}
+	if a.eventBusName != "" {
+		entry.EventBusName = aws.String(a.eventBusName)
+	}
+	return entry
+}
+
+// batchEntries splits the events into batches which respect both
+// the maximum number of events and the maximum total size of a
+// PutEvents request.
+func batchEntries(entries []*eventbridge.PutEventsRequestEntry) [][]*eventbridge.PutEventsRequestEntry {
+	var (
+		batches [][]*eventbridge.PutEventsRequestEntry
+		current []*eventbridge.PutEventsRequestEntry
+		size    int
+	)
+	for _, entry := range entries {
+		n := entrySize(entry)
+		if len(current) > 0 && (len(current) == maxBatchEntries || size+n > maxEntrySize) {
+			batches = append(batches, current)
+			current, size = nil, 0
+		}
+		current = append(current, entry)
+		size += n
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// entrySize calculates the size of an event the way EventBridge
+// does when enforcing its limits.
+func entrySize(entry *eventbridge.PutEventsRequestEntry) int {
+	return len(aws.StringValue(entry.Source)) +
+		len(aws.StringValue(entry.DetailType)) +
+		len(aws.StringValue(entry.Detail))
+}
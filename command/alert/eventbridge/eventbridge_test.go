@@ -0,0 +1,273 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package eventbridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+// mockClient records the PutEvents requests it receives and
+// rejects the events at the indices in failed, and every event of
+// the requests at the indices in failedInputs.
+type mockClient struct {
+	eventbridgeiface.EventBridgeAPI
+	inputs       []*eventbridge.PutEventsInput
+	failed       map[int]bool
+	failedInputs map[int]bool
+}
+
+func (m *mockClient) PutEventsWithContext(
+	ctx aws.Context,
+	input *eventbridge.PutEventsInput,
+	opts ...request.Option,
+) (*eventbridge.PutEventsOutput, error) {
+	failInput := m.failedInputs[len(m.inputs)]
+	m.inputs = append(m.inputs, input)
+	out := &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}
+	for i := range input.Entries {
+		entry := &eventbridge.PutEventsResultEntry{EventId: aws.String("id")}
+		if m.failed[i] || failInput {
+			entry = &eventbridge.PutEventsResultEntry{
+				ErrorCode:    aws.String("InternalFailure"),
+				ErrorMessage: aws.String("test error"),
+			}
+			*out.FailedEntryCount++
+		}
+		out.Entries = append(out.Entries, entry)
+	}
+	return out, nil
+}
+
+func newTestMethod(client eventbridgeiface.EventBridgeAPI) *AlertMethod {
+	return &AlertMethod{
+		client:       client,
+		eventBusName: "alerts",
+		source:       "go-elasticsearch-alerts",
+		detailType:   "Alert",
+	}
+}
+
+func TestNewAlertMethod(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *AlertMethodConfig
+		err    bool
+	}{
+		{
+			"success",
+			&AlertMethodConfig{
+				Region:       "us-east-1",
+				EventBusName: "alerts",
+				Source:       "go-elasticsearch-alerts",
+				DetailType:   "Alert",
+			},
+			false,
+		},
+		{
+			"nil-config",
+			nil,
+			true,
+		},
+		{
+			"no-source",
+			&AlertMethodConfig{
+				DetailType: "Alert",
+			},
+			true,
+		},
+		{
+			"no-detail-type",
+			&AlertMethodConfig{
+				Source: "go-elasticsearch-alerts",
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAlertMethod(tc.config)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	client := &mockClient{}
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{{Key: "foo", Count: 2}},
+		},
+		{
+			Filter:    "hits.hits._source",
+			Text:      "{\n    \"ayy\": \"lmao\"\n}",
+			BodyField: true,
+		},
+	}
+
+	if err := newTestMethod(client).Write(context.Background(), "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.inputs) != 1 || len(client.inputs[0].Entries) != 1 {
+		t.Fatalf("expected a single event to be sent, got %+v", client.inputs)
+	}
+	entry := client.inputs[0].Entries[0]
+	if aws.StringValue(entry.EventBusName) != "alerts" ||
+		aws.StringValue(entry.Source) != "go-elasticsearch-alerts" ||
+		aws.StringValue(entry.DetailType) != "Alert" {
+		t.Fatalf("unexpected event: %+v", entry)
+	}
+
+	var detail struct {
+		Rule    string          `json:"rule"`
+		Records []*alert.Record `json:"records"`
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(entry.Detail)), &detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Rule != "test-rule" {
+		t.Fatalf("unexpected rule name (got %q, expected %q)", detail.Rule, "test-rule")
+	}
+	if len(detail.Records) != 2 || detail.Records[1].Text != records[1].Text {
+		t.Fatalf("unexpected records: %+v", detail.Records)
+	}
+}
+
+func TestWriteSplit(t *testing.T) {
+	client := &mockClient{}
+	text := strings.Repeat("a", 100*1024)
+	records := make([]*alert.Record, 0, 5)
+	for i := 0; i < 5; i++ {
+		records = append(records, &alert.Record{Filter: "hits.hits._source", Text: text})
+	}
+
+	if err := newTestMethod(client).Write(context.Background(), "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two records fit in an event and one event fits in a request
+	var events int
+	for _, input := range client.inputs {
+		if len(input.Entries) != 1 {
+			t.Fatalf("expected one event per request, got %d", len(input.Entries))
+		}
+		if n := entrySize(input.Entries[0]); n > maxEntrySize {
+			t.Fatalf("event exceeds the maximum size (%d bytes)", n)
+		}
+		events++
+	}
+	if events != 3 {
+		t.Fatalf("unexpected number of events (got %d, expected %d)", events, 3)
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	client := &mockClient{}
+	records := []*alert.Record{
+		{Filter: "hits.hits._source", Text: strings.Repeat("a", maxEntrySize)},
+		{Filter: "aggregations.hostname.buckets", Fields: []*alert.Field{{Key: "foo", Count: 2}}},
+	}
+
+	err := newTestMethod(client).Write(context.Background(), "test-rule", records)
+	if err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.inputs) != 1 || !strings.Contains(aws.StringValue(client.inputs[0].Entries[0].Detail), "hostname") {
+		t.Fatalf("expected the remaining record to be sent, got %+v", client.inputs)
+	}
+}
+
+func TestWritePartialFailure(t *testing.T) {
+	client := &mockClient{failed: map[int]bool{0: true}}
+	records := []*alert.Record{{Filter: "hits.hits._source", Text: "test"}}
+
+	err := newTestMethod(client).Write(context.Background(), "test-rule", records)
+	if err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if !strings.Contains(err.Error(), "InternalFailure") {
+		t.Fatalf("expected the error to include the error code, got: %v", err)
+	}
+}
+
+func TestWritePartialFailureResume(t *testing.T) {
+	// Each record needs an event, and each event a request, of its
+	// own. The event of the second request is rejected
+	client := &mockClient{failedInputs: map[int]bool{1: true}}
+	records := make([]*alert.Record, 0, 3)
+	for i := 0; i < 3; i++ {
+		text := fmt.Sprintf("%d%s", i, strings.Repeat("a", 200*1024))
+		records = append(records, &alert.Record{Filter: "hits.hits._source", Text: text})
+	}
+
+	ctx := alert.WithProgress(context.Background(), new(alert.Progress))
+	m := newTestMethod(client)
+	if err := m.Write(ctx, "test-rule", records); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if len(client.inputs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(client.inputs))
+	}
+
+	client.failedInputs = nil
+	if err := m.Write(ctx, "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.inputs) != 4 || len(client.inputs[3].Entries) != 1 {
+		t.Fatalf("expected the retry to send a single event, got %d requests", len(client.inputs)-3)
+	}
+	retried := aws.StringValue(client.inputs[3].Entries[0].Detail)
+	if retried != aws.StringValue(client.inputs[1].Entries[0].Detail) {
+		t.Fatal("expected the retry to only send the rejected event")
+	}
+}
+
+func TestBatchEntries(t *testing.T) {
+	m := newTestMethod(nil)
+	entries := make([]*eventbridge.PutEventsRequestEntry, 0, 25)
+	for i := 0; i < 25; i++ {
+		entries = append(entries, m.newEntry(`{"rule":"test-rule","records":[]}`))
+	}
+
+	batches := batchEntries(entries)
+	if len(batches) != 3 {
+		t.Fatalf("unexpected number of batches (got %d, expected %d)", len(batches), 3)
+	}
+	for i, expected := range []int{10, 10, 5} {
+		if len(batches[i]) != expected {
+			t.Fatalf("unexpected size of batch %d (got %d, expected %d)", i, len(batches[i]), expected)
+		}
+	}
+}
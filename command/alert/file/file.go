@@ -14,36 +14,90 @@
 package file
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
 	"time"
 
 	multierror "github.com/hashicorp/go-multierror"
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/mitchellh/mapstructure"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
 	"golang.org/x/xerrors"
 )
 
+// Accepted values of the 'format' option
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
 // Ensure AlertMethod adheres to the alert.Method interface.
 var _ alert.Method = (*AlertMethod)(nil)
 
+// fileLocks serializes writes to the same file by the outputs of
+// different rules, which run concurrently.
+var fileLocks sync.Map
+
 type outputJSON struct {
 	RuleName   string          `json:"rule_name"`
+	AlertID    string          `json:"alert_id,omitempty"`
+	FireCount  int             `json:"fire_count,omitempty"`
+	FirstFired *time.Time      `json:"first_fired,omitempty"`
 	ReceivedAt time.Time       `json:"received_at"`
 	Records    []*alert.Record `json:"results"`
 }
 
+// ndjsonEntry is a single line of a file written in the
+// "ndjson" format.
+type ndjsonEntry struct {
+	Rule       string          `json:"rule"`
+	AlertID    string          `json:"alert_id,omitempty"`
+	FireCount  int             `json:"fire_count,omitempty"`
+	FirstFired *time.Time      `json:"first_fired,omitempty"`
+	Timestamp  time.Time       `json:"timestamp"`
+	Records    []*alert.Record `json:"records"`
+}
+
 // AlertMethodConfig configures to what file alerts will be written.
 type AlertMethodConfig struct {
-	// OutputFilepath is the file where logs will be written
+	// OutputFilepath is the file where logs will be written. It
+	// may be a template (e.g. "/var/alerts/{{.Rule}}/{{.Date}}.log")
+	// executed each time an alert is written, in which case the
+	// directories of the file are created as needed
 	OutputFilepath string `mapstructure:"file"`
+
+	// Format is either "json" (the default) or "ndjson", which
+	// writes each alert as a single line with the fields "rule",
+	// "timestamp" and "records" for ingestion by e.g. Filebeat
+	Format string `mapstructure:"format"`
 }
 
 // AlertMethod implements the alert.AlertMethod interface
 // for writing new alerts to a file.
 type AlertMethod struct {
 	outputFilepath string
+	pathTemplate   *template.Template
+	format         string
+}
+
+func init() {
+	alert.Register("file", newFromConfig)
+	alert.RegisterConfig("file", AlertMethodConfig{})
+}
+
+// newFromConfig decodes the output configuration and creates
+// a new *AlertMethod.
+func newFromConfig(raw map[string]interface{}, opts *alert.FactoryOptions) (alert.Method, error) {
+	config := new(AlertMethodConfig)
+	if err := mapstructure.Decode(raw, config); err != nil {
+		return nil, xerrors.Errorf("error decoding file output configuration: %v", err)
+	}
+	return NewAlertMethod(config)
 }
 
 // NewAlertMethod returns a new *AlertMethod or a non-nil
@@ -58,8 +112,20 @@ func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
 		return nil, xerrors.Errorf("error expanding file path %q: %v", config.OutputFilepath, err)
 	}
 
+	tmpl, err := parsePathTemplate(expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	format := config.Format
+	if format == "" {
+		format = formatJSON
+	}
+
 	return &AlertMethod{
 		outputFilepath: expanded,
+		pathTemplate:   tmpl,
+		format:         format,
 	}, nil
 }
 
@@ -67,27 +133,108 @@ func validateConfig(config *AlertMethodConfig) error {
 	var allErrors *multierror.Error
 	if config == nil {
 		allErrors = multierror.Append(xerrors.New("no config provided"))
-	} else if config.OutputFilepath == "" {
-		allErrors = multierror.Append(xerrors.New("no file path provided"))
+	} else {
+		if config.OutputFilepath == "" {
+			allErrors = multierror.Append(allErrors, xerrors.New("no file path provided"))
+		}
+		switch config.Format {
+		case "", formatJSON, formatNDJSON:
+		default:
+			allErrors = multierror.Append(allErrors, xerrors.Errorf("field 'output.config.format' must either be '%s' or '%s'",
+				formatJSON, formatNDJSON))
+		}
 	}
 	return allErrors.ErrorOrNil()
 }
 
-// Write creates JSON-formatted logs from the records and writes
-// them to the file specified at the creation of the AlertMethod.
-// If there was an error writing logs to disk, it returns a
-// non-nil error.
-func (f *AlertMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
+// Name returns the type of this output method.
+func (f *AlertMethod) Name() string {
+	return "file"
+}
+
+// Check verifies that the file can be opened for writing,
+// creating it if it does not exist. If the file path is a
+// template, it only verifies that the directory under which every
+// file will be written exists or can be created.
+func (f *AlertMethod) Check(ctx context.Context) error {
+	if f.pathTemplate != nil {
+		if err := os.MkdirAll(staticDir(f.outputFilepath), 0o700); err != nil {
+			return xerrors.Errorf("error creating directory: %v", err)
+		}
+		return nil
+	}
 	outfile, err := os.OpenFile(f.outputFilepath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
 	if err != nil {
-		return xerrors.Errorf("error opening new file: %v", err)
+		return xerrors.Errorf("error opening file: %v", err)
 	}
-	defer outfile.Close()
+	return outfile.Close()
+}
 
-	entry := outputJSON{
+// Write creates JSON-formatted logs from the records and writes
+// them to the file specified at the creation of the AlertMethod,
+// or to the one its template produces for the rule and the
+// current time.
+// Each alert is written to the file in a single write so that it
+// ends up on its own line even if other rules write to the same
+// file. If there was an error writing logs to disk, it returns a
+// non-nil error.
+func (f *AlertMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
+	alertID := alert.AlertIDFromContext(ctx)
+	fireCount, since := alert.FireCountFromContext(ctx)
+	var firstFired *time.Time
+	if fireCount > 0 {
+		firstFired = &since
+	}
+	var entry interface{} = &outputJSON{
 		RuleName:   rule,
+		AlertID:    alertID,
+		FireCount:  fireCount,
+		FirstFired: firstFired,
 		ReceivedAt: time.Now(),
 		Records:    records,
 	}
-	return json.NewEncoder(outfile).Encode(&entry)
+	if f.format == formatNDJSON {
+		entry = &ndjsonEntry{
+			Rule:       rule,
+			AlertID:    alertID,
+			FireCount:  fireCount,
+			FirstFired: firstFired,
+			Timestamp:  time.Now().UTC(),
+			Records:    records,
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(entry); err != nil {
+		return xerrors.Errorf("error JSON-encoding alert: %v", err)
+	}
+
+	path := f.outputFilepath
+	if f.pathTemplate != nil {
+		var err error
+		if path, err = executePath(f.pathTemplate, rule, time.Now()); err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return xerrors.Errorf("error creating directory: %v", err)
+		}
+	}
+
+	mu, _ := fileLocks.LoadOrStore(path, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	outfile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return xerrors.Errorf("error opening new file: %v", err)
+	}
+
+	if _, err = outfile.Write(buf.Bytes()); err != nil {
+		outfile.Close()
+		return xerrors.Errorf("error writing to file: %v", err)
+	}
+	if err = outfile.Close(); err != nil {
+		return xerrors.Errorf("error closing file: %v", err)
+	}
+	return nil
 }
@@ -17,10 +17,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
 )
@@ -29,21 +33,55 @@ func TestNewAlertMethod(t *testing.T) {
 	cases := []struct {
 		name     string
 		filename string
+		format   string
 		err      bool
 	}{
 		{
 			"success",
 			"testdata/test.log",
+			"",
+			false,
+		},
+		{
+			"ndjson",
+			"testdata/test.log",
+			"ndjson",
 			false,
 		},
 		{
 			"no-file",
 			"",
+			"",
 			true,
 		},
 		{
 			"homedir-error",
 			"~testdata",
+			"",
+			true,
+		},
+		{
+			"bad-format",
+			"testdata/test.log",
+			"yaml",
+			true,
+		},
+		{
+			"template",
+			"testdata/{{.Rule}}/{{.Date}}-{{.Time.Format \"15\"}}.log",
+			"",
+			false,
+		},
+		{
+			"bad-template",
+			"testdata/{{.Rule",
+			"",
+			true,
+		},
+		{
+			"unknown-template-field",
+			"testdata/{{.Host}}.log",
+			"",
 			true,
 		},
 	}
@@ -53,6 +91,7 @@ func TestNewAlertMethod(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			a, err := NewAlertMethod(&AlertMethodConfig{
 				OutputFilepath: tc.filename,
+				Format:         tc.format,
 			})
 			if tc.err {
 				if err == nil {
@@ -137,6 +176,77 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteNDJSON(t *testing.T) {
+	filename := filepath.Join("testdata", "test.ndjson")
+	defer os.Remove(filename)
+
+	// Two rules writing to the same file
+	var methods []alert.Method
+	for i := 0; i < 2; i++ {
+		f, err := NewAlertMethod(&AlertMethodConfig{
+			OutputFilepath: filename,
+			Format:         "ndjson",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		methods = append(methods, f)
+	}
+
+	records := []*alert.Record{
+		{
+			Filter: "hits.hits._source",
+			Text:   "{\n    \"ayy\": \"lmao\"\n}",
+		},
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{{Key: "foo", Count: 2}},
+		},
+	}
+
+	const writes = 50
+	var wg sync.WaitGroup
+	errCh := make(chan error, writes)
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errCh <- methods[i%2].Write(context.Background(), fmt.Sprintf("rule-%d", i%2), records)
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != writes {
+		t.Fatalf("unexpected number of lines (got %d, expected %d)", len(lines), writes)
+	}
+	for i, line := range lines {
+		var entry ndjsonEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", i+1, err)
+		}
+		if entry.Rule != "rule-0" && entry.Rule != "rule-1" {
+			t.Fatalf("unexpected rule on line %d: %q", i+1, entry.Rule)
+		}
+		if entry.Timestamp.IsZero() {
+			t.Fatalf("line %d has no timestamp", i+1)
+		}
+		if !reflect.DeepEqual(entry.Records, records) {
+			t.Fatalf("unexpected records on line %d (got %+v, expected %+v)", i+1, entry.Records, records)
+		}
+	}
+}
+
 func ExampleAlertMethod_Write() {
 	records := []*alert.Record{
 		{
@@ -172,3 +282,111 @@ func ExampleAlertMethod_Write() {
 		return
 	}
 }
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name     string
+		filename string
+		err      bool
+	}{
+		{
+			"success",
+			filepath.Join("testdata", "check.log"),
+			false,
+		},
+		{
+			"missing-directory",
+			filepath.Join("testdata", "missing", "check.log"),
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			defer os.Remove(tc.filename)
+
+			f, err := NewAlertMethod(&AlertMethodConfig{
+				OutputFilepath: tc.filename,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = f.(alert.Checker).Check(context.Background())
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriteTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := NewAlertMethod(&AlertMethodConfig{
+		OutputFilepath: filepath.Join(dir, "alerts", "{{.Rule}}", "{{.Date}}.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.(*AlertMethod).Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*alert.Record{{Filter: "hits.hits", Text: "error"}}
+	for _, rule := range []string{"Test Rule", "../../escape"} {
+		if err = f.Write(context.Background(), rule, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var written []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			written = append(written, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Now().UTC().Format("2006-01-02")
+	expected := []string{
+		"alerts/Test Rule/" + date + ".log",
+		"alerts/______escape/" + date + ".log",
+	}
+	if !reflect.DeepEqual(written, expected) {
+		t.Fatalf("unexpected files written (got %v, expected %v)", written, expected)
+	}
+}
+
+func TestSanitizePathElement(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"Test Rule", "Test Rule"},
+		{"errors/prod", "errors_prod"},
+		{"..", "__"},
+		{"../../etc", "______etc"},
+		{"a\\b", "a_b"},
+		{"v1.2", "v1.2"},
+		{".", "_"},
+		{"", "_"},
+	}
+
+	for _, tc := range cases {
+		if got := sanitizePathElement(tc.name); got != tc.expected {
+			t.Errorf("sanitizePathElement(%q) = %q, expected %q", tc.name, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package file
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// templateDelim starts an action of a file path template.
+const templateDelim = "{{"
+
+// pathData is the data with which the file path template is
+// executed.
+type pathData struct {
+	// Rule is the name of the rule, sanitized so that it is a
+	// single path element
+	Rule string
+
+	// Date is the date of the alert in UTC, e.g. "2006-01-02"
+	Date string
+
+	// Time is the time of the alert in UTC, which may be formatted
+	// as needed, e.g. {{ .Time.Format "15" }} for the hour
+	Time time.Time
+}
+
+// parsePathTemplate parses the file path as a template if it has any
+// actions. It is executed with sample data so that references to
+// unknown fields are reported now rather than when an alert is
+// written.
+func parsePathTemplate(path string) (*template.Template, error) {
+	if !strings.Contains(path, templateDelim) {
+		return nil, nil
+	}
+	tmpl, err := template.New("file").Parse(path)
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing field 'output.config.file' as a template: %v", err)
+	}
+	if _, err = executePath(tmpl, "rule", time.Now()); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// executePath returns the path of the file to which the alert of the
+// rule at the given time is written.
+func executePath(tmpl *template.Template, rule string, at time.Time) (string, error) {
+	at = at.UTC()
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, &pathData{
+		Rule: sanitizePathElement(rule),
+		Date: at.Format("2006-01-02"),
+		Time: at,
+	})
+	if err != nil {
+		return "", xerrors.Errorf("error executing template of field 'output.config.file': %v", err)
+	}
+	if buf.Len() == 0 {
+		return "", xerrors.New("template of field 'output.config.file' produced an empty path")
+	}
+	return filepath.Clean(buf.String()), nil
+}
+
+// sanitizePathElement replaces the path separators and ".." of the
+// name so that it stays a single element of the path it is
+// substituted into, e.g. "../etc" becomes "__etc".
+func sanitizePathElement(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Replace(name, "..", "__", -1)
+	if name == "" || name == "." {
+		return "_"
+	}
+	return name
+}
+
+// staticDir returns the directory of the part of the file path
+// template before its first action, which every path it produces
+// is under.
+func staticDir(path string) string {
+	prefix := path[:strings.Index(path, templateDelim)]
+	if strings.HasSuffix(prefix, string(os.PathSeparator)) || strings.HasSuffix(prefix, "/") {
+		return filepath.Clean(prefix)
+	}
+	return filepath.Dir(prefix)
+}
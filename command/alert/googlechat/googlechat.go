@@ -0,0 +1,470 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package googlechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/mitchellh/mapstructure"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/tlsutil"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// maxMessageSize is the maximum size of a Google Chat message
+	maxMessageSize = 32000
+
+	// maxWidgets is the maximum number of widgets in the card of
+	// a single message
+	maxWidgets = 100
+
+	// textChunkSize is the maximum number of bytes of the text of
+	// a record shown in a single widget. Escaping may grow the
+	// text up to five-fold, so a chunk always fits in a message
+	textChunkSize = 4096
+
+	// pageOverhead is the space reserved in each message for the
+	// note of which page of the alert it is
+	pageOverhead = 32
+
+	// maxErrorBody is the number of bytes of the body of an
+	// unsuccessful response included in the error
+	maxErrorBody = 512
+
+	// maxResponseBody is the number of bytes of a response read
+	// when checking it for an error
+	maxResponseBody = 64 * 1024
+
+	// noMatchingBuckets is shown in place of the fields of a
+	// record which has none
+	noMatchingBuckets = "<i>No matching buckets</i>"
+)
+
+// Ensure AlertMethod adheres to the alert.Method interface.
+var _ alert.Method = (*AlertMethod)(nil)
+
+// AlertMethodConfig configures to which Google Chat space alerts
+// will be posted.
+type AlertMethodConfig struct {
+	// WebhookURL is the URL of the incoming webhook of the space
+	WebhookURL string `mapstructure:"webhook"`
+
+	// Text is any text posted above the card of each message.
+	// This is what notifications show
+	Text string `mapstructure:"text"`
+
+	UserAgent string `mapstructure:"user_agent"`
+
+	// CACert is the path to a PEM-encoded CA certificate file used
+	// to verify the certificate of the webhook host, e.g. if it is
+	// signed by a private CA. ClientCert and ClientKey are the paths
+	// to a PEM-encoded client certificate and private key presented
+	// to hosts which require mutual TLS
+	CACert             string `mapstructure:"ca_cert"`
+	ClientCert         string `mapstructure:"client_cert"`
+	ClientKey          string `mapstructure:"client_key"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+
+	Client *http.Client
+}
+
+// AlertMethod implements the alert.Method interface for posting
+// new alerts to a Google Chat space.
+type AlertMethod struct {
+	webhookURL string
+	text       string
+	userAgent  string
+	client     *http.Client
+}
+
+// message represents the JSON data needed to create a new
+// Google Chat message with a card (per the cards v2 format).
+type message struct {
+	Text    string       `json:"text,omitempty"`
+	CardsV2 []cardWithID `json:"cardsV2"`
+}
+
+type cardWithID struct {
+	CardID string `json:"cardId"`
+	Card   card   `json:"card"`
+}
+
+type card struct {
+	Header   cardHeader `json:"header"`
+	Sections []section  `json:"sections"`
+}
+
+type cardHeader struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle,omitempty"`
+}
+
+type section struct {
+	Header  string   `json:"header,omitempty"`
+	Widgets []widget `json:"widgets"`
+}
+
+type widget struct {
+	DecoratedText *decoratedText `json:"decoratedText,omitempty"`
+	TextParagraph *textParagraph `json:"textParagraph,omitempty"`
+}
+
+type decoratedText struct {
+	TopLabel string `json:"topLabel"`
+	Text     string `json:"text"`
+}
+
+type textParagraph struct {
+	Text string `json:"text"`
+}
+
+// apiError is the error returned by the Google Chat API in the
+// 'error' field of a response.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func (e *apiError) String() string {
+	return fmt.Sprintf("%s (%d): %s", e.Status, e.Code, e.Message)
+}
+
+func init() {
+	alert.Register("googlechat", newFromConfig)
+	alert.RegisterConfig("googlechat", AlertMethodConfig{})
+}
+
+// newFromConfig decodes the output configuration and creates
+// a new *AlertMethod.
+func newFromConfig(raw map[string]interface{}, opts *alert.FactoryOptions) (alert.Method, error) {
+	config := new(AlertMethodConfig)
+	if err := mapstructure.Decode(raw, config); err != nil {
+		return nil, xerrors.Errorf("error decoding Google Chat output configuration: %v", err)
+	}
+	if config.Client == nil && opts != nil {
+		config.Client = opts.Client
+	}
+	return NewAlertMethod(config)
+}
+
+// NewAlertMethod creates a new *AlertMethod or a
+// non-nil error if there was an error.
+func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
+	if config == nil {
+		return nil, xerrors.New("no config provided")
+	}
+	if config.WebhookURL == "" {
+		return nil, xerrors.New("field 'output.config.webhook' must not be empty when using the Google Chat output method")
+	}
+	if config.Client == nil {
+		config.Client = cleanhttp.DefaultClient()
+	}
+
+	tlsConfig := &tlsutil.Config{
+		CACert:             config.CACert,
+		ClientCert:         config.ClientCert,
+		ClientKey:          config.ClientKey,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if !tlsConfig.Empty() {
+		client, err := tlsutil.NewClient(config.Client, tlsConfig)
+		if err != nil {
+			return nil, xerrors.Errorf("error configuring TLS: %v", err)
+		}
+		config.Client = client
+	}
+	config.UserAgent = version.UserAgentWith(config.UserAgent)
+	return &AlertMethod{
+		webhookURL: config.WebhookURL,
+		text:       config.Text,
+		userAgent:  config.UserAgent,
+		client:     config.Client,
+	}, nil
+}
+
+// Name returns the type of this output method.
+func (g *AlertMethod) Name() string {
+	return "googlechat"
+}
+
+// Write posts the records to the webhook defined at the creation
+// of the AlertMethod as a card headed by the rule name with a
+// section per record. The records are split across as many
+// messages as necessary to respect the Google Chat limits on the
+// size and number of widgets of a message, and the messages are
+// posted in order. A record which cannot fit in a message on its
+// own is not sent. If posting a message fails, no further messages
+// are posted and a non-nil error is returned.
+func (g *AlertMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
+	if records == nil || len(records) < 1 {
+		return nil
+	}
+
+	messages, allErrors := g.buildMessages(rule, alert.AlertIDFromContext(ctx), records)
+	for i, msg := range messages {
+		err := ctx.Err()
+		if err == nil {
+			err = g.post(ctx, msg)
+		}
+		if err != nil {
+			if len(messages) > 1 {
+				err = xerrors.Errorf("error posting message %d of %d: %v", i+1, len(messages), err)
+			}
+			return multierror.Append(allErrors, err).ErrorOrNil()
+		}
+	}
+	return allErrors.ErrorOrNil()
+}
+
+// buildMessages groups the sections of the records into as few
+// messages as possible without exceeding maxMessageSize or
+// maxWidgets. If alertID is not empty, it is shown in the header
+// of each card. Sections which are too large to fit in a message
+// on their own are omitted and reported in the returned error.
+func (g *AlertMethod) buildMessages(rule, alertID string, records []*alert.Record) ([]message, *multierror.Error) {
+	header := cardHeader{Title: rule}
+	if alertID != "" {
+		header.Subtitle = "Alert ID: " + alertID
+	}
+	skeleton, err := encode(g.newMessage(header, nil))
+	if err != nil {
+		return nil, multierror.Append(nil, xerrors.Errorf("error JSON-encoding message: %v", err))
+	}
+	overhead := len(skeleton) + pageOverhead
+
+	var (
+		allErrors *multierror.Error
+		pages     [][]section
+		current   []section
+		size      = overhead
+		widgets   int
+	)
+	flush := func() {
+		if len(current) > 0 {
+			pages = append(pages, current)
+		}
+		current, size, widgets = nil, overhead, 0
+	}
+
+	for i, record := range records {
+		for _, s := range buildSections(record) {
+			data, err := encode(s)
+			if err != nil {
+				allErrors = multierror.Append(allErrors, xerrors.Errorf("error JSON-encoding record %d: %v", i+1, err))
+				continue
+			}
+			if overhead+len(data) > maxMessageSize {
+				allErrors = multierror.Append(allErrors, xerrors.Errorf(
+					"record %d (filter: %q) is too large to send to Google Chat (%d bytes)",
+					i+1, record.Filter, len(data)))
+				continue
+			}
+
+			n := len(data)
+			if len(current) > 0 {
+				n++ // The separating comma
+			}
+			if len(current) > 0 && (size+n > maxMessageSize || widgets+len(s.Widgets) > maxWidgets) {
+				flush()
+				n = len(data)
+			}
+			current = append(current, s)
+			size += n
+			widgets += len(s.Widgets)
+		}
+	}
+	flush()
+
+	messages := make([]message, 0, len(pages))
+	for i, sections := range pages {
+		pageHeader := header
+		if len(pages) > 1 {
+			note := fmt.Sprintf("(page %d of %d)", i+1, len(pages))
+			if pageHeader.Subtitle != "" {
+				note = pageHeader.Subtitle + " " + note
+			}
+			pageHeader.Subtitle = note
+		}
+		msg := g.newMessage(pageHeader, sections)
+		msg.CardsV2[0].CardID = fmt.Sprintf("alert-%d", i+1)
+		messages = append(messages, msg)
+	}
+	return messages, allErrors
+}
+
+func (g *AlertMethod) newMessage(header cardHeader, sections []section) message {
+	return message{
+		Text: g.text,
+		CardsV2: []cardWithID{
+			{
+				CardID: "alert",
+				Card: card{
+					Header:   header,
+					Sections: sections,
+				},
+			},
+		},
+	}
+}
+
+// buildSections creates the sections of the card which show the
+// record: a text paragraph per chunk of its text and a decorated
+// text per field, with at most maxWidgets fields per section. The
+// header of each section is the filter of the record, noting which
+// part of the record it is if there are several.
+func buildSections(record *alert.Record) []section {
+	filter := html.EscapeString(record.Filter)
+
+	var sections []section
+	if record.BodyField && record.Text != "" {
+		chunks := splitText(record.Text, textChunkSize)
+		for i, chunk := range chunks {
+			s := section{
+				Header: filter,
+				Widgets: []widget{
+					{TextParagraph: &textParagraph{Text: html.EscapeString(chunk)}},
+				},
+			}
+			if len(chunks) > 1 {
+				s.Header = fmt.Sprintf("%s (%d of %d)", filter, i+1, len(chunks))
+			}
+			sections = append(sections, s)
+		}
+	}
+
+	for start := 0; start < len(record.Fields); start += maxWidgets {
+		end := start + maxWidgets
+		if end > len(record.Fields) {
+			end = len(record.Fields)
+		}
+		s := section{Header: filter}
+		if len(record.Fields) > maxWidgets {
+			s.Header = fmt.Sprintf("%s (fields %d–%d)", filter, start+1, end)
+		}
+		for _, f := range record.Fields[start:end] {
+			s.Widgets = append(s.Widgets, widget{
+				DecoratedText: &decoratedText{
+					TopLabel: html.EscapeString(f.Key),
+					Text:     html.EscapeString(f.Display()),
+				},
+			})
+		}
+		sections = append(sections, s)
+	}
+
+	if len(sections) == 0 {
+		// Every section must have at least one widget
+		sections = append(sections, section{
+			Header: filter,
+			Widgets: []widget{
+				{TextParagraph: &textParagraph{Text: noMatchingBuckets}},
+			},
+		})
+	}
+	return sections
+}
+
+// splitText breaks text into chunks of at most n bytes without
+// splitting any UTF-8 encoded characters.
+func splitText(text string, n int) []string {
+	var chunks []string
+	for len(text) > n {
+		end := n
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		if end == 0 {
+			end = n
+		}
+		chunks = append(chunks, text[:end])
+		text = text[end:]
+	}
+	return append(chunks, text)
+}
+
+// post sends the message to the webhook. Google Chat responds with
+// 200 OK and the created message on success; any other status code,
+// or an 'error' field in the response, is reported as an error.
+func (g *AlertMethod) post(ctx context.Context, msg message) error {
+	body, err := encode(msg)
+	if err != nil {
+		return xerrors.Errorf("error JSON-encoding message: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, g.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return xerrors.Errorf("error creating HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if g.userAgent != "" {
+		req.Header.Set("User-Agent", g.userAgent)
+	}
+
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	var envelope struct {
+		Error *apiError `json:"error"`
+	}
+	// The response is only inspected for an error, so a response
+	// which is not JSON is not itself an error
+	_ = json.Unmarshal(data, &envelope) // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		if envelope.Error != nil {
+			return xerrors.Errorf("received unsuccessful status code: %s: %s", resp.Status, envelope.Error)
+		}
+		if len(data) > maxErrorBody {
+			data = data[:maxErrorBody]
+		}
+		if text := strings.TrimSpace(string(data)); text != "" {
+			return xerrors.Errorf("received unsuccessful status code: %s: %s", resp.Status, text)
+		}
+		return xerrors.Errorf("received unsuccessful status code: %s", resp.Status)
+	}
+	if envelope.Error != nil {
+		return xerrors.Errorf("Google Chat returned an error: %s", envelope.Error)
+	}
+	return nil
+}
+
+// encode JSON-encodes v without escaping HTML characters, since
+// the text of cards is HTML which has already been escaped.
+func encode(v interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,343 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package googlechat
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestNewAlertMethod(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *AlertMethodConfig
+		err    bool
+	}{
+		{
+			"success",
+			&AlertMethodConfig{
+				WebhookURL: "https://chat.googleapis.com/v1/spaces/AAAA/messages?key=k&token=t",
+				Text:       "test",
+			},
+			false,
+		},
+		{
+			"nil-config",
+			nil,
+			true,
+		},
+		{
+			"no-webhook",
+			&AlertMethodConfig{
+				Text: "test",
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAlertMethod(tc.config)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			g, ok := a.(*AlertMethod)
+			if !ok {
+				t.Fatal("expected type *AlertMethod")
+			}
+			if g.webhookURL != tc.config.WebhookURL {
+				t.Fatalf("got unexpected webhook URL (got %q, expected %q)", g.webhookURL, tc.config.WebhookURL)
+			}
+			if g.client == nil {
+				t.Fatal("expected a default HTTP client")
+			}
+		})
+	}
+}
+
+func TestBuildMessages(t *testing.T) {
+	g := &AlertMethod{text: "alert"}
+
+	fields := func(n int) []*alert.Field {
+		f := make([]*alert.Field, 0, n)
+		for i := 0; i < n; i++ {
+			f = append(f, &alert.Field{Key: fmt.Sprintf("key-%d", i), Count: i})
+		}
+		return f
+	}
+
+	t.Run("single-message", func(t *testing.T) {
+		messages, errs := g.buildMessages("Test Rule", "abc", []*alert.Record{
+			{Filter: "aggregations.hosts.buckets", Fields: fields(2)},
+			{Filter: "hits.hits._source", Text: "<error> & more", BodyField: true},
+			{Filter: "aggregations.empty.buckets"},
+		})
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		if len(messages) != 1 {
+			t.Fatalf("expected 1 message, got %d", len(messages))
+		}
+		msg := messages[0]
+		if msg.Text != "alert" {
+			t.Errorf("got unexpected text %q", msg.Text)
+		}
+		header := msg.CardsV2[0].Card.Header
+		if header.Title != "Test Rule" || header.Subtitle != "Alert ID: abc" {
+			t.Errorf("got unexpected header %+v", header)
+		}
+		sections := msg.CardsV2[0].Card.Sections
+		if len(sections) != 3 {
+			t.Fatalf("expected 3 sections, got %d", len(sections))
+		}
+		if got := sections[0].Widgets[1].DecoratedText; got.TopLabel != "key-1" || got.Text != "1" {
+			t.Errorf("got unexpected field widget %+v", got)
+		}
+		if got := sections[1].Widgets[0].TextParagraph.Text; got != "&lt;error&gt; &amp; more" {
+			t.Errorf("text was not escaped: %q", got)
+		}
+		if got := sections[2].Widgets[0].TextParagraph.Text; got != noMatchingBuckets {
+			t.Errorf("got unexpected widget of empty record %q", got)
+		}
+	})
+
+	t.Run("split-widgets", func(t *testing.T) {
+		messages, errs := g.buildMessages("Test Rule", "", []*alert.Record{
+			{Filter: "aggregations.hosts.buckets", Fields: fields(250)},
+		})
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		if len(messages) != 3 {
+			t.Fatalf("expected 3 messages, got %d", len(messages))
+		}
+		for i, msg := range messages {
+			var widgets int
+			for _, s := range msg.CardsV2[0].Card.Sections {
+				widgets += len(s.Widgets)
+			}
+			if widgets > maxWidgets {
+				t.Errorf("message %d has %d widgets", i+1, widgets)
+			}
+			expected := fmt.Sprintf("(page %d of 3)", i+1)
+			if subtitle := msg.CardsV2[0].Card.Header.Subtitle; subtitle != expected {
+				t.Errorf("got subtitle %q, expected %q", subtitle, expected)
+			}
+		}
+		if header := messages[2].CardsV2[0].Card.Sections[0].Header; header != "aggregations.hosts.buckets (fields 201–250)" {
+			t.Errorf("got unexpected section header %q", header)
+		}
+	})
+
+	t.Run("split-size", func(t *testing.T) {
+		text := strings.Repeat("<é>", 20000)
+		messages, errs := g.buildMessages("Test Rule", "", []*alert.Record{
+			{Filter: "hits.hits._source", Text: text, BodyField: true},
+		})
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		if len(messages) < 2 {
+			t.Fatalf("expected the text to be split across messages, got %d", len(messages))
+		}
+		var joined strings.Builder
+		for i, msg := range messages {
+			data, err := encode(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) > maxMessageSize {
+				t.Errorf("message %d is %d bytes", i+1, len(data))
+			}
+			for _, s := range msg.CardsV2[0].Card.Sections {
+				joined.WriteString(s.Widgets[0].TextParagraph.Text)
+			}
+		}
+		if expected := strings.Repeat("&lt;é&gt;", 20000); joined.String() != expected {
+			t.Error("the text of the messages does not add up to the text of the record")
+		}
+	})
+
+	t.Run("too-large", func(t *testing.T) {
+		messages, errs := g.buildMessages("Test Rule", "", []*alert.Record{
+			{
+				Filter: "aggregations.hosts.buckets",
+				Fields: []*alert.Field{{Key: strings.Repeat("a", maxMessageSize), Count: 1}},
+			},
+			{Filter: "aggregations.other.buckets", Fields: fields(1)},
+		})
+		if errs == nil {
+			t.Fatal("expected an error but didn't receive one")
+		}
+		if len(messages) != 1 || len(messages[0].CardsV2[0].Card.Sections) != 1 {
+			t.Fatal("expected the record which fits to still be sent")
+		}
+	})
+}
+
+func TestWrite(t *testing.T) {
+	records := []*alert.Record{
+		{Filter: "aggregations.hosts.buckets", Fields: []*alert.Field{{Key: "foo", Count: 1}}},
+	}
+
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		err    string
+	}{
+		{
+			"success",
+			http.StatusOK,
+			`{"name":"spaces/AAAA/messages/1"}`,
+			"",
+		},
+		{
+			"error-envelope",
+			http.StatusOK,
+			`{"error":{"code":400,"message":"Invalid JSON payload","status":"INVALID_ARGUMENT"}}`,
+			"INVALID_ARGUMENT (400): Invalid JSON payload",
+		},
+		{
+			"unsuccessful-status",
+			http.StatusBadRequest,
+			`{"error":{"code":400,"message":"Message too long","status":"INVALID_ARGUMENT"}}`,
+			"400 Bad Request: INVALID_ARGUMENT (400): Message too long",
+		},
+		{
+			"unsuccessful-status-text",
+			http.StatusServiceUnavailable,
+			"unavailable",
+			"503 Service Unavailable: unavailable",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var received message
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				if err := json.Unmarshal(data, &received); err != nil {
+					t.Error(err)
+				}
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer ts.Close()
+
+			g, err := NewAlertMethod(&AlertMethodConfig{WebhookURL: ts.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = g.Write(context.Background(), "Test Rule", records)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(received.CardsV2) != 1 || received.CardsV2[0].Card.Header.Title != "Test Rule" {
+				t.Fatalf("got unexpected message %+v", received)
+			}
+		})
+	}
+}
+
+func TestWriteCanceled(t *testing.T) {
+	var posted bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = true
+	}))
+	defer ts.Close()
+
+	g, err := NewAlertMethod(&AlertMethodConfig{WebhookURL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = g.Write(ctx, "Test Rule", []*alert.Record{{Filter: "aggregations.hosts.buckets"}})
+	if err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if posted {
+		t.Fatal("no message should be posted once the context is canceled")
+	}
+}
+
+func TestWriteCustomCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"name":"spaces/AAAA/messages/1"}`)) // nolint: errcheck
+	}))
+	defer ts.Close()
+
+	caFile, err := ioutil.TempFile("", "googlechat-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	if err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	caFile.Close()
+
+	records := []*alert.Record{
+		{Filter: "aggregations.hosts.buckets", Fields: []*alert.Field{{Key: "foo", Count: 1}}},
+	}
+
+	untrusted, err := NewAlertMethod(&AlertMethodConfig{WebhookURL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = untrusted.Write(context.Background(), "Test Rule", records); err == nil {
+		t.Fatal("expected an error writing to a host signed by an unknown CA")
+	}
+
+	trusted, err := NewAlertMethod(&AlertMethodConfig{WebhookURL: ts.URL, CACert: caFile.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = trusted.Write(context.Background(), "Test Rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewAlertMethod(&AlertMethodConfig{WebhookURL: ts.URL, ClientCert: caFile.Name()}); err == nil {
+		t.Fatal("expected an error configuring a client certificate without a key")
+	}
+}
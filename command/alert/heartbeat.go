@@ -0,0 +1,162 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultHeartbeatInterval = time.Hour
+
+	// heartbeatTimeout bounds how long checking Elasticsearch and
+	// sending a heartbeat may take
+	heartbeatTimeout = 30 * time.Second
+
+	// HeartbeatRule is the name of the rule of the heartbeats sent
+	// by a Heartbeat. Rules may not have this name (see
+	// config.ParseRules)
+	HeartbeatRule = "heartbeat"
+
+	// HeartbeatFilter is the filter of the records of the
+	// heartbeats sent by a Heartbeat, which distinguishes them
+	// from the alerts of the rules
+	HeartbeatFilter = "heartbeat"
+)
+
+// HeartbeatConfig is used to create a new *Heartbeat.
+type HeartbeatConfig struct {
+	// Method is the output to which the heartbeats are sent
+	Method Method
+
+	// Interval is the time between two heartbeats. If zero, a
+	// default of one hour will be used
+	Interval time.Duration
+
+	// Check, if not nil, verifies that Elasticsearch is reachable
+	// before each heartbeat. Its result is included in the
+	// heartbeat, which is sent either way
+	Check func(context.Context) error
+
+	// Active, if not nil, reports whether this instance should send
+	// the heartbeats, e.g. whether it holds the distributed lock, so
+	// that only one of several instances sends them
+	Active func() bool
+
+	// Host is the name of the host of this instance, which is
+	// included in the heartbeats
+	Host string
+
+	Logger hclog.Logger
+
+	// Clock is the source of the current time. If nil, the system
+	// clock will be used
+	Clock clock.Clock
+}
+
+// Heartbeat sends a heartbeat alert to an output at a regular
+// interval regardless of the results of the rules, so that the
+// absence of the heartbeats reveals that the daemon, its connection
+// to Elasticsearch or the output itself is not working.
+type Heartbeat struct {
+	method   Method
+	interval time.Duration
+	check    func(context.Context) error
+	active   func() bool
+	host     string
+	logger   hclog.Logger
+	clock    clock.Clock
+}
+
+// NewHeartbeat creates a new *Heartbeat instance.
+func NewHeartbeat(config *HeartbeatConfig) (*Heartbeat, error) {
+	if config.Method == nil {
+		return nil, xerrors.New("no heartbeat output method provided")
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultHeartbeatInterval
+	}
+	if config.Logger == nil {
+		config.Logger = hclog.Default()
+	}
+	if config.Clock == nil {
+		config.Clock = clock.Real()
+	}
+	return &Heartbeat{
+		method:   config.Method,
+		interval: config.Interval,
+		check:    config.Check,
+		active:   config.Active,
+		host:     config.Host,
+		logger:   config.Logger,
+		clock:    config.Clock,
+	}, nil
+}
+
+// Run sends a heartbeat each time the interval elapses until the
+// context is canceled.
+func (h *Heartbeat) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.clock.After(h.interval):
+			if h.active != nil && !h.active() {
+				continue
+			}
+			h.beat(ctx)
+		}
+	}
+}
+
+// beat sends a single heartbeat.
+func (h *Heartbeat) beat(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, heartbeatTimeout)
+	defer cancel()
+
+	status := "reachable"
+	if h.check != nil {
+		if err := h.check(ctx); err != nil {
+			h.logger.Error("Elasticsearch is unreachable", "error", err)
+			status = fmt.Sprintf("unreachable (%v)", err)
+		}
+	}
+	records := []*Record{{
+		Filter: HeartbeatFilter,
+		Text:   heartbeatText(h.host, h.clock.Now(), status),
+	}}
+	if err := h.method.Write(ctx, HeartbeatRule, records); err != nil {
+		h.logger.Error("error sending heartbeat", "method", h.method.Name(), "error", err)
+		return
+	}
+	h.logger.Debug("Sent heartbeat", "method", h.method.Name())
+}
+
+// heartbeatText describes the heartbeat of the host.
+func heartbeatText(host string, at time.Time, status string) string {
+	var b strings.Builder
+	b.WriteString("Heartbeat: go-elasticsearch-alerts is running")
+	if host != "" {
+		fmt.Fprintf(&b, "\nHost: %s", host)
+	}
+	fmt.Fprintf(&b, "\nTime: %s\nElasticsearch: %s", at.UTC().Format(time.RFC3339), status)
+	return b.String()
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"golang.org/x/xerrors"
+)
+
+func TestHeartbeatRun(t *testing.T) {
+	clk := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	m := &recordsMethod{writes: make(chan []*Record, 8)}
+	var (
+		active int32 = 1
+		down   int32
+	)
+	h, err := NewHeartbeat(&HeartbeatConfig{
+		Method:   m,
+		Interval: 5 * time.Minute,
+		Check: func(context.Context) error {
+			if atomic.LoadInt32(&down) == 1 {
+				return xerrors.New("connection refused")
+			}
+			return nil
+		},
+		Active: func() bool { return atomic.LoadInt32(&active) == 1 },
+		Host:   "alerts-1",
+		Logger: hclog.NewNullLogger(),
+		Clock:  clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// tick advances the clock to the next heartbeat once Run is
+	// waiting for it
+	tick := func() {
+		clk.BlockUntil(1)
+		clk.Advance(5 * time.Minute)
+	}
+	receive := func(expected string) {
+		t.Helper()
+		select {
+		case records := <-m.writes:
+			if len(records) != 1 || records[0].Filter != HeartbeatFilter {
+				t.Fatalf("unexpected records: %+v", records)
+			}
+			if !strings.Contains(records[0].Text, expected) {
+				t.Fatalf("Expected heartbeat to contain:\n\t%s\nGot:\n\t%s", expected, records[0].Text)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the heartbeat")
+		}
+	}
+	none := func() {
+		t.Helper()
+		select {
+		case records := <-m.writes:
+			t.Fatalf("unexpected heartbeat: %s", records[0].Text)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Nothing is sent before the first interval elapses
+	none()
+
+	tick()
+	receive("Heartbeat: go-elasticsearch-alerts is running\nHost: alerts-1\n" +
+		"Time: 2019-01-01T00:05:00Z\nElasticsearch: reachable")
+
+	tick()
+	receive("Time: 2019-01-01T00:10:00Z")
+
+	// The heartbeat is still sent when Elasticsearch is unreachable
+	atomic.StoreInt32(&down, 1)
+	tick()
+	receive("Elasticsearch: unreachable (connection refused)")
+
+	// Inactive instances skip the heartbeat
+	atomic.StoreInt32(&active, 0)
+	tick()
+	none()
+
+	atomic.StoreInt32(&active, 1)
+	atomic.StoreInt32(&down, 0)
+	tick()
+	receive("Time: 2019-01-01T00:25:00Z\nElasticsearch: reachable")
+
+	if _, err = NewHeartbeat(&HeartbeatConfig{}); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+}
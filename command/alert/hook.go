@@ -0,0 +1,142 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Hook observes the records of every alert, e.g. to feed them to an
+// analytics pipeline, without being an output of the rules. It is
+// called with the context (which carries the ID, fire count and
+// query of the alert like that of Method.Write) and the name and
+// records of the rule just before the alert is dispatched to its
+// outputs. The records are shared with the outputs and must not be
+// modified. Hooks are called alongside the delivery of the alert,
+// so they never delay it, and an error returned by a Hook is logged
+// and does not prevent the delivery. A Hook which has not returned
+// after hookTimeout is abandoned; its context is canceled at that
+// point and it should return as soon as it can.
+type Hook func(ctx context.Context, rule string, records []*Record) error
+
+// hookTimeout is how long a Hook is waited for before it is
+// abandoned.
+var hookTimeout = 10 * time.Second
+
+// maxHookRuns is the maximum number of alerts whose hooks Run calls
+// in the background at the same time. The hooks of an alert
+// received while that many are running are skipped.
+const maxHookRuns = 16
+
+var (
+	hooksMutex sync.RWMutex
+	hooks      = make(map[string]Hook)
+)
+
+// RegisterHook adds a hook, identified by name in the logs, which
+// is called with every alert. Hooks are called in the order of
+// their names. It is intended to be called from the init function
+// of the package implementing the hook. If RegisterHook is called
+// twice with the same name or if hook is nil, it panics.
+func RegisterHook(name string, hook Hook) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+
+	if hook == nil {
+		panic("alert: RegisterHook hook is nil")
+	}
+	if _, ok := hooks[name]; ok {
+		panic("alert: RegisterHook called twice for hook " + name)
+	}
+	hooks[name] = hook
+}
+
+// startHooks calls the registered hooks with the alert in the
+// background, as runHooks does, and returns a channel which is
+// closed once they have returned. If maxHookRuns alerts already have
+// hooks running, the hooks are skipped and the channel is closed at
+// once.
+func (a *Handler) startHooks(ctx context.Context, alert *Alert) <-chan struct{} {
+	done := make(chan struct{})
+	select {
+	case a.hookRuns <- struct{}{}:
+	default:
+		a.logger.Warn(fmt.Sprintf("too many hooks running, skipping the hooks of the alert from rule %q",
+			alert.RuleName), "max_hook_runs", maxHookRuns)
+		close(done)
+		return done
+	}
+	go func() {
+		defer func() {
+			<-a.hookRuns
+			close(done)
+		}()
+		a.runHooks(ctx, alert)
+	}()
+	return done
+}
+
+// runHooks calls the registered hooks with the alert, logging the
+// errors they return. A hook which panics is treated as having
+// returned an error so that it cannot bring down the handler.
+func (a *Handler) runHooks(ctx context.Context, alert *Alert) {
+	hooksMutex.RLock()
+	names := make([]string, 0, len(hooks))
+	for name := range hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	registered := make([]Hook, 0, len(names))
+	for _, name := range names {
+		registered = append(registered, hooks[name])
+	}
+	hooksMutex.RUnlock()
+
+	for i, hook := range registered {
+		if err := callHook(ctx, hook, alert); err != nil {
+			a.logger.Error(fmt.Sprintf("error returned by hook %q for rule %q", names[i], alert.RuleName), "error", err)
+		}
+	}
+}
+
+// callHook calls the hook with the alert, recovering from a panic.
+// The hook runs in its own goroutine and, if it has not returned
+// after hookTimeout, an error is returned without waiting for it.
+func callHook(ctx context.Context, hook Hook, alert *Alert) error {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errCh <- xerrors.Errorf("hook panicked: %v", r)
+			}
+		}()
+		errCh <- hook(ctx, alert.RuleName, alert.Records)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return xerrors.Errorf("hook did not return after %v: %v", hookTimeout, ctx.Err())
+	}
+}
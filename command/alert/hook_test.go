@@ -0,0 +1,258 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"golang.org/x/xerrors"
+)
+
+// withHooks registers the hooks and returns a function which
+// unregisters them.
+func withHooks(registered map[string]Hook) func() {
+	for name, hook := range registered {
+		RegisterHook(name, hook)
+	}
+	return func() {
+		hooksMutex.Lock()
+		defer hooksMutex.Unlock()
+		for name := range registered {
+			delete(hooks, name)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+		ids   []string
+	)
+	observe := func(name string) Hook {
+		return func(ctx context.Context, rule string, records []*Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, name+":"+rule+":"+records[0].Text)
+			ids = append(ids, AlertIDFromContext(ctx))
+			return nil
+		}
+	}
+	defer withHooks(map[string]Hook{
+		"test-b-observe": observe("b"),
+		"test-a-observe": observe("a"),
+		"test-c-error": func(context.Context, string, []*Record) error {
+			return xerrors.New("test error")
+		},
+		"test-d-panic": func(context.Context, string, []*Record) error {
+			panic("test panic")
+		},
+	})()
+
+	handler := NewHandler(&HandlerConfig{
+		Logger: hclog.NewNullLogger(),
+	})
+	method := &idAlertMethod{}
+	err := handler.Send(context.Background(), &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		AlertID:  "0123abcd",
+		Records:  []*Record{{Filter: "hits.hits._source", Text: "sent"}},
+		Methods:  []Method{method},
+	})
+	if err != nil {
+		t.Fatalf("the errors of hooks should not fail the delivery: %v", err)
+	}
+	if method.id != "0123abcd" {
+		t.Fatal("the alert was not delivered")
+	}
+
+	// Run calls the hooks too
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outputCh := make(chan *Alert, 1)
+	go handler.Run(ctx, outputCh)
+	outputCh <- &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		Records:  []*Record{{Filter: "hits.hits._source", Text: "run"}},
+		Methods:  []Method{&idAlertMethod{}},
+	}
+
+	expected := []string{"a:test-rule:sent", "b:test-rule:sent", "a:test-rule:run", "b:test-rule:run"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(calls)
+		mu.Unlock()
+		if n >= len(expected) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-handler.DoneCh
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != len(expected) {
+		t.Fatalf("unexpected hook calls (got %v, expected %v)", calls, expected)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Fatalf("unexpected hook calls (got %v, expected %v)", calls, expected)
+		}
+	}
+	if ids[0] != "0123abcd" || ids[2] != "" {
+		t.Fatalf("hooks should receive the context of the alert (got IDs %v)", ids)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { hookTimeout = timeout }(hookTimeout)
+	hookTimeout = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+	defer withHooks(map[string]Hook{
+		// The hook ignores the cancellation of its context
+		"test-stuck": func(context.Context, string, []*Record) error {
+			<-release
+			return nil
+		},
+	})()
+
+	handler := NewHandler(&HandlerConfig{
+		Logger: hclog.NewNullLogger(),
+	})
+	method := &idAlertMethod{}
+	alert := &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		AlertID:  "0123abcd",
+		Records:  []*Record{{Filter: "hits.hits._source", Text: "sent"}},
+		Methods:  []Method{method},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- handler.Send(context.Background(), alert)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("a stuck hook should not fail the delivery: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the delivery was held up by a stuck hook")
+	}
+	if method.id != "0123abcd" {
+		t.Fatal("the alert was not delivered")
+	}
+}
+
+// chanAlertMethod reports the rule of each alert it writes on
+// written.
+type chanAlertMethod struct {
+	written chan string
+}
+
+func (m *chanAlertMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	m.written <- rule
+	return nil
+}
+
+func (m *chanAlertMethod) Name() string {
+	return "chan"
+}
+
+func TestRunHooksInBackground(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	defer close(release)
+	defer withHooks(map[string]Hook{
+		// The hook blocks for longer than the test, ignoring the
+		// cancellation of its context
+		"test-blocking": func(context.Context, string, []*Record) error {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return nil
+		},
+	})()
+
+	handler := NewHandler(&HandlerConfig{
+		Logger: hclog.NewNullLogger(),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-handler.DoneCh
+	}()
+	outputCh := make(chan *Alert)
+	go handler.Run(ctx, outputCh)
+
+	method := &chanAlertMethod{written: make(chan string, 2)}
+	for _, rule := range []string{"test-rule-1", "test-rule-2"} {
+		outputCh <- &Alert{
+			ID:       randomUUID(t),
+			RuleName: rule,
+			Records:  []*Record{{Filter: "hits.hits._source", Text: "test"}},
+			Methods:  []Method{method},
+		}
+	}
+
+	timeout := time.After(time.Second)
+	for _, expected := range []string{"test-rule-1", "test-rule-2"} {
+		select {
+		case rule := <-method.written:
+			if rule != expected {
+				t.Fatalf("unexpected alert (got %q, expected %q)", rule, expected)
+			}
+		case <-timeout:
+			t.Fatalf("the alert from rule %q was held up by a blocking hook", expected)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected the hook to be called with both alerts (got %d calls)", n)
+	}
+}
+
+func TestRegisterHookPanics(t *testing.T) {
+	defer withHooks(map[string]Hook{
+		"test-duplicate": func(context.Context, string, []*Record) error { return nil },
+	})()
+	for name, hook := range map[string]Hook{
+		"test-duplicate": func(context.Context, string, []*Record) error { return nil },
+		"test-nil":       nil,
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterHook(%q) should have panicked", name)
+				}
+			}()
+			RegisterHook(name, hook)
+		}()
+	}
+}
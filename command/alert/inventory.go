@@ -13,7 +13,11 @@
 
 package alert
 
-import "sync"
+import (
+	"sync"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
 
 const defaultNumAttempts int = 3
 
@@ -62,3 +66,53 @@ func (i *inventory) remaining(id string) int {
 	}
 	return remaining
 }
+
+// outcome collects the results of sending an alert with each of
+// the methods it is sent with, one attempt at a time, and reports
+// on result whether any of them delivered it once all of them are
+// done. A nil *outcome does nothing.
+type outcome struct {
+	mutex     sync.Mutex
+	pending   int
+	delivered bool
+	errs      *multierror.Error
+	result    chan<- error
+}
+
+// newOutcome returns the outcome of sending an alert with the given
+// number of methods, which is reported on result. If there are no
+// methods, nil is reported at once. It returns nil if result is nil.
+func newOutcome(result chan<- error, pending int) *outcome {
+	if result == nil {
+		return nil
+	}
+	if pending < 1 {
+		result <- nil
+		return nil
+	}
+	return &outcome{pending: pending, result: result}
+}
+
+// done records that one of the methods delivered the alert, if err
+// is nil, or that it failed every attempt otherwise.
+func (o *outcome) done(err error) {
+	if o == nil {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if err == nil {
+		o.delivered = true
+	} else {
+		o.errs = multierror.Append(o.errs, err)
+	}
+	o.pending--
+	if o.pending > 0 {
+		return
+	}
+	if o.delivered {
+		o.result <- nil
+		return
+	}
+	o.result <- o.errs.ErrorOrNil()
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import "context"
+
+// Progress records how much of an alert a Method has delivered so
+// that, when the Handler retries the alert with the Method, it can
+// resume where it failed rather than start over, e.g. so that the
+// pages of a message which were already posted are not posted a
+// second time. The parts of the alert which are delivered out of
+// order (e.g. the mirrors of a message) are recorded by key instead.
+// The Handler passes a new Progress to each output in the context of
+// Write (see ProgressFromContext) and keeps it across the attempts.
+// A nil *Progress records nothing.
+type Progress struct {
+	done int
+	sent map[string]bool
+}
+
+// Done returns the number of parts of the alert (e.g. pages) that
+// have been delivered.
+func (p *Progress) Done() int {
+	if p == nil {
+		return 0
+	}
+	return p.done
+}
+
+// SetDone records that the first n parts of the alert have been
+// delivered.
+func (p *Progress) SetDone(n int) {
+	if p != nil {
+		p.done = n
+	}
+}
+
+// Sent returns whether the part of the alert with the given key (e.g.
+// a page posted to one of several webhooks) has been delivered.
+func (p *Progress) Sent(key string) bool {
+	if p == nil {
+		return false
+	}
+	return p.sent[key]
+}
+
+// SetSent records that the part of the alert with the given key has
+// been delivered.
+func (p *Progress) SetSent(key string) {
+	if p == nil {
+		return
+	}
+	if p.sent == nil {
+		p.sent = make(map[string]bool)
+	}
+	p.sent[key] = true
+}
+
+// progressKey is the context key of the progress of an alert.
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx which carries p.
+func WithProgress(ctx context.Context, p *Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// ProgressFromContext returns the progress carried by ctx (see
+// Progress), or nil if there is none.
+func ProgressFromContext(ctx context.Context) *Progress {
+	p, _ := ctx.Value(progressKey{}).(*Progress)
+	return p
+}
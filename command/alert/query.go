@@ -0,0 +1,122 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// redactedValue replaces the values of the redacted fields of a
+// query rendered by RenderQuery.
+const redactedValue = "[REDACTED]"
+
+// queryKey is the context key of the query of an alert.
+type queryKey struct{}
+
+// WithQuery returns a copy of ctx which carries the body of the
+// Elasticsearch query which produced an alert.
+func WithQuery(ctx context.Context, query map[string]interface{}) context.Context {
+	return context.WithValue(ctx, queryKey{}, query)
+}
+
+// QueryFromContext returns the query carried by ctx (see
+// Alert.Query), or nil if there is none.
+func QueryFromContext(ctx context.Context) map[string]interface{} {
+	query, _ := ctx.Value(queryKey{}).(map[string]interface{})
+	return query
+}
+
+// RenderQuery returns the query as indented JSON for inclusion in
+// a notification. The value of any field of the query, at any
+// depth, whose name is one of redact is replaced with
+// "[REDACTED]". The query itself is not modified since it is
+// shared with the other outputs of the rule. If query is nil, it
+// returns an empty string.
+func RenderQuery(query map[string]interface{}, redact []string) (string, error) {
+	if query == nil {
+		return "", nil
+	}
+	// HTML characters are left as is since the query is displayed
+	// rather than embedded in HTML
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(RedactQuery(query, redact)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// RedactQuery returns a copy of the query in which the value of
+// any field, at any depth, whose name is one of redact is replaced
+// with "[REDACTED]". If query is nil, it returns nil.
+func RedactQuery(query map[string]interface{}, redact []string) map[string]interface{} {
+	if query == nil {
+		return nil
+	}
+	fields := make(map[string]bool, len(redact))
+	for _, name := range redact {
+		fields[name] = true
+	}
+	return redactQuery(query, fields).(map[string]interface{})
+}
+
+// QueryIncluder is implemented by a Method which can include the
+// query of an alert in its notifications, e.g. so that the query
+// is only persisted by the Spool as the method would send it.
+type QueryIncluder interface {
+	// IncludedQuery returns the query as the method would include
+	// it (i.e. redacted), or nil if the method does not include it
+	IncludedQuery(query map[string]interface{}) map[string]interface{}
+}
+
+// IncludedQuery invokes the IncludedQuery method of method if it
+// implements QueryIncluder. It returns nil if method does not
+// implement QueryIncluder.
+func IncludedQuery(method Method, query map[string]interface{}) map[string]interface{} {
+	q, ok := method.(QueryIncluder)
+	if !ok {
+		return nil
+	}
+	return q.IncludedQuery(query)
+}
+
+// redactQuery returns a copy of v with the values of the named
+// fields replaced.
+func redactQuery(v interface{}, fields map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			if fields[k] {
+				out[k] = redactedValue
+				continue
+			}
+			out[k] = redactQuery(elem, fields)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = redactQuery(elem, fields)
+		}
+		return out
+	default:
+		return v
+	}
+}
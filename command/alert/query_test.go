@@ -0,0 +1,107 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRenderQuery(t *testing.T) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{
+						"term": map[string]interface{}{"api_key": "secret"},
+					},
+				},
+				"must": map[string]interface{}{
+					"match": map[string]interface{}{"message": "error"},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		query    map[string]interface{}
+		redact   []string
+		expected string
+	}{
+		{
+			"nil",
+			nil,
+			nil,
+			"",
+		},
+		{
+			"no-redaction",
+			map[string]interface{}{"size": 0},
+			nil,
+			"{\n  \"size\": 0\n}",
+		},
+		{
+			"redacted",
+			query,
+			[]string{"api_key", "must"},
+			`{
+  "query": {
+    "bool": {
+      "filter": [
+        {
+          "term": {
+            "api_key": "[REDACTED]"
+          }
+        }
+      ],
+      "must": "[REDACTED]"
+    }
+  }
+}`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := RenderQuery(tc.query, tc.redact)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Fatalf("unexpected query:\nGot:\n%s\nExpected:\n%s", got, tc.expected)
+			}
+		})
+	}
+
+	// The query is shared with the other outputs of the rule
+	term := query["query"].(map[string]interface{})["bool"].(map[string]interface{})["filter"].([]interface{})[0]
+	expected := map[string]interface{}{"term": map[string]interface{}{"api_key": "secret"}}
+	if !reflect.DeepEqual(term, expected) {
+		t.Fatalf("original query was modified: %v", term)
+	}
+}
+
+func TestAlertContextQuery(t *testing.T) {
+	query := map[string]interface{}{"size": 0}
+	a := &Alert{Query: query}
+	if got := QueryFromContext(a.context(context.Background())); !reflect.DeepEqual(got, query) {
+		t.Fatalf("unexpected query (got %v, expected %v)", got, query)
+	}
+	if got := QueryFromContext((&Alert{}).context(context.Background())); got != nil {
+		t.Fatalf("expected no query but got %v", got)
+	}
+}
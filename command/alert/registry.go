@@ -0,0 +1,113 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"golang.org/x/xerrors"
+)
+
+// FactoryOptions are settings shared by all outputs which are
+// passed to every Factory.
+type FactoryOptions struct {
+	// Client is the HTTP client that methods which make HTTP
+	// requests should use unless they are configured with
+	// their own client
+	Client *http.Client
+
+	// Logger is the logger with which methods log errors which do
+	// not prevent an alert from being sent
+	Logger hclog.Logger
+}
+
+// Factory creates a new Method from the 'config' field of
+// an output in a rule configuration file. The options may
+// be nil.
+type Factory func(config map[string]interface{}, opts *FactoryOptions) (Method, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]Factory)
+	configs       = make(map[string]interface{})
+)
+
+// Register makes an output method available by the provided
+// type (e.g. "slack"). It is intended to be called from the
+// init function of the package implementing the method. If
+// Register is called twice with the same type or if factory
+// is nil, it panics.
+func Register(methodType string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("alert: Register factory is nil")
+	}
+	if _, ok := registry[methodType]; ok {
+		panic("alert: Register called twice for method type " + methodType)
+	}
+	registry[methodType] = factory
+}
+
+// RegisterConfig records the configuration struct decoded by
+// the factory of the given method type so that its fields can be
+// described (e.g. by the config-schema subcommand). Like Register,
+// it is intended to be called from an init function.
+func RegisterConfig(methodType string, config interface{}) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	configs[methodType] = config
+}
+
+// Config returns the configuration struct registered for the
+// given method type, or nil if there is none.
+func Config(methodType string) interface{} {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	return configs[methodType]
+}
+
+// New creates a new Method of the given type using the
+// factory with which the type was registered.
+func New(methodType string, config map[string]interface{}, opts *FactoryOptions) (Method, error) {
+	registryMutex.RLock()
+	factory, ok := registry[methodType]
+	registryMutex.RUnlock()
+
+	if !ok {
+		return nil, xerrors.Errorf("unknown output method type %q (known types: %s)",
+			methodType, strings.Join(Types(), ", "))
+	}
+	return factory(config, opts)
+}
+
+// Types returns the sorted list of registered method types.
+func Types() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	types := make([]string, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
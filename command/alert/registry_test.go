@@ -0,0 +1,76 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+func TestRegistry(t *testing.T) {
+	Register("test-file", func(config map[string]interface{}, opts *FactoryOptions) (Method, error) {
+		path, ok := config["file"].(string)
+		if !ok {
+			return nil, xerrors.New("no file path provided")
+		}
+		return &fileAlertMethod{outputFilepath: path}, nil
+	})
+	RegisterConfig("test-file", fileAlertMethod{})
+
+	t.Run("registered", func(t *testing.T) {
+		method, err := New("test-file", map[string]interface{}{"file": "test.log"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method.Name() != "file" {
+			t.Fatalf("unexpected method name (got %q, expected %q)", method.Name(), "file")
+		}
+	})
+
+	t.Run("config", func(t *testing.T) {
+		if _, ok := Config("test-file").(fileAlertMethod); !ok {
+			t.Fatalf("unexpected config type %T", Config("test-file"))
+		}
+		if cfg := Config("carrier-pigeon"); cfg != nil {
+			t.Fatalf("expected no config for unknown type (got %T)", cfg)
+		}
+	})
+
+	t.Run("factory-error", func(t *testing.T) {
+		if _, err := New("test-file", map[string]interface{}{}, nil); err == nil {
+			t.Fatal("expected an error but didn't receive one")
+		}
+	})
+
+	t.Run("unknown-type", func(t *testing.T) {
+		_, err := New("carrier-pigeon", nil, nil)
+		if err == nil {
+			t.Fatal("expected an error but didn't receive one")
+		}
+		expected := `unknown output method type "carrier-pigeon" (known types: test-file)`
+		if err.Error() != expected {
+			t.Fatalf("Expected error:\n\t%q\nGot:\n\t%q\n", expected, err.Error())
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected Register to panic")
+			}
+		}()
+		Register("test-file", func(map[string]interface{}, *FactoryOptions) (Method, error) { return nil, nil })
+	})
+}
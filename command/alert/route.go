@@ -0,0 +1,174 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+// Matcher reports whether a field of a record should be sent to
+// an output. The field is nil for records without fields.
+type Matcher func(record *Record, field *Field) bool
+
+// Evaluator is a boolean expression over named values, such as
+// the 'match' expression of an output.
+type Evaluator interface {
+	Eval(lookup func(name string) (interface{}, bool)) bool
+}
+
+// MatchExpression returns a Matcher which evaluates expr against
+// the values "filter" and "text" of the record and "key" and
+// "count" of the field. Records without fields have no "key" or
+// "count", and records without text have no "text".
+func MatchExpression(expr Evaluator) Matcher {
+	return func(record *Record, field *Field) bool {
+		return expr.Eval(func(name string) (interface{}, bool) {
+			switch name {
+			case "filter":
+				return record.Filter, true
+			case "text":
+				return record.Text, record.Text != ""
+			case "key":
+				if field == nil {
+					return nil, false
+				}
+				return field.Key, true
+			case "count":
+				if field == nil {
+					return nil, false
+				}
+				return json.Number(strconv.Itoa(field.Count)), true
+			}
+			return nil, false
+		})
+	}
+}
+
+// routedMethod is an output to which only the records matched by
+// its Matcher are sent.
+type routedMethod struct {
+	Method
+	match Matcher
+}
+
+// Route returns a Method which only writes the records matched by
+// match to method. Records with fields are sent with only their
+// matching fields.
+func Route(method Method, match Matcher) Method {
+	return &routedMethod{Method: method, match: match}
+}
+
+// Write writes the matching records, if there are any, to the
+// underlying method.
+func (r *routedMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	routed := r.route(records)
+	if len(routed) == 0 {
+		return nil
+	}
+	return r.Method.Write(ctx, rule, routed)
+}
+
+// Check checks the underlying method.
+func (r *routedMethod) Check(ctx context.Context) error {
+	return Check(ctx, r.Method)
+}
+
+// IncludedQuery returns the query as the underlying method would
+// include it.
+func (r *routedMethod) IncludedQuery(query map[string]interface{}) map[string]interface{} {
+	return IncludedQuery(r.Method, query)
+}
+
+// HasContent returns whether the underlying method would send any
+// of the matching records.
+func (r *routedMethod) HasContent(records []*Record) bool {
+	return HasContent(r.Method, r.route(records))
+}
+
+// route returns the records matched by r.match. The original
+// records are not modified since they are shared with the other
+// outputs of the rule.
+func (r *routedMethod) route(records []*Record) []*Record {
+	var routed []*Record
+	for _, record := range records {
+		if len(record.Fields) == 0 {
+			if r.match(record, nil) {
+				routed = append(routed, record)
+			}
+			continue
+		}
+		var fields []*Field
+		for _, f := range record.Fields {
+			if r.match(record, f) {
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		matched := *record
+		matched.Fields = fields
+		routed = append(routed, &matched)
+	}
+	return routed
+}
+
+// RouteRecords returns the records which would be written to the
+// method: those matched by it if it was created with Route, or
+// otherwise all of them.
+func RouteRecords(method Method, records []*Record) []*Record {
+	if d, ok := method.(*disabledMethod); ok {
+		method = d.Method
+	}
+	r, ok := method.(*routedMethod)
+	if !ok {
+		return records
+	}
+	return r.route(records)
+}
+
+// Unrouted returns the records, with only their fields, which would
+// be written to none of the enabled methods. It returns nil if any
+// of them was not created with Route.
+func Unrouted(methods []Method, records []*Record) []*Record {
+	var routers []*routedMethod
+	for _, method := range methods {
+		if !Enabled(method) {
+			continue
+		}
+		r, ok := method.(*routedMethod)
+		if !ok {
+			// The records all go to at least this method
+			return nil
+		}
+		routers = append(routers, r)
+	}
+	if len(routers) == 0 {
+		return nil
+	}
+
+	matchedByAny := func(record *Record, field *Field) bool {
+		for _, r := range routers {
+			if r.match(record, field) {
+				return true
+			}
+		}
+		return false
+	}
+	return (&routedMethod{match: func(record *Record, field *Field) bool {
+		return !matchedByAny(record, field)
+	}}).route(records)
+}
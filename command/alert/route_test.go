@@ -0,0 +1,148 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+// recordingMethod records the records written to it.
+type recordingMethod struct {
+	name    string
+	records []*Record
+	writes  int
+}
+
+func (m *recordingMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	m.records = records
+	m.writes++
+	return nil
+}
+
+func (m *recordingMethod) Name() string {
+	return m.name
+}
+
+func routeExpression(t *testing.T, src string) Matcher {
+	expr, err := config.ParseExpression(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return MatchExpression(expr)
+}
+
+func TestRoute(t *testing.T) {
+	records := []*Record{
+		{
+			Filter: "aggregations.severity.buckets",
+			Fields: []*Field{
+				{Key: "critical", Count: 3},
+				{Key: "warning", Count: 12},
+				{Key: "info", Count: 40},
+			},
+		},
+		{
+			Filter:    "hits.hits._source",
+			Text:      `{"message": "disk full"}`,
+			BodyField: true,
+		},
+	}
+
+	pager := &recordingMethod{name: "pager"}
+	slack := &recordingMethod{name: "slack"}
+	methods := []Method{
+		Route(pager, routeExpression(t, `key == "critical" AND count >= 1`)),
+		Route(slack, routeExpression(t, `key == "critical" OR key == "warning" OR filter == "hits.hits._source"`)),
+	}
+
+	handler := NewHandler(&HandlerConfig{Logger: hclog.NewNullLogger()})
+	err := handler.Send(context.Background(), &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		Records:  records,
+		Methods:  methods,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPager := []*Record{
+		{Filter: "aggregations.severity.buckets", Fields: []*Field{{Key: "critical", Count: 3}}},
+	}
+	if !reflect.DeepEqual(pager.records, expectedPager) {
+		t.Fatalf("unexpected records sent to pager:\nGot:\n\t%+v\nExpected:\n\t%+v", pager.records, expectedPager)
+	}
+	expectedSlack := []*Record{
+		{
+			Filter: "aggregations.severity.buckets",
+			Fields: []*Field{{Key: "critical", Count: 3}, {Key: "warning", Count: 12}},
+		},
+		records[1],
+	}
+	if !reflect.DeepEqual(slack.records, expectedSlack) {
+		t.Fatalf("unexpected records sent to slack:\nGot:\n\t%+v\nExpected:\n\t%+v", slack.records, expectedSlack)
+	}
+	if len(records[0].Fields) != 3 {
+		t.Fatal("routing should not modify the original records")
+	}
+
+	unrouted := Unrouted(methods, records)
+	expectedUnrouted := []*Record{
+		{Filter: "aggregations.severity.buckets", Fields: []*Field{{Key: "info", Count: 40}}},
+	}
+	if !reflect.DeepEqual(unrouted, expectedUnrouted) {
+		t.Fatalf("unexpected unrouted records:\nGot:\n\t%+v\nExpected:\n\t%+v", unrouted, expectedUnrouted)
+	}
+}
+
+func TestRouteNoMatch(t *testing.T) {
+	var logs bytes.Buffer
+	handler := NewHandler(&HandlerConfig{
+		Logger: hclog.New(&hclog.LoggerOptions{Output: &logs}),
+	})
+	records := []*Record{
+		{Filter: "aggregations.severity.buckets", Fields: []*Field{{Key: "info", Count: 40}}},
+	}
+
+	pager := &recordingMethod{name: "pager"}
+	err := handler.Send(context.Background(), &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		Records:  records,
+		Methods:  []Method{Route(pager, routeExpression(t, `key == "critical"`))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pager.writes != 0 {
+		t.Fatalf("expected no records to be sent to an output matching none of them (got %d writes)", pager.writes)
+	}
+	if !strings.Contains(logs.String(), `records of rule "test-rule" match none of its outputs`) {
+		t.Fatalf("expected the unrouted records to be logged, got:\n%s", logs.String())
+	}
+
+	// Records always reach an output without 'match'
+	methods := []Method{Route(pager, routeExpression(t, `key == "critical"`)), pager}
+	if unrouted := Unrouted(methods, records); unrouted != nil {
+		t.Fatalf("expected no unrouted records, got %+v", unrouted)
+	}
+}
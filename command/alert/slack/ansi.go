@@ -0,0 +1,154 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+const (
+	// Accepted values of the 'ansi_mode' option
+	ansiModeStrip = "strip"
+	ansiModeFold  = "fold"
+)
+
+// ansiEscape matches an ANSI control sequence (e.g. "\x1b[31m"),
+// either raw or with its escape character JSON-encoded as in the
+// stringified documents of a record. The parameters are captured
+// and the final byte is "m" for sequences setting colors.
+var ansiEscape = regexp.MustCompile(`(?:\x1b|\\u001[bB])\[([0-9;?]*)[ -/]*([@-~])`)
+
+// ansiEmphasis are the mrkdwn markers with which text in the given
+// colors and styles is emphasized when folding ANSI sequences.
+var ansiEmphasis = map[string]string{
+	"1":  "*", // bold
+	"31": "*", // red
+	"91": "*", // bright red
+	"3":  "_", // italic
+	"33": "_", // yellow
+	"93": "_", // bright yellow
+	"9":  "~", // strikethrough
+}
+
+// cleanANSI returns copies of the body field records whose text
+// contains ANSI control sequences, with the sequences removed or,
+// if s.ansiMode is ansiModeFold, folded into mrkdwn emphasis (see
+// foldANSI). The records are returned as is if s.stripANSI is false.
+func (s *AlertMethod) cleanANSI(rawRecords []*alert.Record) []*alert.Record {
+	if !s.stripANSI {
+		return rawRecords
+	}
+	records := make([]*alert.Record, 0, len(rawRecords))
+	for _, rawRecord := range rawRecords {
+		if !rawRecord.BodyField || !ansiEscape.MatchString(rawRecord.Text) {
+			records = append(records, rawRecord)
+			continue
+		}
+		record := *rawRecord
+		if s.foldsANSI() {
+			record.Text = foldANSI(rawRecord.Text)
+		} else {
+			record.Text = stripANSI(rawRecord.Text)
+		}
+		records = append(records, &record)
+	}
+	return records
+}
+
+// foldsANSI returns whether ANSI sequences in the text of body field
+// records are folded into mrkdwn emphasis.
+func (s *AlertMethod) foldsANSI() bool {
+	return s.stripANSI && s.ansiMode == ansiModeFold
+}
+
+// stripANSI removes the ANSI control sequences from text.
+func stripANSI(text string) string {
+	return ansiEscape.ReplaceAllString(text, "")
+}
+
+// foldANSI removes the ANSI control sequences from text, wrapping
+// the text following a sequence which sets one of the colors or
+// styles of ansiEmphasis in the corresponding mrkdwn marker until
+// the next sequence which resets the colors or styles. Other
+// sequences are removed as they are.
+func foldANSI(text string) string {
+	var (
+		b    strings.Builder
+		open []string
+		last int
+	)
+	// starts are the lengths of b after each marker of open was
+	// written, so that markers around no text can be left out
+	var starts []int
+	closeAll := func() {
+		for i := len(open) - 1; i >= 0; i-- {
+			if b.Len() == starts[i] {
+				// Nothing was emphasized; drop the opening marker
+				s := b.String()
+				b.Reset()
+				b.WriteString(s[:starts[i]-len(open[i])])
+				continue
+			}
+			b.WriteString(open[i])
+		}
+		open, starts = open[:0], starts[:0]
+	}
+
+	for _, loc := range ansiEscape.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(text[last:loc[0]])
+		last = loc[1]
+		if text[loc[4]:loc[5]] != "m" {
+			continue
+		}
+		for _, param := range strings.Split(text[loc[2]:loc[3]], ";") {
+			marker, ok := ansiEmphasis[param]
+			if !ok {
+				if isANSIReset(param) {
+					closeAll()
+				}
+				continue
+			}
+			if !containsString(open, marker) {
+				b.WriteString(marker)
+				open = append(open, marker)
+				starts = append(starts, b.Len())
+			}
+		}
+	}
+	b.WriteString(text[last:])
+	closeAll()
+	return b.String()
+}
+
+// isANSIReset returns whether the parameter of an ANSI sequence
+// setting colors resets the colors or styles of ansiEmphasis.
+func isANSIReset(param string) bool {
+	switch param {
+	case "", "0", "22", "23", "29", "39":
+		return true
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
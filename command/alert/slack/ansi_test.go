@@ -0,0 +1,163 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestANSI(t *testing.T) {
+	cases := []struct {
+		name  string
+		text  string
+		strip string
+		fold  string
+	}{
+		{
+			"color",
+			"\x1b[31mERROR\x1b[0m disk full",
+			"ERROR disk full",
+			"*ERROR* disk full",
+		},
+		{
+			"json-encoded",
+			`{"message": "\u001b[33mWARN\u001b[39m retrying"}`,
+			`{"message": "WARN retrying"}`,
+			`{"message": "_WARN_ retrying"}`,
+		},
+		{
+			"combined-params",
+			"\x1b[1;93mslow\x1b[m query",
+			"slow query",
+			"*_slow_* query",
+		},
+		{
+			"unmapped-color",
+			"\x1b[32mOK\x1b[0m",
+			"OK",
+			"OK",
+		},
+		{
+			"not-a-color",
+			"\x1b[2Kprogress\x1b[1A",
+			"progress",
+			"progress",
+		},
+		{
+			"empty-span",
+			"\x1b[31m\x1b[0mdone",
+			"done",
+			"done",
+		},
+		{
+			"unterminated",
+			"\x1b[91mpanic: runtime error",
+			"panic: runtime error",
+			"*panic: runtime error*",
+		},
+		{
+			"none",
+			"plain text",
+			"plain text",
+			"plain text",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := stripANSI(tc.text); got != tc.strip {
+				t.Errorf("unexpected stripped text (got %q, expected %q)", got, tc.strip)
+			}
+			if got := foldANSI(tc.text); got != tc.fold {
+				t.Errorf("unexpected folded text (got %q, expected %q)", got, tc.fold)
+			}
+		})
+	}
+}
+
+func TestWriteStripANSI(t *testing.T) {
+	cases := []struct {
+		name     string
+		mode     string
+		expected string
+	}{
+		{"strip", "", "\n```\nERROR disk full\n```"},
+		{"fold", ansiModeFold, "\n*ERROR* disk full"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var pl payload
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(200)
+			}))
+			defer ts.Close()
+
+			s, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL: ts.URL,
+				StripANSI:  true,
+				ANSIMode:   tc.mode,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			records := []*alert.Record{
+				{
+					Filter:    "hits.hits._source",
+					BodyField: true,
+					Text:      "\x1b[31mERROR\x1b[0m disk full",
+				},
+			}
+			if err = s.Write(context.Background(), "Test Rule", records); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(pl.Attachments) != 1 {
+				t.Fatalf("expected 1 attachment, got %d", len(pl.Attachments))
+			}
+			text := pl.Attachments[0].Text
+			if strings.Contains(text, "\x1b") {
+				t.Fatalf("ANSI escapes were not removed: %q", text)
+			}
+			if expected := "hits.hits._source" + tc.expected; text != expected {
+				t.Fatalf("unexpected attachment text (got %q, expected %q)", text, expected)
+			}
+			// The records are shared with the other outputs of the rule
+			if records[0].Text != "\x1b[31mERROR\x1b[0m disk full" {
+				t.Fatal("record was modified")
+			}
+		})
+	}
+
+	if _, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL: "https://example.com",
+		StripANSI:  true,
+		ANSIMode:   "html",
+	}); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+}
@@ -17,6 +17,10 @@ const (
 	defaultAttachmentColor      = "#36a64f"
 	defaultAttachmentFooter     = "Go Elasticsearch Alerts"
 	defaultAttachmentFooterIcon = "https://www.elastic.co/static/images/elastic-logo-200.png"
+
+	// queryAttachmentColor is the color of the attachment showing
+	// the query which produced an alert
+	queryAttachmentColor = "#808080"
 )
 
 // field corresponds to the 'attachment.field'
@@ -27,12 +31,22 @@ type field struct {
 	Short bool   `json:"short"`
 }
 
+// action corresponds to the 'attachment.actions'
+// field of a Slack message payload. Only link buttons,
+// which do not require a Slack app, are used.
+type action struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
 // attachment corresponds to the 'attachment' field
 // of a Slack message payload.
 type attachment struct {
 	Fallback   string   `json:"fallback"`
 	Color      string   `json:"color,omitempty"`
 	Title      string   `json:"title,omitempty"`
+	TitleLink  string   `json:"title_link,omitempty"`
 	Pretext    string   `json:"pretext,omitempty"`
 	Fields     []field  `json:"fields,omitempty"`
 	Text       string   `json:"text,omitempty"`
@@ -42,4 +56,5 @@ type attachment struct {
 	FooterIcon string   `json:"footer_icon,omitempty"`
 	Timestamp  int64    `json:"ts,omitempty"`
 	MarkdownIn []string `json:"mrkdwn_in,omitempty"`
+	Actions    []action `json:"actions,omitempty"`
 }
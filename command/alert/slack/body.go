@@ -0,0 +1,135 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultMaxDocs is the maximum number of documents of a record
+	// rendered with the 'body_template' template
+	defaultMaxDocs = 10
+
+	// documentDelimiter separates the rendered documents of a record
+	documentDelimiter = "\n----------------------------------------\n"
+)
+
+// parseBodyTemplate parses the 'body_template' template. It returns
+// nil if the template is empty. Unlike the message templates it is
+// not rendered against sample data since the fields of the documents
+// depend on the rule.
+func parseBodyTemplate(raw string) (*template.Template, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("body_template").Parse(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing field 'output.config.body_template': %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderDocuments returns a copy of the records in which the text of
+// each body field record with documents is replaced by the first
+// s.maxDocs documents, each rendered with s.bodyTemplate. Documents
+// which cannot be rendered are shown as JSON instead. The records
+// are returned as is if there is no body template.
+func (s *AlertMethod) renderDocuments(rawRecords []*alert.Record) []*alert.Record {
+	if s.bodyTemplate == nil {
+		return rawRecords
+	}
+	records := make([]*alert.Record, 0, len(rawRecords))
+	for _, rawRecord := range rawRecords {
+		if !rawRecord.BodyField || len(rawRecord.Documents) == 0 {
+			records = append(records, rawRecord)
+			continue
+		}
+		docs := rawRecord.Documents
+		if s.maxDocs > 0 && len(docs) > s.maxDocs {
+			docs = docs[:s.maxDocs]
+		}
+		rendered := make([]string, 0, len(docs))
+		for _, doc := range docs {
+			rendered = append(rendered, s.renderDocument(doc))
+		}
+		record := *rawRecord
+		record.Text = strings.Join(rendered, documentDelimiter)
+		if omitted := len(rawRecord.Documents) - len(docs); omitted > 0 {
+			record.Text = fmt.Sprintf("%s\n\n(and %d more documents)", record.Text, omitted)
+		}
+		records = append(records, &record)
+	}
+	return records
+}
+
+// renderDocument renders the document with s.bodyTemplate, or as
+// JSON if it cannot be rendered. If s.flattenDocs is true, the
+// template is executed with the flattened document instead (see
+// flattenDocument).
+func (s *AlertMethod) renderDocument(doc map[string]interface{}) string {
+	dot := doc
+	if s.flattenDocs {
+		dot = flattenDocument(doc)
+	}
+	var buf bytes.Buffer
+	if err := s.bodyTemplate.Execute(&buf, dot); err == nil {
+		return strings.TrimSpace(buf.String())
+	}
+	data, err := json.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		return fmt.Sprintf("%v", doc)
+	}
+	return string(data)
+}
+
+// flattenDocument returns a copy of the document which, alongside
+// its own fields, holds each field of its nested objects under its
+// dotted path (e.g. "http.response.status_code"), so that templates
+// can reach it with index. A field of the document whose name
+// already is such a path is not replaced. The document itself is not
+// modified.
+func flattenDocument(doc map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		flat[k] = v
+	}
+	for k, v := range doc {
+		if obj, ok := v.(map[string]interface{}); ok {
+			flattenInto(flat, k, obj)
+		}
+	}
+	return flat
+}
+
+// flattenInto adds each field of obj, and of its nested objects, to
+// flat under its dotted path below prefix.
+func flattenInto(flat map[string]interface{}, prefix string, obj map[string]interface{}) {
+	for k, v := range obj {
+		path := prefix + "." + k
+		if _, ok := flat[path]; !ok {
+			flat[path] = v
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenInto(flat, path, nested)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import "strings"
+
+// Accepted values of the 'compat' option.
+const (
+	compatSlack      = "slack"
+	compatMattermost = "mattermost"
+)
+
+// mattermost adapts a payload built for Slack to the incoming
+// webhooks of Mattermost, which are mostly but not entirely
+// Slack-compatible:
+//
+//   - 'icon_emoji' is the name of the emoji without colons
+//   - attachments do not support 'ts' or 'mrkdwn_in' (Markdown
+//     is always rendered)
+//   - 'fallback' is used in notifications, so it should not be
+//     empty
+//   - link buttons are not supported ('actions' must post to an
+//     integration), though 'title_link' is
+func mattermost(pl payload) payload {
+	pl.Emoji = strings.Trim(pl.Emoji, ":")
+	for i := range pl.Attachments {
+		att := &pl.Attachments[i]
+		att.Timestamp = 0
+		att.MarkdownIn = nil
+		att.Actions = nil
+		if att.Fallback == "" {
+			att.Fallback = att.Title
+			if filter := strings.SplitN(att.Text, "\n", 2)[0]; filter != "" {
+				att.Fallback = att.Fallback + ": " + filter
+			}
+		}
+	}
+	return pl
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestBuildPayloadMattermost(t *testing.T) {
+	a, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL: "https://mattermost.example.com/hooks/abcdefg",
+		Emoji:      ":robot:",
+		Compat:     compatMattermost,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := a.(*AlertMethod).buildPayload(context.Background(), "Test Rule", []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{{Key: "foo", Count: 2}},
+		},
+	})
+
+	if pl.Emoji != "robot" {
+		t.Errorf("unexpected icon_emoji (got %q, expected %q)", pl.Emoji, "robot")
+	}
+
+	if expected := "Test Rule: aggregations.hostname.buckets"; pl.Attachments[0].Fallback != expected {
+		t.Errorf("unexpected fallback (got %q, expected %q)", pl.Attachments[0].Fallback, expected)
+	}
+
+	data, err := json.Marshal(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"ts"`, `"mrkdwn_in"`} {
+		if strings.Contains(string(data), key) {
+			t.Errorf("payload should not contain %s:\n%s", key, data)
+		}
+	}
+}
+
+func TestNewAlertMethodCompat(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *AlertMethodConfig
+		err    bool
+	}{
+		{
+			"slack",
+			&AlertMethodConfig{WebhookURL: "https://example.com", Compat: compatSlack},
+			false,
+		},
+		{
+			"mattermost",
+			&AlertMethodConfig{WebhookURL: "https://example.com", Compat: compatMattermost},
+			false,
+		},
+		{
+			"unknown",
+			&AlertMethodConfig{WebhookURL: "https://example.com", Compat: "discord"},
+			true,
+		},
+		{
+			"mattermost-snippets",
+			&AlertMethodConfig{
+				WebhookURL:       "https://example.com",
+				Compat:           compatMattermost,
+				SnippetThreshold: 1000,
+				BotToken:         "xoxb-test",
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAlertMethod(tc.config)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"regexp"
+	"strings"
+)
+
+// mrkdwnReplacer escapes the control characters of Slack's mrkdwn,
+// which are otherwise interpreted as (or break) link syntax.
+var mrkdwnReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackLink matches Slack's link syntax: links (e.g.
+// <https://example.com|text>), mentions of users and channels (e.g.
+// <@U012AB3CD> and <#C123ABC456>), and special mentions (e.g.
+// <!here>).
+var slackLink = regexp.MustCompile(`<(?:(?:https?|mailto):|[@#!])[^<>]*>`)
+
+// escapeMrkdwn escapes &, < and > in text as &amp;, &lt; and &gt;
+// so that Slack displays them literally. If preserveLinks is true,
+// anything in text which matches Slack's link syntax is left as is
+// so that it is rendered as a link or mention.
+func escapeMrkdwn(text string, preserveLinks bool) string {
+	if !preserveLinks {
+		return mrkdwnReplacer.Replace(text)
+	}
+	var b strings.Builder
+	last := 0
+	for _, loc := range slackLink.FindAllStringIndex(text, -1) {
+		b.WriteString(mrkdwnReplacer.Replace(text[last:loc[0]]))
+		b.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(mrkdwnReplacer.Replace(text[last:]))
+	return b.String()
+}
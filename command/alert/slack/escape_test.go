@@ -0,0 +1,65 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import "testing"
+
+func TestEscapeMrkdwn(t *testing.T) {
+	cases := []struct {
+		name          string
+		text          string
+		preserveLinks bool
+		expected      string
+	}{
+		{
+			"plain",
+			"hits.hits._source",
+			false,
+			"hits.hits._source",
+		},
+		{
+			"special-characters",
+			"a < b && c > d",
+			false,
+			"a &lt; b &amp;&amp; c &gt; d",
+		},
+		{
+			"links-escaped",
+			"see <https://example.com?a=1&b=2|docs> <!here>",
+			false,
+			"see &lt;https://example.com?a=1&amp;b=2|docs&gt; &lt;!here&gt;",
+		},
+		{
+			"links-preserved",
+			"a < b <https://example.com?a=1&b=2|docs> && <@U012AB3CD> <!here> c > d",
+			true,
+			"a &lt; b <https://example.com?a=1&b=2|docs> &amp;&amp; <@U012AB3CD> <!here> c &gt; d",
+		},
+		{
+			"not-a-link",
+			"<b>bold</b>",
+			true,
+			"&lt;b&gt;bold&lt;/b&gt;",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := escapeMrkdwn(tc.text, tc.preserveLinks); got != tc.expected {
+				t.Fatalf("unexpected text (got %q, expected %q)", got, tc.expected)
+			}
+		})
+	}
+}
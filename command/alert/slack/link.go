@@ -0,0 +1,195 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultLinkText      = "View in Kibana"
+	defaultLinkTimeRange = 15 * time.Minute
+)
+
+// linkData is the data with which the 'link_url' and
+// 'title_link_template' templates are executed for each attachment.
+type linkData struct {
+	// Rule is the name of the rule
+	Rule string
+
+	// AlertID is the ID of the firing of the rule, if the rule
+	// includes it in its alerts (see alert.Alert.AlertID)
+	AlertID string
+
+	// Filter, Text and Fields are those of the record from which
+	// the attachment was created
+	Filter string
+	Text   string
+	Fields []*alert.Field
+
+	// From and To are the bounds of the time range leading up to
+	// the alert, formatted per RFC 3339 in UTC
+	From string
+	To   string
+}
+
+// link renders the URLs of the links of the attachments.
+type link struct {
+	tmpl      *template.Template
+	text      string
+	timeRange time.Duration
+}
+
+// newLink parses and validates the 'link_url' template by
+// rendering it against sample data. The rendered URL must be an
+// absolute http(s) URL.
+func newLink(rawURL, text, rawTimeRange string) (*link, error) {
+	l, err := parseLink("link_url", rawURL, rawTimeRange)
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		text = defaultLinkText
+	}
+	l.text = text
+
+	u, err := l.render(sampleMessage, sampleRecord, time.Now())
+	if err != nil {
+		return nil, xerrors.Errorf("field 'output.config.link_url' is invalid: %v", err)
+	}
+	if u == "" {
+		return nil, xerrors.New("field 'output.config.link_url' is invalid: it renders an empty URL")
+	}
+	return l, nil
+}
+
+// newTitleLink parses and validates the 'title_link_template'
+// template by executing it against sample data. Unlike 'link_url',
+// the template may render an empty or invalid URL, e.g. for records
+// without an entity to link to, since such records are simply sent
+// without a title link.
+func newTitleLink(rawURL, rawTimeRange string) (*link, error) {
+	l, err := parseLink("title_link_template", rawURL, rawTimeRange)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.tmpl.Execute(ioutil.Discard, l.data(sampleMessage, sampleRecord, time.Now())); err != nil {
+		return nil, xerrors.Errorf("field 'output.config.title_link_template' is invalid: %v", err)
+	}
+	return l, nil
+}
+
+// sampleMessage and sampleRecord are the data against which link
+// templates are validated.
+var (
+	sampleMessage = &messageData{Rule: "Test Rule", AlertID: "0123456789abcdef"}
+	sampleRecord  = &alert.Record{
+		Filter: "aggregations.hostname.buckets",
+		Fields: []*alert.Field{{Key: "test-host", Count: 1}},
+	}
+)
+
+// parseLink parses the template of the URL of a link given by the
+// named field and the 'link_time_range' field.
+func parseLink(name, rawURL, rawTimeRange string) (*link, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(rawURL)
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing field 'output.config.%s': %v", name, err)
+	}
+
+	timeRange := defaultLinkTimeRange
+	if rawTimeRange != "" {
+		if timeRange, err = time.ParseDuration(rawTimeRange); err != nil {
+			return nil, xerrors.Errorf("error parsing field 'output.config.link_time_range': %v", err)
+		}
+		if timeRange <= 0 {
+			return nil, xerrors.New("field 'output.config.link_time_range' must be positive")
+		}
+	}
+	return &link{tmpl: tmpl, timeRange: timeRange}, nil
+}
+
+// data returns the data with which the template is executed for
+// the given record of the message.
+func (l *link) data(msg *messageData, record *alert.Record, now time.Time) *linkData {
+	return &linkData{
+		Rule:    msg.Rule,
+		AlertID: msg.AlertID,
+		Filter:  record.Filter,
+		Text:    record.Text,
+		Fields:  record.Fields,
+		From:    now.Add(-l.timeRange).UTC().Format(time.RFC3339),
+		To:      now.UTC().Format(time.RFC3339),
+	}
+}
+
+// render executes the template for the given record of the
+// message. It returns an empty string if the template renders
+// nothing, e.g. so that only some records are linked.
+func (l *link) render(msg *messageData, record *alert.Record, now time.Time) (string, error) {
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, l.data(msg, record, now)); err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", nil
+	}
+
+	u, err := url.Parse(buf.String())
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", xerrors.Errorf("%q is not an absolute http(s) URL", buf.String())
+	}
+	return u.String(), nil
+}
+
+// apply sets the title link and adds a link button to the
+// attachment. The attachment is left as-is if the template renders
+// nothing for the record, or if it cannot be rendered, in which
+// case the error is returned.
+func (l *link) apply(att *attachment, msg *messageData, record *alert.Record, now time.Time) error {
+	u, err := l.render(msg, record, now)
+	if err != nil || u == "" {
+		return err
+	}
+	att.TitleLink = u
+	att.Actions = append(att.Actions, action{
+		Type: "button",
+		Text: l.text,
+		URL:  u,
+	})
+	return nil
+}
+
+// applyTitle sets the title link of the attachment. The attachment
+// is left without a title link if the template renders nothing for
+// the record, or if it cannot be rendered or renders an invalid URL,
+// in which case the error is returned.
+func (l *link) applyTitle(att *attachment, msg *messageData, record *alert.Record, now time.Time) error {
+	u, err := l.render(msg, record, now)
+	if err != nil {
+		return err
+	}
+	att.TitleLink = u
+	return nil
+}
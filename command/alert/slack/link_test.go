@@ -0,0 +1,277 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestNewLink(t *testing.T) {
+	cases := []struct {
+		name      string
+		url       string
+		timeRange string
+		err       bool
+	}{
+		{
+			"success",
+			"https://kibana.example.com/app/discover#/?_g=(time:(from:'{{.From}}',to:'{{.To}}'))&_a=(query:'{{urlquery .Rule}}')",
+			"",
+			false,
+		},
+		{
+			"fields",
+			"https://kibana.example.com/app/discover?host={{with index .Fields 0}}{{urlquery .Key}}{{end}}",
+			"1h",
+			false,
+		},
+		{
+			"parse-error",
+			"https://kibana.example.com/{{.Rule",
+			"",
+			true,
+		},
+		{
+			"unknown-field",
+			"https://kibana.example.com/{{.Dashboard}}",
+			"",
+			true,
+		},
+		{
+			"relative-url",
+			"/app/discover",
+			"",
+			true,
+		},
+		{
+			"empty",
+			"{{with .Text}}https://kibana.example.com{{end}}",
+			"",
+			true,
+		},
+		{
+			"bad-scheme",
+			"javascript:alert(1)",
+			"",
+			true,
+		},
+		{
+			"bad-time-range",
+			"https://kibana.example.com",
+			"yesterday",
+			true,
+		},
+		{
+			"negative-time-range",
+			"https://kibana.example.com",
+			"-1h",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:    "https://hooks.slack.com/services/test",
+				LinkURL:       tc.url,
+				LinkTimeRange: tc.timeRange,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLinkRender(t *testing.T) {
+	l, err := newLink("https://kibana.example.com/app/discover?rule={{urlquery .Rule}}&from={{.From}}&to={{.To}}", "", "30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	got, err := l.render(&messageData{Rule: "Filebeat Errors"}, &alert.Record{Filter: "hits.hits._source"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "https://kibana.example.com/app/discover?rule=Filebeat+Errors&from=2019-03-01T11:30:00Z&to=2019-03-01T12:00:00Z"
+	if got != expected {
+		t.Fatalf("unexpected URL (got %q, expected %q)", got, expected)
+	}
+}
+
+func TestBuildPayloadLink(t *testing.T) {
+	for _, compat := range []string{compatSlack, compatMattermost} {
+		compat := compat
+		t.Run(compat, func(t *testing.T) {
+			a, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL: "https://hooks.slack.com/services/test",
+				LinkURL:    "https://kibana.example.com/app/discover?rule={{urlquery .Rule}}",
+				Compat:     compat,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pl := a.(*AlertMethod).buildPayload(context.Background(), "Test Rule", []*alert.Record{
+				{
+					Filter: "aggregations.hostname.buckets",
+					Fields: []*alert.Field{{Key: "foo", Count: 2}},
+				},
+			})
+
+			expected := "https://kibana.example.com/app/discover?rule=Test+Rule"
+			att := pl.Attachments[0]
+			if att.TitleLink != expected {
+				t.Fatalf("unexpected title link (got %q, expected %q)", att.TitleLink, expected)
+			}
+
+			if compat == compatMattermost {
+				if len(att.Actions) != 0 {
+					t.Fatalf("Mattermost payloads should not have actions (got %+v)", att.Actions)
+				}
+				return
+			}
+			if len(att.Actions) != 1 {
+				t.Fatalf("expected exactly one action (got %d)", len(att.Actions))
+			}
+			if att.Actions[0].URL != expected || att.Actions[0].Text != defaultLinkText || att.Actions[0].Type != "button" {
+				t.Fatalf("unexpected action: %+v", att.Actions[0])
+			}
+		})
+	}
+}
+
+func TestBuildPayloadLinkError(t *testing.T) {
+	a, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL: "https://hooks.slack.com/services/test",
+		LinkURL:    "https://kibana.example.com/app/discover?host={{(index .Fields 0).Key}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	s := a.(*AlertMethod)
+	s.logger = hclog.New(&hclog.LoggerOptions{Output: buf})
+
+	pl := s.buildPayload(context.Background(), "Test Rule", []*alert.Record{
+		{Filter: "hits.hits._source", Text: "{}", BodyField: true},
+	})
+
+	// The attachment is sent without the link
+	if att := pl.Attachments[0]; att.TitleLink != "" || len(att.Actions) != 0 {
+		t.Fatalf("expected no link when the template cannot be rendered (got %+v)", att)
+	}
+	expected := `[WARN]  [Rule: "Test Rule"] error rendering 'link_url' of Slack message: error=`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("Expected logs to contain:\n\t%s\nGot:\n\t%s", expected, buf.String())
+	}
+}
+
+func TestNewTitleLink(t *testing.T) {
+	cases := []struct {
+		name string
+		url  string
+		err  bool
+	}{
+		{
+			"success",
+			"https://runbooks.example.com/{{urlquery .Rule}}",
+			false,
+		},
+		{
+			"empty-for-sample",
+			"{{if .Text}}https://runbooks.example.com/{{end}}",
+			false,
+		},
+		{
+			"parse-error",
+			"https://runbooks.example.com/{{.Rule",
+			true,
+		},
+		{
+			"unknown-field",
+			"https://runbooks.example.com/{{.Runbook}}",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:        "https://hooks.slack.com/services/test",
+				TitleLinkTemplate: tc.url,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBuildPayloadTitleLink(t *testing.T) {
+	a, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL:        "https://hooks.slack.com/services/test",
+		LinkURL:           "https://kibana.example.com/app/discover?rule={{urlquery .Rule}}",
+		TitleLinkTemplate: "{{with .Fields}}https://runbooks.example.com/{{urlquery (index . 0).Key}}{{end}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := a.(*AlertMethod).buildPayload(context.Background(), "Test Rule", []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{{Key: "web 1", Count: 2}},
+		},
+		{
+			Filter:    "hits.hits._source",
+			Text:      "{}",
+			BodyField: true,
+		},
+	})
+
+	if got, expected := pl.Attachments[0].TitleLink, "https://runbooks.example.com/web+1"; got != expected {
+		t.Fatalf("unexpected title link (got %q, expected %q)", got, expected)
+	}
+	if got := pl.Attachments[1].TitleLink; got != "" {
+		t.Fatalf("expected no title link when the template renders no URL (got %q)", got)
+	}
+	for i, att := range pl.Attachments {
+		if len(att.Actions) != 1 || att.Actions[0].URL != "https://kibana.example.com/app/discover?rule=Test+Rule" {
+			t.Fatalf("the button of attachment %d should still link to 'link_url' (got %+v)", i+1, att.Actions)
+		}
+	}
+}
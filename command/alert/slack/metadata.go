@@ -0,0 +1,114 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+const (
+	// metadataVersion is the version of the schema of the metadata
+	// attachment. It is incremented whenever a field is changed or
+	// removed, but not when one is added
+	metadataVersion = 1
+
+	// metadataTitle is the title of the metadata attachment
+	metadataTitle = "Metadata"
+)
+
+// metadata is the machine-readable description of an alert embedded
+// in the metadata attachment for bots processing the messages.
+type metadata struct {
+	Version     int              `json:"version"`
+	Rule        string           `json:"rule"`
+	AlertID     string           `json:"alert_id,omitempty"`
+	Fingerprint string           `json:"fingerprint"`
+	FireCount   int              `json:"fire_count,omitempty"`
+	FirstFired  string           `json:"first_fired,omitempty"`
+	Records     []metadataRecord `json:"records"`
+}
+
+type metadataRecord struct {
+	Filter string          `json:"filter"`
+	Fields []metadataField `json:"fields,omitempty"`
+}
+
+type metadataField struct {
+	Key    string   `json:"key"`
+	Count  int      `json:"count"`
+	Value  string   `json:"value,omitempty"`
+	Number *float64 `json:"number,omitempty"`
+	Unit   string   `json:"unit,omitempty"`
+}
+
+// newMetadata describes the alert made of the records. The records
+// should not have been processed (e.g. by escapeFilters) so that the
+// metadata holds their original filters.
+func newMetadata(ctx context.Context, rule string, records []*alert.Record) *metadata {
+	m := &metadata{
+		Version:     metadataVersion,
+		Rule:        rule,
+		AlertID:     alert.AlertIDFromContext(ctx),
+		Fingerprint: alert.Fingerprint(records),
+		Records:     make([]metadataRecord, 0, len(records)),
+	}
+	var firstFired time.Time
+	if m.FireCount, firstFired = alert.FireCountFromContext(ctx); !firstFired.IsZero() {
+		m.FirstFired = firstFired.UTC().Format(time.RFC3339)
+	}
+	for _, record := range records {
+		r := metadataRecord{Filter: record.Filter}
+		for _, f := range record.Fields {
+			r.Fields = append(r.Fields, metadataField{
+				Key:    f.Key,
+				Count:  f.Count,
+				Value:  f.Value,
+				Number: f.Number,
+				Unit:   f.Unit,
+			})
+		}
+		m.Records = append(m.Records, r)
+	}
+	return m
+}
+
+// metadataAttachment returns the attachment embedding the metadata
+// of the alert made of the records as JSON in a code block.
+func (s *AlertMethod) metadataAttachment(ctx context.Context, rule string, records []*alert.Record) (attachment, error) {
+	data, err := json.Marshal(newMetadata(ctx, rule, records))
+	if err != nil {
+		return attachment{}, err
+	}
+	// The JSON holds no &, < or > since json.Marshal escapes them,
+	// so that it needs no mrkdwn escaping, and backticks are escaped
+	// likewise so that they cannot end the code block
+	data = bytes.ReplaceAll(data, []byte("`"), []byte(`\u0060`))
+
+	att := attachment{
+		Fallback:   metadataTitle,
+		Title:      metadataTitle,
+		Text:       "```\n" + string(data) + "\n```",
+		MarkdownIn: []string{"text"},
+		Color:      queryAttachmentColor,
+	}
+	if s.compat == compatMattermost {
+		att.MarkdownIn = nil
+	}
+	return att, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestWriteMetadata(t *testing.T) {
+	var pl payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL:      ts.URL,
+		IncludeMetadata: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latency := 1500.0
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.service.buckets",
+			Fields: []*alert.Field{
+				{Key: "checkout <eu>", Count: 12},
+				{Key: "search `v2`", Count: 3, Value: "1.5 s", Number: &latency, Unit: alert.UnitMillis},
+			},
+		},
+		{
+			Filter:    "hits.hits._source",
+			BodyField: true,
+			Text:      `{"message": "timeout"}`,
+		},
+	}
+	firstFired := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	ctx := alert.WithFireCount(alert.WithAlertID(context.Background(), "0123456789abcdef"), 3, firstFired)
+	if err = s.Write(ctx, "Test Rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pl.Attachments) != 3 {
+		t.Fatalf("expected 3 attachments, got %d", len(pl.Attachments))
+	}
+	att := pl.Attachments[2]
+	if att.Title != metadataTitle {
+		t.Fatalf("expected the metadata to be the last attachment, got %q", att.Title)
+	}
+	text := strings.TrimSuffix(strings.TrimPrefix(att.Text, "```\n"), "\n```")
+	if strings.ContainsAny(text, "`<>&\n") {
+		t.Fatalf("metadata should not contain backticks, mrkdwn control characters or newlines: %s", text)
+	}
+
+	var got map[string]interface{}
+	if err = json.Unmarshal([]byte(text), &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"version":     float64(metadataVersion),
+		"rule":        "Test Rule",
+		"alert_id":    "0123456789abcdef",
+		"fingerprint": alert.Fingerprint(records),
+		"fire_count":  float64(3),
+		"first_fired": "2019-01-01T00:00:00Z",
+		"records": []interface{}{
+			map[string]interface{}{
+				"filter": "aggregations.service.buckets",
+				"fields": []interface{}{
+					map[string]interface{}{"key": "checkout <eu>", "count": float64(12)},
+					map[string]interface{}{
+						"key":    "search `v2`",
+						"count":  float64(3),
+						"value":  "1.5 s",
+						"number": float64(1500),
+						"unit":   "ms",
+					},
+				},
+			},
+			map[string]interface{}{"filter": "hits.hits._source"},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected metadata:\ngot:      %v\nexpected: %v", got, expected)
+	}
+}
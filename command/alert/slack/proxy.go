@@ -0,0 +1,99 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/httplog"
+	"golang.org/x/xerrors"
+)
+
+// proxyAuthTransport adds the Proxy-Authorization header to
+// plain HTTP requests sent via a proxy. HTTPS requests are
+// authenticated by the CONNECT request using the
+// ProxyConnectHeader of the underlying transport instead.
+type proxyAuthTransport struct {
+	*http.Transport
+	auth string
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && t.Proxy != nil {
+		if u, err := t.Proxy(req); err == nil && u != nil {
+			req = req.Clone(req.Context())
+			req.Header.Set("Proxy-Authorization", t.auth)
+		}
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// newProxyClient returns a copy of client whose transport sends
+// requests via the given proxy. If proxyURL is empty, the proxy
+// is determined by the environment (e.g. HTTPS_PROXY). If username
+// is not empty, requests are authenticated to the proxy with
+// Basic auth. If the client logs its requests, so does the copy.
+func newProxyClient(client *http.Client, proxyURL, username, password string) (*http.Client, error) {
+	base := client.Transport
+	logging, ok := base.(*httplog.Transport)
+	if ok {
+		base = logging.Base
+	}
+
+	var transport *http.Transport
+	switch t := base.(type) {
+	case *http.Transport:
+		transport = t.Clone()
+	case nil:
+		transport = cleanhttp.DefaultPooledTransport()
+	default:
+		return nil, xerrors.New("proxy settings require a client with an *http.Transport")
+	}
+
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, xerrors.Errorf("error parsing proxy URL: %v", err)
+		}
+		if u.User != nil && username == "" {
+			username = u.User.Username()
+			password, _ = u.User.Password()
+		}
+		u.User = nil
+		transport.Proxy = http.ProxyURL(u)
+	} else if transport.Proxy == nil {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+
+	var rt http.RoundTripper = transport
+	if username != "" {
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		transport.ProxyConnectHeader = http.Header{}
+		transport.ProxyConnectHeader.Set("Proxy-Authorization", auth)
+		rt = &proxyAuthTransport{Transport: transport, auth: auth}
+	}
+	if logging != nil {
+		rt = &httplog.Transport{Base: rt, Logger: logging.Logger}
+	}
+
+	return &http.Client{
+		Transport:     rt,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}, nil
+}
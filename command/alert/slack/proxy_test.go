@@ -0,0 +1,167 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/httplog"
+)
+
+func TestWriteProxyAuth(t *testing.T) {
+	const (
+		username = "alerts"
+		password = "s3cret"
+	)
+
+	proxy := newMockProxy(t, "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	defer proxy.Close()
+
+	cases := []struct {
+		name     string
+		tls      bool
+		username string
+		password string
+		err      bool
+	}{
+		{"https-authenticated", true, username, password, false},
+		{"https-unauthenticated", true, "", "", true},
+		{"https-wrong-password", true, username, "wrong", true},
+		{"http-authenticated", false, username, password, false},
+		{"http-unauthenticated", false, "", "", true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+			})
+
+			var ts *httptest.Server
+			if tc.tls {
+				ts = httptest.NewTLSServer(handler)
+			} else {
+				ts = httptest.NewServer(handler)
+			}
+			defer ts.Close()
+
+			s, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:    ts.URL,
+				Client:        ts.Client(),
+				Proxy:         proxy.URL,
+				ProxyUsername: tc.username,
+				ProxyPassword: tc.password,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := []*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "{\n    \"ayy\": \"lmao\"\n}",
+				},
+			}
+			err = s.Write(context.Background(), "test-rule", records)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestNewProxyClientLogging(t *testing.T) {
+	client := httplog.Wrap(cleanhttp.DefaultPooledClient(), hclog.NewNullLogger())
+
+	proxied, err := newProxyClient(client, "http://127.0.0.1:3128", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging, ok := proxied.Transport.(*httplog.Transport)
+	if !ok {
+		t.Fatalf("proxied client should still log its requests (transport: %T)", proxied.Transport)
+	}
+	transport, ok := logging.Base.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		t.Fatal("proxied client should send requests via the proxy")
+	}
+	if transport == client.Transport.(*httplog.Transport).Base {
+		t.Fatal("transport of the original client should not be modified")
+	}
+}
+
+// newMockProxy returns a forward proxy which rejects requests that
+// do not carry the expected Proxy-Authorization header.
+func newMockProxy(t *testing.T, auth string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+			return
+		}
+
+		if r.Method != http.MethodConnect {
+			// Plain HTTP requests would be forwarded; responding
+			// directly is enough to verify authentication
+			if !r.URL.IsAbs() {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(200)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+
+		w.WriteHeader(200)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(upstream, conn) // nolint: errcheck
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(conn, upstream) // nolint: errcheck
+			done <- struct{}{}
+		}()
+		<-done
+	}))
+}
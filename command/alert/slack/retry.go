@@ -0,0 +1,77 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultRetryBase  = 500 * time.Millisecond
+	defaultRetryMax   = 5 * time.Second
+)
+
+// doWithRetry sends the request built by newReq, retrying with
+// capped exponential backoff if the request fails because of a
+// transient network error. Any other error, including an unsuccessful
+// response, is returned immediately.
+func (s *AlertMethod) doWithRetry(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.do(ctx, req)
+		if err == nil || ctx.Err() != nil || !isTransient(err) || attempt >= s.maxRetries {
+			return resp, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff(attempt, s.retryBase, s.retryMax)):
+		}
+	}
+}
+
+// isTransient returns true if err is a network timeout or the
+// connection was refused, in which case the request may succeed
+// if it is attempted again.
+func isTransient(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// backoff returns how long to wait before the given retry attempt
+// (starting at zero). The delay doubles with every attempt up to
+// max, and is jittered so that concurrent alerts do not retry in
+// lockstep.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := max
+	if attempt < 32 && base<<uint(attempt) < max {
+		d = base << uint(attempt)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) // nolint: gosec
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestWriteRetry(t *testing.T) {
+	zero := 0
+	cases := []struct {
+		name       string
+		maxRetries *int
+		refuse     int32
+		status     int
+		attempts   int32
+		err        bool
+	}{
+		{"refused-then-success", nil, 2, 200, 3, false},
+		{"refused-too-often", nil, 10, 200, 4, true},
+		{"non-200-not-retried", nil, 0, 500, 1, true},
+		{"retries-disabled", &zero, 2, 200, 1, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.WriteHeader(tc.status)
+			}))
+			defer ts.Close()
+
+			// The transport refuses the first tc.refuse connections
+			// as though nothing were listening yet
+			var dials int32
+			dialer := &net.Dialer{}
+			transport := &http.Transport{
+				DisableKeepAlives: true,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					if atomic.AddInt32(&dials, 1) <= tc.refuse {
+						return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+					}
+					return dialer.DialContext(ctx, network, addr)
+				},
+			}
+
+			m, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL: ts.URL,
+				Client:     &http.Client{Transport: transport},
+				MaxRetries: tc.maxRetries,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := m.(*AlertMethod)
+			s.retryBase = time.Millisecond
+			s.retryMax = 5 * time.Millisecond
+
+			records := []*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "{\n    \"ayy\": \"lmao\"\n}",
+				},
+			}
+			err = s.Write(context.Background(), "test-rule", records)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+
+			if got := atomic.LoadInt32(&dials); got != tc.attempts {
+				t.Fatalf("unexpected number of attempts (got %d, expected %d)", got, tc.attempts)
+			}
+		})
+	}
+}
+
+func TestWriteRetryCanceled(t *testing.T) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		},
+	}
+
+	m, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL: "http://127.0.0.1:1",
+		Client:     &http.Client{Transport: transport},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := m.(*AlertMethod)
+	s.retryBase = time.Hour
+	s.retryMax = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = s.Write(ctx, "test-rule", []*alert.Record{{Filter: "test", Text: "test"}})
+	if err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Write() did not return when the context was canceled (took %s)", elapsed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+	for attempt := 0; attempt < 40; attempt++ {
+		d := base << uint(attempt)
+		if attempt >= 4 {
+			d = max
+		}
+		got := backoff(attempt, base, max)
+		if got < d/2 || got > d {
+			t.Fatalf("backoff(%d) = %s, expected between %s and %s", attempt, got, d/2, d)
+		}
+	}
+}
@@ -18,19 +18,67 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
+	"text/template"
 	"time"
 
 	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	hclog "github.com/hashicorp/go-hclog"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/mitchellh/mapstructure"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/tlsutil"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
 	"golang.org/x/xerrors"
 )
 
-const defaultTextLimit = 6000
+const (
+	defaultTextLimit = 6000
+
+	// defaultMaxFields is the maximum number of fields Slack
+	// will display in a single attachment
+	defaultMaxFields = 50
+
+	// defaultContentType is the Content-Type header of messages
+	defaultContentType = "application/json"
+
+	// defaultMaxAttachments is the maximum number of attachments
+	// posted in a single message. Slack truncates messages with
+	// more than 100 attachments and recommends no more than 20
+	defaultMaxAttachments = 20
+
+	// maxErrorBody is the number of bytes of the body of an
+	// unsuccessful response included in the error
+	maxErrorBody = 512
+
+	// Accepted values of the 'field_order' option
+	fieldOrderCount     = "count"
+	fieldOrderKey       = "key"
+	fieldOrderInsertion = "insertion"
+
+	// noMatchingBuckets is shown in place of the fields of an
+	// attachment whose fields all had a count of zero
+	noMatchingBuckets = "No matching buckets"
+
+	// thresholdMarker is prepended to the value of a field which
+	// exceeds its threshold (see alert.Field.Exceeds)
+	thresholdMarker = "\u26a0\ufe0f "
+
+	// fireCountTimeFormat is the format of the time since which
+	// the rule has fired identically shown in the footer
+	fireCountTimeFormat = "Jan 2 15:04 MST"
+)
 
 // Ensure AlertMethod adheres to the alert.Method interface.
 var _ alert.Method = (*AlertMethod)(nil)
 
+// Ensure AlertMethod adheres to the alert.ContentFilter interface.
+var _ alert.ContentFilter = (*AlertMethod)(nil)
+
 // AlertMethodConfig configures where Slack alerts should be
 // created and what they should look like.
 type AlertMethodConfig struct {
@@ -40,20 +88,248 @@ type AlertMethodConfig struct {
 	Text        string `mapstructure:"text"`
 	Emoji       string `mapstructure:"emoji"`
 	TextLimit   int    `mapstructure:"text_limit"`
+	MaxFields   int    `mapstructure:"max_fields_per_attachment"`
 	IncludeData bool   `mapstructure:"include_data"`
-	Client      *http.Client
+	UserAgent   string `mapstructure:"user_agent"`
+
+	// IncludeQuery is whether the body of the Elasticsearch query
+	// which produced the alert is appended to the message as an
+	// extra attachment. The values of any fields of the query named
+	// in RedactQuery are replaced with "[REDACTED]"
+	IncludeQuery bool     `mapstructure:"include_query"`
+	RedactQuery  []string `mapstructure:"redact_query"`
+
+	// IncludeMetadata is whether a machine-readable description of
+	// the alert (its rule, alert ID, fingerprint and fields) is
+	// appended to the message as JSON in an extra attachment, for
+	// bots which process the messages
+	IncludeMetadata bool `mapstructure:"include_metadata"`
+
+	// PreserveLinks is whether Slack's link syntax (e.g.
+	// <https://example.com|text> or <!here>) in the filters and text
+	// of records is left as is rather than escaped like any other
+	// &, < and > characters, so that it is rendered as links and
+	// mentions
+	PreserveLinks bool `mapstructure:"preserve_links"`
+
+	// SplitLongMessages is whether records with more than TextLimit
+	// bytes of text or MaxFields fields are split into multiple
+	// attachments. If false, each record is sent in full and Slack
+	// truncates it instead. If nil, records are split
+	SplitLongMessages *bool `mapstructure:"split_long_messages"`
+
+	// MaxAttachments is the maximum number of attachments posted in
+	// a single message. Alerts with more attachments are posted as
+	// multiple messages, each noting which page of the alert it is
+	MaxAttachments int `mapstructure:"max_attachments"`
+
+	// UsernameTemplate and EmojiTemplate are templates (per
+	// text/template) of the username and emoji of each message,
+	// executed with the rule name and the records of the alert. If
+	// a template renders nothing or cannot be rendered, Username or
+	// Emoji is used instead. Text is executed the same way if it
+	// contains any template actions
+	UsernameTemplate string `mapstructure:"username_template"`
+	EmojiTemplate    string `mapstructure:"emoji_template"`
+
+	// HideZeroFields omits fields with neither a count nor a value,
+	// e.g. empty buckets but not the derivative of a bucket in which
+	// the count dropped to zero. If every field of a record is
+	// omitted, the attachment notes that there were no matching
+	// buckets, or is dropped entirely if DropEmptyAttachments is true
+	HideZeroFields       bool `mapstructure:"hide_zero_fields"`
+	DropEmptyAttachments bool `mapstructure:"drop_empty_attachments"`
+
+	// FieldOrder is how the fields of each attachment are sorted:
+	// by count, highest first ("count", the default), alphabetically
+	// by key ("key"), or in the order they were found ("insertion")
+	FieldOrder string `mapstructure:"field_order"`
+
+	// UnfurlLinks and UnfurlMedia control whether Slack expands
+	// links in the message into previews. They apply to the whole
+	// message since Slack ignores them inside attachments
+	UnfurlLinks bool `mapstructure:"unfurl_links"`
+	UnfurlMedia bool `mapstructure:"unfurl_media"`
+
+	// LinkURL is a template (per text/template) of the URL of a
+	// link, e.g. to a Kibana dashboard, added to each attachment as
+	// its title link and as a button labeled LinkText. The template
+	// is executed with the rule name, the record and the time range
+	// of LinkTimeRange leading up to the alert
+	LinkURL       string `mapstructure:"link_url"`
+	LinkText      string `mapstructure:"link_text"`
+	LinkTimeRange string `mapstructure:"link_time_range"`
+
+	// TitleLinkTemplate is a template (per text/template) of the
+	// title link of each attachment, executed like LinkURL. It takes
+	// precedence over LinkURL for the title link, and an attachment
+	// is sent without a title link if it renders an empty or invalid
+	// URL
+	TitleLinkTemplate string `mapstructure:"title_link_template"`
+
+	// BodyTemplate is a template (per text/template) executed with
+	// each of the documents found at the body field of the rule, in
+	// place of showing the JSON of the documents. At most MaxDocs
+	// documents of each record are rendered; if zero, 10 are. If
+	// FlattenDocuments is true, the fields of the nested objects of
+	// each document are also available to the template under their
+	// dotted paths, e.g. {{index . "http.response.status_code"}}
+	BodyTemplate     string `mapstructure:"body_template"`
+	MaxDocs          int    `mapstructure:"max_docs"`
+	FlattenDocuments bool   `mapstructure:"flatten_documents"`
+
+	// SummaryTemplate is a template (per text/template) rendered
+	// like UsernameTemplate as an attachment preceding those of the
+	// records, e.g. "{{.FieldCount}} services affected, {{commas
+	// .FieldSum}} total errors". If it renders nothing, no summary
+	// is sent
+	SummaryTemplate string `mapstructure:"summary_template"`
+
+	// TimestampField is the path (e.g. "@timestamp") of a
+	// field of the documents of each record whose value, in seconds
+	// or milliseconds since the Unix epoch or in RFC3339 format, is
+	// shown as the time of the attachment instead of the current
+	// time, e.g. for alerts about historical data
+	TimestampField string `mapstructure:"timestamp_field"`
+
+	// StripANSI is whether ANSI control sequences (e.g. colors) in
+	// the text of body field records are removed. If ANSIMode is
+	// "fold", a few colors and styles are converted into mrkdwn
+	// emphasis instead, and the text is not shown as a code block
+	// since Slack renders no emphasis in code blocks. If empty,
+	// ANSIMode is "strip"
+	StripANSI bool   `mapstructure:"strip_ansi"`
+	ANSIMode  string `mapstructure:"ansi_mode"`
+
+	// ContentType is the Content-Type header of each message, e.g.
+	// "application/json; charset=utf-8" for receivers which require
+	// a charset. If empty, "application/json" is used
+	ContentType string `mapstructure:"content_type"`
+
+	// IndentJSON is whether messages are encoded as indented rather
+	// than compact JSON
+	IndentJSON bool `mapstructure:"indent_json"`
+
+	// EscapeHTML is whether the characters &, < and > in messages
+	// are escaped (e.g. as \u0026), which some receivers display
+	// literally. If nil, they are escaped
+	EscapeHTML *bool `mapstructure:"escape_html"`
+
+	// Compat adjusts the payload for webhooks which are only mostly
+	// Slack-compatible. Set it to "mattermost" to post to Mattermost
+	Compat string `mapstructure:"compat"`
+
+	// SuccessCodes are the HTTP status codes with which the webhook
+	// may respond to a message which it accepted, e.g. 202 for
+	// receivers which queue messages. If empty, any 2xx status code
+	// is a success
+	SuccessCodes []int `mapstructure:"success_codes"`
+
+	// MaxRetries is the number of times a message is resent if
+	// posting it fails because of a network timeout or a refused
+	// connection. If zero, messages are not resent. If nil, they
+	// are resent up to three times
+	MaxRetries *int `mapstructure:"max_retries"`
+
+	// WebhookURLs are the webhooks to which every message is posted
+	// when the 'webhook' field is a list of URLs, e.g. to mirror
+	// alerts to several workspaces. If RequireAll is false, posting
+	// a message succeeds if any webhook accepted it
+	WebhookURLs []string `mapstructure:"-"`
+	RequireAll  bool     `mapstructure:"require_all"`
+
+	// SnippetThreshold is the size (in bytes) above which the body
+	// of a record is uploaded as a file snippet rather than split
+	// into multiple attachments. Uploading snippets requires BotToken
+	SnippetThreshold int    `mapstructure:"snippet_threshold"`
+	SnippetChannelID string `mapstructure:"snippet_channel_id"`
+	BotToken         string `mapstructure:"bot_token"`
+
+	// Proxy is the URL of the proxy through which requests to
+	// Slack are sent. If ProxyUsername is set, requests will be
+	// authenticated to the proxy with Basic auth
+	Proxy         string `mapstructure:"proxy"`
+	ProxyUsername string `mapstructure:"proxy_username"`
+	ProxyPassword string `mapstructure:"proxy_password"`
+
+	// CACert is the path to a PEM-encoded CA certificate file used
+	// to verify the certificate of the webhook host, e.g. if it is
+	// signed by a private CA. ClientCert and ClientKey are the paths
+	// to a PEM-encoded client certificate and private key presented
+	// to hosts which require mutual TLS
+	CACert             string `mapstructure:"ca_cert"`
+	ClientCert         string `mapstructure:"client_cert"`
+	ClientKey          string `mapstructure:"client_key"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+
+	Client *http.Client
+
+	// Logger is used to log errors which do not prevent an alert
+	// from being sent, e.g. a query which could not be rendered
+	Logger hclog.Logger
 }
 
 // AlertMethod implements the alert.AlertMethod interface
 // for writing new alerts to Slack.
 type AlertMethod struct {
-	webhookURL string
+	webhooks   []string
+	requireAll bool
 	client     *http.Client
 	channel    string
 	username   string
 	text       string
 	emoji      string
 	textLimit  int
+	maxFields  int
+	maxAttach  int
+	noSplit    bool
+	userAgent  string
+	hideZero   bool
+	dropEmpty  bool
+	fieldOrder string
+	compat     string
+
+	successCodes []int
+
+	contentType string
+	indentJSON  bool
+	escapeHTML  bool
+
+	unfurlLinks bool
+	unfurlMedia bool
+	link        *link
+	titleLink   *link
+
+	textTemplate     *template.Template
+	usernameTemplate *template.Template
+	emojiTemplate    *template.Template
+	summaryTemplate  *template.Template
+
+	bodyTemplate *template.Template
+	maxDocs      int
+	flattenDocs  bool
+
+	timestampField string
+
+	stripANSI bool
+	ansiMode  string
+
+	includeQuery bool
+	includeMeta  bool
+	redactQuery  []string
+
+	preserveLinks bool
+
+	maxRetries int
+	retryBase  time.Duration
+	retryMax   time.Duration
+
+	apiURL           string
+	botToken         string
+	snippetThreshold int
+	snippetChannelID string
+
+	logger hclog.Logger
 }
 
 // payload represents the JSON data needed to create a
@@ -64,6 +340,48 @@ type payload struct {
 	Text        string       `json:"text,omitempty"`
 	Emoji       string       `json:"icon_emoji,omitempty"`
 	Attachments []attachment `json:"attachments,omitempty"`
+
+	// UnfurlLinks and UnfurlMedia are always sent since Slack
+	// unfurls links by default when they are absent
+	UnfurlLinks bool `json:"unfurl_links"`
+	UnfurlMedia bool `json:"unfurl_media"`
+}
+
+func init() {
+	alert.Register("slack", newFromConfig)
+	alert.RegisterConfig("slack", AlertMethodConfig{})
+}
+
+// newFromConfig decodes the output configuration and creates
+// a new *AlertMethod.
+func newFromConfig(raw map[string]interface{}, opts *alert.FactoryOptions) (alert.Method, error) {
+	config := new(AlertMethodConfig)
+	if webhook, ok := raw["webhook"]; ok {
+		// The webhook may also be a list of URLs, which is decoded
+		// separately since WebhookURL only holds a single URL
+		if _, ok = webhook.(string); !ok {
+			if err := mapstructure.Decode(webhook, &config.WebhookURLs); err != nil {
+				return nil, xerrors.Errorf("error decoding Slack output configuration: "+
+					"field 'webhook' must be a URL or a list of URLs: %v", err)
+			}
+			rest := make(map[string]interface{}, len(raw))
+			for k, v := range raw {
+				rest[k] = v
+			}
+			delete(rest, "webhook")
+			raw = rest
+		}
+	}
+	if err := mapstructure.Decode(raw, config); err != nil {
+		return nil, xerrors.Errorf("error decoding Slack output configuration: %v", err)
+	}
+	if config.Client == nil && opts != nil {
+		config.Client = opts.Client
+	}
+	if config.Logger == nil && opts != nil {
+		config.Logger = opts.Logger
+	}
+	return NewAlertMethod(config)
 }
 
 // NewAlertMethod creates a new *AlertMethod or a
@@ -73,78 +391,445 @@ func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
 		return nil, xerrors.New("no config provided")
 	}
 
-	if config.WebhookURL == "" {
+	webhooks := config.WebhookURLs
+	if config.WebhookURL != "" {
+		webhooks = append([]string{config.WebhookURL}, webhooks...)
+	}
+	if len(webhooks) == 0 {
 		return nil, xerrors.New("field 'output.config.webhook' must not be empty when using the Slack output method")
 	}
+	for _, webhook := range webhooks {
+		if webhook == "" {
+			return nil, xerrors.New("field 'output.config.webhook' must not contain empty URLs")
+		}
+	}
+
+	if config.SnippetThreshold > 0 && config.BotToken == "" {
+		return nil, xerrors.New("field 'output.config.bot_token' must not be empty when 'output.config.snippet_threshold' is set")
+	}
+
+	if config.MaxAttachments < 0 {
+		return nil, xerrors.New("field 'output.config.max_attachments' must not be negative")
+	}
+
+	switch config.Compat {
+	case "", compatSlack:
+	case compatMattermost:
+		if config.SnippetThreshold > 0 {
+			return nil, xerrors.New("field 'output.config.snippet_threshold' is not supported when 'output.config.compat' is 'mattermost'")
+		}
+	default:
+		return nil, xerrors.Errorf("field 'output.config.compat' must either be '%s' or '%s'", compatSlack, compatMattermost)
+	}
+
+	for _, code := range config.SuccessCodes {
+		if code < 100 || code > 599 {
+			return nil, xerrors.Errorf("field 'output.config.success_codes' contains invalid HTTP status code %d", code)
+		}
+	}
+
+	switch config.ANSIMode {
+	case "":
+		config.ANSIMode = ansiModeStrip
+	case ansiModeStrip, ansiModeFold:
+	default:
+		return nil, xerrors.Errorf("field 'output.config.ansi_mode' must either be '%s' or '%s'",
+			ansiModeStrip, ansiModeFold)
+	}
+
+	switch config.FieldOrder {
+	case "":
+		config.FieldOrder = fieldOrderCount
+	case fieldOrderCount, fieldOrderKey, fieldOrderInsertion:
+	default:
+		return nil, xerrors.Errorf("field 'output.config.field_order' must either be '%s', '%s', or '%s'",
+			fieldOrderCount, fieldOrderKey, fieldOrderInsertion)
+	}
+
+	usernameTemplate, err := parseMessageTemplate("username_template", config.UsernameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	emojiTemplate, err := parseMessageTemplate("emoji_template", config.EmojiTemplate)
+	if err != nil {
+		return nil, err
+	}
+	summaryTemplate, err := parseMessageTemplate("summary_template", config.SummaryTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	// The text is only treated as a template if it contains actions
+	// so that static text is sent exactly as configured
+	text := config.Text
+	var textTemplate *template.Template
+	if strings.Contains(text, "{{") {
+		if textTemplate, err = parseMessageTemplate("text", text); err != nil {
+			return nil, err
+		}
+		text = ""
+	}
+
+	bodyTemplate, err := parseBodyTemplate(config.BodyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case config.MaxDocs < 0:
+		return nil, xerrors.New("field 'output.config.max_docs' must not be negative")
+	case config.MaxDocs == 0:
+		config.MaxDocs = defaultMaxDocs
+	}
+
+	var l *link
+	if config.LinkURL != "" {
+		if l, err = newLink(config.LinkURL, config.LinkText, config.LinkTimeRange); err != nil {
+			return nil, err
+		}
+	}
+
+	var titleLink *link
+	if config.TitleLinkTemplate != "" {
+		if titleLink, err = newTitleLink(config.TitleLinkTemplate, config.LinkTimeRange); err != nil {
+			return nil, err
+		}
+	}
 
 	if config.Client == nil {
 		config.Client = cleanhttp.DefaultClient()
 	}
 
+	if config.Logger == nil {
+		config.Logger = hclog.Default()
+	}
+
+	tlsConfig := &tlsutil.Config{
+		CACert:             config.CACert,
+		ClientCert:         config.ClientCert,
+		ClientKey:          config.ClientKey,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if !tlsConfig.Empty() {
+		client, err := tlsutil.NewClient(config.Client, tlsConfig)
+		if err != nil {
+			return nil, xerrors.Errorf("error configuring TLS: %v", err)
+		}
+		config.Client = client
+	}
+
+	if config.Proxy != "" || config.ProxyUsername != "" {
+		client, err := newProxyClient(config.Client, config.Proxy, config.ProxyUsername, config.ProxyPassword)
+		if err != nil {
+			return nil, err
+		}
+		config.Client = client
+	}
+
 	if config.TextLimit == 0 {
 		config.TextLimit = defaultTextLimit
 	}
 
+	if config.MaxFields == 0 {
+		config.MaxFields = defaultMaxFields
+	}
+
+	if config.MaxAttachments == 0 {
+		config.MaxAttachments = defaultMaxAttachments
+	}
+
+	config.UserAgent = version.UserAgentWith(config.UserAgent)
+
+	maxRetries := defaultMaxRetries
+	if config.MaxRetries != nil {
+		if *config.MaxRetries < 0 {
+			return nil, xerrors.New("field 'output.config.max_retries' must not be negative")
+		}
+		maxRetries = *config.MaxRetries
+	}
+
+	if config.ContentType == "" {
+		config.ContentType = defaultContentType
+	}
+
 	return &AlertMethod{
 		channel:    config.Channel,
-		webhookURL: config.WebhookURL,
+		username:   config.Username,
+		webhooks:   webhooks,
+		requireAll: config.RequireAll,
 		client:     config.Client,
-		text:       config.Text,
+		text:       text,
 		emoji:      config.Emoji,
 		textLimit:  config.TextLimit,
+		maxFields:  config.MaxFields,
+		maxAttach:  config.MaxAttachments,
+		noSplit:    config.SplitLongMessages != nil && !*config.SplitLongMessages,
+		userAgent:  config.UserAgent,
+		hideZero:   config.HideZeroFields,
+		dropEmpty:  config.DropEmptyAttachments,
+		fieldOrder: config.FieldOrder,
+		compat:     config.Compat,
+
+		successCodes: config.SuccessCodes,
+
+		contentType: config.ContentType,
+		indentJSON:  config.IndentJSON,
+		escapeHTML:  config.EscapeHTML == nil || *config.EscapeHTML,
+
+		unfurlLinks: config.UnfurlLinks,
+		unfurlMedia: config.UnfurlMedia,
+		link:        l,
+		titleLink:   titleLink,
+
+		textTemplate:     textTemplate,
+		usernameTemplate: usernameTemplate,
+		emojiTemplate:    emojiTemplate,
+		summaryTemplate:  summaryTemplate,
+
+		bodyTemplate: bodyTemplate,
+		maxDocs:      config.MaxDocs,
+		flattenDocs:  config.FlattenDocuments,
+
+		timestampField: config.TimestampField,
+
+		stripANSI: config.StripANSI,
+		ansiMode:  config.ANSIMode,
+
+		includeQuery: config.IncludeQuery,
+		includeMeta:  config.IncludeMetadata,
+		redactQuery:  config.RedactQuery,
+
+		preserveLinks: config.PreserveLinks,
+
+		maxRetries: maxRetries,
+		retryBase:  defaultRetryBase,
+		retryMax:   defaultRetryMax,
+
+		apiURL:           defaultAPIURL,
+		botToken:         config.BotToken,
+		snippetThreshold: config.SnippetThreshold,
+		snippetChannelID: config.SnippetChannelID,
+
+		logger: config.Logger,
 	}, nil
 }
 
+// Name returns the type of this output method.
+func (s *AlertMethod) Name() string {
+	return "slack"
+}
+
+// IncludedQuery returns the query with the fields of redact_query
+// redacted if include_query is set, or nil otherwise.
+func (s *AlertMethod) IncludedQuery(query map[string]interface{}) map[string]interface{} {
+	if !s.includeQuery {
+		return nil
+	}
+	return alert.RedactQuery(query, s.redactQuery)
+}
+
+// Check sends a HEAD request to each webhook in order to verify
+// that it is reachable. Since webhooks only accept POST requests,
+// any response other than 404 Not Found or a server error is
+// considered a success.
+func (s *AlertMethod) Check(ctx context.Context) error {
+	if len(s.webhooks) == 1 {
+		return s.check(ctx, s.webhooks[0])
+	}
+	var errs *multierror.Error
+	for i, webhook := range s.webhooks {
+		if err := s.check(ctx, webhook); err != nil {
+			errs = multierror.Append(errs, s.webhookError(i, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func (s *AlertMethod) check(ctx context.Context, webhook string) error {
+	req, err := http.NewRequest(http.MethodHead, webhook, nil)
+	if err != nil {
+		return xerrors.Errorf("error creating HTTP request: %v", err)
+	}
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode >= 500 {
+		return xerrors.Errorf("received unexpected status code: %s", resp.Status)
+	}
+	return nil
+}
+
 // Write creates a properly-formatted Slack message from the
 // records and posts it to the webhook defined at the creation
-// of the AlertMethod. If there was an error making the
-// HTTP request, it returns a non-nil error.
+// of the AlertMethod. If the message has more than
+// s.maxAttach attachments, it is posted as multiple messages
+// in order. If there was an error making the HTTP request, it
+// returns a non-nil error and no further messages are posted.
 func (s *AlertMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
 	if records == nil || len(records) < 1 {
 		return nil
 	}
-	return s.post(ctx, s.buildPayload(rule, records))
+	// Filters are escaped before uploading snippets since the records
+	// linking to snippets are given filters including the link, and
+	// documents are rendered first so that snippets hold the rendered
+	// text
+	if !s.HasContent(records) {
+		return nil
+	}
+	var meta attachment
+	if s.includeMeta {
+		var err error
+		if meta, err = s.metadataAttachment(ctx, rule, records); err != nil {
+			return xerrors.Errorf("error encoding metadata: %v", err)
+		}
+	}
+	records, err := s.uploadSnippets(ctx, rule, s.escapeFilters(s.cleanANSI(s.renderDocuments(records))))
+	if err != nil {
+		return err
+	}
+
+	pl := s.buildPayload(ctx, rule, records)
+	if s.includeMeta {
+		pl.Attachments = append(pl.Attachments, meta)
+	}
+	// The pages posted by a previous attempt to send the same alert
+	// are skipped so that a retry resumes at the page which failed
+	pages := s.paginate(pl)
+	progress := alert.ProgressFromContext(ctx)
+	for i := progress.Done(); i < len(pages); i++ {
+		if err := ctx.Err(); err != nil {
+			return xerrors.Errorf("error posting page %d of %d: %v", i+1, len(pages), err)
+		}
+		if err := s.post(ctx, pages[i], i, progress); err != nil {
+			if len(pages) == 1 {
+				return err
+			}
+			return xerrors.Errorf("error posting page %d of %d: %v", i+1, len(pages), err)
+		}
+		progress.SetDone(i + 1)
+	}
+	return nil
+}
+
+// paginate breaks a payload with more than s.maxAttach
+// attachments into multiple payloads, each carrying a slice
+// of the attachments and noting which page it is.
+func (s *AlertMethod) paginate(pl payload) []payload {
+	if s.maxAttach < 1 || len(pl.Attachments) <= s.maxAttach {
+		return []payload{pl}
+	}
+
+	n := (len(pl.Attachments) + s.maxAttach - 1) / s.maxAttach
+	pages := make([]payload, 0, n)
+	for start := 0; start < len(pl.Attachments); start += s.maxAttach {
+		end := start + s.maxAttach
+		if end > len(pl.Attachments) {
+			end = len(pl.Attachments)
+		}
+		page := pl
+		page.Attachments = pl.Attachments[start:end]
+		page.Text = fmt.Sprintf("(page %d of %d)", len(pages)+1, n)
+		if pl.Text != "" {
+			page.Text = pl.Text + " " + page.Text
+		}
+		pages = append(pages, page)
+	}
+	return pages
 }
 
 // buildPayload creates a *Payload instance from the provided
 // records. After being JSON-encoded it can be included in a
 // POST request to a Slack webhook in order to create a new
-// Slack message.
-func (s *AlertMethod) buildPayload(rule string, records []*alert.Record) payload {
+// Slack message. The filters of the records should already be
+// escaped (see escapeFilters); their text is escaped here. If ctx
+// carries an alert ID or a fire count above one, they are shown in
+// the footer of each attachment. If s.includeQuery is true, the
+// query carried by ctx is appended as a final attachment.
+func (s *AlertMethod) buildPayload(ctx context.Context, rule string, records []*alert.Record) payload {
+	msg := &messageData{
+		Rule:    rule,
+		AlertID: alert.AlertIDFromContext(ctx),
+		Records: records,
+	}
+	msg.FireCount, msg.FirstFired = alert.FireCountFromContext(ctx)
 	pl := payload{
-		Channel:  s.channel,
-		Username: s.username,
-		Text:     s.text,
-		Emoji:    s.emoji,
+		Channel:     s.channel,
+		Username:    renderMessageTemplate(s.usernameTemplate, s.username, msg),
+		Text:        renderMessageTemplate(s.textTemplate, s.text, msg),
+		Emoji:       renderMessageTemplate(s.emojiTemplate, s.emoji, msg),
+		UnfurlLinks: s.unfurlLinks,
+		UnfurlMedia: s.unfurlMedia,
 	}
 
 	records = s.preprocess(records)
 
+	footer := defaultAttachmentFooter
+	if msg.AlertID != "" {
+		footer = fmt.Sprintf("%s | Alert ID: %s", footer, msg.AlertID)
+	}
+	if msg.FireCount > 1 {
+		footer = fmt.Sprintf("%s | Fired %d times since %s", footer, msg.FireCount,
+			msg.FirstFired.UTC().Format(fireCountTimeFormat))
+	}
+
+	now := time.Now()
+	if summary := s.summary(msg, footer, now.Unix()); summary != nil {
+		pl.Attachments = append(pl.Attachments, *summary)
+	}
 	for _, record := range records {
 		att := attachment{
 			Title:      rule,
 			Text:       record.Filter,
 			MarkdownIn: []string{"text"},
 			Color:      defaultAttachmentColor,
-			Footer:     defaultAttachmentFooter,
+			Footer:     footer,
 			FooterIcon: defaultAttachmentFooterIcon,
-			Timestamp:  time.Now().Unix(),
+			Timestamp:  s.recordTimestamp(record, now).Unix(),
+		}
+
+		// The attachment is still sent, without the link, if the
+		// link cannot be rendered
+		if s.link != nil {
+			if err := s.link.apply(&att, msg, record, now); err != nil {
+				s.logger.Warn(fmt.Sprintf("[Rule: %q] error rendering 'link_url' of Slack message", rule), "error", err)
+			}
+		}
+		if s.titleLink != nil {
+			att.TitleLink = ""
+			if err := s.titleLink.applyTitle(&att, msg, record, now); err != nil {
+				s.logger.Warn(fmt.Sprintf("[Rule: %q] error rendering 'title_link_template' of Slack message", rule),
+					"error", err)
+			}
 		}
 
 		if record.BodyField && record.Text != "" {
-			att.Text = att.Text + "\n```\n" + record.Text + "\n```"
+			if s.foldsANSI() {
+				att.Text = att.Text + "\n" + s.escape(record.Text)
+			} else {
+				att.Text = att.Text + "\n```\n" + s.escape(record.Text) + "\n```"
+			}
 			att.Color = "#ff0000"
 		}
 
+		if s.hideZero && !record.BodyField && len(record.Fields) == 0 {
+			att.Text = att.Text + "\n_" + noMatchingBuckets + "_"
+		}
+
 		for _, f := range record.Fields {
 			short := false
 			if len(f.Key) <= 35 {
 				short = true
 			}
 
+			value := s.escape(f.Display())
+			if f.Exceeds() {
+				value = thresholdMarker + value
+			}
 			att.Fields = append(att.Fields, field{
 				Title: f.Key,
-				Value: fmt.Sprintf("%d", f.Count),
+				Value: value,
 				Short: short,
 			})
 		}
@@ -152,60 +837,280 @@ func (s *AlertMethod) buildPayload(rule string, records []*alert.Record) payload
 		pl.Attachments = append(pl.Attachments, att)
 	}
 
+	if s.includeQuery {
+		// The message is still sent, without the query, if the
+		// query cannot be rendered
+		query, err := alert.RenderQuery(alert.QueryFromContext(ctx), s.redactQuery)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("[Rule: %q] error rendering query of Slack message", rule), "error", err)
+		}
+		if query != "" {
+			pl.Attachments = append(pl.Attachments, attachment{
+				Title:      "Query",
+				Text:       "```\n" + s.escape(query) + "\n```",
+				MarkdownIn: []string{"text"},
+				Color:      queryAttachmentColor,
+				Footer:     footer,
+				FooterIcon: defaultAttachmentFooterIcon,
+				Timestamp:  now.Unix(),
+			})
+		}
+	}
+
+	if s.compat == compatMattermost {
+		return mattermost(pl)
+	}
 	return pl
 }
 
-func (s *AlertMethod) post(ctx context.Context, pl payload) error {
-	buf := bytes.Buffer{}
-	if err := json.NewEncoder(&buf).Encode(pl); err != nil {
-		return err
+// escape escapes text for inclusion in the mrkdwn of an attachment
+// (see escapeMrkdwn). Mattermost renders Markdown rather than mrkdwn,
+// so text is left as is when posting to Mattermost.
+func (s *AlertMethod) escape(text string) string {
+	if s.compat == compatMattermost {
+		return text
+	}
+	return escapeMrkdwn(text, s.preserveLinks)
+}
+
+// escapeFilters returns copies of the records with their filters
+// escaped. The original records are not modified since they are
+// shared with the other outputs of the rule.
+func (s *AlertMethod) escapeFilters(rawRecords []*alert.Record) []*alert.Record {
+	records := make([]*alert.Record, 0, len(rawRecords))
+	for _, rawRecord := range rawRecords {
+		record := *rawRecord
+		record.Filter = s.escape(rawRecord.Filter)
+		records = append(records, &record)
 	}
-	req, err := http.NewRequest("POST", s.webhookURL, &buf)
+	return records
+}
+
+// post posts the payload, the given page of the message, to each
+// webhook. Unless s.requireAll is true, it only returns an error if
+// no webhook accepted the payload. The webhooks which accepted the
+// page are recorded in progress and skipped by later attempts so
+// that a retry does not post it to them again.
+func (s *AlertMethod) post(ctx context.Context, pl payload, page int, progress *alert.Progress) error {
+	body, err := s.encode(pl)
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req = req.WithContext(ctx)
 
-	resp, err := s.client.Do(req)
+	if len(s.webhooks) == 1 {
+		return s.postBody(ctx, s.webhooks[0], body)
+	}
+	var errs *multierror.Error
+	for i, webhook := range s.webhooks {
+		key := fmt.Sprintf("page %d webhook %d", page, i)
+		if progress.Sent(key) {
+			continue
+		}
+		if err = s.postBody(ctx, webhook, body); err != nil {
+			errs = multierror.Append(errs, s.webhookError(i, err))
+			continue
+		}
+		progress.SetSent(key)
+	}
+	if errs == nil || (!s.requireAll && len(errs.Errors) < len(s.webhooks)) {
+		return nil
+	}
+	return errs
+}
+
+// webhookError notes which of several webhooks an error came
+// from. Webhooks are referred to by position rather than by URL
+// since their URLs are secret.
+func (s *AlertMethod) webhookError(i int, err error) error {
+	return xerrors.Errorf("webhook %d of %d: %v", i+1, len(s.webhooks), err)
+}
+
+func (s *AlertMethod) postBody(ctx context.Context, webhook string, body []byte) error {
+	resp, err := s.doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", webhook, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", s.contentType)
+		return req, nil
+	})
 	if err != nil {
 		return xerrors.Errorf("error making HTTP request: %v", err)
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return xerrors.Errorf("received non-200 status code: %s", resp.Status)
+	if !s.isSuccess(resp.StatusCode) {
+		// Include the start of the body since receivers usually
+		// explain why they rejected the message there
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		if msg := strings.TrimSpace(string(data)); msg != "" {
+			return xerrors.Errorf("received unsuccessful status code: %s: %s", resp.Status, msg)
+		}
+		return xerrors.Errorf("received unsuccessful status code: %s", resp.Status)
 	}
 
-	return err
+	return nil
 }
 
-// preprocess breaks attachments with text greater than s.textLimit
-// into multiple attachments in order to prevent trucation.
+// isSuccess returns true if the webhook accepted the message, i.e.
+// it responded with one of s.successCodes or, if there are none,
+// with any 2xx status code.
+func (s *AlertMethod) isSuccess(code int) bool {
+	if len(s.successCodes) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, c := range s.successCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// encode JSON-encodes the payload, indenting it and escaping
+// HTML characters per the configuration of the AlertMethod.
+func (s *AlertMethod) encode(pl payload) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(s.escapeHTML)
+	if s.indentJSON {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(pl); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// do sets the User-Agent header on the request and sends it.
+func (s *AlertMethod) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if s.userAgent != "" {
+		req.Header.Set("User-Agent", s.userAgent)
+	}
+	return s.client.Do(req.WithContext(ctx))
+}
+
+// preprocess breaks records with more than s.maxFields fields
+// and records with text greater than s.textLimit into multiple
+// attachments in order to prevent truncation, unless s.noSplit
+// is true.
 func (s *AlertMethod) preprocess(records []*alert.Record) []*alert.Record {
 	output := make([]*alert.Record, 0)
 	for _, rawRecord := range records {
-		n := len(rawRecord.Text) / s.textLimit
-		if n < 1 {
+		if s.hideZero {
+			rawRecord = hideZeroFields(rawRecord)
+			if s.dropEmpty && !rawRecord.BodyField && len(rawRecord.Fields) == 0 {
+				continue
+			}
+		}
+		rawRecord = s.sortFields(rawRecord)
+		if s.noSplit {
 			output = append(output, rawRecord)
 			continue
 		}
-		var i int
-		for i = 0; i < n; i++ {
-			chopped := fmt.Sprintf(
-				"(part %d of %d)\n\n%s\n\n(continued)",
-				i+1, n+1, rawRecord.Text[s.textLimit*i:s.textLimit*(i+1)],
-			)
-			record := &alert.Record{
-				Filter:    fmt.Sprintf("%s (%d of %d)", rawRecord.Filter, i+1, n+1),
-				Text:      chopped,
-				BodyField: rawRecord.BodyField,
+		for _, record := range s.splitFields(rawRecord) {
+			output = append(output, s.splitText(record)...)
+		}
+	}
+	return output
+}
+
+// HasContent returns whether any of the records would be sent as an
+// attachment, i.e. unless every one of them has no fields once those
+// with a count of zero are hidden and empty attachments are dropped.
+func (s *AlertMethod) HasContent(records []*alert.Record) bool {
+	for _, record := range records {
+		if !s.hideZero || !s.dropEmpty || record.BodyField || len(hideZeroFields(record).Fields) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hideZeroFields returns a copy of rawRecord without the fields
+// whose count is zero and which have no value. The original record
+// is not modified since it is shared with the other outputs of the
+// rule.
+func hideZeroFields(rawRecord *alert.Record) *alert.Record {
+	record := *rawRecord
+	record.Fields = make([]*alert.Field, 0, len(rawRecord.Fields))
+	for _, f := range rawRecord.Fields {
+		if f.Count != 0 || f.Value != "" {
+			record.Fields = append(record.Fields, f)
+		}
+	}
+	return &record
+}
+
+// sortFields returns a copy of rawRecord with its fields sorted
+// according to s.fieldOrder. Ties are broken by key so that the
+// order is the same every time the same record is rendered.
+func (s *AlertMethod) sortFields(rawRecord *alert.Record) *alert.Record {
+	var less func(a, b *alert.Field) bool
+	switch s.fieldOrder {
+	case fieldOrderCount:
+		less = func(a, b *alert.Field) bool {
+			if a.Count != b.Count {
+				return a.Count > b.Count
 			}
-			output = append(output, record)
+			return a.Key < b.Key
+		}
+	case fieldOrderKey:
+		less = func(a, b *alert.Field) bool {
+			return a.Key < b.Key
+		}
+	default:
+		return rawRecord
+	}
+
+	record := *rawRecord
+	record.Fields = make([]*alert.Field, len(rawRecord.Fields))
+	copy(record.Fields, rawRecord.Fields)
+	sort.SliceStable(record.Fields, func(i, j int) bool {
+		return less(record.Fields[i], record.Fields[j])
+	})
+	return &record
+}
+
+// splitFields breaks a record with more than s.maxFields fields
+// into multiple records, each carrying a slice of the fields.
+func (s *AlertMethod) splitFields(rawRecord *alert.Record) []*alert.Record {
+	if s.maxFields < 1 || len(rawRecord.Fields) <= s.maxFields {
+		return []*alert.Record{rawRecord}
+	}
+
+	output := make([]*alert.Record, 0, len(rawRecord.Fields)/s.maxFields+1)
+	for start := 0; start < len(rawRecord.Fields); start += s.maxFields {
+		end := start + s.maxFields
+		if end > len(rawRecord.Fields) {
+			end = len(rawRecord.Fields)
+		}
+		record := &alert.Record{
+			Filter:    fmt.Sprintf("%s (fields %d–%d)", rawRecord.Filter, start+1, end),
+			BodyField: rawRecord.BodyField,
+			Fields:    rawRecord.Fields[start:end],
 		}
+		if start == 0 {
+			record.Text = rawRecord.Text
+		}
+		output = append(output, record)
+	}
+	return output
+}
+
+// splitText breaks a record with text greater than s.textLimit
+// into multiple records.
+func (s *AlertMethod) splitText(rawRecord *alert.Record) []*alert.Record {
+	n := len(rawRecord.Text) / s.textLimit
+	if n < 1 {
+		return []*alert.Record{rawRecord}
+	}
+	output := make([]*alert.Record, 0, n+1)
+	var i int
+	for i = 0; i < n; i++ {
 		chopped := fmt.Sprintf(
-			"(part %d of %d)\n\n%s", i+1, n+1,
-			rawRecord.Text[s.textLimit*i:],
+			"(part %d of %d)\n\n%s\n\n(continued)",
+			i+1, n+1, rawRecord.Text[s.textLimit*i:s.textLimit*(i+1)],
 		)
 		record := &alert.Record{
 			Filter:    fmt.Sprintf("%s (%d of %d)", rawRecord.Filter, i+1, n+1),
@@ -214,5 +1119,15 @@ func (s *AlertMethod) preprocess(records []*alert.Record) []*alert.Record {
 		}
 		output = append(output, record)
 	}
+	chopped := fmt.Sprintf(
+		"(part %d of %d)\n\n%s", i+1, n+1,
+		rawRecord.Text[s.textLimit*i:],
+	)
+	record := &alert.Record{
+		Filter:    fmt.Sprintf("%s (%d of %d)", rawRecord.Filter, i+1, n+1),
+		Text:      chopped,
+		BodyField: rawRecord.BodyField,
+	}
+	output = append(output, record)
 	return output
 }
@@ -14,17 +14,26 @@
 package slack
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	hclog "github.com/hashicorp/go-hclog"
 	uuid "github.com/hashicorp/go-uuid"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
 )
 
 func TestNewAlertMethod(t *testing.T) {
@@ -48,6 +57,14 @@ func TestNewAlertMethod(t *testing.T) {
 			nil,
 			true,
 		},
+		{
+			"bad-field-order",
+			&AlertMethodConfig{
+				WebhookURL: "https://example.com",
+				FieldOrder: "random",
+			},
+			true,
+		},
 		{
 			"no-webhook",
 			&AlertMethodConfig{
@@ -55,6 +72,38 @@ func TestNewAlertMethod(t *testing.T) {
 			},
 			true,
 		},
+		{
+			"negative-max-attachments",
+			&AlertMethodConfig{
+				WebhookURL:     "https://example.com",
+				MaxAttachments: -1,
+			},
+			true,
+		},
+		{
+			"bad-body-template",
+			&AlertMethodConfig{
+				WebhookURL:   "https://example.com",
+				BodyTemplate: "{{ .message",
+			},
+			true,
+		},
+		{
+			"negative-max-docs",
+			&AlertMethodConfig{
+				WebhookURL: "https://example.com",
+				MaxDocs:    -1,
+			},
+			true,
+		},
+		{
+			"snippet-threshold-without-bot-token",
+			&AlertMethodConfig{
+				WebhookURL:       "https://example.com",
+				SnippetThreshold: 1000,
+			},
+			true,
+		},
 	}
 
 	for _, tc := range cases {
@@ -80,8 +129,8 @@ func TestNewAlertMethod(t *testing.T) {
 				t.Fatalf("got unexpected channel (got %q, expected %q)", s.channel, tc.config.Channel)
 			}
 
-			if s.webhookURL != tc.config.WebhookURL {
-				t.Fatalf("got unexpected webhook URL (got %q, expected %q)", s.webhookURL, tc.config.WebhookURL)
+			if len(s.webhooks) != 1 || s.webhooks[0] != tc.config.WebhookURL {
+				t.Fatalf("got unexpected webhook URLs (got %q, expected %q)", s.webhooks, tc.config.WebhookURL)
 			}
 
 			if s.text != tc.config.Text {
@@ -196,7 +245,7 @@ func TestBuildPayload(t *testing.T) {
 	for _, tc := range cases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			payload := s.buildPayload(rule, tc.records)
+			payload := s.buildPayload(context.Background(), rule, tc.records)
 			if !reflect.DeepEqual(tc.expected.Attachments, payload.Attachments) {
 				t.Fatalf("Got Payload.Attachments:\n%+v\n\nExpected Payload.Attachments:\n%+v\n",
 					prettyJSON(t, payload.Attachments),
@@ -207,189 +256,1428 @@ func TestBuildPayload(t *testing.T) {
 	}
 }
 
-func TestWrite(t *testing.T) {
-	cases := []struct {
-		name    string
-		status  int
-		records []*alert.Record
-		err     bool
-	}{
-		{
-			"success",
-			200,
-			[]*alert.Record{
-				{
-					Filter: "hits.hits._source",
-					Text:   "{\n    \"ayy\": \"lmao\"\n}",
-				},
-				{
-					Filter: "aggregations.hostname.buckets",
-					Fields: []*alert.Field{
-						{
-							Key:   "foo",
-							Count: 3,
-						},
-						{
-							Key:   "bar",
-							Count: 2,
-						},
-					},
-				},
-			},
-			false,
-		},
-		{
-			"no-records",
-			200,
-			[]*alert.Record{},
-			false,
-		},
-		{
-			"wrong-URL",
-			200,
-			[]*alert.Record{
-				{
-					Filter: "hits.hits._source",
-					Text:   "{\n    \"ayy\": \"lmao\"\n}",
-				},
-			},
-			true,
-		},
+func TestBuildPayloadMaxFields(t *testing.T) {
+	fields := make([]*alert.Field, 150)
+	for i := range fields {
+		fields[i] = &alert.Field{
+			Key:   fmt.Sprintf("key-%d", i),
+			Count: i + 1,
+		}
+	}
+
+	s := &AlertMethod{
+		textLimit: defaultTextLimit,
+		maxFields: defaultMaxFields,
+	}
+
+	pl := s.buildPayload(context.Background(), "Test Rule", []*alert.Record{
 		{
-			"non-200-response",
-			201,
-			[]*alert.Record{
-				{
-					Filter: "hits.hits._source",
-					Text:   "{\n    \"ayy\": \"lmao\"\n}",
-				},
-			},
-			true,
+			Filter: "aggregations.hostname.buckets",
+			Fields: fields,
 		},
+	})
+
+	if len(pl.Attachments) != 3 {
+		t.Fatalf("expected 3 attachments (got %d)", len(pl.Attachments))
 	}
 
-	for _, tc := range cases {
-		tc := tc
-		t.Run(tc.name, func(t *testing.T) {
-			ts := newMockSlackServer(tc.status)
+	for i, att := range pl.Attachments {
+		if len(att.Fields) != defaultMaxFields {
+			t.Fatalf("attachment %d has unexpected number of fields (got %d, expected %d)",
+				i, len(att.Fields), defaultMaxFields)
+		}
+		expected := fmt.Sprintf("aggregations.hostname.buckets (fields %d–%d)", i*50+1, (i+1)*50)
+		if att.Text != expected {
+			t.Fatalf("unexpected attachment text (got %q, expected %q)", att.Text, expected)
+		}
+		if att.Fields[0].Title != fmt.Sprintf("key-%d", i*50) {
+			t.Fatalf("attachment %d starts with unexpected field %q", i, att.Fields[0].Title)
+		}
+	}
+}
 
-			defer ts.Close()
+func TestBuildPayloadAlertID(t *testing.T) {
+	s := &AlertMethod{
+		textLimit: defaultTextLimit,
+		maxFields: defaultMaxFields,
+	}
+	records := []*alert.Record{{Filter: "hits.hits._source", Text: "test"}}
 
-			var url string
-			if tc.name == "wrong-URL" {
-				id, err := uuid.GenerateUUID()
-				if err != nil {
-					t.Fatal(err)
-				}
-				url = fmt.Sprintf("http://bad.%s.co.nz", id)
-			} else {
-				url = ts.URL
-			}
+	pl := s.buildPayload(alert.WithAlertID(context.Background(), "0123abcd"), "Test Rule", records)
+	expected := "Go Elasticsearch Alerts | Alert ID: 0123abcd"
+	if pl.Attachments[0].Footer != expected {
+		t.Fatalf("unexpected footer (got %q, expected %q)", pl.Attachments[0].Footer, expected)
+	}
 
-			s, err := NewAlertMethod(&AlertMethodConfig{
-				WebhookURL: url,
-				Text:       "test",
-			})
-			if err != nil {
-				t.Fatal(err)
-			}
+	pl = s.buildPayload(context.Background(), "Test Rule", records)
+	if pl.Attachments[0].Footer != defaultAttachmentFooter {
+		t.Fatalf("unexpected footer (got %q, expected %q)", pl.Attachments[0].Footer, defaultAttachmentFooter)
+	}
+}
 
-			ctx := context.Background()
-			err = s.Write(ctx, "test-rule", tc.records)
-			if tc.err {
-				if err == nil {
-					t.Fatal("expected an error but didn't receive one")
+func TestBuildPayloadFireCount(t *testing.T) {
+	text, err := parseMessageTemplate("text", "{{ .Rule }} fired {{ .FireCount }} times")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &AlertMethod{
+		textLimit:    defaultTextLimit,
+		maxFields:    defaultMaxFields,
+		textTemplate: text,
+	}
+	records := []*alert.Record{{Filter: "hits.hits._source", Text: "test"}}
+	since := time.Date(2019, time.January, 1, 9, 30, 0, 0, time.UTC)
+
+	pl := s.buildPayload(alert.WithFireCount(context.Background(), 7, since), "Test Rule", records)
+	expected := "Go Elasticsearch Alerts | Fired 7 times since Jan 1 09:30 UTC"
+	if pl.Attachments[0].Footer != expected {
+		t.Fatalf("unexpected footer (got %q, expected %q)", pl.Attachments[0].Footer, expected)
+	}
+	if pl.Text != "Test Rule fired 7 times" {
+		t.Fatalf("unexpected text (got %q, expected %q)", pl.Text, "Test Rule fired 7 times")
+	}
+
+	// The first firing is not worth mentioning
+	pl = s.buildPayload(alert.WithFireCount(context.Background(), 1, since), "Test Rule", records)
+	if pl.Attachments[0].Footer != defaultAttachmentFooter {
+		t.Fatalf("unexpected footer (got %q, expected %q)", pl.Attachments[0].Footer, defaultAttachmentFooter)
+	}
+}
+
+func TestBuildPayloadQuery(t *testing.T) {
+	records := []*alert.Record{{Filter: "hits.hits._source", Text: "test"}}
+	query := map[string]interface{}{
+		"term": map[string]interface{}{"token": "secret"},
+	}
+	ctx := alert.WithQuery(context.Background(), query)
+
+	cases := []struct {
+		name     string
+		include  bool
+		redact   []string
+		expected string
+	}{
+		{"disabled", false, nil, ""},
+		{"enabled", true, nil, "```\n{\n  \"term\": {\n    \"token\": \"secret\"\n  }\n}\n```"},
+		{"redacted", true, []string{"token"}, "```\n{\n  \"term\": {\n    \"token\": \"[REDACTED]\"\n  }\n}\n```"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := &AlertMethod{
+				textLimit:    defaultTextLimit,
+				maxFields:    defaultMaxFields,
+				includeQuery: tc.include,
+				redactQuery:  tc.redact,
+			}
+			pl := s.buildPayload(ctx, "Test Rule", records)
+			if tc.expected == "" {
+				if len(pl.Attachments) != 1 {
+					t.Fatalf("expected only the attachment of the record but got %d attachments", len(pl.Attachments))
 				}
 				return
 			}
-			if err != nil {
-				t.Fatal(err)
+			if len(pl.Attachments) != 2 {
+				t.Fatalf("expected an attachment of the query but got %d attachments", len(pl.Attachments))
+			}
+			att := pl.Attachments[1]
+			if att.Title != "Query" {
+				t.Fatalf("unexpected title (got %q, expected %q)", att.Title, "Query")
+			}
+			if att.Text != tc.expected {
+				t.Fatalf("unexpected text:\nGot:\n%s\nExpected:\n%s", att.Text, tc.expected)
 			}
 		})
 	}
 }
 
-func newMockSlackServer(status int) *httptest.Server {
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "POST":
-			ct := r.Header.Get("Content-Type")
-			if ct == "" || ct != "application/json" {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
-			}
+func TestBuildPayloadQueryError(t *testing.T) {
+	records := []*alert.Record{{Filter: "hits.hits._source", Text: "test"}}
+	query := map[string]interface{}{"term": make(chan int)}
+	ctx := alert.WithQuery(context.Background(), query)
 
-			var data map[string]interface{}
-			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-				http.Error(w, "Internal Server Error", 500)
-				return
-			}
+	buf := new(bytes.Buffer)
+	s := &AlertMethod{
+		textLimit:    defaultTextLimit,
+		maxFields:    defaultMaxFields,
+		includeQuery: true,
+		logger:       hclog.New(&hclog.LoggerOptions{Output: buf}),
+	}
+	pl := s.buildPayload(ctx, "Test Rule", records)
+	if len(pl.Attachments) != 1 {
+		t.Fatalf("expected only the attachment of the record but got %d attachments", len(pl.Attachments))
+	}
+	expected := `[Rule: "Test Rule"] error rendering query of Slack message: error="json: unsupported type: chan int"`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("Expected logs to contain:\n\t%s\nGot:\n\t%s", expected, buf.String())
+	}
+}
 
-			text, ok := data["text"].(string)
-			if !ok || text == "" {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
-			}
-			w.WriteHeader(status)
-			w.Write([]byte("OK"))
-			return
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
+func TestBuildPayloadNoSplit(t *testing.T) {
+	fields := make([]*alert.Field, 150)
+	for i := range fields {
+		fields[i] = &alert.Field{
+			Key:   fmt.Sprintf("key-%d", i),
+			Count: i + 1,
 		}
-	}))
-}
+	}
+	text := strings.Repeat("a", 5*defaultTextLimit/2)
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: fields,
+		},
+		{
+			Filter:    "hits.hits._source",
+			Text:      text,
+			BodyField: true,
+		},
+	}
 
-func prettyJSON(t *testing.T, v interface{}) string {
-	data, err := json.MarshalIndent(v, "", "    ")
+	split := false
+	a, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL:        "https://example.com",
+		SplitLongMessages: &split,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	return string(data)
+	s := a.(*AlertMethod)
+
+	pl := s.buildPayload(context.Background(), "Test Rule", records)
+	if len(pl.Attachments) != 2 {
+		t.Fatalf("expected 2 attachments (got %d)", len(pl.Attachments))
+	}
+	if len(pl.Attachments[0].Fields) != len(fields) {
+		t.Fatalf("expected all %d fields in one attachment (got %d)", len(fields), len(pl.Attachments[0].Fields))
+	}
+	if expected := "hits.hits._source\n```\n" + text + "\n```"; pl.Attachments[1].Text != expected {
+		t.Fatal("expected the full text in one attachment")
+	}
+	if strings.Contains(pl.Attachments[1].Text, "(part ") {
+		t.Fatal("text should not be marked as split")
+	}
+
+	// Records are split by default
+	a, err = NewAlertMethod(&AlertMethodConfig{WebhookURL: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pl = a.(*AlertMethod).buildPayload(context.Background(), "Test Rule", records); len(pl.Attachments) != 6 {
+		t.Fatalf("expected 6 attachments when splitting (got %d)", len(pl.Attachments))
+	}
 }
 
-func ExampleAlertMethod_buildPayload() {
+func TestBuildPayloadHideZeroFields(t *testing.T) {
 	records := []*alert.Record{
 		{
-			Filter:    "hits.hits._source",
-			Text:      `Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat. Duis aute irure dolor in reprehenderit in voluptate velit esse cillum dolore eu fugiat nulla pariatur. Excepteur sint occaecat cupidatat non proident, sunt in culpa qui officia deserunt mollit anim id est laborum.`,
-			BodyField: true,
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{
+				{Key: "foo", Count: 0},
+				{Key: "bar", Count: 2},
+				{Key: "baz", Count: 0, Value: "-3.5"},
+			},
 		},
 		{
-			Filter: "aggregation.hostname.buckets",
+			Filter: "aggregations.program.buckets",
 			Fields: []*alert.Field{
-				{
-					Key:   "foo",
-					Count: 2,
-				},
-				{
-					Key:   "bar",
-					Count: 3,
-				},
+				{Key: "ayy", Count: 0},
+				{Key: "lmao", Count: 0},
 			},
 		},
 	}
 
-	a, _ := NewAlertMethod(&AlertMethodConfig{
-		WebhookURL: "https://hooks.slack.com/services/ABCDEFG",
-		Channel:    "#alerts",
-		Text:       "New alert!",
-		Emoji:      ":robot",
-		TextLimit:  200,
-	})
-
-	sm := a.(*AlertMethod)
-
-	payload := sm.buildPayload("Test rule", records)
-
-	// This loop is performed in order that tests will pass --
-	// it is not necessary to perform this
-	for i := range payload.Attachments {
-		payload.Attachments[i].Timestamp = 1
+	cases := []struct {
+		name      string
+		hideZero  bool
+		dropEmpty bool
+		texts     []string
+		fields    []int
+	}{
+		{
+			"disabled",
+			false,
+			false,
+			[]string{"aggregations.hostname.buckets", "aggregations.program.buckets"},
+			[]int{3, 2},
+		},
+		{
+			"note",
+			true,
+			false,
+			[]string{"aggregations.hostname.buckets", "aggregations.program.buckets\n_No matching buckets_"},
+			[]int{2, 0},
+		},
+		{
+			"drop",
+			true,
+			true,
+			[]string{"aggregations.hostname.buckets"},
+			[]int{2},
+		},
 	}
-	data, _ := json.MarshalIndent(payload, "", "    ")
-
-	fmt.Println(string(data))
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := &AlertMethod{
+				textLimit: defaultTextLimit,
+				maxFields: defaultMaxFields,
+				hideZero:  tc.hideZero,
+				dropEmpty: tc.dropEmpty,
+			}
+
+			pl := s.buildPayload(context.Background(), "Test Rule", records)
+			if len(pl.Attachments) != len(tc.texts) {
+				t.Fatalf("unexpected number of attachments (got %d, expected %d)", len(pl.Attachments), len(tc.texts))
+			}
+			for i, att := range pl.Attachments {
+				if att.Text != tc.texts[i] {
+					t.Errorf("unexpected text of attachment %d (got %q, expected %q)", i, att.Text, tc.texts[i])
+				}
+				if len(att.Fields) != tc.fields[i] {
+					t.Errorf("unexpected number of fields in attachment %d (got %d, expected %d)",
+						i, len(att.Fields), tc.fields[i])
+				}
+			}
+		})
+	}
+
+	// The records are shared with other outputs and must not be modified
+	if len(records[0].Fields) != 3 || len(records[1].Fields) != 2 {
+		t.Fatal("buildPayload() modified the records")
+	}
+}
+
+func TestBuildPayloadFieldValue(t *testing.T) {
+	s := &AlertMethod{
+		textLimit: defaultTextLimit,
+		maxFields: defaultMaxFields,
+	}
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{
+				{Key: "integer", Count: 2},
+				{Key: "float", Count: 3, Value: "12.345"},
+				{Key: "string", Count: 4, Value: "<degraded>"},
+			},
+		},
+	}
+
+	pl := s.buildPayload(context.Background(), "Test Rule", records)
+	expected := []string{"2", "12.345", "&lt;degraded&gt;"}
+	if len(pl.Attachments[0].Fields) != len(expected) {
+		t.Fatalf("unexpected number of fields (got %d, expected %d)", len(pl.Attachments[0].Fields), len(expected))
+	}
+	for i, f := range pl.Attachments[0].Fields {
+		if f.Value != expected[i] {
+			t.Errorf("unexpected value of field %q (got %q, expected %q)", f.Title, f.Value, expected[i])
+		}
+	}
+}
+
+func TestBuildPayloadFieldThreshold(t *testing.T) {
+	s := &AlertMethod{
+		textLimit: defaultTextLimit,
+		maxFields: defaultMaxFields,
+	}
+	number := func(v float64) *float64 { return &v }
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{
+				{Key: "size", Count: 2, Value: "536870912", Number: number(536870912), Unit: alert.UnitBytes},
+				{Key: "slow", Count: 3, Value: "1234", Number: number(1234), Unit: alert.UnitMillis,
+					Threshold: number(1000)},
+				{Key: "fast", Count: 4, Value: "250", Number: number(250), Unit: alert.UnitMillis,
+					Threshold: number(1000)},
+				{Key: "plain", Count: 5, Value: "12.5", Number: number(12.5), Threshold: number(10)},
+			},
+		},
+	}
+
+	pl := s.buildPayload(context.Background(), "Test Rule", records)
+	expected := []string{"512 MB", thresholdMarker + "1.2 s", "250 ms", thresholdMarker + "12.5"}
+	if len(pl.Attachments[0].Fields) != len(expected) {
+		t.Fatalf("unexpected number of fields (got %d, expected %d)", len(pl.Attachments[0].Fields), len(expected))
+	}
+	for i, f := range pl.Attachments[0].Fields {
+		if f.Value != expected[i] {
+			t.Errorf("unexpected value of field %q (got %q, expected %q)", f.Title, f.Value, expected[i])
+		}
+	}
+}
+
+func TestBuildPayloadDocuments(t *testing.T) {
+	documents := []map[string]interface{}{
+		{"level": "error", "message": "disk full"},
+		{"level": "warn", "message": "disk <90%> full"},
+		{"level": "error", "message": "out of memory"},
+	}
+	cases := []struct {
+		name      string
+		textLimit int
+		maxDocs   int
+		expected  []string
+	}{
+		{
+			"all-documents",
+			defaultTextLimit,
+			defaultMaxDocs,
+			[]string{
+				"hits.hits._source\n```\n[error] disk full" + documentDelimiter +
+					"[warn] disk &lt;90%&gt; full" + documentDelimiter +
+					"[error] out of memory\n```",
+			},
+		},
+		{
+			"max-docs",
+			defaultTextLimit,
+			2,
+			[]string{
+				"hits.hits._source\n```\n[error] disk full" + documentDelimiter +
+					"[warn] disk &lt;90%&gt; full\n\n(and 1 more documents)\n```",
+			},
+		},
+		{
+			"chunked",
+			80,
+			defaultMaxDocs,
+			[]string{
+				"hits.hits._source (1 of 2)\n```\n(part 1 of 2)\n\n[error] disk full" + documentDelimiter +
+					"[warn] disk &lt;90%&gt; ful\n\n(continued)\n```",
+				"hits.hits._source (2 of 2)\n```\n(part 2 of 2)\n\nl" + documentDelimiter +
+					"[error] out of memory\n```",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:   "https://example.com",
+				TextLimit:    tc.textLimit,
+				BodyTemplate: "[{{ .level }}] {{ .message }}",
+				MaxDocs:      tc.maxDocs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := a.(*AlertMethod)
+
+			records := []*alert.Record{
+				{
+					Filter:    "hits.hits._source",
+					Text:      "unrendered",
+					BodyField: true,
+					Documents: documents,
+				},
+			}
+			pl := s.buildPayload(context.Background(), "Test Rule", s.renderDocuments(records))
+			if len(pl.Attachments) != len(tc.expected) {
+				t.Fatalf("unexpected number of attachments (got %d, expected %d)",
+					len(pl.Attachments), len(tc.expected))
+			}
+			for i, att := range pl.Attachments {
+				if att.Text != tc.expected[i] {
+					t.Errorf("unexpected text of attachment %d:\ngot:\n%s\n\nexpected:\n%s", i, att.Text, tc.expected[i])
+				}
+			}
+			if records[0].Text != "unrendered" {
+				t.Errorf("original record was modified (got text %q)", records[0].Text)
+			}
+		})
+	}
+}
+
+func TestBuildPayloadFieldOrder(t *testing.T) {
+	record := &alert.Record{
+		Filter: "aggregations.hostname.buckets",
+		Fields: []*alert.Field{
+			{Key: "charlie", Count: 2},
+			{Key: "alpha", Count: 1},
+			{Key: "delta", Count: 5},
+			{Key: "bravo", Count: 2},
+		},
+	}
+
+	cases := []struct {
+		order    string
+		expected []string
+	}{
+		{fieldOrderCount, []string{"delta", "bravo", "charlie", "alpha"}},
+		{fieldOrderKey, []string{"alpha", "bravo", "charlie", "delta"}},
+		{fieldOrderInsertion, []string{"charlie", "alpha", "delta", "bravo"}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.order, func(t *testing.T) {
+			s := &AlertMethod{
+				textLimit:  defaultTextLimit,
+				maxFields:  defaultMaxFields,
+				fieldOrder: tc.order,
+			}
+
+			for i := 0; i < 10; i++ {
+				pl := s.buildPayload(context.Background(), "Test Rule", []*alert.Record{record})
+				got := make([]string, 0, len(pl.Attachments[0].Fields))
+				for _, f := range pl.Attachments[0].Fields {
+					got = append(got, f.Title)
+				}
+				if !reflect.DeepEqual(got, tc.expected) {
+					t.Fatalf("unexpected field order on build %d (got %v, expected %v)", i+1, got, tc.expected)
+				}
+			}
+
+			if record.Fields[0].Key != "charlie" {
+				t.Fatal("buildPayload() modified the order of the record's fields")
+			}
+		})
+	}
+}
+
+func TestBuildPayloadUnfurl(t *testing.T) {
+	cases := []struct {
+		name        string
+		unfurlLinks bool
+		unfurlMedia bool
+	}{
+		{"default", false, false},
+		{"links", true, false},
+		{"media", false, true},
+		{"both", true, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			method, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:  "https://hooks.slack.com/services/test",
+				UnfurlLinks: tc.unfurlLinks,
+				UnfurlMedia: tc.unfurlMedia,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := method.(*AlertMethod)
+
+			pl := s.buildPayload(context.Background(), "Test Rule", []*alert.Record{{Filter: "hits.hits._source", Text: "https://kibana.example.com"}})
+			data, err := json.Marshal(pl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got map[string]interface{}
+			if err = json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got["unfurl_links"] != tc.unfurlLinks {
+				t.Fatalf("unexpected unfurl_links (got %v, expected %v)", got["unfurl_links"], tc.unfurlLinks)
+			}
+			if got["unfurl_media"] != tc.unfurlMedia {
+				t.Fatalf("unexpected unfurl_media (got %v, expected %v)", got["unfurl_media"], tc.unfurlMedia)
+			}
+			for _, att := range got["attachments"].([]interface{}) {
+				if _, ok := att.(map[string]interface{})["unfurl_links"]; ok {
+					t.Fatal("unfurl_links should not be set on attachments")
+				}
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  int
+		records []*alert.Record
+		err     bool
+	}{
+		{
+			"success",
+			200,
+			[]*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "{\n    \"ayy\": \"lmao\"\n}",
+				},
+				{
+					Filter: "aggregations.hostname.buckets",
+					Fields: []*alert.Field{
+						{
+							Key:   "foo",
+							Count: 3,
+						},
+						{
+							Key:   "bar",
+							Count: 2,
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"no-records",
+			200,
+			[]*alert.Record{},
+			false,
+		},
+		{
+			"wrong-URL",
+			200,
+			[]*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "{\n    \"ayy\": \"lmao\"\n}",
+				},
+			},
+			true,
+		},
+		{
+			"accepted-response",
+			202,
+			[]*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "{\n    \"ayy\": \"lmao\"\n}",
+				},
+			},
+			false,
+		},
+		{
+			"non-2xx-response",
+			500,
+			[]*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "{\n    \"ayy\": \"lmao\"\n}",
+				},
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newMockSlackServer(tc.status)
+
+			defer ts.Close()
+
+			var url string
+			if tc.name == "wrong-URL" {
+				id, err := uuid.GenerateUUID()
+				if err != nil {
+					t.Fatal(err)
+				}
+				url = fmt.Sprintf("http://bad.%s.co.nz", id)
+			} else {
+				url = ts.URL
+			}
+
+			s, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL: url,
+				Text:       "test",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			err = s.Write(ctx, "test-rule", tc.records)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriteSuccessCodes(t *testing.T) {
+	cases := []struct {
+		name   string
+		codes  []int
+		status int
+		err    string
+	}{
+		{"default-2xx", nil, 204, ""},
+		{"default-redirect", nil, 302, "302 Found: rejected"},
+		{"custom", []int{200, 299}, 299, ""},
+		{"custom-not-listed", []int{200}, 202, "202 Accepted: rejected"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				if tc.status != 204 {
+					fmt.Fprintln(w, "rejected")
+				}
+			}))
+			defer ts.Close()
+
+			s, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:   ts.URL,
+				SuccessCodes: tc.codes,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Write(context.Background(), "test-rule", []*alert.Record{{Filter: "test", Text: "test"}})
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("error %q does not contain %q", err.Error(), tc.err)
+			}
+		})
+	}
+
+	if _, err := NewAlertMethod(&AlertMethodConfig{WebhookURL: "http://example.com", SuccessCodes: []int{42}}); err == nil {
+		t.Fatal("expected an error for an invalid status code but didn't receive one")
+	}
+}
+
+func TestWriteWebhooks(t *testing.T) {
+	cases := []struct {
+		name       string
+		statuses   []int
+		requireAll bool
+		err        string
+	}{
+		{"all-accepted", []int{200, 200}, false, ""},
+		{"one-rejected", []int{200, 500}, false, ""},
+		{"one-rejected-require-all", []int{200, 500}, true, "webhook 2 of 2: received unsuccessful status code: 500"},
+		{"all-rejected", []int{500, 404}, false, "webhook 1 of 2"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			received := make([]payload, len(tc.statuses))
+			webhooks := make([]interface{}, 0, len(tc.statuses))
+			for i, status := range tc.statuses {
+				i, status := i, status
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if err := json.NewDecoder(r.Body).Decode(&received[i]); err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					w.WriteHeader(status)
+				}))
+				defer ts.Close()
+				webhooks = append(webhooks, ts.URL)
+			}
+
+			s, err := newFromConfig(map[string]interface{}{
+				"webhook":     webhooks,
+				"require_all": tc.requireAll,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Write(context.Background(), "test-rule", []*alert.Record{{Filter: "test", Text: "test"}})
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+
+			// Every webhook is posted to even if an earlier one failed
+			for i, pl := range received {
+				if len(pl.Attachments) != 1 || pl.Attachments[0].Text != "test" {
+					t.Fatalf("webhook %d did not receive the payload: %+v", i+1, pl)
+				}
+			}
+		})
+	}
+
+	if _, err := newFromConfig(map[string]interface{}{"webhook": "https://example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	empty := []interface{}{"https://example.com", ""}
+	if _, err := newFromConfig(map[string]interface{}{"webhook": empty}, nil); err == nil {
+		t.Fatal("expected an error for an empty webhook URL but didn't receive one")
+	}
+	if _, err := newFromConfig(map[string]interface{}{"webhook": 42}, nil); err == nil {
+		t.Fatal("expected an error for an invalid webhook but didn't receive one")
+	}
+}
+
+func TestWriteWebhooksResume(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		posts [2]int
+		fail  = true
+	)
+	webhooks := make([]interface{}, 0, len(posts))
+	for i := range posts {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			posts[i]++
+			// The mirror fails the first time it is posted to
+			if i == 1 && fail {
+				fail = false
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(200)
+		}))
+		defer ts.Close()
+		webhooks = append(webhooks, ts.URL)
+	}
+
+	s, err := newFromConfig(map[string]interface{}{
+		"webhook":     webhooks,
+		"require_all": true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*alert.Record{{Filter: "test", Text: "test"}}
+	ctx := alert.WithProgress(context.Background(), new(alert.Progress))
+	if err = s.Write(ctx, "test-rule", records); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if err = s.Write(ctx, "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry only posts to the mirror which failed
+	if posts != [2]int{1, 2} {
+		t.Fatalf("unexpected number of posts to each webhook (got %v, expected %v)", posts, [2]int{1, 2})
+	}
+}
+
+func TestWriteUserAgent(t *testing.T) {
+	cases := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{"default", "", version.UserAgent()},
+		{"appended", "custom-agent/1.0", version.UserAgent() + " custom-agent/1.0"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("User-Agent")
+				w.WriteHeader(200)
+			}))
+			defer ts.Close()
+
+			s, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL: ts.URL,
+				UserAgent:  tc.userAgent,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := []*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "{\n    \"ayy\": \"lmao\"\n}",
+				},
+			}
+			if err = s.Write(context.Background(), "test-rule", records); err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Fatalf("got unexpected User-Agent (got %q, expected %q)", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestWriteUsername(t *testing.T) {
+	cases := []struct {
+		name     string
+		username string
+	}{
+		{"unset", ""},
+		{"configured", "alerts-bot"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var got map[string]interface{}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(200)
+			}))
+			defer ts.Close()
+
+			s, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL: ts.URL,
+				Username:   tc.username,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := []*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "{\n    \"ayy\": \"lmao\"\n}",
+				},
+			}
+			if err = s.Write(context.Background(), "test-rule", records); err != nil {
+				t.Fatal(err)
+			}
+
+			username, ok := got["username"]
+			if tc.username == "" {
+				if ok {
+					t.Fatalf("username should be omitted when not configured (got %v)", username)
+				}
+				return
+			}
+			if username != tc.username {
+				t.Fatalf("got unexpected username (got %v, expected %q)", username, tc.username)
+			}
+		})
+	}
+}
+
+func TestWriteDisabled(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL: ts.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	ah := alert.NewHandler(&alert.HandlerConfig{
+		Logger: hclog.New(&hclog.LoggerOptions{Output: buf}),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outputCh := make(chan *alert.Alert, 1)
+	outputCh <- &alert.Alert{
+		ID:       "test-alert",
+		RuleName: "test-rule",
+		Methods:  []alert.Method{alert.Disable(s)},
+		Records: []*alert.Record{
+			{
+				Filter: "hits.hits._source",
+				Text:   "{\n    \"ayy\": \"lmao\"\n}",
+			},
+		},
+	}
+
+	go ah.Run(ctx, outputCh)
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	<-ah.DoneCh
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("disabled output made %d HTTP requests", n)
+	}
+	if expected := `skipping disabled output of rule "test-rule": method=slack`; !strings.Contains(buf.String(), expected) {
+		t.Fatalf("Expected logs to contain:\n\t%s\nGot:\n\t%s", expected, buf.String())
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL:           ts.URL,
+		HideZeroFields:       true,
+		DropEmptyAttachments: true,
+		IncludeQuery:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.hostname.buckets",
+			Fields: []*alert.Field{{Key: "foo", Count: 0}, {Key: "bar", Count: 0}},
+		},
+		{
+			Filter: "aggregations.program.buckets",
+		},
+	}
+	if err = s.Write(context.Background(), "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	ah := alert.NewHandler(&alert.HandlerConfig{
+		Logger: hclog.New(&hclog.LoggerOptions{Output: buf, Level: hclog.Debug}),
+	})
+	err = ah.Send(context.Background(), &alert.Alert{
+		ID:       "test-alert",
+		RuleName: "test-rule",
+		Methods:  []alert.Method{s},
+		Records:  records,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("output made %d HTTP requests for an alert with no content", n)
+	}
+	expected := `no content of rule "test-rule" left to send with output: method=slack`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("Expected logs to contain:\n\t%s\nGot:\n\t%s", expected, buf.String())
+	}
+
+	// A single non-zero field is enough to send the alert
+	records[0].Fields[1].Count = 3
+	if err = s.Write(context.Background(), "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 HTTP request, got %d", n)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		err     bool
+	}{
+		{
+			"method-not-allowed",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			},
+			false,
+		},
+		{
+			"not-found",
+			http.NotFound,
+			true,
+		},
+		{
+			"server-error",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var method string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method = r.Method
+				tc.handler(w, r)
+			}))
+			defer ts.Close()
+
+			s, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL: ts.URL,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.(alert.Checker).Check(context.Background())
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+			if method != http.MethodHead {
+				t.Fatalf("unexpected request method (got %q, expected %q)", method, http.MethodHead)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		ts := httptest.NewServer(http.NotFoundHandler())
+		ts.Close()
+
+		s, err := NewAlertMethod(&AlertMethodConfig{
+			WebhookURL: ts.URL,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.(alert.Checker).Check(context.Background()); err == nil {
+			t.Fatal("expected an error but didn't receive one")
+		}
+	})
+}
+
+func TestWriteEncoding(t *testing.T) {
+	f := false
+	cases := []struct {
+		name        string
+		config      *AlertMethodConfig
+		contentType string
+		contains    []string
+		excludes    []string
+	}{
+		{
+			"default",
+			&AlertMethodConfig{},
+			"application/json",
+			[]string{`\u0026 \u003cb\u003e`},
+			[]string{"<b>", "\n  "},
+		},
+		{
+			"no-escape-html",
+			&AlertMethodConfig{
+				EscapeHTML: &f,
+			},
+			"application/json",
+			[]string{"& <b>"},
+			[]string{`\u0026`, `\u003c`},
+		},
+		{
+			"content-type-and-indent",
+			&AlertMethodConfig{
+				ContentType: "application/json; charset=utf-8",
+				IndentJSON:  true,
+			},
+			"application/json; charset=utf-8",
+			[]string{"{\n  \"", `\u0026`},
+			nil,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				contentType string
+				body        []byte
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				contentType = r.Header.Get("Content-Type")
+				body, _ = ioutil.ReadAll(r.Body)
+				w.WriteHeader(200)
+			}))
+			defer ts.Close()
+
+			tc.config.WebhookURL = ts.URL
+			tc.config.Text = "Tom & <b>Jerry</b>"
+			s, err := NewAlertMethod(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := []*alert.Record{
+				{
+					Filter: "hits.hits._source",
+					Text:   "a & <b>",
+				},
+			}
+			if err = s.Write(context.Background(), "test-rule", records); err != nil {
+				t.Fatal(err)
+			}
+
+			if contentType != tc.contentType {
+				t.Fatalf("unexpected Content-Type (got %q, expected %q)", contentType, tc.contentType)
+			}
+			for _, want := range tc.contains {
+				if !strings.Contains(string(body), want) {
+					t.Fatalf("expected message to contain %q:\n%s", want, body)
+				}
+			}
+			for _, unwanted := range tc.excludes {
+				if strings.Contains(string(body), unwanted) {
+					t.Fatalf("expected message not to contain %q:\n%s", unwanted, body)
+				}
+			}
+
+			var pl payload
+			if err = json.Unmarshal(body, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.Text != "Tom & <b>Jerry</b>" {
+				t.Fatalf("unexpected text (got %q, expected %q)", pl.Text, "Tom & <b>Jerry</b>")
+			}
+		})
+	}
+}
+
+func TestWriteMalformedBody(t *testing.T) {
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s, err := NewAlertMethod(&AlertMethodConfig{WebhookURL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bodies are posted as the text they were given rather than
+	// parsed, so a malformed body does not affect the other records
+	records := []*alert.Record{
+		{
+			Filter:    "hits.hits._source",
+			Text:      "{\n    \"ayy\": \"lmao\"\n}",
+			BodyField: true,
+		},
+		{
+			Filter:    "hits.hits._source",
+			Text:      "{\"ayy\": ",
+			BodyField: true,
+		},
+	}
+	if err = s.Write(context.Background(), "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bodies) != 1 {
+		t.Fatalf("expected one message to be posted, got %d", len(bodies))
+	}
+	var pl payload
+	if err = json.Unmarshal(bodies[0], &pl); err != nil {
+		t.Fatal(err)
+	}
+	if len(pl.Attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(pl.Attachments))
+	}
+	for i, record := range records {
+		if expected := "```\n" + record.Text + "\n```"; !strings.Contains(pl.Attachments[i].Text, expected) {
+			t.Fatalf("expected attachment %d to contain %q:\n%s", i+1, expected, pl.Attachments[i].Text)
+		}
+	}
+}
+
+func TestWriteMrkdwnEscaping(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   *AlertMethodConfig
+		expected string
+	}{
+		{
+			"slack",
+			&AlertMethodConfig{},
+			"a &lt; b &amp;&amp; c &gt; d\n```\na &lt; b &amp;&amp; c &gt; d\n```",
+		},
+		{
+			"mattermost",
+			&AlertMethodConfig{Compat: compatMattermost},
+			"a < b && c > d\n```\na < b && c > d\n```",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var pl payload
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&pl) // nolint: errcheck
+				w.WriteHeader(200)
+			}))
+			defer ts.Close()
+
+			tc.config.WebhookURL = ts.URL
+			s, err := NewAlertMethod(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := []*alert.Record{
+				{
+					Filter:    "a < b && c > d",
+					Text:      "a < b && c > d",
+					BodyField: true,
+				},
+			}
+			if err = s.Write(context.Background(), "test-rule", records); err != nil {
+				t.Fatal(err)
+			}
+			if len(pl.Attachments) != 1 {
+				t.Fatalf("expected one attachment but got %d", len(pl.Attachments))
+			}
+			if pl.Attachments[0].Text != tc.expected {
+				t.Fatalf("unexpected text (got %q, expected %q)", pl.Attachments[0].Text, tc.expected)
+			}
+			if records[0].Filter != "a < b && c > d" {
+				t.Fatalf("original record was modified (got %q)", records[0].Filter)
+			}
+		})
+	}
+}
+
+func TestWriteCustomCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	caFile, err := ioutil.TempFile("", "slack-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	if err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	caFile.Close()
+
+	records := []*alert.Record{
+		{
+			Filter: "hits.hits._source",
+			Text:   "{\n    \"ayy\": \"lmao\"\n}",
+		},
+	}
+
+	untrusted, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL: ts.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = untrusted.Write(context.Background(), "test-rule", records); err == nil {
+		t.Fatal("expected an error writing to a host signed by an unknown CA")
+	}
+
+	trusted, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL: ts.URL,
+		CACert:     caFile.Name(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = trusted.Write(context.Background(), "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newMockSlackServer(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			ct := r.Header.Get("Content-Type")
+			if ct == "" || ct != "application/json" {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+
+			var data map[string]interface{}
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				http.Error(w, "Internal Server Error", 500)
+				return
+			}
+
+			text, ok := data["text"].(string)
+			if !ok || text == "" {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(status)
+			w.Write([]byte("OK"))
+			return
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}))
+}
+
+func prettyJSON(t *testing.T, v interface{}) string {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func ExampleAlertMethod_buildPayload() {
+	records := []*alert.Record{
+		{
+			Filter:    "hits.hits._source",
+			Text:      `Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat. Duis aute irure dolor in reprehenderit in voluptate velit esse cillum dolore eu fugiat nulla pariatur. Excepteur sint occaecat cupidatat non proident, sunt in culpa qui officia deserunt mollit anim id est laborum.`,
+			BodyField: true,
+		},
+		{
+			Filter: "aggregation.hostname.buckets",
+			Fields: []*alert.Field{
+				{
+					Key:   "foo",
+					Count: 2,
+				},
+				{
+					Key:   "bar",
+					Count: 3,
+				},
+			},
+		},
+	}
+
+	a, _ := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL: "https://hooks.slack.com/services/ABCDEFG",
+		Channel:    "#alerts",
+		Text:       "New alert!",
+		Emoji:      ":robot",
+		TextLimit:  200,
+	})
+
+	sm := a.(*AlertMethod)
+
+	payload := sm.buildPayload(context.Background(), "Test rule", records)
+
+	// This loop is performed in order that tests will pass --
+	// it is not necessary to perform this
+	for i := range payload.Attachments {
+		payload.Attachments[i].Timestamp = 1
+	}
+	data, _ := json.MarshalIndent(payload, "", "    ")
+
+	fmt.Println(string(data))
 
 	// Output:
 	// {
@@ -439,13 +1727,13 @@ func ExampleAlertMethod_buildPayload() {
 	//             "title": "Test rule",
 	//             "fields": [
 	//                 {
-	//                     "title": "foo",
-	//                     "value": "2",
+	//                     "title": "bar",
+	//                     "value": "3",
 	//                     "short": true
 	//                 },
 	//                 {
-	//                     "title": "bar",
-	//                     "value": "3",
+	//                     "title": "foo",
+	//                     "value": "2",
 	//                     "short": true
 	//                 }
 	//             ],
@@ -457,6 +1745,211 @@ func ExampleAlertMethod_buildPayload() {
 	//                 "text"
 	//             ]
 	//         }
-	//     ]
+	//     ],
+	//     "unfurl_links": false,
+	//     "unfurl_media": false
 	// }
 }
+
+func TestWriteMaxAttachments(t *testing.T) {
+	var payloads []payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pl payload
+		if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payloads = append(payloads, pl)
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL:     ts.URL,
+		Text:           "New alert",
+		MaxAttachments: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make([]*alert.Record, 5)
+	for i := range records {
+		records[i] = &alert.Record{
+			Filter: fmt.Sprintf("aggregations.filter-%d.buckets", i),
+			Fields: []*alert.Field{{Key: "foo", Count: 1}},
+		}
+	}
+	if err = s.Write(context.Background(), "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payloads) != 3 {
+		t.Fatalf("expected 3 messages (got %d)", len(payloads))
+	}
+	var i int
+	for n, pl := range payloads {
+		expected := fmt.Sprintf("New alert (page %d of 3)", n+1)
+		if pl.Text != expected {
+			t.Fatalf("unexpected message text (got %q, expected %q)", pl.Text, expected)
+		}
+		for _, att := range pl.Attachments {
+			if att.Text != records[i].Filter {
+				t.Fatalf("attachments out of order (got %q, expected %q)", att.Text, records[i].Filter)
+			}
+			i++
+		}
+	}
+	if i != len(records) {
+		t.Fatalf("expected %d attachments in total (got %d)", len(records), i)
+	}
+}
+
+func TestWritePagesCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var posts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Cancel the alert once the first page has been posted
+		atomic.AddInt32(&posts, 1)
+		cancel()
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL:     ts.URL,
+		MaxAttachments: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*alert.Record{
+		{Filter: "aggregations.foo.buckets", Fields: []*alert.Field{{Key: "foo", Count: 1}}},
+		{Filter: "aggregations.bar.buckets", Fields: []*alert.Field{{Key: "bar", Count: 1}}},
+		{Filter: "aggregations.baz.buckets", Fields: []*alert.Field{{Key: "baz", Count: 1}}},
+	}
+	if err = s.Write(ctx, "test-rule", records); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if n := atomic.LoadInt32(&posts); n != 1 {
+		t.Fatalf("expected no more messages to be posted after cancellation (got %d)", n)
+	}
+}
+
+func TestWritePagesResume(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		posts []string
+		fail  = true
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pl payload
+		if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+			t.Errorf("error decoding payload: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		posts = append(posts, pl.Text)
+		// The second page fails the first time it is posted
+		if strings.HasPrefix(pl.Text, "(page 2 ") && fail {
+			fail = false
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	s, err := NewAlertMethod(&AlertMethodConfig{
+		WebhookURL:     ts.URL,
+		MaxAttachments: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*alert.Record{
+		{Filter: "aggregations.foo.buckets", Fields: []*alert.Field{{Key: "foo", Count: 1}}},
+		{Filter: "aggregations.bar.buckets", Fields: []*alert.Field{{Key: "bar", Count: 1}}},
+		{Filter: "aggregations.baz.buckets", Fields: []*alert.Field{{Key: "baz", Count: 1}}},
+	}
+	ctx := alert.WithProgress(context.Background(), new(alert.Progress))
+	if err = s.Write(ctx, "test-rule", records); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if err = s.Write(ctx, "test-rule", records); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"(page 1 of 3)", "(page 2 of 3)", "(page 2 of 3)", "(page 3 of 3)"}
+	if !reflect.DeepEqual(posts, expected) {
+		t.Fatalf("unexpected pages posted (got %q, expected %q)", posts, expected)
+	}
+}
+
+func TestRenderDocumentsFlatten(t *testing.T) {
+	doc := map[string]interface{}{
+		"http": map[string]interface{}{
+			"response": map[string]interface{}{
+				"status_code": 503,
+			},
+			"request": map[string]interface{}{
+				"method": "GET",
+			},
+		},
+		"url.path": "/health",
+	}
+	const bodyTemplate = `{{index . "http.request.method"}} {{index . "url.path"}} ` +
+		`{{index . "http.response.status_code"}} {{.http.response.status_code}}`
+
+	cases := []struct {
+		name     string
+		flatten  bool
+		expected string
+	}{
+		{
+			"flattened",
+			true,
+			"GET /health 503 503",
+		},
+		{
+			// Without flattening, only the literal dotted field of
+			// the document is found
+			"nested",
+			false,
+			"<no value> /health <no value> 503",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:       "https://example.com",
+				BodyTemplate:     bodyTemplate,
+				FlattenDocuments: tc.flatten,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := a.(*AlertMethod)
+
+			records := s.renderDocuments([]*alert.Record{
+				{
+					Filter:    "hits.hits._source",
+					BodyField: true,
+					Documents: []map[string]interface{}{doc},
+				},
+			})
+			if records[0].Text != tc.expected {
+				t.Errorf("unexpected text (got %q, expected %q)", records[0].Text, tc.expected)
+			}
+			if _, ok := doc["http.response.status_code"]; ok {
+				t.Error("the document was modified")
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+const defaultAPIURL = "https://slack.com/api"
+
+// uploadURLResponse is the response to a files.getUploadURLExternal
+// request.
+type uploadURLResponse struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error"`
+	UploadURL string `json:"upload_url"`
+	FileID    string `json:"file_id"`
+}
+
+// completeUploadResponse is the response to a
+// files.completeUploadExternal request.
+type completeUploadResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+	Files []struct {
+		ID        string `json:"id"`
+		Permalink string `json:"permalink"`
+	} `json:"files"`
+}
+
+// uploadSnippets uploads the text of any body field records larger
+// than s.snippetThreshold as a Slack file snippet. The returned
+// records are the same as those provided except that each uploaded
+// record is replaced by a record linking to the snippet.
+func (s *AlertMethod) uploadSnippets(ctx context.Context, rule string, records []*alert.Record) ([]*alert.Record, error) {
+	if s.snippetThreshold < 1 {
+		return records, nil
+	}
+
+	output := make([]*alert.Record, 0, len(records))
+	for _, record := range records {
+		if !record.BodyField || len(record.Text) <= s.snippetThreshold {
+			output = append(output, record)
+			continue
+		}
+
+		permalink, err := s.uploadSnippet(ctx, rule, record)
+		if err != nil {
+			return nil, xerrors.Errorf("error uploading snippet: %v", err)
+		}
+
+		output = append(output, &alert.Record{
+			Filter: fmt.Sprintf("%s (too large to display, <%s|view snippet>)", record.Filter, permalink),
+		})
+	}
+	return output, nil
+}
+
+// uploadSnippet uploads the record text as a file using Slack's
+// two-step external upload flow and returns the file's permalink.
+func (s *AlertMethod) uploadSnippet(ctx context.Context, rule string, record *alert.Record) (string, error) {
+	form := url.Values{}
+	form.Set("filename", strings.Replace(strings.ToLower(rule), " ", "-", -1)+".txt")
+	form.Set("length", strconv.Itoa(len(record.Text)))
+	form.Set("snippet_type", "text")
+
+	uploadURL := new(uploadURLResponse)
+	err := s.callAPI(ctx, "files.getUploadURLExternal", "application/x-www-form-urlencoded",
+		strings.NewReader(form.Encode()), uploadURL)
+	if err != nil {
+		return "", err
+	}
+	if !uploadURL.OK {
+		return "", xerrors.Errorf("files.getUploadURLExternal returned error: %s", uploadURL.Error)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL.UploadURL, strings.NewReader(record.Text))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return "", xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", xerrors.Errorf("received non-200 status code uploading file: %s", resp.Status)
+	}
+
+	complete := map[string]interface{}{
+		"files": []map[string]string{
+			{
+				"id":    uploadURL.FileID,
+				"title": fmt.Sprintf("%s: %s", rule, record.Filter),
+			},
+		},
+	}
+	if s.snippetChannelID != "" {
+		complete["channel_id"] = s.snippetChannelID
+	}
+	buf := bytes.Buffer{}
+	if err = json.NewEncoder(&buf).Encode(complete); err != nil {
+		return "", err
+	}
+
+	completed := new(completeUploadResponse)
+	err = s.callAPI(ctx, "files.completeUploadExternal", "application/json", &buf, completed)
+	if err != nil {
+		return "", err
+	}
+	if !completed.OK {
+		return "", xerrors.Errorf("files.completeUploadExternal returned error: %s", completed.Error)
+	}
+	if len(completed.Files) < 1 {
+		return "", xerrors.New("files.completeUploadExternal returned no files")
+	}
+	return completed.Files[0].Permalink, nil
+}
+
+// callAPI makes an authenticated request to the given Slack Web
+// API method and JSON-decodes the response into v.
+func (s *AlertMethod) callAPI(ctx context.Context, method, contentType string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, s.apiURL+"/"+method, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+s.botToken)
+
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return xerrors.Errorf("received non-200 status code from %s: %s", method, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return xerrors.Errorf("error JSON-decoding %s response: %v", method, err)
+	}
+	return nil
+}
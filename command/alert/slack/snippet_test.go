@@ -0,0 +1,113 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestUploadSnippets(t *testing.T) {
+	cases := []struct {
+		name     string
+		text     string
+		complete string
+		err      bool
+		uploaded bool
+	}{
+		{"below-threshold", "short", `{"ok":true}`, false, false},
+		{"above-threshold", strings.Repeat("a", 100), `{"ok":true,"files":[{"id":"F1","permalink":"https://slack.com/files/F1"}]}`, false, true},
+		{"complete-error", strings.Repeat("a", 100), `{"ok":false,"error":"invalid_auth"}`, true, false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var uploaded string
+			var ts *httptest.Server
+			ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/files.getUploadURLExternal":
+					if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+						http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+						return
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"ok":         true,
+						"upload_url": ts.URL + "/upload",
+						"file_id":    "F1",
+					})
+				case "/upload":
+					data, _ := ioutil.ReadAll(r.Body)
+					uploaded = string(data)
+				case "/files.completeUploadExternal":
+					w.Write([]byte(tc.complete))
+				default:
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+
+			s := &AlertMethod{
+				client:           ts.Client(),
+				apiURL:           ts.URL,
+				botToken:         "xoxb-test",
+				snippetThreshold: 50,
+			}
+
+			records := []*alert.Record{
+				{
+					Filter:    "hits.hits._source",
+					Text:      tc.text,
+					BodyField: true,
+				},
+			}
+
+			got, err := s.uploadSnippets(context.Background(), "Test Rule", records)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.uploaded {
+				if got[0] != records[0] {
+					t.Fatal("record below the threshold should not be modified")
+				}
+				return
+			}
+
+			if uploaded != tc.text {
+				t.Fatalf("unexpected uploaded text (got %q, expected %q)", uploaded, tc.text)
+			}
+			if got[0].Text != "" {
+				t.Fatalf("uploaded record should have no text (got %q)", got[0].Text)
+			}
+			if !strings.Contains(got[0].Filter, "https://slack.com/files/F1") {
+				t.Fatalf("record should link to snippet (got %q)", got[0].Filter)
+			}
+		})
+	}
+}
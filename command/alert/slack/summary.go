@@ -0,0 +1,90 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+// summaryTitle is the title of the attachment rendered from the
+// 'summary_template' field
+const summaryTitle = "Summary"
+
+// FieldSum returns the sum of the counts of the fields of the
+// records of the alert, e.g. the total number of matching errors.
+func (m *messageData) FieldSum() int {
+	n := 0
+	for _, record := range m.Records {
+		for _, f := range record.Fields {
+			n += f.Count
+		}
+	}
+	return n
+}
+
+// TopFields returns the n fields of the records of the alert with
+// the highest counts, in descending order of count. Ties are broken
+// by key so that the same fields are returned every time.
+func (m *messageData) TopFields(n int) []*alert.Field {
+	fields := make([]*alert.Field, 0, m.FieldCount())
+	for _, record := range m.Records {
+		fields = append(fields, record.Fields...)
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		if fields[i].Count != fields[j].Count {
+			return fields[i].Count > fields[j].Count
+		}
+		return fields[i].Key < fields[j].Key
+	})
+	if n >= 0 && n < len(fields) {
+		fields = fields[:n]
+	}
+	return fields
+}
+
+// commas formats an integer with commas separating its thousands,
+// e.g. 4210 as "4,210".
+func commas(n int) string {
+	s := strconv.Itoa(n)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return sign + s
+}
+
+// summary returns the attachment rendered from s.summaryTemplate,
+// which precedes the attachments of the records, or nil if there is
+// no template or it renders nothing.
+func (s *AlertMethod) summary(msg *messageData, footer string, ts int64) *attachment {
+	text := renderMessageTemplate(s.summaryTemplate, "", msg)
+	if text == "" {
+		return nil
+	}
+	return &attachment{
+		Title:      summaryTitle,
+		Text:       text,
+		MarkdownIn: []string{"text"},
+		Color:      defaultAttachmentColor,
+		Footer:     footer,
+		FooterIcon: defaultAttachmentFooterIcon,
+		Timestamp:  ts,
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestMessageDataSummary(t *testing.T) {
+	msg := &messageData{
+		Records: []*alert.Record{
+			{
+				Filter: "aggregations.service.buckets",
+				Fields: []*alert.Field{
+					{Key: "checkout", Count: 2000},
+					{Key: "search", Count: 10},
+					{Key: "payments", Count: 2000},
+				},
+			},
+			{
+				Filter: "aggregations.host.buckets",
+				Fields: []*alert.Field{
+					{Key: "web-1", Count: 200},
+				},
+			},
+			{
+				Filter:    "hits.hits._source",
+				BodyField: true,
+				Text:      "{}",
+			},
+		},
+	}
+
+	if n := msg.FieldSum(); n != 4210 {
+		t.Fatalf("unexpected sum of counts (got %d, expected 4210)", n)
+	}
+
+	cases := []struct {
+		n    int
+		keys []string
+	}{
+		{0, []string{}},
+		{2, []string{"checkout", "payments"}},
+		{3, []string{"checkout", "payments", "web-1"}},
+		{10, []string{"checkout", "payments", "web-1", "search"}},
+	}
+	for _, tc := range cases {
+		top := msg.TopFields(tc.n)
+		keys := make([]string, 0, len(top))
+		for _, f := range top {
+			keys = append(keys, f.Key)
+		}
+		if len(keys) != len(tc.keys) {
+			t.Fatalf("unexpected top %d fields (got %v, expected %v)", tc.n, keys, tc.keys)
+		}
+		for i := range keys {
+			if keys[i] != tc.keys[i] {
+				t.Fatalf("unexpected top %d fields (got %v, expected %v)", tc.n, keys, tc.keys)
+			}
+		}
+	}
+
+	// The fields of the records are not reordered
+	if msg.Records[0].Fields[1].Key != "search" {
+		t.Fatal("fields of the record were sorted in place")
+	}
+}
+
+func TestCommas(t *testing.T) {
+	cases := []struct {
+		n        int
+		expected string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{4210, "4,210"},
+		{100000, "100,000"},
+		{1234567, "1,234,567"},
+		{-4210, "-4,210"},
+	}
+	for _, tc := range cases {
+		if got := commas(tc.n); got != tc.expected {
+			t.Errorf("unexpected result of commas(%d) (got %q, expected %q)", tc.n, got, tc.expected)
+		}
+	}
+}
+
+func TestBuildPayloadSummary(t *testing.T) {
+	records := []*alert.Record{
+		{
+			Filter: "aggregations.service.buckets",
+			Fields: []*alert.Field{
+				{Key: "checkout", Count: 4000},
+				{Key: "search", Count: 210},
+			},
+		},
+	}
+	cases := []struct {
+		name     string
+		template string
+		summary  string
+		err      bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "summary",
+			template: "{{.FieldCount}} services affected, {{commas .FieldSum}} total errors",
+			summary:  "2 services affected, 4,210 total errors",
+		},
+		{
+			name:     "top",
+			template: "Top: {{range .TopFields 1}}{{.Key}} ({{.Count}}){{end}}",
+			summary:  "Top: checkout (4000)",
+		},
+		{
+			name:     "empty",
+			template: "{{if gt .FieldSum 10000}}Over 10,000 errors{{end}}",
+		},
+		{
+			name:     "invalid",
+			template: "{{.Missing}}",
+			err:      true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:      "https://example.com",
+				SummaryTemplate: tc.template,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pl := a.(*AlertMethod).buildPayload(context.Background(), "Test Rule", records)
+			if tc.summary == "" {
+				if len(pl.Attachments) != 1 {
+					t.Fatalf("expected 1 attachment, got %d", len(pl.Attachments))
+				}
+				return
+			}
+			if len(pl.Attachments) != 2 {
+				t.Fatalf("expected 2 attachments, got %d", len(pl.Attachments))
+			}
+			att := pl.Attachments[0]
+			if att.Title != summaryTitle || att.Text != tc.summary {
+				t.Fatalf("unexpected summary attachment (got %q: %q, expected %q: %q)",
+					att.Title, att.Text, summaryTitle, tc.summary)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+// messageData is the data with which the 'text', 'username_template',
+// 'emoji_template' and 'summary_template' templates are executed for
+// each message.
+type messageData struct {
+	// Rule is the name of the rule
+	Rule string
+
+	// AlertID is the ID of the firing of the rule, if the rule
+	// includes it in its alerts (see alert.Alert.AlertID)
+	AlertID string
+
+	// FireCount is the number of consecutive runs of the rule which
+	// produced the same records, if the rule collapses identical
+	// firings (see alert.Alert.FireCount), and FirstFired is when
+	// the first of them ran
+	FireCount  int
+	FirstFired time.Time
+
+	// Records are the records of the alert
+	Records []*alert.Record
+}
+
+// Count returns the number of records of the alert.
+func (m *messageData) Count() int {
+	return len(m.Records)
+}
+
+// FieldCount returns the total number of fields of the records of
+// the alert, e.g. the number of buckets which matched.
+func (m *messageData) FieldCount() int {
+	n := 0
+	for _, record := range m.Records {
+		n += len(record.Fields)
+	}
+	return n
+}
+
+// messageFuncs are the functions available to message templates.
+var messageFuncs = template.FuncMap{
+	"commas": commas,
+}
+
+// parseMessageTemplate parses the template of the given field and
+// validates it by rendering it against sample data. It returns nil
+// if the template is empty.
+func parseMessageTemplate(field, raw string) (*template.Template, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(field).Option("missingkey=error").Funcs(messageFuncs).Parse(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing field 'output.config.%s': %v", field, err)
+	}
+	sample := &messageData{
+		Rule:       "Test Rule",
+		AlertID:    "0123456789abcdef",
+		FireCount:  2,
+		FirstFired: time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Records: []*alert.Record{
+			{
+				Filter: "aggregations.hostname.buckets",
+				Fields: []*alert.Field{{Key: "test-host", Count: 1}},
+			},
+		},
+	}
+	if err = tmpl.Execute(new(bytes.Buffer), sample); err != nil {
+		return nil, xerrors.Errorf("field 'output.config.%s' is invalid: %v", field, err)
+	}
+	return tmpl, nil
+}
+
+// renderMessageTemplate returns the rendered template, or fallback
+// if there is no template, it cannot be rendered, or it renders
+// only whitespace.
+func renderMessageTemplate(tmpl *template.Template, fallback string, data *messageData) string {
+	if tmpl == nil {
+		return fallback
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fallback
+	}
+	if s := strings.TrimSpace(buf.String()); s != "" {
+		return s
+	}
+	return fallback
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestBuildPayloadMessageTemplates(t *testing.T) {
+	severe := `{{range .Records}}{{range .Fields}}{{if ge .Count 100}}:rotating_light:{{end}}{{end}}{{end}}`
+	cases := []struct {
+		name     string
+		config   *AlertMethodConfig
+		count    int
+		username string
+		emoji    string
+		text     string
+		err      bool
+	}{
+		{
+			name: "static",
+			config: &AlertMethodConfig{
+				Username: "alerts-bot",
+				Emoji:    ":robot_face:",
+			},
+			count:    1,
+			username: "alerts-bot",
+			emoji:    ":robot_face:",
+		},
+		{
+			name: "templated",
+			config: &AlertMethodConfig{
+				Username:         "alerts-bot",
+				UsernameTemplate: "{{.Rule}} bot",
+				Emoji:            ":robot_face:",
+				EmojiTemplate:    severe,
+			},
+			count:    150,
+			username: "Test Rule bot",
+			emoji:    ":rotating_light:",
+		},
+		{
+			name: "fallback",
+			config: &AlertMethodConfig{
+				Username:         "alerts-bot",
+				UsernameTemplate: "{{if gt (len .Records) 1}}multi-bot{{end}}",
+				Emoji:            ":robot_face:",
+				EmojiTemplate:    severe,
+			},
+			count:    1,
+			username: "alerts-bot",
+			emoji:    ":robot_face:",
+		},
+		{
+			name: "static-text",
+			config: &AlertMethodConfig{
+				Username: "alerts-bot",
+				Text:     "100% of <services> are down",
+			},
+			count:    1,
+			username: "alerts-bot",
+			text:     "100% of <services> are down",
+		},
+		{
+			name: "templated-text",
+			config: &AlertMethodConfig{
+				Username: "alerts-bot",
+				Text:     ":fire: {{.FieldCount}} services over threshold in {{.Rule}} ({{.Count}} records)",
+			},
+			count:    1,
+			username: "alerts-bot",
+			text:     ":fire: 2 services over threshold in Test Rule (1 records)",
+		},
+		{
+			name: "text-parse-error",
+			config: &AlertMethodConfig{
+				Text: "{{.FieldCount",
+			},
+			err: true,
+		},
+		{
+			name: "parse-error",
+			config: &AlertMethodConfig{
+				UsernameTemplate: "{{.Rule",
+			},
+			err: true,
+		},
+		{
+			name: "unknown-field",
+			config: &AlertMethodConfig{
+				EmojiTemplate: "{{.Severity}}",
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.WebhookURL = "https://hooks.slack.com/services/test"
+			a, err := NewAlertMethod(tc.config)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pl := a.(*AlertMethod).buildPayload(context.Background(), "Test Rule", []*alert.Record{
+				{
+					Filter: "aggregations.hostname.buckets",
+					Fields: []*alert.Field{{Key: "foo", Count: tc.count}, {Key: "bar", Count: 0}},
+				},
+			})
+			if pl.Username != tc.username {
+				t.Errorf("unexpected username (got %q, expected %q)", pl.Username, tc.username)
+			}
+			if pl.Emoji != tc.emoji {
+				t.Errorf("unexpected emoji (got %q, expected %q)", pl.Emoji, tc.emoji)
+			}
+			if pl.Text != tc.text {
+				t.Errorf("unexpected text (got %q, expected %q)", pl.Text, tc.text)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+)
+
+// maxEpochSeconds is the largest number treated as a number of
+// seconds since the Unix epoch by parseTimestamp. Larger numbers
+// are treated as milliseconds. It corresponds to the year 5138, so
+// no timestamp in milliseconds after 1973 is mistaken for seconds
+const maxEpochSeconds = 1e11
+
+// recordTimestamp returns the time at s.timestampField of the first
+// document of the record which has it, or now if there is no
+// timestamp field, no such document, or the value cannot be parsed.
+func (s *AlertMethod) recordTimestamp(record *alert.Record, now time.Time) time.Time {
+	if s.timestampField == "" {
+		return now
+	}
+	for _, doc := range record.Documents {
+		if v := utils.Get(doc, s.timestampField); v != nil {
+			if ts, ok := parseTimestamp(v); ok {
+				return ts
+			}
+			return now
+		}
+	}
+	return now
+}
+
+// parseTimestamp parses v as a number of seconds or milliseconds
+// since the Unix epoch (see maxEpochSeconds), either as a JSON
+// number or a string, or as an RFC3339 string.
+func parseTimestamp(v interface{}) (time.Time, bool) {
+	var epoch float64
+	switch value := v.(type) {
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		epoch = f
+	case float64:
+		epoch = value
+	case int:
+		epoch = float64(value)
+	case int64:
+		epoch = float64(value)
+	case string:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			epoch = f
+			break
+		}
+		ts, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return ts, true
+	default:
+		return time.Time{}, false
+	}
+
+	if math.IsNaN(epoch) || math.IsInf(epoch, 0) || epoch <= 0 {
+		return time.Time{}, false
+	}
+	if epoch > maxEpochSeconds {
+		epoch /= 1000
+		if epoch > maxEpochSeconds {
+			return time.Time{}, false
+		}
+	}
+	sec, frac := math.Modf(epoch)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+func TestBuildPayloadTimestamp(t *testing.T) {
+	expected := time.Date(2019, time.March, 14, 15, 9, 26, 0, time.UTC).Unix()
+	cases := []struct {
+		name     string
+		value    interface{}
+		fallback bool
+	}{
+		{"epoch-seconds", json.Number("1552576166"), false},
+		{"epoch-seconds-fraction", json.Number("1552576166.535"), false},
+		{"epoch-millis", json.Number("1552576166535"), false},
+		{"epoch-float", float64(1552576166535), false},
+		{"epoch-string", "1552576166", false},
+		{"rfc3339", "2019-03-14T15:09:26Z", false},
+		{"rfc3339-offset", "2019-03-14T11:09:26.535-04:00", false},
+		{"missing", nil, true},
+		{"unparseable", "yesterday", true},
+		{"negative", json.Number("-1"), true},
+		{"wrong-type", map[string]interface{}{"seconds": 1552576166}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAlertMethod(&AlertMethodConfig{
+				WebhookURL:     "https://example.com",
+				TimestampField: "event.created",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := a.(*AlertMethod)
+
+			doc := map[string]interface{}{"message": "disk full"}
+			if tc.value != nil {
+				doc["event"] = map[string]interface{}{"created": tc.value}
+			}
+			records := []*alert.Record{
+				{
+					Filter:    "hits.hits._source",
+					BodyField: true,
+					Documents: []map[string]interface{}{doc},
+				},
+			}
+			before := time.Now().Unix()
+			pl := s.buildPayload(context.Background(), "Test Rule", records)
+			after := time.Now().Unix()
+
+			got := pl.Attachments[0].Timestamp
+			if tc.fallback {
+				if got < before || got > after {
+					t.Fatalf("expected the current time, got %d", got)
+				}
+				return
+			}
+			if got != expected {
+				t.Fatalf("unexpected timestamp (got %d, expected %d)", got, expected)
+			}
+		})
+	}
+}
+
+func TestBuildPayloadTimestampUnset(t *testing.T) {
+	a, err := NewAlertMethod(&AlertMethodConfig{WebhookURL: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := a.(*AlertMethod)
+
+	records := []*alert.Record{
+		{
+			Filter:    "hits.hits._source",
+			BodyField: true,
+			Documents: []map[string]interface{}{{"@timestamp": "2019-03-14T15:09:26Z"}},
+		},
+	}
+	before := time.Now().Unix()
+	pl := s.buildPayload(context.Background(), "Test Rule", records)
+	if got := pl.Attachments[0].Timestamp; got < before {
+		t.Fatalf("expected the current time, got %d", got)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/mitchellh/mapstructure"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
 	"golang.org/x/xerrors"
 )
@@ -43,6 +44,21 @@ type AlertMethod struct {
 	template *template.Template
 }
 
+func init() {
+	alert.Register("sns", newFromConfig)
+	alert.RegisterConfig("sns", AlertMethodConfig{})
+}
+
+// newFromConfig decodes the output configuration and creates
+// a new *AlertMethod.
+func newFromConfig(raw map[string]interface{}, opts *alert.FactoryOptions) (alert.Method, error) {
+	config := new(AlertMethodConfig)
+	if err := mapstructure.Decode(raw, config); err != nil {
+		return nil, xerrors.Errorf("error decoding SNS output configuration: %v", err)
+	}
+	return NewAlertMethod(config)
+}
+
 // NewAlertMethod creates a new *AlertMethod or a
 // non-nil error if there was an error.
 func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
@@ -58,7 +74,7 @@ func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
 	if config.Template == "" {
 		return nil, xerrors.New("field 'output.config.template' must not be empty when using the SNS output method")
 	}
-	tmpl, err := template.New("sns").Funcs(template.FuncMap(sprig.FuncMap())).Parse(config.Template)
+	tmpl, err := template.New("sns").Funcs(templateFuncs()).Parse(config.Template)
 	if err != nil {
 		return nil, xerrors.Errorf("error parsing SNS message template: %w", err)
 	}
@@ -75,6 +91,32 @@ func NewAlertMethod(config *AlertMethodConfig) (alert.Method, error) {
 	}, nil
 }
 
+// templateFuncs returns the functions available to the message
+// template: those of sprig and 'fieldsTable' (see
+// alert.FieldsTable).
+func templateFuncs() template.FuncMap {
+	funcs := template.FuncMap(sprig.FuncMap())
+	funcs["fieldsTable"] = alert.FieldsTable
+	return funcs
+}
+
+// Name returns the type of this output method.
+func (a *AlertMethod) Name() string {
+	return "sns"
+}
+
+// Check verifies that the topic exists and that its attributes
+// can be read with the configured AWS credentials.
+func (a *AlertMethod) Check(ctx context.Context) error {
+	input := &sns.GetTopicAttributesInput{
+		TopicArn: aws.String(a.topicARN),
+	}
+	if _, err := a.client.GetTopicAttributesWithContext(ctx, input); err != nil {
+		return xerrors.Errorf("error getting attributes of SNS topic: %w", err)
+	}
+	return nil
+}
+
 // Write renders the pre-defined message template and publishes
 // the message to an AWS SNS topic.
 func (a *AlertMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
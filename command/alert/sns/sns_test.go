@@ -17,7 +17,6 @@ import (
 	"testing"
 	"text/template"
 
-	"github.com/Masterminds/sprig"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
 )
 
@@ -138,6 +137,27 @@ func TestAlertMethod_renderTemplate(t *testing.T) {
 			false,
 			"[TEST ERROR ALERT]\n* [ERROR] Error launching: bad stuff happened\n* [ERROR] Error launching: more bad stuff happened\n",
 		},
+		{
+			"fields-table",
+			"{{range .}}{{.Filter}}:\n{{fieldsTable .Fields}}{{end}}",
+			[]*alert.Record{
+				{
+					Filter: "aggregations.hostname.buckets",
+					Fields: []*alert.Field{
+						{
+							Key:   "host|1",
+							Count: 2,
+						},
+						{
+							Key:   "host-2",
+							Count: 4,
+						},
+					},
+				},
+			},
+			false,
+			"[TEST ERROR ALERT]\naggregations.hostname.buckets:\n| Key | Count |\n| --- | ---: |\n| host\\|1 | 2 |\n| host-2 | 4 |\n",
+		},
 		{
 			"invalid-template",
 			"Filter: {{.Filter}}", // this will cause template.Execute to fail
@@ -165,7 +185,7 @@ func TestAlertMethod_renderTemplate(t *testing.T) {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
 			a := &AlertMethod{
-				template: template.Must(template.New("test").Funcs(template.FuncMap(sprig.FuncMap())).Parse(tc.template)),
+				template: template.Must(template.New("test").Funcs(templateFuncs()).Parse(tc.template)),
 			}
 			msg, err := a.renderTemplate("TEST ERROR ALERT", tc.records)
 			if tc.expectErr {
@@ -0,0 +1,353 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultSpoolMaxAge        = 24 * time.Hour
+	defaultSpoolRetryInterval = 1 * time.Minute
+	maxSpoolBackoff           = 1 * time.Hour
+
+	// deadDir is the subdirectory of the spool to which alerts
+	// which could not be delivered before they expired are moved
+	deadDir = ".dead"
+)
+
+// SpoolConfig is passed as an argument to NewSpool().
+type SpoolConfig struct {
+	// Dir is the directory to which undeliverable alerts are
+	// written. It is created if it does not exist
+	Dir string
+
+	// MaxAge is how long a spooled alert is retried before it is
+	// moved to the '.dead' subdirectory of Dir. If zero, a default
+	// of 24 hours will be used
+	MaxAge time.Duration
+
+	// RetryInterval is how often the spool is checked for alerts
+	// due to be retried, and how long after the first failed retry
+	// an alert is retried again. The delay doubles after each
+	// failed retry, up to an hour. If zero, a default of one minute
+	// will be used
+	RetryInterval time.Duration
+
+	Logger hclog.Logger
+
+	// Clock is the source of the current time. If nil, the system
+	// clock will be used
+	Clock clock.Clock
+}
+
+// Spool persists alerts which could not be sent with one of their
+// outputs to a directory and retries sending them in the
+// background (see Run). Each spooled alert is retried with the
+// output of the same rule which failed to send it, as set by
+// SetMethods.
+type Spool struct {
+	dir      string
+	maxAge   time.Duration
+	interval time.Duration
+	logger   hclog.Logger
+	clock    clock.Clock
+
+	mu      sync.Mutex
+	methods map[string][]Method
+}
+
+// spooledAlert is the file format of a spooled alert. Output is the
+// index of the failed output among the outputs of the rule. Query is
+// only recorded, redacted, if the output includes it (see
+// QueryIncluder).
+type spooledAlert struct {
+	ID          string                 `json:"id"`
+	Rule        string                 `json:"rule"`
+	AlertID     string                 `json:"alert_id,omitempty"`
+	FireCount   int                    `json:"fire_count,omitempty"`
+	FirstFired  time.Time              `json:"first_fired"`
+	Query       map[string]interface{} `json:"query,omitempty"`
+	Output      int                    `json:"output"`
+	OutputType  string                 `json:"output_type"`
+	Records     []*spooledRecord       `json:"records"`
+	SpooledAt   time.Time              `json:"spooled_at"`
+	Attempts    int                    `json:"attempts"`
+	NextAttempt time.Time              `json:"next_attempt"`
+}
+
+// spooledRecord preserves the BodyField and Documents of a Record,
+// which are otherwise not JSON-encoded.
+type spooledRecord struct {
+	*Record
+	BodyField bool                     `json:"body_field,omitempty"`
+	Documents []map[string]interface{} `json:"documents,omitempty"`
+}
+
+// NewSpool creates a new *Spool instance.
+func NewSpool(config *SpoolConfig) (*Spool, error) {
+	if config.Dir == "" {
+		return nil, xerrors.New("no spool directory provided")
+	}
+	if err := os.MkdirAll(filepath.Join(config.Dir, deadDir), 0o700); err != nil {
+		return nil, xerrors.Errorf("error creating spool directory: %v", err)
+	}
+	if config.MaxAge == 0 {
+		config.MaxAge = defaultSpoolMaxAge
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = defaultSpoolRetryInterval
+	}
+	if config.Logger == nil {
+		config.Logger = hclog.Default()
+	}
+	if config.Clock == nil {
+		config.Clock = clock.Real()
+	}
+	return &Spool{
+		dir:      config.Dir,
+		maxAge:   config.MaxAge,
+		interval: config.RetryInterval,
+		logger:   config.Logger,
+		clock:    config.Clock,
+	}, nil
+}
+
+// SetMethods sets the outputs of each rule, by rule name, with
+// which spooled alerts are retried. It should be called again
+// whenever the rules are reloaded.
+func (s *Spool) SetMethods(methods map[string][]Method) {
+	s.mu.Lock()
+	s.methods = methods
+	s.mu.Unlock()
+}
+
+// method returns the output with which the spooled alert should be
+// retried, or nil if the rule no longer has that output.
+func (s *Spool) method(sa *spooledAlert) Method {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	methods := s.methods[sa.Rule]
+	if sa.Output < 0 || sa.Output >= len(methods) {
+		return nil
+	}
+	if m := methods[sa.Output]; m.Name() == sa.OutputType {
+		return m
+	}
+	return nil
+}
+
+// Write persists the alert so that it is retried with the output,
+// which is the one at the given index of alert.Methods.
+func (s *Spool) Write(alert *Alert, output int) error {
+	records := make([]*spooledRecord, 0, len(alert.Records))
+	for _, record := range alert.Records {
+		records = append(records, &spooledRecord{
+			Record:    record,
+			BodyField: record.BodyField,
+			Documents: record.Documents,
+		})
+	}
+	now := s.clock.Now()
+	sa := &spooledAlert{
+		ID:          fmt.Sprintf("%d-%s-%d", now.UnixNano(), alert.ID, output),
+		Rule:        alert.RuleName,
+		AlertID:     alert.AlertID,
+		FireCount:   alert.FireCount,
+		FirstFired:  alert.FirstFired,
+		Query:       IncludedQuery(alert.Methods[output], alert.Query),
+		Output:      output,
+		OutputType:  alert.Methods[output].Name(),
+		Records:     records,
+		SpooledAt:   now,
+		NextAttempt: now.Add(s.interval),
+	}
+	return s.save(sa)
+}
+
+// save writes the spooled alert to its file, replacing the file
+// atomically if it already exists.
+func (s *Spool) save(sa *spooledAlert) error {
+	data, err := json.Marshal(sa)
+	if err != nil {
+		return xerrors.Errorf("error JSON-encoding spooled alert: %v", err)
+	}
+	tmp := filepath.Join(s.dir, sa.ID+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return xerrors.Errorf("error writing spooled alert: %v", err)
+	}
+	if err = os.Rename(tmp, s.path(sa.ID)); err != nil {
+		os.Remove(tmp) // nolint: errcheck
+		return xerrors.Errorf("error writing spooled alert: %v", err)
+	}
+	return nil
+}
+
+func (s *Spool) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Run drains the spool, retrying every spooled alert immediately,
+// and then retries the spooled alerts which are due every
+// RetryInterval until ctx is done.
+func (s *Spool) Run(ctx context.Context) {
+	s.Replay(ctx, true)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(s.interval):
+			s.Replay(ctx, false)
+		}
+	}
+}
+
+// Replay retries the spooled alerts which are due, or all of them
+// if all is true. Alerts which are sent are removed from the spool,
+// while those which have been spooled for longer than the maximum
+// age are moved to the '.dead' subdirectory instead of being
+// retried.
+func (s *Spool) Replay(ctx context.Context, all bool) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		s.logger.Error("error listing spooled alerts", "error", err)
+		return
+	}
+	// The file names start with the time of spooling
+	sort.Strings(files)
+
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+		sa, err := readSpooled(file)
+		if err != nil {
+			s.logger.Error("error reading spooled alert, moving it to the dead letter directory", "id", id, "error", err)
+			s.bury(id)
+			continue
+		}
+
+		now := s.clock.Now()
+		if now.Sub(sa.SpooledAt) >= s.maxAge {
+			s.logger.Error(fmt.Sprintf("giving up on spooled alert from rule %q", sa.Rule),
+				"id", id, "output", sa.OutputType, "attempts", sa.Attempts)
+			s.bury(id)
+			continue
+		}
+		if !all && now.Before(sa.NextAttempt) {
+			continue
+		}
+
+		if err = s.retry(ctx, sa); err == nil {
+			s.logger.Info(fmt.Sprintf("spooled alert from rule %q sent", sa.Rule),
+				"id", id, "method", sa.OutputType)
+			if err = os.Remove(file); err != nil {
+				s.logger.Error("error removing spooled alert", "id", id, "error", err)
+			}
+			continue
+		}
+
+		sa.Attempts++
+		sa.NextAttempt = now.Add(s.backoff(sa.Attempts))
+		s.logger.Warn(fmt.Sprintf("error sending spooled alert from rule %q", sa.Rule),
+			"id", id, "error", err, "next_attempt", sa.NextAttempt.Format(time.RFC822))
+		if err = s.save(sa); err != nil {
+			s.logger.Error("error updating spooled alert", "id", id, "error", err)
+		}
+	}
+}
+
+func (s *Spool) retry(ctx context.Context, sa *spooledAlert) error {
+	method := s.method(sa)
+	if method == nil {
+		return xerrors.Errorf("rule %q has no %s output at index %d", sa.Rule, sa.OutputType, sa.Output)
+	}
+	records := make([]*Record, 0, len(sa.Records))
+	for _, record := range sa.Records {
+		r := *record.Record
+		r.BodyField = record.BodyField
+		r.Documents = record.Documents
+		records = append(records, &r)
+	}
+	if sa.AlertID != "" {
+		ctx = WithAlertID(ctx, sa.AlertID)
+	}
+	if sa.FireCount > 0 {
+		ctx = WithFireCount(ctx, sa.FireCount, sa.FirstFired)
+	}
+	if sa.Query != nil {
+		ctx = WithQuery(ctx, sa.Query)
+	}
+	if err := method.Write(ctx, sa.Rule, records); err != nil {
+		return xerrors.Errorf("error writing alert to %s output: %w", method.Name(), err)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the next attempt to send
+// an alert which has failed the given number of retries.
+func (s *Spool) backoff(attempts int) time.Duration {
+	if s.interval >= maxSpoolBackoff {
+		return s.interval
+	}
+	backoff := s.interval
+	for i := 1; i < attempts && backoff < maxSpoolBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxSpoolBackoff {
+		return maxSpoolBackoff
+	}
+	return backoff
+}
+
+// bury moves the spooled alert to the '.dead' subdirectory.
+func (s *Spool) bury(id string) {
+	if err := os.Rename(s.path(id), filepath.Join(s.dir, deadDir, id+".json")); err != nil {
+		s.logger.Error("error moving spooled alert to the dead letter directory", "id", id, "error", err)
+	}
+}
+
+func readSpooled(file string) (*spooledAlert, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	sa := new(spooledAlert)
+	if err = json.Unmarshal(data, sa); err != nil {
+		return nil, err
+	}
+	for _, record := range sa.Records {
+		if record.Record == nil {
+			record.Record = new(Record)
+		}
+	}
+	return sa, nil
+}
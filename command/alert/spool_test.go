@@ -0,0 +1,370 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"golang.org/x/xerrors"
+)
+
+// spoolMethod is a mock Method which records what it was asked to
+// send and fails while err is not nil.
+type spoolMethod struct {
+	err     error
+	writes  int
+	records []*Record
+	alertID string
+}
+
+func (s *spoolMethod) Write(ctx context.Context, rule string, records []*Record) error {
+	s.writes++
+	if s.err != nil {
+		return s.err
+	}
+	s.records = records
+	s.alertID = AlertIDFromContext(ctx)
+	return nil
+}
+
+func (s *spoolMethod) Name() string {
+	return "spool"
+}
+
+// queryMethod is a spoolMethod which includes the query of an
+// alert with the given fields redacted.
+type queryMethod struct {
+	spoolMethod
+	redact []string
+}
+
+func (q *queryMethod) IncludedQuery(query map[string]interface{}) map[string]interface{} {
+	return RedactQuery(query, q.redact)
+}
+
+func newTestSpool(t *testing.T, clk clock.Clock) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSpool(&SpoolConfig{
+		Dir:           dir,
+		MaxAge:        time.Hour,
+		RetryInterval: time.Minute,
+		Logger:        hclog.NewNullLogger(),
+		Clock:         clk,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func spooledFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func spoolTestAlert(t *testing.T, method Method) *Alert {
+	return &Alert{
+		ID:       randomUUID(t),
+		RuleName: "test-rule",
+		AlertID:  "0123abcd",
+		Methods:  []Method{&spoolMethod{}, method},
+		Records: []*Record{
+			{Filter: "hits.hits._source", Text: "test", BodyField: true},
+			{Filter: "aggregations.hostname.buckets", Fields: []*Field{{Key: "foo", Count: 2}}},
+		},
+	}
+}
+
+func TestSpoolWrite(t *testing.T) {
+	clk := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	s, dir := newTestSpool(t, clk)
+	defer os.RemoveAll(dir)
+
+	a := spoolTestAlert(t, &spoolMethod{})
+	if err := s.Write(a, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	files := spooledFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 spooled alert, got %v", files)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		t.Fatalf("expected no temporary files to be left, got %v", tmp)
+	}
+	sa, err := readSpooled(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.Rule != "test-rule" || sa.AlertID != "0123abcd" || sa.Output != 1 || sa.OutputType != "spool" {
+		t.Fatalf("unexpected spooled alert: %+v", sa)
+	}
+	if !sa.NextAttempt.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("unexpected next attempt (got %s, expected %s)", sa.NextAttempt, clk.Now().Add(time.Minute))
+	}
+	if len(sa.Records) != 2 || !sa.Records[0].BodyField || sa.Records[1].Fields[0].Count != 2 {
+		t.Fatalf("unexpected spooled records: %+v", sa.Records)
+	}
+}
+
+func TestSpoolWriteQuery(t *testing.T) {
+	query := map[string]interface{}{
+		"term": map[string]interface{}{"token": "secret"},
+	}
+
+	cases := []struct {
+		name     string
+		method   Method
+		expected map[string]interface{}
+	}{
+		{
+			"not-included",
+			&spoolMethod{},
+			nil,
+		},
+		{
+			"redacted",
+			&queryMethod{redact: []string{"token"}},
+			map[string]interface{}{
+				"term": map[string]interface{}{"token": "[REDACTED]"},
+			},
+		},
+		{
+			"routed",
+			Route(&queryMethod{redact: []string{"token"}}, func(*Record, *Field) bool { return true }),
+			map[string]interface{}{
+				"term": map[string]interface{}{"token": "[REDACTED]"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s, dir := newTestSpool(t, clock.Real())
+			defer os.RemoveAll(dir)
+
+			a := spoolTestAlert(t, tc.method)
+			a.Query = query
+			if err := s.Write(a, 1); err != nil {
+				t.Fatal(err)
+			}
+			files := spooledFiles(t, dir)
+			if len(files) != 1 {
+				t.Fatalf("expected 1 spooled alert, got %v", files)
+			}
+			sa, err := readSpooled(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sa.Query, tc.expected) {
+				t.Fatalf("unexpected spooled query (got %v, expected %v)", sa.Query, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRunSpoolsFailedAlert(t *testing.T) {
+	clk := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	s, dir := newTestSpool(t, clk)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ah := NewHandler(&HandlerConfig{
+		Logger: hclog.NewNullLogger(),
+		Spool:  s,
+	})
+
+	method := &spoolMethod{err: xerrors.New("test error")}
+	outputCh := make(chan *Alert, 1)
+	outputCh <- spoolTestAlert(t, method)
+
+	go ah.Run(ctx, outputCh)
+	defer func() {
+		cancel()
+		<-ah.DoneCh
+	}()
+
+	// The alert is spooled once every attempt of the failing output
+	// has failed
+	var files []string
+	for len(files) == 0 && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+		files = spooledFiles(t, dir)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected the alert to be spooled, got %v", files)
+	}
+	sa, err := readSpooled(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.Rule != "test-rule" || sa.Output != 1 {
+		t.Fatalf("unexpected spooled alert: %+v", sa)
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	clk := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	s, dir := newTestSpool(t, clk)
+	defer os.RemoveAll(dir)
+
+	method := &spoolMethod{}
+	a := spoolTestAlert(t, method)
+	s.SetMethods(map[string][]Method{"test-rule": a.Methods})
+	if err := s.Write(a, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry is not due yet
+	s.Replay(context.Background(), false)
+	if method.writes != 0 {
+		t.Fatalf("expected no retries before the retry interval, got %d", method.writes)
+	}
+
+	// Draining the spool retries every alert
+	s.Replay(context.Background(), true)
+	if method.writes != 1 {
+		t.Fatalf("expected 1 retry, got %d", method.writes)
+	}
+	if len(method.records) != 2 || !method.records[0].BodyField || method.records[0].Text != "test" {
+		t.Fatalf("unexpected records: %+v", method.records)
+	}
+	if method.alertID != "0123abcd" {
+		t.Fatalf("unexpected alert ID (got %q, expected \"0123abcd\")", method.alertID)
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected the sent alert to be removed from the spool, got %v", files)
+	}
+}
+
+func TestSpoolReplayFailure(t *testing.T) {
+	clk := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	s, dir := newTestSpool(t, clk)
+	defer os.RemoveAll(dir)
+
+	method := &spoolMethod{err: xerrors.New("test error")}
+	a := spoolTestAlert(t, method)
+	s.SetMethods(map[string][]Method{"test-rule": a.Methods})
+	if err := s.Write(a, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(time.Minute)
+	s.Replay(context.Background(), false)
+	if method.writes != 1 {
+		t.Fatalf("expected 1 retry, got %d", method.writes)
+	}
+
+	files := spooledFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("expected the alert to remain in the spool, got %v", files)
+	}
+	sa, err := readSpooled(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.Attempts != 1 || !sa.NextAttempt.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("unexpected attempts after failed retry: %+v", sa)
+	}
+
+	// The delay doubles after each failed retry
+	clk.Advance(time.Minute)
+	s.Replay(context.Background(), false)
+	if sa, err = readSpooled(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if sa.Attempts != 2 || !sa.NextAttempt.Equal(clk.Now().Add(2*time.Minute)) {
+		t.Fatalf("unexpected attempts after failed retry: %+v", sa)
+	}
+
+	// Once the output succeeds, the alert is removed
+	method.err = nil
+	clk.Advance(2 * time.Minute)
+	s.Replay(context.Background(), false)
+	if method.writes != 3 {
+		t.Fatalf("expected 3 retries, got %d", method.writes)
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected the sent alert to be removed from the spool, got %v", files)
+	}
+}
+
+func TestSpoolExpiry(t *testing.T) {
+	clk := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	s, dir := newTestSpool(t, clk)
+	defer os.RemoveAll(dir)
+
+	method := &spoolMethod{}
+	a := spoolTestAlert(t, method)
+	if err := s.Write(a, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rule no longer exists, so the alert cannot be retried
+	s.Replay(context.Background(), true)
+	if files := spooledFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected the alert to remain in the spool, got %v", files)
+	}
+
+	s.SetMethods(map[string][]Method{"test-rule": a.Methods})
+	clk.Advance(time.Hour)
+	s.Replay(context.Background(), true)
+	if method.writes != 0 {
+		t.Fatalf("expected the expired alert not to be retried, got %d retries", method.writes)
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected the expired alert to be removed from the spool, got %v", files)
+	}
+	dead := spooledFiles(t, filepath.Join(dir, deadDir))
+	if len(dead) != 1 {
+		t.Fatalf("expected the expired alert to be moved to %s, got %v", deadDir, dead)
+	}
+	if _, err := readSpooled(dead[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	s := &Spool{interval: time.Minute}
+	cases := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{10, maxSpoolBackoff},
+	}
+	for _, tc := range cases {
+		if got := s.backoff(tc.attempts); got != tc.expected {
+			t.Errorf("unexpected backoff after %d attempts (got %s, expected %s)", tc.attempts, got, tc.expected)
+		}
+	}
+}
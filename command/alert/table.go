@@ -0,0 +1,54 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"strings"
+)
+
+// tableCellReplacer escapes the characters of a field key which
+// would otherwise break a row of a markdown table.
+var tableCellReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	"|", `\|`,
+	"\r\n", " ",
+	"\n", " ",
+	"\r", " ",
+)
+
+// FieldsTable renders the fields as a markdown table with the
+// columns "Key" and "Count", one row per field in the given order.
+// The value of a field which has one replaces its count (see
+// Field.Display).
+// Pipe characters in the keys are escaped and line breaks are
+// replaced with spaces so that they do not break the table. It
+// returns an empty string if there are no fields.
+func FieldsTable(fields []*Field) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("| Key | Count |\n| --- | ---: |\n")
+	for _, field := range fields {
+		if field == nil {
+			continue
+		}
+		b.WriteString("| ")
+		b.WriteString(tableCellReplacer.Replace(field.Key))
+		b.WriteString(" | ")
+		b.WriteString(tableCellReplacer.Replace(field.Display()))
+		b.WriteString(" |\n")
+	}
+	return b.String()
+}
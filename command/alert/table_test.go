@@ -0,0 +1,65 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import "testing"
+
+func TestFieldsTable(t *testing.T) {
+	cases := []struct {
+		name     string
+		fields   []*Field
+		expected string
+	}{
+		{
+			"fields",
+			[]*Field{
+				{Key: "foo", Count: 10},
+				{Key: "a|b", Count: 3},
+				{Key: "line\nbreak", Count: 0},
+				{Key: `back\|slash`, Count: 1},
+			},
+			"| Key | Count |\n" +
+				"| --- | ---: |\n" +
+				"| foo | 10 |\n" +
+				"| a\\|b | 3 |\n" +
+				"| line break | 0 |\n" +
+				"| back\\\\\\|slash | 1 |\n",
+		},
+		{
+			"values",
+			[]*Field{
+				{Key: "foo", Count: 10, Value: "12.5 ms"},
+				{Key: "bar", Count: 3},
+			},
+			"| Key | Count |\n" +
+				"| --- | ---: |\n" +
+				"| foo | 12.5 ms |\n" +
+				"| bar | 3 |\n",
+		},
+		{
+			"no-fields",
+			nil,
+			"",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := FieldsTable(tc.fields); got != tc.expected {
+				t.Fatalf("unexpected table:\n%s\nexpected:\n%s", got, tc.expected)
+			}
+		})
+	}
+}
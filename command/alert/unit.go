@@ -0,0 +1,84 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"math"
+	"strconv"
+)
+
+const (
+	// UnitBytes formats numbers as a size in bytes in the largest
+	// binary multiple (e.g. "512 MB") which keeps them at or above 1
+	UnitBytes = "bytes"
+
+	// UnitSeconds formats numbers as a duration in seconds in the
+	// largest of milliseconds, seconds, minutes and hours which
+	// keeps them at or above 1 (e.g. "1.2 s")
+	UnitSeconds = "s"
+
+	// UnitMillis is like UnitSeconds for durations in milliseconds
+	UnitMillis = "ms"
+)
+
+// byteUnits are the binary multiples of a byte with which UnitBytes
+// is formatted.
+var byteUnits = []string{"B", "KB", "MB", "GB", "TB", "PB"}
+
+// durationUnits are the units, and their length in seconds, with
+// which UnitSeconds and UnitMillis are formatted, from the largest.
+var durationUnits = []struct {
+	name    string
+	seconds float64
+}{
+	{"h", 3600},
+	{"min", 60},
+	{"s", 1},
+	{"ms", 0.001},
+}
+
+// FormatUnit formats v, a number in the given unit, rounded to one
+// decimal place. Sizes (UnitBytes) and durations (UnitSeconds and
+// UnitMillis) are scaled to the largest unit which keeps them at or
+// above 1. Any other unit (e.g. "%") is appended to v as it is.
+func FormatUnit(v float64, unit string) string {
+	switch unit {
+	case UnitBytes:
+		i := 0
+		for ; i < len(byteUnits)-1 && math.Abs(v) >= 1024; i++ {
+			v /= 1024
+		}
+		return formatScaled(v) + " " + byteUnits[i]
+	case UnitSeconds, UnitMillis:
+		if unit == UnitMillis {
+			v /= 1000
+		}
+		for _, u := range durationUnits[:len(durationUnits)-1] {
+			if math.Abs(v) >= u.seconds {
+				return formatScaled(v/u.seconds) + " " + u.name
+			}
+		}
+		last := durationUnits[len(durationUnits)-1]
+		return formatScaled(v/last.seconds) + " " + last.name
+	case "":
+		return formatScaled(v)
+	}
+	return formatScaled(v) + " " + unit
+}
+
+// formatScaled formats v rounded to one decimal place, without
+// trailing zeros.
+func formatScaled(v float64) string {
+	return strconv.FormatFloat(math.Round(v*10)/10, 'f', -1, 64)
+}
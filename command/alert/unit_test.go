@@ -0,0 +1,86 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package alert
+
+import (
+	"testing"
+)
+
+func TestFormatUnit(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    float64
+		unit     string
+		expected string
+	}{
+		{"bytes", 512, UnitBytes, "512 B"},
+		{"kilobytes", 1536, UnitBytes, "1.5 KB"},
+		{"megabytes", 512 * 1024 * 1024, UnitBytes, "512 MB"},
+		{"gigabytes", 3.25 * 1024 * 1024 * 1024, UnitBytes, "3.3 GB"},
+		{"petabytes", 2048 * 1024 * 1024 * 1024 * 1024 * 1024, UnitBytes, "2048 PB"},
+		{"negative-bytes", -2048, UnitBytes, "-2 KB"},
+		{"seconds", 1.2, UnitSeconds, "1.2 s"},
+		{"sub-second", 0.35, UnitSeconds, "350 ms"},
+		{"minutes", 150, UnitSeconds, "2.5 min"},
+		{"hours", 5400, UnitSeconds, "1.5 h"},
+		{"millis", 1234, UnitMillis, "1.2 s"},
+		{"sub-milli", 0.25, UnitMillis, "0.3 ms"},
+		{"zero-millis", 0, UnitMillis, "0 ms"},
+		{"plain", 12.345, "", "12.3"},
+		{"plain-integer", 120, "", "120"},
+		{"other-unit", 99.95, "%", "100 %"},
+		{"other-unit-word", 7, "requests", "7 requests"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := FormatUnit(tc.value, tc.unit); got != tc.expected {
+				t.Fatalf("unexpected formatted value (got %q, expected %q)", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFieldExceeds(t *testing.T) {
+	number := func(v float64) *float64 { return &v }
+	cases := []struct {
+		name     string
+		field    *Field
+		display  string
+		expected bool
+	}{
+		{"count", &Field{Key: "foo", Count: 3}, "3", false},
+		{"no-threshold", &Field{Key: "foo", Count: 3, Value: "900", Number: number(900), Unit: UnitMillis},
+			"900 ms", false},
+		{"below", &Field{Key: "foo", Count: 3, Value: "250", Number: number(250), Threshold: number(500)},
+			"250", false},
+		{"equal", &Field{Key: "foo", Count: 3, Value: "500", Number: number(500), Threshold: number(500)},
+			"500", false},
+		{"above", &Field{Key: "foo", Count: 3, Value: "1200", Number: number(1200), Unit: UnitMillis,
+			Threshold: number(500)}, "1.2 s", true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.field.Display(); got != tc.display {
+				t.Fatalf("unexpected displayed value (got %q, expected %q)", got, tc.display)
+			}
+			if got := tc.field.Exceeds(); got != tc.expected {
+				t.Fatalf("unexpected result of Exceeds (got %t, expected %t)", got, tc.expected)
+			}
+		})
+	}
+}
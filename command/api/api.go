@@ -0,0 +1,480 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package api serves an HTTP API which reports the rules the daemon
+// is running and what each of them last did, and which may execute,
+// pause and resume them on demand.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/query"
+	"golang.org/x/xerrors"
+)
+
+const (
+	rulesPath = "/rules"
+
+	// runSuffix is the suffix of the path of a rule which executes
+	// it on demand
+	runSuffix = "/run"
+
+	// pauseSuffix and resumeSuffix are the suffixes of the path of a
+	// rule, or of the path of the rules, which pause or resume it or
+	// all of them
+	pauseSuffix  = "/pause"
+	resumeSuffix = "/resume"
+
+	// runTimeout is how long an on-demand execution may take,
+	// including waiting for the rule to be between executions
+	runTimeout = 2 * time.Minute
+
+	// shutdownTimeout is how long in-flight requests are given to
+	// complete once the server is stopped
+	shutdownTimeout = 5 * time.Second
+)
+
+// Config configures the API server.
+type Config struct {
+	// Address is the address on which the server listens
+	Address string
+
+	// Token, if not empty, is the bearer token with which every
+	// request must be authenticated
+	Token string
+
+	// TLSCert and TLSKey are the paths to the PEM-encoded
+	// certificate and private key with which the API is served over
+	// HTTPS. If empty, the API is served over plain HTTP
+	TLSCert string
+	TLSKey  string
+
+	// ClientCA is the path to a PEM-encoded CA certificate file. If
+	// set, clients must present a certificate signed by one of its
+	// CAs. It requires TLSCert and TLSKey
+	ClientCA string
+
+	// AllowRun is whether rules may be executed on demand with
+	// POST /rules/{name}/run. Otherwise, the API is read-only
+	AllowRun bool
+
+	// AllowPause is whether rules may be paused and resumed with
+	// POST /rules/{name}/pause and POST /rules/{name}/resume, or all
+	// of them with POST /rules/pause and POST /rules/resume
+	AllowPause bool
+
+	// Rules returns the query handlers of the rules currently being
+	// run. It is called on every request since the rules change
+	// when they are reloaded
+	Rules func() []*query.QueryHandler
+
+	Logger hclog.Logger
+}
+
+// Server is the API server.
+type Server struct {
+	address    string
+	token      string
+	tlsConfig  *tls.Config
+	allowRun   bool
+	allowPause bool
+	rules      func() []*query.QueryHandler
+	logger     hclog.Logger
+}
+
+// NewServer creates a new *Server, loading its certificates if
+// the API is served over HTTPS.
+func NewServer(config *Config) (*Server, error) {
+	if config == nil {
+		return nil, xerrors.New("no config provided")
+	}
+	if config.Rules == nil {
+		return nil, xerrors.New("no rules provided")
+	}
+	if config.Token == "" && config.ClientCA == "" {
+		return nil, xerrors.New("either a token or a client CA must be provided")
+	}
+	if config.Logger == nil {
+		config.Logger = hclog.Default()
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		address:    config.Address,
+		token:      config.Token,
+		tlsConfig:  tlsConfig,
+		allowRun:   config.AllowRun,
+		allowPause: config.AllowPause,
+		rules:      config.Rules,
+		logger:     config.Logger,
+	}, nil
+}
+
+// newTLSConfig loads the certificates with which the API is served,
+// or returns nil if it is served over plain HTTP.
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCert == "" && config.TLSKey == "" {
+		if config.ClientCA != "" {
+			return nil, xerrors.New("a client CA requires a TLS certificate and key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, xerrors.Errorf("error loading X509 key pair: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.ClientCA != "" {
+		var caCert []byte
+		if caCert, err = ioutil.ReadFile(config.ClientCA); err != nil {
+			return nil, xerrors.Errorf("error reading client CA certificate file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, xerrors.Errorf("no certificates found in client CA certificate file %s", config.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Run listens on the address of the server and serves the API until
+// ctx is done. It returns a non-nil error if the server could not
+// listen or stopped unexpectedly.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return xerrors.Errorf("error listening on %s: %v", s.address, err)
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          s.logger.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true}),
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+	s.logger.Info("API listening", "address", ln.Addr().String(), "tls", s.tlsConfig != nil)
+
+	select {
+	case err = <-errCh:
+		return xerrors.Errorf("error serving API: %v", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		return xerrors.Errorf("error shutting down API: %v", err)
+	}
+	return nil
+}
+
+// Handler returns the http.Handler serving the API. Every request
+// must be authenticated with the token of the server, if it has
+// one, and only GET and HEAD requests are accepted, along with
+// POST /rules/{name}/run if the server allows rules to be run and
+// the POST requests which pause and resume rules if it allows rules
+// to be paused.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(rulesPath, s.listRules)
+	mux.HandleFunc(rulesPath+"/", s.getRule)
+	return s.authenticate(mux)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "missing or invalid token")
+				return
+			}
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.allowPost(r) {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, "the API is read-only")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowPost returns whether the server allows the POST request r.
+func (s *Server) allowPost(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	if strings.HasSuffix(r.URL.Path, runSuffix) {
+		return s.allowRun
+	}
+	if strings.HasSuffix(r.URL.Path, pauseSuffix) || strings.HasSuffix(r.URL.Path, resumeSuffix) {
+		return s.allowPause
+	}
+	return false
+}
+
+// listRules serves GET /rules, the summary of every rule.
+func (s *Server) listRules(w http.ResponseWriter, r *http.Request) {
+	qhs := s.rules()
+	rules := make([]*rule, 0, len(qhs))
+	for _, qh := range qhs {
+		rules = append(rules, newRule(qh, qh.Status()))
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// getRule serves GET /rules/{name}, the detail of a single rule.
+func (s *Server) getRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if strings.HasSuffix(r.URL.Path, runSuffix) {
+			s.runRule(w, r)
+		} else {
+			s.pauseRule(w, r)
+		}
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, rulesPath+"/")
+	for _, qh := range s.rules() {
+		if qh.Name() == name {
+			writeJSON(w, http.StatusOK, newRuleDetail(qh))
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "no rule named "+name)
+}
+
+// runResult is the outcome of an on-demand execution returned by
+// POST /rules/{name}/run.
+type runResult struct {
+	Name    string `json:"name"`
+	Result  string `json:"result"`
+	Matched int    `json:"matched"`
+	Alerted bool   `json:"alerted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runRule serves POST /rules/{name}/run, which executes a rule once,
+// now, and reports what happened. The name is taken from the escaped
+// path so that a rule whose name ends with "/run" can be told apart.
+func (s *Server) runRule(w http.ResponseWriter, r *http.Request) {
+	escaped := strings.TrimSuffix(strings.TrimPrefix(r.URL.EscapedPath(), rulesPath+"/"), runSuffix)
+	name, err := url.PathUnescape(escaped)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid rule name")
+		return
+	}
+
+	var qh *query.QueryHandler
+	for _, h := range s.rules() {
+		if h.Name() == name {
+			qh = h
+			break
+		}
+	}
+	if qh == nil {
+		writeError(w, http.StatusNotFound, "no rule named "+name)
+		return
+	}
+
+	s.logger.Info("Executing rule on demand", "rule", name, "remote_addr", r.RemoteAddr)
+	ctx, cancel := context.WithTimeout(r.Context(), runTimeout)
+	defer cancel()
+	res, err := qh.Trigger(ctx)
+	switch {
+	case err == query.ErrNotLeader || err == query.ErrPaused:
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, "error executing rule: "+err.Error())
+		return
+	}
+
+	result := &runResult{
+		Name:    name,
+		Result:  res.Result,
+		Matched: res.Matched,
+		Alerted: res.Result == query.ResultAlert,
+	}
+	if res.Err != nil {
+		result.Error = res.Err.Error()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// pauseRule serves POST /rules/{name}/pause and /resume, which pause
+// or resume a rule and return its summary, and POST /rules/pause and
+// /rules/resume, which pause or resume every rule and return their
+// summaries. As in runRule, the name is taken from the escaped path.
+func (s *Server) pauseRule(w http.ResponseWriter, r *http.Request) {
+	suffix, pause := resumeSuffix, false
+	if strings.HasSuffix(r.URL.Path, pauseSuffix) {
+		suffix, pause = pauseSuffix, true
+	}
+	apply := func(qh *query.QueryHandler) {
+		switch {
+		case pause && qh.Pause():
+			s.logger.Info("Pausing rule on demand", "rule", qh.Name(), "remote_addr", r.RemoteAddr)
+		case !pause && qh.Resume():
+			s.logger.Info("Resuming rule on demand", "rule", qh.Name(), "remote_addr", r.RemoteAddr)
+		}
+	}
+
+	escaped := strings.TrimPrefix(r.URL.EscapedPath(), rulesPath+"/")
+	if "/"+escaped == suffix {
+		qhs := s.rules()
+		rules := make([]*rule, 0, len(qhs))
+		for _, qh := range qhs {
+			apply(qh)
+			rules = append(rules, newRule(qh, qh.Status()))
+		}
+		writeJSON(w, http.StatusOK, rules)
+		return
+	}
+
+	name, err := url.PathUnescape(strings.TrimSuffix(escaped, suffix))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid rule name")
+		return
+	}
+	for _, qh := range s.rules() {
+		if qh.Name() == name {
+			apply(qh)
+			writeJSON(w, http.StatusOK, newRule(qh, qh.Status()))
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "no rule named "+name)
+}
+
+// output describes an output of a rule.
+type output struct {
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+// rule is the summary of a rule returned by GET /rules.
+type rule struct {
+	Name       string     `json:"name"`
+	Schedule   string     `json:"schedule"`
+	Enabled    bool       `json:"enabled"`
+	Outputs    []output   `json:"outputs"`
+	LastRun    *time.Time `json:"last_run"`
+	NextRun    *time.Time `json:"next_run"`
+	LastResult string     `json:"last_result,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	Heartbeat  *time.Time `json:"last_heartbeat"`
+	Restarts   int        `json:"restarts"`
+	StuckSince *time.Time `json:"stuck_since"`
+	Abandoned  int        `json:"abandoned_runs"`
+	Paused     bool       `json:"paused"`
+	PausedAt   *time.Time `json:"paused_since"`
+}
+
+// ruleDetail is the detail of a rule returned by GET /rules/{name}.
+type ruleDetail struct {
+	rule
+	Index       string     `json:"index"`
+	LastAlert   *time.Time `json:"last_alert"`
+	FiringSince *time.Time `json:"firing_since"`
+	AlertID     string     `json:"alert_id,omitempty"`
+}
+
+// newRule summarizes the rule of the query handler given its
+// status. A rule is enabled unless all of its outputs are disabled.
+func newRule(qh *query.QueryHandler, status query.Status) *rule {
+	r := &rule{
+		Name:       qh.Name(),
+		Schedule:   qh.Schedule(),
+		Outputs:    make([]output, 0, len(qh.Outputs())),
+		LastRun:    timePtr(status.LastRun),
+		NextRun:    timePtr(status.NextRun),
+		LastResult: status.LastResult,
+		LastError:  status.LastError,
+		Heartbeat:  timePtr(status.Heartbeat),
+		Restarts:   status.Restarts,
+		StuckSince: timePtr(status.StuckSince),
+		Abandoned:  status.AbandonedRuns,
+		Paused:     status.Paused,
+		PausedAt:   timePtr(status.PausedSince),
+	}
+	for _, method := range qh.Outputs() {
+		enabled := alert.Enabled(method)
+		r.Enabled = r.Enabled || enabled
+		r.Outputs = append(r.Outputs, output{Type: method.Name(), Enabled: enabled})
+	}
+	return r
+}
+
+func newRuleDetail(qh *query.QueryHandler) *ruleDetail {
+	status := qh.Status()
+	return &ruleDetail{
+		rule:        *newRule(qh, status),
+		Index:       qh.Index(),
+		LastAlert:   timePtr(status.LastAlert),
+		FiringSince: timePtr(status.FiringSince),
+		AlertID:     status.AlertID,
+	}
+}
+
+// timePtr returns a pointer to t, or nil if t is the zero time so
+// that unknown times are encoded as null.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v) // nolint: errcheck
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,381 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/query"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+)
+
+func newQueryHandler(t *testing.T, name string, methods ...alert.Method) *query.QueryHandler {
+	qh, err := query.NewQueryHandler(&query.QueryHandlerConfig{
+		Name:         name,
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        "http://127.0.0.1:9200",
+		QueryIndex:   "test-*",
+		QueryData:    map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:     "@every 10m",
+		AlertMethods: methods,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qh
+}
+
+func TestHandler(t *testing.T) {
+	fm, err := file.NewAlertMethod(&file.AlertMethodConfig{OutputFilepath: "alerts.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qhs := []*query.QueryHandler{
+		newQueryHandler(t, "errors", fm),
+		newQueryHandler(t, "slow requests/api", alert.Disable(fm)),
+	}
+	s, err := NewServer(&Config{
+		Token:  "secret",
+		Rules:  func() []*query.QueryHandler { return qhs },
+		Logger: hclog.NewNullLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"no-token", http.MethodGet, "/rules", "", http.StatusUnauthorized},
+		{"wrong-token", http.MethodGet, "/rules", "wrong", http.StatusUnauthorized},
+		{"list", http.MethodGet, "/rules", "secret", http.StatusOK},
+		{"detail", http.MethodGet, "/rules/slow%20requests%2Fapi", "secret", http.StatusOK},
+		{"unknown-rule", http.MethodGet, "/rules/missing", "secret", http.StatusNotFound},
+		{"read-only", http.MethodPost, "/rules", "secret", http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, ts.URL+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Fatalf("unexpected status code (got %d, expected %d)", resp.StatusCode, tc.status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			switch tc.name {
+			case "list":
+				var rules []*rule
+				if err = json.NewDecoder(resp.Body).Decode(&rules); err != nil {
+					t.Fatal(err)
+				}
+				if len(rules) != 2 {
+					t.Fatalf("expected 2 rules but got %d", len(rules))
+				}
+				if rules[0].Name != "errors" || rules[0].Schedule != "@every 10m" || !rules[0].Enabled {
+					t.Fatalf("unexpected rule: %+v", rules[0])
+				}
+				if len(rules[1].Outputs) != 1 || rules[1].Outputs[0].Type != "file" || rules[1].Outputs[0].Enabled {
+					t.Fatalf("unexpected outputs: %+v", rules[1].Outputs)
+				}
+				if rules[1].Enabled {
+					t.Fatal("a rule whose outputs are all disabled should not be enabled")
+				}
+				if rules[0].LastRun != nil {
+					t.Fatalf("expected no last run but got %s", rules[0].LastRun)
+				}
+			case "detail":
+				var detail ruleDetail
+				if err = json.NewDecoder(resp.Body).Decode(&detail); err != nil {
+					t.Fatal(err)
+				}
+				if detail.Name != "slow requests/api" || detail.Index != "test-*" {
+					t.Fatalf("unexpected rule: %+v", detail)
+				}
+			}
+		})
+	}
+}
+
+func TestRunRule(t *testing.T) {
+	// The state says the rules are not due for an hour, so that only
+	// the on-demand executions query the index
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "go-es-alerts") && strings.HasSuffix(r.URL.Path, "/_search"):
+			fmt.Fprintf(w, `{"hits":{"hits":[{"_source":{"next_query":%q}}]}}`,
+				time.Now().Add(time.Hour).Format(time.RFC3339))
+		case strings.Contains(r.URL.Path, "go-es-alerts") && strings.HasSuffix(r.URL.Path, "/_doc"):
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/test-index/_search":
+			w.Write([]byte(`{"hits":{"hits":[{"_source":{"level":"error"}}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	newRunningHandler := func(name string) *query.QueryHandler {
+		qh, err := query.NewQueryHandler(&query.QueryHandlerConfig{
+			Name:          name,
+			Logger:        hclog.NewNullLogger(),
+			ESUrl:         ts.URL,
+			QueryIndex:    "test-index",
+			QueryData:     map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}},
+			Schedule:      "@every 1h",
+			AlertMethods:  []alert.Method{&file.AlertMethod{}},
+			AlertCooldown: 10 * time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return qh
+	}
+	qhs := []*query.QueryHandler{
+		newRunningHandler("errors/run"),
+		newRunningHandler("follower"),
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	outputCh := make(chan *alert.Alert, 2)
+	leaderLock, followerLock := lock.NewLock(), lock.NewLock()
+	leaderLock.Set(true)
+	wg.Add(2)
+	go qhs[0].Run(ctx, outputCh, &wg, leaderLock)
+	go qhs[1].Run(ctx, outputCh, &wg, followerLock)
+
+	newServer := func(allowRun bool) *httptest.Server {
+		s, err := NewServer(&Config{
+			Token:    "secret",
+			AllowRun: allowRun,
+			Rules:    func() []*query.QueryHandler { return qhs },
+			Logger:   hclog.NewNullLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewServer(s.Handler())
+	}
+	srv := newServer(true)
+	defer srv.Close()
+	readOnly := newServer(false)
+	defer readOnly.Close()
+
+	cases := []struct {
+		name     string
+		url      string
+		status   int
+		expected *runResult
+	}{
+		{"read-only", readOnly.URL + "/rules/errors%2Frun/run", http.StatusMethodNotAllowed, nil},
+		{"unknown-rule", srv.URL + "/rules/missing/run", http.StatusNotFound, nil},
+		{"alert", srv.URL + "/rules/errors%2Frun/run", http.StatusOK,
+			&runResult{Name: "errors/run", Result: query.ResultAlert, Matched: 1, Alerted: true}},
+		{"cooldown", srv.URL + "/rules/errors%2Frun/run", http.StatusOK,
+			&runResult{Name: "errors/run", Result: query.ResultSuppressed, Matched: 1}},
+		{"not-leader", srv.URL + "/rules/follower/run", http.StatusConflict, nil},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodPost, tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result runResult
+		decodeErr := json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: unexpected status code (got %d, expected %d)", tc.name, resp.StatusCode, tc.status)
+		}
+		if tc.expected == nil {
+			continue
+		}
+		if decodeErr != nil {
+			t.Fatalf("%s: %v", tc.name, decodeErr)
+		}
+		if result != *tc.expected {
+			t.Fatalf("%s: unexpected result (got %+v, expected %+v)", tc.name, result, *tc.expected)
+		}
+	}
+
+	select {
+	case a := <-outputCh:
+		if a.RuleName != "errors/run" || len(a.Records) != 1 {
+			t.Fatalf("unexpected alert: %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the alert of the on-demand execution")
+	}
+	if status := qhs[0].Status(); status.LastResult != query.ResultSuppressed || !status.NextRun.After(time.Now()) {
+		t.Fatalf("unexpected status after the on-demand executions: %+v", status)
+	}
+}
+
+func TestPauseRule(t *testing.T) {
+	fm, err := file.NewAlertMethod(&file.AlertMethodConfig{OutputFilepath: "alerts.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qhs := []*query.QueryHandler{
+		newQueryHandler(t, "errors", fm),
+		newQueryHandler(t, "slow requests/api", fm),
+	}
+	newServer := func(allowPause bool) *httptest.Server {
+		s, err := NewServer(&Config{
+			Token:      "secret",
+			AllowRun:   true,
+			AllowPause: allowPause,
+			Rules:      func() []*query.QueryHandler { return qhs },
+			Logger:     hclog.NewNullLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewServer(s.Handler())
+	}
+	srv := newServer(true)
+	defer srv.Close()
+	readOnly := newServer(false)
+	defer readOnly.Close()
+
+	cases := []struct {
+		name   string
+		url    string
+		status int
+		paused []bool
+	}{
+		{"not-allowed", readOnly.URL + "/rules/errors/pause", http.StatusMethodNotAllowed, []bool{false, false}},
+		{"unknown-rule", srv.URL + "/rules/missing/pause", http.StatusNotFound, []bool{false, false}},
+		{"pause", srv.URL + "/rules/slow%20requests%2Fapi/pause", http.StatusOK, []bool{false, true}},
+		{"pause-paused", srv.URL + "/rules/slow%20requests%2Fapi/pause", http.StatusOK, []bool{false, true}},
+		{"pause-all", srv.URL + "/rules/pause", http.StatusOK, []bool{true, true}},
+		{"resume", srv.URL + "/rules/errors/resume", http.StatusOK, []bool{false, true}},
+		{"resume-all", srv.URL + "/rules/resume", http.StatusOK, []bool{false, false}},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodPost, tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: unexpected status code (got %d, expected %d)", tc.name, resp.StatusCode, tc.status)
+		}
+		for i, qh := range qhs {
+			if qh.Paused() != tc.paused[i] {
+				t.Fatalf("%s: unexpected paused state of rule %q (got %t, expected %t)",
+					tc.name, qh.Name(), qh.Paused(), tc.paused[i])
+			}
+		}
+	}
+
+	// The summaries report the paused state
+	qhs[0].Pause()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/rules", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var rules []*rule
+	if err = json.NewDecoder(resp.Body).Decode(&rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || !rules[0].Paused || rules[0].PausedAt == nil || rules[1].Paused || rules[1].PausedAt != nil {
+		t.Fatalf("unexpected rules: %+v, %+v", rules[0], rules[1])
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	rules := func() []*query.QueryHandler { return nil }
+	cases := []struct {
+		name   string
+		config *Config
+		err    bool
+	}{
+		{"token", &Config{Token: "secret", Rules: rules}, false},
+		{"no-config", nil, true},
+		{"no-rules", &Config{Token: "secret"}, true},
+		{"no-auth", &Config{Rules: rules}, true},
+		{"client-ca-without-tls", &Config{ClientCA: "ca.pem", Rules: rules}, true},
+		{"missing-certificate", &Config{Token: "secret", TLSCert: "cert.pem", TLSKey: "key.pem", Rules: rules}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewServer(tc.config)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
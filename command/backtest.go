@@ -0,0 +1,193 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/query"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+const backtestUsage = "Usage: go-elasticsearch-alerts backtest -since <time> -until <time> <rule-name>"
+
+// backtestLine is a line of the output of the backtest subcommand.
+// Each run of the rule is printed as a line of type "run" followed
+// by a line of type "summary".
+type backtestLine struct {
+	Type string `json:"type"`
+	Rule string `json:"rule"`
+
+	*query.BacktestRun
+
+	Since      *time.Time `json:"since,omitempty"`
+	Until      *time.Time `json:"until,omitempty"`
+	Runs       *int       `json:"runs,omitempty"`
+	Alerts     *int       `json:"alerts,omitempty"`
+	Suppressed *int       `json:"suppressed,omitempty"`
+	Errors     *int       `json:"errors,omitempty"`
+}
+
+// RunBacktest replays a rule against a fixed historical window and
+// prints, as one JSON object per line, what the rule would have
+// done each time it was scheduled within the window followed by a
+// summary. Nothing is sent to the outputs of the rule. The args are
+// the command-line arguments following the subcommand. This
+// function should be called directly within os.Exit() in your
+// main.main() function.
+func RunBacktest(args []string) int {
+	var since, until string
+	fs := flag.NewFlagSet("backtest", flag.ContinueOnError)
+	fs.StringVar(&since, "since", "", "the start of the window (RFC 3339)")
+	fs.StringVar(&until, "until", "", "the end of the window (RFC 3339); defaults to now")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	// Allow the flags to follow the rule name as well
+	rest := fs.Args()
+	if len(rest) > 1 {
+		if err := fs.Parse(rest[1:]); err != nil {
+			return 1
+		}
+		rest = append([]string{rest[0]}, fs.Args()...)
+	}
+	if len(rest) != 1 || rest[0] == "" || since == "" {
+		fmt.Fprintln(os.Stderr, backtestUsage)
+		return 1
+	}
+	name := rest[0]
+
+	start, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing -since: %v\n", err)
+		return 1
+	}
+	end := time.Now()
+	if until != "" {
+		if end, err = time.Parse(time.RFC3339, until); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing -until: %v\n", err)
+			return 1
+		}
+	}
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+
+	var rules []config.RuleConfig
+	for _, rule := range cfg.Rules {
+		if rule.Name == name {
+			rules = append(rules, rule)
+			break
+		}
+	}
+	if len(rules) == 0 {
+		fmt.Fprintf(os.Stderr, "No rule named %q\n", name)
+		return 1
+	}
+
+	// Warnings and errors go to stderr so that stdout is only JSON
+	logger := hclog.New(&hclog.LoggerOptions{
+		Output: os.Stderr,
+		Level:  hclog.Warn,
+	})
+
+	esClient, err := newESClient(cfg, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating new Elasticsearch HTTP client: %v\n", err)
+		return 1
+	}
+
+	opts := &alert.FactoryOptions{
+		Client: logRequests(cfg.NewHTTPClient(), "outputs"),
+		Logger: logger,
+	}
+	qhs, err := buildQueryHandlers(rules, cfg.Elasticsearch, cfg.State, cfg.MaintenanceWindows, cfg.IndexPolicy(),
+		esClient, opts, nil, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating query handler from rule: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownCh := makeShutdownCh()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-shutdownCh:
+			cancel()
+		}
+	}()
+
+	runs, err := qhs[0].Backtest(ctx, start, end)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error backtesting rule %q: %v\n", name, err)
+		return 1
+	}
+	return printBacktest(os.Stdout, name, start, end, runs)
+}
+
+// printBacktest prints the runs and the summary of a backtest as
+// JSON lines. It returns a non-zero status if any run failed.
+func printBacktest(w io.Writer, rule string, since, until time.Time, runs []*query.BacktestRun) int {
+	enc := json.NewEncoder(w)
+
+	var alerts, suppressed, errs int
+	for _, run := range runs {
+		switch run.Result {
+		case query.ResultAlert:
+			alerts++
+		case query.ResultSuppressed:
+			suppressed++
+		case query.ResultError:
+			errs++
+		}
+		if err := enc.Encode(&backtestLine{Type: "run", Rule: rule, BacktestRun: run}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding run: %v\n", err)
+			return 1
+		}
+	}
+
+	total := len(runs)
+	summary := &backtestLine{
+		Type:       "summary",
+		Rule:       rule,
+		Since:      &since,
+		Until:      &until,
+		Runs:       &total,
+		Alerts:     &alerts,
+		Suppressed: &suppressed,
+		Errors:     &errs,
+	}
+	if err := enc.Encode(summary); err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding summary: %v\n", err)
+		return 1
+	}
+	if errs > 0 {
+		return 1
+	}
+	return 0
+}
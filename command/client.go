@@ -14,13 +14,76 @@
 package command
 
 import (
+	"net/http"
 	"os"
 	"strings"
 
 	consul "github.com/hashicorp/consul/api"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/vault"
 	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/httplog"
+	"golang.org/x/xerrors"
 )
 
+// LogRequests is whether the HTTP requests made to Elasticsearch,
+// Vault, and the outputs, and the responses to them, are logged in
+// full (with their secrets redacted, and without the bodies for
+// Vault since they hold the credentials). It is set by the
+// '-log-requests' flag and should be set before any of the Run
+// functions is called.
+var LogRequests bool
+
+// logRequests returns the client, wrapped so that it logs its
+// requests and responses under the given name if LogRequests is
+// set.
+func logRequests(client *http.Client, name string) *http.Client {
+	if !LogRequests {
+		return client
+	}
+	return httplog.Wrap(client, hclog.Default().Named("http").Named(name))
+}
+
+// logVaultRequests is like logRequests but leaves the bodies of the
+// requests and responses, which hold the credentials read from
+// Vault, out of the logs.
+func logVaultRequests(client *http.Client) *http.Client {
+	if !LogRequests {
+		return client
+	}
+	return httplog.WrapHeaders(client, hclog.Default().Named("http").Named("vault"))
+}
+
+// newESClient creates the HTTP client used to communicate with
+// Elasticsearch. If 'elasticsearch.vault' is configured, each
+// request is authenticated with credentials read from Vault.
+func newESClient(cfg *config.Config, logger hclog.Logger) (*http.Client, error) {
+	client, err := cfg.NewESClient()
+	if err != nil {
+		return nil, err
+	}
+	client = logRequests(client, "elasticsearch")
+
+	vc := cfg.Elasticsearch.Vault
+	if vc == nil {
+		return client, nil
+	}
+
+	provider, err := vault.NewProvider(&vault.ProviderConfig{
+		Address:       vc.Address,
+		Path:          vc.Path,
+		UsernameField: vc.UsernameField,
+		PasswordField: vc.PasswordField,
+		RenewBefore:   vc.RenewBefore,
+		Client:        logVaultRequests(cfg.NewHTTPClient()),
+		Logger:        logger.Named("vault"),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error creating Vault credentials provider: %v", err)
+	}
+	return provider.Wrap(client), nil
+}
+
 func newConsulClient(config config.ConsulConfig) (*consul.Client, error) {
 	consulEnvVars := []string{
 		consul.HTTPAddrEnvName,
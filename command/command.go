@@ -16,14 +16,20 @@ package command
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
 	"syscall"
 
 	consul "github.com/hashicorp/consul/api"
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/api"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/query"
 	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/ratelog"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
 	"golang.org/x/xerrors"
 )
 
@@ -31,7 +37,10 @@ import (
 // called directly within os.Exit() in your main.main()
 // function.
 func Run() int { // nolint: gocyclo, funlen
-	logger := hclog.Default()
+	logger := ratelog.New(hclog.Default(), ratelog.DefaultWindow, nil)
+	logger.Info("Starting Go Elasticsearch Alerts", "version", version.Version,
+		"commit", version.Commit, "built", version.Date, "go", runtime.Version())
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -43,35 +52,118 @@ func Run() int { // nolint: gocyclo, funlen
 		logger.Error("Error loading main configuration file", "error", err)
 		return 1
 	}
+	if err = cfg.CheckTLS(logger, cfg.Rules); err != nil {
+		logger.Error("Refusing to start with insecure TLS settings", "error", err)
+		return 1
+	}
 
-	esClient, err := cfg.NewESClient()
+	esClient, err := newESClient(cfg, logger)
 	if err != nil {
 		logger.Error("Error creating new Elasticsearch HTTP client", "error", err)
 		return 1
 	}
 
-	qhs, err := buildQueryHandlers(cfg.Rules, cfg.Elasticsearch.Server.ElasticsearchURL, esClient, logger)
+	opts := &alert.FactoryOptions{
+		Client: logRequests(cfg.NewHTTPClient(), "outputs"),
+		Logger: logger,
+	}
+
+	var errorOutput *alert.ErrorOutput
+	if cfg.ErrorOutput != nil {
+		if errorOutput, err = newErrorOutput(cfg.ErrorOutput, opts, logger.Named("error_output")); err != nil {
+			logger.Error("Error creating error output", "error", err)
+			return 1
+		}
+	}
+
+	qhs, err := buildQueryHandlers(cfg.Rules, cfg.Elasticsearch, cfg.State, cfg.MaintenanceWindows, cfg.IndexPolicy(),
+		esClient, opts, errorOutput, logger)
 	if err != nil {
 		logger.Error("Error creating query handlers from rules", "error", err)
 		return 1
 	}
 
+	if cfg.StartupCheck || cfg.StrictStartup {
+		if err = checkConnections(ctx, cfg.Rules, qhs, logger); err != nil && cfg.StrictStartup {
+			logger.Error("Exiting because 'strict_startup' is set", "error", err)
+			return 1
+		}
+	}
+
+	var spool *alert.Spool
+	if cfg.Spool != nil {
+		spool, err = alert.NewSpool(&alert.SpoolConfig{
+			Dir:           cfg.Spool.Dir,
+			MaxAge:        cfg.Spool.MaxAge,
+			RetryInterval: cfg.Spool.RetryInterval,
+			Logger:        logger.Named("spool"),
+		})
+		if err != nil {
+			logger.Error("Error creating alert spool", "error", err)
+			return 1
+		}
+		spool.SetMethods(ruleOutputs(qhs))
+	}
+
+	handlerConfig := &alert.HandlerConfig{
+		Logger:      logger.Named("alert_handler"),
+		Spool:       spool,
+		ErrorOutput: errorOutput,
+	}
+	var retryQueue *query.RetryQueue
+	if cfg.RetryQueue != nil {
+		if retryQueue, err = newRetryQueue(cfg, esClient, logger); err != nil {
+			logger.Error("Error creating retry queue", "error", err)
+			return 1
+		}
+		retryQueue.SetMethods(ruleOutputs(qhs))
+		handlerConfig.RetryQueue = retryQueue
+	}
+
 	controller, err := newController(&controllerConfig{
 		queryHandlers: qhs,
-		alertHandler: alert.NewHandler(&alert.HandlerConfig{
-			Logger: logger.Named("alert_handler"),
-		}),
+		alertHandler:  alert.NewHandler(handlerConfig),
 	})
 	if err != nil {
 		logger.Error("Error creating new controller", "error", err)
 		return 1
 	}
 
+	var apiServer *api.Server
+	if cfg.API != nil && cfg.API.Enabled {
+		apiServer, err = api.NewServer(&api.Config{
+			Address:    cfg.API.Address,
+			Token:      cfg.API.Token,
+			TLSCert:    cfg.API.TLSCert,
+			TLSKey:     cfg.API.TLSKey,
+			ClientCA:   cfg.API.ClientCA,
+			AllowRun:   cfg.API.AllowRun,
+			AllowPause: cfg.API.AllowPause,
+			Rules:      controller.handlers,
+			Logger:     logger.Named("api"),
+		})
+		if err != nil {
+			logger.Error("Error creating API server", "error", err)
+			return 1
+		}
+	}
+
 	syncDoneCh := make(chan struct{})
 	syncErrCh := make(chan error)
-	if cfg.Distributed {
+	switch {
+	case cfg.Distributed && cfg.Lock.Backend == config.LockBackendElasticsearch:
+		var lease *query.Lease
+		if lease, err = newLease(cfg, esClient, logger); err != nil {
+			logger.Error("Error creating Elasticsearch lease", "error", err)
+			return 1
+		}
+		go func() {
+			defer close(syncDoneCh)
+			lease.Run(ctx, controller.distLock)
+		}()
+	case cfg.Distributed:
 		go handleDistOp(ctx, cfg.Consul, logger, controller, syncErrCh, syncDoneCh)
-	} else {
+	default:
 		close(syncDoneCh)
 		controller.distLock.Set(true)
 	}
@@ -86,6 +178,34 @@ func Run() int { // nolint: gocyclo, funlen
 
 	go controller.run(ctx)
 
+	if spool != nil {
+		go spool.Run(ctx)
+	}
+
+	if retryQueue != nil {
+		if err = retryQueue.CreateIndex(ctx); err != nil {
+			logger.Error(fmt.Sprintf("Error creating retry index %q", retryQueue.IndexName()), "error", err)
+		}
+		go retryQueue.Run(ctx)
+	}
+
+	if cfg.Heartbeat != nil {
+		var heartbeat *alert.Heartbeat
+		if heartbeat, err = newHeartbeat(cfg.Heartbeat, qh, controller, opts, logger.Named("heartbeat")); err != nil {
+			logger.Error("Error creating heartbeat", "error", err)
+			return 1
+		}
+		go heartbeat.Run(ctx)
+	}
+
+	if apiServer != nil {
+		go func() {
+			if apiErr := apiServer.Run(ctx); apiErr != nil {
+				logger.Error("Error running API server", "error", apiErr)
+			}
+		}()
+	}
+
 	defer func() {
 		<-syncDoneCh
 		close(syncErrCh)
@@ -107,18 +227,35 @@ func Run() int { // nolint: gocyclo, funlen
 			return 0
 		case <-reloadCh:
 			logger.Info("SIGHUP received. Updating rules.")
-			rules, err := config.ParseRules()
+			rules, err := config.ParseRules(cfg.Fragments, cfg.Outputs)
 			if err != nil {
 				logger.Error("Error parsing rules. Exiting", "error", err)
 				cancel()
 				return 1
 			}
-			qhs, err := buildQueryHandlers(rules, cfg.Elasticsearch.Server.ElasticsearchURL, esClient, logger)
+			if err = cfg.CheckTLS(logger, rules); err != nil {
+				logger.Error("Refusing to run rules with insecure TLS settings. Exiting", "error", err)
+				cancel()
+				return 1
+			}
+			if err = cfg.IndexPolicy().ValidateRules(rules); err != nil {
+				logger.Error("Error validating the indices of the rules. Exiting", "error", err)
+				cancel()
+				return 1
+			}
+			qhs, err := buildQueryHandlers(rules, cfg.Elasticsearch, cfg.State, cfg.MaintenanceWindows, cfg.IndexPolicy(),
+				esClient, opts, errorOutput, logger)
 			if err != nil {
 				logger.Error("Error creating query handlers from rules. Exiting", "error", err)
 				cancel()
 				return 1
 			}
+			if spool != nil {
+				spool.SetMethods(ruleOutputs(qhs))
+			}
+			if retryQueue != nil {
+				retryQueue.SetMethods(ruleOutputs(qhs))
+			}
 			controller.updateHandlersCh <- qhs
 		}
 	}
@@ -171,6 +308,86 @@ func handleDistOp(
 	}
 }
 
+// newLease creates the lease used to elect the leader when the
+// 'lock.backend' is "elasticsearch". Unless 'lock.holder' is set,
+// the process is identified by its host name and process ID.
+func newLease(cfg *config.Config, esClient *http.Client, logger hclog.Logger) (*query.Lease, error) {
+	holder := cfg.Lock.Holder
+	if holder == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, xerrors.Errorf("error getting host name: %v", err)
+		}
+		holder = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	var (
+		userAgent string
+		headers   map[string]string
+	)
+	if cc := cfg.Elasticsearch.Client; cc != nil {
+		userAgent = cc.UserAgent
+		headers = cc.Headers
+	}
+	return query.NewLease(&query.LeaseConfig{
+		Client:    esClient,
+		ESUrl:     cfg.Elasticsearch.Server.BaseURL(),
+		UserAgent: userAgent,
+		Headers:   headers,
+		Holder:    holder,
+		TTL:       cfg.Lock.TTL,
+		Logger:    logger.Named("lease"),
+	})
+}
+
+func newRetryQueue(cfg *config.Config, esClient *http.Client, logger hclog.Logger) (*query.RetryQueue, error) {
+	var (
+		userAgent string
+		headers   map[string]string
+	)
+	if cc := cfg.Elasticsearch.Client; cc != nil {
+		userAgent = cc.UserAgent
+		headers = cc.Headers
+	}
+	return query.NewRetryQueue(&query.RetryQueueConfig{
+		Client:        esClient,
+		ESUrl:         cfg.Elasticsearch.Server.BaseURL(),
+		UserAgent:     userAgent,
+		Headers:       headers,
+		MaxAttempts:   cfg.RetryQueue.MaxAttempts,
+		RetryInterval: cfg.RetryQueue.RetryInterval,
+		Logger:        logger.Named("retry_queue"),
+	})
+}
+
+// newHeartbeat creates the heartbeat which checks that Elasticsearch
+// is reachable using the query handler. Only the instance which
+// holds the distributed lock sends the heartbeats.
+func newHeartbeat(
+	hc *config.HeartbeatConfig,
+	qh *query.QueryHandler,
+	ctrl *controller,
+	opts *alert.FactoryOptions,
+	logger hclog.Logger,
+) (*alert.Heartbeat, error) {
+	method, err := buildMethod(*hc.Output, opts)
+	if err != nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		logger.Warn("Error getting hostname", "error", err)
+	}
+	return alert.NewHeartbeat(&alert.HeartbeatConfig{
+		Method:   method,
+		Interval: hc.Interval,
+		Check:    qh.Ping,
+		Active:   ctrl.distLock.Acquired,
+		Host:     host,
+		Logger:   logger,
+	})
+}
+
 func newConsulLock(cfg config.ConsulConfig) (*consul.Lock, error) {
 	client, err := newConsulClient(cfg)
 	if err != nil {
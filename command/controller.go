@@ -35,7 +35,11 @@ type controller struct {
 	distLock         *lock.Lock
 	queryHandlerWG   *sync.WaitGroup
 	alertHandler     *alert.Handler
-	queryHandlers    []*query.QueryHandler
+
+	// mu guards queryHandlers, which are replaced when the rules
+	// are reloaded
+	mu            sync.RWMutex
+	queryHandlers []*query.QueryHandler
 }
 
 func newController(config *controllerConfig) (*controller, error) {
@@ -70,12 +74,22 @@ func (ctrl *controller) run(ctx context.Context) {
 			return
 		case qhs := <-ctrl.updateHandlersCh:
 			ctrl.stopQueryHandlers()
+			keepPaused(ctrl.queryHandlers, qhs)
+			ctrl.mu.Lock()
 			ctrl.queryHandlers = qhs
+			ctrl.mu.Unlock()
 			ctrl.startQueryHandlers(ctx)
 		}
 	}
 }
 
+// handlers returns the query handlers currently being run.
+func (ctrl *controller) handlers() []*query.QueryHandler {
+	ctrl.mu.RLock()
+	defer ctrl.mu.RUnlock()
+	return ctrl.queryHandlers
+}
+
 func (ctrl *controller) startAlertHandler(ctx context.Context) {
 	go ctrl.alertHandler.Run(ctx, ctrl.outputCh)
 }
@@ -87,6 +101,22 @@ func (ctrl *controller) startQueryHandlers(ctx context.Context) {
 	}
 }
 
+// keepPaused pauses the reloaded query handlers of the rules which
+// were paused before the rules were reloaded.
+func keepPaused(old, reloaded []*query.QueryHandler) {
+	paused := make(map[string]bool, len(old))
+	for _, qh := range old {
+		if qh.Paused() {
+			paused[qh.Name()] = true
+		}
+	}
+	for _, qh := range reloaded {
+		if paused[qh.Name()] {
+			qh.Pause()
+		}
+	}
+}
+
 func (ctrl *controller) stopQueryHandlers() {
 	for _, qh := range ctrl.queryHandlers {
 		qh.StopCh <- struct{}{}
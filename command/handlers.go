@@ -17,12 +17,15 @@ import (
 	"net/http"
 
 	hclog "github.com/hashicorp/go-hclog"
-	"github.com/mitchellh/mapstructure"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
-	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/email"
-	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
-	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/slack"
-	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/sns"
+	// Register the built-in output methods
+	_ "github.com/morningconsult/go-elasticsearch-alerts/command/alert/alertmanager"
+	_ "github.com/morningconsult/go-elasticsearch-alerts/command/alert/email"
+	_ "github.com/morningconsult/go-elasticsearch-alerts/command/alert/eventbridge"
+	_ "github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	_ "github.com/morningconsult/go-elasticsearch-alerts/command/alert/googlechat"
+	_ "github.com/morningconsult/go-elasticsearch-alerts/command/alert/slack"
+	_ "github.com/morningconsult/go-elasticsearch-alerts/command/alert/sns"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/query"
 	"github.com/morningconsult/go-elasticsearch-alerts/config"
 	"golang.org/x/xerrors"
@@ -30,8 +33,13 @@ import (
 
 func buildQueryHandlers(
 	rules []config.RuleConfig,
-	esURL string,
+	esConfig *config.ESConfig,
+	stateConfig *config.StateConfig,
+	windows []config.MaintenanceWindowConfig,
+	policy *config.IndexPolicy,
 	esClient *http.Client,
+	opts *alert.FactoryOptions,
+	errorOutput *alert.ErrorOutput,
 	logger hclog.Logger,
 ) ([]*query.QueryHandler, error) {
 	if len(rules) < 1 {
@@ -43,32 +51,150 @@ func buildQueryHandlers(
 	if esClient == nil {
 		return nil, xerrors.New("no HTTP client provided")
 	}
-	if esURL == "" {
+	if esConfig == nil || esConfig.Server == nil || esConfig.Server.ElasticsearchURL == "" {
 		return nil, xerrors.New("no URL provided")
 	}
 
+	var (
+		userAgent   string
+		headers     map[string]string
+		sourceParam bool
+	)
+	if esConfig.Client != nil {
+		userAgent = esConfig.Client.UserAgent
+		headers = esConfig.Client.Headers
+		sourceParam = esConfig.Client.SourceParam
+	}
+
+	if stateConfig == nil {
+		stateConfig = &config.StateConfig{}
+	}
+
+	var retry *query.Retry
+	if rc := esConfig.Retry; rc != nil && rc.MaxRetries > 0 {
+		retry = &query.Retry{
+			MaxRetries:     rc.MaxRetries,
+			InitialBackoff: rc.InitialBackoff,
+			MaxBackoff:     rc.MaxBackoff,
+		}
+	}
+
+	var batcher *query.Batcher
+	if mc := esConfig.MSearch; mc != nil && mc.Enabled {
+		batcher = query.NewBatcher(&query.BatcherConfig{
+			Window:   mc.Window,
+			Compress: mc.Compress,
+		})
+	}
+
 	queryHandlers := make([]*query.QueryHandler, 0, len(rules))
 	for _, rule := range rules {
-		var methods []alert.Method
-		for _, output := range rule.Outputs {
-			method, err := buildMethod(output)
-			if err != nil {
-				return nil, xerrors.Errorf("error creating alert.AlertMethod: %v", err)
+		methods, err := buildMethods(rule.Outputs, opts)
+		if err != nil {
+			return nil, err
+		}
+		evaluations := make([]query.Evaluation, 0, len(rule.Evaluations))
+		for _, e := range rule.Evaluations {
+			var evaluationMethods []alert.Method
+			if evaluationMethods, err = buildMethods(e.Outputs, opts); err != nil {
+				return nil, err
+			}
+			evaluations = append(evaluations, query.Evaluation{
+				Name:          e.Name,
+				Conditions:    e.Conditions,
+				Expression:    e.Expression,
+				Values:        e.Values,
+				AlertMethods:  evaluationMethods,
+				DedupKeyField: e.DedupKeyField,
+			})
+		}
+		subQueries := make([]query.SubQuery, 0, len(rule.SubQueries))
+		for _, sq := range rule.SubQueries {
+			subQueries = append(subQueries, query.SubQuery{
+				Name:    sq.Name,
+				Index:   sq.ElasticsearchIndex,
+				Body:    sq.ElasticsearchBody,
+				Filters: sq.Filters,
+			})
+		}
+		var composite *query.Composite
+		if rule.Composite != nil {
+			composite = &query.Composite{
+				Aggregation: rule.Composite.Aggregation,
+				MaxBuckets:  rule.Composite.MaxBuckets,
+			}
+		}
+		var sendQueue config.SendQueueConfig
+		if rule.SendQueue != nil {
+			sendQueue = *rule.SendQueue
+		}
+		var async *query.Async
+		if rule.Async {
+			async = &query.Async{MaxWait: rule.AsyncMaxWait}
+		}
+		var sql *query.SQL
+		if rule.SQL != nil {
+			sql = &query.SQL{
+				Query:     rule.SQL.Query,
+				FetchSize: rule.SQL.FetchSize,
+				MaxRows:   rule.SQL.MaxRows,
 			}
-			methods = append(methods, method)
 		}
 		handler, err := query.NewQueryHandler(&query.QueryHandlerConfig{
-			Name:         rule.Name,
-			Logger:       logger,
-			AlertMethods: methods,
-			Client:       esClient,
-			ESUrl:        esURL,
-			QueryData:    rule.ElasticsearchBody,
-			QueryIndex:   rule.ElasticsearchIndex,
-			Schedule:     rule.CronSchedule,
-			BodyField:    rule.BodyField,
-			Filters:      rule.Filters,
-			Conditions:   rule.Conditions,
+			Name:               rule.Name,
+			Logger:             logger,
+			AlertMethods:       methods,
+			Client:             esClient,
+			ESUrl:              esConfig.Server.BaseURL(),
+			QueryData:          rule.ElasticsearchBody,
+			QueryIndex:         rule.ElasticsearchIndex,
+			Schedule:           rule.CronSchedule,
+			BodyField:          rule.BodyField,
+			Filters:            rule.Filters,
+			ValueField:         rule.ValueField,
+			ValueFormat:        rule.ValueFormat,
+			ValueUnit:          rule.ValueUnit,
+			ValueThreshold:     rule.ValueThreshold,
+			Conditions:         rule.Conditions,
+			Expression:         rule.Expression,
+			MinSeverity:        rule.MinSeverity,
+			Redaction:          rule.Redaction,
+			Values:             rule.Values,
+			Evaluations:        evaluations,
+			UserAgent:          userAgent,
+			Headers:            headers,
+			SourceParam:        sourceParam,
+			AlertCooldown:      rule.AlertCooldown,
+			ReminderInterval:   rule.ReminderInterval,
+			IncludeAlertID:     rule.IncludeAlertID,
+			CollapseIdentical:  rule.CollapseIdentical,
+			DedupKeyField:      rule.DedupKeyField,
+			DisableDedup:       rule.DisableDedup,
+			MinMatches:         rule.MinMatches,
+			SlowQueryThreshold: rule.SlowQueryThreshold,
+			SubQueries:         subQueries,
+			Batcher:            batcher,
+			FirstRun:           rule.FirstRun,
+			CountOnly:          rule.CountOnly,
+			Composite:          composite,
+			SQL:                sql,
+			Async:              async,
+			QueryTimeout:       rule.QueryTimeout,
+			Retry:              retry,
+			QueryDelay:         rule.QueryDelay,
+			MaxRuntime:         rule.MaxRuntime,
+			QueryParams:        rule.QueryParams,
+			RequireAllOutputs:  rule.RequireAllOutputs,
+			OutputConcurrency:  rule.OutputConcurrency,
+			ErrorOutput:        errorOutput,
+			MaintenanceWindows: ruleWindows(rule, windows),
+			IndexPolicy:        policy,
+			SendQueueSize:      sendQueue.Size,
+			SendQueuePolicy:    sendQueue.Policy,
+
+			StateRetention:       stateConfig.Retention,
+			StateCleanupInterval: stateConfig.CleanupInterval,
+			StateILMPolicy:       stateConfig.ILMPolicy,
 		})
 		if err != nil {
 			return nil, xerrors.Errorf("error creating new *query.QueryHandler: %v", err)
@@ -78,40 +204,75 @@ func buildQueryHandlers(
 	return queryHandlers, nil
 }
 
-func buildMethod(output config.OutputConfig) (alert.Method, error) {
-	var method alert.Method
-	var err error
-
-	switch output.Type {
-	case "slack":
-		slackConfig := new(slack.AlertMethodConfig)
-		if err = mapstructure.Decode(output.Config, slackConfig); err != nil {
-			return nil, xerrors.Errorf("error decoding Slack output configuration: %v", err)
-		}
-		method, err = slack.NewAlertMethod(slackConfig)
-	case "file":
-		fileConfig := new(file.AlertMethodConfig)
-		if err = mapstructure.Decode(output.Config, fileConfig); err != nil {
-			return nil, xerrors.Errorf("error decoding file output configuration: %v", err)
+// ruleWindows returns the maintenance windows of the main
+// configuration file which apply to the rule followed by those of
+// the rule itself.
+func ruleWindows(rule config.RuleConfig, windows []config.MaintenanceWindowConfig) []*config.MaintenanceWindow {
+	var applied []*config.MaintenanceWindow
+	for _, w := range windows {
+		if w.AppliesTo(rule.Name) {
+			applied = append(applied, w.Window)
 		}
-		method, err = file.NewAlertMethod(fileConfig)
-	case "email":
-		emailConfig := new(email.AlertMethodConfig)
-		if err = mapstructure.Decode(output.Config, emailConfig); err != nil {
-			return nil, xerrors.Errorf("error decoding email output configuration: %v", err)
+	}
+	for _, w := range rule.MaintenanceWindows {
+		applied = append(applied, w.Window)
+	}
+	return applied
+}
+
+// ruleOutputs returns the outputs of each of the query handlers, and
+// of each of their evaluations, by the name of its rule.
+func ruleOutputs(qhs []*query.QueryHandler) map[string][]alert.Method {
+	outputs := make(map[string][]alert.Method, len(qhs))
+	for _, qh := range qhs {
+		outputs[qh.Name()] = qh.Outputs()
+		for _, eq := range qh.Evaluations() {
+			outputs[eq.Name()] = eq.Outputs()
 		}
-		method, err = email.NewAlertMethod(emailConfig)
-	case "sns":
-		snsConfig := new(sns.AlertMethodConfig)
-		if err = mapstructure.Decode(output.Config, snsConfig); err != nil {
-			return nil, xerrors.Errorf("error decoding SNS output configuration: %v", err)
+	}
+	return outputs
+}
+
+func buildMethods(outputs []config.OutputConfig, opts *alert.FactoryOptions) ([]alert.Method, error) {
+	methods := make([]alert.Method, 0, len(outputs))
+	for _, output := range outputs {
+		method, err := buildMethod(output, opts)
+		if err != nil {
+			return nil, xerrors.Errorf("error creating alert.AlertMethod: %v", err)
 		}
-		method, err = sns.NewAlertMethod(snsConfig)
-	default:
-		return nil, xerrors.Errorf("output type %q is not supported", output.Type)
+		methods = append(methods, method)
 	}
+	return methods, nil
+}
+
+// newErrorOutput creates the output to which the failures of the
+// rules are sent.
+func newErrorOutput(
+	ec *config.ErrorOutputConfig,
+	opts *alert.FactoryOptions,
+	logger hclog.Logger,
+) (*alert.ErrorOutput, error) {
+	method, err := buildMethod(*ec.Output, opts)
+	if err != nil {
+		return nil, err
+	}
+	return alert.NewErrorOutput(&alert.ErrorOutputConfig{
+		Method:   method,
+		Interval: ec.Interval,
+		Logger:   logger,
+	})
+}
+
+func buildMethod(output config.OutputConfig, opts *alert.FactoryOptions) (alert.Method, error) {
+	method, err := alert.New(output.Type, output.Config, opts)
 	if err != nil {
 		return nil, xerrors.Errorf("error creating new %s output method: %v", output.Type, err)
 	}
+	if output.Match != nil {
+		method = alert.Route(method, alert.MatchExpression(output.Match))
+	}
+	if !output.IsEnabled() {
+		return alert.Disable(method), nil
+	}
 	return method, nil
 }
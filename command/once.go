@@ -0,0 +1,137 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/query"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+// onceConcurrency is the maximum number of rules RunOnce
+// executes at a time.
+const onceConcurrency = 4
+
+// RunOnce executes each rule a single time, sends any alerts, and
+// exits. It returns a non-zero status if any rule failed to run or
+// to send its alert. If maintainState is false, the state indices
+// are neither read nor written. This function should be called
+// directly within os.Exit() in your main.main() function.
+func RunOnce(maintainState bool) int {
+	logger := hclog.Default()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownCh := makeShutdownCh()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-shutdownCh:
+			logger.Info("Received shutdown signal, canceling queries")
+			cancel()
+		}
+	}()
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		logger.Error("Error loading main configuration file", "error", err)
+		return 1
+	}
+	if err = cfg.CheckTLS(logger, cfg.Rules); err != nil {
+		logger.Error("Refusing to run with insecure TLS settings", "error", err)
+		return 1
+	}
+
+	esClient, err := newESClient(cfg, logger)
+	if err != nil {
+		logger.Error("Error creating new Elasticsearch HTTP client", "error", err)
+		return 1
+	}
+
+	opts := &alert.FactoryOptions{
+		Client: logRequests(cfg.NewHTTPClient(), "outputs"),
+		Logger: logger,
+	}
+
+	qhs, err := buildQueryHandlers(cfg.Rules, cfg.Elasticsearch, cfg.State, cfg.MaintenanceWindows, cfg.IndexPolicy(),
+		esClient, opts, nil, logger)
+	if err != nil {
+		logger.Error("Error creating query handlers from rules", "error", err)
+		return 1
+	}
+
+	if maintainState {
+		if err = qhs[0].PutTemplate(ctx); err != nil {
+			logger.Error(fmt.Sprintf("Error creating template %q", qhs[0].StateAliasURL()), "error", err)
+			return 1
+		}
+	}
+
+	alertHandler := alert.NewHandler(&alert.HandlerConfig{
+		Logger: logger.Named("alert_handler"),
+	})
+
+	names := make([]string, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		names = append(names, rule.Name)
+	}
+
+	if failed := runOnce(ctx, names, qhs, alertHandler, maintainState, logger); failed > 0 {
+		logger.Error(fmt.Sprintf("%d of %d rules failed", failed, len(qhs)))
+		return 1
+	}
+	return 0
+}
+
+// runOnce runs the query handlers concurrently, at most
+// onceConcurrency at a time, and returns how many failed. The
+// names are those of the rules of the query handlers.
+func runOnce(
+	ctx context.Context,
+	names []string,
+	qhs []*query.QueryHandler,
+	alertHandler *alert.Handler,
+	maintainState bool,
+	logger hclog.Logger,
+) int {
+	var (
+		failed int32
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, onceConcurrency)
+	)
+	for i, qh := range qhs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string, qh *query.QueryHandler) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := qh.RunOnce(ctx, maintainState, alertHandler.Send); err != nil {
+				logger.Error(fmt.Sprintf("Error running rule %q", name), "error", err)
+				atomic.AddInt32(&failed, 1)
+			}
+		}(names[i], qh)
+	}
+	wg.Wait()
+	return int(failed)
+}
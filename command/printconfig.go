@@ -0,0 +1,45 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+// RunPrintConfig loads the main configuration file and the rules and
+// prints the effective configuration, with its secrets redacted, to
+// stdout. No connection is made to Elasticsearch or to any output.
+// This function should be called directly within os.Exit() in your
+// main.main() function.
+func RunPrintConfig() int {
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+
+	data, err := cfg.Redacted()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error printing configuration: %v\n", err)
+		return 1
+	}
+	if _, err = os.Stdout.Write(data); err != nil {
+		fmt.Fprintf(os.Stderr, "Error printing configuration: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultAsyncMaxWait is the maximum amount of time to wait for
+	// an asynchronous query to complete if Async.MaxWait is zero
+	defaultAsyncMaxWait = 10 * time.Minute
+
+	// asyncPollTimeout is how long each request for the results of
+	// an asynchronous query waits for it to complete before
+	// returning that it is still running
+	asyncPollTimeout = 5 * time.Second
+
+	// asyncDeleteTimeout bounds the request deleting the results of
+	// an asynchronous query, which is sent even if the query itself
+	// was canceled
+	asyncDeleteTimeout = 10 * time.Second
+)
+
+// Async configures the submission of the query to the _async_search
+// API, whose results are polled until it completes, rather than
+// waiting for them in a single request.
+type Async struct {
+	// MaxWait is the maximum amount of time to wait for the query
+	// to complete. If zero, defaultAsyncMaxWait is used
+	MaxWait time.Duration
+}
+
+// queryAsync submits the query to the _async_search API and polls
+// its results until it is no longer running, then deletes them from
+// Elasticsearch. It returns the response to the search, which may
+// be partial if some shards failed, so that it can be processed
+// like that of any other query. It returns a non-nil error if the
+// query fails or does not complete within q.async.MaxWait.
+func (q *QueryHandler) queryAsync(ctx context.Context) (map[string]interface{}, error) {
+	if err := q.indexPolicy.Check(q.queryIndex); err != nil {
+		return nil, xerrors.Errorf("refusing to query index: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, q.async.MaxWait)
+	defer cancel()
+
+	body := q.windowBody(q.queryData)
+	payload := bytes.Buffer{}
+	if err := json.NewEncoder(&payload).Encode(&body); err != nil {
+		return nil, xerrors.Errorf("error JSON-encoding Elasticsearch query body: %v", err)
+	}
+
+	// The results are kept a little longer than the query may run
+	// in case deleting them fails
+	params := q.searchParams("_async_search")
+	params.Set("wait_for_completion_timeout", esSeconds(asyncPollTimeout))
+	params.Set("keep_alive", esSeconds(q.async.MaxWait+time.Minute))
+	u := fmt.Sprintf("%s/%s/_async_search?%s", q.esURL, escapeIndex(q.queryIndex), params.Encode())
+	data, err := q.asyncRequest(ctx, http.MethodPost, u, payload.Bytes())
+	if err != nil {
+		return nil, q.asyncError(ctx, "submitting", err)
+	}
+
+	id, _ := data["id"].(string)
+	if id != "" {
+		defer q.deleteAsyncSearch(id)
+	}
+	for polls := 1; isRunning(data); polls++ {
+		if id == "" {
+			return nil, xerrors.New("async search is still running but has no ID")
+		}
+		q.logger.Debug(fmt.Sprintf("[Rule: %q] waiting for async search to complete", q.name), "polls", polls)
+		u = fmt.Sprintf("%s/_async_search/%s?wait_for_completion_timeout=%s",
+			q.esURL, url.PathEscape(id), esSeconds(asyncPollTimeout))
+		if data, err = q.asyncRequest(ctx, http.MethodGet, u, nil); err != nil {
+			return nil, q.asyncError(ctx, "polling", err)
+		}
+	}
+	return q.asyncResponse(data)
+}
+
+// asyncError returns the error of a request made while doing the
+// given thing with an asynchronous query, noting if it failed
+// because the query did not complete within q.async.MaxWait.
+func (q *QueryHandler) asyncError(ctx context.Context, doing string, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return xerrors.Errorf("async search did not complete within %s: %v", q.async.MaxWait, err)
+	}
+	return xerrors.Errorf("error %s async search: %v", doing, err)
+}
+
+// isRunning returns whether the response of the _async_search API
+// reports that the query is still running.
+func isRunning(data map[string]interface{}) bool {
+	running, _ := data["is_running"].(bool)
+	return running
+}
+
+// asyncResponse returns the response to the search of a completed
+// asynchronous query, warning if it is partial.
+func (q *QueryHandler) asyncResponse(data map[string]interface{}) (map[string]interface{}, error) {
+	if errData, ok := data["error"]; ok {
+		return nil, xerrors.Errorf("async search failed: %v", errData)
+	}
+	response, ok := data["response"].(map[string]interface{})
+	if !ok {
+		return nil, xerrors.New("async search completed without a response")
+	}
+	if partial, _ := data["is_partial"].(bool); partial {
+		args := []interface{}{}
+		if shards, ok := response["_shards"].(map[string]interface{}); ok {
+			args = append(args, "failed_shards", fmt.Sprint(shards["failed"]), "total_shards", fmt.Sprint(shards["total"]))
+		}
+		q.logger.Warn(fmt.Sprintf("[Rule: %q] async search returned partial results", q.name), args...)
+	}
+	return response, nil
+}
+
+// deleteAsyncSearch deletes the results of the asynchronous query
+// with the given ID from Elasticsearch. Errors are only logged since
+// the results expire on their own eventually.
+func (q *QueryHandler) deleteAsyncSearch(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), asyncDeleteTimeout)
+	defer cancel()
+
+	u := fmt.Sprintf("%s/_async_search/%s", q.esURL, url.PathEscape(id))
+	resp, err := q.makeRequest(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		q.logger.Warn(fmt.Sprintf("[Rule: %q] error deleting async search", q.name), "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// The results of a query which completed before the first
+	// response are not kept in the first place
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		q.logger.Warn(fmt.Sprintf("[Rule: %q] error deleting async search", q.name),
+			"status", resp.Status, "response", q.readErrRespBody(resp))
+	}
+}
+
+// asyncRequest sends a request with the body, if not nil, to the
+// given URL of the _async_search API and returns the JSON-decoded
+// response.
+func (q *QueryHandler) asyncRequest(
+	ctx context.Context,
+	method, u string,
+	body []byte,
+) (map[string]interface{}, error) {
+	resp, err := q.doWithRetry(ctx, func() (*http.Request, error) {
+		var data io.Reader
+		if body != nil {
+			data = bytes.NewReader(body)
+		}
+		req, err := q.newRequest(ctx, method, u, data)
+		if err != nil {
+			return nil, xerrors.Errorf("error creating new request: %v", err)
+		}
+		req.Header.Set(ruleHeader, q.name)
+		return req, nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, xerrors.Errorf("received non-200 response status (status: %q). Response body:\n%s",
+			resp.Status, q.readErrRespBody(resp))
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+
+	data := make(map[string]interface{})
+	if err := dec.Decode(&data); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding Elasticsearch response: %v", err)
+	}
+	return data, nil
+}
+
+// esSeconds formats d as an Elasticsearch time value in whole
+// seconds, rounded up.
+func esSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10) + "s"
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+)
+
+func TestQueryAsync(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "async_search.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stages map[string]json.RawMessage
+	if err = json.Unmarshal(data, &stages); err != nil {
+		t.Fatal(err)
+	}
+	const id = "FmRldE8zREVEUzA2ZVpUeGs2ejJFUFEaMkZ5QTVrSTZSaVN3WlNFVmtlWHJsdzoxMDc="
+
+	// "hang" stands for a poll which outlasts the maximum wait
+	cases := []struct {
+		name     string
+		stages   []string
+		maxWait  time.Duration
+		requests []string
+		fields   []*alert.Field
+		err      string
+	}{
+		{
+			"lifecycle",
+			[]string{"submit", "running", "complete"},
+			0,
+			[]string{
+				"POST /test-index/_async_search",
+				"GET /_async_search/" + id,
+				"GET /_async_search/" + id,
+				"DELETE /_async_search/" + id,
+			},
+			[]*alert.Field{{Key: "api-1", Count: 12}, {Key: "api-2", Count: 7}},
+			"",
+		},
+		{
+			"immediate",
+			[]string{"immediate"},
+			0,
+			[]string{"POST /test-index/_async_search"},
+			[]*alert.Field{{Key: "api-3", Count: 2}},
+			"",
+		},
+		{
+			"partial",
+			[]string{"submit", "partial"},
+			0,
+			[]string{
+				"POST /test-index/_async_search",
+				"GET /_async_search/" + id,
+				"DELETE /_async_search/" + id,
+			},
+			[]*alert.Field{{Key: "api-1", Count: 11}},
+			"",
+		},
+		{
+			"failed",
+			[]string{"submit", "failed"},
+			0,
+			[]string{
+				"POST /test-index/_async_search",
+				"GET /_async_search/" + id,
+				"DELETE /_async_search/" + id,
+			},
+			nil,
+			"async search failed",
+		},
+		{
+			"max-wait",
+			[]string{"submit", "hang"},
+			200 * time.Millisecond,
+			[]string{
+				"POST /test-index/_async_search",
+				"GET /_async_search/" + id,
+				"DELETE /_async_search/" + id,
+			},
+			nil,
+			"async search did not complete within 200ms",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests []string
+				params   = make(map[string]string)
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				n := len(requests)
+				if n == 1 {
+					params["wait_for_completion_timeout"] = r.URL.Query().Get("wait_for_completion_timeout")
+					params["keep_alive"] = r.URL.Query().Get("keep_alive")
+				}
+				mu.Unlock()
+
+				if r.Method == http.MethodDelete {
+					w.Write([]byte(`{"acknowledged": true}`)) // nolint: errcheck
+					return
+				}
+				if n > len(tc.stages) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if tc.stages[n-1] == "hang" {
+					<-r.Context().Done()
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(stages[tc.stages[n-1]]) // nolint: errcheck
+			}))
+			defer ts.Close()
+
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Async",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-index",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData:    map[string]interface{}{"size": 0},
+				Schedule:     "@every 10m",
+				Filters:      []string{"aggregations.hostname.buckets"},
+				Async:        &Async{MaxWait: tc.maxWait},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := qh.query(context.Background())
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(requests, tc.requests) {
+				t.Fatalf("unexpected requests:\nGot:\n\t%v\nExpected:\n\t%v", requests, tc.requests)
+			}
+			if params["wait_for_completion_timeout"] != "5s" {
+				t.Errorf("unexpected 'wait_for_completion_timeout' (got %q)", params["wait_for_completion_timeout"])
+			}
+			if tc.err != "" {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				if !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error to contain:\n\t%s\nGot:\n\t%v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.maxWait == 0 && params["keep_alive"] != "660s" {
+				t.Errorf("unexpected 'keep_alive' (got %q, expected %q)", params["keep_alive"], "660s")
+			}
+
+			records, _, err := qh.process(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %d", len(records))
+			}
+			if !reflect.DeepEqual(records[0].Fields, tc.fields) {
+				t.Fatalf("unexpected fields:\nGot:\n\t%+v\nExpected:\n\t%+v", records[0].Fields, tc.fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+// maxBacktestRuns is the maximum number of scheduled runs of a rule
+// which may be backtested at once.
+const maxBacktestRuns = 10000
+
+// BacktestRun is the outcome of a single scheduled run of a rule
+// within the time window of a backtest.
+type BacktestRun struct {
+	// Time is when the run would have been scheduled. The time
+	// window of the query ends at this time (less the query delay
+	// of the rule)
+	Time time.Time `json:"time"`
+
+	// Result is the outcome of the run: ResultAlert if an alert
+	// would have been sent, ResultSuppressed if the records would
+	// have been suppressed (e.g. during the cooldown of the rule),
+	// ResultOK if there were no records, or ResultError
+	Result string `json:"result"`
+
+	// Error is the error of the run if it failed
+	Error string `json:"error,omitempty"`
+
+	// Records are the records the run produced
+	Records []*alert.Record `json:"records,omitempty"`
+}
+
+// backtestClock is a clock fixed at the time of a backtested run.
+// Unlike clock.Fake, it really waits, e.g. between retries.
+type backtestClock struct {
+	now time.Time
+}
+
+func (c backtestClock) Now() time.Time {
+	return c.now
+}
+
+func (backtestClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Backtest replays the query at each time it would have been
+// scheduled between since and until (inclusive) as if it were run
+// at that time, anchoring the date math relative to "now" of the
+// query at it, and returns what the rule would have done each time.
+// The records are suppressed as Run would suppress them (except by
+// 'first_run'), but no alerts are sent and the state indices are not
+// used. SQL rules cannot be backtested since their queries are not
+// anchored, nor can rules with evaluations.
+func (q *QueryHandler) Backtest(ctx context.Context, since, until time.Time) ([]*BacktestRun, error) {
+	if q.sql != nil {
+		return nil, xerrors.Errorf("rule %q uses SQL and cannot be backtested", q.name)
+	}
+	if len(q.evaluations) > 0 {
+		return nil, xerrors.Errorf("rule %q has evaluations and cannot be backtested", q.name)
+	}
+	if !since.Before(until) {
+		return nil, xerrors.New("the start of the window must be before its end")
+	}
+
+	var times []time.Time
+	for t := q.schedule.Next(since.Add(-time.Nanosecond)); !t.IsZero() && !t.After(until); t = q.schedule.Next(t) {
+		if len(times) == maxBacktestRuns {
+			return nil, xerrors.Errorf("the window spans more than %d runs of rule %q", maxBacktestRuns, q.name)
+		}
+		times = append(times, t)
+	}
+
+	clk := q.clock
+	defer func() {
+		q.clock = clk
+		q.backtesting = false
+	}()
+	q.backtesting = true
+
+	runs := make([]*BacktestRun, 0, len(times))
+	for _, t := range times {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		q.clock = backtestClock{now: t}
+		runs = append(runs, q.backtestRun(ctx, t))
+	}
+	return runs, nil
+}
+
+// backtestRun executes the query as if it were run at t and decides
+// whether the records would have been sent like Run does.
+func (q *QueryHandler) backtestRun(ctx context.Context, t time.Time) *BacktestRun {
+	run := &BacktestRun{Time: t, Result: ResultOK}
+
+	records, _, err := q.execute(ctx)
+	if err != nil {
+		run.Result, run.Error = ResultError, err.Error()
+		return run
+	}
+	if len(records) == 0 {
+		return run
+	}
+
+	sent, keys, suppressed := q.suppress(records, false, t)
+	if suppressed {
+		run.Result = ResultSuppressed
+		run.Records = q.redact(records)
+		return run
+	}
+
+	run.Result = ResultAlert
+	run.Records = q.redact(sent)
+	q.lastAlert = t
+	q.markDedupKeys(keys, t)
+	return run
+}
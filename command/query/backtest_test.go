@@ -0,0 +1,160 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+)
+
+func TestBacktest(t *testing.T) {
+	// Only the runs at 00:10, 00:20 and 00:40 find any documents
+	firing := map[string]bool{
+		"2020-01-01T00:10:00.000Z||-10m": true,
+		"2020-01-01T00:20:00.000Z||-10m": true,
+		"2020-01-01T00:40:00.000Z||-10m": true,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/test-index/") || strings.Contains(r.URL.Path, "go-es-alerts") {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding query body: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if gte, _ := utils.Get(body, "query.range.@timestamp.gte").(string); firing[gte] {
+			w.Write([]byte(`{"hits": {"hits": [{"_source": {"message": "error"}}]}}`))
+			return
+		}
+		w.Write([]byte(`{"hits": {"hits": []}}`))
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		name       string
+		minMatches int
+		expected   []string
+	}{
+		{
+			"cooldown",
+			0,
+			[]string{ResultOK, ResultAlert, ResultSuppressed, ResultOK, ResultAlert},
+		},
+		{
+			"min-matches",
+			2,
+			[]string{ResultOK, ResultSuppressed, ResultSuppressed, ResultOK, ResultSuppressed},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Backtest",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-index",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"query": map[string]interface{}{
+						"range": map[string]interface{}{
+							"@timestamp": map[string]interface{}{"gte": "now-10m"},
+						},
+					},
+				},
+				Schedule:      "0 */10 * * * *",
+				AlertCooldown: 15 * time.Minute,
+				MinMatches:    tc.minMatches,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			since := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+			runs, err := qh.Backtest(context.Background(), since, since.Add(40*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(runs) != len(tc.expected) {
+				t.Fatalf("unexpected number of runs (got %d, expected %d)", len(runs), len(tc.expected))
+			}
+			for i, run := range runs {
+				if at := since.Add(time.Duration(i) * 10 * time.Minute); !run.Time.Equal(at) {
+					t.Errorf("unexpected time of run %d (got %s, expected %s)", i, run.Time, at)
+				}
+				if run.Result != tc.expected[i] {
+					t.Errorf("unexpected result of run %d (got %q, expected %q)", i, run.Result, tc.expected[i])
+				}
+				if (run.Result == ResultOK) != (len(run.Records) == 0) {
+					t.Errorf("unexpected records of run %d: %+v", i, run.Records)
+				}
+			}
+			if _, fixed := qh.clock.(backtestClock); fixed || qh.backtesting {
+				t.Fatal("the clock of the query handler should be restored after backtesting")
+			}
+		})
+	}
+}
+
+func TestBacktestError(t *testing.T) {
+	since := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name  string
+		sql   *SQL
+		until time.Time
+	}{
+		{"empty-window", nil, since},
+		{"too-many-runs", nil, since.AddDate(1, 0, 0)},
+		{"sql", &SQL{Query: "SELECT 1"}, since.Add(time.Hour)},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Backtest",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        "http://127.0.0.1:9200",
+				QueryIndex:   "test-index",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+				},
+				Schedule: "0 */10 * * * *",
+				SQL:      tc.sql,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = qh.Backtest(context.Background(), since, tc.until); err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+		})
+	}
+}
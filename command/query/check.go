@@ -0,0 +1,53 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"net/http"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+// Ping sends a request to the root endpoint of Elasticsearch in
+// order to verify that it is reachable and that the client is
+// authorized to query it.
+func (q *QueryHandler) Ping(ctx context.Context) error {
+	resp, err := q.makeRequest(ctx, http.MethodGet, q.esURL, nil)
+	if err != nil {
+		return xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return xerrors.Errorf("received non-200 response status (status: %q): Response body:\n%s",
+			resp.Status, q.readErrRespBody(resp))
+	}
+	return nil
+}
+
+// CheckOutputs verifies that each enabled output of the rule is
+// reachable (see alert.Checker). It returns the combined errors of
+// the outputs which could not be reached.
+func (q *QueryHandler) CheckOutputs(ctx context.Context) error {
+	var allErrors *multierror.Error
+	for _, method := range q.Outputs() {
+		if err := alert.Check(ctx, method); err != nil {
+			allErrors = multierror.Append(allErrors, xerrors.Errorf("error checking %s output: %v", method.Name(), err))
+		}
+	}
+	return allErrors.ErrorOrNil()
+}
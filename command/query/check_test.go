@@ -0,0 +1,113 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+// checkMethod is a mock alert.Method which implements alert.Checker.
+type checkMethod struct {
+	err     error
+	checked bool
+}
+
+func (c *checkMethod) Write(context.Context, string, []*alert.Record) error {
+	return nil
+}
+
+func (c *checkMethod) Name() string {
+	return "check"
+}
+
+func (c *checkMethod) Check(context.Context) error {
+	c.checked = true
+	return c.err
+}
+
+func TestPing(t *testing.T) {
+	reqFunc, err := buildHTTPRequestFunc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		status int
+		err    bool
+	}{
+		{"success", 200, false},
+		{"unauthorized", 401, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/" {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer ts.Close()
+
+			qh := &QueryHandler{
+				client:     cleanhttp.DefaultClient(),
+				esURL:      ts.URL,
+				newRequest: reqFunc,
+			}
+
+			err := qh.Ping(context.Background())
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckOutputs(t *testing.T) {
+	ok := &checkMethod{}
+	failed := &checkMethod{err: xerrors.New("test error")}
+	disabled := &checkMethod{err: xerrors.New("test error")}
+
+	qh := &QueryHandler{
+		alertMethods: []alert.Method{ok, failed, alert.Disable(disabled)},
+	}
+
+	if err := qh.CheckOutputs(context.Background()); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if !ok.checked || !failed.checked {
+		t.Fatal("expected the enabled outputs to be checked")
+	}
+	if disabled.checked {
+		t.Fatal("expected the disabled output not to be checked")
+	}
+
+	qh.alertMethods = []alert.Method{ok}
+	if err := qh.CheckOutputs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// lifecycleSettings returns the index settings, to be included in
+// the template of the state indices, which apply q.ilmPolicy to
+// them. It returns an empty string if no policy is configured.
+func (q *QueryHandler) lifecycleSettings() string {
+	if q.ilmPolicy == "" {
+		return ""
+	}
+	name, _ := json.Marshal(q.ilmPolicy) // nolint: errcheck
+	return fmt.Sprintf("\n        \"lifecycle\": {\n          \"name\": %s\n        },", name)
+}
+
+// cleanupDue returns true if expired state documents should be
+// deleted, i.e. if a retention is configured and the last cleanup
+// was at least q.cleanupInterval ago.
+func (q *QueryHandler) cleanupDue(now time.Time) bool {
+	return q.stateRetention > 0 && now.Sub(q.lastCleanup) >= q.cleanupInterval
+}
+
+// stateCutoff returns the time before which the state documents of
+// this rule may be deleted. This is q.stateRetention ago, except
+// that the most recent state document (which is used to restore the
+// schedule after a restart) and the documents written since the
+// last alert while the rule is in cooldown are always kept.
+func (q *QueryHandler) stateCutoff(now time.Time) time.Time {
+	cutoff := now.Add(-q.stateRetention)
+	if !q.lastStateWrite.IsZero() && q.lastStateWrite.Before(cutoff) {
+		cutoff = q.lastStateWrite
+	}
+	if q.inCooldown(now) && q.lastAlert.Before(cutoff) {
+		cutoff = q.lastAlert
+	}
+	return cutoff
+}
+
+// cleanupState deletes the state documents of this rule, and of each
+// of its evaluations, which were created before their stateCutoff().
+func (q *QueryHandler) cleanupState(ctx context.Context, now time.Time) error {
+	cutoff := q.stateCutoff(now)
+	body := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{
+						"term": map[string]interface{}{
+							"rule_name": q.cleanedName(),
+						},
+					},
+					map[string]interface{}{
+						"range": map[string]interface{}{
+							"@timestamp": map[string]interface{}{
+								"lt": cutoff.Format(defaultTimestampFormat),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	payload := bytes.Buffer{}
+	if err := json.NewEncoder(&payload).Encode(&body); err != nil {
+		return xerrors.Errorf("error JSON-encoding payload: %v", err)
+	}
+
+	resp, err := q.makeRequest(ctx, http.MethodPost, q.StateAliasURL()+"/_delete_by_query?conflicts=proceed", &payload)
+	if err != nil {
+		return xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return xerrors.Errorf("received non-200 response status (status: %q). Response body:\n%s",
+			resp.Status, q.readErrRespBody(resp))
+	}
+
+	var data struct {
+		Deleted int `json:"deleted"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return xerrors.Errorf("error JSON-decoding response body: %v", err)
+	}
+
+	q.lastCleanup = now
+	if data.Deleted > 0 {
+		q.logger.Info(fmt.Sprintf("[Rule: %q] deleted expired state documents", q.name),
+			"deleted", data.Deleted, "before", cutoff.Format(time.RFC822))
+	}
+
+	for _, eq := range q.evaluations {
+		if err = eq.cleanupState(ctx, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
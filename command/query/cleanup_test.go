@@ -0,0 +1,226 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+)
+
+type stateDoc struct {
+	rule      string
+	timestamp time.Time
+}
+
+// newStateServer returns a server which emulates the
+// _delete_by_query API over the given state documents.
+func newStateServer(mu *sync.Mutex, docs *[]stateDoc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_delete_by_query") {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule, _ := utils.Get(body, "query.bool.filter[0].term.rule_name").(string)
+		lt, _ := utils.Get(body, "query.bool.filter[1].range.@timestamp.lt").(string)
+		cutoff, err := time.Parse(time.RFC3339, lt)
+		if rule == "" || err != nil {
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		var kept []stateDoc
+		for _, doc := range *docs {
+			if doc.rule != rule || !doc.timestamp.Before(cutoff) {
+				kept = append(kept, doc)
+			}
+		}
+		fmt.Fprintf(w, `{"deleted": %d}`, len(*docs)-len(kept))
+		*docs = kept
+	}))
+}
+
+func TestCleanupState(t *testing.T) {
+	// The fake clock
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	cases := []struct {
+		name      string
+		writes    []time.Duration
+		lastAlert time.Duration
+		cooldown  time.Duration
+		expected  []time.Duration
+	}{
+		{
+			"expired",
+			[]time.Duration{10 * day, 8 * day, 2 * day, time.Hour},
+			0,
+			0,
+			[]time.Duration{2 * day, time.Hour},
+		},
+		{
+			"nothing-expired",
+			[]time.Duration{3 * day, 2 * day, time.Hour},
+			0,
+			0,
+			[]time.Duration{3 * day, 2 * day, time.Hour},
+		},
+		{
+			"keep-latest",
+			[]time.Duration{30 * day, 20 * day},
+			0,
+			0,
+			[]time.Duration{20 * day},
+		},
+		{
+			"keep-cooldown",
+			[]time.Duration{10 * day, 9 * day, 8 * day, time.Hour},
+			9 * day,
+			10 * day,
+			[]time.Duration{9 * day, 8 * day, time.Hour},
+		},
+		{
+			"cooldown-over",
+			[]time.Duration{10 * day, 9 * day, 8 * day, time.Hour},
+			9 * day,
+			time.Hour,
+			[]time.Duration{time.Hour},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mu := new(sync.Mutex)
+			var docs []stateDoc
+			for _, ago := range tc.writes {
+				docs = append(docs, stateDoc{"test-rule", now.Add(-ago)}, stateDoc{"other-rule", now.Add(-ago)})
+			}
+			ts := newStateServer(mu, &docs)
+			defer ts.Close()
+
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Rule",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-*",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"query": "test",
+				},
+				Schedule:       "@every 10m",
+				AlertCooldown:  tc.cooldown,
+				StateRetention: 7 * day,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			qh.lastStateWrite = now.Add(-tc.writes[len(tc.writes)-1])
+			if tc.lastAlert > 0 {
+				qh.lastAlert = now.Add(-tc.lastAlert)
+			}
+
+			if !qh.cleanupDue(now) {
+				t.Fatal("cleanup should be due before the first cleanup")
+			}
+			if err = qh.cleanupState(context.Background(), now); err != nil {
+				t.Fatal(err)
+			}
+			if qh.cleanupDue(now.Add(time.Minute)) {
+				t.Fatal("cleanup should not be due again before the cleanup interval has passed")
+			}
+			if !qh.cleanupDue(now.Add(defaultCleanupInterval)) {
+				t.Fatal("cleanup should be due once the cleanup interval has passed")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			var got []time.Duration
+			others := 0
+			for _, doc := range docs {
+				if doc.rule != "test-rule" {
+					others++
+					continue
+				}
+				got = append(got, now.Sub(doc.timestamp))
+			}
+			if others != len(tc.writes) {
+				t.Fatalf("state documents of other rules were deleted (%d of %d left)", others, len(tc.writes))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Fatalf("unexpected state documents left (got %v, expected %v)", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestCleanupDisabled(t *testing.T) {
+	qh := &QueryHandler{cleanupInterval: defaultCleanupInterval}
+	if qh.cleanupDue(time.Now()) {
+		t.Fatal("cleanup should never be due without a retention")
+	}
+}
+
+func TestPutTemplateLifecycle(t *testing.T) {
+	reqFunc, err := buildHTTPRequestFunc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var template map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"acknowledged": true}`))
+	}))
+	defer ts.Close()
+
+	for _, policy := range []string{"", "go-es-alerts-state"} {
+		qh := &QueryHandler{
+			client:     http.DefaultClient,
+			esURL:      ts.URL,
+			ilmPolicy:  policy,
+			newRequest: reqFunc,
+		}
+		if err := qh.PutTemplate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := utils.Get(template, "settings.index.lifecycle.name").(string)
+		if got != policy {
+			t.Fatalf("unexpected lifecycle policy (got %q, expected %q)", got, policy)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+)
+
+// updateFireCount counts the consecutive runs which produced the
+// same records as the run which ran at runAt. A run which produced
+// no records resets the count, and one which produced different
+// records starts counting again from one.
+func (q *QueryHandler) updateFireCount(records []*alert.Record, runAt time.Time) {
+	if len(records) < 1 {
+		q.fingerprint, q.fireCount, q.firstFired = "", 0, time.Time{}
+		return
+	}
+	fp := alert.Fingerprint(records)
+	if q.fireCount > 0 && fp == q.fingerprint {
+		q.fireCount++
+		return
+	}
+	q.fingerprint, q.fireCount, q.firstFired = fp, 1, runAt
+}
+
+// parseStateFireCount returns the 'fingerprint', 'fire_count' and
+// 'first_fired' fields of a state document, or a zero count if any
+// of them is missing or invalid.
+func parseStateFireCount(data map[string]interface{}) (string, int, time.Time) {
+	fp, ok := utils.Get(data, "hits.hits[0]._source.fingerprint").(string)
+	if !ok {
+		return "", 0, time.Time{}
+	}
+	count, ok := utils.Get(data, "hits.hits[0]._source.fire_count").(float64)
+	if !ok || count < 1 {
+		return "", 0, time.Time{}
+	}
+	first := parseStateTime(data, "first_fired")
+	if first.IsZero() {
+		return "", 0, time.Time{}
+	}
+	return fp, int(count), first
+}
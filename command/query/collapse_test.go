@@ -0,0 +1,205 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+)
+
+func TestUpdateFireCount(t *testing.T) {
+	qh := &QueryHandler{}
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	records := func(text string) []*alert.Record {
+		return []*alert.Record{{Filter: "hits.hits._source", Text: text, BodyField: true}}
+	}
+
+	runs := []struct {
+		name    string
+		records []*alert.Record
+		count   int
+		first   time.Time
+	}{
+		{"first-firing", records("a"), 1, start},
+		{"identical", records("a"), 2, start},
+		{"identical-again", records("a"), 3, start},
+		{"changed", records("b"), 1, start.Add(3 * time.Minute)},
+		{"identical-to-changed", records("b"), 2, start.Add(3 * time.Minute)},
+		{"no-records", nil, 0, time.Time{}},
+		{"firing-again", records("b"), 1, start.Add(6 * time.Minute)},
+	}
+	for i, run := range runs {
+		qh.updateFireCount(run.records, start.Add(time.Duration(i)*time.Minute))
+		if qh.fireCount != run.count {
+			t.Fatalf("%s: unexpected fire count (got %d, expected %d)", run.name, qh.fireCount, run.count)
+		}
+		if !qh.firstFired.Equal(run.first) {
+			t.Fatalf("%s: unexpected first firing (got %s, expected %s)", run.name, qh.firstFired, run.first)
+		}
+	}
+}
+
+func TestParseStateFireCount(t *testing.T) {
+	source := func(fields map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"hits": map[string]interface{}{
+				"hits": []interface{}{map[string]interface{}{"_source": fields}},
+			},
+		}
+	}
+	first := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		fields map[string]interface{}
+		count  int
+	}{
+		{
+			"valid",
+			map[string]interface{}{"fingerprint": "abc", "fire_count": float64(3), "first_fired": "2019-01-01T00:00:00Z"},
+			3,
+		},
+		{
+			"no-fingerprint",
+			map[string]interface{}{"fire_count": float64(3), "first_fired": "2019-01-01T00:00:00Z"},
+			0,
+		},
+		{
+			"invalid-count",
+			map[string]interface{}{"fingerprint": "abc", "fire_count": "3", "first_fired": "2019-01-01T00:00:00Z"},
+			0,
+		},
+		{
+			"invalid-time",
+			map[string]interface{}{"fingerprint": "abc", "fire_count": float64(3), "first_fired": "yesterday"},
+			0,
+		},
+	}
+	for _, tc := range cases {
+		fp, count, since := parseStateFireCount(source(tc.fields))
+		if count != tc.count {
+			t.Fatalf("%s: unexpected fire count (got %d, expected %d)", tc.name, count, tc.count)
+		}
+		if count > 0 && (fp != "abc" || !since.Equal(first)) {
+			t.Fatalf("%s: unexpected fingerprint or first firing (got %q and %s)", tc.name, fp, since)
+		}
+	}
+}
+
+func TestRunCollapseIdentical(t *testing.T) {
+	queryIndex := randomUUID(t)
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/%s-%s/_search", defaultStateIndexAlias, templateVersion):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"hits":{"hits":[{"_source":{"next_query":%q}}]}}`, start.Format(time.RFC3339))
+		case fmt.Sprintf("/<%s-status-%s-{now/d}>/_doc", defaultStateIndexAlias, templateVersion):
+			w.WriteHeader(201)
+		case fmt.Sprintf("/%s/_search", queryIndex):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hits":{"hits":[{"_source":{"hello":"world"}}]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	fileAM, err := file.NewAlertMethod(&file.AlertMethodConfig{
+		OutputFilepath: filepath.Join("testdata", "testfile.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:              "Test Collapse Identical",
+		Logger:            hclog.NewNullLogger(),
+		ESUrl:             ts.URL,
+		QueryIndex:        queryIndex,
+		AlertMethods:      []alert.Method{fileAM},
+		QueryData:         map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:          "@every 10s",
+		AlertCooldown:     25 * time.Second,
+		CollapseIdentical: true,
+		Clock:             fc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	outputCh := make(chan *alert.Alert, 1)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+
+	receive := func() *alert.Alert {
+		select {
+		case a := <-outputCh:
+			return a
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an alert")
+		}
+		return nil
+	}
+
+	if a := receive(); a.FireCount != 1 || !a.FirstFired.Equal(start) {
+		t.Fatalf("unexpected fire count of the first alert (got %d since %s, expected 1 since %s)",
+			a.FireCount, a.FirstFired, start)
+	}
+
+	// The next two runs are within the cooldown but keep counting
+	for i := 0; i < 2; i++ {
+		fc.BlockUntil(1)
+		fc.Advance(10 * time.Second)
+	}
+	fc.BlockUntil(1)
+	select {
+	case <-outputCh:
+		t.Fatal("alert should have been suppressed by the cooldown")
+	default:
+	}
+	fc.Advance(10 * time.Second)
+
+	a := receive()
+	if a.FireCount != 4 {
+		t.Fatalf("unexpected fire count of the alert sent after the cooldown (got %d, expected 4)", a.FireCount)
+	}
+	if !a.FirstFired.Equal(start) {
+		t.Fatalf("unexpected first firing (got %s, expected %s)", a.FirstFired, start)
+	}
+}
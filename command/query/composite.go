@@ -0,0 +1,204 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// defaultMaxCompositeBuckets is the maximum number of buckets of a
+// composite aggregation collected across all of its pages if
+// Composite.MaxBuckets is zero.
+const defaultMaxCompositeBuckets = 10000
+
+// Composite configures the pagination of a composite aggregation
+// of the query of a rule.
+type Composite struct {
+	// Aggregation is the name of the top-level composite
+	// aggregation of the query
+	Aggregation string
+
+	// MaxBuckets is the maximum number of buckets collected across
+	// all pages. If zero, defaultMaxCompositeBuckets is used
+	MaxBuckets int
+}
+
+// queryComposite executes the query once per page of the composite
+// aggregation q.composite, passing the 'after_key' of each page as
+// the 'after' of the next, until a page has no 'after_key' or no
+// buckets or q.composite.MaxBuckets buckets have been collected.
+// It returns the response to the first page with the buckets of all
+// pages. The key of each bucket, an object with a value per source
+// of the aggregation, is replaced with the values joined by " - "
+// in the order of the sources so that the buckets can be grouped
+// like those of any other aggregation.
+func (q *QueryHandler) queryComposite(ctx context.Context) (map[string]interface{}, error) {
+	name := q.composite.Aggregation
+	var (
+		first   map[string]interface{}
+		buckets []interface{}
+		after   interface{}
+	)
+	for page := 1; ; page++ {
+		data, err := q.search(ctx, q.queryIndex, "_search", compositePage(q.queryData, name, after))
+		if err != nil {
+			return nil, xerrors.Errorf("error querying page %d of composite aggregation %q: %v", page, name, err)
+		}
+		agg := responseAggregation(data, name)
+		if agg == nil {
+			return nil, xerrors.Errorf("response to page %d has no aggregation %q", page, name)
+		}
+		if first == nil {
+			first = data
+		}
+
+		pageBuckets, _ := agg["buckets"].([]interface{})
+		buckets = append(buckets, pageBuckets...)
+		after = agg["after_key"]
+		if len(buckets) >= q.composite.MaxBuckets {
+			if len(buckets) > q.composite.MaxBuckets || after != nil {
+				q.logger.Warn(fmt.Sprintf("[Rule: %q] collected the maximum number of buckets of a composite aggregation",
+					q.name), "aggregation", name, "max_buckets", q.composite.MaxBuckets, "pages", page)
+			}
+			buckets = buckets[:q.composite.MaxBuckets]
+			break
+		}
+		if after == nil || len(pageBuckets) == 0 {
+			break
+		}
+	}
+
+	sources := compositeSources(q.queryData, name)
+	for _, b := range buckets {
+		if bucket, ok := b.(map[string]interface{}); ok {
+			bucket["key"] = compositeKey(bucket["key"], sources)
+		}
+	}
+
+	agg := responseAggregation(first, name)
+	agg["buckets"] = buckets
+	delete(agg, "after_key")
+	return first, nil
+}
+
+// compositePage returns a copy of body in which the composite
+// aggregation of the given name resumes after the given key, or
+// body itself if after is nil. The maps on the path to the
+// aggregation are copied so that body is not modified.
+func compositePage(body map[string]interface{}, name string, after interface{}) map[string]interface{} {
+	if after == nil {
+		return body
+	}
+	key := aggregationsKey(body)
+	aggs := copyMap(body[key])
+	agg := copyMap(aggs[name])
+	composite := copyMap(agg["composite"])
+	composite["after"] = after
+	agg["composite"] = composite
+	aggs[name] = agg
+
+	page := copyMap(body)
+	page[key] = aggs
+	return page
+}
+
+// compositeSources returns the names of the sources of the
+// composite aggregation of the given name in body, in order.
+func compositeSources(body map[string]interface{}, name string) []string {
+	aggs, _ := body[aggregationsKey(body)].(map[string]interface{})
+	agg, _ := aggs[name].(map[string]interface{})
+	composite, _ := agg["composite"].(map[string]interface{})
+	list, _ := composite["sources"].([]interface{})
+
+	var sources []string
+	for _, elem := range list {
+		source, ok := elem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// Each source is an object with a single field, its name
+		for k := range source {
+			sources = append(sources, k)
+		}
+	}
+	return sources
+}
+
+// compositeKey joins the values of the key of a composite bucket
+// in the order of the given sources.
+func compositeKey(key interface{}, sources []string) interface{} {
+	m, ok := key.(map[string]interface{})
+	if !ok {
+		return key
+	}
+	values := make([]string, 0, len(sources))
+	for _, source := range sources {
+		values = append(values, keyValue(m[source]))
+	}
+	return strings.Join(values, " - ")
+}
+
+// keyValue formats a value of the key of a composite bucket.
+// Buckets of documents missing a source (see 'missing_bucket')
+// have a null value.
+func keyValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// responseAggregation returns the aggregation of the given name
+// of the response, or nil if there is none.
+func responseAggregation(data map[string]interface{}, name string) map[string]interface{} {
+	aggs, _ := data["aggregations"].(map[string]interface{})
+	agg, _ := aggs[name].(map[string]interface{})
+	return agg
+}
+
+// aggregationsKey returns the name of the field of body holding
+// its aggregations, which may be abbreviated as "aggs".
+func aggregationsKey(body map[string]interface{}) string {
+	if _, ok := body["aggs"]; ok {
+		return "aggs"
+	}
+	return "aggregations"
+}
+
+// copyMap returns a shallow copy of v if it is an object, or an
+// empty object otherwise.
+func copyMap(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	c := make(map[string]interface{}, len(m)+1)
+	for k, elem := range m {
+		c[k] = elem
+	}
+	return c
+}
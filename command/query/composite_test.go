@@ -0,0 +1,154 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+)
+
+func TestQueryComposite(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "composite_aggregation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pages []json.RawMessage
+	if err = json.Unmarshal(data, &pages); err != nil {
+		t.Fatal(err)
+	}
+
+	source := func(name string) map[string]interface{} {
+		return map[string]interface{}{
+			name: map[string]interface{}{"terms": map[string]interface{}{"field": name}},
+		}
+	}
+	composite := map[string]interface{}{
+		"size":    2,
+		"sources": []interface{}{source("host"), source("status")},
+	}
+	body := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"by_host": map[string]interface{}{"composite": composite},
+		},
+	}
+
+	cases := []struct {
+		name       string
+		maxBuckets int
+		afters     []interface{}
+		fields     []*alert.Field
+	}{
+		{
+			"all-pages",
+			0,
+			[]interface{}{
+				nil,
+				map[string]interface{}{"host": "api-2", "status": float64(502)},
+				map[string]interface{}{"host": "web-1", "status": float64(503)},
+			},
+			[]*alert.Field{
+				{Key: "api-1 - 500", Count: 3},
+				{Key: "api-2 - 502", Count: 2},
+				{Key: "web-1 - 500", Count: 6},
+				{Key: "web-1 - 503", Count: 1},
+			},
+		},
+		{
+			"max-buckets",
+			3,
+			[]interface{}{
+				nil,
+				map[string]interface{}{"host": "api-2", "status": float64(502)},
+			},
+			[]*alert.Field{
+				{Key: "api-1 - 500", Count: 3},
+				{Key: "api-2 - 502", Count: 2},
+				{Key: "web-1 - 500", Count: 6},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var afters []interface{}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Aggs map[string]struct {
+						Composite map[string]interface{} `json:"composite"`
+					} `json:"aggs"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				afters = append(afters, req.Aggs["by_host"].Composite["after"])
+				if len(afters) > len(pages) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Write(pages[len(afters)-1]) // nolint: errcheck
+			}))
+			defer ts.Close()
+
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Composite",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-index",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData:    body,
+				Schedule:     "@every 10m",
+				Filters:      []string{"aggregations.by_host.buckets"},
+				Composite:    &Composite{Aggregation: "by_host", MaxBuckets: tc.maxBuckets},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := qh.query(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(afters, tc.afters) {
+				t.Fatalf("unexpected 'after' of each page:\nGot:\n\t%v\nExpected:\n\t%v", afters, tc.afters)
+			}
+			if _, ok := composite["after"]; ok {
+				t.Fatal("query body was modified")
+			}
+
+			records, _, err := qh.process(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("expected one record but got %d", len(records))
+			}
+			if !reflect.DeepEqual(records[0].Fields, tc.fields) {
+				t.Fatalf("unexpected fields:\nGot:\n\t%+v\nExpected:\n\t%+v", records[0].Fields, tc.fields)
+			}
+		})
+	}
+}
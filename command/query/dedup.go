@@ -0,0 +1,139 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+)
+
+// dedupKey is the time at which an alert was last sent for a key of
+// the dedup key field, as persisted in the 'dedup_keys' field of the
+// state documents.
+type dedupKey struct {
+	Key       string `json:"key"`
+	LastAlert string `json:"last_alert"`
+}
+
+// dedup removes the fields of the record of the dedup key field
+// whose keys were alerted on less than q.cooldown ago. It returns
+// the remaining records and the keys of the remaining fields, or
+// no records at all if no key is new, since the other records only
+// provide context for the new keys.
+func (q *QueryHandler) dedup(records []*alert.Record, now time.Time) ([]*alert.Record, []string) {
+	var (
+		deduped = make([]*alert.Record, 0, len(records))
+		keys    []string
+	)
+	for _, record := range records {
+		if record.Filter != q.dedupField {
+			deduped = append(deduped, record)
+			continue
+		}
+		// The record is copied since it is not ours to modify
+		r := *record
+		r.Fields = make([]*alert.Field, 0, len(record.Fields))
+		for _, f := range record.Fields {
+			if last, ok := q.dedupKeys[f.Key]; ok && now.Before(last.Add(q.cooldown)) {
+				continue
+			}
+			r.Fields = append(r.Fields, f)
+			keys = append(keys, f.Key)
+		}
+		if len(r.Fields) > 0 {
+			deduped = append(deduped, &r)
+		}
+	}
+	if len(keys) == 0 {
+		q.logger.Info(fmt.Sprintf("[Rule: %q] suppressing alert (no new keys of %s)", q.name, q.dedupField))
+		return nil, nil
+	}
+	return deduped, keys
+}
+
+// markDedupKeys starts the cooldown of each of the keys at the time
+// of the alert sent for them and forgets the keys whose cooldown has
+// ended.
+func (q *QueryHandler) markDedupKeys(keys []string, at time.Time) {
+	if len(keys) == 0 {
+		return
+	}
+	if q.dedupKeys == nil {
+		q.dedupKeys = make(map[string]time.Time, len(keys))
+	}
+	for key, last := range q.dedupKeys {
+		if !at.Before(last.Add(q.cooldown)) {
+			delete(q.dedupKeys, key)
+		}
+	}
+	for _, key := range keys {
+		q.dedupKeys[key] = at
+	}
+}
+
+// forgetDedupKeys undoes the cooldown which the alert sent at the
+// given time started for each of the keys, unless another alert has
+// been sent for the key since.
+func (q *QueryHandler) forgetDedupKeys(keys []string, at time.Time) {
+	for _, key := range keys {
+		if last, ok := q.dedupKeys[key]; ok && last.Equal(at) {
+			delete(q.dedupKeys, key)
+		}
+	}
+}
+
+// stateDedupKeys returns the keys in cooldown in the form persisted
+// in the state documents, sorted by key.
+func (q *QueryHandler) stateDedupKeys() []dedupKey {
+	keys := make([]dedupKey, 0, len(q.dedupKeys))
+	for key, last := range q.dedupKeys {
+		keys = append(keys, dedupKey{Key: key, LastAlert: last.Format(defaultTimestampFormat)})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+// parseStateDedupKeys returns the 'dedup_keys' field of a state
+// document, omitting any invalid entries.
+func parseStateDedupKeys(data map[string]interface{}) map[string]time.Time {
+	raw, ok := utils.Get(data, "hits.hits[0]._source.dedup_keys").([]interface{})
+	if !ok {
+		return nil
+	}
+	keys := make(map[string]time.Time, len(raw))
+	for _, v := range raw {
+		entry, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		key, ok := entry["key"].(string)
+		if !ok {
+			continue
+		}
+		last, ok := entry["last_alert"].(string)
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(defaultTimestampFormat, last)
+		if err != nil {
+			continue
+		}
+		keys[key] = t
+	}
+	return keys
+}
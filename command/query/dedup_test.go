@@ -0,0 +1,193 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+func TestDedup(t *testing.T) {
+	const filter = "aggregations.hostname.buckets"
+	qh := &QueryHandler{
+		name:       "Test Dedup",
+		logger:     hclog.NewNullLogger(),
+		cooldown:   time.Hour,
+		dedupField: filter,
+	}
+	hosts := func(keys ...string) []*alert.Record {
+		record := &alert.Record{Filter: filter}
+		for _, key := range keys {
+			record.Fields = append(record.Fields, &alert.Field{Key: key, Count: 1})
+		}
+		return []*alert.Record{
+			{Filter: "hits.hits._source", Text: "context", BodyField: true},
+			record,
+		}
+	}
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	runs := []struct {
+		name     string
+		at       time.Time
+		hosts    []string
+		expected []string
+	}{
+		{"first-run", start, []string{"A", "B"}, []string{"A", "B"}},
+		{"new-host", start.Add(10 * time.Minute), []string{"B", "C"}, []string{"C"}},
+		{"no-new-hosts", start.Add(20 * time.Minute), []string{"A", "B", "C"}, nil},
+		{"cooldown-ended", start.Add(time.Hour), []string{"A", "B", "C"}, []string{"A", "B"}},
+	}
+	for _, run := range runs {
+		records := hosts(run.hosts...)
+		deduped, keys := qh.dedup(records, run.at)
+		if fmt.Sprint(keys) != fmt.Sprint(run.expected) {
+			t.Fatalf("%s: unexpected keys (got %v, expected %v)", run.name, keys, run.expected)
+		}
+		if len(run.expected) == 0 {
+			if deduped != nil {
+				t.Fatalf("%s: expected no records, got %d", run.name, len(deduped))
+			}
+			continue
+		}
+		if len(deduped) != 2 || deduped[0] != records[0] {
+			t.Fatalf("%s: the records of other filters should be kept as is", run.name)
+		}
+		if len(deduped[1].Fields) != len(run.expected) {
+			t.Fatalf("%s: unexpected number of fields (got %d, expected %d)",
+				run.name, len(deduped[1].Fields), len(run.expected))
+		}
+		if len(records[1].Fields) != len(run.hosts) {
+			t.Fatalf("%s: the original record should not be modified", run.name)
+		}
+		qh.markDedupKeys(keys, run.at)
+	}
+
+	if _, ok := qh.dedupKeys["C"]; !ok {
+		t.Fatal("key C should still be in cooldown")
+	}
+	qh.forgetDedupKeys([]string{"A", "C"}, start.Add(time.Hour))
+	if _, ok := qh.dedupKeys["A"]; ok {
+		t.Fatal("the cooldown of key A should have been undone")
+	}
+	if _, ok := qh.dedupKeys["C"]; !ok {
+		t.Fatal("the cooldown of key C, started by another alert, should have been kept")
+	}
+}
+
+func TestDispatchDisableDedup(t *testing.T) {
+	const filter = "aggregations.hostname.buckets"
+	cases := []struct {
+		name     string
+		disable  bool
+		cooldown time.Duration
+		expected []string
+	}{
+		// Only the first of the identical firings is new
+		{"dedup", false, time.Hour, []string{ResultAlert, ResultSuppressed, ResultSuppressed}},
+		{"disabled", true, 0, []string{ResultAlert, ResultAlert, ResultAlert}},
+		// The cooldown applies to the rule as a whole
+		{"disabled-cooldown", true, 15 * time.Minute, []string{ResultAlert, ResultSuppressed, ResultAlert}},
+	}
+
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fc := clock.NewFake(start)
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:          "Test Disable Dedup",
+				Logger:        hclog.NewNullLogger(),
+				ESUrl:         ElasticsearchURL,
+				QueryIndex:    "test-*",
+				AlertMethods:  []alert.Method{&file.AlertMethod{}},
+				QueryData:     map[string]interface{}{"query": map[string]interface{}{}},
+				Schedule:      "@every 10m",
+				Filters:       []string{filter},
+				AlertCooldown: tc.cooldown,
+				DedupKeyField: filter,
+				DisableDedup:  tc.disable,
+				Clock:         fc,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sq := newSendQueue(len(tc.expected))
+			var alerts int
+			for i, expected := range tc.expected {
+				records := []*alert.Record{
+					{Filter: filter, Fields: []*alert.Field{{Key: "web-1", Count: 1}}},
+				}
+				res := qh.dispatch(context.Background(), sq, false, records)
+				if res.Result != expected {
+					t.Fatalf("firing %d: unexpected result (got %q, expected %q)", i+1, res.Result, expected)
+				}
+				if res.Result == ResultAlert {
+					alerts++
+				}
+				fc.Advance(10 * time.Minute)
+			}
+
+			close(sq.alerts)
+			var sent int
+			for range sq.alerts {
+				sent++
+			}
+			if sent != alerts {
+				t.Fatalf("unexpected number of alerts sent (got %d, expected %d)", sent, alerts)
+			}
+		})
+	}
+}
+
+func TestParseStateDedupKeys(t *testing.T) {
+	qh := &QueryHandler{
+		dedupKeys: map[string]time.Time{
+			"b": time.Date(2019, time.January, 1, 1, 0, 0, 0, time.UTC),
+			"a": time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	entries := make([]interface{}, 0, 3)
+	for _, key := range qh.stateDedupKeys() {
+		entries = append(entries, map[string]interface{}{"key": key.Key, "last_alert": key.LastAlert})
+	}
+	entries = append(entries, map[string]interface{}{"key": "c", "last_alert": "not a time"})
+	data := map[string]interface{}{
+		"hits": map[string]interface{}{
+			"hits": []interface{}{
+				map[string]interface{}{
+					"_source": map[string]interface{}{"dedup_keys": entries},
+				},
+			},
+		},
+	}
+
+	keys := parseStateDedupKeys(data)
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	for key, last := range qh.dedupKeys {
+		if !keys[key].Equal(last) {
+			t.Fatalf("unexpected time of key %s (got %s, expected %s)", key, keys[key], last)
+		}
+	}
+}
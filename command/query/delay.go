@@ -0,0 +1,210 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"strings"
+	"time"
+)
+
+// anchorFormat is the format of the dates at which delayed date
+// math is anchored. It is parsed by the strict_date_optional_time
+// format, the default of date fields.
+const anchorFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// rangeParams are the parameters of a range query or of a range of
+// a date_range aggregation which may hold date math.
+var rangeParams = map[string]bool{
+	"gt":   true,
+	"gte":  true,
+	"lt":   true,
+	"lte":  true,
+	"from": true,
+	"to":   true,
+}
+
+// delayBody returns a copy of the query body in which the date math
+// relative to "now" (e.g. "now-5m/m") of every range query and
+// date_range aggregation is instead anchored at now - delay (e.g.
+// "2020-01-01T00:04:00.000Z||-5m/m") so that the time window of the
+// query ends delay earlier. If an affected range has a 'format', the
+// format of the anchor is appended to it. If delay is not positive,
+// body is returned as is.
+func delayBody(body map[string]interface{}, delay time.Duration, now time.Time) map[string]interface{} {
+	if delay <= 0 {
+		return body
+	}
+	return anchorBody(body, now.Add(-delay))
+}
+
+// anchorBody returns a copy of the query body in which the date math
+// relative to "now" of every range query and date_range aggregation
+// is instead anchored at the given time, as in delayBody.
+func anchorBody(body map[string]interface{}, at time.Time) map[string]interface{} {
+	if body == nil {
+		return body
+	}
+	anchor := at.UTC().Format(anchorFormat)
+	anchored, _ := delayValue(body, anchor).(map[string]interface{})
+	return anchored
+}
+
+// delayValue returns a copy of v in which the date math of any range
+// queries and date_range aggregations is anchored at anchor.
+func delayValue(v interface{}, anchor string) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		delayed := make(map[string]interface{}, len(value))
+		for k, child := range value {
+			switch k {
+			case "range":
+				delayed[k] = delayRangeQuery(child, anchor)
+			case "date_range":
+				delayed[k] = delayDateRange(child, anchor)
+			default:
+				delayed[k] = delayValue(child, anchor)
+			}
+		}
+		return delayed
+	case []interface{}:
+		delayed := make([]interface{}, 0, len(value))
+		for _, child := range value {
+			delayed = append(delayed, delayValue(child, anchor))
+		}
+		return delayed
+	default:
+		return v
+	}
+}
+
+// delayRangeQuery anchors the date math of the range of each field
+// of a range query (e.g. {"@timestamp": {"gte": "now-5m"}}). If a
+// range has a 'format', the format of the anchor is appended to it.
+func delayRangeQuery(v interface{}, anchor string) interface{} {
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return delayValue(v, anchor)
+	}
+	delayed := make(map[string]interface{}, len(fields))
+	for field, params := range fields {
+		r, anchored := delayRange(params, anchor)
+		if r == nil {
+			delayed[field] = params
+			continue
+		}
+		if f, ok := r["format"]; ok && anchored {
+			r["format"] = anchorParseFormat(f)
+		}
+		delayed[field] = r
+	}
+	return delayed
+}
+
+// delayDateRange anchors the date math of each of the 'ranges' of a
+// date_range aggregation. Since the 'format' of the aggregation
+// applies to all of its ranges, the format of the anchor is appended
+// to it if any range was anchored.
+func delayDateRange(v interface{}, anchor string) interface{} {
+	agg, ok := delayValue(v, anchor).(map[string]interface{})
+	if !ok {
+		return v
+	}
+	ranges, ok := agg["ranges"].([]interface{})
+	if !ok {
+		return agg
+	}
+	delayed := make([]interface{}, 0, len(ranges))
+	var anyAnchored bool
+	for _, params := range ranges {
+		r, anchored := delayRange(params, anchor)
+		if r == nil {
+			delayed = append(delayed, params)
+			continue
+		}
+		anyAnchored = anyAnchored || anchored
+		delayed = append(delayed, r)
+	}
+	agg["ranges"] = delayed
+	if f, ok := agg["format"]; ok && anyAnchored {
+		agg["format"] = anchorParseFormat(f)
+	}
+	return agg
+}
+
+// delayRange returns a copy of the parameters of a single range
+// (e.g. {"gte": "now-5m", "lt": "now"}) with their date math
+// anchored, and whether any was. It returns nil if v is not an
+// object.
+func delayRange(v interface{}, anchor string) (map[string]interface{}, bool) {
+	params, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	delayed := make(map[string]interface{}, len(params))
+	var anchored bool
+	for k, param := range params {
+		if s, ok := param.(string); ok && rangeParams[k] {
+			if math, ok := anchorDateMath(s, anchor); ok {
+				delayed[k] = math
+				anchored = true
+				continue
+			}
+		}
+		delayed[k] = param
+	}
+	return delayed, anchored
+}
+
+// anchorDateMath returns the date math s anchored at anchor rather
+// than "now", and whether s was relative to "now".
+func anchorDateMath(s, anchor string) (string, bool) {
+	if !strings.HasPrefix(s, "now") {
+		return s, false
+	}
+	rest := s[len("now"):]
+	if rest == "" {
+		return anchor, true
+	}
+	switch rest[0] {
+	case '+', '-', '/':
+		return anchor + "||" + rest, true
+	}
+	return s, false
+}
+
+// anchorParseFormat returns the date format f with the format of
+// anchors appended so that Elasticsearch can parse them.
+func anchorParseFormat(f interface{}) interface{} {
+	s, ok := f.(string)
+	if !ok || s == "" {
+		return f
+	}
+	for _, format := range strings.Split(s, "||") {
+		if format == "strict_date_optional_time" {
+			return s
+		}
+	}
+	return s + "||strict_date_optional_time"
+}
+
+// windowBody returns a copy of the query body whose time window ends
+// q.queryDelay before the current time of the clock. While the rule
+// is being backtested, the window is anchored at the time of the
+// backtested run even if the rule has no delay.
+func (q *QueryHandler) windowBody(body map[string]interface{}) map[string]interface{} {
+	if q.backtesting {
+		return anchorBody(body, q.clk().Now().Add(-q.queryDelay))
+	}
+	return delayBody(body, q.queryDelay, q.clk().Now())
+}
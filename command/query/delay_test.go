@@ -0,0 +1,154 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+func TestDelayBody(t *testing.T) {
+	now := time.Date(2020, time.January, 1, 0, 5, 0, 0, time.UTC)
+	const anchor = "2020-01-01T00:04:00.000Z"
+
+	cases := []struct {
+		name     string
+		body     string
+		delay    time.Duration
+		expected string
+	}{
+		{
+			"range-query",
+			`{"query":{"bool":{"filter":[{"range":{"@timestamp":{"gte":"now-5m/m","lt":"now"}}}]}}}`,
+			time.Minute,
+			`{"query":{"bool":{"filter":[{"range":{"@timestamp":{"gte":"` + anchor + `||-5m/m","lt":"` + anchor + `"}}}]}}}`,
+		},
+		{
+			"no-delay",
+			`{"query":{"range":{"@timestamp":{"gte":"now-5m"}}}}`,
+			0,
+			`{"query":{"range":{"@timestamp":{"gte":"now-5m"}}}}`,
+		},
+		{
+			"absolute-dates",
+			`{"query":{"range":{"@timestamp":{"gte":"2019-12-31","lt":"nowhere","boost":2}}}}`,
+			time.Minute,
+			`{"query":{"range":{"@timestamp":{"gte":"2019-12-31","lt":"nowhere","boost":2}}}}`,
+		},
+		{
+			"range-format",
+			`{"query":{"range":{"@timestamp":{"gte":"now-1d","format":"epoch_millis"}}}}`,
+			time.Minute,
+			`{"query":{"range":{"@timestamp":{"gte":"` + anchor + `||-1d",` +
+				`"format":"epoch_millis||strict_date_optional_time"}}}}`,
+		},
+		{
+			"date-range-aggregation",
+			`{"aggs":{"recent":{"date_range":{"field":"@timestamp","format":"yyyy-MM-dd",` +
+				`"ranges":[{"from":"now-1h"},{"to":"2019-12-31"}]}}}}`,
+			time.Minute,
+			`{"aggs":{"recent":{"date_range":{"field":"@timestamp","format":"yyyy-MM-dd||strict_date_optional_time",` +
+				`"ranges":[{"from":"` + anchor + `||-1h"},{"to":"2019-12-31"}]}}}}`,
+		},
+		{
+			"match-not-rewritten",
+			`{"query":{"match":{"message":"now"}}}`,
+			time.Minute,
+			`{"query":{"match":{"message":"now"}}}`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var body, original, expected map[string]interface{}
+			for _, v := range []struct {
+				data string
+				dst  *map[string]interface{}
+			}{{tc.body, &body}, {tc.body, &original}, {tc.expected, &expected}} {
+				if err := json.Unmarshal([]byte(v.data), v.dst); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := delayBody(body, tc.delay, now)
+			if !reflect.DeepEqual(got, expected) {
+				data, _ := json.Marshal(got) // nolint: errcheck
+				t.Fatalf("unexpected body:\nGot:\n\t%s\nExpected:\n\t%s", data, tc.expected)
+			}
+			if !reflect.DeepEqual(body, original) {
+				t.Fatal("the original body should not be modified")
+			}
+		})
+	}
+}
+
+func TestQueryDelay(t *testing.T) {
+	now := time.Date(2020, time.January, 1, 0, 5, 0, 0, time.UTC)
+
+	var upper interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query struct {
+				Range map[string]map[string]interface{} `json:"range"`
+			} `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		upper = body.Query.Range["@timestamp"]["lte"]
+		w.Write([]byte(`{"hits": {"total": 0, "hits": []}}`)) // nolint: errcheck
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Delay",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		Schedule:     "@every 1m",
+		QueryIndex:   "logs-*",
+		QueryData: map[string]interface{}{
+			"query": map[string]interface{}{
+				"range": map[string]interface{}{
+					"@timestamp": map[string]interface{}{"gte": "now-1m", "lte": "now"},
+				},
+			},
+		},
+		QueryDelay: time.Minute,
+		Clock:      clock.NewFake(now),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = qh.execute(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := now.Add(-time.Minute).Format(anchorFormat); upper != expected {
+		t.Fatalf("expected the upper bound of the range to be offset by the query delay (got %v, expected %q)",
+			upper, expected)
+	}
+}
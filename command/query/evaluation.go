@@ -0,0 +1,155 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"golang.org/x/xerrors"
+)
+
+// Evaluation is one of several independent sets of conditions
+// evaluated against the response to the query of a rule. Each
+// evaluation which is met sends its own alert to its own outputs.
+type Evaluation struct {
+	// Name identifies the evaluation among those of the rule. Its
+	// alerts are sent, and its state is persisted, as those of the
+	// rule '<rule>/<name>'
+	Name string
+
+	// Conditions, Expression and Values are like the fields of the
+	// same names of QueryHandlerConfig
+	Conditions []config.Condition
+	Expression *config.Expression
+	Values     map[string]string
+
+	// AlertMethods are the outputs of the alerts of the evaluation
+	AlertMethods []alert.Method
+
+	// DedupKeyField is like the field of the same name of
+	// QueryHandlerConfig
+	DedupKeyField string
+}
+
+// newEvaluations creates a QueryHandler for each of the evaluations
+// of the rule. It is configured like the rule itself but is never
+// run; instead, the QueryHandler of the rule hands it the response
+// to the query (see cycleEvaluations).
+func (q *QueryHandler) newEvaluations(cfg *QueryHandlerConfig) error {
+	for _, e := range cfg.Evaluations {
+		ecfg := *cfg
+		ecfg.Name = cfg.Name + "/" + e.Name
+		ecfg.Conditions = e.Conditions
+		ecfg.Expression = e.Expression
+		ecfg.Values = e.Values
+		ecfg.AlertMethods = e.AlertMethods
+		ecfg.DedupKeyField = e.DedupKeyField
+		ecfg.Evaluations = nil
+
+		eq, err := NewQueryHandler(&ecfg)
+		if err != nil {
+			return xerrors.Errorf("error in evaluation %s: %v", e.Name, err)
+		}
+		q.evaluations = append(q.evaluations, eq)
+	}
+	return nil
+}
+
+// Evaluations returns the QueryHandlers of the evaluations of the
+// rule, if any.
+func (q *QueryHandler) Evaluations() []*QueryHandler {
+	return q.evaluations
+}
+
+// cycleEvaluations executes the query once and hands the response to
+// each of the evaluations, each of which sends its own alert if it is
+// met. The outcome is the most significant of the outcomes of the
+// evaluations (see resultRank), and the number of records matched is
+// their total. isFirst and the returned hits are as for cycle.
+func (q *QueryHandler) cycleEvaluations(
+	ctx context.Context,
+	sq *sendQueue,
+	isFirst bool,
+) (*RunResult, []map[string]interface{}) {
+	runAt := q.clk().Now()
+	data, hits, err := q.queryResponse(ctx)
+	if err != nil {
+		q.logger.Error(fmt.Sprintf("[Rule: %q] error executing query", q.name), "error", err)
+		q.errorOutput.Report(q.name, alert.ErrorSourceQuery, err)
+		return &RunResult{Result: ResultError, Err: err}, nil
+	}
+	q.lastRun = runAt
+
+	res := &RunResult{Result: ResultOK}
+	for _, eq := range q.evaluations {
+		eres := eq.evaluate(ctx, sq, isFirst, data, runAt)
+		res.Matched += eres.Matched
+		if resultRank[eres.Result] > resultRank[res.Result] {
+			res.Result, res.Err = eres.Result, eres.Err
+		}
+		if eq.lastAlert.After(q.lastAlert) {
+			q.lastAlert = eq.lastAlert
+		}
+	}
+	return res, hits
+}
+
+// queryResponse executes the query and returns the response along
+// with the hits to persist in the state document. The rule has no
+// conditions of its own, so processing the response only gathers
+// the hits.
+func (q *QueryHandler) queryResponse(ctx context.Context) (map[string]interface{}, []map[string]interface{}, error) {
+	data, err := q.timedQuery(ctx)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("error querying Elasticsearch: %v", err)
+	}
+	_, hits, err := q.process(data)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("error processing response: %v", err)
+	}
+	return data, hits, nil
+}
+
+// resultRank orders the outcomes of evaluations by significance.
+var resultRank = map[string]int{
+	ResultOK:          0,
+	ResultSuppressed:  1,
+	ResultAlert:       2,
+	ResultUndelivered: 3,
+	ResultError:       4,
+}
+
+// evaluate processes the response to the query of the rule of which
+// q is an evaluation and sends an alert if its records warrant one,
+// as cycle does for the response to its own query.
+func (q *QueryHandler) evaluate(
+	ctx context.Context,
+	sq *sendQueue,
+	isFirst bool,
+	data map[string]interface{},
+	runAt time.Time,
+) *RunResult {
+	records, _, err := q.process(data)
+	if err != nil {
+		err = xerrors.Errorf("error processing response: %v", err)
+		q.logger.Error(fmt.Sprintf("[Rule: %q] error evaluating query response", q.name), "error", err)
+		return &RunResult{Result: ResultError, Err: err}
+	}
+	q.observe(records, runAt)
+	return q.dispatch(ctx, sq, isFirst, records)
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+func TestCycleEvaluations(t *testing.T) {
+	cases := []struct {
+		name     string
+		errors   int
+		latency  int
+		expected []string
+		result   string
+	}{
+		{"both", 12, 900, []string{"Test Evaluations/errors", "Test Evaluations/latency"}, ResultAlert},
+		{"errors", 12, 250, []string{"Test Evaluations/errors"}, ResultAlert},
+		{"latency", 3, 900, []string{"Test Evaluations/latency"}, ResultAlert},
+		{"neither", 3, 250, nil, ResultOK},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			queryIndex := randomUUID(t)
+			var queries int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != fmt.Sprintf("/%s/_search", queryIndex) {
+					w.WriteHeader(404)
+					return
+				}
+				atomic.AddInt32(&queries, 1)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"hits":{"hits":[{"_source":{"message":"timeout"}}]},`+
+					`"aggregations":{"errors":{"doc_count":%d},"latency":{"value":%d}}}`,
+					tc.errors, tc.latency)
+			}))
+			defer ts.Close()
+
+			errorsMethod := &checkMethod{}
+			latencyMethod := &checkMethod{}
+			methods := map[string]alert.Method{
+				"Test Evaluations/errors":  errorsMethod,
+				"Test Evaluations/latency": latencyMethod,
+			}
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:       "Test Evaluations",
+				Logger:     hclog.NewNullLogger(),
+				ESUrl:      ts.URL,
+				QueryIndex: queryIndex,
+				QueryData:  map[string]interface{}{"query": map[string]interface{}{}},
+				Schedule:   "@every 1m",
+				BodyField:  "hits.hits._source",
+				Evaluations: []Evaluation{
+					{
+						Name: "errors",
+						Conditions: []config.Condition{
+							{"field": "aggregations.errors.doc_count", "quantifier": "any", "gt": json.Number("10")},
+						},
+						AlertMethods: []alert.Method{errorsMethod},
+					},
+					{
+						Name: "latency",
+						Conditions: []config.Condition{
+							{"field": "aggregations.latency.value", "quantifier": "any", "gt": json.Number("500")},
+						},
+						AlertMethods: []alert.Method{latencyMethod},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sq := newSendQueue(defaultSendQueueSize)
+			res, _ := qh.cycle(context.Background(), sq, false)
+			if n := atomic.LoadInt32(&queries); n != 1 {
+				t.Fatalf("expected the query to run once (got %d)", n)
+			}
+			if res.Result != tc.result {
+				t.Fatalf("unexpected result (got %q, expected %q)", res.Result, tc.result)
+			}
+
+			close(sq.alerts)
+			var rules []string
+			for qa := range sq.alerts {
+				rules = append(rules, qa.alert.RuleName)
+				if len(qa.alert.Methods) != 1 || qa.alert.Methods[0] != methods[qa.alert.RuleName] {
+					t.Errorf("alert of %s was not routed to its own output", qa.alert.RuleName)
+				}
+			}
+			sort.Strings(rules)
+			if fmt.Sprint(rules) != fmt.Sprint(tc.expected) {
+				t.Fatalf("unexpected alerts (got %v, expected %v)", rules, tc.expected)
+			}
+		})
+	}
+}
+
+func TestCycleEvaluationsCooldown(t *testing.T) {
+	queryIndex := randomUUID(t)
+	var latency int32 = 250
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"hits":{"hits":[{"_source":{"message":"timeout"}}]},`+
+			`"aggregations":{"errors":{"doc_count":12},"latency":{"value":%d}}}`,
+			atomic.LoadInt32(&latency))
+	}))
+	defer ts.Close()
+
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:          "Test Evaluations",
+		Logger:        hclog.NewNullLogger(),
+		ESUrl:         ts.URL,
+		QueryIndex:    queryIndex,
+		QueryData:     map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:      "@every 1m",
+		BodyField:     "hits.hits._source",
+		AlertCooldown: time.Hour,
+		Clock:         fc,
+		Evaluations: []Evaluation{
+			{
+				Name: "errors",
+				Conditions: []config.Condition{
+					{"field": "aggregations.errors.doc_count", "quantifier": "any", "gt": json.Number("10")},
+				},
+				AlertMethods: []alert.Method{&checkMethod{}},
+			},
+			{
+				Name: "latency",
+				Conditions: []config.Condition{
+					{"field": "aggregations.latency.value", "quantifier": "any", "gt": json.Number("500")},
+				},
+				AlertMethods: []alert.Method{&checkMethod{}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sq := newSendQueue(defaultSendQueueSize)
+	if res, _ := qh.cycle(context.Background(), sq, false); res.Result != ResultAlert {
+		t.Fatalf("unexpected result of the first run (got %q, expected %q)", res.Result, ResultAlert)
+	}
+	if qa := <-sq.alerts; qa.alert.RuleName != "Test Evaluations/errors" {
+		t.Fatalf("unexpected alert of the first run (got %s)", qa.alert.RuleName)
+	}
+
+	// The cooldown of one evaluation does not suppress the other
+	fc.Advance(time.Minute)
+	atomic.StoreInt32(&latency, 900)
+	if res, _ := qh.cycle(context.Background(), sq, false); res.Result != ResultAlert {
+		t.Fatalf("unexpected result of the second run (got %q, expected %q)", res.Result, ResultAlert)
+	}
+	close(sq.alerts)
+	var rules []string
+	for qa := range sq.alerts {
+		rules = append(rules, qa.alert.RuleName)
+	}
+	if fmt.Sprint(rules) != "[Test Evaluations/latency]" {
+		t.Fatalf("unexpected alerts of the second run (got %v)", rules)
+	}
+	if !qh.lastAlert.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected time of last alert (got %s, expected %s)", qh.lastAlert, start.Add(time.Minute))
+	}
+}
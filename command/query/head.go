@@ -0,0 +1,195 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// maxHeadWrites is the number of times writeHead tries to write the
+// head document of a rule, merging in that of another process after
+// each conflict.
+const maxHeadWrites = 3
+
+// headDoc is the head document of a rule in the head index: the
+// alert cooldown and the keys of the dedup key field in cooldown.
+// Unlike the state documents, which are only ever appended, there
+// is one per rule and each write is conditional on the version read
+// before it, so that two processes running the rule at once (e.g.
+// while the leadership changes hands) merge their cooldowns rather
+// than the last one written overriding the other's.
+type headDoc struct {
+	Name      string     `json:"rule_name"`
+	LastAlert string     `json:"last_alert,omitempty"`
+	DedupKeys []dedupKey `json:"dedup_keys,omitempty"`
+}
+
+// HeadIndexName returns the name of the index of the head documents.
+func (q *QueryHandler) HeadIndexName() string {
+	return fmt.Sprintf("%s-head-%s", defaultStateIndexAlias, templateVersion)
+}
+
+// headURL returns the URL of the head document of the rule for the
+// API, e.g. "_doc" or "_create".
+func (q *QueryHandler) headURL(api string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", q.esURL, q.HeadIndexName(), api, url.PathEscape(q.cleanedName()))
+}
+
+// getHead returns the head document of the rule and its version, or
+// nil if there is none.
+func (q *QueryHandler) getHead(ctx context.Context) (*headDoc, *docVersion, error) {
+	resp, err := q.makeRequest(ctx, http.MethodGet, q.headURL("_doc"), nil)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil, nil
+	default:
+		return nil, nil, xerrors.Errorf("unexpected status code reading head document: %d", resp.StatusCode)
+	}
+
+	var data struct {
+		docVersion
+		Found  bool    `json:"found"`
+		Source headDoc `json:"_source"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, nil, xerrors.Errorf("error JSON-decoding head document: %v", err)
+	}
+	if !data.Found {
+		return nil, nil, nil
+	}
+	return &data.Source, &data.docVersion, nil
+}
+
+// readHead reads the head document of the rule, merging its
+// cooldowns into those of the QueryHandler (see mergeHead), and
+// records its version.
+func (q *QueryHandler) readHead(ctx context.Context) error {
+	head, version, err := q.getHead(ctx)
+	if err != nil {
+		return err
+	}
+	q.headVersion = version
+	if head != nil {
+		q.mergeHead(head)
+	}
+	return nil
+}
+
+// mergeHead merges the cooldowns of the head document into those
+// of the QueryHandler, keeping the latest alert of the rule and of
+// each dedup key. Invalid times are ignored.
+func (q *QueryHandler) mergeHead(head *headDoc) {
+	if t, err := time.Parse(defaultTimestampFormat, head.LastAlert); err == nil && t.After(q.lastAlert) {
+		q.lastAlert = t
+	}
+	for _, key := range head.DedupKeys {
+		t, err := time.Parse(defaultTimestampFormat, key.LastAlert)
+		if err != nil {
+			continue
+		}
+		if q.dedupKeys == nil {
+			q.dedupKeys = make(map[string]time.Time, len(head.DedupKeys))
+		}
+		if last, ok := q.dedupKeys[key.Key]; !ok || t.After(last) {
+			q.dedupKeys[key.Key] = t
+		}
+	}
+}
+
+// writeHead writes the cooldowns of the QueryHandler to the head
+// document of the rule, conditionally on the version last read or
+// written. If another process wrote the document in the meantime,
+// its cooldowns are merged in and the write is retried, up to
+// maxHeadWrites times in all. Nothing is written if there is no head
+// document and no cooldown to record.
+func (q *QueryHandler) writeHead(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		head := &headDoc{Name: q.cleanedName()}
+		if !q.lastAlert.IsZero() {
+			head.LastAlert = q.lastAlert.Format(defaultTimestampFormat)
+		}
+		if len(q.dedupKeys) > 0 {
+			head.DedupKeys = q.stateDedupKeys()
+		}
+		if q.headVersion == nil && head.LastAlert == "" && len(head.DedupKeys) == 0 {
+			return nil
+		}
+
+		u := q.headURL("_create")
+		if q.headVersion != nil {
+			u = fmt.Sprintf("%s?if_seq_no=%d&if_primary_term=%d", q.headURL("_doc"),
+				q.headVersion.SeqNo, q.headVersion.PrimaryTerm)
+		}
+		written, err := q.putHead(ctx, u, head)
+		if err != nil {
+			return err
+		}
+		if written != nil {
+			q.headVersion = written
+			return nil
+		}
+
+		// Another process wrote the head document first
+		if attempt == maxHeadWrites {
+			return xerrors.Errorf("head document was written by another process %d times in a row", attempt)
+		}
+		q.logger.Debug(fmt.Sprintf("[Rule: %q] head document was written by another process, merging", q.name))
+		if err = q.readHead(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// putHead writes the head document to the URL. It returns the
+// version written, or nil if the write conflicted with that of
+// another process.
+func (q *QueryHandler) putHead(ctx context.Context, u string, head *headDoc) (*docVersion, error) {
+	payload := bytes.Buffer{}
+	if err := json.NewEncoder(&payload).Encode(head); err != nil {
+		return nil, xerrors.Errorf("error JSON-encoding head document: %v", err)
+	}
+	resp, err := q.makeRequest(ctx, http.MethodPut, u, &payload)
+	if err != nil {
+		return nil, xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusConflict:
+		return nil, nil
+	default:
+		return nil, xerrors.Errorf("unexpected status code writing head document (received status: %q). "+
+			"Response body:\n%s", resp.Status, q.readErrRespBody(resp))
+	}
+	written := new(docVersion)
+	if err = json.NewDecoder(resp.Body).Decode(written); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding response to writing head document: %v", err)
+	}
+	return written, nil
+}
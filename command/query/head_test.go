@@ -0,0 +1,268 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+)
+
+// fakeHeadES is a fake Elasticsearch holding the head documents,
+// which enforces the optimistic concurrency control of their writes,
+// and accepting state documents.
+type fakeHeadES struct {
+	mu     sync.Mutex
+	docs   map[string]json.RawMessage
+	seqNos map[string]int64
+	seqNo  int64
+
+	// writes are the paths and query strings of the writes of head
+	// documents; conflicts is how many of them conflicted
+	writes    []string
+	conflicts int
+
+	// conflictAlways makes every conditional write conflict
+	conflictAlways bool
+}
+
+func newFakeHeadES() *fakeHeadES {
+	return &fakeHeadES{docs: make(map[string]json.RawMessage), seqNos: make(map[string]int64)}
+}
+
+func (f *fakeHeadES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != fmt.Sprintf("%s-head-%s", defaultStateIndexAlias, templateVersion) {
+		// A state document
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"result": "created"}`)) // nolint: errcheck
+		return
+	}
+	api, id := parts[1], parts[2]
+	_, exists := f.docs[id]
+
+	if r.Method == http.MethodGet {
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"found": false}`)) // nolint: errcheck
+			return
+		}
+		fmt.Fprintf(w, `{"found": true, "_seq_no": %d, "_primary_term": 1, "_source": %s}`, f.seqNos[id], f.docs[id])
+		return
+	}
+
+	f.writes = append(f.writes, api+"?"+r.URL.RawQuery)
+	var conflict bool
+	switch api {
+	case "_create":
+		conflict = exists
+	case "_doc":
+		// Unconditional writes are refused so that the test fails
+		conflict = f.conflictAlways || !exists || r.URL.Query().Get("if_primary_term") != "1" ||
+			r.URL.Query().Get("if_seq_no") != fmt.Sprint(f.seqNos[id])
+	}
+	if conflict {
+		f.conflicts++
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error": {"type": "version_conflict_engine_exception"}}`)) // nolint: errcheck
+		return
+	}
+
+	var doc json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.docs[id] = doc
+	f.seqNos[id] = f.seqNo
+	f.seqNo++
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+	}
+	fmt.Fprintf(w, `{"_seq_no": %d, "_primary_term": 1}`, f.seqNos[id])
+}
+
+// head returns the head document of the rule.
+func (f *fakeHeadES) head(t *testing.T, rule string) *headDoc {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	head := new(headDoc)
+	if err := json.Unmarshal(f.docs[rule], head); err != nil {
+		t.Fatal(err)
+	}
+	return head
+}
+
+func newHeadQueryHandler(t *testing.T, esURL string) *QueryHandler {
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:          "Test Head",
+		Logger:        hclog.NewNullLogger(),
+		ESUrl:         esURL,
+		QueryIndex:    "test-*",
+		AlertMethods:  []alert.Method{&file.AlertMethod{}},
+		QueryData:     map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:      "@every 10m",
+		AlertCooldown: time.Hour,
+		DedupKeyField: "aggregations.hostname.buckets",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qh
+}
+
+func TestWriteHeadConcurrentReplicas(t *testing.T) {
+	es := newFakeHeadES()
+	ts := httptest.NewServer(es)
+	defer ts.Close()
+
+	// Two replicas run the same rule, e.g. while the leadership
+	// changes hands
+	a, b := newHeadQueryHandler(t, ts.URL), newHeadQueryHandler(t, ts.URL)
+	start := time.Now().UTC().Truncate(time.Second)
+	next := start.Add(10 * time.Minute)
+	alerts := []struct {
+		qh  *QueryHandler
+		key string
+		at  time.Time
+	}{
+		{a, "web-1", start},
+		{b, "web-2", start.Add(time.Minute)},
+		{a, "web-3", start.Add(2 * time.Minute)},
+	}
+	for _, run := range alerts {
+		run.qh.lastAlert = run.at
+		run.qh.markDedupKeys([]string{run.key}, run.at)
+		if err := run.qh.setNextQuery(context.Background(), next, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each write is conditional on the version last seen, and on a
+	// conflict the document of the other replica is merged in
+	expected := []string{
+		"_create?",
+		"_create?",
+		"_doc?if_seq_no=0&if_primary_term=1",
+		"_doc?if_seq_no=0&if_primary_term=1",
+		"_doc?if_seq_no=1&if_primary_term=1",
+	}
+	if fmt.Sprint(es.writes) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected writes of the head document:\nGot:\n\t%v\nExpected:\n\t%v", es.writes, expected)
+	}
+	if es.conflicts != 2 {
+		t.Fatalf("expected 2 conflicts (got %d)", es.conflicts)
+	}
+
+	head := es.head(t, "test-head")
+	if fmt.Sprint(head.DedupKeys) != fmt.Sprint([]dedupKey{
+		{Key: "web-1", LastAlert: start.Format(defaultTimestampFormat)},
+		{Key: "web-2", LastAlert: start.Add(time.Minute).Format(defaultTimestampFormat)},
+		{Key: "web-3", LastAlert: start.Add(2 * time.Minute).Format(defaultTimestampFormat)},
+	}) {
+		t.Fatalf("the dedup keys of both replicas should have been kept (got %v)", head.DedupKeys)
+	}
+	if head.LastAlert != start.Add(2*time.Minute).Format(defaultTimestampFormat) {
+		t.Fatalf("unexpected last alert (got %q)", head.LastAlert)
+	}
+	if _, ok := a.dedupKeys["web-2"]; !ok {
+		t.Fatal("the dedup key of the other replica should be in cooldown")
+	}
+}
+
+func TestWriteHeadConflicts(t *testing.T) {
+	es := newFakeHeadES()
+	ts := httptest.NewServer(es)
+	defer ts.Close()
+
+	qh := newHeadQueryHandler(t, ts.URL)
+	qh.lastAlert = time.Now()
+	if err := qh.writeHead(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	es.mu.Lock()
+	es.conflictAlways = true
+	es.mu.Unlock()
+	if err := qh.writeHead(context.Background()); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if es.conflicts != maxHeadWrites {
+		t.Fatalf("expected %d attempts to conflict (got %d)", maxHeadWrites, es.conflicts)
+	}
+}
+
+func TestWriteHeadNothingToRecord(t *testing.T) {
+	es := newFakeHeadES()
+	ts := httptest.NewServer(es)
+	defer ts.Close()
+
+	qh := newHeadQueryHandler(t, ts.URL)
+	if err := qh.setNextQuery(context.Background(), time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(es.writes) != 0 {
+		t.Fatalf("a rule which never alerted should not write a head document (got %v)", es.writes)
+	}
+}
+
+func TestGetNextQueryReadsHead(t *testing.T) {
+	last := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "-head-") {
+			fmt.Fprintf(w, `{"found": true, "_seq_no": 7, "_primary_term": 2, "_source": {
+  "rule_name": "test-head",
+  "last_alert": %q,
+  "dedup_keys": [{"key": "web-2", "last_alert": %q}]
+}}`, last.Add(time.Minute).Format(defaultTimestampFormat), last.Format(defaultTimestampFormat))
+			return
+		}
+		fmt.Fprintf(w, `{"hits": {"hits": [{"_source": {
+  "next_query": %q,
+  "last_alert": %q,
+  "dedup_keys": [{"key": "web-1", "last_alert": %q}]
+}}]}}`, last.Add(time.Hour).Format(defaultTimestampFormat), last.Format(defaultTimestampFormat),
+			last.Format(defaultTimestampFormat))
+	}))
+	defer ts.Close()
+
+	qh := newHeadQueryHandler(t, ts.URL)
+	if _, err := qh.getNextQuery(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !qh.lastAlert.Equal(last.Add(time.Minute)) {
+		t.Fatalf("the later alert of the head document should be kept (got %s)", qh.lastAlert)
+	}
+	if len(qh.dedupKeys) != 2 {
+		t.Fatalf("the dedup keys of the state and head documents should be merged (got %v)", qh.dedupKeys)
+	}
+	if qh.headVersion == nil || *qh.headVersion != (docVersion{SeqNo: 7, PrimaryTerm: 2}) {
+		t.Fatalf("unexpected version of the head document: %+v", qh.headVersion)
+	}
+}
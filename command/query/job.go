@@ -16,6 +16,8 @@ package query
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,6 +25,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -33,7 +36,9 @@ import (
 	uuid "github.com/hashicorp/go-uuid"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
 	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
 	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
 	"github.com/robfig/cron"
 	"golang.org/x/xerrors"
 
@@ -47,6 +52,16 @@ const (
 	defaultStateIndexAlias string = "go-es-alerts"
 	defaultTimestampFormat string = time.RFC3339
 	defaultBodyField       string = "hits.hits._source"
+
+	defaultSlowQueryThreshold = 10 * time.Second
+	defaultQueryTimeout       = 30 * time.Second
+	defaultCleanupInterval    = 1 * time.Hour
+
+	// maxSourceURILength is the maximum length of the path and
+	// query string of a query sent in the 'source' parameter. It
+	// stays below the default 'http.max_initial_line_length' of
+	// Elasticsearch (4KB) and the limits of most proxies
+	maxSourceURILength = 4000
 )
 
 // QueryHandlerConfig is passed as an argument to NewQueryHandler().
@@ -59,6 +74,23 @@ type QueryHandlerConfig struct { // nolint: golint
 	// by a query to the alert handler via the outputCh
 	AlertMethods []alert.Method
 
+	// RequireAllOutputs is whether an alert is only considered
+	// delivered if every one of AlertMethods succeeds in sending it.
+	// Otherwise, the alert cooldown is not started so that the next
+	// execution of the query alerts again. This should come from the
+	// 'require_all_outputs' field of the rule configuration file
+	RequireAllOutputs bool
+
+	// OutputConcurrency is the maximum number of AlertMethods to
+	// which an alert is sent at the same time. If zero, they are
+	// sent to one at a time. This should come from the
+	// 'output_concurrency' field of the rule configuration file
+	OutputConcurrency int
+
+	// ErrorOutput, if not nil, is sent the errors of executing the
+	// query
+	ErrorOutput *alert.ErrorOutput
+
 	// Client is an *http.Client instance that will be used to
 	// query Elasticsearch
 	Client *http.Client
@@ -98,6 +130,240 @@ type QueryHandlerConfig struct { // nolint: golint
 	// Conditions are used to make alerts fire when certain criteria
 	// are met.
 	Conditions []config.Condition
+
+	// Expression is used, like Conditions, to make alerts fire when
+	// the values extracted from the response per Values satisfy it.
+	// These should come from the 'expression' and 'values' fields
+	// of the rule configuration file
+	Expression *config.Expression
+	Values     map[string]string
+
+	// Evaluations are independent sets of conditions evaluated
+	// against the response to the query in place of Conditions and
+	// Expression, each sending alerts to its own outputs in place
+	// of AlertMethods
+	Evaluations []Evaluation
+
+	// UserAgent is appended to version.UserAgent() to form the
+	// User-Agent header included in every request to Elasticsearch
+	UserAgent string
+
+	// Headers are additional headers included in every request to
+	// Elasticsearch. These should come from the
+	// 'elasticsearch.client.headers' field of the main configuration
+	// file
+	Headers map[string]string
+
+	// SourceParam is whether queries are sent as GET requests
+	// without a body, with the query in the 'source' query-string
+	// parameter, so that caching proxies can cache them. Queries
+	// which would make the URL too long are sent as POST requests
+	// instead. This should come from the
+	// 'elasticsearch.client.source_param' field of the main
+	// configuration file
+	SourceParam bool
+
+	// AlertCooldown is the minimum amount of time between alerts
+	// sent by this rule. This should come from the 'alert_cooldown'
+	// field of the rule configuration file
+	AlertCooldown time.Duration
+
+	// IncludeAlertID is whether the alerts of this rule carry the
+	// ID of the firing which produced them (see alert.Alert.AlertID)
+	// so that the outputs include it in their notifications. This
+	// should come from the 'include_alert_id' field of the rule
+	// configuration file
+	IncludeAlertID bool
+
+	// ValueField is the path of a field of each bucket matched by
+	// the filters whose value is shown in place of its count (see
+	// alert.Field.Value), and ValueFormat the format of its numeric
+	// values. These should come from the 'value_field' and
+	// 'value_format' fields of the rule configuration file
+	ValueField  string
+	ValueFormat string
+
+	// ValueUnit is the unit of the numeric values of ValueField (see
+	// alert.FormatUnit) and ValueThreshold, if not nil, the value
+	// above which they are flagged (see alert.Field.Exceeds). These
+	// should come from the 'value_unit' and 'value_threshold' fields
+	// of the rule configuration file
+	ValueUnit      string
+	ValueThreshold *float64
+
+	// IndexPolicy, if not nil, restricts the indices which the query
+	// and the sub-queries may search. A search of any other index
+	// fails without being sent. This should come from the
+	// 'allowed_index_patterns' and 'denied_index_patterns' fields of
+	// the main configuration file
+	IndexPolicy *config.IndexPolicy
+
+	// CollapseIdentical is whether the rule counts how many times in
+	// a row it has produced the same records (see
+	// alert.Alert.FireCount) so that the outputs include the count in
+	// their notifications. This should come from the
+	// 'collapse_identical' field of the rule configuration file
+	CollapseIdentical bool
+
+	// ReminderInterval is how long after the last alert the alert
+	// is sent again, despite the cooldown, if the rule has produced
+	// records on every run since. This should come from the
+	// 'reminder_interval' field of the rule configuration file
+	ReminderInterval time.Duration
+
+	// MinSeverity, if not nil, drops the hits of the response whose
+	// severity is below a minimum before the response is processed.
+	// This should come from the 'min_severity' field of the rule
+	// configuration file
+	MinSeverity *config.SeverityFilter
+
+	// Redaction, if not nil, masks the sensitive values of the
+	// records of the alerts before they are sent. This should come
+	// from the 'redact' field of the rule configuration file
+	Redaction *config.Redaction
+
+	// DedupKeyField is the filter whose field keys each get their
+	// own alert cooldown instead of sharing that of the rule, so
+	// that alerts are only sent for newly-affected keys. This
+	// should come from the 'dedup_key_field' field of the rule
+	// configuration file
+	DedupKeyField string
+
+	// DisableDedup is whether every firing of the rule alerts, even
+	// if it is identical to the last one, by ignoring DedupKeyField
+	// (including that of each evaluation). The alert cooldown, if
+	// any, then applies to the rule as a whole. This should come
+	// from the 'disable_dedup' field of the rule configuration file
+	DisableDedup bool
+
+	// MinMatches is the number of documents which the records of an
+	// execution must match (see matchCount) for an alert to be sent.
+	// This should come from the 'min_matches' field of the rule
+	// configuration file
+	MinMatches int
+
+	// SlowQueryThreshold is the query duration above which a warning
+	// will be logged. This should come from the 'slow_query_threshold'
+	// field of the rule configuration file
+	SlowQueryThreshold time.Duration
+
+	// QueryTimeout is the maximum amount of time a query may take
+	// before it is canceled. This should come from the
+	// 'query_timeout' field of the rule configuration file. If
+	// zero, a default of 30 seconds will be used
+	QueryTimeout time.Duration
+
+	// Retry, if not nil, retries the requests of the query and of
+	// the sub-queries which fail because of a transient error, within
+	// the query timeout. This should come from the
+	// 'elasticsearch.retry' field of the main configuration file
+	Retry *Retry
+
+	// QueryDelay is how far back the time window of each query is
+	// shifted, i.e. the date math relative to "now" of its range
+	// queries is anchored at QueryDelay before the query runs. This
+	// should come from the 'query_delay' field of the rule
+	// configuration file
+	QueryDelay time.Duration
+
+	// MaxRuntime is how long a run of the query may take, counting
+	// from when it was due, before Run considers it stuck and
+	// restarts it (see watchdog.go). If zero, runs are not watched.
+	// This should come from the 'max_runtime' field of the rule
+	// configuration file
+	MaxRuntime time.Duration
+
+	// QueryParams are additional query-string parameters sent with
+	// each query. Only 'preference' and 'routing' are sent to the
+	// _count API since it does not support the others. This should
+	// come from the 'query_params' field of the rule configuration
+	// file
+	QueryParams map[string]string
+
+	// FirstRun is what to do with an alert produced by the first
+	// execution of the query after startup. This should come from
+	// the 'first_run' field of the rule configuration file. If
+	// empty, config.FirstRunAlert will be used
+	FirstRun string
+
+	// CountOnly is whether the query should use the _count API,
+	// which only returns the number of matching documents, rather
+	// than the _search API. It is ignored if Filters or BodyField
+	// are set since they require the response of the _search API,
+	// or if QueryData has 'runtime_mappings' since the _count API
+	// does not support them.
+	// This should come from the 'count_only' field of the rule
+	// configuration file
+	CountOnly bool
+
+	// Composite, if not nil, collects every page of buckets of a
+	// composite aggregation of the query rather than only the
+	// first. This should come from the 'composite' field of the
+	// rule configuration file
+	Composite *Composite
+
+	// SQL, if not nil, is an Elasticsearch SQL statement executed
+	// instead of QueryData, whose rows are grouped like the buckets
+	// of an aggregation (see sqlResponse). This should come from the
+	// 'sql' field of the rule configuration file
+	SQL *SQL
+
+	// Async, if not nil, submits the query to the _async_search API
+	// and polls its results until it completes. This should come
+	// from the 'async' and 'async_max_wait' fields of the rule
+	// configuration file
+	Async *Async
+
+	// SubQueries are additional queries executed after the main
+	// query each time the rule runs. These should come from the
+	// 'sub_queries' field of the rule configuration file
+	SubQueries []SubQuery
+
+	// MaintenanceWindows are the periods during which the query
+	// still runs but its alerts are not sent. Overlapping windows
+	// combine. These should come from the 'maintenance_windows'
+	// fields of the main and rule configuration files
+	MaintenanceWindows []*config.MaintenanceWindow
+
+	// SendQueueSize is the maximum number of alerts of the rule
+	// waiting to be handed to the alert handler, which lets the
+	// query keep running on schedule while the outputs are slow.
+	// SendQueuePolicy is what to do with a new alert when the queue
+	// is full. These should come from the 'send_queue' field of the
+	// rule configuration file. If zero or empty, a size of 10 and
+	// config.SendQueueDropOldest will be used
+	SendQueueSize   int
+	SendQueuePolicy string
+
+	// Batcher, if not nil, sends the query together with those of
+	// other rules due at the same time in a single request to the
+	// _msearch API. It is ignored if CountOnly or QueryParams are
+	// set since the _msearch API does not support them per query,
+	// or if Composite is set since each page depends on the last.
+	// Neither are SQL and Async queries, nor sub-queries
+	Batcher *Batcher
+
+	// StateRetention is how long the state documents of this rule
+	// are kept. If zero, they are never deleted. This should come
+	// from the 'state.retention' field of the main configuration
+	// file
+	StateRetention time.Duration
+
+	// StateCleanupInterval is how often expired state documents are
+	// deleted. This should come from the 'state.cleanup_interval'
+	// field of the main configuration file. If zero, a default of
+	// one hour will be used
+	StateCleanupInterval time.Duration
+
+	// StateILMPolicy is the name of the index lifecycle management
+	// policy set by PutTemplate() on the state indices. This should
+	// come from the 'state.ilm_policy' field of the main
+	// configuration file
+	StateILMPolicy string
+
+	// Clock is the source of the current time used to schedule the
+	// query. If nil, the system clock will be used
+	Clock clock.Clock
 }
 
 // QueryHandler performs the defined Elasticsearch query at the
@@ -107,19 +373,107 @@ type QueryHandler struct { // nolint: golint
 	// StopCh terminates the Run() method when closed
 	StopCh chan struct{}
 
+	// triggerCh receives the requests of Trigger for an on-demand
+	// execution, each of which is answered on its channel
+	triggerCh chan chan *RunResult
+
 	name         string
 	hostname     string
 	logger       hclog.Logger
 	alertMethods []alert.Method
+	requireAll   bool
+	concurrency  int
+	errorOutput  *alert.ErrorOutput
 	client       *http.Client
 	esURL        string
 	queryIndex   string
 	queryData    map[string]interface{}
 	schedule     cron.Schedule
+	scheduleSpec string
 	bodyField    string
 	filters      []string
+	valueField   string
+	valueFormat  string
+	valueUnit    string
+	threshold    *float64
 	conditions   []config.Condition
+	expression   *config.Expression
+	minSeverity  *config.SeverityFilter
+	values       map[string]string
+	userAgent    string
+	headers      map[string]string
+	sourceParam  bool
+	cooldown     time.Duration
+	reminder     time.Duration
+	lastAlert    time.Time
+	firingSince  time.Time
+	alertID      string
+	includeID    bool
+	collapse     bool
+	lastRun      time.Time
+	slowQuery    time.Duration
+	subQueries   []SubQuery
+	firstRun     string
+	countOnly    bool
+	composite    *Composite
+	sql          *SQL
+	async        *Async
+	queryTimeout time.Duration
+	retry        *Retry
+	queryDelay   time.Duration
+	maxRuntime   time.Duration
+	queryParams  map[string]string
+	batcher      *Batcher
+	maintenance  []*config.MaintenanceWindow
+	evaluations  []*QueryHandler
+	indexPolicy  *config.IndexPolicy
+	sendSize     int
+	sendPolicy   string
 	newRequest   func(ctx context.Context, method, url string, data io.Reader) (*http.Request, error)
+
+	stateRetention  time.Duration
+	cleanupInterval time.Duration
+	ilmPolicy       string
+	lastCleanup     time.Time
+	lastStateWrite  time.Time
+
+	// headVersion is the version of the head document of the rule
+	// last read or written, on which its next write is conditional
+	// (see writeHead), or nil if there is none
+	headVersion *docVersion
+
+	// previousValues are the values of the fields on which the
+	// delta conditions depend as of the last run
+	previousValues map[string]json.Number
+
+	// dedupField is the filter whose field keys each get their own
+	// cooldown, and dedupKeys the times at which they last alerted
+	dedupField string
+	dedupKeys  map[string]time.Time
+
+	// minMatches is the number of documents the records must match
+	// for an alert to be sent
+	minMatches int
+
+	// redaction, if not nil, masks the records of the alerts
+	redaction *config.Redaction
+
+	// fingerprint identifies the records of the last run, fireCount
+	// is the number of consecutive runs which produced them and
+	// firstFired is when the first of those runs ran
+	fingerprint string
+	fireCount   int
+	firstFired  time.Time
+
+	clock clock.Clock
+
+	// backtesting is whether the query is being run by Backtest, in
+	// which case the clock is fixed at the time of each backtested
+	// run and the time window of the query is anchored at it
+	backtesting bool
+
+	statusMu sync.Mutex
+	status   Status
 }
 
 // NewQueryHandler creates a new *QueryHandler instance.
@@ -155,27 +509,163 @@ func NewQueryHandler(config *QueryHandlerConfig) (*QueryHandler, error) {
 		config.Client = cleanhttp.DefaultClient()
 	}
 
+	if config.DisableDedup {
+		config.DedupKeyField = ""
+	}
+
+	if config.CountOnly && (len(config.Filters) > 0 || config.BodyField != "") {
+		config.Logger.Warn(fmt.Sprintf("[Rule: %q] using the _search API since 'filters' or 'body_field' are set", config.Name))
+		config.CountOnly = false
+	}
+
+	// The _count API only accepts a query, which may depend on
+	// runtime fields it would not know about
+	if _, ok := config.QueryData["runtime_mappings"]; ok && config.CountOnly {
+		config.Logger.Warn(fmt.Sprintf("[Rule: %q] using the _search API since 'runtime_mappings' is set", config.Name))
+		config.CountOnly = false
+	}
+
+	if config.Batcher != nil {
+		if config.CountOnly || len(config.QueryParams) > 0 || config.Composite != nil || config.SQL != nil ||
+			config.Async != nil {
+			config.Logger.Info(fmt.Sprintf(
+				"[Rule: %q] not batching queries since 'count_only', 'query_params', 'composite', 'sql' or 'async' are set",
+				config.Name,
+			))
+			config.Batcher = nil
+		} else {
+			config.Batcher.join()
+		}
+	}
+
+	if config.SQL != nil {
+		sql := *config.SQL
+		if sql.FetchSize == 0 {
+			sql.FetchSize = defaultSQLFetchSize
+		}
+		if sql.MaxRows == 0 {
+			sql.MaxRows = defaultMaxSQLRows
+		}
+		config.SQL = &sql
+		// The rows are grouped into fields by default
+		if len(config.Filters) == 0 && config.BodyField == "" {
+			config.Filters = []string{sqlBucketsFilter}
+		}
+	}
+
 	if config.BodyField == "" {
 		config.BodyField = defaultBodyField
 	}
 
-	return &QueryHandler{
-		StopCh: make(chan struct{}),
+	if config.Composite != nil && config.Composite.MaxBuckets == 0 {
+		composite := *config.Composite
+		composite.MaxBuckets = defaultMaxCompositeBuckets
+		config.Composite = &composite
+	}
+
+	if config.Async != nil && config.Async.MaxWait == 0 {
+		async := *config.Async
+		async.MaxWait = defaultAsyncMaxWait
+		config.Async = &async
+	}
+
+	if config.SendQueueSize == 0 {
+		config.SendQueueSize = defaultSendQueueSize
+	}
+
+	config.UserAgent = version.UserAgentWith(config.UserAgent)
+
+	if config.SlowQueryThreshold == 0 {
+		config.SlowQueryThreshold = defaultSlowQueryThreshold
+	}
+
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = defaultQueryTimeout
+	}
+
+	if config.StateCleanupInterval == 0 {
+		config.StateCleanupInterval = defaultCleanupInterval
+	}
+
+	if config.Clock == nil {
+		config.Clock = clock.Real()
+	}
+
+	q := &QueryHandler{
+		StopCh:    make(chan struct{}),
+		triggerCh: make(chan chan *RunResult),
 
 		name:         config.Name,
 		hostname:     hostname,
 		logger:       config.Logger,
 		alertMethods: config.AlertMethods,
+		requireAll:   config.RequireAllOutputs,
+		concurrency:  config.OutputConcurrency,
+		errorOutput:  config.ErrorOutput,
 		client:       config.Client,
 		esURL:        config.ESUrl,
 		queryIndex:   config.QueryIndex,
 		queryData:    config.QueryData,
 		schedule:     schedule,
+		scheduleSpec: config.Schedule,
 		bodyField:    config.BodyField,
 		filters:      config.Filters,
+		valueField:   config.ValueField,
+		valueFormat:  config.ValueFormat,
+		valueUnit:    config.ValueUnit,
+		threshold:    config.ValueThreshold,
 		conditions:   config.Conditions,
+		expression:   config.Expression,
+		minSeverity:  config.MinSeverity,
+		values:       config.Values,
+		userAgent:    config.UserAgent,
+		headers:      config.Headers,
+		sourceParam:  config.SourceParam,
+		cooldown:     config.AlertCooldown,
+		reminder:     config.ReminderInterval,
+		dedupField:   config.DedupKeyField,
+		minMatches:   config.MinMatches,
+		redaction:    config.Redaction,
+		includeID:    config.IncludeAlertID,
+		collapse:     config.CollapseIdentical,
+		slowQuery:    config.SlowQueryThreshold,
+		subQueries:   config.SubQueries,
+		firstRun:     config.FirstRun,
+		countOnly:    config.CountOnly,
+		composite:    config.Composite,
+		sql:          config.SQL,
+		async:        config.Async,
+		queryTimeout: config.QueryTimeout,
+		retry:        config.Retry,
+		queryDelay:   config.QueryDelay,
+		maxRuntime:   config.MaxRuntime,
+		queryParams:  config.QueryParams,
+		batcher:      config.Batcher,
+		maintenance:  config.MaintenanceWindows,
+		indexPolicy:  config.IndexPolicy,
+		sendSize:     config.SendQueueSize,
+		sendPolicy:   config.SendQueuePolicy,
 		newRequest:   reqFunc,
-	}, nil
+
+		stateRetention:  config.StateRetention,
+		cleanupInterval: config.StateCleanupInterval,
+		ilmPolicy:       config.StateILMPolicy,
+
+		clock: config.Clock,
+	}
+	if err = q.newEvaluations(config); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// clk returns the clock of the QueryHandler, or the system clock
+// if it has none.
+func (q *QueryHandler) clk() clock.Clock {
+	if q.clock == nil {
+		return clock.Real()
+	}
+	return q.clock
 }
 
 func validateConfig(config *QueryHandlerConfig) error {
@@ -190,15 +680,17 @@ func validateConfig(config *QueryHandlerConfig) error {
 		allErrors = multierror.Append(allErrors, xerrors.New("no Elasticsearch URL provided"))
 	}
 
-	if config.QueryIndex == "" {
+	// SQL queries name their index in their FROM clause and need
+	// no body
+	if config.QueryIndex == "" && config.SQL == nil {
 		allErrors = multierror.Append(allErrors, xerrors.New("no Elasticsearch index provided"))
 	}
 
-	if len(config.AlertMethods) < 1 {
+	if len(config.AlertMethods) < 1 && len(config.Evaluations) < 1 {
 		allErrors = multierror.Append(allErrors, xerrors.New("at least one alert method must be specified"))
 	}
 
-	if config.QueryData == nil || len(config.QueryData) < 1 {
+	if len(config.QueryData) < 1 && config.SQL == nil {
 		allErrors = multierror.Append(allErrors, xerrors.New("no query body provided"))
 	}
 	return allErrors.ErrorOrNil()
@@ -208,6 +700,10 @@ func validateConfig(config *QueryHandlerConfig) error {
 // https://www.elastic.co/guide/en/elasticsearch/reference/current/rest-api-compatibility.html
 const compatibilityHeader = "application/vnd.elasticsearch+json;compatible-with=7"
 
+// ruleHeader is the header used to identify which rule
+// sent a request to Elasticsearch.
+const ruleHeader = "X-Alert-Rule"
+
 func buildHTTPRequestFunc() (func(context.Context, string, string, io.Reader) (*http.Request, error), error) {
 	reqFunc := func(ctx context.Context, method, url string, data io.Reader) (*http.Request, error) {
 		req, err := http.NewRequest(method, url, data)
@@ -222,8 +718,14 @@ func buildHTTPRequestFunc() (func(context.Context, string, string, io.Reader) (*
 		return req, nil
 	}
 
-	username := os.Getenv(envESBasicAuthUsername)
-	password := os.Getenv(envESBasicAuthPassword)
+	username, err := utils.Getenv(envESBasicAuthUsername)
+	if err != nil {
+		return nil, err
+	}
+	password, err := utils.Getenv(envESBasicAuthPassword)
+	if err != nil {
+		return nil, err
+	}
 
 	if username != "" || password != "" {
 		if !(username != "" && password != "") {
@@ -258,21 +760,49 @@ func buildHTTPRequestFunc() (func(context.Context, string, string, io.Reader) (*
 // write a new state document to Elasticsearch in which the 'next_query'
 // equals the next time the query shall be executed per the provided
 // cron schedule. It will only execute the query if distLock.Acquired()
-// is true.
-func (q *QueryHandler) Run( // nolint: gocyclo, funlen, gocognit
+// is true. Alerts are queued and sent to outputCh in the background,
+// so the query keeps running on schedule while they are being sent.
+// If the QueryHandler has a maximum runtime, a run which takes any
+// longer is canceled and the QueryHandler is restarted (see
+// supervise).
+func (q *QueryHandler) Run(
 	ctx context.Context,
 	outputCh chan *alert.Alert,
 	wg *sync.WaitGroup,
 	distLock *lock.Lock,
+) {
+	defer wg.Done()
+	if q.maxRuntime <= 0 {
+		q.run(ctx, outputCh, distLock)
+		return
+	}
+	q.supervise(ctx, outputCh, distLock)
+}
+
+// run runs the QueryHandler as described by Run until ctx is done
+// or it is stopped.
+func (q *QueryHandler) run( // nolint: gocyclo, funlen, gocognit
+	ctx context.Context,
+	outputCh chan *alert.Alert,
+	distLock *lock.Lock,
 ) {
 	var (
-		now           = time.Now()
+		clk           = q.clk()
+		now           = clk.Now()
 		next          = now
 		maintainState = true
+		first         = true
+		sq            = newSendQueue(q.sendSize)
 	)
 
+	// Alerts are handed to the alert handler in the background so
+	// that slow outputs do not delay the next execution
+	sendCtx, stopSending := context.WithCancel(ctx)
+	go q.sendAlerts(sendCtx, sq, outputCh)
+
 	defer func() {
-		wg.Done()
+		stopSending()
+		<-sq.done
 	}()
 
 	t, err := q.getNextQuery(ctx)
@@ -294,6 +824,7 @@ func (q *QueryHandler) Run( // nolint: gocyclo, funlen, gocognit
 	if t != nil {
 		next = *t
 	}
+	q.updateStatus("", nil, next)
 
 	if distLock.Acquired() {
 		q.logger.Info(
@@ -305,55 +836,424 @@ func (q *QueryHandler) Run( // nolint: gocyclo, funlen, gocognit
 		)
 	}
 
+	due := clk.After(next.Sub(now))
 	for {
-		hits := []map[string]interface{}{}
+		var (
+			hits   = []map[string]interface{}{}
+			result string
+			runErr error
+			paused bool
+		)
 		select {
 		case <-ctx.Done():
 			return
 		case <-q.StopCh:
 			return
-		case <-time.After(next.Sub(now)):
-			if distLock.Acquired() {
-				data, err := q.query(ctx)
-				if err != nil {
-					q.logger.Error(fmt.Sprintf("[Rule: %q] error querying Elasticsearch", q.name), "error", err)
-					break
-				}
-
-				var records []*alert.Record
-				records, hits, err = q.process(data)
-				if err != nil {
-					q.logger.Error(fmt.Sprintf("[Rule: %q] error processing response", q.name), "error", err)
-					break
-				}
-
-				if len(records) > 0 {
-					id, err := uuid.GenerateUUID()
-					if err != nil {
-						q.logger.Error(fmt.Sprintf("[Rule: %q] error creating new random UUID", q.name), "error", err)
-						break
-					}
-
-					a := &alert.Alert{
-						ID:       id,
-						RuleName: q.name,
-						Records:  records,
-						Methods:  q.alertMethods,
-					}
-					outputCh <- a
-				}
+		case d := <-sq.deliveries:
+			q.recordDelivery(d)
+			continue
+		case <-due:
+			// A paused query keeps to its schedule without executing
+			// or updating its state document
+			paused = q.Paused()
+			if distLock.Acquired() && !paused {
+				isFirst := first
+				first = false
+
+				var res *RunResult
+				res, hits = q.cycle(ctx, sq, isFirst)
+				result, runErr = res.Result, res.Err
 			}
+		case reply := <-q.triggerCh:
+			reply <- q.trigger(ctx, sq, distLock, next, maintainState)
+			continue
 		}
-		now = time.Now()
+		if ctx.Err() != nil {
+			// The run was canceled, e.g. by the watchdog, while it
+			// was executing the query
+			return
+		}
+		now = clk.Now()
 		next = q.schedule.Next(now)
-		if maintainState {
+		if maintainState && !paused {
 			if err := q.setNextQuery(ctx, next, hits); err != nil {
 				q.logger.Error(fmt.Sprintf("[Rule: %q] error creating next query document in Elasticsearch", q.name), "error", err)
 				q.logger.Info(fmt.Sprintf("[Rule: %q] continuing without maintaining job state in Elasticsearch", q.name))
 				maintainState = false
+			} else if distLock.Acquired() && q.cleanupDue(now) {
+				if err := q.cleanupState(ctx, now); err != nil {
+					q.logger.Warn(fmt.Sprintf("[Rule: %q] error deleting expired state documents", q.name), "error", err)
+				}
+			}
+		}
+		q.updateStatus(result, runErr, next)
+		due = clk.After(next.Sub(now))
+	}
+}
+
+// cycle executes the query once and sends an alert if its records
+// warrant one. isFirst is whether this is the first scheduled
+// execution since the rule started, to which 'first_run' applies.
+// It returns the outcome along with the hits to persist in the
+// state document.
+func (q *QueryHandler) cycle(
+	ctx context.Context,
+	sq *sendQueue,
+	isFirst bool,
+) (*RunResult, []map[string]interface{}) {
+	if len(q.evaluations) > 0 {
+		return q.cycleEvaluations(ctx, sq, isFirst)
+	}
+
+	records, hits, err := q.execute(ctx)
+	if err != nil {
+		q.logger.Error(fmt.Sprintf("[Rule: %q] error executing query", q.name), "error", err)
+		q.errorOutput.Report(q.name, alert.ErrorSourceQuery, err)
+		return &RunResult{Result: ResultError, Err: err}, hits
+	}
+	return q.dispatch(ctx, sq, isFirst, records), hits
+}
+
+// dispatch sends an alert made of the records produced by an
+// execution of the query unless they are suppressed (see suppress)
+// and returns the outcome. Nothing is sent, nor any cooldown
+// started, once ctx is canceled.
+func (q *QueryHandler) dispatch(
+	ctx context.Context,
+	sq *sendQueue,
+	isFirst bool,
+	records []*alert.Record,
+) *RunResult {
+	clk := q.clk()
+	res := &RunResult{Result: ResultOK, Matched: len(records)}
+	if len(records) == 0 {
+		return res
+	}
+	if err := ctx.Err(); err != nil {
+		res.Result, res.Err = ResultError, err
+		return res
+	}
+
+	records, dedupKeys, suppressed := q.suppress(records, isFirst, clk.Now())
+	if suppressed {
+		res.Result = ResultSuppressed
+		return res
+	}
+
+	a, err := q.newAlert(records)
+	if err != nil {
+		q.logger.Error(fmt.Sprintf("[Rule: %q] error creating new random UUID", q.name), "error", err)
+		res.Result, res.Err = ResultError, err
+		return res
+	}
+	qa := &queuedAlert{
+		alert:         a,
+		sentAt:        clk.Now(),
+		previousAlert: q.lastAlert,
+		dedupKeys:     dedupKeys,
+		handler:       q,
+	}
+	if !q.enqueue(ctx, sq, qa) {
+		res.Result = ResultUndelivered
+		return res
+	}
+	res.Result = ResultAlert
+	q.lastAlert = qa.sentAt
+	q.markDedupKeys(dedupKeys, qa.sentAt)
+	return res
+}
+
+// suppress decides whether the records produced by an execution of
+// the query at now are suppressed by 'min_matches', a maintenance
+// window, 'first_run' (if isFirst), the dedup keys or the alert
+// cooldown, in that order. If they are not, it returns the records
+// to send, i.e. those with new dedup keys if the rule has a dedup
+// key field, along with those keys. Run, RunOnce and Backtest all
+// decide through it so that they suppress the same alerts.
+func (q *QueryHandler) suppress(
+	records []*alert.Record,
+	isFirst bool,
+	now time.Time,
+) ([]*alert.Record, []string, bool) {
+	if q.belowMinMatches(records) || q.inMaintenance(records, now) || (isFirst && q.warmup(records)) {
+		return nil, nil, true
+	}
+
+	if q.dedupField != "" {
+		records, dedupKeys := q.dedup(records, now)
+		return records, dedupKeys, len(records) == 0
+	}
+
+	if !q.inCooldown(now) {
+		return records, nil, false
+	}
+	if !q.reminderDue(now) {
+		q.logger.Info(
+			fmt.Sprintf(
+				"[Rule: %q] suppressing alert (cooldown ends at: %s)",
+				q.name,
+				q.lastAlert.Add(q.cooldown).Format(time.RFC822),
+			),
+		)
+		return nil, nil, true
+	}
+	q.logger.Info(
+		fmt.Sprintf(
+			"[Rule: %q] sending reminder (firing since: %s)",
+			q.name,
+			q.firingSince.Format(time.RFC822),
+		),
+		"alert_id", q.alertID,
+	)
+	return records, nil, false
+}
+
+// execute runs the query and processes the response into records.
+// The sub-queries are only run if the response matched the rule.
+func (q *QueryHandler) execute(ctx context.Context) ([]*alert.Record, []map[string]interface{}, error) {
+	runAt := q.clk().Now()
+	data, err := q.timedQuery(ctx)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("error querying Elasticsearch: %v", err)
+	}
+
+	data, ok := q.match(data)
+	if !ok {
+		q.observe(nil, runAt)
+		return nil, nil, nil
+	}
+
+	records, hits, err := q.convert(data)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("error processing response: %v", err)
+	}
+	records = append(records, q.runSubQueries(ctx)...)
+	q.observe(records, runAt)
+	return records, hits, nil
+}
+
+// observe records that the query ran successfully at runAt and
+// produced the records.
+func (q *QueryHandler) observe(records []*alert.Record, runAt time.Time) {
+	q.lastRun = runAt
+	q.updateFiring(records, runAt)
+	if q.collapse {
+		q.updateFireCount(records, runAt)
+	}
+}
+
+// updateFiring records when the rule started firing, i.e. when
+// the first of the consecutive runs which produced records ran,
+// and the ID of the firing.
+func (q *QueryHandler) updateFiring(records []*alert.Record, runAt time.Time) {
+	switch {
+	case len(records) < 1:
+		q.setFiringSince(time.Time{})
+	case q.firingSince.IsZero():
+		q.setFiringSince(runAt)
+	}
+}
+
+// setFiringSince sets when the rule started firing and derives
+// the ID of the firing from it.
+func (q *QueryHandler) setFiringSince(t time.Time) {
+	q.firingSince = t
+	q.alertID = ""
+	if !t.IsZero() {
+		q.alertID = firingID(q.cleanedName(), t)
+	}
+}
+
+// firingID returns the ID of the firing of the given rule which
+// started at the given time. It is derived from the time as stored
+// in the state documents so that it is the same after a restart.
+func firingID(rule string, since time.Time) string {
+	sum := sha256.Sum256([]byte(rule + "|" + since.UTC().Format(defaultTimestampFormat)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newAlert creates a new alert from the records which will be
+// sent with the outputs of this rule.
+func (q *QueryHandler) newAlert(records []*alert.Record) (*alert.Alert, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	a := &alert.Alert{
+		ID:          id,
+		RuleName:    q.name,
+		Records:     q.redact(records),
+		Methods:     q.alertMethods,
+		Query:       q.queryData,
+		Concurrency: q.concurrency,
+
+		RequireAllOutputs: q.requireAll,
+		Result:            make(chan error, 1),
+	}
+	if q.countOnly {
+		a.Query = countBody(q.queryData)
+	}
+	if q.sql != nil {
+		a.Query = sqlBody(q.sql)
+	}
+	if q.includeID {
+		a.AlertID = q.alertID
+	}
+	if q.collapse {
+		a.FireCount = q.fireCount
+		a.FirstFired = q.firstFired
+	}
+	return a, nil
+}
+
+// delivered waits for the outcome of sending the alert, which has
+// been sent to the alert handler, and returns whether it was
+// delivered: to every output if the alert requires all of them to
+// succeed, or to at least one of them otherwise. Alerts without a
+// Result are considered delivered.
+func (q *QueryHandler) delivered(ctx context.Context, a *alert.Alert) bool {
+	if a.Result == nil {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case err := <-a.Result:
+		switch {
+		case err == nil:
+			return true
+		case a.RequireAllOutputs:
+			q.logger.Error(fmt.Sprintf("[Rule: %q] failed to deliver alert to every output", q.name), "error", err)
+		default:
+			q.logger.Error(fmt.Sprintf("[Rule: %q] failed to deliver alert to any output", q.name), "error", err)
+		}
+		return false
+	}
+}
+
+// belowMinMatches returns true, after logging that the alert made of
+// the records is suppressed, if they match fewer documents than the
+// minimum of the rule.
+func (q *QueryHandler) belowMinMatches(records []*alert.Record) bool {
+	if q.minMatches < 1 {
+		return false
+	}
+	matches := matchCount(records)
+	if matches >= q.minMatches {
+		return false
+	}
+	q.logger.Info(fmt.Sprintf("[Rule: %q] suppressing alert (matches below 'min_matches')", q.name),
+		"matches", matches, "min_matches", q.minMatches, "filters", recordFilters(records))
+	return true
+}
+
+// matchCount returns the number of documents matched by the
+// records, i.e. the largest number of documents of any of them: the
+// sum of the counts of the fields of a record grouped by a filter,
+// or the number of hits of the record of the body field. Since each
+// record groups the same matching documents differently, their
+// numbers are not added up.
+func matchCount(records []*alert.Record) int {
+	var matches int
+	for _, record := range records {
+		var n int
+		switch {
+		case len(record.Fields) > 0:
+			for _, field := range record.Fields {
+				n += field.Count
 			}
+		case len(record.Documents) > 0:
+			n = len(record.Documents)
+		case record.BodyField && record.Text != "":
+			// The hits of the body field are strings
+			n = strings.Count(record.Text, hitsDelimiter) + 1
+		}
+		if n > matches {
+			matches = n
 		}
 	}
+	return matches
+}
+
+// warmup handles the records produced by the first execution of
+// the query according to q.firstRun. It returns true if the alert
+// should not be sent.
+func (q *QueryHandler) warmup(records []*alert.Record) bool {
+	switch q.firstRun {
+	case config.FirstRunSuppress:
+		q.logger.Debug(fmt.Sprintf("[Rule: %q] suppressing alert from first run", q.name))
+		return true
+	case config.FirstRunLog:
+		q.logger.Info(fmt.Sprintf("[Rule: %q] not sending alert from first run", q.name),
+			"records", len(records), "filters", recordFilters(records))
+		return true
+	default:
+		return false
+	}
+}
+
+// inMaintenance returns true, after logging that the alert made of
+// the records is suppressed, if now is within any of the maintenance
+// windows of the rule.
+func (q *QueryHandler) inMaintenance(records []*alert.Record, now time.Time) bool {
+	var (
+		names []string
+		log   bool
+	)
+	for i, w := range q.maintenance {
+		if !w.Contains(now) {
+			continue
+		}
+		name := w.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		names = append(names, name)
+		log = log || w.LogSuppressed
+	}
+	if len(names) == 0 {
+		return false
+	}
+
+	msg := fmt.Sprintf("[Rule: %q] suppressing alert during maintenance window", q.name)
+	if log {
+		q.logger.Info(msg, "windows", strings.Join(names, ", "),
+			"records", len(records), "filters", recordFilters(records))
+	} else {
+		q.logger.Debug(msg, "windows", strings.Join(names, ", "))
+	}
+	return true
+}
+
+// recordFilters joins the filters of the records for use in logs.
+func recordFilters(records []*alert.Record) string {
+	filters := make([]string, 0, len(records))
+	for _, record := range records {
+		filters = append(filters, record.Filter)
+	}
+	return strings.Join(filters, ", ")
+}
+
+// reminderDue returns true if the rule has been firing since
+// before its last alert and that alert was sent at least
+// q.reminder ago.
+func (q *QueryHandler) reminderDue(now time.Time) bool {
+	if q.reminder <= 0 || q.firingSince.IsZero() || q.lastAlert.IsZero() {
+		return false
+	}
+	if q.lastAlert.Before(q.firingSince) {
+		return false
+	}
+	return !now.Before(q.lastAlert.Add(q.reminder))
+}
+
+// inCooldown returns true if an alert was sent by this rule
+// less than q.cooldown ago.
+func (q *QueryHandler) inCooldown(now time.Time) bool {
+	if q.cooldown <= 0 || q.lastAlert.IsZero() {
+		return false
+	}
+	return now.Before(q.lastAlert.Add(q.cooldown))
 }
 
 // PutTemplate attempts to create a template in Elasticsearch which
@@ -374,7 +1274,7 @@ func (q *QueryHandler) PutTemplate(ctx context.Context) error { // nolint: funle
         "number_of_shards": 1,
         "number_of_replicas": 1,
         "auto_expand_replicas": "0-2",
-        "codec": "best_compression",
+        "codec": "best_compression",%s
         "translog": {
           "flush_threshold_size": "752mb"
         },
@@ -413,6 +1313,24 @@ func (q *QueryHandler) PutTemplate(ctx context.Context) error { // nolint: funle
         "next_query": {
           "type": "date"
         },
+        "last_alert": {
+          "type": "date"
+        },
+        "last_run": {
+          "type": "date"
+        },
+        "firing_since": {
+          "type": "date"
+        },
+        "fingerprint": {
+          "type": "keyword"
+        },
+        "fire_count": {
+          "type": "long"
+        },
+        "first_fired": {
+          "type": "date"
+        },
         "hostname": {
           "type": "keyword"
         },
@@ -420,12 +1338,18 @@ func (q *QueryHandler) PutTemplate(ctx context.Context) error { // nolint: funle
           "type": "long",
           "null_value": 0
         },
+        "previous_values": {
+          "enabled": false
+        },
+        "dedup_keys": {
+          "enabled": false
+        },
         "hits": {
           "enabled": false
         }
       }
     }
-  }`, defaultStateIndexAlias, templateVersion, q.TemplateName())
+  }`, defaultStateIndexAlias, templateVersion, q.TemplateName(), q.lifecycleSettings())
 
 	resp, err := q.makeRequest(
 		ctx,
@@ -462,11 +1386,78 @@ func (q *QueryHandler) PutTemplate(ctx context.Context) error { // nolint: funle
 	return nil
 }
 
-// getNextQuery queries the state indices for the most recently-
-// created document belonging to this rule. It then attempts to
-// parse the 'next_query' field in order to inform the Run() loop
-// when to next execute the query.
-func (q *QueryHandler) getNextQuery(ctx context.Context) (*time.Time, error) { // nolint: funlen
+// State is the state of a rule persisted in the state indices.
+type State struct {
+	// NextQuery is when the query is next scheduled to run
+	NextQuery time.Time
+
+	// LastRun is when the query last ran successfully. It is
+	// zero if unknown
+	LastRun time.Time
+
+	// LastAlert is when the rule last sent an alert. It is zero
+	// if unknown
+	LastAlert time.Time
+
+	// FiringSince is when the rule started producing records on
+	// every run. It is zero if the rule is not firing or if unknown
+	FiringSince time.Time
+
+	// PreviousValues are the values of the fields on which the
+	// delta conditions of the rule depend as of the last run
+	PreviousValues map[string]json.Number
+
+	// DedupKeys are the times at which the keys of the dedup key
+	// field of the rule last alerted, for the keys in cooldown
+	DedupKeys map[string]time.Time
+
+	// Fingerprint identifies the records of the last run if the
+	// rule collapses identical firings, FireCount is the number of
+	// consecutive runs which produced them and FirstFired is when
+	// the first of those runs ran. FireCount is zero if unknown
+	Fingerprint string
+	FireCount   int
+	FirstFired  time.Time
+}
+
+// getNextQuery looks up the state of this rule in order to inform
+// the Run() loop when to next execute the query. The 'last_alert',
+// 'last_run', 'firing_since' and 'previous_values' fields of the
+// state, if any, are used to restore the alert cooldown, the time of
+// the last run, when the rule started firing and the values compared
+// by the delta conditions, as are the keys of the dedup key field
+// in cooldown and the count of identical firings.
+func (q *QueryHandler) getNextQuery(ctx context.Context) (*time.Time, error) {
+	state, err := q.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q.lastAlert = state.LastAlert
+	q.lastRun = state.LastRun
+	q.setFiringSince(state.FiringSince)
+	q.previousValues = state.PreviousValues
+	q.dedupKeys = state.DedupKeys
+	q.fingerprint, q.fireCount, q.firstFired = state.Fingerprint, state.FireCount, state.FirstFired
+	if err := q.readHead(ctx); err != nil {
+		q.logger.Warn(fmt.Sprintf("[Rule: %q] error reading head document from Elasticsearch", q.name), "error", err)
+	}
+
+	// The evaluations have no state of their own until they first
+	// run, e.g. if they were just added to the rule
+	for _, eq := range q.evaluations {
+		if _, err := eq.getNextQuery(ctx); err != nil {
+			q.logger.Debug(fmt.Sprintf("[Rule: %q] no state found for evaluation", eq.name), "error", err)
+		}
+	}
+	return &state.NextQuery, nil
+}
+
+// State queries the state indices for the most recently-created
+// document belonging to this rule and parses it. An error is
+// returned if the document or its 'next_query' field cannot be
+// found or parsed. Invalid 'last_run', 'last_alert', 'firing_since'
+// and 'previous_values' fields are ignored.
+func (q *QueryHandler) State(ctx context.Context) (*State, error) { // nolint: funlen
 	payload := fmt.Sprintf(`{
     "query": {
       "bool": {
@@ -496,7 +1487,17 @@ func (q *QueryHandler) getNextQuery(ctx context.Context) (*time.Time, error) { /
 		return nil, xerrors.Errorf("error parsing URL: %v", err)
 	}
 	query := u.Query()
-	query.Add("filter_path", "hits.hits._source.next_query")
+	query.Add("filter_path", strings.Join([]string{
+		"hits.hits._source.next_query",
+		"hits.hits._source.last_alert",
+		"hits.hits._source.last_run",
+		"hits.hits._source.firing_since",
+		"hits.hits._source.previous_values",
+		"hits.hits._source.dedup_keys",
+		"hits.hits._source.fingerprint",
+		"hits.hits._source.fire_count",
+		"hits.hits._source.first_fired",
+	}, ","))
 	u.RawQuery = query.Encode()
 
 	resp, err := q.makeRequest(ctx, http.MethodGet, u.String(), bytes.NewBufferString(payload))
@@ -532,28 +1533,119 @@ func (q *QueryHandler) getNextQuery(ctx context.Context) (*time.Time, error) { /
 	if err != nil {
 		return nil, xerrors.Errorf("error parsing time: %v", err)
 	}
-	return &t, nil
+
+	state := &State{
+		NextQuery: t,
+		LastRun:   parseStateTime(data, "last_run"),
+		LastAlert: parseStateTime(data, "last_alert"),
+
+		FiringSince:    parseStateTime(data, "firing_since"),
+		PreviousValues: parseStateValues(data),
+		DedupKeys:      parseStateDedupKeys(data),
+	}
+	state.Fingerprint, state.FireCount, state.FirstFired = parseStateFireCount(data)
+	return state, nil
+}
+
+// parseStateValues returns the 'previous_values' field of a state
+// document, omitting any values which are not numbers.
+func parseStateValues(data map[string]interface{}) map[string]json.Number {
+	raw, ok := utils.Get(data, "hits.hits[0]._source.previous_values").(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	values := make(map[string]json.Number, len(raw))
+	for field, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			values[field] = json.Number(s)
+		}
+	}
+	return values
+}
+
+// parseStateTime returns the time of the given field of a state
+// document, or the zero time if it is missing or invalid.
+func parseStateTime(data map[string]interface{}, field string) time.Time {
+	raw, ok := utils.Get(data, "hits.hits[0]._source."+field).(string)
+	if !ok {
+		return time.Time{}
+	}
+	t, err := time.Parse(defaultTimestampFormat, raw)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
 }
 
 // setNextQuery creates a new document in a state index to
 // inform the Run() loop when to next execute the query if
-// the process gets restarted.
+// the process gets restarted. The state documents are only ever
+// appended, and the latest one is read back, so the cooldowns of the
+// rule are first written to its head document (see writeHead),
+// merging in those of any other process running the rule at the
+// same time, e.g. while the leadership changes hands. An error
+// writing the head document is only logged since the state document
+// records the cooldowns too.
 func (q *QueryHandler) setNextQuery(ctx context.Context, ts time.Time, hits []map[string]interface{}) error {
+	if err := q.writeHead(ctx); err != nil {
+		q.logger.Warn(fmt.Sprintf("[Rule: %q] error writing head document to Elasticsearch", q.name), "error", err)
+	}
+
+	now := q.clk().Now()
 	status := struct {
 		Time  string                   `json:"@timestamp"`
 		Name  string                   `json:"rule_name"`
 		Next  string                   `json:"next_query"`
+		Last  string                   `json:"last_alert,omitempty"`
+		Run   string                   `json:"last_run,omitempty"`
+		Since string                   `json:"firing_since,omitempty"`
+		ID    string                   `json:"alert_id,omitempty"`
+		Prev  map[string]string        `json:"previous_values,omitempty"`
+		Dedup []dedupKey               `json:"dedup_keys,omitempty"`
+		Print string                   `json:"fingerprint,omitempty"`
+		Fired int                      `json:"fire_count,omitempty"`
+		First string                   `json:"first_fired,omitempty"`
 		Host  string                   `json:"hostname"`
 		NHits int                      `json:"hits_count"`
 		Hits  []map[string]interface{} `json:"hits,omitempty"`
 	}{
-		Time:  time.Now().Format(defaultTimestampFormat),
+		Time:  now.Format(defaultTimestampFormat),
 		Name:  q.cleanedName(),
 		Next:  ts.Format(defaultTimestampFormat),
 		Host:  q.hostname,
 		NHits: len(hits),
 		Hits:  hits,
 	}
+	if !q.lastAlert.IsZero() {
+		status.Last = q.lastAlert.Format(defaultTimestampFormat)
+	}
+	if !q.lastRun.IsZero() {
+		status.Run = q.lastRun.Format(defaultTimestampFormat)
+	}
+	if !q.firingSince.IsZero() {
+		status.Since = q.firingSince.Format(defaultTimestampFormat)
+		status.ID = q.alertID
+	}
+	if len(q.previousValues) > 0 {
+		// Values are stored as strings to preserve their precision
+		status.Prev = make(map[string]string, len(q.previousValues))
+		for field, v := range q.previousValues {
+			status.Prev[field] = v.String()
+		}
+	}
+
+	if len(q.dedupKeys) > 0 {
+		status.Dedup = q.stateDedupKeys()
+	}
+	if q.fireCount > 0 {
+		status.Print = q.fingerprint
+		status.Fired = q.fireCount
+		status.First = q.firstFired.Format(defaultTimestampFormat)
+	}
 
 	payload := bytes.Buffer{}
 	if err := json.NewEncoder(&payload).Encode(&status); err != nil {
@@ -570,16 +1662,97 @@ func (q *QueryHandler) setNextQuery(ctx context.Context, ts time.Time, hits []ma
 		return xerrors.Errorf("failed to create new document (received status: %q). Response body:\n%s",
 			resp.Status, q.readErrRespBody(resp))
 	}
+	q.lastStateWrite = now
+
+	for _, eq := range q.evaluations {
+		if err := eq.setNextQuery(ctx, ts, nil); err != nil {
+			return xerrors.Errorf("error persisting state of evaluation %s: %v", eq.name, err)
+		}
+	}
 	return nil
 }
 
+// timedQuery executes the query and logs how long the request
+// took, warning if it took longer than q.slowQuery. If ctx was
+// canceled meanwhile, e.g. by the watchdog, an error is returned
+// even if the query succeeded, so that a run which was abandoned
+// while blocked in the query does not process its response.
+func (q *QueryHandler) timedQuery(ctx context.Context) (map[string]interface{}, error) {
+	start := q.clk().Now()
+	data, err := q.query(ctx)
+	elapsed := q.clk().Now().Sub(start)
+	if err == nil && ctx.Err() != nil {
+		data, err = nil, ctx.Err()
+	}
+
+	if q.slowQuery > 0 && elapsed > q.slowQuery {
+		q.logger.Warn(fmt.Sprintf("[Rule: %q] slow Elasticsearch query", q.name),
+			"duration", elapsed.String(), "threshold", q.slowQuery.String())
+	} else {
+		q.logger.Debug(fmt.Sprintf("[Rule: %q] Elasticsearch query completed", q.name),
+			"duration", elapsed.String())
+	}
+	return data, err
+}
+
 func (q *QueryHandler) query(ctx context.Context) (map[string]interface{}, error) {
+	if q.sql != nil {
+		return q.querySQL(ctx)
+	}
+	if q.countOnly {
+		return q.search(ctx, q.queryIndex, "_count", countBody(q.queryData))
+	}
+	if q.composite != nil {
+		return q.queryComposite(ctx)
+	}
+	if q.async != nil {
+		return q.queryAsync(ctx)
+	}
+	if q.batcher != nil {
+		if err := q.indexPolicy.Check(q.queryIndex); err != nil {
+			return nil, xerrors.Errorf("refusing to query index: %v", err)
+		}
+		return q.batcher.search(ctx, q, q.queryIndex, q.windowBody(q.queryData))
+	}
+	return q.search(ctx, q.queryIndex, "_search", q.queryData)
+}
+
+// countBody returns the subset of a search body accepted by the
+// _count API, which only supports the 'query' field.
+func countBody(body map[string]interface{}) map[string]interface{} {
+	count := make(map[string]interface{})
+	if query, ok := body["query"]; ok {
+		count["query"] = query
+	}
+	return count
+}
+
+func (q *QueryHandler) search(ctx context.Context, index, api string, body map[string]interface{}) (map[string]interface{}, error) {
+	if err := q.indexPolicy.Check(index); err != nil {
+		return nil, xerrors.Errorf("refusing to query index: %v", err)
+	}
+	if q.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.queryTimeout)
+		defer cancel()
+	}
+
+	body = q.windowBody(body)
 	payload := bytes.Buffer{}
-	if err := json.NewEncoder(&payload).Encode(&q.queryData); err != nil {
+	if err := json.NewEncoder(&payload).Encode(&body); err != nil {
 		return nil, xerrors.Errorf("error JSON-encoding Elasticsearch query body: %v", err)
 	}
 
-	resp, err := q.makeRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s/_search", q.esURL, q.queryIndex), &payload)
+	u := fmt.Sprintf("%s/%s/%s", q.esURL, escapeIndex(index), api)
+	params := q.searchParams(api)
+	resp, err := q.doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := q.searchRequest(ctx, u, params, payload.Bytes())
+		if err != nil {
+			return nil, xerrors.Errorf("error creating new request: %v", err)
+		}
+		req.Header.Set(ruleHeader, q.name)
+		return req, nil
+	})
 	if err != nil {
 		return nil, xerrors.Errorf("error making HTTP request: %v", err)
 	}
@@ -600,6 +1773,99 @@ func (q *QueryHandler) query(ctx context.Context) (map[string]interface{}, error
 	return data, nil
 }
 
+// searchRequest creates the request of a query with the given body
+// to the URL. If q.sourceParam is true, the body is sent in the
+// 'source' parameter of a GET request so that proxies can cache the
+// response, unless the URL would be longer than maxSourceURILength,
+// in which case it is sent in the body of a POST request, which
+// proxies do not cache. Otherwise, it is sent in the body of a GET
+// request.
+func (q *QueryHandler) searchRequest(
+	ctx context.Context,
+	u string,
+	params url.Values,
+	body []byte,
+) (*http.Request, error) {
+	method := http.MethodGet
+	if q.sourceParam {
+		source := make(url.Values, len(params)+2)
+		for key, values := range params {
+			source[key] = values
+		}
+		source.Set("source", string(bytes.TrimSpace(body)))
+		source.Set("source_content_type", "application/json")
+		su := u + "?" + source.Encode()
+		if len(su)-len(q.esURL) <= maxSourceURILength {
+			return q.newRequest(ctx, http.MethodGet, su, nil)
+		}
+		q.logger.Debug(fmt.Sprintf(
+			"[Rule: %q] query is too long for the 'source' parameter, sending it as a POST request",
+			q.name,
+		))
+		method = http.MethodPost
+	}
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	return q.newRequest(ctx, method, u, bytes.NewReader(body))
+}
+
+// searchParams returns the query-string parameters of a request to
+// the given API.
+func (q *QueryHandler) searchParams(api string) url.Values {
+	params := make(url.Values, len(q.queryParams))
+	for key, value := range q.queryParams {
+		if api == "_count" && key != "preference" && key != "routing" {
+			continue
+		}
+		params.Set(key, value)
+	}
+	return params
+}
+
+// escapeIndex percent-encodes each index of a comma-separated list
+// of indices so that date math expressions (e.g. '<logs-{now/d}>')
+// reach Elasticsearch intact. Wildcards are left as-is, and indices
+// which are already percent-encoded are not encoded twice.
+func escapeIndex(index string) string {
+	indices := strings.Split(index, ",")
+	for i, idx := range indices {
+		if unescaped, err := url.PathUnescape(idx); err == nil {
+			idx = unescaped
+		}
+		indices[i] = strings.Replace(url.PathEscape(idx), "%2A", "*", -1)
+	}
+	return strings.Join(indices, ",")
+}
+
+// Name returns the name of the rule.
+func (q *QueryHandler) Name() string {
+	return q.name
+}
+
+// Schedule returns the cron schedule of the rule as configured.
+func (q *QueryHandler) Schedule() string {
+	return q.scheduleSpec
+}
+
+// Index returns the index queried by the rule.
+func (q *QueryHandler) Index() string {
+	return q.queryIndex
+}
+
+// Outputs returns the outputs with which the alerts of the rule
+// are sent.
+func (q *QueryHandler) Outputs() []alert.Method {
+	if len(q.evaluations) > 0 {
+		var methods []alert.Method
+		for _, eq := range q.evaluations {
+			methods = append(methods, eq.alertMethods...)
+		}
+		return methods
+	}
+	return q.alertMethods
+}
+
 func (q *QueryHandler) cleanedName() string {
 	return strings.Replace(strings.ToLower(q.name), " ", "-", -1)
 }
@@ -609,6 +1875,18 @@ func (q *QueryHandler) makeRequest(ctx context.Context, method, url string, data
 	if err != nil {
 		return nil, xerrors.Errorf("error creating new request: %v", err)
 	}
+	return q.do(req)
+}
+
+// do sets the identifying headers on the request and sends it
+// to Elasticsearch.
+func (q *QueryHandler) do(req *http.Request) (*http.Response, error) {
+	for k, v := range q.headers {
+		req.Header.Set(k, v)
+	}
+	if q.userAgent != "" {
+		req.Header.Set("User-Agent", q.userAgent)
+	}
 	return q.client.Do(req)
 }
 
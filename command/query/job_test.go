@@ -18,12 +18,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,7 +36,10 @@ import (
 	uuid "github.com/hashicorp/go-uuid"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
 	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
 	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
 )
 
 const (
@@ -447,6 +454,331 @@ func TestGetNextQuery(t *testing.T) {
 	}
 }
 
+func TestInCooldown(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name      string
+		cooldown  time.Duration
+		lastAlert time.Time
+		expected  bool
+	}{
+		{"no-cooldown", 0, now.Add(-1 * time.Minute), false},
+		{"never-alerted", 30 * time.Minute, time.Time{}, false},
+		{"within-cooldown", 30 * time.Minute, now.Add(-10 * time.Minute), true},
+		{"cooldown-elapsed", 30 * time.Minute, now.Add(-40 * time.Minute), false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				cooldown:  tc.cooldown,
+				lastAlert: tc.lastAlert,
+			}
+			if got := qh.inCooldown(now); got != tc.expected {
+				t.Fatalf("unexpected result (got %t, expected %t)", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestReminderDue(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name        string
+		reminder    time.Duration
+		firingSince time.Time
+		lastAlert   time.Time
+		expected    bool
+	}{
+		{"no-reminder", 0, now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), false},
+		{"not-firing", time.Hour, time.Time{}, now.Add(-2 * time.Hour), false},
+		{"never-alerted", time.Hour, now.Add(-3 * time.Hour), time.Time{}, false},
+		{"alerted-before-firing", time.Hour, now.Add(-30 * time.Minute), now.Add(-2 * time.Hour), false},
+		{"not-yet-due", time.Hour, now.Add(-3 * time.Hour), now.Add(-30 * time.Minute), false},
+		{"due", time.Hour, now.Add(-3 * time.Hour), now.Add(-time.Hour), true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				reminder:    tc.reminder,
+				firingSince: tc.firingSince,
+				lastAlert:   tc.lastAlert,
+			}
+			if got := qh.reminderDue(now); got != tc.expected {
+				t.Fatalf("unexpected result (got %t, expected %t)", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestUpdateFiring(t *testing.T) {
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	records := []*alert.Record{{Filter: "hits.hits._source", Text: "test"}}
+	qh := &QueryHandler{}
+
+	qh.updateFiring(records, start)
+	qh.updateFiring(records, start.Add(time.Minute))
+	if !qh.firingSince.Equal(start) {
+		t.Fatalf("unexpected firing time (got %s, expected %s)", qh.firingSince, start)
+	}
+
+	qh.updateFiring(nil, start.Add(2*time.Minute))
+	if !qh.firingSince.IsZero() {
+		t.Fatalf("expected the rule to stop firing, got %s", qh.firingSince)
+	}
+
+	qh.updateFiring(records, start.Add(3*time.Minute))
+	if !qh.firingSince.Equal(start.Add(3 * time.Minute)) {
+		t.Fatalf("unexpected firing time (got %s, expected %s)", qh.firingSince, start.Add(3*time.Minute))
+	}
+}
+
+func TestAlertID(t *testing.T) {
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	records := []*alert.Record{{Filter: "hits.hits._source", Text: "test"}}
+	qh := &QueryHandler{name: "Test Rule", includeID: true}
+
+	qh.updateFiring(records, start)
+	first := qh.alertID
+	if first == "" {
+		t.Fatal("expected an alert ID to be set")
+	}
+	qh.updateFiring(records, start.Add(time.Minute))
+	if qh.alertID != first {
+		t.Fatalf("alert ID changed while firing (got %q, expected %q)", qh.alertID, first)
+	}
+
+	a, err := qh.newAlert(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.AlertID != first {
+		t.Fatalf("unexpected alert ID (got %q, expected %q)", a.AlertID, first)
+	}
+
+	// The same ID is derived when the firing time is restored
+	// from the state documents after a restart
+	restored := &QueryHandler{name: "Test Rule"}
+	restored.setFiringSince(start.In(time.FixedZone("EST", -5*60*60)))
+	if restored.alertID != first {
+		t.Fatalf("unexpected alert ID after restart (got %q, expected %q)", restored.alertID, first)
+	}
+	if a, err = restored.newAlert(records); err != nil {
+		t.Fatal(err)
+	}
+	if a.AlertID != "" {
+		t.Fatalf("expected no alert ID when 'include_alert_id' is false, got %q", a.AlertID)
+	}
+
+	qh.updateFiring(nil, start.Add(2*time.Minute))
+	if qh.alertID != "" {
+		t.Fatalf("expected the alert ID to be cleared, got %q", qh.alertID)
+	}
+	qh.updateFiring(records, start.Add(3*time.Minute))
+	if qh.alertID == "" || qh.alertID == first {
+		t.Fatalf("expected a new alert ID, got %q", qh.alertID)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	records := []*alert.Record{
+		{Filter: "aggregations.hostname.buckets"},
+		{Filter: "hits.hits._source"},
+	}
+
+	cases := []struct {
+		name     string
+		firstRun string
+		expected bool
+		log      string
+	}{
+		{"default", "", false, ""},
+		{"alert", config.FirstRunAlert, false, ""},
+		{"suppress", config.FirstRunSuppress, true, ""},
+		{
+			"log",
+			config.FirstRunLog,
+			true,
+			`not sending alert from first run: records=2 filters="aggregations.hostname.buckets, hits.hits._source"`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			qh := &QueryHandler{
+				name:     "Test Warmup",
+				firstRun: tc.firstRun,
+				logger:   hclog.New(&hclog.LoggerOptions{Output: buf}),
+			}
+			if got := qh.warmup(records); got != tc.expected {
+				t.Fatalf("unexpected result (got %t, expected %t)", got, tc.expected)
+			}
+			if !strings.Contains(buf.String(), tc.log) {
+				t.Fatalf("expected log to contain %q, got:\n%s", tc.log, buf.String())
+			}
+		})
+	}
+}
+
+func TestGetNextQueryRestoresLastAlert(t *testing.T) {
+	last := time.Now().Add(-5 * time.Minute).Format(time.RFC3339)
+	ts := newTestServer(200, map[string]interface{}{
+		"hits": map[string]interface{}{
+			"hits": []interface{}{
+				map[string]interface{}{
+					"_source": map[string]interface{}{
+						"next_query": time.Now().Format(time.RFC3339),
+						"last_alert": last,
+					},
+				},
+			},
+		},
+	})
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Cooldown",
+		ESUrl:        ts.URL,
+		QueryIndex:   "test-*",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData: map[string]interface{}{
+			"hello": "world",
+		},
+		Schedule:      "@every 10m",
+		AlertCooldown: 30 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = qh.getNextQuery(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if qh.lastAlert.Format(time.RFC3339) != last {
+		t.Fatalf("unexpected last alert time (got %q, expected %q)", qh.lastAlert.Format(time.RFC3339), last)
+	}
+	if !qh.inCooldown(time.Now()) {
+		t.Fatal("rule should be in cooldown after restoring state")
+	}
+}
+
+func TestState(t *testing.T) {
+	next := time.Now().Add(10 * time.Minute).Truncate(time.Second).UTC()
+	last := time.Now().Add(-5 * time.Minute).Truncate(time.Second).UTC()
+	cases := []struct {
+		name   string
+		source map[string]interface{}
+		err    bool
+		expect *State
+	}{
+		{
+			"next-only",
+			map[string]interface{}{
+				"next_query": next.Format(time.RFC3339),
+			},
+			false,
+			&State{NextQuery: next},
+		},
+		{
+			"all-fields",
+			map[string]interface{}{
+				"next_query":   next.Format(time.RFC3339),
+				"last_run":     last.Format(time.RFC3339),
+				"last_alert":   last.Format(time.RFC3339),
+				"firing_since": last.Format(time.RFC3339),
+			},
+			false,
+			&State{NextQuery: next, LastRun: last, LastAlert: last, FiringSince: last},
+		},
+		{
+			"previous-values",
+			map[string]interface{}{
+				"next_query": next.Format(time.RFC3339),
+				"previous_values": map[string]interface{}{
+					"aggregations.errors.doc_count": "1200",
+					"aggregations.total.value":      "lots",
+				},
+			},
+			false,
+			&State{
+				NextQuery: next,
+				PreviousValues: map[string]json.Number{
+					"aggregations.errors.doc_count": "1200",
+				},
+			},
+		},
+		{
+			"corrupt-last-run",
+			map[string]interface{}{
+				"next_query": next.Format(time.RFC3339),
+				"last_run":   "yesterday",
+			},
+			false,
+			&State{NextQuery: next},
+		},
+		{
+			"missing-next-query",
+			map[string]interface{}{
+				"last_run": last.Format(time.RFC3339),
+			},
+			true,
+			nil,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(200, map[string]interface{}{
+				"hits": map[string]interface{}{
+					"hits": []interface{}{
+						map[string]interface{}{
+							"_source": tc.source,
+						},
+					},
+				},
+			})
+			defer ts.Close()
+
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test State",
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-*",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"hello": "world",
+				},
+				Schedule: "@every 10m",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := qh.State(context.Background())
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !state.NextQuery.Equal(tc.expect.NextQuery) ||
+				!state.LastRun.Equal(tc.expect.LastRun) ||
+				!state.LastAlert.Equal(tc.expect.LastAlert) ||
+				!reflect.DeepEqual(state.PreviousValues, tc.expect.PreviousValues) {
+				t.Fatalf("unexpected state (got %+v, expected %+v)", state, tc.expect)
+			}
+		})
+	}
+}
+
 func TestRun(t *testing.T) {
 	queryIndex := randomUUID(t)
 	expected := map[string]interface{}{
@@ -515,174 +847,1081 @@ func TestRun(t *testing.T) {
 		QueryIndex:   queryIndex,
 		AlertMethods: []alert.Method{fileAM},
 		QueryData: map[string]interface{}{
-			"query": map[string]interface{}{
-				"term": map[string]interface{}{
-					"hello": "world",
-				},
-			},
+			"query": map[string]interface{}{
+				"term": map[string]interface{}{
+					"hello": "world",
+				},
+			},
+		},
+		Schedule: "@every 10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	outputCh := make(chan *alert.Alert, 1)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context timeout")
+	case a := <-outputCh:
+		cancel()
+		defer func() {
+			wg.Wait()
+		}()
+		if a.RuleName != qh.name {
+			t.Fatalf("bad alert rule name (expected: %q, got: %q)", qh.name, a.RuleName)
+		}
+		if len(a.Methods) != 1 {
+			t.Fatal("alert should have just one alert method (file)")
+		}
+		if _, ok := a.Methods[0].(*file.AlertMethod); !ok {
+			t.Fatalf("alert method should be of the AlertMethod type (got type: %T)", a.Methods[0])
+		}
+		if len(a.Records) != 1 {
+			t.Fatalf("expected only one alert.Record (got %d records)", len(a.Records))
+		}
+
+		expected := "{\n    \"hello\": \"world\"\n}"
+		if a.Records[0].Text != expected {
+			t.Fatalf("unexpected alert.Record[0].Text value (got %q, expected %q)", a.Records[0].Text, expected)
+		}
+	}
+}
+
+func TestRunFakeClock(t *testing.T) {
+	queryIndex := randomUUID(t)
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+
+	var queries int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/%s-%s/_search", defaultStateIndexAlias, templateVersion):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"hits":{"hits":[{"_source":{"next_query":%q}}]}}`,
+				start.Add(time.Hour).Format(time.RFC3339))
+		case fmt.Sprintf("/<%s-status-%s-{now/d}>/_doc", defaultStateIndexAlias, templateVersion):
+			w.WriteHeader(201)
+		case fmt.Sprintf("/%s/_search", queryIndex):
+			atomic.AddInt32(&queries, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hits":{"hits":[{"_source":{"hello":"world"}}]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	fileAM, err := file.NewAlertMethod(&file.AlertMethodConfig{
+		OutputFilepath: filepath.Join("testdata", "testfile.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:          "Test Fake Clock",
+		Logger:        hclog.NewNullLogger(),
+		ESUrl:         ts.URL,
+		QueryIndex:    queryIndex,
+		AlertMethods:  []alert.Method{fileAM},
+		QueryData:     map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:      "@every 10s",
+		AlertCooldown: time.Minute,
+		Clock:         fc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	outputCh := make(chan *alert.Alert, 1)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+
+	// The query is not due until the next_query of the state document
+	fc.BlockUntil(1)
+	if n := atomic.LoadInt32(&queries); n != 0 {
+		t.Fatalf("query ran before it was scheduled (%d queries)", n)
+	}
+
+	fc.Advance(time.Hour)
+	select {
+	case <-outputCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an alert")
+	}
+	fc.BlockUntil(1)
+	if !qh.lastAlert.Equal(start.Add(time.Hour)) {
+		t.Fatalf("unexpected time of last alert (got %s, expected %s)", qh.lastAlert, start.Add(time.Hour))
+	}
+	status := qh.Status()
+	if status.LastResult != ResultAlert {
+		t.Fatalf("unexpected result of the last run (got %q, expected %q)", status.LastResult, ResultAlert)
+	}
+	if !status.NextRun.Equal(start.Add(time.Hour + 10*time.Second)) {
+		t.Fatalf("unexpected time of next run (got %s, expected %s)", status.NextRun, start.Add(time.Hour+10*time.Second))
+	}
+
+	// The next execution is within the cooldown
+	fc.Advance(10 * time.Second)
+	fc.BlockUntil(1)
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Fatalf("expected the query to run twice (got %d)", n)
+	}
+	select {
+	case <-outputCh:
+		t.Fatal("alert should have been suppressed by the cooldown")
+	default:
+	}
+	if status = qh.Status(); status.LastResult != ResultSuppressed {
+		t.Fatalf("unexpected result of the last run (got %q, expected %q)", status.LastResult, ResultSuppressed)
+	}
+}
+
+func TestRunMaintenanceWindow(t *testing.T) {
+	queryIndex := randomUUID(t)
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+
+	var queries int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/%s-%s/_search", defaultStateIndexAlias, templateVersion):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"hits":{"hits":[{"_source":{"next_query":%q}}]}}`,
+				start.Add(time.Hour).Format(time.RFC3339))
+		case fmt.Sprintf("/<%s-status-%s-{now/d}>/_doc", defaultStateIndexAlias, templateVersion):
+			w.WriteHeader(201)
+		case fmt.Sprintf("/%s/_search", queryIndex):
+			atomic.AddInt32(&queries, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hits":{"hits":[{"_source":{"hello":"world"}}]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	// Two overlapping windows which together last from 1:00 to 1:30
+	var windows []*config.MaintenanceWindow
+	for _, wc := range []*config.MaintenanceWindowConfig{
+		{Name: "upgrade", Start: "2019-01-01 01:00", End: "2019-01-01 01:20"},
+		{Name: "reindex", Start: "2019-01-01 01:10", End: "2019-01-01 01:30", LogSuppressed: true},
+	} {
+		w, err := config.ParseMaintenanceWindow(wc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows = append(windows, w)
+	}
+
+	fileAM, err := file.NewAlertMethod(&file.AlertMethodConfig{
+		OutputFilepath: filepath.Join("testdata", "testfile.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:               "Test Maintenance Window",
+		Logger:             hclog.NewNullLogger(),
+		ESUrl:              ts.URL,
+		QueryIndex:         queryIndex,
+		AlertMethods:       []alert.Method{fileAM},
+		QueryData:          map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:           "@every 10m",
+		MaintenanceWindows: windows,
+		Clock:              fc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	outputCh := make(chan *alert.Alert, 1)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+	fc.BlockUntil(1)
+
+	// The query keeps running within the windows but no alert is sent
+	for i, advance := range []time.Duration{time.Hour, 10 * time.Minute, 10 * time.Minute} {
+		fc.Advance(advance)
+		fc.BlockUntil(1)
+		if n := atomic.LoadInt32(&queries); n != int32(i+1) {
+			t.Fatalf("expected the query to run %d times (got %d)", i+1, n)
+		}
+		select {
+		case <-outputCh:
+			t.Fatalf("alert should have been suppressed by the maintenance windows (run %d)", i+1)
+		default:
+		}
+		if status := qh.Status(); status.LastResult != ResultSuppressed {
+			t.Fatalf("unexpected result of run %d (got %q, expected %q)", i+1, status.LastResult, ResultSuppressed)
+		}
+	}
+	if !qh.lastAlert.IsZero() {
+		t.Fatalf("suppressed alerts should not start the cooldown (last alert: %s)", qh.lastAlert)
+	}
+
+	// The condition is still active once the windows have ended
+	fc.Advance(10 * time.Minute)
+	select {
+	case <-outputCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an alert after the maintenance windows")
+	}
+	fc.BlockUntil(1)
+	if status := qh.Status(); status.LastResult != ResultAlert {
+		t.Fatalf("unexpected result of the last run (got %q, expected %q)", status.LastResult, ResultAlert)
+	}
+}
+
+func TestSetNextQuery(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		err    bool
+	}{
+		{
+			"success",
+			201,
+			false,
+		},
+		{
+			"non-200-response",
+			500,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case "POST", "PUT":
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(tc.status)
+					w.Write([]byte(`{"acknowledged": true}`))
+				default:
+					http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				}
+			}))
+			defer ts.Close()
+
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Errors",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-*",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"query": "test",
+				},
+				Schedule: "@every 10s",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = qh.setNextQuery(context.Background(), time.Now().Add(1*time.Hour), nil)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSetNextQueryLastRun(t *testing.T) {
+	var doc map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(`{"acknowledged": true}`))
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Last Run",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   "test-*",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData: map[string]interface{}{
+			"query": "test",
+		},
+		Schedule: "@every 10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = qh.setNextQuery(context.Background(), time.Now().Add(1*time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["last_run"]; ok {
+		t.Fatalf("last_run should be omitted before the first run (got %v)", doc["last_run"])
+	}
+
+	last := time.Now().Truncate(time.Second).UTC()
+	qh.lastRun = last
+	if err = qh.setNextQuery(context.Background(), time.Now().Add(1*time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	if doc["last_run"] != last.Format(time.RFC3339) {
+		t.Fatalf("unexpected last_run (got %v, expected %q)", doc["last_run"], last.Format(time.RFC3339))
+	}
+}
+
+func TestSetNextQueryPreviousValues(t *testing.T) {
+	var doc map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(201)
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Previous Values",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   "test-*",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData: map[string]interface{}{
+			"query": "test",
+		},
+		Schedule: "@every 10s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = qh.setNextQuery(context.Background(), time.Now().Add(1*time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["previous_values"]; ok {
+		t.Fatalf("previous_values should be omitted without delta conditions (got %v)", doc["previous_values"])
+	}
+
+	qh.previousValues = map[string]json.Number{"aggregations.errors.doc_count": "12345678901234567890"}
+	if err = qh.setNextQuery(context.Background(), time.Now().Add(1*time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"aggregations.errors.doc_count": "12345678901234567890"}
+	if !reflect.DeepEqual(doc["previous_values"], expected) {
+		t.Fatalf("unexpected previous_values (got %v, expected %v)", doc["previous_values"], expected)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	expected := map[string]interface{}{"some": "data"}
+	cases := []struct {
+		name   string
+		status int
+		data   interface{}
+		err    bool
+	}{
+		{badURL, 200, "lol", true},
+		{"non-200-response", 500, "", true},
+		{"non-json-response", 200, "not a json!!", true},
+		{"success", 200, expected, false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(tc.status, tc.data)
+			defer ts.Close()
+
+			u := ts.URL
+			if tc.name == badURL {
+				u = fmt.Sprintf("http://example.%s.co.nz", randomUUID(t))
+			}
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Errors",
+				ESUrl:        u,
+				QueryIndex:   "test-*",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"hello": "world",
+				},
+				Schedule: "@every 10m",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := qh.query(context.Background())
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(data, tc.data) {
+				t.Fatalf("unexpected data received. Expected:\n\t%+v\nGot:\n\t%+v\n", tc.data, data)
+			}
+		})
+	}
+}
+
+func TestTimedQuery(t *testing.T) {
+	cases := []struct {
+		name      string
+		threshold time.Duration
+		expected  string
+	}{
+		{"fast", time.Hour, "[DEBUG] [Rule: \"Test Slow\"] Elasticsearch query completed"},
+		{"slow", time.Nanosecond, "[WARN]  [Rule: \"Test Slow\"] slow Elasticsearch query"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(200, map[string]interface{}{"some": "data"})
+			defer ts.Close()
+
+			buf := new(bytes.Buffer)
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name: "Test Slow",
+				Logger: hclog.New(&hclog.LoggerOptions{
+					Output: buf,
+					Level:  hclog.Debug,
+				}),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-*",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"hello": "world",
+				},
+				Schedule:           "@every 10m",
+				SlowQueryThreshold: tc.threshold,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = qh.timedQuery(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(buf.String(), tc.expected) {
+				t.Fatalf("Expected logs to contain:\n\t%s\nGot:\n\t%s", tc.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices that the client went away
+		// once the request body has been consumed
+		new(bytes.Buffer).ReadFrom(r.Body) // nolint: errcheck
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+			w.Write([]byte(`{"some": "data"}`))
+		}
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Timeout",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   "test-index",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData: map[string]interface{}{
+			"hello": "world",
+		},
+		Schedule:     "@every 10m",
+		QueryTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err = qh.query(context.Background()); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("query was not canceled at the deadline (took %s)", elapsed)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("in-flight request was not aborted")
+	}
+}
+
+// errorOutputMethod sends the records of each of its writes on a
+// channel.
+type errorOutputMethod struct {
+	writes chan []*alert.Record
+}
+
+func (m *errorOutputMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
+	m.writes <- records
+	return nil
+}
+
+func (m *errorOutputMethod) Name() string {
+	return "error-output"
+}
+
+func TestCycleErrorOutput(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		w.Write([]byte(`{"error": "search_phase_execution_exception"}`))
+	}))
+	defer ts.Close()
+
+	m := &errorOutputMethod{writes: make(chan []*alert.Record, 4)}
+	errorOutput, err := alert.NewErrorOutput(&alert.ErrorOutputConfig{
+		Method:   m,
+		Interval: time.Hour,
+		Logger:   hclog.NewNullLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Error Output",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   "test-index",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData:    map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:     "@every 1m",
+		ErrorOutput:  errorOutput,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each failed execution is reported, but only the first one
+	// within the interval is sent
+	sq := newSendQueue(defaultSendQueueSize)
+	for i := 0; i < 3; i++ {
+		res, _ := qh.cycle(context.Background(), sq, false)
+		if res.Result != ResultError {
+			t.Fatalf("unexpected result of execution %d (got %q, expected %q)", i+1, res.Result, ResultError)
+		}
+	}
+
+	select {
+	case records := <-m.writes:
+		if len(records) != 1 || records[0].Filter != alert.ErrorFilter {
+			t.Fatalf("unexpected records: %+v", records)
+		}
+		expected := "Rule: Test Error Output\nSource: query\n"
+		if !strings.Contains(records[0].Text, expected) {
+			t.Fatalf("Expected error alert to contain:\n\t%s\nGot:\n\t%s", expected, records[0].Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error alert")
+	}
+	select {
+	case records := <-m.writes:
+		t.Fatalf("unexpected second error alert: %s", records[0].Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEscapeIndex(t *testing.T) {
+	cases := []struct {
+		name     string
+		index    string
+		expected string
+	}{
+		{"plain", "logs-2024.06.01", "logs-2024.06.01"},
+		{"wildcard", "logs-*", "logs-*"},
+		{"date-math", "<logs-{now/d}>", "%3Clogs-%7Bnow%2Fd%7D%3E"},
+		{"date-math-already-escaped", "%3Clogs-%7Bnow%2Fd%7D%3E", "%3Clogs-%7Bnow%2Fd%7D%3E"},
+		{"multiple", "<logs-{now/d}>,<logs-{now/d-1d}>,metrics-*", "%3Clogs-%7Bnow%2Fd%7D%3E,%3Clogs-%7Bnow%2Fd-1d%7D%3E,metrics-*"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := escapeIndex(tc.index); got != tc.expected {
+				t.Fatalf("unexpected escaped index (got %q, expected %q)", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestQueryDateMathIndex(t *testing.T) {
+	var gotURI, gotPath string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURI = r.RequestURI
+		gotPath = r.URL.Path
+		w.Write([]byte(`{"some": "data"}`))
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Date Math",
+		ESUrl:        ts.URL,
+		QueryIndex:   "<logs-{now/d}>",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData: map[string]interface{}{
+			"hello": "world",
+		},
+		Schedule: "@every 10m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = qh.query(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "/%3Clogs-%7Bnow%2Fd%7D%3E/_search"; gotURI != expected {
+		t.Errorf("unexpected request URI (got %q, expected %q)", gotURI, expected)
+	}
+	if expected := "/<logs-{now/d}>/_search"; gotPath != expected {
+		t.Errorf("unexpected decoded path (got %q, expected %q)", gotPath, expected)
+	}
+}
+
+func TestQueryPathPrefix(t *testing.T) {
+	var gotPath string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte(`{"some": "data"}`))
+	}))
+	defer ts.Close()
+
+	server := &config.ServerConfig{ElasticsearchURL: ts.URL + "/", PathPrefix: "/es-proxy/"}
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Path Prefix",
+		ESUrl:        server.BaseURL(),
+		QueryIndex:   "logs-*",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData: map[string]interface{}{
+			"hello": "world",
 		},
-		Schedule: "@every 10s",
+		Schedule: "@every 10m",
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var wg sync.WaitGroup
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
-
-	outputCh := make(chan *alert.Alert, 1)
-	lock := lock.NewLock()
-	lock.Set(true)
-	wg.Add(1)
+	if _, err = qh.query(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "/es-proxy/logs-*/_search"; gotPath != expected {
+		t.Errorf("unexpected path (got %q, expected %q)", gotPath, expected)
+	}
+	if !strings.HasPrefix(qh.StateAliasURL(), ts.URL+"/es-proxy/") {
+		t.Errorf("unexpected state alias URL (got %q)", qh.StateAliasURL())
+	}
+}
 
-	go qh.Run(ctx, outputCh, &wg, lock)
+func TestQueryIndexPolicy(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"some": "data"}`))
+	}))
+	defer ts.Close()
 
-	select {
-	case <-ctx.Done():
-		t.Fatal("context timeout")
-	case a := <-outputCh:
-		cancel()
-		defer func() {
-			wg.Wait()
-		}()
-		if a.RuleName != qh.name {
-			t.Fatalf("bad alert rule name (expected: %q, got: %q)", qh.name, a.RuleName)
-		}
-		if len(a.Methods) != 1 {
-			t.Fatal("alert should have just one alert method (file)")
+	policy := &config.IndexPolicy{Allowed: []string{"logs-*"}}
+	for index, allowed := range map[string]bool{"logs-nginx-*": true, "*": false} {
+		qh, err := NewQueryHandler(&QueryHandlerConfig{
+			Name:         "Test Index Policy",
+			ESUrl:        ts.URL,
+			QueryIndex:   index,
+			AlertMethods: []alert.Method{&file.AlertMethod{}},
+			QueryData: map[string]interface{}{
+				"hello": "world",
+			},
+			Schedule:    "@every 10m",
+			IndexPolicy: policy,
+		})
+		if err != nil {
+			t.Fatal(err)
 		}
-		if _, ok := a.Methods[0].(*file.AlertMethod); !ok {
-			t.Fatalf("alert method should be of the AlertMethod type (got type: %T)", a.Methods[0])
+		atomic.StoreInt32(&requests, 0)
+		_, err = qh.query(context.Background())
+		if allowed && err != nil {
+			t.Fatalf("index %q: %v", index, err)
 		}
-		if len(a.Records) != 1 {
-			t.Fatalf("expected only one alert.Record (got %d records)", len(a.Records))
+		if !allowed && err == nil {
+			t.Fatalf("index %q: expected an error but didn't receive one", index)
 		}
-
-		expected := "{\n    \"hello\": \"world\"\n}"
-		if a.Records[0].Text != expected {
-			t.Fatalf("unexpected alert.Record[0].Text value (got %q, expected %q)", a.Records[0].Text, expected)
+		if n := atomic.LoadInt32(&requests); allowed != (n == 1) {
+			t.Fatalf("index %q: unexpected number of requests (%d)", index, n)
 		}
 	}
 }
 
-func TestSetNextQuery(t *testing.T) {
+func TestQueryCountOnly(t *testing.T) {
 	cases := []struct {
-		name   string
-		status int
-		err    bool
+		name      string
+		filters   []string
+		bodyField string
+		runtime   bool
+		path      string
+		body      string
+		records   int
 	}{
 		{
-			"success",
-			201,
+			"count",
+			nil,
+			"",
 			false,
+			"/test-index/_count",
+			`{"query":{"term":{"level":"error"}}}`,
+			1,
 		},
 		{
-			"non-200-response",
-			500,
+			"filters-fallback",
+			[]string{"aggregations.hostname.buckets"},
+			"",
+			false,
+			"/test-index/_search",
+			`{"aggs":{"hostname":{"terms":{"field":"hostname"}}},"query":{"term":{"level":"error"}},"size":0}`,
+			0,
+		},
+		{
+			"body-field-fallback",
+			nil,
+			"hits.hits",
+			false,
+			"/test-index/_search",
+			`{"aggs":{"hostname":{"terms":{"field":"hostname"}}},"query":{"term":{"level":"error"}},"size":0}`,
+			0,
+		},
+		{
+			"runtime-mappings-fallback",
+			nil,
+			"",
 			true,
+			"/test-index/_search",
+			`{"aggs":{"hostname":{"terms":{"field":"hostname"}}},"query":{"term":{"level":"error"}},` +
+				`"runtime_mappings":{"level":{"type":"keyword"}},"size":0}`,
+			0,
 		},
 	}
 
 	for _, tc := range cases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
+			var gotPath, gotBody string
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				switch r.Method {
-				case "POST", "PUT":
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(tc.status)
-					w.Write([]byte(`{"acknowledged": true}`))
-				default:
-					http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-				}
+				gotPath = r.URL.Path
+				buf := new(bytes.Buffer)
+				buf.ReadFrom(r.Body) // nolint: errcheck
+				gotBody = strings.TrimSpace(buf.String())
+				w.Write([]byte(`{"count": 42, "_shards": {"total": 1, "successful": 1}}`))
 			}))
 			defer ts.Close()
 
+			queryData := map[string]interface{}{
+				"size":  0,
+				"query": map[string]interface{}{"term": map[string]interface{}{"level": "error"}},
+				"aggs": map[string]interface{}{
+					"hostname": map[string]interface{}{"terms": map[string]interface{}{"field": "hostname"}},
+				},
+			}
+			if tc.runtime {
+				queryData["runtime_mappings"] = map[string]interface{}{
+					"level": map[string]interface{}{"type": "keyword"},
+				}
+			}
+
 			qh, err := NewQueryHandler(&QueryHandlerConfig{
-				Name:         "Test Errors",
+				Name:         "Test Count",
 				Logger:       hclog.NewNullLogger(),
 				ESUrl:        ts.URL,
-				QueryIndex:   "test-*",
+				QueryIndex:   "test-index",
 				AlertMethods: []alert.Method{&file.AlertMethod{}},
-				QueryData: map[string]interface{}{
-					"query": "test",
-				},
-				Schedule: "@every 10s",
+				QueryData:    queryData,
+				Schedule:     "@every 10m",
+				Filters:      tc.filters,
+				BodyField:    tc.bodyField,
+				CountOnly:    true,
 			})
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			err = qh.setNextQuery(context.Background(), time.Now().Add(1*time.Hour), nil)
-			if tc.err {
-				if err == nil {
-					t.Fatal("expected an error but didn't receive one")
-				}
-				return
+			data, err := qh.query(context.Background())
+			if err != nil {
+				t.Fatal(err)
 			}
+			if gotPath != tc.path {
+				t.Errorf("unexpected path (got %q, expected %q)", gotPath, tc.path)
+			}
+			if gotBody != tc.body {
+				t.Errorf("unexpected body (got %s, expected %s)", gotBody, tc.body)
+			}
+
+			records, _, err := qh.process(data)
 			if err != nil {
 				t.Fatal(err)
 			}
+			if len(records) != tc.records {
+				t.Fatalf("unexpected number of records (got %d, expected %d)", len(records), tc.records)
+			}
+			if tc.records > 0 && records[0].Fields[0].Count != 42 {
+				t.Errorf("unexpected count (got %d, expected 42)", records[0].Fields[0].Count)
+			}
 		})
 	}
 }
 
-func TestQuery(t *testing.T) {
-	expected := map[string]interface{}{"some": "data"}
+func TestQueryParams(t *testing.T) {
+	params := map[string]string{
+		"request_cache": "true",
+		"search_type":   "dfs_query_then_fetch",
+		"preference":    "rule #1&more",
+		"routing":       "user1,user2",
+	}
 	cases := []struct {
-		name   string
-		status int
-		data   interface{}
-		err    bool
+		name      string
+		countOnly bool
+		expected  url.Values
 	}{
-		{badURL, 200, "lol", true},
-		{"non-200-response", 500, "", true},
-		{"non-json-response", 200, "not a json!!", true},
-		{"success", 200, expected, false},
+		{
+			"search",
+			false,
+			url.Values{
+				"request_cache": {"true"},
+				"search_type":   {"dfs_query_then_fetch"},
+				"preference":    {"rule #1&more"},
+				"routing":       {"user1,user2"},
+			},
+		},
+		{
+			"count",
+			true,
+			url.Values{
+				"preference": {"rule #1&more"},
+				"routing":    {"user1,user2"},
+			},
+		},
 	}
 
 	for _, tc := range cases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			ts := newTestServer(tc.status, tc.data)
+			var gotQuery url.Values
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotQuery = r.URL.Query()
+				w.Write([]byte(`{"count": 0, "hits": {"hits": []}}`))
+			}))
 			defer ts.Close()
 
-			u := ts.URL
-			if tc.name == badURL {
-				u = fmt.Sprintf("http://example.%s.co.nz", randomUUID(t))
-			}
 			qh, err := NewQueryHandler(&QueryHandlerConfig{
-				Name:         "Test Errors",
-				ESUrl:        u,
-				QueryIndex:   "test-*",
+				Name:         "Test Query Params",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-index",
 				AlertMethods: []alert.Method{&file.AlertMethod{}},
 				QueryData: map[string]interface{}{
-					"hello": "world",
+					"query": map[string]interface{}{"match_all": map[string]interface{}{}},
 				},
-				Schedule: "@every 10m",
+				Schedule:    "@every 10m",
+				CountOnly:   tc.countOnly,
+				QueryParams: params,
 			})
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			data, err := qh.query(context.Background())
-			if tc.err {
-				if err == nil {
-					t.Fatal("expected an error but didn't receive one")
-				}
-				return
+			if _, err = qh.query(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotQuery, tc.expected) {
+				t.Fatalf("unexpected query parameters (got %v, expected %v)", gotQuery, tc.expected)
 			}
+		})
+	}
+}
+
+func TestQuerySourceParam(t *testing.T) {
+	short := map[string]interface{}{
+		"query": map[string]interface{}{
+			"query_string": map[string]interface{}{"query": "level:error && message:\"a b\"/+?#"},
+		},
+		"aggs": map[string]interface{}{
+			"hostname": map[string]interface{}{"terms": map[string]interface{}{"field": "hostname"}},
+		},
+	}
+	long := map[string]interface{}{
+		"query": map[string]interface{}{
+			"query_string": map[string]interface{}{"query": strings.Repeat("a", maxSourceURILength)},
+		},
+	}
+
+	cases := []struct {
+		name   string
+		body   map[string]interface{}
+		method string
+	}{
+		{"get", short, http.MethodGet},
+		{"post-fallback", long, http.MethodPost},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				gotMethod string
+				gotQuery  url.Values
+				gotBody   []byte
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotMethod = r.Method
+				gotQuery = r.URL.Query()
+				gotBody, _ = ioutil.ReadAll(r.Body)
+				w.Write([]byte(`{"hits": {"hits": []}}`))
+			}))
+			defer ts.Close()
+
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Source Param",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-index",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData:    tc.body,
+				Schedule:     "@every 10m",
+				QueryParams:  map[string]string{"request_cache": "true"},
+				SourceParam:  true,
+			})
 			if err != nil {
 				t.Fatal(err)
 			}
-			if !reflect.DeepEqual(data, tc.data) {
-				t.Fatalf("unexpected data received. Expected:\n\t%+v\nGot:\n\t%+v\n", tc.data, data)
+
+			if _, err = qh.query(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if gotMethod != tc.method {
+				t.Fatalf("unexpected method (got %s, expected %s)", gotMethod, tc.method)
+			}
+			if gotQuery.Get("request_cache") != "true" {
+				t.Fatalf("expected the query parameters to be kept, got %v", gotQuery)
+			}
+
+			source := []byte(gotQuery.Get("source"))
+			if tc.method == http.MethodPost {
+				if len(source) != 0 {
+					t.Fatalf("expected no 'source' parameter, got %s", source)
+				}
+				source = gotBody
+			} else {
+				if len(gotBody) != 0 {
+					t.Fatalf("expected no request body, got %s", gotBody)
+				}
+				if ct := gotQuery.Get("source_content_type"); ct != "application/json" {
+					t.Fatalf("unexpected 'source_content_type' (got %q, expected \"application/json\")", ct)
+				}
+			}
+
+			var got map[string]interface{}
+			if err = json.Unmarshal(source, &got); err != nil {
+				t.Fatalf("error decoding query %s: %v", source, err)
+			}
+			if !reflect.DeepEqual(got, tc.body) {
+				t.Fatalf("unexpected query (got %v, expected %v)", got, tc.body)
 			}
 		})
 	}
 }
 
+func TestQueryHeaders(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Write([]byte(`{"some": "data"}`))
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Headers",
+		ESUrl:        ts.URL,
+		QueryIndex:   "test-*",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData: map[string]interface{}{
+			"hello": "world",
+		},
+		Schedule: "@every 10m",
+		Headers: map[string]string{
+			"X-Team": "platform",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = qh.query(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"User-Agent":   version.UserAgent(),
+		"X-Alert-Rule": "Test Headers",
+		"X-Team":       "platform",
+	}
+	for k, v := range expected {
+		if got.Get(k) != v {
+			t.Errorf("unexpected value for header %s (got %q, expected %q)", k, got.Get(k), v)
+		}
+	}
+}
+
 func TestNewRequestErrors(t *testing.T) {
 	reqFunc, err := buildHTTPRequestFunc()
 	if err != nil {
@@ -796,3 +2035,97 @@ func newTestServer(status int, payload interface{}) *httptest.Server {
 		}
 	}))
 }
+
+func TestDispatchMinMatches(t *testing.T) {
+	const filter = "aggregations.hostname.buckets"
+	cases := []struct {
+		name     string
+		records  []*alert.Record
+		expected string
+	}{
+		{
+			"below",
+			[]*alert.Record{
+				{Filter: filter, Fields: []*alert.Field{{Key: "web-1", Count: 3}, {Key: "web-2", Count: 1}}},
+			},
+			ResultSuppressed,
+		},
+		{
+			"at",
+			[]*alert.Record{
+				{Filter: filter, Fields: []*alert.Field{{Key: "web-1", Count: 3}, {Key: "web-2", Count: 2}}},
+			},
+			ResultAlert,
+		},
+		{
+			// The documents of the body field and the buckets
+			// matching them are not added up
+			"below-body-field",
+			[]*alert.Record{
+				{Filter: filter, Fields: []*alert.Field{{Key: "web-1", Count: 4}}},
+				{
+					Filter:    defaultBodyField,
+					BodyField: true,
+					Documents: []map[string]interface{}{{}, {}, {}, {}},
+				},
+			},
+			ResultSuppressed,
+		},
+		{
+			"at-body-field",
+			[]*alert.Record{
+				{
+					Filter:    defaultBodyField,
+					BodyField: true,
+					Documents: []map[string]interface{}{{}, {}, {}, {}, {}},
+				},
+			},
+			ResultAlert,
+		},
+		{
+			"at-string-hits",
+			[]*alert.Record{
+				{
+					Filter:    "hits.hits._source.message",
+					BodyField: true,
+					Text:      strings.Join([]string{"a", "b", "c", "d", "e"}, hitsDelimiter),
+				},
+			},
+			ResultAlert,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Min Matches",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ElasticsearchURL,
+				QueryIndex:   "test-*",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData:    map[string]interface{}{"query": map[string]interface{}{}},
+				Schedule:     "@every 10m",
+				Filters:      []string{filter},
+				MinMatches:   5,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sq := newSendQueue(1)
+			res := qh.dispatch(context.Background(), sq, false, tc.records)
+			if res.Result != tc.expected {
+				t.Fatalf("unexpected result (got %q, expected %q)", res.Result, tc.expected)
+			}
+			close(sq.alerts)
+			var sent int
+			for range sq.alerts {
+				sent++
+			}
+			if (sent == 1) != (tc.expected == ResultAlert) {
+				t.Fatalf("unexpected number of alerts sent: %d", sent)
+			}
+		})
+	}
+}
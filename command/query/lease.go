@@ -0,0 +1,315 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
+	"golang.org/x/xerrors"
+)
+
+// leaseDocID is the ID of the lock document of the lease index.
+const leaseDocID = "leader"
+
+// LeaseConfig is used to configure a Lease.
+type LeaseConfig struct {
+	// Client is the HTTP client used to communicate with
+	// Elasticsearch. If nil, a default client will be used
+	Client *http.Client
+
+	// ESUrl is the URL of the Elasticsearch instance
+	ESUrl string
+
+	// UserAgent is appended to version.UserAgent() to form the
+	// User-Agent header sent with each request
+	UserAgent string
+
+	// Headers are additional headers sent with each request
+	Headers map[string]string
+
+	// Holder identifies this process in the lock document. It must
+	// be unique among the processes sharing the lease
+	Holder string
+
+	// TTL is how long the lease lasts unless it is renewed. The
+	// leader renews it every third of the TTL
+	TTL time.Duration
+
+	// Logger is the logger used to log leadership changes. If nil,
+	// a default logger will be used
+	Logger hclog.Logger
+
+	// Clock is used to tell the time. If nil, the system clock is
+	// used
+	Clock clock.Clock
+}
+
+// Lease elects a leader among the processes sharing an Elasticsearch
+// instance with a lock document in the lease index. The document
+// names its holder and when the lease expires. A process takes the
+// lease when there is no document or the lease has expired, and the
+// holder renews it; every write is conditional on the sequence
+// number and primary term read before it, so that only one of the
+// processes racing for an expired lease gets it.
+type Lease struct {
+	client     *http.Client
+	esURL      string
+	userAgent  string
+	headers    map[string]string
+	holder     string
+	ttl        time.Duration
+	logger     hclog.Logger
+	clock      clock.Clock
+	newRequest func(ctx context.Context, method, url string, data io.Reader) (*http.Request, error)
+}
+
+// leaseDoc is the lock document of the lease index.
+type leaseDoc struct {
+	Holder    string `json:"holder"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// docVersion is the version of a document (e.g. the lock document)
+// read or written by this process, on which the next write of the
+// document is conditional.
+type docVersion struct {
+	SeqNo       int64 `json:"_seq_no"`
+	PrimaryTerm int64 `json:"_primary_term"`
+}
+
+// NewLease creates a new *Lease instance.
+func NewLease(config *LeaseConfig) (*Lease, error) {
+	if config == nil {
+		return nil, xerrors.New("no config provided")
+	}
+	if config.ESUrl == "" {
+		return nil, xerrors.New("no Elasticsearch URL provided")
+	}
+	if config.Holder == "" {
+		return nil, xerrors.New("no holder provided")
+	}
+	if config.TTL <= 0 {
+		return nil, xerrors.New("the TTL must be positive")
+	}
+	reqFunc, err := buildHTTPRequestFunc()
+	if err != nil {
+		return nil, err
+	}
+	if config.Client == nil {
+		config.Client = cleanhttp.DefaultClient()
+	}
+	if config.Logger == nil {
+		config.Logger = hclog.Default()
+	}
+	if config.Clock == nil {
+		config.Clock = clock.Real()
+	}
+	return &Lease{
+		client:     config.Client,
+		esURL:      strings.TrimRight(config.ESUrl, "/"),
+		userAgent:  version.UserAgentWith(config.UserAgent),
+		headers:    config.Headers,
+		holder:     config.Holder,
+		ttl:        config.TTL,
+		logger:     config.Logger,
+		clock:      config.Clock,
+		newRequest: reqFunc,
+	}, nil
+}
+
+// IndexName returns the name of the index of the lock document.
+func (l *Lease) IndexName() string {
+	return fmt.Sprintf("%s-lock-%s", defaultStateIndexAlias, templateVersion)
+}
+
+// Run tries to take or renew the lease every third of its TTL until
+// ctx is done, setting distLock to whether this process holds it.
+// A process which fails to renew its lease stops acting as the
+// leader at once rather than when the lease expires. The lease is
+// released on return so that another process may take over without
+// waiting for it to expire.
+func (l *Lease) Run(ctx context.Context, distLock *lock.Lock) {
+	var (
+		leader bool
+		doc    *docVersion
+	)
+	defer func() {
+		if leader {
+			distLock.Set(false)
+			// The context is done, but the release should still be sent
+			releaseCtx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+			defer cancel()
+			if err := l.release(releaseCtx, doc); err != nil {
+				l.logger.Warn("Error releasing the lease", "error", err)
+			}
+		}
+	}()
+
+	for {
+		// A renewal must not outlast the lease it renews
+		acquireCtx, cancel := context.WithTimeout(ctx, l.ttl/3)
+		var err error
+		doc, err = l.acquire(acquireCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			l.logger.Warn("Error acquiring the lease", "error", err)
+		}
+		switch held := doc != nil; {
+		case held && !leader:
+			l.logger.Info("This process is now the leader", "holder", l.holder)
+		case !held && leader:
+			l.logger.Info("This process is no longer the leader", "holder", l.holder)
+		}
+		leader = doc != nil
+		distLock.Set(leader)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-l.clock.After(l.ttl / 3):
+		}
+	}
+}
+
+// acquire takes the lease if it is free or has expired, or renews it
+// if this process holds it. It returns the version of the lock
+// document it wrote, or nil if another process holds the lease.
+func (l *Lease) acquire(ctx context.Context) (*docVersion, error) {
+	now := l.clock.Now()
+	current, version, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprintf("%s/%s/_create/%s", l.esURL, l.IndexName(), leaseDocID)
+	if current != nil {
+		expires, err := time.Parse(time.RFC3339Nano, current.ExpiresAt)
+		if err == nil && current.Holder != l.holder && now.Before(expires) {
+			return nil, nil
+		}
+		u = fmt.Sprintf("%s/%s/_doc/%s?if_seq_no=%d&if_primary_term=%d", l.esURL, l.IndexName(), leaseDocID,
+			version.SeqNo, version.PrimaryTerm)
+	}
+
+	body, err := json.Marshal(&leaseDoc{
+		Holder:    l.holder,
+		ExpiresAt: now.Add(l.ttl).UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error JSON-encoding lock document: %v", err)
+	}
+	resp, err := l.do(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusConflict:
+		// Another process wrote the lock document first
+		return nil, nil
+	default:
+		return nil, xerrors.Errorf("unexpected status code writing lock document: %d", resp.StatusCode)
+	}
+	written := new(docVersion)
+	if err = json.NewDecoder(resp.Body).Decode(written); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding response to writing lock document: %v", err)
+	}
+	return written, nil
+}
+
+// get returns the lock document and its version, or nil if there is
+// none.
+func (l *Lease) get(ctx context.Context) (*leaseDoc, *docVersion, error) {
+	u := fmt.Sprintf("%s/%s/_doc/%s", l.esURL, l.IndexName(), leaseDocID)
+	resp, err := l.do(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil, nil
+	default:
+		return nil, nil, xerrors.Errorf("unexpected status code reading lock document: %d", resp.StatusCode)
+	}
+
+	var data struct {
+		docVersion
+		Found  bool     `json:"found"`
+		Source leaseDoc `json:"_source"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, nil, xerrors.Errorf("error JSON-decoding lock document: %v", err)
+	}
+	if !data.Found {
+		return nil, nil, nil
+	}
+	return &data.Source, &data.docVersion, nil
+}
+
+// release deletes the lock document unless another process has
+// written it since this process did.
+func (l *Lease) release(ctx context.Context, version *docVersion) error {
+	if version == nil {
+		return nil
+	}
+	u := fmt.Sprintf("%s/%s/_doc/%s?if_seq_no=%d&if_primary_term=%d", l.esURL, l.IndexName(), leaseDocID,
+		version.SeqNo, version.PrimaryTerm)
+	resp, err := l.do(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound, http.StatusConflict:
+		return nil
+	default:
+		return xerrors.Errorf("unexpected status code deleting lock document: %d", resp.StatusCode)
+	}
+}
+
+func (l *Lease) do(ctx context.Context, method, u string, data io.Reader) (*http.Response, error) {
+	req, err := l.newRequest(ctx, method, u, data)
+	if err != nil {
+		return nil, xerrors.Errorf("error creating new request: %v", err)
+	}
+	for k, v := range l.headers {
+		req.Header.Set(k, v)
+	}
+	if l.userAgent != "" {
+		req.Header.Set("User-Agent", l.userAgent)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	return resp, nil
+}
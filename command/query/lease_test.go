@@ -0,0 +1,280 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+)
+
+// fakeLockIndex mocks the lock document of the lease index,
+// refusing writes whose if_seq_no and if_primary_term do not match
+// its version.
+type fakeLockIndex struct {
+	t  *testing.T
+	mu sync.Mutex
+
+	doc   *leaseDoc
+	seqNo int64
+
+	// down are the holders whose requests fail, per the X-Holder
+	// header
+	down map[string]bool
+
+	// afterGet is called after the document is read
+	afterGet func(f *fakeLockIndex)
+}
+
+func newFakeLockIndex(t *testing.T) *fakeLockIndex {
+	return &fakeLockIndex{t: t, seqNo: -1, down: make(map[string]bool)}
+}
+
+func (f *fakeLockIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down[r.Header.Get("X-Holder")] {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	index := fmt.Sprintf("/%s-lock-%s", defaultStateIndexAlias, templateVersion)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == index+"/_doc/"+leaseDocID:
+		if f.doc == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"found": false}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"found":         true,
+			"_seq_no":       f.seqNo,
+			"_primary_term": 1,
+			"_source":       f.doc,
+		})
+		if f.afterGet != nil {
+			f.afterGet(f)
+		}
+	case r.Method == http.MethodPut && r.URL.Path == index+"/_create/"+leaseDocID:
+		if f.doc != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.write(w, r, http.StatusCreated)
+	case r.Method == http.MethodPut && r.URL.Path == index+"/_doc/"+leaseDocID:
+		if !f.matches(r) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.write(w, r, http.StatusOK)
+	case r.Method == http.MethodDelete && r.URL.Path == index+"/_doc/"+leaseDocID:
+		if !f.matches(r) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.doc = nil
+		f.seqNo++
+	default:
+		f.t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// matches returns whether the request is conditional on the current
+// version of the document.
+func (f *fakeLockIndex) matches(r *http.Request) bool {
+	seqNo, err := strconv.ParseInt(r.URL.Query().Get("if_seq_no"), 10, 64)
+	if err != nil {
+		f.t.Errorf("write is not conditional on the sequence number: %s %s", r.Method, r.URL)
+		return false
+	}
+	if r.URL.Query().Get("if_primary_term") != "1" {
+		f.t.Errorf("write is not conditional on the primary term: %s %s", r.Method, r.URL)
+		return false
+	}
+	return f.doc != nil && seqNo == f.seqNo
+}
+
+func (f *fakeLockIndex) write(w http.ResponseWriter, r *http.Request, status int) {
+	doc := new(leaseDoc)
+	if err := json.NewDecoder(r.Body).Decode(doc); err != nil {
+		f.t.Errorf("error decoding lock document: %v", err)
+	}
+	f.doc = doc
+	f.seqNo++
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"_seq_no": %d, "_primary_term": 1}`, f.seqNo)
+}
+
+func (f *fakeLockIndex) holder() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.doc == nil {
+		return ""
+	}
+	return f.doc.Holder
+}
+
+func newTestLease(t *testing.T, url, holder string, clk clock.Clock) *Lease {
+	l, err := NewLease(&LeaseConfig{
+		ESUrl:   url,
+		Holder:  holder,
+		Headers: map[string]string{"X-Holder": holder},
+		TTL:     30 * time.Second,
+		Logger:  hclog.NewNullLogger(),
+		Clock:   clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLeaseFailover(t *testing.T) {
+	index := newFakeLockIndex(t)
+	ts := httptest.NewServer(index)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+	a := newTestLease(t, ts.URL, "a", fc)
+	b := newTestLease(t, ts.URL, "b", fc)
+	lockA, lockB := lock.NewLock(), lock.NewLock()
+
+	var wg sync.WaitGroup
+	ctxA, cancelA := context.WithCancel(context.Background())
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer func() {
+		cancelA()
+		cancelB()
+		wg.Wait()
+	}()
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.Run(ctxA, lockA)
+	}()
+	fc.BlockUntil(1)
+	go func() {
+		defer wg.Done()
+		b.Run(ctxB, lockB)
+	}()
+	fc.BlockUntil(2)
+
+	if !lockA.Acquired() || lockB.Acquired() {
+		t.Fatalf("expected only a to be the leader (a: %t, b: %t)", lockA.Acquired(), lockB.Acquired())
+	}
+
+	// a renews its lease while it can reach Elasticsearch
+	fc.Advance(10 * time.Second)
+	fc.BlockUntil(2)
+	if !lockA.Acquired() || lockB.Acquired() {
+		t.Fatalf("expected only a to be the leader (a: %t, b: %t)", lockA.Acquired(), lockB.Acquired())
+	}
+
+	// a can no longer renew its lease, which expires 30 seconds after
+	// its last renewal
+	index.mu.Lock()
+	index.down["a"] = true
+	index.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		fc.Advance(10 * time.Second)
+		fc.BlockUntil(2)
+		if lockA.Acquired() || lockB.Acquired() {
+			t.Fatalf("expected neither to be the leader before the lease expires (a: %t, b: %t)",
+				lockA.Acquired(), lockB.Acquired())
+		}
+	}
+	fc.Advance(10 * time.Second)
+	fc.BlockUntil(2)
+	if lockA.Acquired() || !lockB.Acquired() {
+		t.Fatalf("expected b to take over once the lease expired (a: %t, b: %t)", lockA.Acquired(), lockB.Acquired())
+	}
+	if holder := index.holder(); holder != "b" {
+		t.Fatalf("expected the lock document to be held by b (got %q)", holder)
+	}
+
+	// a does not take the lease back once it can reach Elasticsearch
+	index.mu.Lock()
+	index.down["a"] = false
+	index.mu.Unlock()
+	fc.Advance(10 * time.Second)
+	fc.BlockUntil(2)
+	if lockA.Acquired() || !lockB.Acquired() {
+		t.Fatalf("expected only b to be the leader (a: %t, b: %t)", lockA.Acquired(), lockB.Acquired())
+	}
+
+	// b releases the lease when it stops
+	cancelB()
+	fc.BlockUntil(1)
+	for i := 0; i < 100 && index.holder() != ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if holder := index.holder(); holder != "" {
+		t.Fatalf("expected the lease to be released (held by %q)", holder)
+	}
+	if lockB.Acquired() {
+		t.Fatal("expected b to no longer be the leader")
+	}
+}
+
+func TestLeaseConflict(t *testing.T) {
+	index := newFakeLockIndex(t)
+	now := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	index.doc = &leaseDoc{Holder: "a", ExpiresAt: now.Add(-time.Second).Format(time.RFC3339Nano)}
+	index.seqNo = 4
+
+	// Another process takes over the expired lease between the read
+	// and the write of b
+	index.afterGet = func(f *fakeLockIndex) {
+		f.doc = &leaseDoc{Holder: "c", ExpiresAt: now.Add(30 * time.Second).Format(time.RFC3339Nano)}
+		f.seqNo++
+		f.afterGet = nil
+	}
+	ts := httptest.NewServer(index)
+	defer ts.Close()
+
+	b := newTestLease(t, ts.URL, "b", clock.NewFake(now))
+	version, err := b.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != nil {
+		t.Fatal("expected b not to acquire a lease taken by another process")
+	}
+	if holder := index.holder(); holder != "c" {
+		t.Fatalf("expected the lock document to be held by c (got %q)", holder)
+	}
+
+	// The lease is taken once it has expired again
+	b.clock = clock.NewFake(now.Add(time.Minute))
+	if version, err = b.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if version == nil || version.SeqNo != 6 {
+		t.Fatalf("expected b to acquire the lease (got version %+v)", version)
+	}
+}
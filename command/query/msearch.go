@@ -0,0 +1,285 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const defaultBatchWindow = 100 * time.Millisecond
+
+// ndjsonHeader is the Content-Type of requests to the _msearch API
+// with REST API compatibility enabled (see compatibilityHeader).
+const ndjsonHeader = "application/vnd.elasticsearch+x-ndjson;compatible-with=7"
+
+// BatcherConfig is passed as an argument to NewBatcher().
+type BatcherConfig struct {
+	// Window is how long a query waits for the queries of other
+	// rules to join its batch. This should come from the
+	// 'elasticsearch.msearch.window' field of the main configuration
+	// file. If zero, a default of 100 milliseconds will be used
+	Window time.Duration
+
+	// Compress is whether the body of each _msearch request is
+	// gzip-compressed. This should come from the
+	// 'elasticsearch.msearch.compress' field of the main
+	// configuration file
+	Compress bool
+}
+
+// Batcher coalesces the queries of rules which are due at the same
+// time into a single request to the _msearch API and routes each
+// response back to the rule which sent the query. A Batcher is
+// shared by the QueryHandlers created with it (see
+// QueryHandlerConfig.Batcher), all of which must query the same
+// Elasticsearch instance with the same client.
+type Batcher struct {
+	window   time.Duration
+	compress bool
+
+	mu      sync.Mutex
+	members int
+	pending []*batchedQuery
+	timer   *time.Timer
+}
+
+type batchedQuery struct {
+	q      *QueryHandler
+	index  string
+	body   map[string]interface{}
+	result chan batchResult
+}
+
+type batchResult struct {
+	data map[string]interface{}
+	err  error
+}
+
+// NewBatcher creates a new *Batcher instance.
+func NewBatcher(config *BatcherConfig) *Batcher {
+	if config == nil {
+		config = &BatcherConfig{}
+	}
+	if config.Window == 0 {
+		config.Window = defaultBatchWindow
+	}
+	return &Batcher{
+		window:   config.Window,
+		compress: config.Compress,
+	}
+}
+
+// join registers a QueryHandler whose queries will be batched. A
+// batch is sent as soon as every registered QueryHandler has added
+// a query to it.
+func (b *Batcher) join() {
+	b.mu.Lock()
+	b.members++
+	b.mu.Unlock()
+}
+
+// search adds the query to the current batch and waits for its
+// response, which is the same as that of the _search API.
+func (b *Batcher) search(
+	ctx context.Context,
+	q *QueryHandler,
+	index string,
+	body map[string]interface{},
+) (map[string]interface{}, error) {
+	if q.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.queryTimeout)
+		defer cancel()
+	}
+
+	bq := &batchedQuery{
+		q:      q,
+		index:  index,
+		body:   body,
+		result: make(chan batchResult, 1),
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, bq)
+	if len(b.pending) >= b.members {
+		go b.send(b.take())
+	} else if b.timer == nil {
+		var timer *time.Timer
+		timer = time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			// The batch may have been sent already, in which case
+			// this timer belongs to it rather than to the next one
+			if b.timer == timer {
+				go b.send(b.take())
+			}
+		})
+		b.timer = timer
+	}
+	b.mu.Unlock()
+
+	select {
+	case res := <-bq.result:
+		return res.data, res.err
+	case <-ctx.Done():
+		return nil, xerrors.Errorf("error waiting for _msearch response: %v", ctx.Err())
+	}
+}
+
+// take removes the pending queries from the Batcher so that they
+// may be sent. b.mu must be held by the caller.
+func (b *Batcher) take() []*batchedQuery {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+// send sends the batch to the _msearch API and delivers each
+// response, or the error, to the query to which it belongs.
+func (b *Batcher) send(batch []*batchedQuery) {
+	responses, err := b.msearch(batch)
+	for i, bq := range batch {
+		if err != nil {
+			bq.result <- batchResult{err: err}
+			continue
+		}
+		data, respErr := batchResponse(responses[i])
+		bq.result <- batchResult{data: data, err: respErr}
+	}
+}
+
+func (b *Batcher) msearch(batch []*batchedQuery) ([]map[string]interface{}, error) {
+	// The batch is not bound to the context of any one rule so that
+	// it can outlive the rule which happened to complete it
+	var timeout time.Duration
+	names := make([]string, 0, len(batch))
+	for _, bq := range batch {
+		if bq.q.queryTimeout > timeout {
+			timeout = bq.q.queryTimeout
+		}
+		names = append(names, bq.q.name)
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Every QueryHandler of the Batcher uses the same client and
+	// Elasticsearch instance, so any of them can send the request
+	q := batch[0].q
+	q.logger.Debug("sending batched queries to the _msearch API", "rules", len(batch))
+
+	resp, err := q.doWithRetry(ctx, func() (*http.Request, error) {
+		payload, err := b.encode(batch)
+		if err != nil {
+			return nil, err
+		}
+		req, err := q.newRequest(ctx, http.MethodGet, q.esURL+"/_msearch", payload)
+		if err != nil {
+			return nil, xerrors.Errorf("error creating new request: %v", err)
+		}
+		req.Header.Set("Content-Type", ndjsonHeader)
+		if b.compress {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		req.Header.Set(ruleHeader, strings.Join(names, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, xerrors.Errorf("received non-200 response status from _msearch (status: %q). Response body:\n%s",
+			resp.Status, q.readErrRespBody(resp))
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+
+	var data struct {
+		Responses []map[string]interface{} `json:"responses"`
+	}
+	if err = dec.Decode(&data); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding _msearch response: %v", err)
+	}
+	if len(data.Responses) != len(batch) {
+		return nil, xerrors.Errorf("_msearch returned %d responses to %d queries", len(data.Responses), len(batch))
+	}
+	return data.Responses, nil
+}
+
+// encode creates the NDJSON body of the _msearch request, which
+// consists of a header naming the index and the body of each
+// query, optionally gzip-compressed.
+func (b *Batcher) encode(batch []*batchedQuery) (io.Reader, error) {
+	payload := &bytes.Buffer{}
+	var w io.Writer = payload
+	var zw *gzip.Writer
+	if b.compress {
+		zw = gzip.NewWriter(payload)
+		w = zw
+	}
+
+	enc := json.NewEncoder(w)
+	for _, bq := range batch {
+		if err := enc.Encode(map[string]string{"index": bq.index}); err != nil {
+			return nil, xerrors.Errorf("error JSON-encoding _msearch header: %v", err)
+		}
+		if err := enc.Encode(&bq.body); err != nil {
+			return nil, xerrors.Errorf("error JSON-encoding Elasticsearch query body: %v", err)
+		}
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, xerrors.Errorf("error compressing _msearch body: %v", err)
+		}
+	}
+	return payload, nil
+}
+
+// batchResponse returns one of the responses of the _msearch API
+// as if it had been returned by the _search API, or an error if
+// the query failed.
+func batchResponse(data map[string]interface{}) (map[string]interface{}, error) {
+	if e, ok := data["error"]; ok {
+		buf, err := json.MarshalIndent(e, "", "    ")
+		if err != nil {
+			buf = []byte(fmt.Sprintf("%v", e))
+		}
+		return nil, xerrors.Errorf("received error response from _msearch (status: %v). Response body:\n%s",
+			data["status"], buf)
+	}
+	delete(data, "status")
+	return data, nil
+}
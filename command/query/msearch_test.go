@@ -0,0 +1,226 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+// newMSearchServer creates a mock Elasticsearch server which
+// answers each query of an _msearch request with the index it was
+// sent to, or with an error if the index is "missing". It counts
+// the requests to the _msearch and _search APIs.
+func newMSearchServer(msearches, searches *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_search") {
+			atomic.AddInt32(searches, 1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"hits":{"hits":[]}}`)
+			return
+		}
+		if r.URL.Path != "/_msearch" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(msearches, 1)
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			body = zr
+		}
+
+		var responses []map[string]interface{}
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			var header map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !scanner.Scan() {
+				http.Error(w, "missing query body", http.StatusBadRequest)
+				return
+			}
+			if header["index"] == "missing" {
+				responses = append(responses, map[string]interface{}{
+					"error":  map[string]interface{}{"type": "index_not_found_exception"},
+					"status": 404,
+				})
+				continue
+			}
+			responses = append(responses, map[string]interface{}{
+				"hits":    map[string]interface{}{"hits": []interface{}{}},
+				"queried": header["index"],
+				"status":  200,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses}) // nolint: errcheck
+	}))
+}
+
+func newBatchedHandler(t *testing.T, url, index string, batcher *Batcher, countOnly bool) *QueryHandler {
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "rule-" + index,
+		Logger:       hclog.NewNullLogger(),
+		AlertMethods: []alert.Method{&checkMethod{}},
+		ESUrl:        url,
+		QueryIndex:   index,
+		QueryData:    map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}},
+		Schedule:     "@every 1m",
+		CountOnly:    countOnly,
+		Batcher:      batcher,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qh
+}
+
+func TestBatcher(t *testing.T) {
+	cases := []struct {
+		name     string
+		compress bool
+	}{
+		{"uncompressed", false},
+		{"compressed", true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var msearches, searches int32
+			ts := newMSearchServer(&msearches, &searches)
+			defer ts.Close()
+
+			// The window is long enough that the batch is only sent
+			// in time if it is sent as soon as every rule has joined
+			batcher := NewBatcher(&BatcherConfig{Window: time.Minute, Compress: tc.compress})
+
+			indices := []string{"index-0", "index-1", "missing", "<logs-{now/d}>"}
+			qhs := make([]*QueryHandler, 0, len(indices))
+			for _, index := range indices {
+				qhs = append(qhs, newBatchedHandler(t, ts.URL, index, batcher, false))
+			}
+
+			var wg sync.WaitGroup
+			results := make([]map[string]interface{}, len(qhs))
+			errs := make([]error, len(qhs))
+			for i, qh := range qhs {
+				wg.Add(1)
+				go func(i int, qh *QueryHandler) {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					results[i], errs[i] = qh.query(ctx)
+				}(i, qh)
+			}
+			wg.Wait()
+
+			if n := atomic.LoadInt32(&msearches); n != 1 {
+				t.Fatalf("expected 1 _msearch request, got %d", n)
+			}
+			if n := atomic.LoadInt32(&searches); n != 0 {
+				t.Fatalf("expected no _search requests, got %d", n)
+			}
+
+			for i, index := range indices {
+				if index == "missing" {
+					if errs[i] == nil || !strings.Contains(errs[i].Error(), "index_not_found_exception") {
+						t.Fatalf("unexpected error for index %q: %v", index, errs[i])
+					}
+					continue
+				}
+				if errs[i] != nil {
+					t.Fatalf("unexpected error for index %q: %v", index, errs[i])
+				}
+				if results[i]["queried"] != index {
+					t.Fatalf("response of index %q was routed to the wrong rule: %v", index, results[i])
+				}
+				if _, ok := results[i]["status"]; ok {
+					t.Fatalf("expected the status to be removed from the response: %v", results[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatcherWindow(t *testing.T) {
+	var msearches, searches int32
+	ts := newMSearchServer(&msearches, &searches)
+	defer ts.Close()
+
+	batcher := NewBatcher(&BatcherConfig{Window: 10 * time.Millisecond})
+	qh := newBatchedHandler(t, ts.URL, "index-0", batcher, false)
+	newBatchedHandler(t, ts.URL, "index-1", batcher, false)
+
+	// The other rule never queries, so the batch is sent once the
+	// window has elapsed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := qh.query(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["queried"] != "index-0" {
+		t.Fatalf("unexpected response: %v", data)
+	}
+	if n := atomic.LoadInt32(&msearches); n != 1 {
+		t.Fatalf("expected 1 _msearch request, got %d", n)
+	}
+}
+
+func TestBatcherExcluded(t *testing.T) {
+	var msearches, searches int32
+	ts := newMSearchServer(&msearches, &searches)
+	defer ts.Close()
+
+	batcher := NewBatcher(&BatcherConfig{Window: time.Minute})
+	qh := newBatchedHandler(t, ts.URL, "index-0", batcher, false)
+	excluded := newBatchedHandler(t, ts.URL, "index-1", batcher, true)
+	if excluded.batcher != nil {
+		t.Fatal("expected a rule with 'count_only' set not to be batched")
+	}
+
+	// Only one rule was batched, so its batch is sent immediately
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := qh.query(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&msearches); n != 1 {
+		t.Fatalf("expected 1 _msearch request, got %d", n)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"golang.org/x/xerrors"
+)
+
+// RunOnce executes the query a single time and sends the alerts
+// which are due with send: that of the rule or, if the rule has
+// evaluations, those of the evaluations which were met. Unlike Run,
+// it ignores the schedule and the 'first_run' setting, but the
+// records are otherwise suppressed as Run would suppress them (see
+// suppress). An alert which send fails to deliver does not start a
+// cooldown, so it is sent again by the next run. If maintainState
+// is true, the state of the rule (e.g. when it last alerted) is
+// restored from the state indices beforehand and a new state
+// document is written once the alerts have been sent; otherwise,
+// the state indices are not used at all. An evaluation or an alert
+// which fails does not prevent the others from being sent, and
+// their errors are returned together.
+func (q *QueryHandler) RunOnce(
+	ctx context.Context,
+	maintainState bool,
+	send func(context.Context, *alert.Alert) error,
+) error {
+	if maintainState {
+		if _, err := q.getNextQuery(ctx); err != nil {
+			q.logger.Warn(fmt.Sprintf("[Rule: %q] error looking up state in Elasticsearch", q.name), "error", err)
+		}
+	}
+
+	var (
+		pending []*queuedAlert
+		hits    []map[string]interface{}
+		merr    *multierror.Error
+	)
+	if len(q.evaluations) == 0 {
+		records, h, err := q.execute(ctx)
+		if err != nil {
+			return err
+		}
+		hits = h
+		qa, err := q.onceAlert(records)
+		if err != nil {
+			return err
+		}
+		if qa != nil {
+			pending = append(pending, qa)
+		}
+	} else {
+		runAt := q.clk().Now()
+		data, h, err := q.queryResponse(ctx)
+		if err != nil {
+			return err
+		}
+		hits = h
+		q.lastRun = runAt
+		pending, merr = q.evaluateOnce(data, runAt)
+	}
+
+	for _, qa := range pending {
+		if err := send(ctx, qa.alert); err != nil {
+			merr = multierror.Append(merr, xerrors.Errorf("error sending alert from rule %q: %v", qa.alert.RuleName, err))
+			q.recordDelivery(delivery{queuedAlert: qa})
+		}
+	}
+	for _, eq := range q.evaluations {
+		if eq.lastAlert.After(q.lastAlert) {
+			q.lastAlert = eq.lastAlert
+		}
+	}
+
+	if maintainState {
+		if err := q.setNextQuery(ctx, q.schedule.Next(q.clk().Now()), hits); err != nil {
+			merr = multierror.Append(merr, xerrors.Errorf("error creating next query document in Elasticsearch: %v",
+				err))
+		}
+	}
+	return merr.ErrorOrNil()
+}
+
+// evaluateOnce hands the response to the query of the rule to each
+// of its evaluations, as cycleEvaluations does, and returns the
+// alerts of those which were met along with the errors of those
+// which failed.
+func (q *QueryHandler) evaluateOnce(
+	data map[string]interface{},
+	runAt time.Time,
+) ([]*queuedAlert, *multierror.Error) {
+	var (
+		pending []*queuedAlert
+		merr    *multierror.Error
+	)
+	for _, eq := range q.evaluations {
+		records, _, err := eq.process(data)
+		if err != nil {
+			merr = multierror.Append(merr, xerrors.Errorf("error processing response in evaluation %s: %v",
+				eq.name, err))
+			continue
+		}
+		eq.observe(records, runAt)
+
+		qa, err := eq.onceAlert(records)
+		if err != nil {
+			merr = multierror.Append(merr, xerrors.Errorf("error in evaluation %s: %v", eq.name, err))
+			continue
+		}
+		if qa != nil {
+			pending = append(pending, qa)
+		}
+	}
+	return pending, merr
+}
+
+// onceAlert returns the alert made of the records produced by an
+// execution of the query, or nil if they are suppressed. The alert
+// starts the cooldown of the rule and of its dedup keys, which
+// recordDelivery undoes if it cannot be delivered.
+func (q *QueryHandler) onceAlert(records []*alert.Record) (*queuedAlert, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	now := q.clk().Now()
+	records, dedupKeys, suppressed := q.suppress(records, false, now)
+	if suppressed {
+		return nil, nil
+	}
+
+	a, err := q.newAlert(records)
+	if err != nil {
+		return nil, xerrors.Errorf("error creating new random UUID: %v", err)
+	}
+	qa := &queuedAlert{
+		alert:         a,
+		sentAt:        now,
+		previousAlert: q.lastAlert,
+		dedupKeys:     dedupKeys,
+		handler:       q,
+	}
+	q.lastAlert = now
+	q.markDedupKeys(dedupKeys, now)
+	return qa, nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"golang.org/x/xerrors"
+)
+
+func TestRunOnce(t *testing.T) {
+	cases := []struct {
+		name          string
+		maintainState bool
+		lastAlert     time.Duration
+		firingSince   time.Duration
+		minMatches    int
+		alert         bool
+		stateRequests int32
+	}{
+		{"no-state", false, 0, 0, 0, true, 0},
+		{"state", true, 0, 0, 0, true, 2},
+		{"state-cooldown", true, 5 * time.Minute, 0, 0, false, 2},
+		{"state-reminder", true, 20 * time.Minute, time.Hour, 0, true, 2},
+		{"min-matches", false, 0, 0, 2, false, 0},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var stateRequests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case strings.HasPrefix(r.URL.Path, "/test-index/"):
+					w.Write([]byte(`{"hits": {"hits": [{"_source": {"message": "error"}}]}}`))
+				case strings.Contains(r.URL.Path, "go-es-alerts-head"):
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				case strings.Contains(r.URL.Path, "go-es-alerts") && r.Method == http.MethodGet:
+					atomic.AddInt32(&stateRequests, 1)
+					last := ""
+					if tc.lastAlert > 0 {
+						last = fmt.Sprintf(`, "last_alert": %q`, time.Now().Add(-tc.lastAlert).Format(time.RFC3339))
+					}
+					if tc.firingSince > 0 {
+						last += fmt.Sprintf(`, "firing_since": %q`, time.Now().Add(-tc.firingSince).Format(time.RFC3339))
+					}
+					fmt.Fprintf(w, `{"hits": {"hits": [{"_source": {"next_query": %q%s}}]}}`,
+						time.Now().Add(time.Hour).Format(time.RFC3339), last)
+				case strings.Contains(r.URL.Path, "go-es-alerts"):
+					atomic.AddInt32(&stateRequests, 1)
+					w.WriteHeader(http.StatusCreated)
+					w.Write([]byte(`{"result": "created"}`))
+				default:
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Once",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-index",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+				},
+				Schedule:         "@every 10m",
+				AlertCooldown:    30 * time.Minute,
+				ReminderInterval: 15 * time.Minute,
+				MinMatches:       tc.minMatches,
+				FirstRun:         "suppress",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var alerts []*alert.Alert
+			err = qh.RunOnce(context.Background(), tc.maintainState, func(_ context.Context, a *alert.Alert) error {
+				alerts = append(alerts, a)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.alert != (len(alerts) == 1) || len(alerts) > 1 {
+				t.Fatalf("unexpected alerts (got %+v, expected alert: %t)", alerts, tc.alert)
+			}
+			if len(alerts) == 1 && (alerts[0].RuleName != "Test Once" || len(alerts[0].Records) != 1) {
+				t.Fatalf("unexpected alert: %+v", alerts[0])
+			}
+			if n := atomic.LoadInt32(&stateRequests); n != tc.stateRequests {
+				t.Fatalf("unexpected number of requests to the state indices (got %d, expected %d)", n, tc.stateRequests)
+			}
+		})
+	}
+}
+
+func TestRunOnceEvaluations(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+  "hits": {"hits": [{"_source": {"message": "error"}}]},
+  "aggregations": {"errors": {"doc_count": 20}, "latency": {"value": 100}}
+}`))
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:       "Test Once",
+		Logger:     hclog.NewNullLogger(),
+		ESUrl:      ts.URL,
+		QueryIndex: "test-index",
+		QueryData:  map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:   "@every 10m",
+		Evaluations: []Evaluation{
+			{
+				Name: "errors",
+				Conditions: []config.Condition{
+					{"field": "aggregations.errors.doc_count", "quantifier": "any", "gt": json.Number("10")},
+				},
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+			},
+			{
+				Name: "latency",
+				Conditions: []config.Condition{
+					{"field": "aggregations.latency.value", "quantifier": "any", "gt": json.Number("500")},
+				},
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var alerts []*alert.Alert
+	err = qh.RunOnce(context.Background(), false, func(_ context.Context, a *alert.Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].RuleName != "Test Once/errors" {
+		t.Fatalf("unexpected alerts: %+v", alerts)
+	}
+}
+
+func TestRunOnceSendFails(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		state []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/test-index/"):
+			w.Write([]byte(`{"aggregations": {"hostname": {"buckets": [{"key": "db-1", "doc_count": 1}]}}}`))
+		case strings.Contains(r.URL.Path, "go-es-alerts-head"):
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case strings.Contains(r.URL.Path, "go-es-alerts") && r.Method == http.MethodGet:
+			w.Write([]byte(`{"hits": {"hits": []}}`))
+		case strings.Contains(r.URL.Path, "go-es-alerts"):
+			body, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			state = append(state, string(body))
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"result": "created"}`))
+		default:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:          "Test Once",
+		Logger:        hclog.NewNullLogger(),
+		ESUrl:         ts.URL,
+		QueryIndex:    "test-index",
+		AlertMethods:  []alert.Method{&file.AlertMethod{}},
+		QueryData:     map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:      "@every 10m",
+		Filters:       []string{"aggregations.hostname.buckets"},
+		AlertCooldown: 30 * time.Minute,
+		DedupKeyField: "aggregations.hostname.buckets",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The alert cannot be delivered, so it must not start a cooldown
+	// either in memory or in the state document
+	sends := 0
+	err = qh.RunOnce(context.Background(), true, func(context.Context, *alert.Alert) error {
+		sends++
+		return xerrors.New("test error")
+	})
+	if err == nil || !strings.Contains(err.Error(), "test error") {
+		t.Fatalf("expected the error of the send (got %v)", err)
+	}
+	if sends != 1 {
+		t.Fatalf("expected 1 send (got %d)", sends)
+	}
+	mu.Lock()
+	if len(state) != 1 || strings.Contains(state[0], "last_alert") || strings.Contains(state[0], "dedup_keys") {
+		t.Fatalf("the undelivered alert should not be recorded in the state document (got %v)", state)
+	}
+	mu.Unlock()
+
+	// The next run alerts again
+	err = qh.RunOnce(context.Background(), true, func(context.Context, *alert.Alert) error {
+		sends++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sends != 2 {
+		t.Fatalf("expected the alert to be sent again (got %d sends)", sends)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(state) != 2 || !strings.Contains(state[1], "last_alert") || !strings.Contains(state[1], "dedup_keys") {
+		t.Fatalf("the delivered alert should be recorded in the state document (got %v)", state)
+	}
+}
+
+func TestDelivered(t *testing.T) {
+	qh := &QueryHandler{
+		name:   "Test Delivered",
+		logger: hclog.NewNullLogger(),
+	}
+
+	if !qh.delivered(context.Background(), &alert.Alert{}) {
+		t.Fatal("alerts without a result should always be considered delivered")
+	}
+
+	undelivered := &alert.Alert{Result: make(chan error, 1)}
+	undelivered.Result <- fmt.Errorf("test error")
+	if qh.delivered(context.Background(), undelivered) {
+		t.Fatal("best-effort alert should not be considered delivered when no output delivered it")
+	}
+
+	ok := &alert.Alert{RequireAllOutputs: true, Result: make(chan error, 1)}
+	ok.Result <- nil
+	if !qh.delivered(context.Background(), ok) {
+		t.Fatal("alert should be considered delivered when every output succeeded")
+	}
+
+	failed := &alert.Alert{RequireAllOutputs: true, Result: make(chan error, 1)}
+	failed.Result <- fmt.Errorf("test error")
+	if qh.delivered(context.Background(), failed) {
+		t.Fatal("alert should not be considered delivered when an output failed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if qh.delivered(ctx, &alert.Alert{RequireAllOutputs: true, Result: make(chan error, 1)}) {
+		t.Fatal("alert should not be considered delivered when the context is canceled")
+	}
+}
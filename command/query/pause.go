@@ -0,0 +1,64 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrPaused is the error of an on-demand execution requested of a
+// paused QueryHandler.
+var ErrPaused = xerrors.New("rule is paused")
+
+// Pause stops the QueryHandler from executing its query until
+// Resume is called, e.g. during a deploy known to be noisy. Its
+// schedule keeps running and its state (e.g. the alert cooldown) is
+// kept as is, so that it resumes at its next scheduled execution as
+// if it had not been paused; the executions it skipped are not made
+// up for. It returns false if the QueryHandler was already paused.
+// It is safe to call while Run is running.
+func (q *QueryHandler) Pause() bool {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+
+	if q.status.Paused {
+		return false
+	}
+	q.status.Paused = true
+	q.status.PausedSince = q.clk().Now()
+	return true
+}
+
+// Resume undoes Pause. It returns false if the QueryHandler was not
+// paused.
+func (q *QueryHandler) Resume() bool {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+
+	if !q.status.Paused {
+		return false
+	}
+	q.status.Paused = false
+	q.status.PausedSince = time.Time{}
+	return true
+}
+
+// Paused returns whether the QueryHandler is paused.
+func (q *QueryHandler) Paused() bool {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	return q.status.Paused
+}
@@ -0,0 +1,183 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+)
+
+func TestPause(t *testing.T) {
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Pause",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ElasticsearchURL,
+		QueryIndex:   "test-*",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData:    map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:     "@every 10m",
+		Clock:        fc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		op      func() bool
+		changed bool
+		paused  bool
+	}{
+		{"resume-running", qh.Resume, false, false},
+		{"pause", qh.Pause, true, true},
+		{"pause-paused", qh.Pause, false, true},
+		{"resume", qh.Resume, true, false},
+		{"pause-again", qh.Pause, true, true},
+	}
+	for _, step := range steps {
+		fc.Advance(time.Minute)
+		if changed := step.op(); changed != step.changed {
+			t.Fatalf("%s: unexpected change (got %t, expected %t)", step.name, changed, step.changed)
+		}
+		status := qh.Status()
+		if qh.Paused() != step.paused || status.Paused != step.paused {
+			t.Fatalf("%s: unexpected paused state (got %t, expected %t)", step.name, status.Paused, step.paused)
+		}
+		if step.paused == status.PausedSince.IsZero() {
+			t.Fatalf("%s: unexpected time since which the rule is paused: %s", step.name, status.PausedSince)
+		}
+	}
+
+	// The time is that of the latest pause rather than the first
+	if since := qh.Status().PausedSince; !since.Equal(start.Add(5 * time.Minute)) {
+		t.Fatalf("unexpected time since which the rule is paused (got %s, expected %s)", since, start.Add(5*time.Minute))
+	}
+}
+
+func TestRunPaused(t *testing.T) {
+	queryIndex := randomUUID(t)
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+
+	var queries, states int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/%s-%s/_search", defaultStateIndexAlias, templateVersion):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"hits":{"hits":[{"_source":{"next_query":%q}}]}}`,
+				start.Add(time.Hour).Format(time.RFC3339))
+		case fmt.Sprintf("/<%s-status-%s-{now/d}>/_doc", defaultStateIndexAlias, templateVersion):
+			atomic.AddInt32(&states, 1)
+			w.WriteHeader(201)
+		case fmt.Sprintf("/%s/_search", queryIndex):
+			atomic.AddInt32(&queries, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hits":{"hits":[{"_source":{"hello":"world"}}]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	fileAM, err := file.NewAlertMethod(&file.AlertMethodConfig{
+		OutputFilepath: filepath.Join("testdata", "testfile.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Run Paused",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   queryIndex,
+		AlertMethods: []alert.Method{fileAM},
+		QueryData:    map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:     "@every 10m",
+		Clock:        fc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	outputCh := make(chan *alert.Alert, 1)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+	fc.BlockUntil(1)
+	qh.Pause()
+
+	// The paused query keeps to its schedule without running
+	for i := 0; i < 2; i++ {
+		advance := 10 * time.Minute
+		if i == 0 {
+			advance = time.Hour
+		}
+		fc.Advance(advance)
+		fc.BlockUntil(1)
+		if n := atomic.LoadInt32(&queries); n != 0 {
+			t.Fatalf("paused query ran %d times", n)
+		}
+		if n := atomic.LoadInt32(&states); n != 0 {
+			t.Fatalf("paused query updated its state %d times", n)
+		}
+		expected := start.Add(time.Hour + time.Duration(i+1)*10*time.Minute)
+		if status := qh.Status(); !status.NextRun.Equal(expected) || status.LastResult != "" {
+			t.Fatalf("unexpected status of the paused query: %+v", status)
+		}
+	}
+
+	if _, err = qh.Trigger(ctx); err != ErrPaused {
+		t.Fatalf("unexpected error of an on-demand execution (got %v, expected %v)", err, ErrPaused)
+	}
+
+	qh.Resume()
+	fc.Advance(10 * time.Minute)
+	select {
+	case <-outputCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an alert of the resumed query")
+	}
+	fc.BlockUntil(1)
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("expected the resumed query to run once (got %d)", n)
+	}
+	if status := qh.Status(); status.LastResult != ResultAlert || status.Paused {
+		t.Fatalf("unexpected status of the resumed query: %+v", status)
+	}
+}
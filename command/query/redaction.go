@@ -0,0 +1,80 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+// redact returns copies of the records in which the values redacted
+// by the rule (see config.Redaction) are masked, so that they are
+// not sent to the outputs. The records themselves are not modified
+// since their original values are still used, e.g. as dedup keys.
+func (q *QueryHandler) redact(records []*alert.Record) []*alert.Record {
+	r := q.redaction
+	if r == nil {
+		return records
+	}
+	redacted := make([]*alert.Record, 0, len(records))
+	for _, record := range records {
+		rec := *record
+		rec.Text = r.Text(record.Text)
+		if record.BodyField {
+			rec.Text = q.redactHits(record.Text)
+			rec.Documents = make([]map[string]interface{}, 0, len(record.Documents))
+			for _, doc := range record.Documents {
+				rec.Documents = append(rec.Documents, r.Document(doc))
+			}
+		}
+		if record.Fields != nil {
+			rec.Fields = make([]*alert.Field, 0, len(record.Fields))
+			for _, f := range record.Fields {
+				field := *f
+				field.Key = r.Key(record.Filter, f.Key)
+				field.Value = r.Text(f.Value)
+				field.TopHit = r.Document(f.TopHit)
+				rec.Fields = append(rec.Fields, &field)
+			}
+		}
+		redacted = append(redacted, &rec)
+	}
+	return redacted
+}
+
+// redactHits redacts the text of a record of the body field, i.e.
+// the hits stringified by gatherHits. The hits which are documents
+// are decoded so that their redacted fields are masked as well.
+func (q *QueryHandler) redactHits(text string) string {
+	hits := strings.Split(text, hitsDelimiter)
+	for i, hit := range hits {
+		var doc map[string]interface{}
+		dec := json.NewDecoder(strings.NewReader(hit))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil || doc == nil || dec.More() {
+			hits[i] = q.redaction.Text(hit)
+			continue
+		}
+		// Encoded like gatherHits does
+		data, err := json.MarshalIndent(q.redaction.Document(doc), "", "    ")
+		if err != nil {
+			hits[i] = q.redaction.Text(hit)
+			continue
+		}
+		hits[i] = string(data)
+	}
+	return strings.Join(hits, hitsDelimiter)
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	hclog "github.com/hashicorp/go-hclog"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+func TestRedact(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "redaction.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var input map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	redaction, err := config.ParseRedaction(&config.RedactionConfig{
+		Fields:   []string{"token", "aggregations.by_email.buckets"},
+		Patterns: []string{`[\w.+-]+@[\w-]+\.[\w.]+`, `\b\d{16}\b`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qh := &QueryHandler{
+		logger:    hclog.NewNullLogger(),
+		filters:   []string{"aggregations.by_email.buckets", "aggregations.by_message.buckets"},
+		bodyField: defaultBodyField,
+		redaction: redaction,
+	}
+	records, _, err := qh.process(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := qh.newAlert(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*alert.Record{
+		{
+			// The keys of a filter named in the fields are masked
+			Filter: "aggregations.by_email.buckets",
+			Fields: []*alert.Field{
+				{
+					Key:   "***",
+					Count: 3,
+					TopHit: map[string]interface{}{
+						"message": "payment by *** declined",
+						"token":   "***",
+					},
+				},
+			},
+		},
+		{
+			// Otherwise only the matches of the patterns are
+			Filter: "aggregations.by_message.buckets",
+			Fields: []*alert.Field{
+				{Key: "card *** expired", Count: 2},
+				{Key: "payment declined", Count: 1},
+			},
+		},
+		{
+			Filter: defaultBodyField,
+			Text: `{
+    "message": "payment by *** declined",
+    "user": {
+        "email": "***",
+        "token": "***"
+    }
+}` + hitsDelimiter + `{
+    "message": "card *** expired",
+    "user": {
+        "email": "***",
+        "token": "***"
+    }
+}`,
+			BodyField: true,
+			Documents: []map[string]interface{}{
+				{
+					"message": "payment by *** declined",
+					"user":    map[string]interface{}{"email": "***", "token": "***"},
+				},
+				{
+					"message": "card *** expired",
+					"user":    map[string]interface{}{"email": "***", "token": "***"},
+				},
+			},
+		},
+	}
+	if !cmp.Equal(expected, a.Records) {
+		t.Errorf("Results differ:\n%v", cmp.Diff(expected, a.Records))
+	}
+
+	// The records themselves are not modified
+	if key := records[0].Fields[0].Key; key != "alice@example.com" {
+		t.Errorf("unexpected key of the original record: %q", key)
+	}
+	if token := records[2].Documents[0]["user"].(map[string]interface{})["token"]; token != "tok_5f2b" {
+		t.Errorf("unexpected token of the original document: %v", token)
+	}
+	if !strings.Contains(records[2].Text, "alice@example.com") {
+		t.Errorf("unexpected text of the original record:\n%s", records[2].Text)
+	}
+
+	// Without a redaction the records are sent as they are
+	qh.redaction = nil
+	if a, err = qh.newAlert(records); err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(records, a.Records) {
+		t.Errorf("Results differ:\n%v", cmp.Diff(records, a.Records))
+	}
+}
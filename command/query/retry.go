@@ -0,0 +1,166 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRetryBackoff and defaultMaxRetryBackoff bound the
+	// backoff between retries if Retry does not
+	defaultRetryBackoff    = 500 * time.Millisecond
+	defaultMaxRetryBackoff = 10 * time.Second
+
+	// maxRetryAfter is the longest Retry-After of a rate-limited
+	// response which is waited out before retrying. Requests asked
+	// to wait any longer fail instead of holding up the rule
+	maxRetryAfter = 2 * time.Minute
+)
+
+// Retry configures the retries of queries which fail because of a
+// transient error, i.e. a connection error or a 429 or 5xx response.
+// Other responses, e.g. a 400 because of a bad query, are never
+// retried.
+type Retry struct {
+	// MaxRetries is the maximum number of times a query is retried
+	MaxRetries int
+
+	// InitialBackoff is the backoff before the first retry, which
+	// doubles with every retry up to MaxBackoff. If zero,
+	// defaultRetryBackoff and defaultMaxRetryBackoff are used
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// doWithRetry sends the request built by newReq, retrying with
+// capped exponential backoff per q.retry while the request fails
+// with a connection error or a retriable status (see
+// retriableStatus). A rate-limited response is not retried before
+// its Retry-After has passed, nor at all if that is more than
+// maxRetryAfter away. It stops retrying once ctx is done, so the
+// query timeout bounds all of the attempts. The response or error
+// of the last attempt is returned.
+func (q *QueryHandler) doWithRetry(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := q.do(req)
+		var (
+			after    time.Duration
+			hasAfter bool
+		)
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			after, hasAfter = retryAfter(resp.Header.Get("Retry-After"), q.clk().Now())
+			q.logger.Warn(fmt.Sprintf("[Rule: %q] Elasticsearch is rate limiting requests, "+
+				"consider lengthening the schedule of the rule", q.name),
+				"retry_after", resp.Header.Get("Retry-After"))
+		}
+		if q.retry == nil || attempt >= q.retry.MaxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil && !retriableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if hasAfter && after > maxRetryAfter {
+			return resp, nil
+		}
+
+		wait := retryBackoff(attempt, q.retry.InitialBackoff, q.retry.MaxBackoff)
+		if hasAfter && after > wait {
+			wait = after
+		}
+		reason := "error"
+		var cause interface{} = err
+		if err == nil {
+			reason, cause = "status", resp.Status
+			// Drain the body so that the connection can be reused
+			io.Copy(ioutil.Discard, resp.Body) // nolint: errcheck
+			resp.Body.Close()
+		}
+		q.logger.Warn(fmt.Sprintf("[Rule: %q] retrying Elasticsearch request", q.name),
+			reason, cause, "attempt", attempt+1, "backoff", wait.String())
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return nil, err
+		case <-q.clk().After(wait):
+		}
+	}
+}
+
+// retriableStatus returns whether a request which received a
+// response with the given status may succeed if it is sent again,
+// i.e. if Elasticsearch is rate limiting (429) or is unavailable or
+// overloaded (5xx).
+func retriableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryAfter parses the value of a Retry-After header, either a
+// number of seconds or an HTTP date, into how long after now the
+// request may be retried. It returns false if the header is absent
+// or malformed.
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// retryBackoff returns how long to wait before the given retry
+// attempt (starting at zero). The delay doubles with every attempt
+// up to max, and is jittered so that the rules of an overloaded
+// cluster do not retry in lockstep.
+func retryBackoff(attempt int, base, max time.Duration) time.Duration {
+	if base <= 0 {
+		base, max = defaultRetryBackoff, defaultMaxRetryBackoff
+	}
+	if max < base {
+		max = base
+	}
+	d := max
+	if attempt < 32 && base<<uint(attempt) > 0 && base<<uint(attempt) < max {
+		d = base << uint(attempt)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) // nolint: gosec
+}
@@ -0,0 +1,213 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+func TestQueryRetry(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+		timeout  time.Duration
+		requests int32
+		atMost   bool
+		err      bool
+	}{
+		{"unavailable-then-ok", []int{503, 503, 200}, 0, 3, false, false},
+		{"rate-limited-then-ok", []int{429, 200}, 0, 2, false, false},
+		{"bad-request", []int{400, 200}, 0, 1, false, true},
+		{"retries-exhausted", []int{500, 502, 503, 504, 200}, 0, 4, false, true},
+		// The query timeout bounds the retries
+		{"timeout", []int{503, 503, 503, 503, 200}, 50 * time.Millisecond, 3, true, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				w.WriteHeader(tc.statuses[n-1])
+				w.Write([]byte(`{"hits": {"total": 0}}`))
+			}))
+			defer ts.Close()
+
+			retry := &Retry{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+			if tc.timeout > 0 {
+				retry.InitialBackoff, retry.MaxBackoff = 40*time.Millisecond, 40*time.Millisecond
+			}
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Retry",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-*",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"hello": "world",
+				},
+				Schedule:     "@every 10m",
+				QueryTimeout: tc.timeout,
+				Retry:        retry,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = qh.query(context.Background())
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+			if n := atomic.LoadInt32(&requests); n != tc.requests && !(tc.atMost && n < tc.requests) {
+				t.Fatalf("unexpected number of requests (got %d, expected %d)", n, tc.requests)
+			}
+		})
+	}
+}
+
+func TestQueryRetryAfter(t *testing.T) {
+	cases := []struct {
+		name       string
+		retryAfter string
+		requests   int32
+		err        bool
+	}{
+		{"retry-after", "30", 2, false},
+		{"retry-after-too-long", "600", 1, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) == 1 {
+					w.Header().Set("Retry-After", tc.retryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+					w.Write([]byte(`{"error": "too many requests"}`))
+					return
+				}
+				w.Write([]byte(`{"hits": {"total": 0}}`))
+			}))
+			defer ts.Close()
+
+			clk := clock.NewFake(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Retry-After",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "test-*",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData: map[string]interface{}{
+					"hello": "world",
+				},
+				Schedule: "@every 10m",
+				Retry:    &Retry{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+				Clock:    clk,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := qh.query(context.Background())
+				errCh <- err
+			}()
+
+			if tc.requests > 1 {
+				// The backoff of the retry is the Retry-After rather
+				// than the much shorter configured backoff
+				clk.BlockUntil(1)
+				clk.Advance(29 * time.Second)
+				if n := atomic.LoadInt32(&requests); n != 1 {
+					t.Fatalf("retried before Retry-After passed (got %d requests)", n)
+				}
+				clk.Advance(time.Second)
+			}
+
+			err = <-errCh
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+			if n := atomic.LoadInt32(&requests); n != tc.requests {
+				t.Fatalf("unexpected number of requests (got %d, expected %d)", n, tc.requests)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"Wed, 01 Jan 2020 00:00:30 GMT", 30 * time.Second, true},
+		{"Tue, 31 Dec 2019 23:59:00 GMT", 0, true},
+	}
+	for _, tc := range cases {
+		d, ok := retryAfter(tc.header, now)
+		if d != tc.expected || ok != tc.ok {
+			t.Errorf("unexpected Retry-After of %q (got %s, %t, expected %s, %t)", tc.header, d, ok, tc.expected, tc.ok)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cases := []struct {
+		attempt  int
+		base     time.Duration
+		max      time.Duration
+		expected time.Duration
+	}{
+		{0, time.Second, 10 * time.Second, time.Second},
+		{2, time.Second, 10 * time.Second, 4 * time.Second},
+		{5, time.Second, 10 * time.Second, 10 * time.Second},
+		{62, time.Hour, 2 * time.Hour, 2 * time.Hour},
+		{0, 0, 0, defaultRetryBackoff},
+	}
+	for _, tc := range cases {
+		for i := 0; i < 10; i++ {
+			d := retryBackoff(tc.attempt, tc.base, tc.max)
+			if d < tc.expected/2 || d > tc.expected {
+				t.Fatalf("backoff of attempt %d (base %s, max %s) out of range (got %s, expected between %s and %s)",
+					tc.attempt, tc.base, tc.max, d, tc.expected/2, tc.expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,541 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"github.com/morningconsult/go-elasticsearch-alerts/version"
+	"golang.org/x/xerrors"
+)
+
+// Statuses of the documents of the retry index.
+const (
+	// RetryPending is the status of a queued alert which is yet to
+	// be sent
+	RetryPending = "pending"
+
+	// RetryDelivered is the status of a queued alert which has
+	// been sent
+	RetryDelivered = "delivered"
+
+	// RetryDead is the status of a queued alert which could not be
+	// sent after the maximum number of attempts
+	RetryDead = "dead"
+)
+
+const (
+	defaultRetryMaxAttempts = 10
+	defaultRetryInterval    = 1 * time.Minute
+	maxRetryBackoff         = 1 * time.Hour
+
+	// retryClaimTimeout is how long a process which has claimed a
+	// queued alert has to send it before another process may claim
+	// it, e.g. if the first process exited while sending it
+	retryClaimTimeout = 5 * time.Minute
+
+	// retryBatchSize is the maximum number of queued alerts which
+	// are retried at a time
+	retryBatchSize = 100
+
+	// retryWriteTimeout is how long queueing an alert may take
+	retryWriteTimeout = 30 * time.Second
+)
+
+// Ensure RetryQueue adheres to the alert.Retrier interface.
+var _ alert.Retrier = (*RetryQueue)(nil)
+
+// RetryQueueConfig is used to configure a RetryQueue.
+type RetryQueueConfig struct {
+	// Client is the HTTP client used to communicate with
+	// Elasticsearch. If nil, a default client will be used
+	Client *http.Client
+
+	// ESUrl is the URL of the Elasticsearch instance
+	ESUrl string
+
+	// UserAgent is appended to version.UserAgent() to form the
+	// User-Agent header sent with each request
+	UserAgent string
+
+	// Headers are additional headers sent with each request
+	Headers map[string]string
+
+	// MaxAttempts is how many times a queued alert is retried
+	// before it is marked dead. If zero, a default of 10 will be
+	// used
+	MaxAttempts int
+
+	// RetryInterval is how often the queue is checked for alerts
+	// due to be retried, and how long after the first failed
+	// attempt an alert is retried. The delay doubles after each
+	// failed retry, up to an hour. If zero, a default of one minute
+	// will be used
+	RetryInterval time.Duration
+
+	// Logger is the logger used to log retries. If nil, a default
+	// logger will be used
+	Logger hclog.Logger
+
+	// Clock is used to tell the time. If nil, the system clock is
+	// used
+	Clock clock.Clock
+}
+
+// RetryQueue persists alerts which could not be sent with one of
+// their outputs as documents of the retry index, each with its
+// status, number of attempts and time of its next attempt, and
+// retries them in the background (see Run). Since the queue is kept
+// in Elasticsearch, alerts are retried across restarts and by any of
+// the processes sharing the Elasticsearch instance: a process claims
+// an alert before retrying it by postponing its next attempt, and
+// every write is conditional on the sequence number and primary term
+// read before it, so that only one process retries each alert at a
+// time. Each queued alert is retried with the output of the same rule
+// which failed to send it, as set by SetMethods.
+type RetryQueue struct {
+	client      *http.Client
+	esURL       string
+	userAgent   string
+	headers     map[string]string
+	maxAttempts int
+	interval    time.Duration
+	logger      hclog.Logger
+	clock       clock.Clock
+	newRequest  func(ctx context.Context, method, url string, data io.Reader) (*http.Request, error)
+
+	mu      sync.Mutex
+	methods map[string][]alert.Method
+}
+
+// retryDoc is a queued alert, a document of the retry index. Output
+// is the index of the failed output among the outputs of the rule.
+// Query is only recorded, redacted, if the output includes it (see
+// alert.QueryIncluder).
+type retryDoc struct {
+	Rule        string                 `json:"rule_name"`
+	AlertID     string                 `json:"alert_id,omitempty"`
+	FireCount   int                    `json:"fire_count,omitempty"`
+	FirstFired  time.Time              `json:"first_fired"`
+	Query       map[string]interface{} `json:"query,omitempty"`
+	Output      int                    `json:"output"`
+	OutputType  string                 `json:"output_type"`
+	Records     []*retryRecord         `json:"records"`
+	Status      string                 `json:"status"`
+	Attempts    int                    `json:"attempts"`
+	NextAttempt time.Time              `json:"next_attempt"`
+	QueuedAt    time.Time              `json:"queued_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+	LastError   string                 `json:"last_error,omitempty"`
+}
+
+// retryRecord preserves the BodyField and Documents of a Record,
+// which are otherwise not JSON-encoded.
+type retryRecord struct {
+	*alert.Record
+	BodyField bool                     `json:"body_field,omitempty"`
+	Documents []map[string]interface{} `json:"documents,omitempty"`
+}
+
+// retryHit is a queued alert found by searching the retry index.
+type retryHit struct {
+	docVersion
+	ID     string   `json:"_id"`
+	Source retryDoc `json:"_source"`
+}
+
+// NewRetryQueue creates a new *RetryQueue instance.
+func NewRetryQueue(config *RetryQueueConfig) (*RetryQueue, error) {
+	if config == nil {
+		return nil, xerrors.New("no config provided")
+	}
+	if config.ESUrl == "" {
+		return nil, xerrors.New("no Elasticsearch URL provided")
+	}
+	reqFunc, err := buildHTTPRequestFunc()
+	if err != nil {
+		return nil, err
+	}
+	if config.Client == nil {
+		config.Client = cleanhttp.DefaultClient()
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = defaultRetryInterval
+	}
+	if config.Logger == nil {
+		config.Logger = hclog.Default()
+	}
+	if config.Clock == nil {
+		config.Clock = clock.Real()
+	}
+	return &RetryQueue{
+		client:      config.Client,
+		esURL:       strings.TrimRight(config.ESUrl, "/"),
+		userAgent:   version.UserAgentWith(config.UserAgent),
+		headers:     config.Headers,
+		maxAttempts: config.MaxAttempts,
+		interval:    config.RetryInterval,
+		logger:      config.Logger,
+		clock:       config.Clock,
+		newRequest:  reqFunc,
+	}, nil
+}
+
+// IndexName returns the name of the retry index.
+func (r *RetryQueue) IndexName() string {
+	return fmt.Sprintf("%s-retry-%s", defaultStateIndexAlias, templateVersion)
+}
+
+// SetMethods sets the outputs of each rule, by rule name, with
+// which queued alerts are retried. It should be called again
+// whenever the rules are reloaded.
+func (r *RetryQueue) SetMethods(methods map[string][]alert.Method) {
+	r.mu.Lock()
+	r.methods = methods
+	r.mu.Unlock()
+}
+
+// method returns the output with which the queued alert should be
+// retried, or nil if the rule no longer has that output.
+func (r *RetryQueue) method(qa *retryDoc) alert.Method {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	methods := r.methods[qa.Rule]
+	if qa.Output < 0 || qa.Output >= len(methods) {
+		return nil
+	}
+	if m := methods[qa.Output]; m.Name() == qa.OutputType {
+		return m
+	}
+	return nil
+}
+
+// CreateIndex creates the retry index with the mappings of the
+// queued alerts, unless it already exists.
+func (r *RetryQueue) CreateIndex(ctx context.Context) error {
+	payload := `{
+    "settings": {
+      "index": {
+        "number_of_shards": 1,
+        "auto_expand_replicas": "0-2"
+      }
+    },
+    "mappings": {
+      "properties": {
+        "rule_name": {"type": "keyword"},
+        "alert_id": {"type": "keyword"},
+        "output_type": {"type": "keyword"},
+        "status": {"type": "keyword"},
+        "attempts": {"type": "long"},
+        "next_attempt": {"type": "date"},
+        "queued_at": {"type": "date"},
+        "updated_at": {"type": "date"},
+        "last_error": {"type": "text"},
+        "query": {"enabled": false},
+        "records": {"enabled": false}
+      }
+    }
+  }`
+	resp, err := r.do(ctx, http.MethodPut, fmt.Sprintf("%s/%s", r.esURL, r.IndexName()), bytes.NewBufferString(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		body, _ := ioutil.ReadAll(resp.Body)
+		if bytes.Contains(body, []byte("resource_already_exists_exception")) {
+			return nil
+		}
+		return xerrors.Errorf("unexpected status code creating retry index: %d: %s", resp.StatusCode, body)
+	default:
+		return xerrors.Errorf("unexpected status code creating retry index: %d", resp.StatusCode)
+	}
+}
+
+// Write queues the alert so that it is retried with the output,
+// which is the one at the given index of alert.Methods.
+func (r *RetryQueue) Write(a *alert.Alert, output int) error {
+	records := make([]*retryRecord, 0, len(a.Records))
+	for _, record := range a.Records {
+		records = append(records, &retryRecord{
+			Record:    record,
+			BodyField: record.BodyField,
+			Documents: record.Documents,
+		})
+	}
+	now := r.clock.Now()
+	qa := &retryDoc{
+		Rule:        a.RuleName,
+		AlertID:     a.AlertID,
+		FireCount:   a.FireCount,
+		FirstFired:  a.FirstFired,
+		Query:       alert.IncludedQuery(a.Methods[output], a.Query),
+		Output:      output,
+		OutputType:  a.Methods[output].Name(),
+		Records:     records,
+		Status:      RetryPending,
+		NextAttempt: now.Add(r.interval),
+		QueuedAt:    now,
+		UpdatedAt:   now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), retryWriteTimeout)
+	defer cancel()
+	id := fmt.Sprintf("%d-%s-%d", now.UnixNano(), a.ID, output)
+	_, err := r.put(ctx, fmt.Sprintf("%s/%s/_create/%s", r.esURL, r.IndexName(), id), qa)
+	return err
+}
+
+// Run retries the queued alerts which are due at once and then
+// every RetryInterval until ctx is done.
+func (r *RetryQueue) Run(ctx context.Context) {
+	for {
+		r.Replay(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.clock.After(r.interval):
+		}
+	}
+}
+
+// Replay retries the queued alerts which are due and are not
+// claimed by another process. Alerts which are sent are marked
+// delivered, while those which have failed the maximum number of
+// attempts are marked dead.
+func (r *RetryQueue) Replay(ctx context.Context) {
+	hits, err := r.due(ctx)
+	if err != nil {
+		r.logger.Error("error searching for queued alerts", "error", err)
+		return
+	}
+	for _, hit := range hits {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		r.attempt(ctx, hit)
+	}
+}
+
+// attempt claims the queued alert and retries it, recording the
+// outcome in its document.
+func (r *RetryQueue) attempt(ctx context.Context, hit *retryHit) {
+	qa := &hit.Source
+	now := r.clock.Now()
+
+	// Claim the alert so that no other process retries it meanwhile
+	qa.NextAttempt, qa.UpdatedAt = now.Add(retryClaimTimeout), now
+	version, err := r.put(ctx, r.docURL(hit.ID, &hit.docVersion), qa)
+	if err != nil {
+		r.logger.Error("error claiming queued alert", "id", hit.ID, "error", err)
+		return
+	}
+	if version == nil {
+		r.logger.Debug("queued alert claimed by another process", "id", hit.ID)
+		return
+	}
+
+	err = r.retry(ctx, qa)
+	now = r.clock.Now()
+	qa.Attempts++
+	qa.UpdatedAt = now
+	switch {
+	case err == nil:
+		qa.Status, qa.LastError = RetryDelivered, ""
+		r.logger.Info(fmt.Sprintf("queued alert from rule %q sent", qa.Rule), "id", hit.ID, "method", qa.OutputType)
+	case qa.Attempts >= r.maxAttempts:
+		qa.Status, qa.LastError = RetryDead, err.Error()
+		r.logger.Error(fmt.Sprintf("giving up on queued alert from rule %q", qa.Rule),
+			"id", hit.ID, "output", qa.OutputType, "attempts", qa.Attempts, "error", err)
+	default:
+		qa.LastError = err.Error()
+		qa.NextAttempt = now.Add(r.backoff(qa.Attempts))
+		r.logger.Warn(fmt.Sprintf("error sending queued alert from rule %q", qa.Rule),
+			"id", hit.ID, "error", err, "next_attempt", qa.NextAttempt.Format(time.RFC822))
+	}
+
+	written, err := r.put(ctx, r.docURL(hit.ID, version), qa)
+	switch {
+	case err != nil:
+		r.logger.Error("error updating queued alert", "id", hit.ID, "error", err)
+	case written == nil:
+		r.logger.Warn("queued alert was modified by another process while it was sent", "id", hit.ID)
+	}
+}
+
+func (r *RetryQueue) retry(ctx context.Context, qa *retryDoc) error {
+	method := r.method(qa)
+	if method == nil {
+		return xerrors.Errorf("rule %q has no %s output at index %d", qa.Rule, qa.OutputType, qa.Output)
+	}
+	records := make([]*alert.Record, 0, len(qa.Records))
+	for _, record := range qa.Records {
+		rec := new(alert.Record)
+		if record.Record != nil {
+			*rec = *record.Record
+		}
+		rec.BodyField = record.BodyField
+		rec.Documents = record.Documents
+		records = append(records, rec)
+	}
+	if qa.AlertID != "" {
+		ctx = alert.WithAlertID(ctx, qa.AlertID)
+	}
+	if qa.FireCount > 0 {
+		ctx = alert.WithFireCount(ctx, qa.FireCount, qa.FirstFired)
+	}
+	if qa.Query != nil {
+		ctx = alert.WithQuery(ctx, qa.Query)
+	}
+	if err := method.Write(ctx, qa.Rule, records); err != nil {
+		return xerrors.Errorf("error writing alert to %s output: %w", method.Name(), err)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the next attempt to send
+// an alert which has failed the given number of attempts.
+func (r *RetryQueue) backoff(attempts int) time.Duration {
+	if r.interval >= maxRetryBackoff {
+		return r.interval
+	}
+	backoff := r.interval
+	for i := 1; i < attempts && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// due returns the oldest pending alerts whose next attempt is due.
+func (r *RetryQueue) due(ctx context.Context) ([]*retryHit, error) {
+	payload := fmt.Sprintf(`{
+    "size": %d,
+    "seq_no_primary_term": true,
+    "sort": [{"next_attempt": "asc"}],
+    "query": {
+      "bool": {
+        "filter": [
+          {"term": {"status": %q}},
+          {"range": {"next_attempt": {"lte": %q}}}
+        ]
+      }
+    }
+  }`, retryBatchSize, RetryPending, r.clock.Now().UTC().Format(time.RFC3339Nano))
+
+	resp, err := r.do(ctx, http.MethodPost, fmt.Sprintf("%s/%s/_search", r.esURL, r.IndexName()),
+		bytes.NewBufferString(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// Nothing has been queued yet
+		return nil, nil
+	default:
+		return nil, xerrors.Errorf("unexpected status code searching retry index: %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Hits struct {
+			Hits []*retryHit `json:"hits"`
+		} `json:"hits"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err = dec.Decode(&data); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding response to searching retry index: %v", err)
+	}
+	return data.Hits.Hits, nil
+}
+
+// docURL returns the URL with which the queued alert is written if
+// it is still at the given version.
+func (r *RetryQueue) docURL(id string, version *docVersion) string {
+	return fmt.Sprintf("%s/%s/_doc/%s?if_seq_no=%d&if_primary_term=%d", r.esURL, r.IndexName(), id,
+		version.SeqNo, version.PrimaryTerm)
+}
+
+// put writes the queued alert to u and returns the version of the
+// document it wrote, or nil if the document was created or modified
+// by another process first.
+func (r *RetryQueue) put(ctx context.Context, u string, qa *retryDoc) (*docVersion, error) {
+	body, err := json.Marshal(qa)
+	if err != nil {
+		return nil, xerrors.Errorf("error JSON-encoding queued alert: %v", err)
+	}
+	resp, err := r.do(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusConflict:
+		return nil, nil
+	default:
+		return nil, xerrors.Errorf("unexpected status code writing queued alert: %d", resp.StatusCode)
+	}
+	written := new(docVersion)
+	if err = json.NewDecoder(resp.Body).Decode(written); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding response to writing queued alert: %v", err)
+	}
+	return written, nil
+}
+
+func (r *RetryQueue) do(ctx context.Context, method, u string, data io.Reader) (*http.Response, error) {
+	req, err := r.newRequest(ctx, method, u, data)
+	if err != nil {
+		return nil, xerrors.Errorf("error creating new request: %v", err)
+	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	if r.userAgent != "" {
+		req.Header.Set("User-Agent", r.userAgent)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,383 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+// fakeRetryIndex mocks the retry index, refusing writes whose
+// if_seq_no and if_primary_term do not match the version of the
+// document.
+type fakeRetryIndex struct {
+	t  *testing.T
+	mu sync.Mutex
+
+	created bool
+	docs    map[string]*retryDoc
+	seqNos  map[string]int64
+	seqNo   int64
+
+	// afterSearch is called after the index is searched
+	afterSearch func(f *fakeRetryIndex)
+}
+
+func newFakeRetryIndex(t *testing.T) *fakeRetryIndex {
+	return &fakeRetryIndex{t: t, docs: make(map[string]*retryDoc), seqNos: make(map[string]int64)}
+}
+
+func (f *fakeRetryIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	index := fmt.Sprintf("/%s-retry-%s", defaultStateIndexAlias, templateVersion)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == index:
+		if f.created {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"type": "resource_already_exists_exception"}, "status": 400}`))
+			return
+		}
+		f.created = true
+		w.Write([]byte(`{"acknowledged": true}`))
+	case r.Method == http.MethodPost && r.URL.Path == index+"/_search":
+		f.search(w, r)
+		if f.afterSearch != nil {
+			f.afterSearch(f)
+		}
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, index+"/_create/"):
+		id := strings.TrimPrefix(r.URL.Path, index+"/_create/")
+		if _, ok := f.docs[id]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.write(w, r, id, http.StatusCreated)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, index+"/_doc/"):
+		id := strings.TrimPrefix(r.URL.Path, index+"/_doc/")
+		if !f.matches(r, id) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.write(w, r, id, http.StatusOK)
+	default:
+		f.t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// search returns the pending documents due by the time of the range
+// query of the request, oldest first.
+func (f *fakeRetryIndex) search(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Query struct {
+			Bool struct {
+				Filter []struct {
+					Range struct {
+						NextAttempt struct {
+							LTE time.Time `json:"lte"`
+						} `json:"next_attempt"`
+					} `json:"range"`
+				} `json:"filter"`
+			} `json:"bool"`
+		} `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Query.Bool.Filter) != 2 {
+		f.t.Errorf("unexpected search request (error: %v)", err)
+	}
+	due := body.Query.Bool.Filter[1].Range.NextAttempt.LTE
+
+	if !f.created && len(f.docs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	hits := make([]map[string]interface{}, 0)
+	for id, doc := range f.docs {
+		if doc.Status != RetryPending || doc.NextAttempt.After(due) {
+			continue
+		}
+		hits = append(hits, map[string]interface{}{
+			"_id":           id,
+			"_seq_no":       f.seqNos[id],
+			"_primary_term": 1,
+			"_source":       doc,
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i]["_source"].(*retryDoc).NextAttempt.Before(hits[j]["_source"].(*retryDoc).NextAttempt)
+	})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hits": map[string]interface{}{"hits": hits},
+	})
+}
+
+// matches returns whether the request is conditional on the current
+// version of the document.
+func (f *fakeRetryIndex) matches(r *http.Request, id string) bool {
+	seqNo, err := strconv.ParseInt(r.URL.Query().Get("if_seq_no"), 10, 64)
+	if err != nil {
+		f.t.Errorf("write is not conditional on the sequence number: %s %s", r.Method, r.URL)
+		return false
+	}
+	if r.URL.Query().Get("if_primary_term") != "1" {
+		f.t.Errorf("write is not conditional on the primary term: %s %s", r.Method, r.URL)
+		return false
+	}
+	_, ok := f.docs[id]
+	return ok && seqNo == f.seqNos[id]
+}
+
+func (f *fakeRetryIndex) write(w http.ResponseWriter, r *http.Request, id string, status int) {
+	doc := new(retryDoc)
+	if err := json.NewDecoder(r.Body).Decode(doc); err != nil {
+		f.t.Errorf("error decoding queued alert: %v", err)
+	}
+	f.seqNo++
+	f.docs[id], f.seqNos[id] = doc, f.seqNo
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"_seq_no": %d, "_primary_term": 1}`, f.seqNo)
+}
+
+// doc returns the only document of the index.
+func (f *fakeRetryIndex) doc() *retryDoc {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.docs) != 1 {
+		f.t.Fatalf("expected 1 queued alert, got %d", len(f.docs))
+	}
+	for _, doc := range f.docs {
+		return doc
+	}
+	return nil
+}
+
+// retryMethod is a mock alert.Method which fails while err is set.
+type retryMethod struct {
+	mu      sync.Mutex
+	err     error
+	records [][]*alert.Record
+}
+
+func (m *retryMethod) Write(ctx context.Context, rule string, records []*alert.Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.records = append(m.records, records)
+	return nil
+}
+
+func (m *retryMethod) Name() string {
+	return "retry"
+}
+
+func (m *retryMethod) writes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.records)
+}
+
+func newTestRetryQueue(t *testing.T, url string, clk clock.Clock, method alert.Method) *RetryQueue {
+	r, err := NewRetryQueue(&RetryQueueConfig{
+		ESUrl:         url,
+		MaxAttempts:   3,
+		RetryInterval: time.Minute,
+		Logger:        hclog.NewNullLogger(),
+		Clock:         clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetMethods(map[string][]alert.Method{"test-rule": {method}})
+	return r
+}
+
+func queueTestAlert(t *testing.T, r *RetryQueue, method alert.Method) {
+	err := r.Write(&alert.Alert{
+		ID:       "abc",
+		RuleName: "test-rule",
+		Methods:  []alert.Method{method},
+		Records: []*alert.Record{
+			{
+				Filter: "hits.hits._source",
+				Text:   `{"message": "error"}`,
+				Documents: []map[string]interface{}{
+					{"message": "error"},
+				},
+				BodyField: true,
+			},
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryQueueEnqueue(t *testing.T) {
+	index := newFakeRetryIndex(t)
+	ts := httptest.NewServer(index)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	method := new(retryMethod)
+	r := newTestRetryQueue(t, ts.URL, fc, method)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		// The index may already exist
+		if err := r.CreateIndex(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queueTestAlert(t, r, method)
+
+	doc := index.doc()
+	if doc.Status != RetryPending || doc.Attempts != 0 || doc.Rule != "test-rule" || doc.OutputType != "retry" {
+		t.Fatalf("unexpected queued alert: %+v", doc)
+	}
+	if expected := fc.Now().Add(time.Minute); !doc.NextAttempt.Equal(expected) {
+		t.Fatalf("unexpected next attempt (got %v, expected %v)", doc.NextAttempt, expected)
+	}
+	if len(doc.Records) != 1 || !doc.Records[0].BodyField || len(doc.Records[0].Documents) != 1 {
+		t.Fatalf("unexpected records: %+v", doc.Records)
+	}
+
+	// The alert is not retried before it is due
+	r.Replay(ctx)
+	if method.writes() != 0 {
+		t.Fatal("alert should not have been retried before it was due")
+	}
+}
+
+func TestRetryQueueDeliver(t *testing.T) {
+	index := newFakeRetryIndex(t)
+	ts := httptest.NewServer(index)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	method := &retryMethod{err: errors.New("unavailable")}
+	queueTestAlert(t, newTestRetryQueue(t, ts.URL, fc, method), method)
+
+	fc.Advance(time.Minute)
+	method.mu.Lock()
+	method.err = nil
+	method.mu.Unlock()
+
+	// The alert is retried by another process, e.g. after a restart
+	r := newTestRetryQueue(t, ts.URL, fc, method)
+	r.Replay(context.Background())
+
+	if method.writes() != 1 {
+		t.Fatalf("expected 1 write, got %d", method.writes())
+	}
+	records := method.records[0]
+	if len(records) != 1 || !records[0].BodyField || len(records[0].Documents) != 1 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if doc := index.doc(); doc.Status != RetryDelivered || doc.Attempts != 1 || doc.LastError != "" {
+		t.Fatalf("unexpected queued alert: %+v", doc)
+	}
+
+	// A delivered alert is not sent again
+	fc.Advance(time.Hour)
+	r.Replay(context.Background())
+	if method.writes() != 1 {
+		t.Fatalf("expected 1 write, got %d", method.writes())
+	}
+}
+
+func TestRetryQueueGiveUp(t *testing.T) {
+	index := newFakeRetryIndex(t)
+	ts := httptest.NewServer(index)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	method := &retryMethod{err: errors.New("unavailable")}
+	r := newTestRetryQueue(t, ts.URL, fc, method)
+	queueTestAlert(t, r, method)
+
+	steps := []struct {
+		advance     time.Duration
+		status      string
+		attempts    int
+		nextAttempt time.Duration
+	}{
+		{time.Minute, RetryPending, 1, time.Minute},
+		// Not due yet
+		{30 * time.Second, RetryPending, 1, 0},
+		{30 * time.Second, RetryPending, 2, 2 * time.Minute},
+		{2 * time.Minute, RetryDead, 3, 0},
+		// A dead alert is not retried
+		{time.Hour, RetryDead, 3, 0},
+	}
+	for i, step := range steps {
+		fc.Advance(step.advance)
+		r.Replay(context.Background())
+
+		doc := index.doc()
+		if doc.Status != step.status || doc.Attempts != step.attempts {
+			t.Fatalf("step %d: unexpected queued alert (status: %q, attempts: %d)", i+1, doc.Status, doc.Attempts)
+		}
+		if step.nextAttempt > 0 && !doc.NextAttempt.Equal(fc.Now().Add(step.nextAttempt)) {
+			t.Fatalf("step %d: unexpected next attempt %v", i+1, doc.NextAttempt)
+		}
+		if doc.LastError == "" {
+			t.Fatalf("step %d: the error was not recorded", i+1)
+		}
+	}
+}
+
+func TestRetryQueueClaimed(t *testing.T) {
+	index := newFakeRetryIndex(t)
+	ts := httptest.NewServer(index)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	method := new(retryMethod)
+	r := newTestRetryQueue(t, ts.URL, fc, method)
+	queueTestAlert(t, r, method)
+	fc.Advance(time.Minute)
+
+	// Another process claims the alert between the search and
+	// the claim of this process
+	index.afterSearch = func(f *fakeRetryIndex) {
+		for id := range f.docs {
+			f.seqNo++
+			f.seqNos[id] = f.seqNo
+		}
+	}
+	r.Replay(context.Background())
+	if method.writes() != 0 {
+		t.Fatal("alert claimed by another process should not have been sent")
+	}
+	if doc := index.doc(); doc.Status != RetryPending || doc.Attempts != 0 {
+		t.Fatalf("unexpected queued alert: %+v", doc)
+	}
+}
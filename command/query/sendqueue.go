@@ -0,0 +1,191 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+const defaultSendQueueSize = 10
+
+// sendQueue holds the alerts of a rule waiting to be handed to the
+// alert handler so that the Run loop of the rule does not wait for
+// its outputs to send them.
+type sendQueue struct {
+	alerts chan *queuedAlert
+
+	// deliveries receives the outcome of the alerts once they have
+	// been sent
+	deliveries chan delivery
+
+	// done is closed once sendAlerts returns
+	done chan struct{}
+}
+
+// queuedAlert is an alert waiting in the send queue.
+type queuedAlert struct {
+	alert *alert.Alert
+
+	// sentAt is the time of the alert and previousAlert the time
+	// of the alert before it, which is restored if it cannot be
+	// delivered
+	sentAt        time.Time
+	previousAlert time.Time
+
+	// dedupKeys are the keys of the dedup key field whose cooldown
+	// the alert started
+	dedupKeys []string
+
+	// handler is the QueryHandler which sent the alert: that of the
+	// rule or of one of its evaluations
+	handler *QueryHandler
+}
+
+// delivery is the outcome of sending a queued alert.
+type delivery struct {
+	*queuedAlert
+	ok bool
+}
+
+func newSendQueue(size int) *sendQueue {
+	return &sendQueue{
+		alerts:     make(chan *queuedAlert, size),
+		deliveries: make(chan delivery),
+		done:       make(chan struct{}),
+	}
+}
+
+// enqueue adds the alert to the send queue. If the queue is full,
+// what happens depends on the policy of the rule: the oldest alert
+// is discarded, the new alert is discarded, or enqueue waits until
+// there is room, handling the outcome of deliveries meanwhile. It
+// returns false if the alert was not queued.
+func (q *QueryHandler) enqueue(ctx context.Context, sq *sendQueue, qa *queuedAlert) bool {
+	for {
+		select {
+		case sq.alerts <- qa:
+			return true
+		default:
+		}
+
+		switch q.sendPolicy {
+		case config.SendQueueDropNewest:
+			q.logger.Warn(fmt.Sprintf("[Rule: %q] send queue is full, dropping new alert", q.name),
+				"queue_size", cap(sq.alerts))
+			return false
+		case config.SendQueueBlock:
+			q.logger.Warn(fmt.Sprintf("[Rule: %q] send queue is full, waiting to queue alert", q.name),
+				"queue_size", cap(sq.alerts))
+			for {
+				select {
+				case <-ctx.Done():
+					return false
+				case <-q.StopCh:
+					return false
+				case d := <-sq.deliveries:
+					q.recordDelivery(d)
+					continue
+				case sq.alerts <- qa:
+					return true
+				}
+			}
+		default:
+			select {
+			case dropped := <-sq.alerts:
+				q.logger.Warn(fmt.Sprintf("[Rule: %q] send queue is full, dropping oldest alert", q.name),
+					"queue_size", cap(sq.alerts))
+				q.dropQueued(dropped, qa)
+			default:
+			}
+		}
+	}
+}
+
+// dropQueued handles an alert dropped from the send queue to make
+// room for qa as one which could not be delivered, undoing the
+// cooldowns it started (see recordDelivery), so that the keys it
+// alerted for are not suppressed by an alert which was never sent.
+// If qa would restore the time of the dropped alert should it fail
+// too, it restores the time before the dropped alert instead.
+func (q *QueryHandler) dropQueued(dropped, qa *queuedAlert) {
+	q.recordDelivery(delivery{queuedAlert: dropped})
+	if dropped.handler == qa.handler && qa.previousAlert.Equal(dropped.sentAt) {
+		qa.previousAlert = dropped.previousAlert
+	}
+}
+
+// sendAlerts hands the queued alerts to the alert handler via
+// outputCh one at a time, reporting their outcome on sq.deliveries,
+// until ctx is canceled. It waits for the outcome of the alerts
+// which require every output to succeed before handing over the
+// next one.
+func (q *QueryHandler) sendAlerts(ctx context.Context, sq *sendQueue, outputCh chan<- *alert.Alert) {
+	defer close(sq.done)
+	for {
+		var qa *queuedAlert
+		select {
+		case <-ctx.Done():
+			return
+		case qa = <-sq.alerts:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case outputCh <- qa.alert:
+		}
+		if !qa.alert.RequireAllOutputs {
+			// Waiting for the outcome would hold up the next alerts
+			go q.reportDelivery(ctx, sq, qa)
+			continue
+		}
+		q.reportDelivery(ctx, sq, qa)
+	}
+}
+
+// reportDelivery waits for the outcome of sending the queued alert
+// and reports it on sq.deliveries.
+func (q *QueryHandler) reportDelivery(ctx context.Context, sq *sendQueue, qa *queuedAlert) {
+	d := delivery{queuedAlert: qa, ok: q.delivered(ctx, qa.alert)}
+	select {
+	case <-ctx.Done():
+	case sq.deliveries <- d:
+	}
+}
+
+// recordDelivery handles the outcome of a delivery. If the alert
+// could not be delivered, the cooldown it started (either that of
+// the rule or evaluation which sent it, if no alert has been queued
+// since, or those of its dedup keys) is undone so that the next
+// execution of the query alerts again.
+func (q *QueryHandler) recordDelivery(d delivery) {
+	if d.ok {
+		return
+	}
+	h := q
+	if d.handler != nil {
+		h = d.handler
+	}
+	h.forgetDedupKeys(d.dedupKeys, d.sentAt)
+	if !h.lastAlert.Equal(d.sentAt) {
+		return
+	}
+	h.lastAlert = d.previousAlert
+	q.updateStatus(ResultUndelivered, nil, q.Status().NextRun)
+}
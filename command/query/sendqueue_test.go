@@ -0,0 +1,281 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+)
+
+func TestEnqueue(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   string
+		queued   bool
+		expected []string
+	}{
+		{"drop-oldest", config.SendQueueDropOldest, true, []string{"2", "3"}},
+		{"default", "", true, []string{"2", "3"}},
+		{"drop-newest", config.SendQueueDropNewest, false, []string{"1", "2"}},
+		{"block", config.SendQueueBlock, false, []string{"1", "2"}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				StopCh:     make(chan struct{}),
+				name:       "Test Enqueue",
+				logger:     hclog.NewNullLogger(),
+				sendPolicy: tc.policy,
+			}
+			sq := newSendQueue(2)
+
+			// A blocked enqueue gives up once the context is canceled
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			for i, id := range []string{"1", "2", "3"} {
+				queued := qh.enqueue(ctx, sq, &queuedAlert{alert: &alert.Alert{ID: id}})
+				if expected := i < 2 || tc.queued; queued != expected {
+					t.Fatalf("unexpected result of queuing alert %s (got %t, expected %t)", id, queued, expected)
+				}
+			}
+
+			close(sq.alerts)
+			var ids []string
+			for qa := range sq.alerts {
+				ids = append(ids, qa.alert.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+				t.Fatalf("unexpected queued alerts (got %v, expected %v)", ids, tc.expected)
+			}
+		})
+	}
+}
+
+func TestEnqueueDropOldestRestoresCooldown(t *testing.T) {
+	const filter = "aggregations.hostname.buckets"
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:          "Test Drop Oldest",
+		Logger:        hclog.NewNullLogger(),
+		ESUrl:         ElasticsearchURL,
+		QueryIndex:    "test-*",
+		AlertMethods:  []alert.Method{&file.AlertMethod{}},
+		QueryData:     map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:      "@every 10m",
+		Filters:       []string{filter},
+		AlertCooldown: time.Hour,
+		DedupKeyField: filter,
+		SendQueueSize: 1,
+		Clock:         fc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := func(key string) []*alert.Record {
+		return []*alert.Record{{Filter: filter, Fields: []*alert.Field{{Key: key, Count: 1}}}}
+	}
+
+	// Nothing drains the queue, so the alert for web-2 drops that of
+	// web-1
+	sq := newSendQueue(1)
+	for _, key := range []string{"web-1", "web-2"} {
+		if res := qh.dispatch(context.Background(), sq, false, hosts(key)); res.Result != ResultAlert {
+			t.Fatalf("%s: unexpected result (got %q, expected %q)", key, res.Result, ResultAlert)
+		}
+		fc.Advance(time.Minute)
+	}
+	if qa := <-sq.alerts; !qa.previousAlert.IsZero() {
+		t.Fatalf("the queued alert should restore the time before the dropped alert (got %s)", qa.previousAlert)
+	}
+
+	// The dropped key alerts again while the queued one is suppressed
+	if res := qh.dispatch(context.Background(), sq, false, hosts("web-1")); res.Result != ResultAlert {
+		t.Fatalf("the key of the dropped alert should alert again (got %q)", res.Result)
+	}
+	if res := qh.dispatch(context.Background(), sq, false, hosts("web-2")); res.Result != ResultSuppressed {
+		t.Fatalf("the key of the queued alert should be suppressed (got %q)", res.Result)
+	}
+}
+
+func TestRecordDelivery(t *testing.T) {
+	previous := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	sentAt := previous.Add(time.Hour)
+	qh := &QueryHandler{lastAlert: sentAt}
+
+	qh.recordDelivery(delivery{queuedAlert: &queuedAlert{sentAt: sentAt, previousAlert: previous}, ok: true})
+	if !qh.lastAlert.Equal(sentAt) {
+		t.Fatalf("time of last alert should be kept when it was delivered (got %s)", qh.lastAlert)
+	}
+
+	qh.recordDelivery(delivery{queuedAlert: &queuedAlert{sentAt: previous.Add(time.Minute), previousAlert: previous}})
+	if !qh.lastAlert.Equal(sentAt) {
+		t.Fatalf("time of last alert should be kept when a newer alert was queued (got %s)", qh.lastAlert)
+	}
+
+	qh.recordDelivery(delivery{queuedAlert: &queuedAlert{sentAt: sentAt, previousAlert: previous}})
+	if !qh.lastAlert.Equal(previous) {
+		t.Fatalf("time of last alert should be restored when it was not delivered (got %s, expected %s)",
+			qh.lastAlert, previous)
+	}
+	if status := qh.Status(); status.LastResult != ResultUndelivered {
+		t.Fatalf("unexpected result of the last run (got %q, expected %q)", status.LastResult, ResultUndelivered)
+	}
+}
+
+func TestSendAlertsBestEffort(t *testing.T) {
+	qh := &QueryHandler{
+		name:   "Test Send Alerts",
+		logger: hclog.NewNullLogger(),
+	}
+	sq := newSendQueue(2)
+	outputCh := make(chan *alert.Alert)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-sq.done
+	}()
+	go qh.sendAlerts(ctx, sq, outputCh)
+
+	failed := &queuedAlert{alert: &alert.Alert{ID: "1", Result: make(chan error, 1)}}
+	next := &queuedAlert{alert: &alert.Alert{ID: "2", Result: make(chan error, 1)}}
+	sq.alerts <- failed
+	sq.alerts <- next
+
+	// The next alert is handed over without waiting for the outcome
+	// of the first, which is reported once every output failed
+	for _, id := range []string{"1", "2"} {
+		select {
+		case a := <-outputCh:
+			if a.ID != id {
+				t.Fatalf("unexpected alert (got %s, expected %s)", a.ID, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for alert %s", id)
+		}
+	}
+	failed.alert.Result <- fmt.Errorf("test error")
+
+	select {
+	case d := <-sq.deliveries:
+		if d.queuedAlert != failed || d.ok {
+			t.Fatalf("unexpected delivery of alert %s (ok: %t)", d.alert.ID, d.ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the outcome of the alert")
+	}
+}
+
+func TestRunStalledOutput(t *testing.T) {
+	queryIndex := randomUUID(t)
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+
+	var queries int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/%s-%s/_search", defaultStateIndexAlias, templateVersion):
+			w.WriteHeader(404)
+		case fmt.Sprintf("/<%s-status-%s-{now/d}>/_doc", defaultStateIndexAlias, templateVersion):
+			w.WriteHeader(201)
+		case fmt.Sprintf("/%s/_search", queryIndex):
+			atomic.AddInt32(&queries, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hits":{"hits":[{"_source":{"hello":"world"}}]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	fileAM, err := file.NewAlertMethod(&file.AlertMethodConfig{
+		OutputFilepath: filepath.Join("testdata", "testfile.log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:            "Test Stalled Output",
+		AlertMethods:    []alert.Method{fileAM},
+		Logger:          hclog.NewNullLogger(),
+		ESUrl:           ts.URL,
+		QueryIndex:      queryIndex,
+		QueryData:       map[string]interface{}{"query": map[string]interface{}{}},
+		Schedule:        "@every 10s",
+		SendQueueSize:   1,
+		SendQueuePolicy: config.SendQueueDropNewest,
+		Clock:           fc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// Nothing reads outputCh until the end, as if the alert
+	// handler were stuck sending the first alert
+	outputCh := make(chan *alert.Alert)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+
+	// The first execution is immediate since there is no state
+	fc.BlockUntil(1)
+	for i := 0; i < 4; i++ {
+		fc.Advance(10 * time.Second)
+		fc.BlockUntil(1)
+	}
+
+	if n := atomic.LoadInt32(&queries); n != 5 {
+		t.Fatalf("expected the query to keep running while the output is stalled (got %d queries, expected 5)", n)
+	}
+	if status := qh.Status(); status.LastResult != ResultUndelivered {
+		t.Fatalf("unexpected result of the last run (got %q, expected %q)", status.LastResult, ResultUndelivered)
+	}
+
+	select {
+	case a := <-outputCh:
+		if a.RuleName != "Test Stalled Output" {
+			t.Fatalf("unexpected rule name (got %q)", a.RuleName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the queued alert")
+	}
+}
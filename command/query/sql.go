@@ -0,0 +1,251 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultSQLFetchSize is the number of rows of each page of the
+	// results of an SQL query if SQL.FetchSize is zero
+	defaultSQLFetchSize = 1000
+
+	// defaultMaxSQLRows is the maximum number of rows of an SQL
+	// query collected across all pages if SQL.MaxRows is zero
+	defaultMaxSQLRows = 10000
+
+	// sqlField is the field of the response to an SQL query, as
+	// returned by querySQL, holding its results
+	sqlField = "sql"
+
+	// sqlBucketsFilter is the filter grouping the rows of an SQL
+	// query, which is used if the rule has no filters
+	sqlBucketsFilter = sqlField + ".buckets"
+)
+
+// SQL configures an Elasticsearch SQL statement executed instead of
+// the query DSL body of a rule.
+type SQL struct {
+	// Query is the SQL statement
+	Query string
+
+	// FetchSize is the number of rows of each page of results. If
+	// zero, defaultSQLFetchSize is used
+	FetchSize int
+
+	// MaxRows is the maximum number of rows collected across all
+	// pages. If zero, defaultMaxSQLRows is used
+	MaxRows int
+}
+
+// querySQL executes q.sql via the _sql API, following the cursor of
+// each page until there are no more rows or q.sql.MaxRows rows have
+// been collected, in which case the cursor is closed. It returns
+// the rows shaped like the response to a search (see sqlResponse)
+// so that they can be processed like any other query. The indices
+// an SQL statement reads cannot be checked against an index policy,
+// so it is refused if there is one.
+func (q *QueryHandler) querySQL(ctx context.Context) (map[string]interface{}, error) {
+	if q.indexPolicy != nil {
+		return nil, xerrors.New("refusing to run SQL query: the indices of SQL queries cannot be checked " +
+			"against the index policy")
+	}
+	body := sqlBody(q.sql)
+	var (
+		columns []interface{}
+		rows    []interface{}
+		cursor  string
+	)
+	for page := 1; ; page++ {
+		data, err := q.sqlRequest(ctx, "_sql", body)
+		if err != nil {
+			if cursor != "" {
+				q.closeSQLCursor(ctx, cursor)
+			}
+			return nil, xerrors.Errorf("error querying page %d of SQL query: %v", page, err)
+		}
+		if page == 1 {
+			columns, _ = data["columns"].([]interface{})
+		}
+
+		pageRows, _ := data["rows"].([]interface{})
+		rows = append(rows, pageRows...)
+		cursor, _ = data["cursor"].(string)
+		if cursor == "" || len(pageRows) == 0 {
+			break
+		}
+		if len(rows) >= q.sql.MaxRows {
+			q.logger.Warn(fmt.Sprintf("[Rule: %q] collected the maximum number of rows of an SQL query", q.name),
+				"max_rows", q.sql.MaxRows, "pages", page)
+			q.closeSQLCursor(ctx, cursor)
+			break
+		}
+		body = map[string]interface{}{"cursor": cursor}
+	}
+	if len(rows) > q.sql.MaxRows {
+		rows = rows[:q.sql.MaxRows]
+	}
+	return sqlResponse(columns, rows), nil
+}
+
+// sqlBody returns the body of the request for the first page of the
+// results of the SQL query.
+func sqlBody(sql *SQL) map[string]interface{} {
+	return map[string]interface{}{
+		"query":      sql.Query,
+		"fetch_size": sql.FetchSize,
+	}
+}
+
+// closeSQLCursor frees the resources held by Elasticsearch for a
+// cursor whose remaining pages will not be requested. Errors are
+// only logged since the cursor expires on its own eventually.
+func (q *QueryHandler) closeSQLCursor(ctx context.Context, cursor string) {
+	if _, err := q.sqlRequest(ctx, "_sql/close", map[string]interface{}{"cursor": cursor}); err != nil {
+		q.logger.Warn(fmt.Sprintf("[Rule: %q] error closing SQL cursor", q.name), "error", err)
+	}
+}
+
+// sqlRequest posts the body to the given SQL API and returns the
+// JSON-decoded response.
+func (q *QueryHandler) sqlRequest(
+	ctx context.Context,
+	api string,
+	body map[string]interface{},
+) (map[string]interface{}, error) {
+	if q.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.queryTimeout)
+		defer cancel()
+	}
+
+	payload := bytes.Buffer{}
+	if err := json.NewEncoder(&payload).Encode(&body); err != nil {
+		return nil, xerrors.Errorf("error JSON-encoding SQL request body: %v", err)
+	}
+
+	u := fmt.Sprintf("%s/%s?format=json", q.esURL, api)
+	resp, err := q.doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := q.newRequest(ctx, http.MethodPost, u, bytes.NewReader(payload.Bytes()))
+		if err != nil {
+			return nil, xerrors.Errorf("error creating new request: %v", err)
+		}
+		req.Header.Set(ruleHeader, q.name)
+		return req, nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, xerrors.Errorf("received non-200 response status (status: %q). Response body:\n%s",
+			resp.Status, q.readErrRespBody(resp))
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+
+	data := make(map[string]interface{})
+	if err := dec.Decode(&data); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding Elasticsearch response: %v", err)
+	}
+	return data, nil
+}
+
+// sqlResponse converts the columnar results of an SQL query into
+// an object with the following fields under sqlField, so that the
+// conditions and filters of the rule can refer to them:
+//
+//	"columns":   the columns of the results, each with a name and type
+//	"row_count": the number of rows
+//	"rows":      the rows, each an object keyed by the column names
+//	"buckets":   a bucket per row, like those of an aggregation
+//
+// The bucket of a row is keyed by the values of its columns joined
+// by " - ", except the last if it is an integer (e.g. the COUNT(*)
+// of a GROUP BY query), which is the count of the bucket. A row
+// whose single column is an integer is keyed by the name of the
+// column. If the last column is not an integer, the count is 1.
+func sqlResponse(columns, rows []interface{}) map[string]interface{} {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		c, _ := column.(map[string]interface{})
+		names[i], _ = c["name"].(string)
+	}
+
+	objects := make([]interface{}, 0, len(rows))
+	buckets := make([]interface{}, 0, len(rows))
+	for _, raw := range rows {
+		row, _ := raw.([]interface{})
+		obj := make(map[string]interface{}, len(row))
+		for i, v := range row {
+			if i < len(names) && names[i] != "" {
+				obj[names[i]] = v
+			} else {
+				obj[strconv.Itoa(i)] = v
+			}
+		}
+		objects = append(objects, obj)
+		buckets = append(buckets, sqlBucket(names, row))
+	}
+
+	return map[string]interface{}{
+		sqlField: map[string]interface{}{
+			"columns":   columns,
+			"row_count": json.Number(strconv.Itoa(len(rows))),
+			"rows":      objects,
+			"buckets":   buckets,
+		},
+	}
+}
+
+// sqlBucket returns the bucket of a row of the results of an SQL
+// query (see sqlResponse).
+func sqlBucket(names []string, row []interface{}) map[string]interface{} {
+	keyColumns, count := row, json.Number("1")
+	if n := len(row); n > 0 {
+		if v, ok := row[n-1].(json.Number); ok {
+			if _, err := v.Int64(); err == nil {
+				keyColumns, count = row[:n-1], v
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(keyColumns))
+	for _, v := range keyColumns {
+		if v == nil {
+			keys = append(keys, "null")
+			continue
+		}
+		keys = append(keys, fmt.Sprint(v))
+	}
+	key := strings.Join(keys, " - ")
+	if len(keyColumns) == 0 && len(names) > 0 {
+		key = names[len(names)-1]
+	}
+	return map[string]interface{}{
+		"key":       key,
+		"doc_count": count,
+	}
+}
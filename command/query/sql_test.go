@@ -0,0 +1,281 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+func TestQuerySQL(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "sql_group_by.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pages []json.RawMessage
+	if err = json.Unmarshal(data, &pages); err != nil {
+		t.Fatal(err)
+	}
+
+	const query = "SELECT service, status, COUNT(*) AS errors FROM \"logs-*\" GROUP BY service, status"
+	cases := []struct {
+		name     string
+		maxRows  int
+		requests []string
+		closed   bool
+		fields   []*alert.Field
+	}{
+		{
+			"all-pages",
+			0,
+			[]string{"query", "cursor", "cursor"},
+			false,
+			[]*alert.Field{
+				{Key: "api - 500", Count: 42},
+				{Key: "api - 502", Count: 7},
+				{Key: "web - 500", Count: 15},
+				{Key: "worker - null", Count: 3},
+			},
+		},
+		{
+			"max-rows",
+			3,
+			[]string{"query", "cursor"},
+			true,
+			[]*alert.Field{
+				{Key: "api - 500", Count: 42},
+				{Key: "api - 502", Count: 7},
+				{Key: "web - 500", Count: 15},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				requests []string
+				closed   bool
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Query().Get("format") != "json" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				var req map[string]interface{}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				switch r.URL.Path {
+				case "/_sql/close":
+					closed = req["cursor"] == "sDXF1ZXJ5QW5kRmV0Y2gBAAAAAAAAAAIWWWdrRlVfSS1TbDYtcW9lc1FJNmlYdw=="
+					w.Write([]byte(`{"succeeded": true}`)) // nolint: errcheck
+					return
+				case "/_sql":
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if _, ok := req["cursor"]; ok {
+					requests = append(requests, "cursor")
+				} else if req["query"] == query && req["fetch_size"] == float64(2) {
+					requests = append(requests, "query")
+				}
+				if len(requests) > len(pages) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Write(pages[len(requests)-1]) // nolint: errcheck
+			}))
+			defer ts.Close()
+
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test SQL",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				Schedule:     "@every 10m",
+				SQL:          &SQL{Query: query, FetchSize: 2, MaxRows: tc.maxRows},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records, _, err := qh.execute(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(requests, tc.requests) {
+				t.Fatalf("unexpected requests (got %v, expected %v)", requests, tc.requests)
+			}
+			if closed != tc.closed {
+				t.Fatalf("unexpected closing of the cursor (got %t, expected %t)", closed, tc.closed)
+			}
+			if len(records) != 1 || records[0].Filter != sqlBucketsFilter {
+				t.Fatalf("expected a single record of filter %q, got %d records", sqlBucketsFilter, len(records))
+			}
+			if !reflect.DeepEqual(records[0].Fields, tc.fields) {
+				t.Fatalf("unexpected fields:\nGot:\n\t%v\nExpected:\n\t%v", records[0].Fields, tc.fields)
+			}
+		})
+	}
+}
+
+func TestQuerySQLIndexPolicy(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"columns": [], "rows": []}`)) // nolint: errcheck
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test SQL",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		Schedule:     "@every 10m",
+		SQL:          &SQL{Query: "SELECT * FROM secrets"},
+		IndexPolicy:  &config.IndexPolicy{Denied: []string{"secrets"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = qh.execute(context.Background()); err == nil {
+		t.Fatal("expected the SQL query to be refused")
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("the SQL query should not have been sent (got %d requests)", n)
+	}
+}
+
+func TestSQLResponse(t *testing.T) {
+	column := func(name, typ string) interface{} {
+		return map[string]interface{}{"name": name, "type": typ}
+	}
+
+	cases := []struct {
+		name    string
+		columns []interface{}
+		rows    []interface{}
+		buckets []interface{}
+	}{
+		{
+			"count-only",
+			[]interface{}{column("errors", "long")},
+			[]interface{}{[]interface{}{json.Number("12")}},
+			[]interface{}{map[string]interface{}{"key": "errors", "doc_count": json.Number("12")}},
+		},
+		{
+			"no-count",
+			[]interface{}{column("host", "keyword"), column("load", "double")},
+			[]interface{}{[]interface{}{"web-1", json.Number("0.75")}},
+			[]interface{}{map[string]interface{}{"key": "web-1 - 0.75", "doc_count": json.Number("1")}},
+		},
+		{
+			"no-rows",
+			[]interface{}{column("errors", "long")},
+			nil,
+			[]interface{}{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp := sqlResponse(tc.columns, tc.rows)
+			sql, ok := resp[sqlField].(map[string]interface{})
+			if !ok {
+				t.Fatalf("response has no %q field", sqlField)
+			}
+			if !reflect.DeepEqual(sql["buckets"], tc.buckets) {
+				t.Fatalf("unexpected buckets:\nGot:\n\t%v\nExpected:\n\t%v", sql["buckets"], tc.buckets)
+			}
+			if n := sql["row_count"]; n != json.Number(fmt.Sprint(len(tc.rows))) {
+				t.Fatalf("unexpected row count %v", n)
+			}
+		})
+	}
+}
+
+func TestProcessSQLConditions(t *testing.T) {
+	columns := []interface{}{
+		map[string]interface{}{"name": "service", "type": "keyword"},
+		map[string]interface{}{"name": "errors", "type": "long"},
+	}
+	rows := []interface{}{
+		[]interface{}{"api", json.Number("42")},
+		[]interface{}{"web", json.Number("3")},
+	}
+
+	cases := []struct {
+		name      string
+		condition config.Condition
+		records   int
+	}{
+		{
+			"row-count-met",
+			config.Condition{"field": "sql.row_count", "quantifier": "any", "gte": json.Number("2")},
+			1,
+		},
+		{
+			"row-count-not-met",
+			config.Condition{"field": "sql.row_count", "quantifier": "any", "gt": json.Number("2")},
+			0,
+		},
+		{
+			"column-value-met",
+			config.Condition{"field": "sql.rows.errors", "quantifier": "any", "gt": json.Number("40")},
+			1,
+		},
+		{
+			"column-value-not-met",
+			config.Condition{"field": "sql.rows.errors", "quantifier": "all", "gt": json.Number("40")},
+			0,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:     hclog.NewNullLogger(),
+				filters:    []string{sqlBucketsFilter},
+				bodyField:  defaultBodyField,
+				conditions: []config.Condition{tc.condition},
+			}
+			records, _, err := qh.process(sqlResponse(columns, rows))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != tc.records {
+				t.Fatalf("unexpected number of records (got %d, expected %d)", len(records), tc.records)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"time"
+)
+
+// Values of Status.LastResult.
+const (
+	// ResultOK is the result of a run which produced no alert
+	ResultOK = "ok"
+
+	// ResultAlert is the result of a run whose alert was sent
+	ResultAlert = "alert"
+
+	// ResultSuppressed is the result of a run whose alert was
+	// suppressed, e.g. by the cooldown of the rule
+	ResultSuppressed = "suppressed"
+
+	// ResultUndelivered is the result of a run whose alert could
+	// not be delivered by all of the outputs of a rule which
+	// requires them all to succeed, or was dropped because the
+	// send queue of the rule was full
+	ResultUndelivered = "undelivered"
+
+	// ResultError is the result of a run which failed
+	ResultError = "error"
+)
+
+// Status is a snapshot of what a QueryHandler is doing, as tracked
+// by its Run loop. Unlike State, it is kept in memory and is not
+// read from Elasticsearch.
+type Status struct {
+	// LastRun is when the query last ran successfully
+	LastRun time.Time
+
+	// NextRun is when the query is next scheduled to run
+	NextRun time.Time
+
+	// LastResult is the outcome of the last run (one of the
+	// Result* constants), or empty if the query has not been run
+	// by this process
+	LastResult string
+
+	// LastError is the error of the last run if it failed
+	LastError string
+
+	// LastAlert is when an alert was last sent
+	LastAlert time.Time
+
+	// FiringSince is when the rule started firing, or the zero
+	// time if it is not firing. AlertID is the ID of the firing
+	FiringSince time.Time
+	AlertID     string
+
+	// Heartbeat is when Run last started or completed a cycle of
+	// its loop, and Restarts is how many times it was restarted
+	// because a run took longer than its maximum runtime
+	Heartbeat time.Time
+	Restarts  int
+
+	// StuckSince is when a run which was canceled for taking longer
+	// than its maximum runtime was found not to have returned, or
+	// the zero time if none is stuck, and AbandonedRuns is how many
+	// of the runs abandoned for not returning are still running
+	StuckSince    time.Time
+	AbandonedRuns int
+
+	// Paused is whether the query handler is paused (see Pause),
+	// and PausedSince is when it was paused
+	Paused      bool
+	PausedSince time.Time
+}
+
+// Status returns the current status of the query handler. It is
+// safe to call while Run is running.
+func (q *QueryHandler) Status() Status {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	return q.status
+}
+
+// updateStatus records the outcome of a run of the query, if it was
+// run, and when it is next scheduled to run.
+func (q *QueryHandler) updateStatus(result string, err error, next time.Time) {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+
+	q.status.Heartbeat = q.clk().Now()
+	q.status.NextRun = next
+	q.status.LastRun = q.lastRun
+	q.status.LastAlert = q.lastAlert
+	q.status.FiringSince = q.firingSince
+	q.status.AlertID = q.alertID
+	if result == "" {
+		return
+	}
+	q.status.LastResult = result
+	q.status.LastError = ""
+	if err != nil {
+		q.status.LastError = err.Error()
+	}
+}
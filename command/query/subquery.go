@@ -0,0 +1,73 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+)
+
+// SubQuery is an additional query executed by a QueryHandler
+// each time its response matches the rule. Each of its filters
+// produces a separate record titled '<Name>: <filter>'.
+type SubQuery struct {
+	// Name is the title under which the records of this
+	// sub-query are reported
+	Name string
+
+	// Index is the Elasticsearch index to be queried
+	Index string
+
+	// Body is the payload to be included in the query
+	Body map[string]interface{}
+
+	// Filters are the fields of the response to be grouped on
+	Filters []string
+}
+
+// runSubQueries executes each sub-query in order and returns the
+// records they produced in that same order. Hits below the minimum
+// severity of the rule, if any, are dropped from their responses as
+// they are from that of the main query. A sub-query that fails is
+// logged and skipped so that it does not prevent the records of the
+// main query or the other sub-queries from being sent.
+func (q *QueryHandler) runSubQueries(ctx context.Context) []*alert.Record {
+	var records []*alert.Record
+	for _, sq := range q.subQueries {
+		data, err := q.search(ctx, sq.Index, "_search", sq.Body)
+		if err != nil {
+			q.logger.Error(fmt.Sprintf("[Rule: %q] error querying Elasticsearch", q.name),
+				"sub_query", sq.Name, "error", err)
+			continue
+		}
+		if q.minSeverity != nil {
+			data = q.minSeverity.Filter(data)
+		}
+
+		sub, err := q.filterRecords(data, sq.Filters)
+		if err != nil {
+			q.logger.Error(fmt.Sprintf("[Rule: %q] error processing response", q.name),
+				"sub_query", sq.Name, "error", err)
+			continue
+		}
+
+		for _, record := range sub {
+			record.Filter = fmt.Sprintf("%s: %s", sq.Name, record.Filter)
+		}
+		records = append(records, sub...)
+	}
+	return records
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+func TestRunSubQueries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hosts/_search":
+			w.Write([]byte(`{"aggregations": {
+  "hostname": {"buckets": [{"key": "foo", "doc_count": 2}]},
+  "program": {"buckets": [{"key": "bar", "doc_count": 3}]}
+}}`))
+		case "/status/_search":
+			w.Write([]byte(`{"aggregations": {
+  "status": {"buckets": [{"key": "500", "doc_count": 4}]}
+}}`))
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Sub-Queries",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   "main",
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData:    map[string]interface{}{"size": 0},
+		Schedule:     "@every 10m",
+		SubQueries: []SubQuery{
+			{
+				Name:    "Hosts",
+				Index:   "hosts",
+				Filters: []string{"aggregations.program.buckets", "aggregations.hostname.buckets"},
+			},
+			{
+				Name:    "Broken",
+				Index:   "broken",
+				Filters: []string{"aggregations.hostname.buckets"},
+			},
+			{
+				Name:    "Status",
+				Index:   "status",
+				Filters: []string{"aggregations.status.buckets", "aggregations.missing.buckets"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*alert.Record{
+		{
+			Filter: "Hosts: aggregations.program.buckets",
+			Fields: []*alert.Field{{Key: "bar", Count: 3}},
+		},
+		{
+			Filter: "Hosts: aggregations.hostname.buckets",
+			Fields: []*alert.Field{{Key: "foo", Count: 2}},
+		},
+		{
+			Filter: "Status: aggregations.status.buckets",
+			Fields: []*alert.Field{{Key: "500", Count: 4}},
+		},
+	}
+
+	records := qh.runSubQueries(context.Background())
+	if !cmp.Equal(expected, records) {
+		t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+	}
+}
+
+func TestExecuteSubQueries(t *testing.T) {
+	cases := []struct {
+		name     string
+		total    int
+		expected []*alert.Record
+	}{
+		{
+			"conditions-met",
+			20,
+			[]*alert.Record{
+				{
+					Filter: "Hosts: hits.hits._source",
+					Fields: []*alert.Field{{Key: "db", Count: 1}},
+				},
+			},
+		},
+		{
+			"conditions-not-met",
+			5,
+			nil,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var subQueried bool
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/main/_search":
+					fmt.Fprintf(w, `{"hits": {"total": %d, "hits": []}}`, tc.total)
+				case "/hosts/_search":
+					subQueried = true
+					w.Write([]byte(`{"hits": {"hits": [
+  {"_source": {"key": "db", "doc_count": 1, "severity": "error"}},
+  {"_source": {"key": "cache", "doc_count": 1, "severity": "debug"}}
+]}}`))
+				default:
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+
+			minSeverity, err := config.ParseSeverityFilter("severity", "error", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			qh, err := NewQueryHandler(&QueryHandlerConfig{
+				Name:         "Test Sub-Queries",
+				Logger:       hclog.NewNullLogger(),
+				ESUrl:        ts.URL,
+				QueryIndex:   "main",
+				AlertMethods: []alert.Method{&file.AlertMethod{}},
+				QueryData:    map[string]interface{}{"size": 0},
+				Schedule:     "@every 10m",
+				MinSeverity:  minSeverity,
+				Conditions: []config.Condition{
+					{"field": "hits.total", "quantifier": "any", "gt": json.Number("10")},
+				},
+				SubQueries: []SubQuery{
+					{
+						Name:    "Hosts",
+						Index:   "hosts",
+						Filters: []string{"hits.hits._source"},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sq := newSendQueue(defaultSendQueueSize)
+			res, _ := qh.cycle(context.Background(), sq, false)
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			if subQueried != (tc.expected != nil) {
+				t.Fatalf("unexpected sub-query (got %t, expected %t)", subQueried, tc.expected != nil)
+			}
+			if tc.expected == nil {
+				if res.Result == ResultAlert || len(sq.alerts) != 0 {
+					t.Fatalf("expected no alert (got result %v)", res.Result)
+				}
+				return
+			}
+			if res.Result != ResultAlert {
+				t.Fatalf("unexpected result (got %v, expected %v)", res.Result, ResultAlert)
+			}
+			qa := <-sq.alerts
+			if !cmp.Equal(tc.expected, qa.alert.Records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(tc.expected, qa.alert.Records))
+			}
+		})
+	}
+}
@@ -15,6 +15,9 @@ package query
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/mitchellh/mapstructure"
@@ -23,23 +26,153 @@ import (
 	"github.com/morningconsult/go-elasticsearch-alerts/utils"
 )
 
-const hitsDelimiter = "\n----------------------------------------\n"
+const (
+	hitsDelimiter = "\n----------------------------------------\n"
+
+	// countField is the field of a _count API response holding
+	// the number of matching documents
+	countField = "count"
+
+	// otherBucketKey is the key of the field added to a record for
+	// the documents of a terms aggregation which fell outside of
+	// its top buckets (its 'sum_other_doc_count')
+	otherBucketKey = "(other)"
+)
 
 // process converts the raw response returned from Elasticsearch into a
 // []*github.com/morningconsult/go-elasticsearch-alerts/command/alert.Record
 // array and returns that array, the response fields grouped by
 // *QueryHandler.bodyField (if any), and an error if there was an error.
+// Hits below the minimum severity of the rule, if any, are dropped
+// first so that they affect neither the conditions nor the records.
 // If process returns a non-nil error, the other returned values will
 // be nil.
-func (q *QueryHandler) process( // nolint: gocyclo
+func (q *QueryHandler) process(
 	respData map[string]interface{},
 ) ([]*alert.Record, []map[string]interface{}, error) {
-	if len(q.conditions) != 0 && !config.ConditionsMet(q.logger.Named("conditions"), respData, q.conditions) {
+	respData, ok := q.match(respData)
+	if !ok {
 		return nil, nil, nil
 	}
+	return q.convert(respData)
+}
+
+// match drops the hits of the response below the minimum severity
+// of the rule, if any, and returns the remaining response and
+// whether it meets the conditions and the expression of the rule.
+func (q *QueryHandler) match(respData map[string]interface{}) (map[string]interface{}, bool) {
+	if q.minSeverity != nil {
+		respData = q.minSeverity.Filter(respData)
+	}
 
+	if len(q.conditions) != 0 {
+		previous := q.updatePreviousValues(respData)
+		if !config.ConditionsMetSince(q.logger.Named("conditions"), respData, q.conditions, previous) {
+			return nil, false
+		}
+	}
+
+	if q.expression != nil && !config.ExpressionMet(respData, q.values, q.expression) {
+		return nil, false
+	}
+	return respData, true
+}
+
+// convert converts a response which matched the rule into records
+// and returns them along with the response fields grouped by
+// *QueryHandler.bodyField (if any). If convert returns a non-nil
+// error, the other returned values will be nil.
+func (q *QueryHandler) convert(
+	respData map[string]interface{},
+) ([]*alert.Record, []map[string]interface{}, error) {
+	if q.countOnly {
+		return q.countRecords(respData), nil, nil
+	}
+
+	records, err := q.filterRecords(respData, q.filters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Get the body field
+	body := utils.GetAll(respData, q.bodyField)
+	if body == nil {
+		return records, nil, nil
+	}
+
+	stringifiedHits, hits, err := q.gatherHits(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(stringifiedHits) > 0 {
+		record := &alert.Record{
+			Filter:    q.bodyField,
+			Text:      strings.Join(stringifiedHits, hitsDelimiter),
+			BodyField: true,
+			Documents: hits,
+		}
+		records = append(records, record)
+	}
+
+	return records, hits, nil
+}
+
+// updatePreviousValues records the values of the fields of respData
+// on which the delta conditions depend and returns the values they
+// replace. The previous value of a field missing from respData is
+// kept for the next run.
+func (q *QueryHandler) updatePreviousValues(respData map[string]interface{}) map[string]json.Number {
+	current := config.DeltaValues(respData, q.conditions)
+	if len(current) == 0 {
+		return q.previousValues
+	}
+
+	previous := q.previousValues
+	values := make(map[string]json.Number, len(previous)+len(current))
+	for field, v := range previous {
+		values[field] = v
+	}
+	for field, v := range current {
+		values[field] = v
+	}
+	q.previousValues = values
+	return previous
+}
+
+// countRecords returns a single record holding the number of
+// matching documents of a response returned by the _count API,
+// or no records if no documents matched.
+func (q *QueryHandler) countRecords(respData map[string]interface{}) []*alert.Record {
+	n, ok := utils.Get(respData, countField).(json.Number)
+	if !ok {
+		return nil
+	}
+
+	count, err := n.Int64()
+	if err != nil || count < 1 {
+		return nil
+	}
+
+	return []*alert.Record{
+		{
+			Filter: countField,
+			Fields: []*alert.Field{
+				{
+					Key:   "documents",
+					Count: int(count),
+				},
+			},
+		},
+	}
+}
+
+// filterRecords groups respData on each of the given filters and
+// returns one record per filter which yielded any fields, in the
+// same order as filters.
+func (q *QueryHandler) filterRecords(respData map[string]interface{}, filters []string) ([]*alert.Record, error) {
 	records := make([]*alert.Record, 0)
-	for _, filter := range q.filters {
+	for _, filter := range filters {
 		elems := utils.GetAll(respData, filter)
 		if elems == nil || len(elems) < 1 {
 			continue
@@ -47,13 +180,17 @@ func (q *QueryHandler) process( // nolint: gocyclo
 
 		fields, err := q.gatherFields(elems)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 
 		if len(fields) < 1 {
 			continue
 		}
 
+		if other := q.otherBucket(respData, filter); other != nil {
+			fields = append(fields, other)
+		}
+
 		record := &alert.Record{
 			Filter: filter,
 			Fields: fields,
@@ -61,42 +198,100 @@ func (q *QueryHandler) process( // nolint: gocyclo
 
 		records = append(records, record)
 	}
+	return records, nil
+}
 
-	// Get the body field
-	body := utils.GetAll(respData, q.bodyField)
-	if body == nil {
-		return records, nil, nil
+// otherBucket returns a field counting the documents which the
+// terms aggregations whose buckets the filter matches left out of
+// their top buckets, i.e. the sum of their 'sum_other_doc_count',
+// so that truncated results are not mistaken for complete ones.
+// It returns nil if no documents were left out or the filter does
+// not match the buckets of an aggregation.
+func (q *QueryHandler) otherBucket(respData map[string]interface{}, filter string) *alert.Field {
+	var other, errorBound int64
+	for _, agg := range bucketAggregations(respData, filter) {
+		other += aggregationCount(agg["sum_other_doc_count"])
+		errorBound += aggregationCount(agg["doc_count_error_upper_bound"])
+	}
+	if other < 1 {
+		return nil
 	}
+	q.logger.Debug(fmt.Sprintf("[Rule: %q] results of filter are truncated", q.name), "filter", filter,
+		"sum_other_doc_count", other, "doc_count_error_upper_bound", errorBound)
+	return &alert.Field{Key: otherBucketKey, Count: int(other)}
+}
 
-	stringifiedHits, hits, err := q.gatherHits(body)
-	if err != nil {
-		return nil, nil, err
+// bucketAggregations returns the aggregations whose buckets are
+// matched by the filter, e.g. the by_status aggregation within
+// each of the by_service buckets for the filter
+// "aggregations.by_service.buckets[].by_status.buckets[]".
+func bucketAggregations(respData map[string]interface{}, filter string) []map[string]interface{} {
+	var parent string
+	switch {
+	case strings.HasSuffix(filter, ".buckets[]"):
+		parent = strings.TrimSuffix(filter, ".buckets[]")
+	case strings.HasSuffix(filter, ".buckets"):
+		parent = strings.TrimSuffix(filter, ".buckets")
+	default:
+		return nil
 	}
 
-	if len(stringifiedHits) > 0 {
-		record := &alert.Record{
-			Filter:    q.bodyField,
-			Text:      strings.Join(stringifiedHits, hitsDelimiter),
-			BodyField: true,
+	var elems []interface{}
+	if i := strings.LastIndex(parent, "[]."); i >= 0 {
+		// Nested aggregations are found within each of the buckets
+		// of the aggregations they are nested within
+		for _, bucket := range utils.GetBuckets(respData, parent[:i+2]) {
+			if b, ok := bucket.(map[string]interface{}); ok {
+				elems = append(elems, utils.Get(b, parent[i+3:]))
+			}
 		}
-		records = append(records, record)
+	} else {
+		elems = utils.GetAll(respData, parent)
 	}
 
-	return records, hits, nil
+	aggs := make([]map[string]interface{}, 0, len(elems))
+	for _, elem := range elems {
+		if agg, ok := elem.(map[string]interface{}); ok {
+			aggs = append(aggs, agg)
+		}
+	}
+	return aggs
 }
 
+// aggregationCount returns the value of a count of an aggregation
+// response, or zero if it is not a number.
+func aggregationCount(v interface{}) int64 {
+	switch v := v.(type) {
+	case json.Number:
+		n, _ := v.Int64()
+		return n
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// gatherHits stringifies each of the values matching q.bodyField.
+// Strings are used as-is and other values are JSON-encoded, while
+// documents missing the field (or with an empty string) are
+// skipped. Only the values which are objects are returned as hits.
 func (q *QueryHandler) gatherHits(body []interface{}) ([]string, []map[string]interface{}, error) {
 	stringifiedHits := make([]string, 0, len(body))
 	hits := make([]map[string]interface{}, 0, len(body))
 	for _, elem := range body {
-		hit, ok := elem.(map[string]interface{})
-		if !ok {
+		switch v := elem.(type) {
+		case nil:
+			continue
+		case string:
+			if v != "" {
+				stringifiedHits = append(stringifiedHits, v)
+			}
 			continue
+		case map[string]interface{}:
+			hits = append(hits, v)
 		}
 
-		hits = append(hits, hit)
-
-		data, err := json.MarshalIndent(hit, "", "    ")
+		data, err := json.MarshalIndent(elem, "", "    ")
 		if err != nil {
 			return nil, nil, err
 		}
@@ -118,11 +313,100 @@ func (q *QueryHandler) gatherFields(elems []interface{}) ([]*alert.Field, error)
 			return nil, err
 		}
 
-		if field.Key == "" || field.Count < 1 {
+		if q.valueField != "" {
+			v := utils.Get(obj, q.valueField)
+			field.Value = formatValue(v, q.valueFormat)
+			if n, ok := numberValue(v); ok && (q.valueUnit != "" || q.threshold != nil) {
+				field.Number, field.Unit, field.Threshold = &n, q.valueUnit, q.threshold
+			}
+		}
+
+		// Empty buckets are kept if they have a value, e.g. the
+		// derivative of a date_histogram bucket in which the count
+		// dropped to zero
+		if field.Key == "" || (field.Count < 1 && field.Value == "") {
 			continue
 		}
 
+		field.TopHit = topHit(obj)
+
 		fields = append(fields, field)
 	}
 	return fields, nil
 }
+
+// topHit returns the first document of the first (in lexical order
+// of their names) top_hits sub-aggregation of a bucket, i.e. its
+// '_source', or the hit itself if it has none (e.g. if only 'fields'
+// were requested). It returns nil if the bucket has no top_hits
+// sub-aggregation or it has no hits.
+func topHit(bucket map[string]interface{}) map[string]interface{} {
+	names := make([]string, 0, len(bucket))
+	for name := range bucket {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		agg, ok := bucket[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		hits, ok := utils.Get(agg, "hits.hits").([]interface{})
+		if !ok || len(hits) == 0 {
+			continue
+		}
+		hit, ok := hits[0].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if source, ok := hit["_source"].(map[string]interface{}); ok {
+			return source
+		}
+		return hit
+	}
+	return nil
+}
+
+// formatValue renders the value of the value field of a bucket.
+// Numbers are rendered with format if it is not empty, and as they
+// appear in the response otherwise; strings and booleans are used
+// as they are. It returns an empty string for any other value, e.g.
+// if the bucket has no such field, so that its count is shown
+// instead.
+func formatValue(v interface{}, format string) string {
+	switch v := v.(type) {
+	case json.Number:
+		if format == "" {
+			return v.String()
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return v.String()
+		}
+		return fmt.Sprintf(format, f)
+	case float64:
+		if format == "" {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return fmt.Sprintf(format, v)
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// numberValue returns the value of the value field of a bucket as
+// a number, if it is one.
+func numberValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -15,6 +15,9 @@ package query
 
 import (
 	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -342,6 +345,9 @@ func TestProcess(t *testing.T) {
 					Filter:    "hits.hits._source",
 					Text:      "{\n    \"ayy\": \"lmao\"\n}",
 					BodyField: true,
+					Documents: []map[string]interface{}{
+						{"ayy": "lmao"},
+					},
 				},
 			},
 			hits: 1,
@@ -377,6 +383,10 @@ func TestProcess(t *testing.T) {
     "yeah": "buddy"
 }`,
 					BodyField: true,
+					Documents: []map[string]interface{}{
+						{"ayy": "lmao"},
+						{"yeah": "buddy"},
+					},
 				},
 			},
 			hits: 2,
@@ -508,3 +518,871 @@ func TestProcess(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessExpression(t *testing.T) {
+	input := map[string]interface{}{
+		"aggregations": map[string]interface{}{
+			"errors": map[string]interface{}{"doc_count": json.Number("150")},
+			"hostname": map[string]interface{}{
+				"buckets": []interface{}{
+					map[string]interface{}{
+						"key":       "foo",
+						"doc_count": json.Number("2"),
+					},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		expr    string
+		records int
+	}{
+		{"met", "errors > 100", 1},
+		{"not-met", "errors > 1000", 0},
+		{"missing", "errors > 100 AND total > 0", 0},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			expr, err := config.ParseExpression(tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			qh := &QueryHandler{
+				logger:     hclog.NewNullLogger(),
+				filters:    []string{"aggregations.hostname.buckets"},
+				bodyField:  defaultBodyField,
+				expression: expr,
+				values: map[string]string{
+					"errors": "aggregations.errors.doc_count",
+					"total":  "hits.total.value",
+				},
+			}
+			records, _, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != tc.records {
+				t.Fatalf("unexpected number of records (got %d, expected %d)", len(records), tc.records)
+			}
+		})
+	}
+}
+
+func TestProcessNestedAggregation(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "nested_aggregation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var input map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		filter string
+		fields []*alert.Field
+	}{
+		{
+			"two-levels",
+			"aggregations.by_service.buckets[].by_status.buckets[]",
+			[]*alert.Field{
+				{Key: "api/500", Count: 100},
+				{Key: "api/503", Count: 20},
+				{Key: "web/502", Count: 43},
+			},
+		},
+		{
+			"first-level",
+			"aggregations.by_service.buckets[]",
+			[]*alert.Field{
+				{Key: "api", Count: 120},
+				{Key: "web", Count: 43},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:    hclog.NewNullLogger(),
+				filters:   []string{tc.filter},
+				bodyField: defaultBodyField,
+			}
+			records, _, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []*alert.Record{
+				{
+					Filter: tc.filter,
+					Fields: tc.fields,
+				},
+			}
+			if !cmp.Equal(expected, records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+			}
+		})
+	}
+}
+
+func TestProcessOtherBucket(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "truncated_aggregation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var input map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		filter string
+		fields []*alert.Field
+	}{
+		{
+			"terms",
+			"aggregations.hostname.buckets",
+			[]*alert.Field{
+				{Key: "foo", Count: 70},
+				{Key: "bar", Count: 50},
+				{Key: otherBucketKey, Count: 42},
+			},
+		},
+		{
+			"nested",
+			"aggregations.by_service.buckets[].by_status.buckets[]",
+			[]*alert.Field{
+				{Key: "api/500", Count: 73},
+				{Key: "web/502", Count: 43},
+				{Key: otherBucketKey, Count: 12},
+			},
+		},
+		{
+			"nested-flattened",
+			"aggregations.by_service.buckets.by_status.buckets",
+			[]*alert.Field{
+				{Key: "api - 500", Count: 73},
+				{Key: "web - 502", Count: 43},
+				{Key: otherBucketKey, Count: 12},
+			},
+		},
+		{
+			"not-truncated",
+			"aggregations.by_service.buckets[]",
+			[]*alert.Field{
+				{Key: "api", Count: 80},
+				{Key: "web", Count: 48},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:    hclog.NewNullLogger(),
+				filters:   []string{tc.filter},
+				bodyField: defaultBodyField,
+			}
+			records, _, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []*alert.Record{
+				{
+					Filter: tc.filter,
+					Fields: tc.fields,
+				},
+			}
+			if !cmp.Equal(expected, records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+			}
+		})
+	}
+}
+
+func TestProcessTopHits(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "top_hits_aggregation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var input map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		filter string
+		fields []*alert.Field
+	}{
+		{
+			"terms",
+			"aggregations.hostname.buckets",
+			[]*alert.Field{
+				{
+					Key:   "foo",
+					Count: 70,
+					TopHit: map[string]interface{}{
+						"@timestamp": "2019-01-01T00:05:00.000Z",
+						"message":    "connection refused to db-1:5432",
+					},
+				},
+				{
+					// Without a '_source' the hit itself is used
+					Key:   "bar",
+					Count: 50,
+					TopHit: map[string]interface{}{
+						"_index": "filebeat-2019.01.01",
+						"_id":    "b1",
+						"_score": nil,
+						"fields": map[string]interface{}{
+							"message": []interface{}{"disk full on /var"},
+						},
+					},
+				},
+				{Key: "baz", Count: 15},
+			},
+		},
+		{
+			"nested",
+			"aggregations.by_service.buckets[].by_status.buckets[]",
+			[]*alert.Field{
+				{
+					Key:    "api/500",
+					Count:  80,
+					TopHit: map[string]interface{}{"request": "GET /api/users"},
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:    hclog.NewNullLogger(),
+				filters:   []string{tc.filter},
+				bodyField: defaultBodyField,
+			}
+			records, _, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []*alert.Record{
+				{
+					Filter: tc.filter,
+					Fields: tc.fields,
+				},
+			}
+			if !cmp.Equal(expected, records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+			}
+		})
+	}
+}
+
+func TestProcessPipelineAggregation(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "derivative_aggregation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var input map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	const filter = "aggregations.per_minute.buckets"
+	threshold := 30.0
+	number := func(f float64) *float64 { return &f }
+	cases := []struct {
+		name       string
+		valueField string
+		conditions []config.Condition
+		fields     []*alert.Field
+	}{
+		{
+			"derivative-above-threshold",
+			"errors_deriv.value",
+			[]config.Condition{
+				{"field": filter + ".errors_deriv.value", "quantifier": "any", "gt": json.Number("30")},
+			},
+			[]*alert.Field{
+				// The first bucket has no derivative
+				{Key: "2019-01-01T00:00:00.000Z", Count: 10},
+				{Key: "2019-01-01T00:01:00.000Z", Count: 15, Value: "5.0", Number: number(5), Threshold: &threshold},
+				{Key: "2019-01-01T00:02:00.000Z", Count: 55, Value: "40.0", Number: number(40), Threshold: &threshold},
+				{Key: "2019-01-01T00:03:00.000Z", Count: 70, Value: "15.0", Number: number(15), Threshold: &threshold},
+				// Empty buckets are kept if they have a value
+				{Key: "2019-01-01T00:04:00.000Z", Value: "-70.0", Number: number(-70), Threshold: &threshold},
+			},
+		},
+		{
+			"derivative-below-threshold",
+			"errors_deriv.value",
+			[]config.Condition{
+				{"field": filter + ".errors_deriv.value", "quantifier": "any", "gt": json.Number("40")},
+			},
+			nil,
+		},
+		{
+			// The moving average of the first bucket is null
+			"moving-average-null-ignored",
+			"errors_avg.value",
+			[]config.Condition{
+				{"field": filter + ".errors_avg.value", "quantifier": "any", "gt": json.Number("35")},
+			},
+			nil,
+		},
+		{
+			"moving-average-all",
+			"errors_avg.value",
+			[]config.Condition{
+				{"field": filter + ".errors_avg.value", "quantifier": "all", "gt": json.Number("5")},
+			},
+			[]*alert.Field{
+				{Key: "2019-01-01T00:00:00.000Z", Count: 10},
+				{Key: "2019-01-01T00:01:00.000Z", Count: 15, Value: "10.0", Number: number(10), Threshold: &threshold},
+				{Key: "2019-01-01T00:02:00.000Z", Count: 55, Value: "12.5", Number: number(12.5), Threshold: &threshold},
+				{
+					Key:       "2019-01-01T00:03:00.000Z",
+					Count:     70,
+					Value:     "26.666666666666668",
+					Number:    number(26.666666666666668),
+					Threshold: &threshold,
+				},
+				{
+					Key:       "2019-01-01T00:04:00.000Z",
+					Value:     "31.666666666666668",
+					Number:    number(31.666666666666668),
+					Threshold: &threshold,
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:     hclog.NewNullLogger(),
+				filters:    []string{filter},
+				bodyField:  defaultBodyField,
+				conditions: tc.conditions,
+				valueField: tc.valueField,
+				threshold:  &threshold,
+			}
+			records, _, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected []*alert.Record
+			if tc.fields != nil {
+				expected = []*alert.Record{
+					{
+						Filter: filter,
+						Fields: tc.fields,
+					},
+				}
+			}
+			if !cmp.Equal(expected, records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+			}
+		})
+	}
+}
+
+func TestProcessValueField(t *testing.T) {
+	const filter = "aggregations.hostname.buckets"
+	response := `{
+  "aggregations": {
+    "hostname": {
+      "buckets": [
+        {"key": "foo", "doc_count": 3, "max_errors": {"value": 120}, "latency": {"value": 12.345}, "state": "degraded"},
+        {"key": "bar", "doc_count": 5}
+      ]
+    }
+  }
+}`
+	var input map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(response))
+	dec.UseNumber()
+	if err := dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		field  string
+		format string
+		value  string
+	}{
+		{"integer", "max_errors.value", "", "120"},
+		{"float", "latency.value", "", "12.345"},
+		{"formatted-float", "latency.value", "%.1f ms", "12.3 ms"},
+		{"formatted-integer", "max_errors.value", "%.0f errors", "120 errors"},
+		{"string", "state", "%.1f", "degraded"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:      hclog.NewNullLogger(),
+				filters:     []string{filter},
+				bodyField:   defaultBodyField,
+				valueField:  tc.field,
+				valueFormat: tc.format,
+			}
+			records, _, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []*alert.Record{
+				{
+					Filter: filter,
+					Fields: []*alert.Field{
+						{Key: "foo", Count: 3, Value: tc.value},
+						// Buckets without the field fall back to their count
+						{Key: "bar", Count: 5},
+					},
+				},
+			}
+			if !cmp.Equal(expected, records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+			}
+			if got := records[0].Fields[1].Display(); got != "5" {
+				t.Errorf("unexpected displayed count (got %q, expected %q)", got, "5")
+			}
+		})
+	}
+}
+
+func TestProcessValueUnit(t *testing.T) {
+	filter := "aggregations.hostname.buckets"
+	response := `{
+  "aggregations": {
+    "hostname": {
+      "buckets": [
+        {"key": "foo", "doc_count": 3, "latency": {"value": 1234}},
+        {"key": "bar", "doc_count": 5, "latency": {"value": "n/a"}}
+      ]
+    }
+  }
+}`
+	var input map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(response))
+	dec.UseNumber()
+	if err := dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	threshold := float64(1000)
+	qh := &QueryHandler{
+		logger:     hclog.NewNullLogger(),
+		filters:    []string{filter},
+		bodyField:  defaultBodyField,
+		valueField: "latency.value",
+		valueUnit:  alert.UnitMillis,
+		threshold:  &threshold,
+	}
+	records, _, err := qh.process(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	number := float64(1234)
+	expected := []*alert.Record{
+		{
+			Filter: filter,
+			Fields: []*alert.Field{
+				{Key: "foo", Count: 3, Value: "1234", Number: &number, Unit: alert.UnitMillis, Threshold: &threshold},
+				// Values which are not numbers are shown as they are
+				{Key: "bar", Count: 5, Value: "n/a"},
+			},
+		},
+	}
+	if !cmp.Equal(expected, records) {
+		t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+	}
+	if got := records[0].Fields[0].Display(); got != "1.2 s" {
+		t.Errorf("unexpected displayed value (got %q, expected %q)", got, "1.2 s")
+	}
+}
+
+func TestProcessRuntimeFieldAggregation(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "runtime_field_aggregation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var input map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		filter string
+		fields []*alert.Field
+	}{
+		{
+			"keyword",
+			"aggregations.by_status_class.buckets",
+			[]*alert.Field{
+				{Key: "5xx", Count: 42},
+				{Key: "4xx", Count: 15},
+			},
+		},
+		{
+			"boolean-nested",
+			"aggregations.by_status_class.buckets.by_slow.buckets",
+			[]*alert.Field{
+				{Key: "5xx - true", Count: 30},
+				{Key: "5xx - false", Count: 12},
+				{Key: "4xx - false", Count: 15},
+			},
+		},
+		{
+			"boolean-walk",
+			"aggregations.by_status_class.buckets[].by_slow.buckets[]",
+			[]*alert.Field{
+				{Key: "5xx/true", Count: 30},
+				{Key: "5xx/false", Count: 12},
+				{Key: "4xx/false", Count: 15},
+			},
+		},
+		{
+			"numeric",
+			"aggregations.by_latency_bucket.buckets",
+			[]*alert.Field{
+				{Key: "1000", Count: 40},
+				{Key: "500", Count: 17},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:    hclog.NewNullLogger(),
+				filters:   []string{tc.filter},
+				bodyField: defaultBodyField,
+			}
+			records, _, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []*alert.Record{
+				{
+					Filter: tc.filter,
+					Fields: tc.fields,
+				},
+			}
+			if !cmp.Equal(expected, records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+			}
+		})
+	}
+}
+
+func TestProcessKeyedAggregation(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "keyed_aggregation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var input map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		filter string
+		fields []*alert.Field
+	}{
+		{
+			"filters",
+			"aggregations.levels.buckets",
+			[]*alert.Field{
+				{Key: "errors", Count: 34},
+				{Key: "warnings", Count: 120},
+			},
+		},
+		{
+			"filters-nested",
+			"aggregations.by_service.buckets.levels.buckets",
+			[]*alert.Field{
+				{Key: "api - errors", Count: 30},
+				{Key: "api - warnings", Count: 80},
+				{Key: "web - errors", Count: 4},
+				{Key: "web - warnings", Count: 40},
+			},
+		},
+		{
+			"filters-walk",
+			"aggregations.by_service.buckets[].levels.buckets[]",
+			[]*alert.Field{
+				{Key: "api/errors", Count: 30},
+				{Key: "api/warnings", Count: 80},
+				{Key: "web/errors", Count: 4},
+				{Key: "web/warnings", Count: 40},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:    hclog.NewNullLogger(),
+				filters:   []string{tc.filter},
+				bodyField: defaultBodyField,
+			}
+			records, _, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []*alert.Record{
+				{
+					Filter: tc.filter,
+					Fields: tc.fields,
+				},
+			}
+			if !cmp.Equal(expected, records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+			}
+		})
+	}
+}
+
+func TestProcessMinSeverity(t *testing.T) {
+	minSeverity, err := config.ParseSeverityFilter("severity", "error", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qh := &QueryHandler{
+		logger:      hclog.NewNullLogger(),
+		bodyField:   defaultBodyField,
+		minSeverity: minSeverity,
+		conditions: []config.Condition{
+			{
+				"field":      "hits.hits._source.severity",
+				"quantifier": "all",
+				"ne":         "debug",
+			},
+		},
+	}
+
+	hit := func(severity string) interface{} {
+		return map[string]interface{}{
+			"_source": map[string]interface{}{"severity": severity, "message": severity + " message"},
+		}
+	}
+	response := func(severities ...string) map[string]interface{} {
+		hits := make([]interface{}, 0, len(severities))
+		for _, severity := range severities {
+			hits = append(hits, hit(severity))
+		}
+		return map[string]interface{}{
+			"hits": map[string]interface{}{"hits": hits},
+		}
+	}
+
+	records, hits, err := qh.process(response("debug", "error", "info", "crit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(hits) != 2 {
+		t.Fatalf("expected 1 record of 2 hits, got %d records and %d hits", len(records), len(hits))
+	}
+	for _, dropped := range []string{"debug", "info"} {
+		if strings.Contains(records[0].Text, dropped+" message") {
+			t.Fatalf("hit of severity %q should have been dropped:\n%s", dropped, records[0].Text)
+		}
+	}
+
+	if records, _, err = qh.process(response("debug", "info")); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected no records when every hit is below the minimum, got %d", len(records))
+	}
+}
+
+func TestProcessDelta(t *testing.T) {
+	qh := &QueryHandler{
+		logger:    hclog.NewNullLogger(),
+		filters:   []string{"aggregations.hostname.buckets"},
+		bodyField: defaultBodyField,
+		conditions: []config.Condition{
+			{
+				"field":      "aggregations.errors.doc_count",
+				"quantifier": "any",
+				"delta":      true,
+				"gt":         json.Number("500"),
+			},
+		},
+	}
+
+	response := func(errors string) map[string]interface{} {
+		return map[string]interface{}{
+			"aggregations": map[string]interface{}{
+				"errors": map[string]interface{}{"doc_count": json.Number(errors)},
+				"hostname": map[string]interface{}{
+					"buckets": []interface{}{
+						map[string]interface{}{
+							"key":       "foo",
+							"doc_count": json.Number("2"),
+						},
+					},
+				},
+			},
+		}
+	}
+
+	runs := []struct {
+		name    string
+		errors  string
+		records int
+	}{
+		{"first-run", "1000", 0},
+		{"increased", "1600", 1},
+		{"increased-below-threshold", "1700", 0},
+		{"decreased", "100", 0},
+		{"increased-after-decrease", "700", 1},
+	}
+
+	for _, run := range runs {
+		records, _, err := qh.process(response(run.errors))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != run.records {
+			t.Fatalf("%s: unexpected number of records (got %d, expected %d)", run.name, len(records), run.records)
+		}
+		if v := qh.previousValues["aggregations.errors.doc_count"]; v.String() != run.errors {
+			t.Fatalf("%s: previous value not updated (got %s, expected %s)", run.name, v, run.errors)
+		}
+	}
+}
+
+func TestProcessBodyField(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "body_field.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var input map[string]interface{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		bodyField string
+		text      string
+		hits      int
+	}{
+		{
+			"present-in-some",
+			"hits.hits._source.message",
+			"connection refused" + hitsDelimiter + "request timed out",
+			0,
+		},
+		{
+			"nested",
+			"hits.hits._source.error.stack",
+			"dial tcp 10.0.0.1:5432: connect: connection refused" + hitsDelimiter + "context deadline exceeded",
+			0,
+		},
+		{
+			"number",
+			"hits.hits._source.error.code",
+			"111" + hitsDelimiter + "504",
+			0,
+		},
+		{
+			"object",
+			"hits.hits._source.error",
+			"{\n    \"code\": 111,\n    \"stack\": \"dial tcp 10.0.0.1:5432: connect: connection refused\"\n}" +
+				hitsDelimiter +
+				"{\n    \"code\": 504,\n    \"stack\": \"context deadline exceeded\"\n}",
+			2,
+		},
+		{
+			"absent",
+			"hits.hits._source.stack_trace",
+			"",
+			0,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			qh := &QueryHandler{
+				logger:    hclog.NewNullLogger(),
+				bodyField: tc.bodyField,
+			}
+			records, hits, err := qh.process(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != tc.hits {
+				t.Fatalf("unexpected number of hits (got %d, expected %d)", len(hits), tc.hits)
+			}
+
+			if tc.text == "" {
+				if len(records) != 0 {
+					t.Fatalf("expected no records (got %d)", len(records))
+				}
+				return
+			}
+			expected := []*alert.Record{
+				{
+					Filter:    tc.bodyField,
+					Text:      tc.text,
+					BodyField: true,
+					Documents: hits,
+				},
+			}
+			if !cmp.Equal(expected, records) {
+				t.Errorf("Results differ:\n%v", cmp.Diff(expected, records))
+			}
+		})
+	}
+}
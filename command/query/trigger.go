@@ -0,0 +1,96 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+	"golang.org/x/xerrors"
+)
+
+// ErrNotLeader is the error of an on-demand execution requested of
+// a process which is not the leader, and therefore does not run
+// queries.
+var ErrNotLeader = xerrors.New("this process is not the leader")
+
+// RunResult is the outcome of an execution of a rule.
+type RunResult struct {
+	// Result is one of the Result constants
+	Result string
+
+	// Matched is the number of records the query produced, before
+	// any were suppressed
+	Matched int
+
+	// Err is the error of the execution, if any
+	Err error
+}
+
+// Trigger executes the query of the running QueryHandler once, now,
+// as if it were due, and returns the outcome. The execution is
+// subject to the maintenance windows, the alert cooldown and the
+// dedup keys of the rule, and it starts the cooldown of the alert it
+// sends, if any, as a scheduled one would; its schedule is
+// unaffected. It returns a non-nil error if ctx is done before the
+// execution completes, e.g. because the QueryHandler is not running,
+// ErrNotLeader, or ErrPaused.
+func (q *QueryHandler) Trigger(ctx context.Context) (*RunResult, error) {
+	// The reply is buffered so that the run loop never waits for
+	// a caller which gave up
+	reply := make(chan *RunResult, 1)
+	select {
+	case q.triggerCh <- reply:
+	case <-ctx.Done():
+		return nil, xerrors.Errorf("rule is not running: %v", ctx.Err())
+	}
+	select {
+	case res := <-reply:
+		if res.Err == ErrNotLeader || res.Err == ErrPaused {
+			return nil, res.Err
+		}
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// trigger executes the query on demand from the run loop, which is
+// next due at the given time, and persists the state it changed.
+func (q *QueryHandler) trigger(
+	ctx context.Context,
+	sq *sendQueue,
+	distLock *lock.Lock,
+	next time.Time,
+	maintainState bool,
+) *RunResult {
+	if !distLock.Acquired() {
+		return &RunResult{Err: ErrNotLeader}
+	}
+	if q.Paused() {
+		return &RunResult{Err: ErrPaused}
+	}
+	q.logger.Info(fmt.Sprintf("[Rule: %q] executing query on demand", q.name))
+	res, hits := q.cycle(ctx, sq, false)
+	if maintainState {
+		if err := q.setNextQuery(ctx, next, hits); err != nil {
+			q.logger.Warn(fmt.Sprintf("[Rule: %q] error creating next query document in Elasticsearch", q.name),
+				"error", err)
+		}
+	}
+	q.updateStatus(res.Result, res.Err, next)
+	return res
+}
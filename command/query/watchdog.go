@@ -0,0 +1,173 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+)
+
+// watchdogGrace is how long a stuck run is given to return once it
+// has been canceled before it is reported as stuck.
+var watchdogGrace = 5 * time.Second
+
+// watchdogAbandon is how long a stuck run is waited for once it has
+// been canceled before it is abandoned and the QueryHandler is
+// restarted anyway.
+var watchdogAbandon = time.Minute
+
+// supervise runs the QueryHandler, restarting it whenever a run has
+// taken more than q.maxRuntime since it was due (see stalledFor),
+// e.g. because a request or a send blocked without a timeout. The
+// stuck run is canceled and the QueryHandler is restarted once it
+// has returned. A run which has not returned after watchdogGrace is
+// reported as stuck (see Status.StuckSince), and one which has not
+// returned after watchdogAbandon, e.g. because it is blocked in a
+// call which ignores the cancellation, is abandoned and the
+// QueryHandler restarted anyway. An abandoned run cannot send alerts
+// or write the state of the rule, since a canceled run stops before
+// doing either (see timedQuery, dispatch and run). It returns once
+// ctx is done or the QueryHandler is stopped.
+func (q *QueryHandler) supervise(ctx context.Context, outputCh chan *alert.Alert, distLock *lock.Lock) {
+	clk := q.clk()
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		q.heartbeat(clk.Now())
+		go func() {
+			defer close(done)
+			q.run(runCtx, outputCh, distLock)
+		}()
+
+		if !q.watch(done) {
+			cancel()
+			return
+		}
+		cancel()
+
+		if !q.awaitStuck(ctx, done) {
+			return
+		}
+		q.restarted()
+	}
+}
+
+// awaitStuck waits for a canceled run to return or to be abandoned
+// after watchdogAbandon, in which case it returns true, reporting
+// the run as stuck after watchdogGrace. It returns false if ctx is
+// done or the QueryHandler is stopped first.
+func (q *QueryHandler) awaitStuck(ctx context.Context, done chan struct{}) bool {
+	var (
+		clk     = q.clk()
+		grace   = clk.After(watchdogGrace)
+		abandon = clk.After(watchdogAbandon)
+	)
+	defer q.setStuck(time.Time{})
+	for {
+		select {
+		case <-done:
+			return ctx.Err() == nil
+		case <-ctx.Done():
+			return false
+		case <-q.StopCh:
+			return false
+		case <-grace:
+			q.logger.Warn(fmt.Sprintf("[Rule: %q] stuck run did not return after being canceled, "+
+				"waiting for it before restarting", q.name), "abandon_after", watchdogAbandon.String())
+			q.setStuck(clk.Now())
+			grace = nil
+		case <-abandon:
+			q.logger.Error(fmt.Sprintf("[Rule: %q] stuck run did not return after being canceled, "+
+				"abandoning it and restarting", q.name), "waited", watchdogAbandon.String())
+			q.abandoned(done)
+			return ctx.Err() == nil
+		}
+	}
+}
+
+// watch waits for the run to return, in which case it returns
+// false, or to take more than q.maxRuntime, in which case it
+// returns true.
+func (q *QueryHandler) watch(done chan struct{}) bool {
+	clk := q.clk()
+	interval := q.maxRuntime / 4
+	for {
+		select {
+		case <-done:
+			return false
+		case <-clk.After(interval):
+			if stalled := q.stalledFor(clk.Now()); stalled > q.maxRuntime {
+				q.logger.Error(fmt.Sprintf("[Rule: %q] run exceeded its maximum runtime, restarting", q.name),
+					"max_runtime", q.maxRuntime.String(), "stalled_for", stalled.String(),
+					"last_heartbeat", q.Status().Heartbeat.Format(time.RFC3339))
+				return true
+			}
+		}
+	}
+}
+
+// stalledFor returns how long ago the current run was due, i.e. the
+// later of the last heartbeat and the next scheduled run, or zero if
+// it is not due yet.
+func (q *QueryHandler) stalledFor(now time.Time) time.Duration {
+	status := q.Status()
+	due := status.NextRun
+	if status.Heartbeat.After(due) {
+		due = status.Heartbeat
+	}
+	if !now.After(due) {
+		return 0
+	}
+	return now.Sub(due)
+}
+
+// heartbeat records that Run started or completed a cycle at t.
+func (q *QueryHandler) heartbeat(t time.Time) {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	q.status.Heartbeat = t
+}
+
+// setStuck records since when a canceled run has not returned, or
+// that none is stuck if t is zero.
+func (q *QueryHandler) setStuck(t time.Time) {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	q.status.StuckSince = t
+}
+
+// abandoned records that the run, which is done once done is closed,
+// was abandoned, until it returns.
+func (q *QueryHandler) abandoned(done chan struct{}) {
+	q.statusMu.Lock()
+	q.status.AbandonedRuns++
+	q.statusMu.Unlock()
+	go func() {
+		<-done
+		q.statusMu.Lock()
+		defer q.statusMu.Unlock()
+		q.status.AbandonedRuns--
+	}()
+}
+
+// restarted records that Run was restarted by the watchdog.
+func (q *QueryHandler) restarted() {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	q.status.Restarts++
+}
@@ -0,0 +1,322 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert/file"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/lock"
+)
+
+func TestRunRestartsStuckRule(t *testing.T) {
+	queryIndex := randomUUID(t)
+
+	// The first query hangs until it is canceled or the test ends
+	var queries int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/<%s-status-%s-{now/d}>/_doc", defaultStateIndexAlias, templateVersion):
+			w.WriteHeader(201)
+		case fmt.Sprintf("/%s/_search", queryIndex):
+			if atomic.AddInt32(&queries, 1) == 1 {
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hits":{"hits":[]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Stuck Rule",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   queryIndex,
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData:    map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}},
+		Schedule:     "@every 10m",
+		MaxRuntime:   200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	outputCh := make(chan *alert.Alert, 1)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+
+	deadline := time.After(5 * time.Second)
+	for {
+		status := qh.Status()
+		if status.Restarts > 0 && status.LastResult == ResultOK {
+			if status.Restarts != 1 {
+				t.Fatalf("expected the rule to be restarted once (got %d restarts)", status.Restarts)
+			}
+			if status.Heartbeat.IsZero() {
+				t.Fatal("expected a heartbeat")
+			}
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for the stuck rule to be restarted (status: %+v)", status)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Fatalf("expected 2 queries (got %d)", n)
+	}
+}
+
+// stuckTransport blocks the first request to path until release is
+// closed and then sends it, ignoring the cancellation of the request.
+type stuckTransport struct {
+	path     string
+	searches int32
+	release  chan struct{}
+}
+
+func (s *stuckTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == s.path && atomic.AddInt32(&s.searches, 1) == 1 {
+		<-s.release
+		// The request is sent as if it had not been canceled
+		return http.DefaultTransport.RoundTrip(req.WithContext(context.Background()))
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRunWaitsForStuckRule(t *testing.T) {
+	defer func(grace time.Duration) { watchdogGrace = grace }(watchdogGrace)
+	watchdogGrace = 50 * time.Millisecond
+
+	queryIndex := randomUUID(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/<%s-status-%s-{now/d}>/_doc", defaultStateIndexAlias, templateVersion):
+			w.WriteHeader(201)
+		case fmt.Sprintf("/%s/_search", queryIndex):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hits":{"hits":[]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	transport := &stuckTransport{
+		path:    fmt.Sprintf("/%s/_search", queryIndex),
+		release: make(chan struct{}),
+	}
+	released := false
+	defer func() {
+		if !released {
+			close(transport.release)
+		}
+	}()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Stuck Rule",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   queryIndex,
+		Client:       &http.Client{Transport: transport},
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData:    map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}},
+		Schedule:     "@every 10m",
+		MaxRuntime:   100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	outputCh := make(chan *alert.Alert, 1)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+
+	// The stuck run ignores its cancellation, so the rule must not
+	// be restarted alongside it after the grace period, but it is
+	// reported as stuck
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(&transport.searches); n != 1 {
+		t.Fatalf("expected 1 query while the stuck run is alive (got %d)", n)
+	}
+	if status := qh.Status(); status.Restarts != 0 || status.StuckSince.IsZero() {
+		t.Fatalf("expected a stuck run and no restart while it is alive (status: %+v)", status)
+	}
+
+	close(transport.release)
+	released = true
+
+	deadline := time.After(5 * time.Second)
+	for {
+		status := qh.Status()
+		if status.Restarts > 0 && status.LastResult == ResultOK {
+			if status.Restarts != 1 {
+				t.Fatalf("expected the rule to be restarted once (got %d restarts)", status.Restarts)
+			}
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for the stuck rule to be restarted (status: %+v)", status)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if n := atomic.LoadInt32(&transport.searches); n != 2 {
+		t.Fatalf("expected 2 queries (got %d)", n)
+	}
+	if status := qh.Status(); !status.StuckSince.IsZero() {
+		t.Fatalf("the run should no longer be reported as stuck (status: %+v)", status)
+	}
+}
+
+func TestRunAbandonsStuckRule(t *testing.T) {
+	defer func(grace, abandon time.Duration) {
+		watchdogGrace, watchdogAbandon = grace, abandon
+	}(watchdogGrace, watchdogAbandon)
+	watchdogGrace, watchdogAbandon = 50*time.Millisecond, 200*time.Millisecond
+
+	queryIndex := randomUUID(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fmt.Sprintf("/<%s-status-%s-{now/d}>/_doc", defaultStateIndexAlias, templateVersion):
+			w.WriteHeader(201)
+		case fmt.Sprintf("/%s/_search", queryIndex):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hits":{"hits":[{"_source":{"message":"error"}}]}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	transport := &stuckTransport{
+		path:    fmt.Sprintf("/%s/_search", queryIndex),
+		release: make(chan struct{}),
+	}
+	released := false
+	defer func() {
+		if !released {
+			close(transport.release)
+		}
+	}()
+
+	qh, err := NewQueryHandler(&QueryHandlerConfig{
+		Name:         "Test Stuck Rule",
+		Logger:       hclog.NewNullLogger(),
+		ESUrl:        ts.URL,
+		QueryIndex:   queryIndex,
+		Client:       &http.Client{Transport: transport},
+		AlertMethods: []alert.Method{&file.AlertMethod{}},
+		QueryData:    map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}},
+		Schedule:     "@every 10m",
+		MaxRuntime:   100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	outputCh := make(chan *alert.Alert, 4)
+	lock := lock.NewLock()
+	lock.Set(true)
+	wg.Add(1)
+
+	go qh.Run(ctx, outputCh, &wg, lock)
+
+	// The stuck run is abandoned and the restarted one alerts
+	select {
+	case <-outputCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the restarted rule to alert (status: %+v)", qh.Status())
+	}
+	var status Status
+	deadline := time.Now().Add(5 * time.Second)
+	for status = qh.Status(); status.LastResult != ResultAlert && time.Now().Before(deadline); status = qh.Status() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Restarts != 1 || status.AbandonedRuns != 1 {
+		t.Fatalf("expected one restart and one abandoned run (status: %+v)", status)
+	}
+	lastAlert := status.LastAlert
+
+	// Once it returns, the abandoned run neither alerts nor counts
+	// as abandoned any more
+	close(transport.release)
+	released = true
+	deadline = time.Now().Add(5 * time.Second)
+	for qh.Status().AbandonedRuns > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status = qh.Status(); status.AbandonedRuns != 0 {
+		t.Fatalf("the abandoned run should have returned (status: %+v)", status)
+	}
+	select {
+	case a := <-outputCh:
+		t.Fatalf("the abandoned run should not have alerted (got %+v)", a)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// The abandoned run has returned (see abandoned), so its writes
+	// happened before the status was read
+	if !qh.lastAlert.Equal(lastAlert) {
+		t.Fatalf("the abandoned run should not have started a cooldown (got %s, expected %s)", qh.lastAlert, lastAlert)
+	}
+	if n := atomic.LoadInt32(&transport.searches); n != 2 {
+		t.Fatalf("expected 2 queries (got %d)", n)
+	}
+}
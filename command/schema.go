@@ -0,0 +1,101 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/schema"
+)
+
+// RunConfigSchema prints the JSON Schema of the main configuration
+// file, or of a rule configuration file if kind is "rule", to
+// stdout. This function should be called directly within os.Exit()
+// in your main.main() function.
+func RunConfigSchema(kind string) int {
+	var doc map[string]interface{}
+	switch kind {
+	case "", "config":
+		doc = configSchema()
+	case "rule":
+		doc = ruleSchema()
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: go-elasticsearch-alerts config-schema [config|rule]")
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		fmt.Fprintf(os.Stderr, "error JSON-encoding schema: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func configSchema() map[string]interface{} {
+	g := &schema.Generator{Tag: "json"}
+	return g.Document("go-elasticsearch-alerts configuration file", config.Config{})
+}
+
+func ruleSchema() map[string]interface{} {
+	g := &schema.Generator{
+		Tag: "json",
+		Overrides: map[reflect.Type]map[string]interface{}{
+			reflect.TypeOf(config.OutputConfig{}): outputSchema(),
+		},
+	}
+	return g.Document("go-elasticsearch-alerts rule file", config.RuleConfig{})
+}
+
+// outputSchema returns the schema of an element of the 'outputs'
+// field of a rule, generated from the struct tags of
+// config.OutputConfig except that the 'type' of the output is one of
+// the registered types and the schema of the 'config' field depends
+// on it.
+func outputSchema() map[string]interface{} {
+	g := &schema.Generator{Tag: "mapstructure"}
+
+	types := alert.Types()
+	conditionals := make([]interface{}, 0, len(types))
+	for _, t := range types {
+		cfg := alert.Config(t)
+		if cfg == nil {
+			continue
+		}
+		conditionals = append(conditionals, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"type": map[string]interface{}{"const": t},
+				},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"config": g.Schema(cfg),
+				},
+			},
+		})
+	}
+
+	s := (&schema.Generator{Tag: "json"}).Schema(config.OutputConfig{})
+	s["properties"].(map[string]interface{})["type"] = map[string]interface{}{"enum": types}
+	s["required"] = []string{"type", "config"}
+	s["allOf"] = conditionals
+	return s
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package command
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+func TestOutputSchema(t *testing.T) {
+	s := outputSchema()
+	properties, ok := s["properties"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("the schema has no properties: %v", s)
+	}
+
+	// Every field of an output is in the schema
+	typ := reflect.TypeOf(config.OutputConfig{})
+	var fields int
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields++
+		if _, ok := properties[name]; !ok {
+			t.Errorf("field %q of an output is missing from the schema", name)
+		}
+	}
+	if len(properties) != fields {
+		t.Errorf("unexpected properties in the schema (got %d, expected %d)", len(properties), fields)
+	}
+
+	// The 'match' expression and the 'priority' are typed from their
+	// fields rather than left out
+	for name, expected := range map[string]string{"match": "string", "priority": "integer", "enabled": "boolean"} {
+		if field, _ := properties[name].(map[string]interface{}); field["type"] != expected {
+			t.Errorf("unexpected schema of field %q (got %v, expected type %q)", name, field, expected)
+		}
+	}
+
+	typeSchema, _ := properties["type"].(map[string]interface{})
+	if !reflect.DeepEqual(typeSchema["enum"], alert.Types()) {
+		t.Errorf("the 'type' of an output should be one of the registered types (got %v)", typeSchema)
+	}
+}
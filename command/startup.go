@@ -0,0 +1,75 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/query"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+	"golang.org/x/xerrors"
+)
+
+// startupCheckTimeout is how long each startup connectivity check
+// may take before it is considered to have failed.
+const startupCheckTimeout = 10 * time.Second
+
+// checkConnections verifies that Elasticsearch and the outputs of
+// each rule are reachable, logging a warning for each which is not.
+// The outputs of the rules are checked concurrently. It returns a
+// non-nil error if any check failed.
+func checkConnections(
+	ctx context.Context,
+	rules []config.RuleConfig,
+	qhs []*query.QueryHandler,
+	logger hclog.Logger,
+) error {
+	if len(qhs) < 1 {
+		return nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	check := func(f func(context.Context) error, msg string, args ...interface{}) {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, startupCheckTimeout)
+		defer cancel()
+		if err := f(ctx); err != nil {
+			logger.Warn(msg, append(args, "error", err)...)
+			mu.Lock()
+			failed++
+			mu.Unlock()
+		}
+	}
+
+	wg.Add(len(qhs) + 1)
+	go check(qhs[0].Ping, "Startup check failed: Elasticsearch is unreachable")
+	for i, qh := range qhs {
+		go check(qh.CheckOutputs, fmt.Sprintf("[Rule: %q] Startup check failed: outputs are unreachable", rules[i].Name))
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		return xerrors.Errorf("%d startup check(s) failed", failed)
+	}
+	logger.Info("Startup checks passed")
+	return nil
+}
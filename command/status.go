@@ -0,0 +1,93 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/command/query"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+const statusTimeout = 30 * time.Second
+
+// RunStatus prints the last run, next scheduled run and last alert
+// of each rule as persisted in the state indices. This function
+// should be called directly within os.Exit() in your main.main()
+// function.
+func RunStatus() int {
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+
+	esClient, err := newESClient(cfg, hclog.NewNullLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating new Elasticsearch HTTP client: %v\n", err)
+		return 1
+	}
+
+	opts := &alert.FactoryOptions{
+		Client: logRequests(cfg.NewHTTPClient(), "outputs"),
+	}
+	qhs, err := buildQueryHandlers(cfg.Rules, cfg.Elasticsearch, cfg.State, cfg.MaintenanceWindows, cfg.IndexPolicy(),
+		esClient, opts, nil, hclog.NewNullLogger())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating query handlers from rules: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+
+	return printStatus(ctx, os.Stdout, cfg.Rules, qhs)
+}
+
+func printStatus(ctx context.Context, w io.Writer, rules []config.RuleConfig, qhs []*query.QueryHandler) int {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tLAST RUN\tNEXT RUN\tLAST ALERT")
+
+	code := 0
+	for i, qh := range qhs {
+		state, err := qh.State(ctx)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t- (error: %v)\n", rules[i].Name, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rules[i].Name,
+			formatStatusTime(state.LastRun),
+			formatStatusTime(state.NextQuery),
+			formatStatusTime(state.LastAlert))
+	}
+	if err := tw.Flush(); err != nil {
+		return 1
+	}
+	return code
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
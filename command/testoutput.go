@@ -0,0 +1,147 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/command/alert"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
+)
+
+const testOutputTimeout = 30 * time.Second
+
+// sampleRecords are sent by RunTestOutput in lieu of real
+// query results.
+var sampleRecords = []*alert.Record{
+	{
+		Filter: "aggregations.hostname.buckets",
+		Fields: []*alert.Field{
+			{
+				Key:   "test-host-1",
+				Count: 12,
+			},
+			{
+				Key:   "test-host-2",
+				Count: 3,
+			},
+		},
+	},
+	{
+		Filter:    "hits.hits._source",
+		Text:      "{\n    \"message\": \"This is a test alert sent by go-elasticsearch-alerts\"\n}",
+		BodyField: true,
+	},
+}
+
+// RunTestOutput sends a sample alert through the outputs of the
+// rule with the given name, through the output of the main
+// configuration file with that name if no rule has it, or else
+// through every output of the given type (e.g. "slack") which has
+// no name. The result of each attempt is printed to stdout. This
+// function should be called directly within os.Exit() in your
+// main.main() function.
+func RunTestOutput(name string) int {
+	if name == "" {
+		fmt.Fprintln(os.Stderr, "Usage: go-elasticsearch-alerts test-output <rule-name|output-name|output-type>")
+		return 1
+	}
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testOutputTimeout)
+	defer cancel()
+
+	opts := &alert.FactoryOptions{
+		Client: logRequests(cfg.NewHTTPClient(), "outputs"),
+	}
+	return testOutputs(ctx, os.Stdout, cfg.Rules, cfg.Outputs, opts, name)
+}
+
+func testOutputs(
+	ctx context.Context,
+	w io.Writer,
+	rules []config.RuleConfig,
+	named config.NamedOutputs,
+	opts *alert.FactoryOptions,
+	name string,
+) int {
+	outputs, rule := selectTestOutputs(rules, named, name)
+	if len(outputs) < 1 {
+		fmt.Fprintf(w, "No rule, output or output type named %q found\n", name)
+		return 1
+	}
+
+	code := 0
+	for i, output := range outputs {
+		label := output.Type
+		if output.Name() != "" {
+			label = fmt.Sprintf("%s (%s)", output.Name(), output.Type)
+		}
+		method, err := buildMethod(output, opts)
+		if err != nil {
+			fmt.Fprintf(w, "[%d] %s: FAILED: %v\n", i+1, label, err)
+			code = 1
+			continue
+		}
+		if !alert.Enabled(method) {
+			fmt.Fprintf(w, "[%d] %s: SKIPPED (disabled)\n", i+1, label)
+			continue
+		}
+		if err = method.Write(ctx, rule, sampleRecords); err != nil {
+			fmt.Fprintf(w, "[%d] %s: FAILED: %v\n", i+1, label, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(w, "[%d] %s: OK\n", i+1, label)
+	}
+	return code
+}
+
+// selectTestOutputs returns the outputs to which the sample alert is
+// sent, along with the name of the rule it is sent as: the outputs
+// of the rule with the given name, the named output with that name,
+// or else the outputs of that type which have no name, since the
+// named outputs are selected by their names.
+func selectTestOutputs(
+	rules []config.RuleConfig,
+	named config.NamedOutputs,
+	name string,
+) ([]config.OutputConfig, string) {
+	for _, r := range rules {
+		if r.Name == name {
+			return r.AllOutputs(), r.Name
+		}
+	}
+	if output, ok := named.Get(name); ok {
+		return []config.OutputConfig{output}, "Test Alert"
+	}
+	var outputs []config.OutputConfig
+	for _, r := range rules {
+		for _, output := range r.AllOutputs() {
+			if output.Name() == "" && output.Type == name {
+				outputs = append(outputs, output)
+			}
+		}
+	}
+	return outputs, "Test Alert"
+}
@@ -0,0 +1,297 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package vault reads the credentials used to authenticate to
+// Elasticsearch from HashiCorp Vault, such as those issued by the
+// database secrets engine, and renews them before they expire.
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	hclog "github.com/hashicorp/go-hclog"
+	"golang.org/x/xerrors"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+const (
+	// EnvVaultToken sets the token with which to authenticate to
+	// Vault. It may instead be read from the file named by
+	// VAULT_TOKEN_FILE
+	EnvVaultToken = "VAULT_TOKEN"
+
+	defaultRenewBefore = 5 * time.Minute
+
+	// defaultRetryInterval is how long to wait after failing to
+	// renew the credentials before trying again
+	defaultRetryInterval = 30 * time.Second
+)
+
+// ProviderConfig configures where a *Provider reads the
+// credentials from.
+type ProviderConfig struct {
+	// Address is the address of the Vault server
+	Address string
+
+	// Token is the token with which to authenticate to Vault. If
+	// empty, the VAULT_TOKEN environment variable will be used
+	Token string
+
+	// Path is the path of the secret holding the credentials
+	Path string
+
+	// UsernameField and PasswordField are the paths (in dot
+	// notation) of the username and password within the 'data'
+	// field of the secret
+	UsernameField string
+	PasswordField string
+
+	// RenewBefore is how long before the lease of the credentials
+	// expires that new credentials are read. If zero, a default of
+	// five minutes will be used
+	RenewBefore time.Duration
+
+	Client *http.Client
+	Logger hclog.Logger
+	Clock  clock.Clock
+}
+
+// Provider reads credentials from Vault, caching them until they
+// are due to be renewed.
+type Provider struct {
+	address       string
+	token         string
+	path          string
+	usernameField string
+	passwordField string
+	renewBefore   time.Duration
+	retryInterval time.Duration
+	client        *http.Client
+	logger        hclog.Logger
+	clock         clock.Clock
+
+	mu    sync.Mutex
+	creds *credentials
+}
+
+type credentials struct {
+	username string
+	password string
+
+	// expires is when the lease of the credentials expires. It is
+	// zero if they have no lease
+	expires time.Time
+
+	// renewAt is when new credentials should be read. It is zero
+	// if they have no lease
+	renewAt time.Time
+}
+
+// valid returns true if the credentials have not expired.
+func (c *credentials) valid(now time.Time) bool {
+	return c.expires.IsZero() || now.Before(c.expires)
+}
+
+// due returns true if the credentials should be renewed.
+func (c *credentials) due(now time.Time) bool {
+	return !c.renewAt.IsZero() && !now.Before(c.renewAt)
+}
+
+// NewProvider creates a new *Provider or a non-nil error
+// if there was an error.
+func NewProvider(config *ProviderConfig) (*Provider, error) {
+	if config == nil {
+		return nil, xerrors.New("no config provided")
+	}
+	if config.Address == "" {
+		return nil, xerrors.New("no Vault address provided")
+	}
+	if config.Path == "" {
+		return nil, xerrors.New("no Vault secret path provided")
+	}
+
+	if config.Token == "" {
+		token, err := utils.Getenv(EnvVaultToken)
+		if err != nil {
+			return nil, err
+		}
+		config.Token = token
+	}
+	if config.Token == "" {
+		return nil, xerrors.Errorf("no Vault token provided (set %s)", EnvVaultToken)
+	}
+
+	if config.UsernameField == "" {
+		config.UsernameField = "username"
+	}
+	if config.PasswordField == "" {
+		config.PasswordField = "password"
+	}
+	if config.RenewBefore == 0 {
+		config.RenewBefore = defaultRenewBefore
+	}
+	if config.Client == nil {
+		config.Client = cleanhttp.DefaultClient()
+	}
+	if config.Logger == nil {
+		config.Logger = hclog.Default()
+	}
+	if config.Clock == nil {
+		config.Clock = clock.Real()
+	}
+
+	return &Provider{
+		address:       strings.TrimRight(config.Address, "/"),
+		token:         config.Token,
+		path:          strings.Trim(config.Path, "/"),
+		usernameField: config.UsernameField,
+		passwordField: config.PasswordField,
+		renewBefore:   config.RenewBefore,
+		retryInterval: defaultRetryInterval,
+		client:        config.Client,
+		logger:        config.Logger,
+		clock:         config.Clock,
+	}, nil
+}
+
+// Credentials returns the username and password read from Vault.
+// They are read again once they are due to be renewed. If that
+// fails, the current credentials are returned until they expire
+// and renewing them is retried periodically.
+func (p *Provider) Credentials(ctx context.Context) (string, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	if p.creds != nil && !p.creds.due(now) {
+		return p.creds.username, p.creds.password, nil
+	}
+
+	creds, err := p.read(ctx, now)
+	if err != nil {
+		if p.creds == nil || !p.creds.valid(now) {
+			return "", "", xerrors.Errorf("error reading Elasticsearch credentials from Vault: %v", err)
+		}
+		p.logger.Error(
+			"Error renewing Elasticsearch credentials from Vault. Using the current credentials until they expire",
+			"error", err,
+			"expires", p.creds.expires.Format(time.RFC3339),
+		)
+		p.creds.renewAt = now.Add(p.retryInterval)
+		return p.creds.username, p.creds.password, nil
+	}
+
+	p.creds = creds
+	if creds.expires.IsZero() {
+		p.logger.Info("Read Elasticsearch credentials from Vault", "path", p.path)
+	} else {
+		p.logger.Info("Read Elasticsearch credentials from Vault", "path", p.path,
+			"expires", creds.expires.Format(time.RFC3339))
+	}
+	return creds.username, creds.password, nil
+}
+
+// read reads the secret from Vault.
+func (p *Provider) read(ctx context.Context, now time.Time) (*credentials, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s", p.address, p.path), nil)
+	if err != nil {
+		return nil, xerrors.Errorf("error creating new HTTP request instance: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, xerrors.Errorf("error making HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, xerrors.Errorf("received non-200 response status (status: %q). Response body:\n%s",
+			resp.Status, string(body))
+	}
+
+	var secret struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding HTTP response: %v", err)
+	}
+
+	username, ok := utils.Get(secret.Data, p.usernameField).(string)
+	if !ok || username == "" {
+		return nil, xerrors.Errorf("secret %s has no field 'data.%s'", p.path, p.usernameField)
+	}
+	password, ok := utils.Get(secret.Data, p.passwordField).(string)
+	if !ok || password == "" {
+		return nil, xerrors.Errorf("secret %s has no field 'data.%s'", p.path, p.passwordField)
+	}
+
+	creds := &credentials{username: username, password: password}
+	if secret.LeaseDuration > 0 {
+		lease := time.Duration(secret.LeaseDuration) * time.Second
+		creds.expires = now.Add(lease)
+
+		// Renew halfway through leases too short to renew
+		// p.renewBefore ahead of time
+		if p.renewBefore < lease {
+			creds.renewAt = creds.expires.Add(-p.renewBefore)
+		} else {
+			creds.renewAt = now.Add(lease / 2)
+		}
+	}
+	return creds, nil
+}
+
+// Wrap returns a copy of the client which authenticates each
+// request with the credentials read from Vault.
+func (p *Provider) Wrap(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	wrapped := *client
+	wrapped.Transport = &transport{base: base, provider: p}
+	return &wrapped
+}
+
+type transport struct {
+	base     http.RoundTripper
+	provider *Provider
+}
+
+// RoundTrip sets the Authorization header of a copy of the
+// request and sends it.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	username, password, err := t.provider.Credentials(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	r.SetBasicAuth(username, password)
+	return t.base.RoundTrip(r)
+}
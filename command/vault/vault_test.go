@@ -0,0 +1,228 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+// newTestVault mocks a Vault server issuing credentials with the
+// given lease. The password is the number of times the secret
+// has been read. Reads fail while fail is nonzero.
+func newTestVault(t *testing.T, lease int, reads, fail *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/database/creds/alerts" {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		if atomic.LoadInt32(fail) != 0 {
+			http.Error(w, `{"errors":["internal error"]}`, http.StatusInternalServerError)
+			return
+		}
+		n := atomic.AddInt32(reads, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"lease_id":"database/creds/alerts/%d","lease_duration":%d,"data":{"username":"v-alerts","password":"%d"}}`,
+			n, lease, n)
+	}))
+}
+
+func newTestProvider(t *testing.T, address string, fc *clock.Fake) *Provider {
+	p, err := NewProvider(&ProviderConfig{
+		Address: address,
+		Token:   "test-token",
+		Path:    "/database/creds/alerts",
+		Logger:  hclog.NewNullLogger(),
+		Clock:   fc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func expectPassword(t *testing.T, p *Provider, expected string) {
+	t.Helper()
+	username, password, err := p.Credentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "v-alerts" || password != expected {
+		t.Fatalf("unexpected credentials (got %s:%s, expected v-alerts:%s)", username, password, expected)
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	for _, env := range []string{EnvVaultToken, EnvVaultToken + "_FILE"} {
+		if v, ok := os.LookupEnv(env); ok {
+			os.Unsetenv(env)
+			defer os.Setenv(env, v)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		config *ProviderConfig
+		err    bool
+	}{
+		{"nil-config", nil, true},
+		{"no-address", &ProviderConfig{Token: "test-token", Path: "database/creds/alerts"}, true},
+		{"no-path", &ProviderConfig{Address: "http://127.0.0.1:8200", Token: "test-token"}, true},
+		{"no-token", &ProviderConfig{Address: "http://127.0.0.1:8200", Path: "database/creds/alerts"}, true},
+		{
+			"success",
+			&ProviderConfig{Address: "http://127.0.0.1:8200", Token: "test-token", Path: "database/creds/alerts"},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewProvider(tc.config)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCredentialsRenew(t *testing.T) {
+	var reads, fail int32
+	ts := newTestVault(t, 3600, &reads, &fail)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	p := newTestProvider(t, ts.URL, fc)
+
+	expectPassword(t, p, "1")
+	fc.Advance(54 * time.Minute)
+	expectPassword(t, p, "1")
+
+	// Renewed five minutes before the lease expires
+	fc.Advance(time.Minute)
+	expectPassword(t, p, "2")
+	if n := atomic.LoadInt32(&reads); n != 2 {
+		t.Fatalf("expected the secret to be read twice (got %d)", n)
+	}
+}
+
+func TestCredentialsShortLease(t *testing.T) {
+	var reads, fail int32
+	ts := newTestVault(t, 60, &reads, &fail)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	p := newTestProvider(t, ts.URL, fc)
+
+	expectPassword(t, p, "1")
+	fc.Advance(29 * time.Second)
+	expectPassword(t, p, "1")
+
+	// Renewed halfway through a lease shorter than renew_before
+	fc.Advance(time.Second)
+	expectPassword(t, p, "2")
+}
+
+func TestCredentialsNoLease(t *testing.T) {
+	var reads, fail int32
+	ts := newTestVault(t, 0, &reads, &fail)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	p := newTestProvider(t, ts.URL, fc)
+
+	expectPassword(t, p, "1")
+	fc.Advance(24 * time.Hour)
+	expectPassword(t, p, "1")
+}
+
+func TestCredentialsRenewFailure(t *testing.T) {
+	var reads, fail int32
+	ts := newTestVault(t, 3600, &reads, &fail)
+	defer ts.Close()
+
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	p := newTestProvider(t, ts.URL, fc)
+
+	expectPassword(t, p, "1")
+
+	// The current credentials are used until they expire
+	atomic.StoreInt32(&fail, 1)
+	fc.Advance(56 * time.Minute)
+	expectPassword(t, p, "1")
+	fc.Advance(3 * time.Minute)
+	expectPassword(t, p, "1")
+
+	fc.Advance(time.Minute)
+	if _, _, err := p.Credentials(context.Background()); err == nil {
+		t.Fatal("expected an error once the credentials expired")
+	}
+
+	// Renewal is retried once Vault recovers
+	atomic.StoreInt32(&fail, 0)
+	expectPassword(t, p, "2")
+}
+
+func TestWrap(t *testing.T) {
+	var reads, fail int32
+	vault := newTestVault(t, 3600, &reads, &fail)
+	defer vault.Close()
+
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "v-alerts" || password != "1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer es.Close()
+
+	p := newTestProvider(t, vault.URL, clock.NewFake(time.Now()))
+	client := p.Wrap(http.DefaultClient)
+
+	req, err := http.NewRequest(http.MethodGet, es.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("request was not authenticated (status: %s)", resp.Status)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Fatal("the original request should not be modified")
+	}
+}
@@ -14,12 +14,12 @@
 package config
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"errors"
 	"net/http"
+	"time"
 
 	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/tlsutil"
 	"golang.org/x/xerrors"
 )
 
@@ -54,13 +54,103 @@ type ClientConfig struct {
 	// 'elasticsearch.client.server_name' field of the main
 	// configuration file
 	ServerName string `json:"server_name"`
+
+	// UserAgent is appended to the default User-Agent header sent
+	// with every request to Elasticsearch. This value should
+	// come from the 'elasticsearch.client.user_agent' field of
+	// the main configuration file
+	UserAgent string `json:"user_agent"`
+
+	// Headers are additional headers to be sent with every
+	// request to Elasticsearch. This value should come from
+	// the 'elasticsearch.client.headers' field of the main
+	// configuration file
+	Headers map[string]string `json:"headers"`
+
+	// SourceParam is whether queries are sent as GET requests with
+	// the query in the 'source' query-string parameter rather than
+	// in the body, so that caching proxies can cache them. This
+	// value should come from the 'elasticsearch.client.source_param'
+	// field of the main configuration file
+	SourceParam bool `json:"source_param"`
+}
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// TransportConfig is used to tune the connection pool of
+// the HTTP clients shared by all rules.
+type TransportConfig struct {
+	// MaxIdleConns is the maximum number of idle connections
+	// across all hosts. This value should come from the
+	// 'http.max_idle_conns' field of the main configuration file
+	MaxIdleConns int `json:"max_idle_conns"`
+
+	// MaxIdleConnsPerHost is the maximum number of idle
+	// connections to keep per host. This value should come
+	// from the 'http.max_idle_conns_per_host' field of the
+	// main configuration file
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+
+	// IdleConnTimeoutRaw is how long an idle connection will
+	// remain idle before closing itself. This value should come
+	// from the 'http.idle_conn_timeout' field of the main
+	// configuration file
+	IdleConnTimeoutRaw string `json:"idle_conn_timeout"`
+
+	// IdleConnTimeout is the parsed value of IdleConnTimeoutRaw
+	IdleConnTimeout time.Duration `json:"-"`
+}
+
+func (t *TransportConfig) validate() error {
+	if t.MaxIdleConns < 0 {
+		return errors.New("field 'http.max_idle_conns' must not be negative")
+	}
+	if t.MaxIdleConnsPerHost < 0 {
+		return errors.New("field 'http.max_idle_conns_per_host' must not be negative")
+	}
+	d, err := parseDuration("http.idle_conn_timeout", t.IdleConnTimeoutRaw)
+	if err != nil {
+		return err
+	}
+	t.IdleConnTimeout = d
+	return nil
+}
+
+// NewHTTPClient creates a new HTTP client with a pooled
+// transport tuned per the 'http' field of the main
+// configuration file. This client should be shared by
+// all output methods that make HTTP requests.
+func (c *Config) NewHTTPClient() *http.Client {
+	client := cleanhttp.DefaultPooledClient()
+	transport := client.Transport.(*http.Transport)
+
+	transport.MaxIdleConns = defaultMaxIdleConns
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+
+	if c.HTTP != nil {
+		if c.HTTP.MaxIdleConns > 0 {
+			transport.MaxIdleConns = c.HTTP.MaxIdleConns
+		}
+		if c.HTTP.MaxIdleConnsPerHost > 0 {
+			transport.MaxIdleConnsPerHost = c.HTTP.MaxIdleConnsPerHost
+		}
+		if c.HTTP.IdleConnTimeout > 0 {
+			transport.IdleConnTimeout = c.HTTP.IdleConnTimeout
+		}
+	}
+	return client
 }
 
 // NewESClient creates a new HTTP client based on the
 // values of ClientConfig's fields. This client should
 // be used to communicate with Elasticsearch.
 func (c *Config) NewESClient() (*http.Client, error) {
-	client := cleanhttp.DefaultClient()
+	client := c.NewHTTPClient()
 	if c.Elasticsearch.Client == nil || !c.Elasticsearch.Client.TLSEnabled {
 		return client, nil
 	}
@@ -75,26 +165,10 @@ func (c *Config) NewESClient() (*http.Client, error) {
 		return nil, xerrors.New("no path to client key")
 	}
 
-	// Load client certificate
-	cert, err := tls.LoadX509KeyPair(c.Elasticsearch.Client.ClientCert, c.Elasticsearch.Client.ClientKey)
-	if err != nil {
-		return nil, xerrors.Errorf("error loading X509 key pair: %w", err)
-	}
-
-	// Load CA certificate
-	caCert, err := ioutil.ReadFile(c.Elasticsearch.Client.CACert)
-	if err != nil {
-		return nil, xerrors.Errorf("error reading CA certificate file: %w", err)
-	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-
-	tlsConfig := &tls.Config{ // nolint: gosec
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-		ServerName:   c.Elasticsearch.Client.ServerName,
-	}
-	tlsConfig.BuildNameToCertificate()
-	client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
-	return client, nil
+	return tlsutil.NewClient(client, &tlsutil.Config{
+		CACert:     c.Elasticsearch.Client.CACert,
+		ClientCert: c.Elasticsearch.Client.ClientCert,
+		ClientKey:  c.Elasticsearch.Client.ClientKey,
+		ServerName: c.Elasticsearch.Client.ServerName,
+	})
 }
@@ -13,7 +13,103 @@
 
 package config
 
-import "testing"
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	cases := []struct {
+		name            string
+		config          *Config
+		maxIdle         int
+		maxIdlePerHost  int
+		idleConnTimeout time.Duration
+	}{
+		{
+			"defaults",
+			&Config{},
+			defaultMaxIdleConns,
+			defaultMaxIdleConnsPerHost,
+			defaultIdleConnTimeout,
+		},
+		{
+			"tuned",
+			&Config{
+				HTTP: &TransportConfig{
+					MaxIdleConns:        200,
+					MaxIdleConnsPerHost: 50,
+					IdleConnTimeout:     30 * time.Second,
+				},
+			},
+			200,
+			50,
+			30 * time.Second,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			transport := tc.config.NewHTTPClient().Transport.(*http.Transport)
+			if transport.DisableKeepAlives {
+				t.Fatal("keep-alives should be enabled")
+			}
+			if transport.MaxIdleConns != tc.maxIdle {
+				t.Errorf("unexpected MaxIdleConns (got %d, expected %d)", transport.MaxIdleConns, tc.maxIdle)
+			}
+			if transport.MaxIdleConnsPerHost != tc.maxIdlePerHost {
+				t.Errorf("unexpected MaxIdleConnsPerHost (got %d, expected %d)",
+					transport.MaxIdleConnsPerHost, tc.maxIdlePerHost)
+			}
+			if transport.IdleConnTimeout != tc.idleConnTimeout {
+				t.Errorf("unexpected IdleConnTimeout (got %s, expected %s)",
+					transport.IdleConnTimeout, tc.idleConnTimeout)
+			}
+		})
+	}
+}
+
+func TestTransportConfig_validate(t *testing.T) {
+	cases := []struct {
+		name   string
+		config TransportConfig
+		err    string
+	}{
+		{
+			"valid",
+			TransportConfig{IdleConnTimeoutRaw: "30s"},
+			"",
+		},
+		{
+			"negative-max-idle-conns",
+			TransportConfig{MaxIdleConns: -1},
+			"field 'http.max_idle_conns' must not be negative",
+		},
+		{
+			"negative-idle-conn-timeout",
+			TransportConfig{IdleConnTimeoutRaw: "-30s"},
+			"'http.idle_conn_timeout' field must not be negative",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate()
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("unexpected error (got %v, expected %q)", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
 
 func TestNewESClient(t *testing.T) {
 	cases := []struct {
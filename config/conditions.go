@@ -28,6 +28,7 @@ import (
 const (
 	keyField      = "field"
 	keyQuantifier = "quantifier"
+	keyDelta      = "delta"
 
 	quantifierAny  = "any"
 	quantifierAll  = "all"
@@ -45,6 +46,29 @@ const (
 // when alerts are triggered.
 type Condition map[string]interface{}
 
+// JSONSchema returns the JSON Schema of a condition.
+func (c Condition) JSONSchema() map[string]interface{} {
+	number := map[string]interface{}{"type": "number"}
+	stringOrNumber := map[string]interface{}{"type": []string{"string", "number", "boolean"}}
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{keyField},
+		"properties": map[string]interface{}{
+			keyField: map[string]interface{}{"type": "string"},
+			keyQuantifier: map[string]interface{}{
+				"enum": []string{quantifierAny, quantifierAll, quantifierNone},
+			},
+			keyDelta:                     map[string]interface{}{"type": "boolean"},
+			operatorEqual:                stringOrNumber,
+			operatorNotEqual:             stringOrNumber,
+			operatorLessThan:             number,
+			operatorLessThanOrEqualTo:    number,
+			operatorGreaterThan:          number,
+			operatorGreaterThanOrEqualTo: number,
+		},
+	}
+}
+
 func (c Condition) field() string {
 	return c[keyField].(string)
 }
@@ -53,6 +77,13 @@ func (c Condition) quantifier() string {
 	return c[keyQuantifier].(string)
 }
 
+// delta returns true if the operators of the condition apply to
+// the change in the value of the field since the previous run.
+func (c Condition) delta() bool {
+	v, _ := c[keyDelta].(bool)
+	return v
+}
+
 func (c Condition) validate() error {
 	var allErrors *multierror.Error
 
@@ -72,9 +103,39 @@ func (c Condition) validate() error {
 		allErrors = multierror.Append(allErrors, errs...)
 	}
 
+	if err := c.validateDelta(); err != nil {
+		allErrors = multierror.Append(allErrors, err)
+	}
+
 	return allErrors.ErrorOrNil()
 }
 
+func (c Condition) validateDelta() error {
+	raw, ok := c[keyDelta]
+	if !ok {
+		return nil
+	}
+
+	v, ok := raw.(bool)
+	if !ok {
+		return errors.New("field 'delta' of condition must be a boolean")
+	}
+
+	if !v {
+		return nil
+	}
+
+	for _, operator := range []string{operatorEqual, operatorNotEqual} {
+		if raw, ok := c[operator]; ok {
+			if _, ok := raw.(json.Number); !ok {
+				return xerrors.Errorf("value of operator '%s' should be a number when 'delta' is true", operator)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c Condition) validateField() error {
 	raw, ok := c[keyField]
 	if !ok {
@@ -158,8 +219,31 @@ func (c Condition) validateMultiOperators() []error {
 }
 
 // ConditionsMet returns true if the response JSON meets the given conditions.
+// Conditions on the delta of a field are never met since there is no
+// previous value; use ConditionsMetSince for those.
 func ConditionsMet(logger hclog.Logger, resp map[string]interface{}, conditions []Condition) bool {
+	return ConditionsMetSince(logger, resp, conditions, nil)
+}
+
+// ConditionsMetSince returns true if the response JSON meets the given
+// conditions. The operators of conditions on the delta of a field are
+// compared with the difference between the value of the field and its
+// previous value (per DeltaValues). A delta condition is not met if
+// either value is missing, such as on the first run of a rule.
+func ConditionsMetSince(
+	logger hclog.Logger,
+	resp map[string]interface{},
+	conditions []Condition,
+	previous map[string]json.Number,
+) bool {
 	for _, condition := range conditions {
+		if condition.delta() {
+			if !deltaSatisfied(resp, condition, previous) {
+				return false
+			}
+			continue
+		}
+
 		matches := utils.GetAll(resp, condition.field())
 
 		res := false
@@ -181,6 +265,45 @@ func ConditionsMet(logger hclog.Logger, resp map[string]interface{}, conditions
 	return true
 }
 
+// DeltaValues returns the values of the fields of the response JSON
+// on which the delta conditions depend, keyed by the paths of the
+// fields. Fields which are missing or not numbers are omitted.
+func DeltaValues(resp map[string]interface{}, conditions []Condition) map[string]json.Number {
+	values := make(map[string]json.Number)
+	for _, condition := range conditions {
+		if !condition.delta() {
+			continue
+		}
+		if v, ok := utils.Get(resp, condition.field()).(json.Number); ok {
+			if _, err := decimal.NewFromString(v.String()); err == nil {
+				values[condition.field()] = v
+			}
+		}
+	}
+	return values
+}
+
+func deltaSatisfied(resp map[string]interface{}, condition Condition, previous map[string]json.Number) bool {
+	current, ok := utils.Get(resp, condition.field()).(json.Number)
+	if !ok {
+		return false
+	}
+	prev, ok := previous[condition.field()]
+	if !ok {
+		return false
+	}
+
+	cur, err := decimal.NewFromString(current.String())
+	if err != nil {
+		return false
+	}
+	p, err := decimal.NewFromString(prev.String())
+	if err != nil {
+		return false
+	}
+	return numberSatisfied(json.Number(cur.Sub(p).String()), condition)
+}
+
 func allSatisfied(logger hclog.Logger, matches []interface{}, condition Condition) bool {
 	for _, match := range matches {
 		sat := satisfied(logger, match, condition)
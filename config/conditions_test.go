@@ -123,6 +123,33 @@ func TestCondition_validate(t *testing.T) {
 
 `,
 		},
+		{
+			name: "success-delta",
+			condition: Condition{
+				"field": "aggregations.errors.doc_count",
+				"delta": true,
+				"gt":    json.Number("500"),
+				"ne":    json.Number("0"),
+			},
+			expectErr: "",
+		},
+		{
+			name: "delta-not-bool",
+			condition: Condition{
+				"field": "aggregations.errors.doc_count",
+				"delta": "yes",
+			},
+			expectErr: "1 error occurred:\n\t* field 'delta' of condition must be a boolean\n\n",
+		},
+		{
+			name: "delta-string-operator",
+			condition: Condition{
+				"field": "aggregations.errors.doc_count",
+				"delta": true,
+				"eq":    "foo",
+			},
+			expectErr: "1 error occurred:\n\t* value of operator 'eq' should be a number when 'delta' is true\n\n",
+		},
 	}
 
 	for _, tc := range cases {
@@ -377,3 +404,93 @@ func TestConditionsMet(t *testing.T) {
 		})
 	}
 }
+
+func TestConditionsMetSince(t *testing.T) {
+	resp := map[string]interface{}{
+		"aggregations": map[string]interface{}{
+			"errors": map[string]interface{}{
+				"doc_count": json.Number("1200"),
+			},
+		},
+	}
+	increased := Condition{
+		"field": "aggregations.errors.doc_count",
+		"delta": true,
+		"gt":    json.Number("500"),
+	}
+	decreased := Condition{
+		"field": "aggregations.errors.doc_count",
+		"delta": true,
+		"lt":    json.Number("-100"),
+	}
+
+	cases := []struct {
+		name      string
+		condition Condition
+		previous  map[string]json.Number
+		expectRes bool
+	}{
+		{
+			"increased-above-threshold",
+			increased,
+			map[string]json.Number{"aggregations.errors.doc_count": "600"},
+			true,
+		},
+		{
+			"increased-below-threshold",
+			increased,
+			map[string]json.Number{"aggregations.errors.doc_count": "1000"},
+			false,
+		},
+		{
+			"decreased",
+			increased,
+			map[string]json.Number{"aggregations.errors.doc_count": "2000"},
+			false,
+		},
+		{
+			"decreased-below-threshold",
+			decreased,
+			map[string]json.Number{"aggregations.errors.doc_count": "2000"},
+			true,
+		},
+		{
+			"first-run",
+			increased,
+			nil,
+			false,
+		},
+		{
+			"missing-field",
+			Condition{
+				"field": "aggregations.warnings.doc_count",
+				"delta": true,
+				"gt":    json.Number("-1"),
+			},
+			map[string]json.Number{"aggregations.warnings.doc_count": "0"},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.condition.validate(); err != nil {
+				t.Fatal(err)
+			}
+			got := ConditionsMetSince(hclog.NewNullLogger(), resp, []Condition{tc.condition}, tc.previous)
+			if got != tc.expectRes {
+				t.Errorf("Expected conditions to be met? %t\nWere conditions met? %t", tc.expectRes, got)
+			}
+		})
+	}
+
+	if ConditionsMet(hclog.NewNullLogger(), resp, []Condition{increased}) {
+		t.Error("delta conditions should never be met without previous values")
+	}
+
+	values := DeltaValues(resp, []Condition{increased, {"field": "aggregations.errors.doc_count"}})
+	if len(values) != 1 || values["aggregations.errors.doc_count"] != "1200" {
+		t.Errorf("unexpected delta values: %v", values)
+	}
+}
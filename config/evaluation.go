@@ -0,0 +1,139 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// EvaluationConfig is one of several independent sets of conditions
+// evaluated against the response to the query of a rule, so that an
+// expensive query which backs several alerts is executed only once.
+// Each evaluation which is met sends its own alert to its own
+// outputs, with its own alert cooldown and dedup keys.
+type EvaluationConfig struct {
+	// Name identifies the evaluation among those of the rule. Its
+	// alerts are sent as those of the rule '<rule>/<name>'. This
+	// value should come from the 'evaluations.name' field of the
+	// rule configuration file
+	Name string `json:"name"`
+
+	// Conditions, Values and ExpressionRaw are like the fields of
+	// the same names of the rule. Values are merged with those of
+	// the rule, taking precedence over them
+	Conditions    []Condition       `json:"conditions"`
+	Values        map[string]string `json:"values"`
+	ExpressionRaw string            `json:"expression"`
+
+	// Expression is the parsed value of ExpressionRaw
+	Expression *Expression `json:"-"`
+
+	// Outputs and OutputNames are the outputs to which the alerts of
+	// the evaluation are sent, like the fields of the same names of
+	// the rule
+	Outputs     []OutputConfig `json:"outputs"`
+	OutputNames []string       `json:"output_names"`
+
+	// DedupKeyField is like the field of the same name of the rule.
+	// It must be one of the filters of the rule
+	DedupKeyField string `json:"dedup_key_field"`
+}
+
+// AllOutputs returns the outputs of the rule followed by those of
+// each of its evaluations.
+func (rule RuleConfig) AllOutputs() []OutputConfig {
+	if len(rule.Evaluations) == 0 {
+		return rule.Outputs
+	}
+	outputs := append([]OutputConfig(nil), rule.Outputs...)
+	for _, e := range rule.Evaluations {
+		outputs = append(outputs, e.Outputs...)
+	}
+	return outputs
+}
+
+// validateEvaluations validates the evaluations of the rule. The
+// fields of the rule which each evaluation sets for itself must not
+// be set on the rule as well.
+func (rule *RuleConfig) validateEvaluations() error {
+	exclusive := []struct {
+		field string
+		set   bool
+	}{
+		{"outputs", len(rule.Outputs) > 0},
+		{"output_names", len(rule.OutputNames) > 0},
+		{"conditions", len(rule.Conditions) > 0},
+		{"expression", rule.ExpressionRaw != ""},
+		{"dedup_key_field", rule.DedupKeyField != ""},
+		{"sub_queries", len(rule.SubQueries) > 0},
+	}
+	for _, f := range exclusive {
+		if f.set {
+			return xerrors.Errorf("'evaluations' field of rule %s must not be set along with '%s'", rule.Name, f.field)
+		}
+	}
+
+	seen := make(map[string]bool, len(rule.Evaluations))
+	for i := range rule.Evaluations {
+		e := &rule.Evaluations[i]
+		if e.Name == "" {
+			return xerrors.Errorf("error in evaluation %d of rule %s: no 'name' field found", i+1, rule.Name)
+		}
+		if seen[e.Name] {
+			return xerrors.Errorf("rule %s has more than one evaluation named %q", rule.Name, e.Name)
+		}
+		seen[e.Name] = true
+		if err := rule.validateEvaluation(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rule *RuleConfig) validateEvaluation(e *EvaluationConfig) error {
+	owner := "evaluation " + e.Name + " of rule " + rule.Name
+	if len(e.Outputs) < 1 {
+		return xerrors.Errorf("error in %s: at least one output must be specified ('outputs' or 'output_names')", owner)
+	}
+	if err := validateOutputs(e.Outputs, owner); err != nil {
+		return err
+	}
+
+	for i, condition := range e.Conditions {
+		if err := condition.validate(); err != nil {
+			return xerrors.Errorf("error in condition %d of %s: %v", i+1, owner, err)
+		}
+	}
+
+	if len(rule.Values) > 0 {
+		values := make(map[string]string, len(rule.Values)+len(e.Values))
+		for name, path := range rule.Values {
+			values[name] = path
+		}
+		for name, path := range e.Values {
+			values[name] = path
+		}
+		e.Values = values
+	}
+	if err := rule.validateCountPaths(e.Conditions, e.Values, owner); err != nil {
+		return err
+	}
+	expr, err := parseRuleExpression(e.ExpressionRaw, e.Values, owner)
+	if err != nil {
+		return err
+	}
+	e.Expression = expr
+
+	return rule.validateDedupKeyField(e.DedupKeyField, owner)
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRulesEvaluations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evaluations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv(envRulesDir, dir)
+	defer os.Unsetenv(envRulesDir)
+
+	outputs := NamedOutputs{
+		"slack-oncall": {
+			Type:   "slack",
+			Config: map[string]interface{}{"webhook": "https://hooks.slack.com/services/oncall"},
+		},
+	}
+
+	const head = `"name": "test-rule",
+  "index": "test-*",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "filters": ["aggregations.hosts.buckets"],
+  "alert_cooldown": "10m",
+  "values": {"errors": "aggregations.errors.doc_count"},`
+
+	cases := []struct {
+		name     string
+		rule     string
+		expected []string
+		err      bool
+	}{
+		{
+			"success",
+			`{` + head + `
+  "evaluations": [
+    {
+      "name": "errors",
+      "expression": "errors > 10",
+      "output_names": ["slack-oncall"],
+      "dedup_key_field": "aggregations.hosts.buckets"
+    },
+    {
+      "name": "latency",
+      "values": {"latency": "aggregations.latency.value"},
+      "expression": "latency > 500 and errors > 0",
+      "outputs": [{"type": "file", "config": {"file": "test.log"}}]
+    }
+  ]
+}`,
+			[]string{"errors: [slack]", "latency: [file]"},
+			false,
+		},
+		{
+			"rule-outputs",
+			`{` + head + `
+  "outputs": [{"type": "file", "config": {"file": "test.log"}}],
+  "evaluations": [{"name": "errors", "expression": "errors > 10", "output_names": ["slack-oncall"]}]
+}`,
+			nil,
+			true,
+		},
+		{
+			"no-name",
+			`{` + head + `
+  "evaluations": [{"expression": "errors > 10", "output_names": ["slack-oncall"]}]
+}`,
+			nil,
+			true,
+		},
+		{
+			"duplicate-name",
+			`{` + head + `
+  "evaluations": [
+    {"name": "errors", "expression": "errors > 10", "output_names": ["slack-oncall"]},
+    {"name": "errors", "expression": "errors > 20", "output_names": ["slack-oncall"]}
+  ]
+}`,
+			nil,
+			true,
+		},
+		{
+			"no-outputs",
+			`{` + head + `
+  "evaluations": [{"name": "errors", "expression": "errors > 10"}]
+}`,
+			nil,
+			true,
+		},
+		{
+			"undefined-value",
+			`{` + head + `
+  "evaluations": [{"name": "errors", "expression": "latency > 10", "output_names": ["slack-oncall"]}]
+}`,
+			nil,
+			true,
+		},
+		{
+			"undefined-output",
+			`{` + head + `
+  "evaluations": [{"name": "errors", "expression": "errors > 10", "output_names": ["pagerduty"]}]
+}`,
+			nil,
+			true,
+		},
+		{
+			"dedup-key-not-filter",
+			`{` + head + `
+  "evaluations": [
+    {"name": "errors", "expression": "errors > 10", "output_names": ["slack-oncall"], "dedup_key_field": "hits.hits"}
+  ]
+}`,
+			nil,
+			true,
+		},
+		{
+			"count-only-hits-condition",
+			`{"name": "test-rule",
+  "index": "test-*",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "count_only": true,
+  "evaluations": [
+    {"name": "errors", "conditions": [{"field": "hits.total.value", "gt": 10}], "output_names": ["slack-oncall"]}
+  ]
+}`,
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fname := filepath.Join(dir, "rule.json")
+			if err := ioutil.WriteFile(fname, []byte(tc.rule), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(fname)
+
+			rules, err := ParseRules(nil, outputs)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != 1 {
+				t.Fatalf("expected 1 rule, got %d", len(rules))
+			}
+			var got []string
+			for _, e := range rules[0].Evaluations {
+				if e.Expression == nil {
+					t.Fatalf("expression of evaluation %s was not parsed", e.Name)
+				}
+				var types []string
+				for _, output := range e.Outputs {
+					types = append(types, output.Type)
+				}
+				got = append(got, fmt.Sprintf("%s: %v", e.Name, types))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Fatalf("unexpected evaluations (got %v, expected %v)", got, tc.expected)
+			}
+			if len(rules[0].AllOutputs()) != 2 {
+				t.Fatalf("expected 2 outputs in all, got %d", len(rules[0].AllOutputs()))
+			}
+		})
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/xerrors"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+)
+
+// Expression is a boolean expression over named values extracted
+// from the response to a query, such as
+//
+//	errors > 100 AND (total > 0 OR NOT degraded == true)
+//
+// Comparisons use the operators ==, !=, <, <=, > and >=, and may be
+// combined with AND, OR and NOT (or &&, || and !). NOT binds tighter
+// than AND, which binds tighter than OR. AND and OR short-circuit.
+// A comparison involving a value that is missing from the response
+// or of the wrong type is false.
+type Expression struct {
+	src  string
+	root node
+}
+
+// ParseExpression parses the given expression.
+func ParseExpression(src string) (*Expression, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, xerrors.Errorf("unexpected %q at position %d", t.text, t.pos+1)
+	}
+	return &Expression{src: src, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.src
+}
+
+// Identifiers returns the names of the values referenced by the
+// expression in the order they first appear.
+func (e *Expression) Identifiers() []string {
+	var names []string
+	seen := make(map[string]bool)
+	e.root.walk(func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	})
+	return names
+}
+
+// Eval evaluates the expression. The lookup function returns the
+// value of the given identifier and whether it has one.
+func (e *Expression) Eval(lookup func(name string) (interface{}, bool)) bool {
+	return e.root.eval(lookup)
+}
+
+// ExpressionMet returns true if the response JSON satisfies the
+// expression. The values map the identifiers of the expression
+// to the paths of the fields of the response from which they are
+// extracted.
+func ExpressionMet(resp map[string]interface{}, values map[string]string, expr *Expression) bool {
+	return expr.Eval(func(name string) (interface{}, bool) {
+		path, ok := values[name]
+		if !ok {
+			return nil, false
+		}
+		v := utils.Get(resp, path)
+		return v, v != nil
+	})
+}
+
+type node interface {
+	eval(lookup func(string) (interface{}, bool)) bool
+	walk(fn func(name string))
+}
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(lookup func(string) (interface{}, bool)) bool {
+	return n.left.eval(lookup) && n.right.eval(lookup)
+}
+
+func (n *andNode) walk(fn func(string)) {
+	n.left.walk(fn)
+	n.right.walk(fn)
+}
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(lookup func(string) (interface{}, bool)) bool {
+	return n.left.eval(lookup) || n.right.eval(lookup)
+}
+
+func (n *orNode) walk(fn func(string)) {
+	n.left.walk(fn)
+	n.right.walk(fn)
+}
+
+type notNode struct{ operand node }
+
+func (n *notNode) eval(lookup func(string) (interface{}, bool)) bool {
+	return !n.operand.eval(lookup)
+}
+
+func (n *notNode) walk(fn func(string)) {
+	n.operand.walk(fn)
+}
+
+// operand is either a literal or a reference to a named value.
+type operand struct {
+	ident   string
+	literal interface{}
+}
+
+func (o operand) value(lookup func(string) (interface{}, bool)) (interface{}, bool) {
+	if o.ident == "" {
+		return o.literal, true
+	}
+	return lookup(o.ident)
+}
+
+type compareNode struct {
+	op          string
+	left, right operand
+}
+
+func (n *compareNode) eval(lookup func(string) (interface{}, bool)) bool {
+	left, ok := n.left.value(lookup)
+	if !ok {
+		return false
+	}
+	right, ok := n.right.value(lookup)
+	if !ok {
+		return false
+	}
+
+	switch l := left.(type) {
+	case json.Number:
+		r, ok := right.(json.Number)
+		if !ok {
+			return false
+		}
+		ld, err := decimal.NewFromString(l.String())
+		if err != nil {
+			return false
+		}
+		rd, err := decimal.NewFromString(r.String())
+		if err != nil {
+			return false
+		}
+		return compare(n.op, ld.Cmp(rd))
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		return compare(n.op, strings.Compare(l, r))
+	case bool:
+		r, ok := right.(bool)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "==":
+			return l == r
+		case "!=":
+			return l != r
+		}
+	}
+	return false
+}
+
+func (n *compareNode) walk(fn func(string)) {
+	if n.left.ident != "" {
+		fn(n.left.ident)
+	}
+	if n.right.ident != "" {
+		fn(n.right.ident)
+	}
+}
+
+func compare(op string, cmp int) bool {
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(src string) ([]token, error) { // nolint: gocyclo
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case strings.HasPrefix(src[i:], "&&"):
+			tokens = append(tokens, token{tokenAnd, "&&", i})
+			i += 2
+		case strings.HasPrefix(src[i:], "||"):
+			tokens = append(tokens, token{tokenOr, "||", i})
+			i += 2
+		case strings.ContainsRune("=!<>", c):
+			op := string(c)
+			if i+1 < len(src) && src[i+1] == '=' {
+				op += "="
+			}
+			switch op {
+			case "!":
+				tokens = append(tokens, token{tokenNot, op, i})
+			case "=":
+				return nil, xerrors.Errorf("unexpected '=' at position %d (use '==')", i+1)
+			default:
+				tokens = append(tokens, token{tokenOperator, op, i})
+			}
+			i += len(op)
+		case c == '"' || c == '\'':
+			end := strings.IndexRune(src[i+1:], c)
+			if end == -1 {
+				return nil, xerrors.Errorf("unterminated string starting at position %d", i+1)
+			}
+			tokens = append(tokens, token{tokenString, src[i+1 : i+1+end], i})
+			i += end + 2
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			start := i
+			i++
+			for i < len(src) && (src[i] == '.' || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, src[start:i], start})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			word := src[start:i]
+			switch strings.ToUpper(word) {
+			case "AND":
+				tokens = append(tokens, token{tokenAnd, word, start})
+			case "OR":
+				tokens = append(tokens, token{tokenOr, word, start})
+			case "NOT":
+				tokens = append(tokens, token{tokenNot, word, start})
+			default:
+				tokens = append(tokens, token{tokenIdent, word, start})
+			}
+		default:
+			return nil, xerrors.Errorf("unexpected character %q at position %d", c, i+1)
+		}
+	}
+	return append(tokens, token{tokenEOF, "end of expression", len(src)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.peek().kind == tokenLParen {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenRParen {
+			return nil, xerrors.Errorf("expected ')' at position %d but found %q", t.pos+1, t.text)
+		}
+		return n, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op.kind != tokenOperator {
+		return nil, xerrors.Errorf("expected a comparison operator at position %d but found %q", op.pos+1, op.text)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &compareNode{op: op.text, left: left, right: right}, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return operand{literal: true}, nil
+		case "false":
+			return operand{literal: false}, nil
+		}
+		return operand{ident: t.text}, nil
+	case tokenNumber:
+		if _, err := decimal.NewFromString(t.text); err != nil {
+			return operand{}, xerrors.Errorf("invalid number %q at position %d", t.text, t.pos+1)
+		}
+		return operand{literal: json.Number(t.text)}, nil
+	case tokenString:
+		return operand{literal: t.text}, nil
+	default:
+		return operand{}, xerrors.Errorf("expected a value at position %d but found %q", t.pos+1, t.text)
+	}
+}
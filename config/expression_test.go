@@ -0,0 +1,193 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseExpressionErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"errors >",
+		"errors = 100",
+		"errors > 100 AND",
+		"(errors > 100",
+		"errors > 100)",
+		"errors 100",
+		"errors > 'unterminated",
+		"errors > 1.2.3",
+		"errors > 100 # comment",
+	}
+
+	for _, src := range cases {
+		src := src
+		t.Run(src, func(t *testing.T) {
+			if _, err := ParseExpression(src); err == nil {
+				t.Fatalf("expected an error parsing %q but didn't receive one", src)
+			}
+		})
+	}
+}
+
+func TestExpressionEval(t *testing.T) {
+	values := map[string]interface{}{
+		"errors":   json.Number("150"),
+		"total":    json.Number("0"),
+		"ratio":    json.Number("0.07"),
+		"latency":  json.Number("250.5"),
+		"status":   "red",
+		"degraded": true,
+	}
+
+	cases := []struct {
+		src      string
+		expected bool
+	}{
+		{"errors > 100", true},
+		{"errors > 100 AND total > 0", false},
+		{"latency > 500 OR ratio > 0.05", true},
+		{"errors >= 150 && ratio <= 0.07", true},
+		{"status == 'red'", true},
+		{`status != "red"`, false},
+		{"degraded == true", true},
+		{"NOT degraded == true", false},
+		{"!(errors > 100)", false},
+		{"100 < errors", true},
+
+		// AND binds tighter than OR
+		{"errors > 100 OR total > 0 AND latency > 500", true},
+		{"(errors > 100 OR total > 0) AND latency > 500", false},
+		// NOT binds tighter than AND
+		{"NOT total > 0 AND errors > 100", true},
+		{"NOT (total > 0 OR errors > 100)", false},
+		{"not total > 0 and errors > 100 or latency > 500", true},
+
+		// Comparisons with missing values are false
+		{"missing > 0", false},
+		{"missing < 0", false},
+		{"NOT missing > 0", true},
+		{"missing > 0 OR errors > 100", true},
+
+		// Comparisons between different types are false
+		{"status > 1", false},
+		{"errors == 'red'", false},
+		{"degraded > false", false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.src, func(t *testing.T) {
+			expr, err := ParseExpression(tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := expr.Eval(func(name string) (interface{}, bool) {
+				v, ok := values[name]
+				return v, ok
+			})
+			if got != tc.expected {
+				t.Fatalf("%q evaluated to %t, expected %t", tc.src, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestExpressionShortCircuit(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected bool
+		lookups  []string
+	}{
+		{"total > 0 AND missing > 5", false, []string{"total"}},
+		{"errors > 100 OR missing > 5", true, []string{"errors"}},
+		{"missing > 5 AND errors > 100", false, []string{"missing"}},
+		{"missing > 5 OR errors > 100", true, []string{"missing", "errors"}},
+		{"(total > 0 AND missing > 5) OR errors > 100", true, []string{"total", "errors"}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.src, func(t *testing.T) {
+			expr, err := ParseExpression(tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var lookups []string
+			got := expr.Eval(func(name string) (interface{}, bool) {
+				lookups = append(lookups, name)
+				switch name {
+				case "errors":
+					return json.Number("150"), true
+				case "total":
+					return json.Number("0"), true
+				default:
+					return nil, false
+				}
+			})
+			if got != tc.expected {
+				t.Fatalf("%q evaluated to %t, expected %t", tc.src, got, tc.expected)
+			}
+			if !reflect.DeepEqual(lookups, tc.lookups) {
+				t.Fatalf("unexpected lookups (got %v, expected %v)", lookups, tc.lookups)
+			}
+		})
+	}
+}
+
+func TestExpressionMet(t *testing.T) {
+	resp := map[string]interface{}{
+		"hits": map[string]interface{}{
+			"total": map[string]interface{}{"value": json.Number("12")},
+		},
+		"aggregations": map[string]interface{}{
+			"errors": map[string]interface{}{"doc_count": json.Number("150")},
+		},
+	}
+	values := map[string]string{
+		"total":  "hits.total.value",
+		"errors": "aggregations.errors.doc_count",
+		"p99":    "aggregations.latency.values.99",
+	}
+
+	cases := []struct {
+		src      string
+		expected bool
+	}{
+		{"errors > 100 AND total > 0", true},
+		{"p99 > 500 OR errors > 1000", false},
+		{"p99 > 500 OR total > 10", true},
+	}
+
+	for _, tc := range cases {
+		expr, err := ParseExpression(tc.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ExpressionMet(resp, values, expr); got != tc.expected {
+			t.Errorf("%q evaluated to %t, expected %t", tc.src, got, tc.expected)
+		}
+	}
+
+	expr, err := ParseExpression("errors > 100 OR (total > 0 AND errors < p99)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := expr.Identifiers(), []string{"errors", "total", "p99"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected identifiers (got %v, expected %v)", got, expected)
+	}
+}
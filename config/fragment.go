@@ -0,0 +1,154 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// fragmentRef is the key of a JSON object in a rule configuration
+// file which references a fragment
+const fragmentRef = "$ref"
+
+// Fragments are the named, reusable pieces of rule configuration,
+// such as query snippets and templates, defined in the 'fragments'
+// field of the main configuration file. A rule references one with
+// a JSON object of the form {"$ref": "<name>"}, which is replaced
+// by the fragment. The other fields of the object, if any, override
+// those of the fragment, which must then be a JSON object itself.
+// Fragments may reference other fragments.
+type Fragments map[string]interface{}
+
+// validate resolves every fragment so that unknown and circular
+// references are reported when the configuration is loaded rather
+// than when a rule happens to use them.
+func (f Fragments) validate() error {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := f.resolve(f[name], []string{name}); err != nil {
+			return xerrors.Errorf("error in fragment %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// resolve returns a copy of v in which every reference to a fragment
+// is replaced by the fragment merged with the overrides given
+// alongside the reference. The stack holds the names of the
+// fragments being resolved and is used to detect cycles.
+func (f Fragments) resolve(v interface{}, stack []string) (interface{}, error) {
+	switch t := v.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			r, err := f.resolve(e, stack)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			if k == fragmentRef {
+				continue
+			}
+			r, err := f.resolve(e, stack)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		ref, ok := t[fragmentRef]
+		if !ok {
+			return out, nil
+		}
+		name, ok := ref.(string)
+		if !ok {
+			return nil, xerrors.Errorf("field '%s' must be a string", fragmentRef)
+		}
+		frag, ok := f[name]
+		if !ok {
+			return nil, xerrors.Errorf("reference to unknown fragment %q", name)
+		}
+		for i, s := range stack {
+			if s == name {
+				cycle := append(append([]string{}, stack[i:]...), name)
+				return nil, xerrors.Errorf("circular fragment reference: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		base, err := f.resolve(frag, append(stack[:len(stack):len(stack)], name))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) == 0 {
+			return base, nil
+		}
+		baseObj, ok := base.(map[string]interface{})
+		if !ok {
+			return nil, xerrors.Errorf("fragment %q is not a JSON object so its fields cannot be overridden", name)
+		}
+		return mergeFragment(baseObj, out), nil
+	default:
+		return v, nil
+	}
+}
+
+// mergeFragment returns the fields of base overridden by those of
+// overrides. Nested objects are merged recursively while any other
+// value, including an array, replaces that of base.
+func mergeFragment(base, overrides map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(base)+len(overrides))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range overrides {
+		bo, ok := out[k].(map[string]interface{})
+		oo, ok2 := v.(map[string]interface{})
+		if ok && ok2 {
+			out[k] = mergeFragment(bo, oo)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// resolveFragments replaces the references to fragments in the
+// JSON-encoded data and returns the re-encoded result.
+func resolveFragments(data []byte, fragments Fragments) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding rule file: %v", err)
+	}
+	v, err := fragments.resolve(v, nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,280 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFragmentsResolve(t *testing.T) {
+	fragments := Fragments{
+		"errors": map[string]interface{}{
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"must": []interface{}{
+						map[string]interface{}{"term": map[string]interface{}{"level": "error"}},
+					},
+					"filter": map[string]interface{}{"range": map[string]interface{}{"@timestamp": "now-15m"}},
+				},
+			},
+			"size": 0,
+		},
+		"recent-errors": map[string]interface{}{
+			fragmentRef: "errors",
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"filter": map[string]interface{}{"range": map[string]interface{}{"@timestamp": "now-5m"}},
+				},
+			},
+		},
+		"username":     "{{.Rule}} alerts",
+		"not-a-string": map[string]interface{}{fragmentRef: 1},
+		"unknown":      map[string]interface{}{fragmentRef: "nope"},
+		"cycle-a":      map[string]interface{}{fragmentRef: "cycle-b"},
+		"cycle-b":      map[string]interface{}{"aggs": map[string]interface{}{fragmentRef: "cycle-a"}},
+		"self":         []interface{}{map[string]interface{}{fragmentRef: "self"}},
+	}
+
+	cases := []struct {
+		name     string
+		input    interface{}
+		expected interface{}
+		err      string
+	}{
+		{
+			"no-references",
+			map[string]interface{}{"size": 1},
+			map[string]interface{}{"size": 1},
+			"",
+		},
+		{
+			"reference",
+			map[string]interface{}{"body": map[string]interface{}{fragmentRef: "errors"}},
+			map[string]interface{}{"body": fragments["errors"]},
+			"",
+		},
+		{
+			"string-fragment",
+			[]interface{}{map[string]interface{}{"username_template": map[string]interface{}{fragmentRef: "username"}}},
+			[]interface{}{map[string]interface{}{"username_template": "{{.Rule}} alerts"}},
+			"",
+		},
+		{
+			"override",
+			map[string]interface{}{
+				fragmentRef: "errors",
+				"size":      10,
+				"query": map[string]interface{}{
+					"bool": map[string]interface{}{
+						"must": []interface{}{},
+					},
+				},
+			},
+			map[string]interface{}{
+				"query": map[string]interface{}{
+					"bool": map[string]interface{}{
+						"must":   []interface{}{},
+						"filter": map[string]interface{}{"range": map[string]interface{}{"@timestamp": "now-15m"}},
+					},
+				},
+				"size": 10,
+			},
+			"",
+		},
+		{
+			"nested-reference",
+			map[string]interface{}{fragmentRef: "recent-errors", "size": 5},
+			map[string]interface{}{
+				"query": map[string]interface{}{
+					"bool": map[string]interface{}{
+						"must": []interface{}{
+							map[string]interface{}{"term": map[string]interface{}{"level": "error"}},
+						},
+						"filter": map[string]interface{}{"range": map[string]interface{}{"@timestamp": "now-5m"}},
+					},
+				},
+				"size": 5,
+			},
+			"",
+		},
+		{
+			"override-string-fragment",
+			map[string]interface{}{fragmentRef: "username", "size": 5},
+			nil,
+			"is not a JSON object",
+		},
+		{
+			"ref-not-a-string",
+			map[string]interface{}{fragmentRef: "not-a-string"},
+			nil,
+			"must be a string",
+		},
+		{
+			"unknown-fragment",
+			map[string]interface{}{fragmentRef: "unknown"},
+			nil,
+			`unknown fragment "nope"`,
+		},
+		{
+			"cycle",
+			map[string]interface{}{fragmentRef: "cycle-a"},
+			nil,
+			"circular fragment reference: cycle-a -> cycle-b -> cycle-a",
+		},
+		{
+			"self-reference",
+			map[string]interface{}{fragmentRef: "self"},
+			nil,
+			"circular fragment reference: self -> self",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resolved, err := fragments.resolve(tc.input, nil)
+			if tc.err != "" {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				if !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %q does not contain %q", err.Error(), tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, resolved); diff != "" {
+				t.Fatalf("resolved value differs from expected:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFragmentsResolveCopies(t *testing.T) {
+	fragments := Fragments{
+		"base": map[string]interface{}{"query": map[string]interface{}{"term": "a"}},
+	}
+	if _, err := fragments.resolve(map[string]interface{}{
+		fragmentRef: "base",
+		"query":     map[string]interface{}{"term": "b"},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"query": map[string]interface{}{"term": "a"}}
+	if diff := cmp.Diff(expected, fragments["base"]); diff != "" {
+		t.Fatalf("overriding a fragment modified it:\n%s", diff)
+	}
+}
+
+func TestFragments_validate(t *testing.T) {
+	cases := []struct {
+		name      string
+		fragments Fragments
+		err       bool
+	}{
+		{"none", nil, false},
+		{"valid", Fragments{
+			"a": map[string]interface{}{fragmentRef: "b", "size": 1},
+			"b": map[string]interface{}{"query": map[string]interface{}{}},
+		}, false},
+		{"unused-cycle", Fragments{
+			"a": map[string]interface{}{fragmentRef: "b"},
+			"b": map[string]interface{}{fragmentRef: "a"},
+		}, true},
+		{"unknown", Fragments{"a": map[string]interface{}{fragmentRef: "b"}}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.fragments.validate()
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParseRulesFragments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fragments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv(envRulesDir, dir)
+	defer os.Unsetenv(envRulesDir)
+
+	rule := `{
+  "name": "test-rule",
+  "index": "test-*",
+  "schedule": "@every 1m",
+  "body": {"$ref": "errors", "size": 20},
+  "outputs": [
+    {
+      "type": "slack",
+      "config": {
+        "webhook": "https://hooks.slack.com/services/test",
+        "username_template": {"$ref": "username"}
+      }
+    }
+  ]
+}`
+	if err = ioutil.WriteFile(filepath.Join(dir, "rule.json"), []byte(rule), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var fragments Fragments
+	if err = json.Unmarshal([]byte(`{
+  "errors": {"query": {"term": {"level": "error"}}, "size": 0},
+  "username": "{{.Rule}}"
+}`), &fragments); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := ParseRules(fragments, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(rules))
+	}
+
+	expectedBody := map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"level": "error"}},
+		"size":  json.Number("20"),
+	}
+	if diff := cmp.Diff(expectedBody, rules[0].ElasticsearchBody); diff != "" {
+		t.Fatalf("rule body differs from expected:\n%s", diff)
+	}
+	if v := rules[0].Outputs[0].Config["username_template"]; v != "{{.Rule}}" {
+		t.Fatalf("expected username_template to be resolved from its fragment, got %v", v)
+	}
+
+	if _, err = ParseRules(nil, nil); err == nil {
+		t.Fatal("expected an error resolving a reference to an undefined fragment")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// IndexPolicy restricts the indices the rules may query so that a
+// mistyped index pattern (e.g. "*") cannot query every index of the
+// cluster.
+type IndexPolicy struct {
+	// Allowed are the patterns of which every index queried must
+	// be a subset. If empty, any index not denied is allowed
+	Allowed []string
+
+	// Denied are the patterns with which no index queried may
+	// overlap
+	Denied []string
+}
+
+// IndexPolicy returns the policy of the 'allowed_index_patterns'
+// and 'denied_index_patterns' fields of the main configuration
+// file, or nil if neither is set.
+func (c *Config) IndexPolicy() *IndexPolicy {
+	if len(c.AllowedIndexPatterns) == 0 && len(c.DeniedIndexPatterns) == 0 {
+		return nil
+	}
+	return &IndexPolicy{Allowed: c.AllowedIndexPatterns, Denied: c.DeniedIndexPatterns}
+}
+
+func (p *IndexPolicy) validate() error {
+	for _, pattern := range p.Allowed {
+		if strings.TrimSpace(pattern) == "" {
+			return xerrors.New("'allowed_index_patterns' field must not contain empty patterns")
+		}
+	}
+	for _, pattern := range p.Denied {
+		if strings.TrimSpace(pattern) == "" {
+			return xerrors.New("'denied_index_patterns' field must not contain empty patterns")
+		}
+	}
+	return nil
+}
+
+// Check returns a non-nil error if the index, which may be a
+// comma-separated list of index patterns, could match an index
+// denied by the policy or one which none of its allowed patterns
+// match. Exclusions (e.g. "-logs-debug") are ignored since they only
+// narrow the indices queried, and the date math of date math index
+// names (e.g. "<logs-{now/d}>") may resolve to anything. A nil
+// policy allows any index.
+func (p *IndexPolicy) Check(index string) error {
+	if p == nil {
+		return nil
+	}
+	for _, expr := range strings.Split(index, ",") {
+		expr = indexPattern(strings.TrimSpace(expr))
+		if expr == "" || strings.HasPrefix(expr, "-") {
+			continue
+		}
+		for _, pattern := range p.Denied {
+			if patternsOverlap(expr, pattern) {
+				return xerrors.Errorf("index %q matches denied index pattern %q", expr, pattern)
+			}
+		}
+		if len(p.Allowed) == 0 {
+			continue
+		}
+		allowed := false
+		for _, pattern := range p.Allowed {
+			if patternContains(pattern, expr) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return xerrors.Errorf("index %q does not match any allowed index pattern (allowed: %s)",
+				expr, strings.Join(p.Allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// ValidateRules checks the indices of the rules and of their sub
+// queries against the policy. Rules using SQL name their indices in
+// their statements, which cannot be checked, so they are rejected.
+func (p *IndexPolicy) ValidateRules(rules []RuleConfig) error {
+	if p == nil {
+		return nil
+	}
+	for _, rule := range rules {
+		if rule.SQL != nil {
+			return xerrors.Errorf("error in rule %s: 'sql' field cannot be used with 'allowed_index_patterns' "+
+				"or 'denied_index_patterns' since the indices of SQL queries cannot be checked", rule.Name)
+		}
+		if err := p.Check(rule.ElasticsearchIndex); err != nil {
+			return xerrors.Errorf("error in rule %s: %v", rule.Name, err)
+		}
+		for _, sq := range rule.SubQueries {
+			if err := p.Check(sq.ElasticsearchIndex); err != nil {
+				return xerrors.Errorf("error in sub query %s of rule %s: %v", sq.Name, rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// indexPattern returns the pattern of the indices an index name may
+// resolve to. "_all" is every index and the date math of date math
+// index names becomes a wildcard.
+func indexPattern(name string) string {
+	if name == "_all" {
+		return "*"
+	}
+	if !strings.HasPrefix(name, "<") || !strings.HasSuffix(name, ">") {
+		return name
+	}
+	var b strings.Builder
+	depth := 0
+	for _, r := range name[1 : len(name)-1] {
+		switch {
+		case r == '{':
+			if depth == 0 {
+				b.WriteByte('*')
+			}
+			depth++
+		case r == '}' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// patternContains returns whether every index matched by expr is
+// also matched by pattern, where '*' matches any sequence of
+// characters. A wildcard of expr can only be matched by one of
+// pattern.
+func patternContains(pattern, expr string) bool {
+	memo := make(map[[2]int]bool)
+	var match func(i, j int) bool
+	match = func(i, j int) bool {
+		key := [2]int{i, j}
+		if v, ok := memo[key]; ok {
+			return v
+		}
+		var v bool
+		switch {
+		case i == len(pattern):
+			v = j == len(expr)
+		case pattern[i] == '*':
+			v = match(i+1, j) || (j < len(expr) && match(i, j+1))
+		default:
+			v = j < len(expr) && expr[j] != '*' && pattern[i] == expr[j] && match(i+1, j+1)
+		}
+		memo[key] = v
+		return v
+	}
+	return match(0, 0)
+}
+
+// patternsOverlap returns whether some index is matched by both
+// patterns, where '*' matches any sequence of characters.
+func patternsOverlap(a, b string) bool {
+	memo := make(map[[2]int]bool)
+	var match func(i, j int) bool
+	match = func(i, j int) bool {
+		key := [2]int{i, j}
+		if v, ok := memo[key]; ok {
+			return v
+		}
+		var v bool
+		switch {
+		case i < len(a) && a[i] == '*':
+			v = match(i+1, j) || (j < len(b) && match(i, j+1))
+		case j < len(b) && b[j] == '*':
+			v = match(i, j+1) || (i < len(a) && match(i+1, j))
+		case i == len(a) || j == len(b):
+			v = i == len(a) && j == len(b)
+		default:
+			v = a[i] == b[j] && match(i+1, j+1)
+		}
+		memo[key] = v
+		return v
+	}
+	return match(0, 0)
+}
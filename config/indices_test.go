@@ -0,0 +1,128 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIndexPolicy_Check(t *testing.T) {
+	policy := &IndexPolicy{
+		Allowed: []string{"logs-*", "metrics-app-*", "audit"},
+		Denied:  []string{".security*", "logs-secret-*"},
+	}
+
+	cases := []struct {
+		name  string
+		index string
+		err   bool
+	}{
+		{"exact-pattern", "metrics-app-*", false},
+		{"narrower-pattern", "logs-nginx-*", false},
+		{"concrete-index", "metrics-app-2019.01.01", false},
+		{"exact-name", "audit", false},
+		{"list", "logs-nginx-*,audit", false},
+		{"exclusion-ignored", "logs-nginx-*,-logs-nginx-debug", false},
+		{"date-math", "<logs-nginx-{now/d}>", false},
+		{"date-math-format", "<logs-nginx-{now/d{yyyy.MM.dd|+12:00}}>", false},
+		{"everything", "*", true},
+		{"all", "_all", true},
+		{"broader-pattern", "log*", true},
+		{"not-allowed", "metrics-db-*", true},
+		{"allowed-prefix-only", "audit-2019", true},
+		{"one-of-list-not-allowed", "logs-*,metrics-*", true},
+		{"overlaps-denied", "logs-sec*", true},
+		{"allowed-but-overlaps-denied", "logs-*", true},
+		{"denied-concrete", "logs-secret-keys", true},
+		{"date-math-anything", "<{now/d}>", true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := policy.Check(tc.index)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestIndexPolicy_CheckDeniedOnly(t *testing.T) {
+	policy := &IndexPolicy{Denied: []string{".*"}}
+	for index, denied := range map[string]bool{
+		"logs-*":    false,
+		"logs-.foo": false,
+		".kibana":   true,
+		"*":         true,
+		"*kibana":   true,
+		"l*":        false,
+	} {
+		if err := policy.Check(index); (err != nil) != denied {
+			t.Errorf("unexpected result of checking index %q (got error %v, expected denied: %t)", index, err, denied)
+		}
+	}
+
+	var nilPolicy *IndexPolicy
+	if err := nilPolicy.Check("*"); err != nil {
+		t.Fatalf("a nil policy should allow any index: %v", err)
+	}
+}
+
+func TestIndexPolicy_ValidateRules(t *testing.T) {
+	policy := &IndexPolicy{Allowed: []string{"logs-*"}}
+	rules := []RuleConfig{
+		{Name: "good", ElasticsearchIndex: "logs-*"},
+	}
+	if err := policy.ValidateRules(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	rules = append(rules, RuleConfig{
+		Name:               "bad-sub-query",
+		ElasticsearchIndex: "logs-*",
+		SubQueries:         []SubQueryConfig{{Name: "everything", ElasticsearchIndex: "*"}},
+	})
+	if err := policy.ValidateRules(rules); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+}
+
+func TestIndexPolicy_ValidateRulesSQL(t *testing.T) {
+	rules := []RuleConfig{
+		{Name: "good", ElasticsearchIndex: "logs-*"},
+		{Name: "sql", SQL: &SQLConfig{Query: "SELECT * FROM secrets"}},
+	}
+
+	// Without a policy, SQL rules are allowed
+	var nilPolicy *IndexPolicy
+	if err := nilPolicy.ValidateRules(rules); err != nil {
+		t.Fatalf("SQL rules should be allowed without a policy: %v", err)
+	}
+
+	// The indices of SQL statements cannot be checked
+	for _, policy := range []*IndexPolicy{
+		{Allowed: []string{"logs-*"}},
+		{Denied: []string{"secrets"}},
+	} {
+		err := policy.ValidateRules(rules)
+		if err == nil || !strings.Contains(err.Error(), "rule sql") {
+			t.Fatalf("expected SQL rules to be rejected with policy %+v (got %v)", policy, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// insecureSkipVerifyField is the field of the configuration of
+	// an output which disables the verification of the certificates
+	// of the servers it connects to
+	insecureSkipVerifyField = "insecure_skip_verify"
+
+	// consulSSLVerifyField is the field of the 'consul' configuration
+	// (or, if set, the environment variable of the same name in upper
+	// case) which disables the verification of Consul's certificate
+	// when false
+	consulSSLVerifyField = "consul_http_ssl_verify"
+)
+
+// InsecureTLS returns the components which connect to servers via
+// TLS without verifying their certificates: the outputs of the main
+// configuration file and of the rules (and their evaluations), and the
+// error output, whose 'insecure_skip_verify' field is true, and Consul
+// if 'consul_http_ssl_verify' is false.
+func (c *Config) InsecureTLS(rules []RuleConfig) []string {
+	var insecure []string
+	if c.Distributed && (c.Lock == nil || c.Lock.Backend == LockBackendConsul) && !consulVerifies(c.Consul) {
+		insecure = append(insecure, fmt.Sprintf("consul (%s)", consulSSLVerifyField))
+	}
+
+	names := make([]string, 0, len(c.Outputs))
+	for name := range c.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if output := c.Outputs[name]; output.skipsVerify() {
+			insecure = append(insecure, fmt.Sprintf("output %q (%s)", name, output.Type))
+		}
+	}
+
+	if ec := c.ErrorOutput; ec != nil && ec.Output != nil && ec.Output.name == "" && ec.Output.skipsVerify() {
+		insecure = append(insecure, fmt.Sprintf("error output (%s)", ec.Output.Type))
+	}
+
+	if hc := c.Heartbeat; hc != nil && hc.Output != nil && hc.Output.name == "" && hc.Output.skipsVerify() {
+		insecure = append(insecure, fmt.Sprintf("heartbeat output (%s)", hc.Output.Type))
+	}
+
+	for _, rule := range rules {
+		for i, output := range rule.Outputs {
+			// The named outputs were listed above
+			if output.name == "" && output.skipsVerify() {
+				insecure = append(insecure, fmt.Sprintf("output %d (%s) of rule %s", i+1, output.Type, rule.Name))
+			}
+		}
+		for _, e := range rule.Evaluations {
+			for i, output := range e.Outputs {
+				if output.name == "" && output.skipsVerify() {
+					insecure = append(insecure, fmt.Sprintf("output %d (%s) of evaluation %s of rule %s",
+						i+1, output.Type, e.Name, rule.Name))
+				}
+			}
+		}
+	}
+	return insecure
+}
+
+// CheckTLS returns a non-nil error naming each of the components
+// which do not verify the certificates of the servers they connect
+// to (see InsecureTLS) if 'refuse_insecure_tls' is set. Otherwise,
+// it logs a warning for each of them.
+func (c *Config) CheckTLS(logger hclog.Logger, rules []RuleConfig) error {
+	insecure := c.InsecureTLS(rules)
+	if len(insecure) == 0 {
+		return nil
+	}
+	if c.RefuseInsecureTLS {
+		return xerrors.Errorf("TLS certificate verification is disabled for %s but 'refuse_insecure_tls' is set",
+			strings.Join(insecure, ", "))
+	}
+	for _, component := range insecure {
+		logger.Warn("TLS CERTIFICATE VERIFICATION IS DISABLED: connections are vulnerable to interception",
+			"component", component)
+	}
+	return nil
+}
+
+// skipsVerify returns whether the output does not verify the
+// certificates of the servers it connects to.
+func (o OutputConfig) skipsVerify() bool {
+	switch v := o.Config[insecureSkipVerifyField].(type) {
+	case bool:
+		return v
+	case string:
+		b, err := strconv.ParseBool(v)
+		return err == nil && b
+	}
+	return false
+}
+
+// consulVerifies returns whether the Consul client verifies the
+// certificate of Consul. The environment variable takes precedence
+// over the configuration, as it does when the client is created.
+func consulVerifies(cc ConsulConfig) bool {
+	v := os.Getenv(strings.ToUpper(consulSSLVerifyField))
+	if v == "" {
+		v = cc[consulSSLVerifyField]
+	}
+	if v == "" {
+		return true
+	}
+	b, err := strconv.ParseBool(v)
+	return err != nil || b
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestInsecureTLS(t *testing.T) {
+	insecureSlack := OutputConfig{
+		Type:   "slack",
+		Config: map[string]interface{}{"webhook": "https://example.com", "insecure_skip_verify": true},
+	}
+	secureSlack := OutputConfig{
+		Type:   "slack",
+		Config: map[string]interface{}{"webhook": "https://example.com", "insecure_skip_verify": "false"},
+	}
+	named := insecureSlack
+	named.name = "slack-oncall"
+
+	cases := []struct {
+		name     string
+		config   *Config
+		rules    []RuleConfig
+		expected []string
+	}{
+		{
+			"secure",
+			&Config{Outputs: NamedOutputs{"slack-notices": secureSlack}},
+			[]RuleConfig{{Name: "errors", Outputs: []OutputConfig{secureSlack}}},
+			nil,
+		},
+		{
+			"outputs",
+			&Config{Outputs: NamedOutputs{"slack-oncall": insecureSlack, "slack-notices": secureSlack}},
+			[]RuleConfig{
+				{Name: "errors", Outputs: []OutputConfig{secureSlack, insecureSlack}},
+				{Name: "latency", Outputs: []OutputConfig{named}, OutputNames: []string{"slack-oncall"}},
+			},
+			[]string{`output "slack-oncall" (slack)`, "output 2 (slack) of rule errors"},
+		},
+		{
+			"consul",
+			&Config{
+				Distributed: true,
+				Consul:      ConsulConfig{"consul_http_ssl_verify": "false"},
+				Lock:        &LockConfig{Backend: LockBackendConsul},
+			},
+			nil,
+			[]string{"consul (consul_http_ssl_verify)"},
+		},
+		{
+			"consul-unused",
+			&Config{
+				Distributed: true,
+				Consul:      ConsulConfig{"consul_http_ssl_verify": "false"},
+				Lock:        &LockConfig{Backend: LockBackendElasticsearch},
+			},
+			nil,
+			nil,
+		},
+	}
+
+	os.Unsetenv("CONSUL_HTTP_SSL_VERIFY")
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.config.InsecureTLS(tc.rules); !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("unexpected insecure components (got %q, expected %q)", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestCheckTLS(t *testing.T) {
+	rules := []RuleConfig{{
+		Name: "errors",
+		Outputs: []OutputConfig{{
+			Type:   "slack",
+			Config: map[string]interface{}{"webhook": "https://example.com", "insecure_skip_verify": true},
+		}},
+	}}
+
+	t.Run("warn", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := hclog.New(&hclog.LoggerOptions{Output: &buf})
+		if err := new(Config).CheckTLS(logger, rules); err != nil {
+			t.Fatal(err)
+		}
+		if out := buf.String(); !strings.Contains(out, "[WARN]") || !strings.Contains(out, "output 1 (slack) of rule errors") {
+			t.Fatalf("expected a warning naming the output, got %q", out)
+		}
+	})
+
+	t.Run("refuse", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := hclog.New(&hclog.LoggerOptions{Output: &buf})
+		err := (&Config{RefuseInsecureTLS: true}).CheckTLS(logger, rules)
+		if err == nil {
+			t.Fatal("expected an error but didn't receive one")
+		}
+		if !strings.Contains(err.Error(), "output 1 (slack) of rule errors") {
+			t.Fatalf("expected the error to name the output, got %q", err)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("expected no warnings, got %q", buf.String())
+		}
+	})
+
+	t.Run("secure", func(t *testing.T) {
+		if err := (&Config{RefuseInsecureTLS: true}).CheckTLS(hclog.NewNullLogger(), nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
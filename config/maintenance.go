@@ -0,0 +1,204 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"time"
+
+	"github.com/robfig/cron"
+	"golang.org/x/xerrors"
+)
+
+// maintenanceTimeLayouts are the accepted layouts of the 'start'
+// and 'end' fields of a maintenance window, besides RFC 3339. They
+// are interpreted in the timezone of the window
+var maintenanceTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// MaintenanceWindowConfig maps to each element of the
+// 'maintenance_windows' field of the main configuration file or of
+// a rule configuration file. During a window, the rules to which it
+// applies still run their queries but do not send alerts. A window
+// either recurs, starting per Schedule and lasting DurationRaw, or
+// happens once, between Start and End.
+type MaintenanceWindowConfig struct {
+	// Name identifies the window in logs. It is optional
+	Name string `json:"name"`
+
+	// Schedule is when each occurrence of a recurring window starts
+	// (in cron syntax) and DurationRaw how long it lasts
+	Schedule    string `json:"schedule"`
+	DurationRaw string `json:"duration"`
+
+	// Start and End bound a one-off window. They are either RFC 3339
+	// timestamps or local times such as "2019-06-01 22:00", in which
+	// case they are interpreted in Timezone
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Timezone is the IANA name of the timezone (e.g.
+	// "America/New_York") in which Schedule, Start and End are
+	// interpreted. If empty, UTC is used
+	Timezone string `json:"timezone"`
+
+	// Rules are the names of the rules to which a window of
+	// the main configuration file applies. If empty, it applies
+	// to every rule. Windows of rule configuration files always
+	// apply to their own rule only
+	Rules []string `json:"rules"`
+
+	// LogSuppressed is whether the alerts suppressed by the window
+	// are logged
+	LogSuppressed bool `json:"log_suppressed"`
+
+	// Window is the window parsed from the fields above
+	Window *MaintenanceWindow `json:"-"`
+}
+
+func (wc *MaintenanceWindowConfig) validate() error {
+	w, err := ParseMaintenanceWindow(wc)
+	if err != nil {
+		return err
+	}
+	wc.Window = w
+	return nil
+}
+
+// MaintenanceWindow is a period during which alerts are not sent.
+type MaintenanceWindow struct {
+	// Name identifies the window in logs
+	Name string
+
+	// LogSuppressed is whether the alerts suppressed by the window
+	// are logged
+	LogSuppressed bool
+
+	location *time.Location
+	schedule cron.Schedule
+	duration time.Duration
+	start    time.Time
+	end      time.Time
+}
+
+// ParseMaintenanceWindow parses the schedule or the start and end
+// of the given window.
+func ParseMaintenanceWindow(wc *MaintenanceWindowConfig) (*MaintenanceWindow, error) {
+	w := &MaintenanceWindow{
+		Name:          wc.Name,
+		LogSuppressed: wc.LogSuppressed,
+		location:      time.UTC,
+	}
+	if wc.Timezone != "" {
+		loc, err := time.LoadLocation(wc.Timezone)
+		if err != nil {
+			return nil, xerrors.Errorf("error parsing 'timezone' field of maintenance window: %v", err)
+		}
+		w.location = loc
+	}
+
+	var err error
+	switch {
+	case wc.Schedule != "" && (wc.Start != "" || wc.End != ""):
+		return nil, errors.New("maintenance window must have either a 'schedule' or a 'start' and 'end', not both")
+	case wc.Schedule != "":
+		if w.schedule, err = cron.Parse(wc.Schedule); err != nil {
+			return nil, xerrors.Errorf("error parsing 'schedule' field of maintenance window: %v", err)
+		}
+		if _, ok := w.schedule.(cron.ConstantDelaySchedule); ok {
+			return nil, errors.New("'schedule' field of maintenance window must not be an '@every' interval")
+		}
+		if w.duration, err = parseDuration("duration", wc.DurationRaw); err != nil {
+			return nil, err
+		}
+		if w.duration == 0 {
+			return nil, errors.New("'duration' field of maintenance window is required along with 'schedule'")
+		}
+	case wc.Start != "" && wc.End != "":
+		if wc.DurationRaw != "" {
+			return nil, errors.New("'duration' field of maintenance window must not be set along with 'start' and 'end'")
+		}
+		if w.start, err = w.parseTime("start", wc.Start); err != nil {
+			return nil, err
+		}
+		if w.end, err = w.parseTime("end", wc.End); err != nil {
+			return nil, err
+		}
+		if !w.end.After(w.start) {
+			return nil, errors.New("'end' field of maintenance window must be after 'start'")
+		}
+	default:
+		return nil, errors.New("maintenance window must have either a 'schedule' and 'duration' or a 'start' and 'end'")
+	}
+	return w, nil
+}
+
+func (w *MaintenanceWindow) parseTime(field, raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	for _, layout := range maintenanceTimeLayouts {
+		if t, err := time.ParseInLocation(layout, raw, w.location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, xerrors.Errorf("error parsing '%s' field of maintenance window: unrecognized time %q", field, raw)
+}
+
+// Contains returns whether t is within the window. An occurrence
+// of a window includes its start but not its end.
+func (w *MaintenanceWindow) Contains(t time.Time) bool {
+	if w.schedule != nil {
+		// The occurrences which contain t are those which start
+		// after t-duration and no later than t
+		start := w.schedule.Next(t.Add(-w.duration).In(w.location))
+		return !start.After(t)
+	}
+	return !t.Before(w.start) && t.Before(w.end)
+}
+
+// AppliesTo returns whether the window applies to the rule of the
+// given name.
+func (w *MaintenanceWindowConfig) AppliesTo(rule string) bool {
+	if len(w.Rules) == 0 {
+		return true
+	}
+	for _, name := range w.Rules {
+		if name == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWindowRules checks that the rules named by the maintenance
+// windows of the main configuration file exist.
+func validateWindowRules(windows []MaintenanceWindowConfig, rules []RuleConfig) error {
+	names := make(map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		names[rule.Name] = struct{}{}
+	}
+	for i, w := range windows {
+		for _, name := range w.Rules {
+			if _, ok := names[name]; !ok {
+				return xerrors.Errorf("maintenance window %d applies to rule %q, which does not exist", i+1, name)
+			}
+		}
+	}
+	return nil
+}
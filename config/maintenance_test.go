@@ -0,0 +1,172 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *MaintenanceWindowConfig
+		err    bool
+	}{
+		{"schedule", &MaintenanceWindowConfig{Schedule: "0 0 2 * * SAT", DurationRaw: "2h"}, false},
+		{"schedule-timezone", &MaintenanceWindowConfig{
+			Schedule:    "@daily",
+			DurationRaw: "30m",
+			Timezone:    "America/New_York",
+		}, false},
+		{"start-end", &MaintenanceWindowConfig{Start: "2019-06-01 22:00", End: "2019-06-02T01:00:00Z"}, false},
+		{"neither", &MaintenanceWindowConfig{}, true},
+		{"both", &MaintenanceWindowConfig{Schedule: "@daily", DurationRaw: "1h", Start: "2019-06-01 22:00"}, true},
+		{"start-only", &MaintenanceWindowConfig{Start: "2019-06-01 22:00"}, true},
+		{"bad-schedule", &MaintenanceWindowConfig{Schedule: "not a schedule", DurationRaw: "1h"}, true},
+		{"every", &MaintenanceWindowConfig{Schedule: "@every 1h", DurationRaw: "10m"}, true},
+		{"no-duration", &MaintenanceWindowConfig{Schedule: "@daily"}, true},
+		{"bad-duration", &MaintenanceWindowConfig{Schedule: "@daily", DurationRaw: "1 hour"}, true},
+		{"start-end-duration", &MaintenanceWindowConfig{
+			Start:       "2019-06-01 22:00",
+			End:         "2019-06-02 01:00",
+			DurationRaw: "3h",
+		}, true},
+		{"bad-start", &MaintenanceWindowConfig{Start: "June 1st", End: "2019-06-02 01:00"}, true},
+		{"end-before-start", &MaintenanceWindowConfig{Start: "2019-06-02 01:00", End: "2019-06-01 22:00"}, true},
+		{"bad-timezone", &MaintenanceWindowConfig{
+			Start:    "2019-06-01 22:00",
+			End:      "2019-06-02 01:00",
+			Timezone: "Mars/Olympus_Mons",
+		}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseMaintenanceWindow(tc.config)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindow_Contains(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		config *MaintenanceWindowConfig
+		time   time.Time
+		in     bool
+	}{
+		{
+			"recurring-start",
+			&MaintenanceWindowConfig{Schedule: "0 0 2 * * *", DurationRaw: "2h"},
+			time.Date(2019, time.June, 1, 2, 0, 0, 0, time.UTC),
+			true,
+		},
+		{
+			"recurring-during",
+			&MaintenanceWindowConfig{Schedule: "0 0 2 * * *", DurationRaw: "2h"},
+			time.Date(2019, time.June, 1, 3, 59, 59, 0, time.UTC),
+			true,
+		},
+		{
+			"recurring-end",
+			&MaintenanceWindowConfig{Schedule: "0 0 2 * * *", DurationRaw: "2h"},
+			time.Date(2019, time.June, 1, 4, 0, 0, 0, time.UTC),
+			false,
+		},
+		{
+			"recurring-before",
+			&MaintenanceWindowConfig{Schedule: "0 0 2 * * *", DurationRaw: "2h"},
+			time.Date(2019, time.June, 1, 1, 59, 0, 0, time.UTC),
+			false,
+		},
+		{
+			"recurring-across-midnight",
+			&MaintenanceWindowConfig{Schedule: "0 0 23 * * *", DurationRaw: "3h"},
+			time.Date(2019, time.June, 2, 1, 0, 0, 0, time.UTC),
+			true,
+		},
+		{
+			"recurring-timezone",
+			&MaintenanceWindowConfig{Schedule: "0 0 2 * * *", DurationRaw: "1h", Timezone: "America/New_York"},
+			time.Date(2019, time.June, 1, 2, 30, 0, 0, ny),
+			true,
+		},
+		{
+			"recurring-timezone-utc",
+			&MaintenanceWindowConfig{Schedule: "0 0 2 * * *", DurationRaw: "1h", Timezone: "America/New_York"},
+			time.Date(2019, time.June, 1, 2, 30, 0, 0, time.UTC),
+			false,
+		},
+		{
+			"one-off-during",
+			&MaintenanceWindowConfig{Start: "2019-06-01 22:00", End: "2019-06-02 01:00", Timezone: "America/New_York"},
+			time.Date(2019, time.June, 2, 3, 0, 0, 0, time.UTC),
+			true,
+		},
+		{
+			"one-off-end",
+			&MaintenanceWindowConfig{Start: "2019-06-01T22:00:00Z", End: "2019-06-02T01:00:00Z"},
+			time.Date(2019, time.June, 2, 1, 0, 0, 0, time.UTC),
+			false,
+		},
+		{
+			"one-off-before",
+			&MaintenanceWindowConfig{Start: "2019-06-01 22:00", End: "2019-06-02 01:00"},
+			time.Date(2019, time.June, 1, 21, 0, 0, 0, time.UTC),
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := ParseMaintenanceWindow(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in := w.Contains(tc.time); in != tc.in {
+				t.Fatalf("unexpected result for %s (got %t, expected %t)", tc.time, in, tc.in)
+			}
+		})
+	}
+}
+
+func TestValidateWindowRules(t *testing.T) {
+	rules := []RuleConfig{{Name: "errors"}, {Name: "latency"}}
+
+	windows := []MaintenanceWindowConfig{{}, {Rules: []string{"errors", "latency"}}}
+	if err := validateWindowRules(windows, rules); err != nil {
+		t.Fatal(err)
+	}
+	if !windows[0].AppliesTo("errors") || !windows[1].AppliesTo("latency") || windows[1].AppliesTo("disk") {
+		t.Fatal("window applies to the wrong rules")
+	}
+
+	windows = append(windows, MaintenanceWindowConfig{Rules: []string{"disk"}})
+	if err := validateWindowRules(windows, rules); err == nil {
+		t.Fatal("expected an error but didn't receive one")
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// NamedOutputs are the outputs defined once, by name, in the
+// 'outputs' field of the main configuration file. A rule sends its
+// alerts to those named by its 'output_names' field in addition to
+// its own 'outputs'.
+type NamedOutputs map[string]OutputConfig
+
+// validate validates each of the outputs and reads the files
+// referenced by their configurations. Relative paths are resolved
+// against dir, the directory of the main configuration file.
+func (n NamedOutputs) validate(dir string) error {
+	names := make([]string, 0, len(n))
+	for name := range n {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "" {
+			return xerrors.New("the names of the outputs must not be empty ('outputs')")
+		}
+		output := n[name]
+		if err := output.validate(); err != nil {
+			return xerrors.Errorf("error in output %q: %v", name, err)
+		}
+		if err := output.parseMatch(); err != nil {
+			return xerrors.Errorf("error in output %q: %v", name, err)
+		}
+		if err := output.readSecretFiles(dir); err != nil {
+			return xerrors.Errorf("error in output %q: %v", name, err)
+		}
+		n[name] = output
+	}
+	return nil
+}
+
+// Get returns the output with the given name, if there is one.
+func (n NamedOutputs) Get(name string) (OutputConfig, bool) {
+	output, ok := n[name]
+	output.name = name
+	return output, ok
+}
+
+// resolve appends the outputs named by the 'output_names' field of
+// the rule, and of each of its evaluations, to its outputs.
+func (n NamedOutputs) resolve(rule *RuleConfig) error {
+	outputs, err := n.lookup(rule.OutputNames, "rule "+rule.Name)
+	if err != nil {
+		return err
+	}
+	rule.Outputs = append(rule.Outputs, outputs...)
+
+	for i := range rule.Evaluations {
+		e := &rule.Evaluations[i]
+		if outputs, err = n.lookup(e.OutputNames, "evaluation "+e.Name+" of rule "+rule.Name); err != nil {
+			return err
+		}
+		e.Outputs = append(e.Outputs, outputs...)
+	}
+	return nil
+}
+
+// lookup returns the outputs with the given names, which the owner
+// (a rule or one of its evaluations) listed in 'output_names'.
+func (n NamedOutputs) lookup(names []string, owner string) ([]OutputConfig, error) {
+	outputs := make([]OutputConfig, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		output, ok := n[name]
+		if !ok {
+			return nil, xerrors.Errorf("'output_names' field of %s references undefined output %q", owner, name)
+		}
+		if seen[name] {
+			return nil, xerrors.Errorf("'output_names' field of %s references output %q more than once",
+				owner, name)
+		}
+		seen[name] = true
+		output.name = name
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// ErrorOutputConfig is the output to which the failures of the
+// rules themselves, such as a query which could not be executed or
+// an output which could not send an alert, are sent.
+type ErrorOutputConfig struct {
+	// Output is the output to which the failures are sent. This
+	// value should come from the 'error_output.output' field of the
+	// main configuration file
+	Output *OutputConfig `json:"output"`
+
+	// OutputName is the name of an output of the main configuration
+	// file (see NamedOutputs) to which the failures are sent instead
+	// of Output. This value should come from the
+	// 'error_output.output_name' field of the main configuration file
+	OutputName string `json:"output_name"`
+
+	// IntervalRaw is the minimum time between two alerts about the
+	// failures of the query, or of an output, of the same rule. This
+	// value should come from the 'error_output.interval' field of
+	// the main configuration file
+	IntervalRaw string `json:"interval"`
+
+	// Interval is the parsed value of IntervalRaw
+	Interval time.Duration `json:"-"`
+}
+
+// validate validates the output, resolving OutputName against the
+// named outputs, and reads the files referenced by its
+// configuration. Relative paths are resolved against dir, the
+// directory of the main configuration file.
+func (ec *ErrorOutputConfig) validate(outputs NamedOutputs, dir string) error {
+	var err error
+	if ec.Interval, err = parseDuration("error_output.interval", ec.IntervalRaw); err != nil {
+		return err
+	}
+	ec.Output, err = resolveOutput("error_output", ec.Output, ec.OutputName, outputs, dir)
+	return err
+}
+
+// HeartbeatConfig is the output to which a heartbeat alert is sent
+// at a regular interval so that its absence reveals that the
+// daemon, or its connection to Elasticsearch or to the output, is
+// not working.
+type HeartbeatConfig struct {
+	// Output is the output to which the heartbeats are sent. This
+	// value should come from the 'heartbeat.output' field of the
+	// main configuration file
+	Output *OutputConfig `json:"output"`
+
+	// OutputName is the name of an output of the main configuration
+	// file (see NamedOutputs) to which the heartbeats are sent
+	// instead of Output. This value should come from the
+	// 'heartbeat.output_name' field of the main configuration file
+	OutputName string `json:"output_name"`
+
+	// IntervalRaw is the time between two heartbeats. This value
+	// should come from the 'heartbeat.interval' field of the main
+	// configuration file
+	IntervalRaw string `json:"interval"`
+
+	// Interval is the parsed value of IntervalRaw
+	Interval time.Duration `json:"-"`
+}
+
+// validate validates the heartbeat in the same way as an
+// ErrorOutputConfig.
+func (hc *HeartbeatConfig) validate(outputs NamedOutputs, dir string) error {
+	var err error
+	if hc.Interval, err = parseDuration("heartbeat.interval", hc.IntervalRaw); err != nil {
+		return err
+	}
+	hc.Output, err = resolveOutput("heartbeat", hc.Output, hc.OutputName, outputs, dir)
+	return err
+}
+
+// resolveOutput returns the output configured by the 'output' or
+// the 'output_name' field of the field of the main configuration
+// file, after validating it.
+func resolveOutput(
+	field string,
+	output *OutputConfig,
+	name string,
+	outputs NamedOutputs,
+	dir string,
+) (*OutputConfig, error) {
+	switch {
+	case output != nil && name != "":
+		return nil, xerrors.Errorf("'%s.output' and '%s.output_name' fields must not both be set", field, field)
+	case name != "":
+		named, ok := outputs[name]
+		if !ok {
+			return nil, xerrors.Errorf("'%s.output_name' field references undefined output %q", field, name)
+		}
+		named.name = name
+		return &named, nil
+	case output == nil:
+		return nil, xerrors.Errorf("no '%s.output' or '%s.output_name' field found", field, field)
+	}
+	if err := output.validate(); err != nil {
+		return nil, xerrors.Errorf("error in '%s.output': %v", field, err)
+	}
+	if err := output.parseMatch(); err != nil {
+		return nil, xerrors.Errorf("error in '%s.output': %v", field, err)
+	}
+	if err := output.readSecretFiles(dir); err != nil {
+		return nil, xerrors.Errorf("error in '%s.output': %v", field, err)
+	}
+	return output, nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNamedOutputs_validate(t *testing.T) {
+	cases := []struct {
+		name    string
+		outputs NamedOutputs
+		err     bool
+	}{
+		{"none", nil, false},
+		{"valid", NamedOutputs{
+			"slack-oncall": {Type: "slack", Config: map[string]interface{}{"webhook": "https://example.com"}},
+		}, false},
+		{"no-type", NamedOutputs{
+			"slack-oncall": {Config: map[string]interface{}{"webhook": "https://example.com"}},
+		}, true},
+		{"empty-name", NamedOutputs{
+			"": {Type: "slack", Config: map[string]interface{}{"webhook": "https://example.com"}},
+		}, true},
+		{"bad-match", NamedOutputs{
+			"slack-oncall": {
+				Type:     "slack",
+				Config:   map[string]interface{}{"webhook": "https://example.com"},
+				MatchRaw: "severity == 'critical'",
+			},
+		}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.outputs.validate("")
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestErrorOutputConfig_validate(t *testing.T) {
+	outputs := NamedOutputs{
+		"slack-ops": {Type: "slack", Config: map[string]interface{}{"webhook": "https://example.com"}},
+	}
+	slack := &OutputConfig{Type: "slack", Config: map[string]interface{}{"webhook": "https://example.com"}}
+
+	cases := []struct {
+		name     string
+		config   ErrorOutputConfig
+		interval time.Duration
+		err      bool
+	}{
+		{"inline", ErrorOutputConfig{Output: slack, IntervalRaw: "30m"}, 30 * time.Minute, false},
+		{"named", ErrorOutputConfig{OutputName: "slack-ops"}, 0, false},
+		{"undefined-name", ErrorOutputConfig{OutputName: "pagerduty-ops"}, 0, true},
+		{"both", ErrorOutputConfig{Output: slack, OutputName: "slack-ops"}, 0, true},
+		{"neither", ErrorOutputConfig{}, 0, true},
+		{"no-type", ErrorOutputConfig{Output: &OutputConfig{}}, 0, true},
+		{"bad-interval", ErrorOutputConfig{Output: slack, IntervalRaw: "-1m"}, 0, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate(outputs, "")
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.config.Output == nil || tc.config.Output.Type != "slack" {
+				t.Fatalf("unexpected output: %+v", tc.config.Output)
+			}
+			if tc.config.Interval != tc.interval {
+				t.Fatalf("unexpected interval (got %s, expected %s)", tc.config.Interval, tc.interval)
+			}
+		})
+	}
+}
+
+func TestNamedOutputsGet(t *testing.T) {
+	outputs := NamedOutputs{
+		"slack-ops": {Type: "slack", Config: map[string]interface{}{"webhook": "https://example.com"}},
+	}
+	output, ok := outputs.Get("slack-ops")
+	if !ok || output.Type != "slack" || output.Name() != "slack-ops" {
+		t.Fatalf("unexpected output: %+v", output)
+	}
+	if _, ok = outputs.Get("slack"); ok {
+		t.Fatal("expected no output named \"slack\"")
+	}
+}
+
+func TestHeartbeatConfig_validate(t *testing.T) {
+	outputs := NamedOutputs{
+		"slack-ops": {Type: "slack", Config: map[string]interface{}{"webhook": "https://example.com"}},
+	}
+
+	hc := &HeartbeatConfig{OutputName: "slack-ops", IntervalRaw: "1h"}
+	if err := hc.validate(outputs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if hc.Output == nil || hc.Output.Type != "slack" || hc.Interval != time.Hour {
+		t.Fatalf("unexpected heartbeat: %+v", hc)
+	}
+
+	hc = &HeartbeatConfig{IntervalRaw: "1h"}
+	err := hc.validate(outputs, "")
+	if expected := "no 'heartbeat.output' or 'heartbeat.output_name' field found"; err == nil || err.Error() != expected {
+		t.Fatalf("unexpected error (got %v, expected %q)", err, expected)
+	}
+}
+
+func TestParseRulesNamedOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv(envRulesDir, dir)
+	defer os.Unsetenv(envRulesDir)
+
+	outputs := NamedOutputs{
+		"slack-oncall": {
+			Type:     "slack",
+			Config:   map[string]interface{}{"webhook": "https://hooks.slack.com/services/oncall"},
+			Priority: 1,
+		},
+		"email-weekly": {
+			Type:   "email",
+			Config: map[string]interface{}{"to": []interface{}{"team@example.com"}},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		rule     string
+		expected []string
+		err      bool
+	}{
+		{
+			"names-only",
+			`{
+  "name": "test-rule",
+  "index": "test-*",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "output_names": ["email-weekly", "slack-oncall"]
+}`,
+			[]string{"slack", "email"},
+			false,
+		},
+		{
+			"names-and-inline",
+			`{
+  "name": "test-rule",
+  "index": "test-*",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "outputs": [{"type": "file", "config": {"file": "test.log"}}],
+  "output_names": ["email-weekly"]
+}`,
+			[]string{"file", "email"},
+			false,
+		},
+		{
+			"undefined-name",
+			`{
+  "name": "test-rule",
+  "index": "test-*",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "output_names": ["pagerduty-critical"]
+}`,
+			nil,
+			true,
+		},
+		{
+			"duplicate-name",
+			`{
+  "name": "test-rule",
+  "index": "test-*",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "output_names": ["slack-oncall", "slack-oncall"]
+}`,
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fname := filepath.Join(dir, "rule.json")
+			if err := ioutil.WriteFile(fname, []byte(tc.rule), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(fname)
+
+			rules, err := ParseRules(nil, outputs)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rules) != 1 {
+				t.Fatalf("expected 1 rule, got %d", len(rules))
+			}
+			var types []string
+			for _, output := range rules[0].Outputs {
+				types = append(types, output.Type)
+			}
+			if len(types) != len(tc.expected) {
+				t.Fatalf("expected outputs %v, got %v", tc.expected, types)
+			}
+			for i := range types {
+				if types[i] != tc.expected[i] {
+					t.Fatalf("expected outputs %v, got %v", tc.expected, types)
+				}
+			}
+		})
+	}
+}
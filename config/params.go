@@ -0,0 +1,127 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// queryParamValidators maps the Elasticsearch query-string
+// parameters which may be set by the 'query_params' field of a
+// rule configuration file to functions that validate their values.
+var queryParamValidators = map[string]func(string) error{
+	"request_cache": oneOf("true", "false"),
+	"search_type":   oneOf("query_then_fetch", "dfs_query_then_fetch"),
+	"preference":    validatePreference,
+	"routing":       validateRouting,
+}
+
+// parseQueryParams validates the raw 'query_params' field of a rule
+// configuration file and converts its values to strings.
+func parseQueryParams(raw map[string]interface{}) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	params := make(map[string]string, len(raw))
+	for key, v := range raw {
+		validate, ok := queryParamValidators[key]
+		if !ok {
+			return nil, xerrors.Errorf("unsupported query parameter %q in 'query_params' field (supported parameters: %s)",
+				key, strings.Join(supportedQueryParams(), ", "))
+		}
+
+		var value string
+		switch v := v.(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case bool, float64:
+			value = fmt.Sprintf("%v", v)
+		default:
+			return nil, xerrors.Errorf("query parameter %q in 'query_params' field must be a string", key)
+		}
+
+		if err := validate(value); err != nil {
+			return nil, xerrors.Errorf("invalid value of query parameter %q in 'query_params' field: %v", key, err)
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
+func supportedQueryParams() []string {
+	keys := make([]string, 0, len(queryParamValidators))
+	for key := range queryParamValidators {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return xerrors.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+// preferencePrefixes are the built-in values of the 'preference'
+// parameter. Custom values must not start with an underscore.
+var preferencePrefixes = []string{"_only_local", "_local", "_only_nodes:", "_prefer_nodes:", "_shards:"}
+
+func validatePreference(value string) error {
+	if value == "" {
+		return xerrors.New("must not be empty")
+	}
+	if !strings.HasPrefix(value, "_") {
+		return nil
+	}
+	for _, prefix := range preferencePrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return nil
+		}
+	}
+	return xerrors.Errorf("custom values must not start with '_'")
+}
+
+func validateRouting(value string) error {
+	for _, r := range strings.Split(value, ",") {
+		if strings.TrimSpace(r) == "" {
+			return xerrors.New("must be a comma-separated list of non-empty routing values")
+		}
+	}
+	return nil
+}
+
+// stickyPreference returns the value of the 'preference' parameter
+// used by rules with 'sticky_preference' set. It is derived from
+// the rule name so that every execution of the rule is routed to
+// the same shard copies, even across restarts and nodes.
+func stickyPreference(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name)) // nolint: errcheck
+	return fmt.Sprintf("go-elasticsearch-alerts-%016x", h.Sum64())
+}
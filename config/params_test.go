@@ -0,0 +1,142 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseQueryParams(t *testing.T) {
+	cases := []struct {
+		name     string
+		raw      map[string]interface{}
+		expected map[string]string
+		err      bool
+	}{
+		{
+			name:     "empty",
+			raw:      nil,
+			expected: nil,
+		},
+		{
+			name: "all",
+			raw: map[string]interface{}{
+				"request_cache": true,
+				"search_type":   "dfs_query_then_fetch",
+				"preference":    "my-rule",
+				"routing":       "user1,user2",
+			},
+			expected: map[string]string{
+				"request_cache": "true",
+				"search_type":   "dfs_query_then_fetch",
+				"preference":    "my-rule",
+				"routing":       "user1,user2",
+			},
+		},
+		{
+			name: "numeric-routing",
+			raw: map[string]interface{}{
+				"routing": json.Number("42"),
+			},
+			expected: map[string]string{
+				"routing": "42",
+			},
+		},
+		{
+			name: "built-in-preference",
+			raw: map[string]interface{}{
+				"preference": "_shards:2,3|_local",
+			},
+			expected: map[string]string{
+				"preference": "_shards:2,3|_local",
+			},
+		},
+		{
+			name: "unsupported-param",
+			raw: map[string]interface{}{
+				"size": "10",
+			},
+			err: true,
+		},
+		{
+			name: "bad-request-cache",
+			raw: map[string]interface{}{
+				"request_cache": "yes",
+			},
+			err: true,
+		},
+		{
+			name: "bad-search-type",
+			raw: map[string]interface{}{
+				"search_type": "scan",
+			},
+			err: true,
+		},
+		{
+			name: "bad-preference",
+			raw: map[string]interface{}{
+				"preference": "_primary",
+			},
+			err: true,
+		},
+		{
+			name: "empty-routing",
+			raw: map[string]interface{}{
+				"routing": "user1,",
+			},
+			err: true,
+		},
+		{
+			name: "non-string",
+			raw: map[string]interface{}{
+				"routing": []interface{}{"user1"},
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := parseQueryParams(tc.raw)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(params, tc.expected) {
+				t.Fatalf("unexpected query parameters (got %v, expected %v)", params, tc.expected)
+			}
+		})
+	}
+}
+
+func TestStickyPreference(t *testing.T) {
+	a := stickyPreference("Filebeat Errors")
+	if a != stickyPreference("Filebeat Errors") {
+		t.Fatal("stickyPreference() should return the same value for the same rule")
+	}
+	if a == stickyPreference("Filebeat Warnings") {
+		t.Fatal("stickyPreference() should return different values for different rules")
+	}
+	if err := validatePreference(a); err != nil {
+		t.Fatalf("stickyPreference() returned an invalid preference %q: %v", a, err)
+	}
+}
@@ -17,8 +17,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"golang.org/x/xerrors"
@@ -29,6 +34,54 @@ const (
 	envRulesDir       string = "GO_ELASTICSEARCH_ALERTS_RULES_DIR"
 	defaultConfigFile string = "/etc/go-elasticsearch-alerts/config.json"
 	defaultRulesDir   string = "/etc/go-elasticsearch-alerts/rules"
+
+	// EnvConfigDir is the environment variable naming a directory
+	// from which both the main configuration file and the rules are
+	// loaded (see the '-config-dir' flag). If set, it takes
+	// precedence over GO_ELASTICSEARCH_ALERTS_CONFIG_FILE and
+	// GO_ELASTICSEARCH_ALERTS_RULES_DIR
+	EnvConfigDir string = "GO_ELASTICSEARCH_ALERTS_CONFIG_DIR"
+
+	// baseConfigFile is the name of the main configuration file
+	// in the directory named by EnvConfigDir
+	baseConfigFile string = "config.json"
+
+	// heartbeatRuleName is the rule name of heartbeats (see
+	// alert.HeartbeatRule), which rules may not use so that their
+	// alerts cannot be mistaken for heartbeats
+	heartbeatRuleName string = "heartbeat"
+)
+
+// Accepted values of the 'first_run' field of a rule
+// configuration file.
+const (
+	// FirstRunAlert sends alerts on the first execution of a
+	// rule like on any other execution
+	FirstRunAlert = "alert"
+
+	// FirstRunSuppress silently drops any alert produced by the
+	// first execution of a rule after startup
+	FirstRunSuppress = "suppress"
+
+	// FirstRunLog logs, rather than sends, any alert produced by
+	// the first execution of a rule after startup
+	FirstRunLog = "log"
+)
+
+// Accepted values of the 'send_queue.policy' field of a rule
+// configuration file.
+const (
+	// SendQueueDropOldest discards the oldest alert waiting to be
+	// sent to make room for a new one when the send queue is full
+	SendQueueDropOldest = "drop-oldest"
+
+	// SendQueueDropNewest discards the new alert when the send
+	// queue is full
+	SendQueueDropNewest = "drop-newest"
+
+	// SendQueueBlock delays the next execution of the rule until
+	// there is room in the send queue for the new alert
+	SendQueueBlock = "block"
 )
 
 // OutputConfig maps to each element of 'output' field of
@@ -44,6 +97,50 @@ type OutputConfig struct {
 	// Please refer to the README for more detailed information
 	// on this field
 	Config map[string]interface{} `json:"config"`
+
+	// Enabled is whether alerts should be sent to this output.
+	// Disabling an output keeps its configuration but skips it
+	// when sending alerts. If not set, the output is enabled
+	Enabled *bool `json:"enabled"`
+
+	// Priority controls the order in which alerts are dispatched
+	// to the outputs of a rule. Outputs with a higher priority are
+	// attempted first; outputs of equal priority keep the order in
+	// which they appear in the rule configuration file
+	Priority int `json:"priority"`
+
+	// MatchRaw is an expression (see Expression) over the fields of
+	// the records of an alert which selects the records sent to this
+	// output. If empty, every record is sent to this output
+	MatchRaw string `json:"match"`
+
+	// Match is the parsed value of MatchRaw
+	Match *Expression `json:"-"`
+
+	// name is the name of the output if it is one of the named
+	// outputs of the main configuration file
+	name string
+}
+
+// matchIdentifiers are the values which the 'match' expression of
+// an output may reference.
+var matchIdentifiers = map[string]bool{
+	"filter": true,
+	"key":    true,
+	"count":  true,
+	"text":   true,
+}
+
+// Name returns the name of the output if it is one of the named
+// outputs of the main configuration file (see NamedOutputs), or an
+// empty string otherwise.
+func (o OutputConfig) Name() string {
+	return o.name
+}
+
+// IsEnabled returns false if the output was explicitly disabled.
+func (o OutputConfig) IsEnabled() bool {
+	return o.Enabled == nil || *o.Enabled
 }
 
 func (o OutputConfig) validate() error {
@@ -56,6 +153,27 @@ func (o OutputConfig) validate() error {
 	return nil
 }
 
+// parseMatch parses the 'match' expression of the output, if it
+// has one, and verifies that it only references the values of
+// records.
+func (o *OutputConfig) parseMatch() error {
+	if o.MatchRaw == "" {
+		return nil
+	}
+	expr, err := ParseExpression(o.MatchRaw)
+	if err != nil {
+		return xerrors.Errorf("error parsing 'match' field: %v", err)
+	}
+	for _, name := range expr.Identifiers() {
+		if !matchIdentifiers[name] {
+			return xerrors.Errorf("'match' field references unknown value %q (must be one of filter, key, count or text)",
+				name)
+		}
+	}
+	o.Match = expr
+	return nil
+}
+
 // ConsulConfig is used to configure the behavior of the
 // Consul network lock required for distributed operation.
 type ConsulConfig map[string]string
@@ -73,6 +191,137 @@ func (cc ConsulConfig) validate() error {
 	return nil
 }
 
+// CompositeConfig maps to the 'composite' field of a rule
+// configuration file.
+type CompositeConfig struct {
+	// Aggregation is the name of the top-level composite
+	// aggregation of the body of the rule whose pages of buckets
+	// should be collected
+	Aggregation string `json:"aggregation"`
+
+	// MaxBuckets is the maximum number of buckets collected across
+	// all pages. If zero, a default is used
+	MaxBuckets int `json:"max_buckets"`
+}
+
+func (cc *CompositeConfig) validate(body map[string]interface{}) error {
+	if cc.Aggregation == "" {
+		return errors.New("field 'composite.aggregation' must not be empty")
+	}
+	aggs, _ := body["aggregations"].(map[string]interface{})
+	if aggs == nil {
+		aggs, _ = body["aggs"].(map[string]interface{})
+	}
+	agg, _ := aggs[cc.Aggregation].(map[string]interface{})
+	if _, ok := agg["composite"].(map[string]interface{}); !ok {
+		return xerrors.Errorf("field 'composite.aggregation' must name a composite aggregation of 'body' (%q is not one)",
+			cc.Aggregation)
+	}
+	if cc.MaxBuckets < 0 {
+		return errors.New("field 'composite.max_buckets' must not be negative")
+	}
+	return nil
+}
+
+// SQLConfig maps to the 'sql' field of a rule configuration file.
+type SQLConfig struct {
+	// Query is the Elasticsearch SQL statement executed instead of
+	// the body of the rule
+	Query string `json:"query"`
+
+	// FetchSize is the number of rows of each page of results. If
+	// zero, a default is used
+	FetchSize int `json:"fetch_size"`
+
+	// MaxRows is the maximum number of rows collected across all
+	// pages. If zero, a default is used
+	MaxRows int `json:"max_rows"`
+}
+
+func (sc *SQLConfig) validate() error {
+	if strings.TrimSpace(sc.Query) == "" {
+		return errors.New("field 'sql.query' must not be empty")
+	}
+	if sc.FetchSize < 0 {
+		return errors.New("field 'sql.fetch_size' must not be negative")
+	}
+	if sc.MaxRows < 0 {
+		return errors.New("field 'sql.max_rows' must not be negative")
+	}
+	return nil
+}
+
+// SendQueueConfig maps to the 'send_queue' field of a rule
+// configuration file.
+type SendQueueConfig struct {
+	// Size is the maximum number of alerts of the rule waiting to
+	// be sent. If zero, a default is used
+	Size int `json:"size"`
+
+	// Policy is what to do with a new alert when the queue is full
+	// (one of SendQueueDropOldest, SendQueueDropNewest, or
+	// SendQueueBlock). If not set, SendQueueDropOldest is used
+	Policy string `json:"policy"`
+}
+
+func (sc *SendQueueConfig) validate() error {
+	if sc.Size < 0 {
+		return errors.New("field 'send_queue.size' must not be negative")
+	}
+	switch sc.Policy {
+	case "":
+		sc.Policy = SendQueueDropOldest
+	case SendQueueDropOldest, SendQueueDropNewest, SendQueueBlock:
+	default:
+		return xerrors.Errorf("field 'send_queue.policy' must either be '%s', '%s', or '%s'",
+			SendQueueDropOldest, SendQueueDropNewest, SendQueueBlock)
+	}
+	return nil
+}
+
+// SubQueryConfig maps to each element of the 'sub_queries'
+// field of a rule configuration file.
+type SubQueryConfig struct {
+	// Name is the title under which the records produced by
+	// this sub-query are reported
+	Name string `json:"name"`
+
+	// ElasticsearchIndex is the index that this sub-query
+	// should query. If empty, the index of the rule is used
+	ElasticsearchIndex string `json:"index"`
+
+	// ElasticsearchBodyRaw is the untyped query that this
+	// sub-query should send when querying Elasticsearch
+	ElasticsearchBodyRaw interface{} `json:"body"`
+
+	// ElasticsearchBody is the typed query that this sub-query
+	// will send when querying Elasticsearch
+	ElasticsearchBody map[string]interface{} `json:"-"`
+
+	// Filters are the fields on which the response to this
+	// sub-query should be grouped
+	Filters []string `json:"filters"`
+}
+
+func (sq *SubQueryConfig) validate() error {
+	if sq.Name == "" {
+		return errors.New("no 'name' field found")
+	}
+
+	if len(sq.Filters) < 1 {
+		return errors.New("at least one filter must be specified ('filters')")
+	}
+
+	body, err := parseBody(sq.ElasticsearchBodyRaw)
+	if err != nil {
+		return err
+	}
+	sq.ElasticsearchBody = body
+	sq.ElasticsearchBodyRaw = nil
+
+	return nil
+}
+
 // RuleConfig represents a rule configuration file.
 type RuleConfig struct {
 	// Name is the name of the rule. This value should come
@@ -102,6 +351,14 @@ type RuleConfig struct {
 	// rule configuration file
 	ElasticsearchBodyRaw interface{} `json:"body"`
 
+	// ElasticsearchBodyFile is the path to a file containing
+	// the query that this alert should send when querying
+	// Elasticsearch. Relative paths are resolved against the
+	// directory of the rule configuration file. This value
+	// should come from the 'body_file' field of the rule
+	// configuration file
+	ElasticsearchBodyFile string `json:"body_file"`
+
 	// ElasticsearchBody is the typed query that this alert
 	// will send when querying Elasticsearch
 	ElasticsearchBody map[string]interface{} `json:"-"`
@@ -112,20 +369,264 @@ type RuleConfig struct {
 	// configuration file
 	Filters []string `json:"filters"`
 
+	// ValueField is the path of a field of each bucket matched by
+	// the filters (e.g. "avg_latency.value") whose value is shown in
+	// place of the document count. This value should come from the
+	// 'value_field' field of the rule configuration file
+	ValueField string `json:"value_field"`
+
+	// ValueFormat is the fmt format (e.g. "%.2f ms") with which the
+	// numeric values of ValueField are rendered. This value should
+	// come from the 'value_format' field of the rule configuration
+	// file
+	ValueFormat string `json:"value_format"`
+
+	// ValueUnit is the unit (e.g. "bytes" or "ms") with which the
+	// numeric values of ValueField are humanized in place of
+	// ValueFormat. This value should come from the 'value_unit'
+	// field of the rule configuration file
+	ValueUnit string `json:"value_unit"`
+
+	// ValueThreshold, if not nil, is the value above which the
+	// numeric values of ValueField are flagged in alerts. This value
+	// should come from the 'value_threshold' field of the rule
+	// configuration file
+	ValueThreshold *float64 `json:"value_threshold"`
+
+	// CountOnly is whether the rule should use the _count API
+	// rather than the _search API when it does not need any
+	// documents or aggregations, only how many documents match.
+	// This value should come from the 'count_only' field of the
+	// rule configuration file
+	CountOnly bool `json:"count_only"`
+
+	// Composite configures the pagination of a composite
+	// aggregation of the query so that all of its buckets, rather
+	// than only the first page, are reported. This value should
+	// come from the 'composite' field of the rule configuration
+	// file
+	Composite *CompositeConfig `json:"composite"`
+
+	// SQL is an Elasticsearch SQL statement executed instead of the
+	// body of the rule, for those who find SQL easier to write than
+	// the query DSL. This value should come from the 'sql' field of
+	// the rule configuration file
+	SQL *SQLConfig `json:"sql"`
+
+	// MaintenanceWindows are the periods during which this rule
+	// does not send alerts, in addition to those of the main
+	// configuration file which apply to it. This value should come
+	// from the 'maintenance_windows' field of the rule configuration
+	// file
+	MaintenanceWindows []MaintenanceWindowConfig `json:"maintenance_windows"`
+
+	// SendQueue configures the queue of the alerts of this rule
+	// waiting to be sent, which lets the rule keep running on
+	// schedule while its outputs are slow. This value should come
+	// from the 'send_queue' field of the rule configuration file
+	SendQueue *SendQueueConfig `json:"send_queue"`
+
+	// SubQueries are additional queries executed each time the
+	// rule runs. Each filter of each sub-query produces its own
+	// record. This value should come from the 'sub_queries'
+	// field of the rule configuration file
+	SubQueries []SubQueryConfig `json:"sub_queries"`
+
 	// Outputs are the methods by which alerts should be sent
 	Outputs []OutputConfig `json:"outputs"`
 
+	// OutputNames are the names of the outputs of the main
+	// configuration file (see NamedOutputs) to which alerts should
+	// also be sent. This value should come from the 'output_names'
+	// field of the rule configuration file
+	OutputNames []string `json:"output_names"`
+
+	// RequireAllOutputs is whether an alert should be considered
+	// undelivered if any of the outputs fails to send it, rather
+	// than delivering it on a best-effort basis. This value should
+	// come from the 'require_all_outputs' field of the rule
+	// configuration file
+	RequireAllOutputs bool `json:"require_all_outputs"`
+
+	// OutputConcurrency is the maximum number of outputs to which an
+	// alert of the rule is sent at the same time. If zero, alerts are
+	// sent to one output at a time. This value should come from the
+	// 'output_concurrency' field of the rule configuration file
+	OutputConcurrency int `json:"output_concurrency"`
+
+	// Evaluations are independent sets of conditions evaluated
+	// against the response to the query, each sending alerts to its
+	// own outputs. Rules with evaluations set neither outputs nor
+	// conditions of their own. This value should come from the
+	// 'evaluations' field of the rule configuration file
+	Evaluations []EvaluationConfig `json:"evaluations"`
+
 	// Conditions are optional parameters that can be used to
 	// limit when alerts are triggered
-	Conditions []Condition
+	Conditions []Condition `json:"conditions"`
+
+	// Values map names to the paths of fields of the query
+	// response so that they can be referenced by the expression.
+	// This value should come from the 'values' field of the rule
+	// configuration file
+	Values map[string]string `json:"values"`
+
+	// ExpressionRaw is a boolean expression over the named values
+	// which must be true for alerts to be triggered. This value
+	// should come from the 'expression' field of the rule
+	// configuration file
+	ExpressionRaw string `json:"expression"`
+
+	// Expression is the parsed value of ExpressionRaw
+	Expression *Expression `json:"-"`
+
+	// AlertCooldownRaw is the minimum amount of time that must
+	// pass after an alert is sent before this rule may send
+	// another alert. This value should come from the
+	// 'alert_cooldown' field of the rule configuration file
+	AlertCooldownRaw string `json:"alert_cooldown"`
+
+	// AlertCooldown is the parsed value of AlertCooldownRaw
+	AlertCooldown time.Duration `json:"-"`
+
+	// IncludeAlertID is whether the ID of the firing of the rule is
+	// included in its notifications. This value should come from
+	// the 'include_alert_id' field of the rule configuration file
+	IncludeAlertID bool `json:"include_alert_id"`
+
+	// CollapseIdentical is whether the rule counts how many times
+	// in a row it has produced the same records so that the count
+	// is included in its notifications. This value should come from
+	// the 'collapse_identical' field of the rule configuration file
+	CollapseIdentical bool `json:"collapse_identical"`
+
+	// ReminderIntervalRaw is how often the alert is sent again
+	// despite the alert cooldown while the rule keeps firing on
+	// consecutive runs. This value should come from the
+	// 'reminder_interval' field of the rule configuration file
+	ReminderIntervalRaw string `json:"reminder_interval"`
+
+	// ReminderInterval is the parsed value of ReminderIntervalRaw
+	ReminderInterval time.Duration `json:"-"`
+
+	// MinSeverityRaw configures the minimum severity of the hits
+	// of the response which are kept. This value should come from
+	// the 'min_severity' field of the rule configuration file
+	MinSeverityRaw *SeverityConfig `json:"min_severity"`
+
+	// MinSeverity is the parsed value of MinSeverityRaw
+	MinSeverity *SeverityFilter `json:"-"`
+
+	// RedactRaw configures the fields and patterns masked in the
+	// alerts of the rule before they are sent. This value should
+	// come from the 'redact' field of the rule configuration file
+	RedactRaw *RedactionConfig `json:"redact"`
+
+	// Redaction is the parsed value of RedactRaw
+	Redaction *Redaction `json:"-"`
+
+	// DedupKeyField is the filter whose field keys (e.g. the
+	// hostnames of a terms aggregation) each get their own alert
+	// cooldown instead of sharing that of the rule, so that an
+	// alert is only sent for newly-affected keys. This value should
+	// come from the 'dedup_key_field' field of the rule
+	// configuration file
+	DedupKeyField string `json:"dedup_key_field"`
+
+	// DisableDedup is whether every firing of the rule alerts, even
+	// if identical to the last one, by ignoring the dedup key field
+	// of the rule and of its evaluations. An alert cooldown still
+	// applies, to the rule as a whole. This value should come from
+	// the 'disable_dedup' field of the rule configuration file
+	DisableDedup bool `json:"disable_dedup"`
+
+	// MinMatches is the number of documents which the records of an
+	// execution must match for an alert to be sent. Executions
+	// matching fewer documents are suppressed. This value should
+	// come from the 'min_matches' field of the rule configuration
+	// file
+	MinMatches int `json:"min_matches"`
+
+	// SlowQueryThresholdRaw is the query duration above which a
+	// warning will be logged. This value should come from the
+	// 'slow_query_threshold' field of the rule configuration file
+	SlowQueryThresholdRaw string `json:"slow_query_threshold"`
+
+	// SlowQueryThreshold is the parsed value of SlowQueryThresholdRaw
+	SlowQueryThreshold time.Duration `json:"-"`
+
+	// QueryTimeoutRaw is the maximum amount of time a query may
+	// take before it is canceled. This value should come from the
+	// 'query_timeout' field of the rule configuration file
+	QueryTimeoutRaw string `json:"query_timeout"`
+
+	// QueryTimeout is the parsed value of QueryTimeoutRaw
+	QueryTimeout time.Duration `json:"-"`
+
+	// Async is whether the query is submitted to the _async_search
+	// API and polled until it completes, for aggregations which take
+	// longer than a synchronous search may. This value should come
+	// from the 'async' field of the rule configuration file
+	Async bool `json:"async"`
+
+	// AsyncMaxWaitRaw is the maximum amount of time to wait for an
+	// asynchronous query to complete. This value should come from
+	// the 'async_max_wait' field of the rule configuration file
+	AsyncMaxWaitRaw string `json:"async_max_wait"`
+
+	// AsyncMaxWait is the parsed value of AsyncMaxWaitRaw
+	AsyncMaxWait time.Duration `json:"-"`
+
+	// QueryDelayRaw is how far back the time window of the query is
+	// shifted to account for ingestion lag. This value should come
+	// from the 'query_delay' field of the rule configuration file
+	QueryDelayRaw string `json:"query_delay"`
+
+	// QueryDelay is the parsed value of QueryDelayRaw
+	QueryDelay time.Duration `json:"-"`
+
+	// MaxRuntimeRaw is how long a run of the rule may take, counting
+	// from when it was due, before the rule is considered stuck and
+	// restarted. This value should come from the 'max_runtime' field
+	// of the rule configuration file
+	MaxRuntimeRaw string `json:"max_runtime"`
+
+	// MaxRuntime is the parsed value of MaxRuntimeRaw
+	MaxRuntime time.Duration `json:"-"`
+
+	// QueryParamsRaw are additional query-string parameters sent
+	// with each query (e.g. 'request_cache'). This value should
+	// come from the 'query_params' field of the rule configuration
+	// file
+	QueryParamsRaw map[string]interface{} `json:"query_params"`
+
+	// QueryParams is the validated value of QueryParamsRaw
+	QueryParams map[string]string `json:"-"`
+
+	// StickyPreference is whether the 'preference' query-string
+	// parameter should be set to a value derived from the rule name
+	// so that repeated queries are served by the same shard copies.
+	// This value should come from the 'sticky_preference' field of
+	// the rule configuration file
+	StickyPreference bool `json:"sticky_preference"`
+
+	// FirstRun is what to do with the alert produced by the first
+	// execution of this rule after startup (one of FirstRunAlert,
+	// FirstRunSuppress, or FirstRunLog). This value should come
+	// from the 'first_run' field of the rule configuration file
+	FirstRun string `json:"first_run"`
 }
 
 func (rule *RuleConfig) validate() error { // nolint: gocyclo
 	if rule.Name == "" {
 		return errors.New("no 'name' field found")
 	}
+	if rule.Name == heartbeatRuleName {
+		return xerrors.Errorf("rule name %q is reserved for heartbeats", rule.Name)
+	}
 
-	if rule.ElasticsearchIndex == "" {
+	// The index of an SQL query is given by its FROM clause
+	if rule.ElasticsearchIndex == "" && rule.SQL == nil {
 		return errors.New("no 'index' field found")
 	}
 
@@ -137,17 +638,108 @@ func (rule *RuleConfig) validate() error { // nolint: gocyclo
 		rule.Filters = []string{}
 	}
 
-	if rule.Outputs == nil {
-		return errors.New("no 'output' field found")
+	if rule.ValueFormat != "" {
+		if rule.ValueField == "" {
+			return xerrors.Errorf("'value_field' field of rule %s must be set along with 'value_format'", rule.Name)
+		}
+		if strings.Contains(fmt.Sprintf(rule.ValueFormat, 1.5), "%!") {
+			return xerrors.Errorf("'value_format' field of rule %s must format a single number", rule.Name)
+		}
 	}
 
-	if len(rule.Outputs) < 1 {
-		return errors.New("at least one output must be specified ('outputs')")
+	if rule.ValueUnit != "" || rule.ValueThreshold != nil {
+		if rule.ValueField == "" {
+			return xerrors.Errorf("'value_field' field of rule %s must be set along with 'value_unit' or "+
+				"'value_threshold'", rule.Name)
+		}
+		if rule.ValueUnit != "" && rule.ValueFormat != "" {
+			return xerrors.Errorf("'value_unit' field of rule %s must not be set along with 'value_format'", rule.Name)
+		}
 	}
 
-	for i, output := range rule.Outputs {
-		if err := output.validate(); err != nil {
-			return xerrors.Errorf("error in output %d of rule %s: %v", i+1, rule.Name, err)
+	// The outputs of rules with evaluations are those of the
+	// evaluations
+	if len(rule.Evaluations) == 0 {
+		if rule.Outputs == nil {
+			return errors.New("no 'output' field found")
+		}
+
+		if len(rule.Outputs) < 1 {
+			return errors.New("at least one output must be specified ('outputs')")
+		}
+	}
+
+	if err := validateOutputs(rule.Outputs, "rule "+rule.Name); err != nil {
+		return err
+	}
+
+	if rule.MinMatches < 0 {
+		return xerrors.Errorf("'min_matches' field of rule %s must not be negative", rule.Name)
+	}
+	if rule.OutputConcurrency < 0 {
+		return xerrors.Errorf("'output_concurrency' field of rule %s must not be negative", rule.Name)
+	}
+
+	switch rule.FirstRun {
+	case "":
+		rule.FirstRun = FirstRunAlert
+	case FirstRunAlert, FirstRunSuppress, FirstRunLog:
+	default:
+		return xerrors.Errorf("'first_run' field must either be '%s', '%s', or '%s'",
+			FirstRunAlert, FirstRunSuppress, FirstRunLog)
+	}
+
+	if rule.Composite != nil {
+		if rule.CountOnly {
+			return xerrors.Errorf("'composite' field of rule %s must not be set along with 'count_only'", rule.Name)
+		}
+		if err := rule.Composite.validate(rule.ElasticsearchBody); err != nil {
+			return xerrors.Errorf("error in rule %s: %v", rule.Name, err)
+		}
+	}
+
+	if rule.SQL != nil {
+		if rule.ElasticsearchBody != nil {
+			return xerrors.Errorf("'sql' field of rule %s must not be set along with 'body' or 'body_file'", rule.Name)
+		}
+		if rule.CountOnly || rule.Composite != nil {
+			return xerrors.Errorf("'sql' field of rule %s must not be set along with 'count_only' or 'composite'",
+				rule.Name)
+		}
+		if err := rule.SQL.validate(); err != nil {
+			return xerrors.Errorf("error in rule %s: %v", rule.Name, err)
+		}
+	}
+
+	for i := range rule.MaintenanceWindows {
+		w := &rule.MaintenanceWindows[i]
+		if len(w.Rules) > 0 {
+			return xerrors.Errorf(
+				"error in maintenance window %d of rule %s: 'rules' field is only allowed in the main configuration file",
+				i+1, rule.Name,
+			)
+		}
+		if err := w.validate(); err != nil {
+			return xerrors.Errorf("error in maintenance window %d of rule %s: %v", i+1, rule.Name, err)
+		}
+	}
+
+	if rule.SendQueue != nil {
+		if err := rule.SendQueue.validate(); err != nil {
+			return xerrors.Errorf("error in rule %s: %v", rule.Name, err)
+		}
+	}
+
+	for i := range rule.SubQueries {
+		sq := &rule.SubQueries[i]
+		if err := sq.validate(); err != nil {
+			return xerrors.Errorf("error in sub-query %d of rule %s: %v", i+1, rule.Name, err)
+		}
+		if sq.ElasticsearchIndex == "" {
+			if rule.ElasticsearchIndex == "" {
+				return xerrors.Errorf("error in sub-query %d of rule %s: no 'index' field found", i+1, rule.Name)
+			}
+			sq.ElasticsearchIndex = rule.ElasticsearchIndex
 		}
 	}
 
@@ -156,10 +748,219 @@ func (rule *RuleConfig) validate() error { // nolint: gocyclo
 			return xerrors.Errorf("error in condition %d of rule %s: %v", i+1, rule.Name, err)
 		}
 	}
+	if err := rule.validateCountPaths(rule.Conditions, rule.Values, "rule "+rule.Name); err != nil {
+		return err
+	}
+
+	var err error
+	if rule.Expression, err = parseRuleExpression(rule.ExpressionRaw, rule.Values, "rule "+rule.Name); err != nil {
+		return err
+	}
+
+	if rule.AlertCooldown, err = parseDuration("alert_cooldown", rule.AlertCooldownRaw); err != nil {
+		return err
+	}
+
+	if rule.ReminderInterval, err = parseDuration("reminder_interval", rule.ReminderIntervalRaw); err != nil {
+		return err
+	}
+	if rule.ReminderInterval > 0 && rule.ReminderInterval >= rule.AlertCooldown {
+		return xerrors.Errorf("'reminder_interval' field of rule %s must be shorter than 'alert_cooldown'", rule.Name)
+	}
+
+	if rule.MinSeverityRaw != nil {
+		if rule.MinSeverity, err = rule.MinSeverityRaw.validate(); err != nil {
+			return xerrors.Errorf("error in rule %s: %v", rule.Name, err)
+		}
+	}
+
+	if rule.RedactRaw != nil {
+		if rule.Redaction, err = rule.RedactRaw.validate(); err != nil {
+			return xerrors.Errorf("error in rule %s: %v", rule.Name, err)
+		}
+	}
+
+	if err = rule.validateDedupKeyField(rule.DedupKeyField, "rule "+rule.Name); err != nil {
+		return err
+	}
+
+	if len(rule.Evaluations) > 0 {
+		if err = rule.validateEvaluations(); err != nil {
+			return err
+		}
+	}
+
+	if rule.SlowQueryThreshold, err = parseDuration("slow_query_threshold", rule.SlowQueryThresholdRaw); err != nil {
+		return err
+	}
+
+	if rule.QueryTimeout, err = parseDuration("query_timeout", rule.QueryTimeoutRaw); err != nil {
+		return err
+	}
+
+	if rule.QueryDelay, err = parseDuration("query_delay", rule.QueryDelayRaw); err != nil {
+		return err
+	}
+
+	if rule.AsyncMaxWait, err = parseDuration("async_max_wait", rule.AsyncMaxWaitRaw); err != nil {
+		return err
+	}
+	if rule.AsyncMaxWait > 0 && !rule.Async {
+		return xerrors.Errorf("'async_max_wait' field of rule %s must be set along with 'async'", rule.Name)
+	}
+	if rule.Async && (rule.CountOnly || rule.Composite != nil || rule.SQL != nil) {
+		return xerrors.Errorf("'async' field of rule %s must not be set along with 'count_only', 'composite' or 'sql'",
+			rule.Name)
+	}
+	if rule.QueryDelay > 0 && rule.SQL != nil {
+		return xerrors.Errorf("'query_delay' field of rule %s is not supported along with 'sql'", rule.Name)
+	}
+
+	if rule.MaxRuntime, err = parseDuration("max_runtime", rule.MaxRuntimeRaw); err != nil {
+		return err
+	}
+	if rule.MaxRuntime > 0 && rule.QueryTimeout > 0 && rule.MaxRuntime <= rule.QueryTimeout {
+		return xerrors.Errorf("'max_runtime' field of rule %s must be longer than its 'query_timeout'", rule.Name)
+	}
+
+	if rule.QueryParams, err = parseQueryParams(rule.QueryParamsRaw); err != nil {
+		return xerrors.Errorf("error in rule %s: %v", rule.Name, err)
+	}
+
+	if rule.StickyPreference {
+		if _, ok := rule.QueryParams["preference"]; ok {
+			return xerrors.Errorf("'sticky_preference' field of rule %s must not be set along with 'query_params.preference'",
+				rule.Name)
+		}
+		if rule.QueryParams == nil {
+			rule.QueryParams = make(map[string]string)
+		}
+		rule.QueryParams["preference"] = stickyPreference(rule.Name)
+	}
 
 	return nil
 }
 
+// validateOutputs validates the outputs of the owner (a rule or one
+// of its evaluations) and sorts them by priority, highest first.
+func validateOutputs(outputs []OutputConfig, owner string) error {
+	for i := range outputs {
+		output := &outputs[i]
+		if err := output.validate(); err != nil {
+			return xerrors.Errorf("error in output %d of %s: %v", i+1, owner, err)
+		}
+		if err := output.parseMatch(); err != nil {
+			return xerrors.Errorf("error in output %d of %s: %v", i+1, owner, err)
+		}
+	}
+	sort.SliceStable(outputs, func(i, j int) bool {
+		return outputs[i].Priority > outputs[j].Priority
+	})
+	return nil
+}
+
+// parseRuleExpression parses the 'expression' field of the owner (a
+// rule or one of its evaluations), whose identifiers must each be
+// defined in values. It returns nil if the expression is empty.
+func parseRuleExpression(raw string, values map[string]string, owner string) (*Expression, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	expr, err := ParseExpression(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing 'expression' field of %s: %v", owner, err)
+	}
+	for _, name := range expr.Identifiers() {
+		if _, ok := values[name]; !ok {
+			return nil, xerrors.Errorf("'expression' field of %s references %q, which is not defined in 'values'",
+				owner, name)
+		}
+	}
+	return expr, nil
+}
+
+// countsOnly returns whether the rule queries the _count API, i.e.
+// whether 'count_only' is set and not ignored (see
+// query.QueryHandlerConfig.CountOnly).
+func (rule *RuleConfig) countsOnly() bool {
+	if !rule.CountOnly || len(rule.Filters) > 0 || rule.BodyField != "" {
+		return false
+	}
+	_, ok := rule.ElasticsearchBody["runtime_mappings"]
+	return !ok
+}
+
+// validateCountPaths validates that the conditions and values of the
+// owner (the rule or one of its evaluations) do not refer to the hits
+// of the response if the rule queries the _count API, whose response
+// has none.
+func (rule *RuleConfig) validateCountPaths(conditions []Condition, values map[string]string, owner string) error {
+	if !rule.countsOnly() {
+		return nil
+	}
+	isHits := func(path string) bool {
+		return path == "hits" || strings.HasPrefix(path, "hits.")
+	}
+	for i, condition := range conditions {
+		if isHits(condition.field()) {
+			return xerrors.Errorf("condition %d of %s must not refer to 'hits' since 'count_only' is set "+
+				"(use the 'count' field instead)", i+1, owner)
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if isHits(values[name]) {
+			return xerrors.Errorf("value %q of %s must not refer to 'hits' since 'count_only' is set "+
+				"(use the 'count' field instead)", name, owner)
+		}
+	}
+	return nil
+}
+
+// validateDedupKeyField validates the 'dedup_key_field' field of the
+// owner (the rule or one of its evaluations), which requires the
+// alert cooldown of the rule and must be one of its filters. The
+// reminder interval of the rule does not apply to per-key cooldowns,
+// so it must not be set along with the field unless dedup is disabled.
+func (rule *RuleConfig) validateDedupKeyField(field, owner string) error {
+	if field == "" {
+		return nil
+	}
+	if rule.AlertCooldown <= 0 {
+		return xerrors.Errorf("'alert_cooldown' field of %s must be set along with 'dedup_key_field'", owner)
+	}
+	if rule.ReminderInterval > 0 && !rule.DisableDedup {
+		return xerrors.Errorf("'reminder_interval' field of rule %s must not be set along with the "+
+			"'dedup_key_field' of %s", rule.Name, owner)
+	}
+	for _, filter := range rule.Filters {
+		if filter == field {
+			return nil
+		}
+	}
+	return xerrors.Errorf("'dedup_key_field' field of %s must be one of its 'filters'", owner)
+}
+
+// parseDuration parses the value of a duration field of a rule
+// configuration file. An empty value yields a zero duration.
+func parseDuration(field, raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, xerrors.Errorf("error parsing '%s' field: %v", field, err)
+	}
+	if d < 0 {
+		return 0, xerrors.Errorf("'%s' field must not be negative", field)
+	}
+	return d, nil
+}
+
 // ServerConfig represents the 'elasticsearch.server'
 // field of the main configuration file.
 type ServerConfig struct {
@@ -167,6 +968,25 @@ type ServerConfig struct {
 	// This value should come from the 'elasticsearch.server.url'
 	// field of the main configuration file
 	ElasticsearchURL string `json:"url"`
+
+	// PathPrefix is the path under which the Elasticsearch API is
+	// served, e.g. by a proxy in front of the cluster. It is joined
+	// to ElasticsearchURL (see BaseURL). This value should come from
+	// the 'elasticsearch.server.path_prefix' field of the main
+	// configuration file
+	PathPrefix string `json:"path_prefix"`
+}
+
+// BaseURL returns the URL which the paths of the Elasticsearch API
+// (e.g. "/<index>/_search") are appended to, i.e. ElasticsearchURL
+// followed by PathPrefix, without a trailing slash and with exactly
+// one slash between them.
+func (s *ServerConfig) BaseURL() string {
+	base := strings.TrimRight(s.ElasticsearchURL, "/")
+	if prefix := strings.Trim(s.PathPrefix, "/"); prefix != "" {
+		base += "/" + prefix
+	}
+	return base
 }
 
 // ESConfig represents the 'elasticsearch' field of the
@@ -179,6 +999,22 @@ type ESConfig struct {
 	// Client represents the 'elasticsearch.client' field
 	// of the main configuration file
 	Client *ClientConfig `json:"client"`
+
+	// Vault represents the 'elasticsearch.vault' field of the
+	// main configuration file. If set, the credentials used to
+	// authenticate to Elasticsearch are read from Vault
+	Vault *VaultConfig `json:"vault"`
+
+	// MSearch represents the 'elasticsearch.msearch' field of the
+	// main configuration file. If enabled, the queries of rules
+	// which are due at the same time are sent together in a single
+	// request to the _msearch API
+	MSearch *MSearchConfig `json:"msearch"`
+
+	// Retry represents the 'elasticsearch.retry' field of the main
+	// configuration file. If set, queries which fail because of a
+	// transient error are retried
+	Retry *RetryConfig `json:"retry"`
 }
 
 func (es *ESConfig) validate() error {
@@ -188,6 +1024,343 @@ func (es *ESConfig) validate() error {
 	if es.Server.ElasticsearchURL == "" {
 		return errors.New("no 'elasticsearch.server.url' field found")
 	}
+	if strings.ContainsAny(es.Server.PathPrefix, "?#") {
+		return errors.New("'elasticsearch.server.path_prefix' field must be a path without a query or fragment")
+	}
+	if es.Vault != nil {
+		if err := es.Vault.validate(); err != nil {
+			return err
+		}
+	}
+	if es.MSearch != nil {
+		if err := es.MSearch.validate(); err != nil {
+			return err
+		}
+	}
+	if es.Retry != nil {
+		return es.Retry.validate()
+	}
+	return nil
+}
+
+// MSearchConfig configures the batching of the queries of
+// several rules into a single request to the _msearch API.
+type MSearchConfig struct {
+	// Enabled is whether queries are batched. This value should
+	// come from the 'elasticsearch.msearch.enabled' field of the
+	// main configuration file
+	Enabled bool `json:"enabled"`
+
+	// WindowRaw is how long a query waits for the queries of other
+	// rules to join its batch. A batch is sent sooner if every rule
+	// which can be batched is waiting. This value should come from
+	// the 'elasticsearch.msearch.window' field of the main
+	// configuration file
+	WindowRaw string `json:"window"`
+
+	// Window is the parsed value of WindowRaw
+	Window time.Duration `json:"-"`
+
+	// Compress is whether the body of each _msearch request is
+	// gzip-compressed. This value should come from the
+	// 'elasticsearch.msearch.compress' field of the main
+	// configuration file
+	Compress bool `json:"compress"`
+}
+
+func (mc *MSearchConfig) validate() error {
+	var err error
+	mc.Window, err = parseDuration("elasticsearch.msearch.window", mc.WindowRaw)
+	return err
+}
+
+// RetryConfig configures the retries of queries which fail because
+// of a connection error or a 429 or 5xx response.
+type RetryConfig struct {
+	// MaxRetries is the maximum number of times a query is retried.
+	// This value should come from the 'elasticsearch.retry.max_retries'
+	// field of the main configuration file
+	MaxRetries int `json:"max_retries"`
+
+	// InitialBackoffRaw is the backoff before the first retry, which
+	// doubles with every retry. This value should come from the
+	// 'elasticsearch.retry.initial_backoff' field of the main
+	// configuration file
+	InitialBackoffRaw string `json:"initial_backoff"`
+
+	// InitialBackoff is the parsed value of InitialBackoffRaw
+	InitialBackoff time.Duration `json:"-"`
+
+	// MaxBackoffRaw is the maximum backoff between retries. This
+	// value should come from the 'elasticsearch.retry.max_backoff'
+	// field of the main configuration file
+	MaxBackoffRaw string `json:"max_backoff"`
+
+	// MaxBackoff is the parsed value of MaxBackoffRaw
+	MaxBackoff time.Duration `json:"-"`
+}
+
+const (
+	defaultRetryInitialBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff     = 10 * time.Second
+)
+
+func (rc *RetryConfig) validate() error {
+	if rc.MaxRetries < 0 {
+		return errors.New("'elasticsearch.retry.max_retries' field must not be negative")
+	}
+	var err error
+	if rc.InitialBackoff, err = parseDuration("elasticsearch.retry.initial_backoff", rc.InitialBackoffRaw); err != nil {
+		return err
+	}
+	if rc.MaxBackoff, err = parseDuration("elasticsearch.retry.max_backoff", rc.MaxBackoffRaw); err != nil {
+		return err
+	}
+	if rc.InitialBackoff == 0 {
+		rc.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if rc.MaxBackoff == 0 {
+		rc.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if rc.MaxBackoff < rc.InitialBackoff {
+		return errors.New("'elasticsearch.retry.max_backoff' field must not be shorter than 'initial_backoff'")
+	}
+	return nil
+}
+
+// StateConfig represents the 'state' field of the main
+// configuration file. It configures the upkeep of the state
+// indices.
+type StateConfig struct {
+	// RetentionRaw is how long state documents are kept before
+	// they are deleted. The most recent state document of each rule
+	// and those written during an active alert cooldown are always
+	// kept. If empty, state documents are never deleted. This value
+	// should come from the 'state.retention' field of the main
+	// configuration file
+	RetentionRaw string `json:"retention"`
+
+	// Retention is the parsed value of RetentionRaw
+	Retention time.Duration `json:"-"`
+
+	// CleanupIntervalRaw is how often expired state documents are
+	// deleted. This value should come from the
+	// 'state.cleanup_interval' field of the main configuration file
+	CleanupIntervalRaw string `json:"cleanup_interval"`
+
+	// CleanupInterval is the parsed value of CleanupIntervalRaw
+	CleanupInterval time.Duration `json:"-"`
+
+	// ILMPolicy is the name of an index lifecycle management
+	// policy applied to the state indices. This value should come
+	// from the 'state.ilm_policy' field of the main configuration
+	// file
+	ILMPolicy string `json:"ilm_policy"`
+}
+
+func (sc *StateConfig) validate() error {
+	var err error
+	if sc.Retention, err = parseDuration("state.retention", sc.RetentionRaw); err != nil {
+		return err
+	}
+	if sc.CleanupInterval, err = parseDuration("state.cleanup_interval", sc.CleanupIntervalRaw); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SpoolConfig represents the 'spool' field of the main
+// configuration file. It configures the directory to which
+// alerts which could not be sent are written for retry.
+type SpoolConfig struct {
+	// Dir is the directory of the spool. This value should come
+	// from the 'spool.dir' field of the main configuration file
+	Dir string `json:"dir"`
+
+	// MaxAgeRaw is how long a spooled alert is retried before it
+	// is given up on. This value should come from the
+	// 'spool.max_age' field of the main configuration file
+	MaxAgeRaw string `json:"max_age"`
+
+	// MaxAge is the parsed value of MaxAgeRaw
+	MaxAge time.Duration `json:"-"`
+
+	// RetryIntervalRaw is how often spooled alerts are retried.
+	// This value should come from the 'spool.retry_interval' field
+	// of the main configuration file
+	RetryIntervalRaw string `json:"retry_interval"`
+
+	// RetryInterval is the parsed value of RetryIntervalRaw
+	RetryInterval time.Duration `json:"-"`
+}
+
+func (sc *SpoolConfig) validate() error {
+	if sc.Dir == "" {
+		return errors.New("no 'spool.dir' field found")
+	}
+	var err error
+	if sc.MaxAge, err = parseDuration("spool.max_age", sc.MaxAgeRaw); err != nil {
+		return err
+	}
+	if sc.RetryInterval, err = parseDuration("spool.retry_interval", sc.RetryIntervalRaw); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RetryQueueConfig represents the 'retry_queue' field of the main
+// configuration file. It configures the retrying of alerts which
+// could not be sent from a queue kept in Elasticsearch.
+type RetryQueueConfig struct {
+	// MaxAttempts is how many times a queued alert is retried
+	// before it is given up on. If zero, a default is used. This
+	// value should come from the 'retry_queue.max_attempts' field
+	// of the main configuration file
+	MaxAttempts int `json:"max_attempts"`
+
+	// RetryIntervalRaw is how often the queue is checked for
+	// alerts due to be retried. This value should come from the
+	// 'retry_queue.retry_interval' field of the main configuration
+	// file
+	RetryIntervalRaw string `json:"retry_interval"`
+
+	// RetryInterval is the parsed value of RetryIntervalRaw
+	RetryInterval time.Duration `json:"-"`
+}
+
+func (rc *RetryQueueConfig) validate() error {
+	if rc.MaxAttempts < 0 {
+		return errors.New("field 'retry_queue.max_attempts' must not be negative")
+	}
+	var err error
+	if rc.RetryInterval, err = parseDuration("retry_queue.retry_interval", rc.RetryIntervalRaw); err != nil {
+		return err
+	}
+	return nil
+}
+
+const (
+	// LockBackendConsul elects the leader with a Consul lock
+	LockBackendConsul = "consul"
+
+	// LockBackendElasticsearch elects the leader with a lease kept
+	// in a lock document in Elasticsearch
+	LockBackendElasticsearch = "elasticsearch"
+)
+
+// defaultLockTTL is how long the lease of the leader lasts if
+// 'lock.ttl' is not set.
+const defaultLockTTL = 30 * time.Second
+
+// LockConfig represents the 'lock' field of the main configuration
+// file. It configures how the leader is elected when running in a
+// distributed fashion.
+type LockConfig struct {
+	// Backend is how the leader is elected, either "consul" (the
+	// default) or "elasticsearch". This value should come from the
+	// 'lock.backend' field of the main configuration file
+	Backend string `json:"backend"`
+
+	// TTLRaw is how long the lease of the leader lasts unless it is
+	// renewed when the backend is "elasticsearch". This value
+	// should come from the 'lock.ttl' field of the main
+	// configuration file
+	TTLRaw string `json:"ttl"`
+
+	// TTL is the parsed value of TTLRaw
+	TTL time.Duration `json:"-"`
+
+	// Holder identifies this process in the lock document when the
+	// backend is "elasticsearch". If empty, the host name and
+	// process ID are used. This value should come from the
+	// 'lock.holder' field of the main configuration file
+	Holder string `json:"holder"`
+}
+
+func (lc *LockConfig) validate() error {
+	switch lc.Backend {
+	case "":
+		lc.Backend = LockBackendConsul
+	case LockBackendConsul, LockBackendElasticsearch:
+	default:
+		return xerrors.Errorf("'lock.backend' field must either be '%s' or '%s'",
+			LockBackendConsul, LockBackendElasticsearch)
+	}
+	var err error
+	if lc.TTL, err = parseDuration("lock.ttl", lc.TTLRaw); err != nil {
+		return err
+	}
+	if lc.TTLRaw != "" && lc.TTL == 0 {
+		return errors.New("'lock.ttl' field must be positive")
+	}
+	if lc.TTL == 0 {
+		lc.TTL = defaultLockTTL
+	}
+	return nil
+}
+
+// defaultAPIAddress is the address on which the API listens if
+// 'api.address' is not set.
+const defaultAPIAddress = "127.0.0.1:9400"
+
+// APIConfig represents the 'api' field of the main configuration
+// file. It configures the read-only HTTP API which reports the
+// configured rules and their status.
+type APIConfig struct {
+	// Enabled is whether the API is served. This value should come
+	// from the 'api.enabled' field of the main configuration file
+	Enabled bool `json:"enabled"`
+
+	// Address is the address on which the API listens. This value
+	// should come from the 'api.address' field of the main
+	// configuration file
+	Address string `json:"address"`
+
+	// Token is the bearer token with which requests to the API
+	// must be authenticated. This value should come from the
+	// 'api.token' field of the main configuration file
+	Token string `json:"token"`
+
+	// TLSCert and TLSKey are the paths to the PEM-encoded
+	// certificate and private key with which the API is served over
+	// HTTPS. These values should come from the 'api.tls_cert' and
+	// 'api.tls_key' fields of the main configuration file
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// ClientCA is the path to a PEM-encoded CA certificate file. If
+	// set, clients must present a certificate signed by one of its
+	// CAs. This value should come from the 'api.client_ca' field of
+	// the main configuration file
+	ClientCA string `json:"client_ca"`
+
+	// AllowRun is whether rules may be executed on demand with
+	// POST /rules/{name}/run. This value should come from the
+	// 'api.allow_run' field of the main configuration file
+	AllowRun bool `json:"allow_run"`
+
+	// AllowPause is whether rules may be paused and resumed with
+	// POST /rules/{name}/pause and /resume. This value should come
+	// from the 'api.allow_pause' field of the main configuration file
+	AllowPause bool `json:"allow_pause"`
+}
+
+func (ac *APIConfig) validate() error {
+	if !ac.Enabled {
+		return nil
+	}
+	if ac.Address == "" {
+		ac.Address = defaultAPIAddress
+	}
+	if ac.Token == "" && ac.ClientCA == "" {
+		return errors.New("one of 'api.token' and 'api.client_ca' must be set when 'api.enabled' is true")
+	}
+	if (ac.TLSCert == "") != (ac.TLSKey == "") {
+		return errors.New("fields 'api.tls_cert' and 'api.tls_key' must be set together")
+	}
+	if ac.ClientCA != "" && ac.TLSCert == "" {
+		return errors.New("fields 'api.tls_cert' and 'api.tls_key' must be set when 'api.client_ca' is set")
+	}
 	return nil
 }
 
@@ -209,6 +1382,99 @@ type Config struct {
 	// 'consul' field of the main configuration file
 	Consul ConsulConfig `json:"consul"`
 
+	// Lock configures how the leader is elected when this process
+	// is run in a distributed fashion. If not set, a Consul lock is
+	// used. This value should come from the 'lock' field of the
+	// main configuration file
+	Lock *LockConfig `json:"lock"`
+
+	// HTTP is used to tune the connection pool of the HTTP
+	// clients used to communicate with Elasticsearch and the
+	// outputs. This value should come from the 'http' field
+	// of the main configuration file
+	HTTP *TransportConfig `json:"http"`
+
+	// State configures the upkeep of the state indices. This value
+	// should come from the 'state' field of the main configuration
+	// file
+	State *StateConfig `json:"state"`
+
+	// Spool configures the directory to which alerts which could
+	// not be sent are written so that they are retried later. This
+	// value should come from the 'spool' field of the main
+	// configuration file
+	Spool *SpoolConfig `json:"spool"`
+
+	// RetryQueue configures the queue in Elasticsearch from which
+	// alerts which could not be sent are retried, by any of the
+	// processes sharing the Elasticsearch instance. This value
+	// should come from the 'retry_queue' field of the main
+	// configuration file
+	RetryQueue *RetryQueueConfig `json:"retry_queue"`
+
+	// API configures the read-only HTTP API which reports the
+	// configured rules and their status. This value should come
+	// from the 'api' field of the main configuration file
+	API *APIConfig `json:"api"`
+
+	// MaintenanceWindows are the periods during which rules do not
+	// send alerts. Each applies to the rules named by its 'rules'
+	// field, or to every rule. This value should come from the
+	// 'maintenance_windows' field of the main configuration file
+	MaintenanceWindows []MaintenanceWindowConfig `json:"maintenance_windows"`
+
+	// AllowedIndexPatterns are the patterns (e.g. "logs-*") of the
+	// indices the rules may query. If set, a rule whose index is not
+	// matched by any of them is rejected. This value should come
+	// from the 'allowed_index_patterns' field of the main
+	// configuration file
+	AllowedIndexPatterns []string `json:"allowed_index_patterns"`
+
+	// DeniedIndexPatterns are the patterns (e.g. ".security*") of
+	// the indices the rules may not query. A rule whose index could
+	// match any of them is rejected. This value should come from the
+	// 'denied_index_patterns' field of the main configuration file
+	DeniedIndexPatterns []string `json:"denied_index_patterns"`
+
+	// StartupCheck is whether the connectivity of Elasticsearch and
+	// of the outputs of each rule is checked at startup. Failed
+	// checks are logged as warnings. This value should come from
+	// the 'startup_check' field of the main configuration file
+	StartupCheck bool `json:"startup_check"`
+
+	// StrictStartup is like StartupCheck, except that the process
+	// exits if any check fails. This value should come from the
+	// 'strict_startup' field of the main configuration file
+	StrictStartup bool `json:"strict_startup"`
+
+	// RefuseInsecureTLS is whether the process refuses to start if
+	// any component does not verify the certificates of the servers
+	// it connects to (see InsecureTLS). Otherwise, a warning is
+	// logged for each of them. This value should come from the
+	// 'refuse_insecure_tls' field of the main configuration file
+	RefuseInsecureTLS bool `json:"refuse_insecure_tls"`
+
+	// Fragments are the named query snippets, templates and other
+	// pieces of rule configuration which may be referenced by the
+	// rules. This value should come from the 'fragments' field of
+	// the main configuration file
+	Fragments Fragments `json:"fragments"`
+
+	// Outputs are the named outputs which may be referenced by the
+	// 'output_names' field of the rules. This value should come
+	// from the 'outputs' field of the main configuration file
+	Outputs NamedOutputs `json:"outputs"`
+
+	// ErrorOutput, if not nil, is the output to which the failures
+	// of the rules themselves are sent. This value should come from
+	// the 'error_output' field of the main configuration file
+	ErrorOutput *ErrorOutputConfig `json:"error_output"`
+
+	// Heartbeat, if not nil, is the output to which a heartbeat
+	// alert is sent at a regular interval. This value should come
+	// from the 'heartbeat' field of the main configuration file
+	Heartbeat *HeartbeatConfig `json:"heartbeat"`
+
 	// Rules are the definitions of the alerts
 	Rules []RuleConfig `json:"-"`
 }
@@ -225,8 +1491,11 @@ func decodeConfigFile(f string) (*Config, error) {
 	}
 	defer file.Close()
 
+	dec := json.NewDecoder(file)
+	dec.UseNumber()
+
 	cfg := new(Config)
-	err = json.NewDecoder(file).Decode(cfg)
+	err = dec.Decode(cfg)
 	return cfg, err
 }
 
@@ -237,6 +1506,9 @@ func ParseConfig() (*Config, error) {
 	if v := os.Getenv(envConfigFile); v != "" {
 		configFile = v
 	}
+	if v := os.Getenv(EnvConfigDir); v != "" {
+		configFile = filepath.Join(v, baseConfigFile)
+	}
 
 	cfg, err := decodeConfigFile(configFile)
 	if err != nil {
@@ -249,7 +1521,42 @@ func ParseConfig() (*Config, error) {
 	if err = cfg.Elasticsearch.validate(); err != nil {
 		return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
 	}
-	if cfg.Distributed {
+	if cfg.HTTP != nil {
+		if err = cfg.HTTP.validate(); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+		}
+	}
+	if cfg.State != nil {
+		if err = cfg.State.validate(); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+		}
+	}
+	if cfg.Spool != nil {
+		if err = cfg.Spool.validate(); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+		}
+	}
+	if cfg.RetryQueue != nil {
+		if cfg.Spool != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: only one of 'spool' and 'retry_queue' may be set",
+				configFile)
+		}
+		if err = cfg.RetryQueue.validate(); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+		}
+	}
+	if cfg.API != nil {
+		if err = cfg.API.validate(); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+		}
+	}
+	if cfg.Lock == nil {
+		cfg.Lock = &LockConfig{}
+	}
+	if err = cfg.Lock.validate(); err != nil {
+		return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+	}
+	if cfg.Distributed && cfg.Lock.Backend == LockBackendConsul {
 		if cfg.Consul == nil {
 			return nil, xerrors.Errorf("no field 'consul' found in main configuration file %s (required when 'distributed' is true)", configFile) // nolint: lll
 		}
@@ -257,27 +1564,73 @@ func ParseConfig() (*Config, error) {
 			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
 		}
 	}
-	rules, err := ParseRules()
+	for i := range cfg.MaintenanceWindows {
+		if err = cfg.MaintenanceWindows[i].validate(); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: error in maintenance window %d: %v",
+				configFile, i+1, err)
+		}
+	}
+	if err = cfg.Fragments.validate(); err != nil {
+		return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+	}
+	if err = cfg.Outputs.validate(filepath.Dir(configFile)); err != nil {
+		return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+	}
+	if cfg.ErrorOutput != nil {
+		if err = cfg.ErrorOutput.validate(cfg.Outputs, filepath.Dir(configFile)); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+		}
+	}
+	if cfg.Heartbeat != nil {
+		if err = cfg.Heartbeat.validate(cfg.Outputs, filepath.Dir(configFile)); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+		}
+	}
+	policy := cfg.IndexPolicy()
+	if policy != nil {
+		if err = policy.validate(); err != nil {
+			return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+		}
+	}
+	rules, err := ParseRules(cfg.Fragments, cfg.Outputs)
 	if err != nil {
 		return nil, err
 	}
 	if len(rules) < 1 {
 		return nil, errors.New("at least one rule must be specified")
 	}
+	if err = validateWindowRules(cfg.MaintenanceWindows, rules); err != nil {
+		return nil, xerrors.Errorf("error in main configuration file %s: %v", configFile, err)
+	}
+	if err = policy.ValidateRules(rules); err != nil {
+		return nil, err
+	}
 	cfg.Rules = rules
 	return cfg, nil
 }
 
 // ParseRules parses the rule configuration files and returns an
 // array of *RuleConfig or a non-nil error if there was an error.
-func ParseRules() ([]RuleConfig, error) {
+// The files are read in lexical order. Each may define a single
+// rule or an array of rules, and no two rules may have the same
+// name. References to the fragments are resolved before the rules
+// are decoded, and the outputs named by each rule are added to its
+// outputs before it is validated.
+func ParseRules(fragments Fragments, outputs NamedOutputs) ([]RuleConfig, error) {
 	rulesDir := defaultRulesDir
 	if v := os.Getenv(envRulesDir); v != "" {
-		d, err := homedir.Expand(v)
-		if err != nil {
-			return nil, xerrors.Errorf("error expanding rules directory: %v", err)
-		}
-		rulesDir = d
+		rulesDir = v
+	}
+	// The main configuration file is in the same directory as the
+	// rules when the configuration directory is used
+	var baseFile string
+	if v := os.Getenv(EnvConfigDir); v != "" {
+		rulesDir = v
+		baseFile = baseConfigFile
+	}
+	rulesDir, err := homedir.Expand(rulesDir)
+	if err != nil {
+		return nil, xerrors.Errorf("error expanding rules directory: %v", err)
 	}
 
 	ruleFiles, err := filepath.Glob(filepath.Join(rulesDir, "*.json"))
@@ -285,39 +1638,142 @@ func ParseRules() ([]RuleConfig, error) {
 		return nil, xerrors.Errorf("error globbing rules dir: %v", err)
 	}
 
-	rules := make([]RuleConfig, 0, len(ruleFiles))
+	var (
+		rules = make([]RuleConfig, 0, len(ruleFiles))
+		names = make(map[string]string, len(ruleFiles))
+	)
 	for _, ruleFile := range ruleFiles {
-		file, err := os.Open(filepath.Clean(ruleFile))
+		if filepath.Base(ruleFile) == baseFile {
+			continue
+		}
+		fileRules, err := parseRuleFile(ruleFile, fragments, outputs)
 		if err != nil {
-			if os.IsNotExist(err) {
-				continue
+			return nil, err
+		}
+		for _, rule := range fileRules {
+			if other, ok := names[rule.Name]; ok {
+				return nil, xerrors.Errorf("error in rule file %s: a rule named %q is already defined in rule file %s",
+					ruleFile, rule.Name, other)
 			}
-			return nil, xerrors.Errorf("error opening file %s: %v", file.Name(), err)
+			names[rule.Name] = ruleFile
+			rules = append(rules, rule)
 		}
+	}
+	return rules, nil
+}
 
-		dec := json.NewDecoder(file)
-		dec.UseNumber()
+// parseRuleFile parses the rules defined in a rule configuration
+// file, which contains either a single rule or an array of rules.
+func parseRuleFile(ruleFile string, fragments Fragments, outputs NamedOutputs) ([]RuleConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(ruleFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("error opening file %s: %v", ruleFile, err)
+	}
 
-		var rule RuleConfig
-		if err = dec.Decode(&rule); err != nil {
-			file.Close()
-			return nil, xerrors.Errorf("error JSON-decoding rule file %s: %v", file.Name(), err)
+	if bytes.Contains(data, []byte(fragmentRef)) {
+		if data, err = resolveFragments(data, fragments); err != nil {
+			return nil, xerrors.Errorf("error in rule file %s: %v", ruleFile, err)
 		}
-		file.Close()
+	}
 
-		rule.ElasticsearchBody, err = parseBody(rule.ElasticsearchBodyRaw)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var rules []RuleConfig
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = dec.Decode(&rules)
+	} else {
+		rules = make([]RuleConfig, 1)
+		err = dec.Decode(&rules[0])
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding rule file %s: %v", ruleFile, err)
+	}
+
+	for i := range rules {
+		if err = prepareRule(ruleFile, &rules[i], outputs); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// prepareRule reads the files referenced by a rule of the rule
+// configuration file, resolves its named outputs, parses its body
+// and validates it.
+func prepareRule(ruleFile string, rule *RuleConfig, outputs NamedOutputs) error {
+	var err error
+	if rule.ElasticsearchBodyFile != "" {
+		if rule.ElasticsearchBodyRaw != nil {
+			return xerrors.Errorf("error in rule file %s: only one of 'body' and 'body_file' may be set", ruleFile)
+		}
+		rule.ElasticsearchBodyRaw, err = readBodyFile(filepath.Dir(ruleFile), rule.ElasticsearchBodyFile)
 		if err != nil {
-			return nil, xerrors.Errorf("error in rule file %s: %v", file.Name(), err)
+			return xerrors.Errorf("error in rule file %s: error reading 'body_file' of rule %s: %v",
+				ruleFile, rule.Name, err)
 		}
-		rule.ElasticsearchBodyRaw = nil
+	}
 
-		if err := rule.validate(); err != nil {
-			return nil, xerrors.Errorf("error in rule file %s: %v", file.Name(), err)
+	for i := range rule.Outputs {
+		if err = rule.Outputs[i].readSecretFiles(filepath.Dir(ruleFile)); err != nil {
+			return xerrors.Errorf("error in rule file %s: error in output %d of rule %s: %v",
+				ruleFile, i+1, rule.Name, err)
+		}
+	}
+	for j := range rule.Evaluations {
+		e := &rule.Evaluations[j]
+		for i := range e.Outputs {
+			if err = e.Outputs[i].readSecretFiles(filepath.Dir(ruleFile)); err != nil {
+				return xerrors.Errorf("error in rule file %s: error in output %d of evaluation %s of rule %s: %v",
+					ruleFile, i+1, e.Name, rule.Name, err)
+			}
 		}
+	}
+	if err = outputs.resolve(rule); err != nil {
+		return xerrors.Errorf("error in rule file %s: %v", ruleFile, err)
+	}
 
-		rules = append(rules, rule)
+	// Rules querying with SQL need no body
+	if rule.SQL == nil || rule.ElasticsearchBodyRaw != nil {
+		rule.ElasticsearchBody, err = parseBody(rule.ElasticsearchBodyRaw)
+		if err != nil {
+			return xerrors.Errorf("error in rule file %s: %v", ruleFile, err)
+		}
 	}
-	return rules, nil
+	rule.ElasticsearchBodyRaw = nil
+
+	if err = rule.validate(); err != nil {
+		return xerrors.Errorf("error in rule file %s: %v", ruleFile, err)
+	}
+	return nil
+}
+
+func readBodyFile(dir, f string) (map[string]interface{}, error) {
+	f, err := homedir.Expand(f)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(f) {
+		f = filepath.Join(dir, f)
+	}
+
+	file, err := os.Open(filepath.Clean(f))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	dec.UseNumber()
+
+	var body map[string]interface{}
+	if err = dec.Decode(&body); err != nil {
+		return nil, xerrors.Errorf("error JSON-decoding file %s: %v", f, err)
+	}
+	return body, nil
 }
 
 func parseBody(v interface{}) (map[string]interface{}, error) {
@@ -15,11 +15,14 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseConfig_MainConfig(t *testing.T) {
@@ -36,12 +39,37 @@ func TestParseConfig_MainConfig(t *testing.T) {
   "elasticsearch": {
     "server": {
       "url": "http://127.0.0.1:9200"
+    },
+    "vault": {
+      "address": "http://127.0.0.1:8200",
+      "path": "database/creds/alerts",
+      "renew_before": "10m"
+    },
+    "msearch": {
+      "enabled": true,
+      "window": "200ms"
+    },
+    "retry": {
+      "max_retries": 3,
+      "initial_backoff": "1s"
     }
   },
   "distributed": true,
+  "strict_startup": true,
   "consul": {
     "consul_http_addr": "http://127.0.0.1:8500",
     "consul_lock_key": "go-elasticsearch-alerts/leader"
+  },
+  "state": {
+    "retention": "168h"
+  },
+  "spool": {
+    "dir": "/var/spool/go-es-alerts",
+    "max_age": "12h"
+  },
+  "api": {
+    "enabled": true,
+    "token": "secret"
   }
 }`,
 			false,
@@ -82,6 +110,85 @@ func TestParseConfig_MainConfig(t *testing.T) {
 			`{"elasticsearch":{"server":{}}}`,
 			true,
 		},
+		{
+			"bad-state-retention",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"}},"state":{"retention":"7d"}}`,
+			true,
+		},
+		{
+			"no-spool-dir",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"}},"spool":{"max_age":"12h"}}`,
+			true,
+		},
+		{
+			"api-no-auth",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"}},"api":{"enabled":true}}`,
+			true,
+		},
+		{
+			"api-client-ca-without-tls",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"}},"api":{"enabled":true,"client_ca":"ca.pem"}}`,
+			true,
+		},
+		{
+			"bad-maintenance-window",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"}},"maintenance_windows":[{"schedule":"@daily"}]}`,
+			true,
+		},
+		{
+			"path-prefix-with-query",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200","path_prefix":"/es-proxy?x=1"}}}`,
+			true,
+		},
+		{
+			"negative-retries",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"},"retry":{"max_retries":-1}}}`,
+			true,
+		},
+		{
+			"retry-max-backoff-too-short",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"},
+			"retry":{"max_retries":3,"initial_backoff":"5s","max_backoff":"1s"}}}`,
+			true,
+		},
+		{
+			"bad-msearch-window",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"},"msearch":{"enabled":true,"window":"soon"}}}`,
+			true,
+		},
+		{
+			"bad-lock-backend",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"}},"lock":{"backend":"etcd"}}`,
+			true,
+		},
+		{
+			"zero-lock-ttl",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"}},"lock":{"backend":"elasticsearch","ttl":"0s"}}`,
+			true,
+		},
+		{
+			"vault-no-path",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"},"vault":{"address":"http://127.0.0.1:8200"}}}`,
+			true,
+		},
+		{
+			"vault-bad-renew-before",
+			"testdata/config.json",
+			`{"elasticsearch":{"server":{"url": "http://127.0.0.1:9200"},"vault":{"address":"http://127.0.0.1:8200","path":"database/creds/alerts","renew_before":"soon"}}}`, // nolint: lll
+			true,
+		},
 		{
 			"no-consul-field-when-distributed",
 			"testdata/config.json",
@@ -160,6 +267,35 @@ func TestParseConfig_MainConfig(t *testing.T) {
 				t.Fatalf("got %t, expected true", cfg.Distributed)
 			}
 
+			if cfg.State == nil || cfg.State.Retention != 168*time.Hour {
+				t.Fatalf("unexpected state configuration: %+v", cfg.State)
+			}
+
+			if cfg.Spool == nil || cfg.Spool.MaxAge != 12*time.Hour || cfg.Spool.RetryInterval != 0 {
+				t.Fatalf("unexpected spool configuration: %+v", cfg.Spool)
+			}
+
+			if cfg.API == nil || cfg.API.Address != defaultAPIAddress || cfg.API.Token != "secret" {
+				t.Fatalf("unexpected api configuration: %+v", cfg.API)
+			}
+
+			if lc := cfg.Lock; lc == nil || lc.Backend != LockBackendConsul || lc.TTL != defaultLockTTL {
+				t.Fatalf("unexpected lock configuration: %+v", lc)
+			}
+
+			if cfg.StartupCheck || !cfg.StrictStartup {
+				t.Fatalf("unexpected startup check configuration (startup_check: %t, strict_startup: %t)",
+					cfg.StartupCheck, cfg.StrictStartup)
+			}
+
+			if vc := cfg.Elasticsearch.Vault; vc == nil || vc.RenewBefore != 10*time.Minute || vc.UsernameField != "username" {
+				t.Fatalf("unexpected vault configuration: %+v", vc)
+			}
+
+			if mc := cfg.Elasticsearch.MSearch; mc == nil || !mc.Enabled || mc.Window != 200*time.Millisecond {
+				t.Fatalf("unexpected msearch configuration: %+v", mc)
+			}
+
 			v, ok := cfg.Consul["consul_http_addr"]
 			if !ok {
 				t.Fatal("config.Consul does not have key \"consul_http_addr\"")
@@ -545,109 +681,1860 @@ func TestParseConfig_Rules(t *testing.T) {
 			},
 			false,
 		},
-	}
-
-	for _, tc := range cases {
-		tc := tc
-		t.Run(tc.name, func(t *testing.T) {
-			os.Setenv(envRulesDir, tc.path)
-			defer os.Unsetenv(envRulesDir)
-
-			for _, file := range tc.files {
-				fname := filepath.Join(tc.path, file.filename)
-				if err := ioutil.WriteFile(fname, []byte(file.data), 0o666); err != nil {
-					t.Fatal(err)
-				}
-				defer os.Remove(fname)
-			}
-
-			rules, err := ParseRules()
-			if tc.err {
-				if err == nil {
-					t.Fatal("expected an error but didn't receive one")
-				}
-				return
-			}
-
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			if len(rules) != len(tc.files) {
-				t.Fatalf("ParseRules() should have created one RuleConfig per rule file (got %d, expected %d)",
-					len(rules), len(tc.files))
-			}
-
-			for i, file := range tc.files {
-				var contents map[string]interface{}
-				if err := json.Unmarshal([]byte(file.data), &contents); err != nil {
-					t.Fatal(err)
-				}
-
-				name, ok := contents["name"].(string)
-				if !ok {
-					continue
-				}
-
-				if rules[i].Name != name {
-					t.Fatalf("unexpected rule name (got %q, expected %q)", rules[i].Name, name)
-				}
-
-				index, ok := contents["index"].(string)
-				if !ok {
-					continue
-				}
-
-				if rules[i].ElasticsearchIndex != index {
-					t.Fatalf("unexpected index value (got %q, expected %q)",
-						rules[i].ElasticsearchIndex, index)
-				}
-
-				schedule, ok := contents["schedule"].(string)
-				if !ok {
-					continue
-				}
-
-				if rules[i].CronSchedule != schedule {
-					t.Fatalf("unexpected schedule value (got %q, expected %q)",
-						rules[i].CronSchedule, schedule)
-				}
-
-				filters, ok := contents["filters"].([]string)
-				if !ok {
-					continue
-				}
-
-				if len(rules[i].Filters) != len(filters) {
-					t.Fatalf("returned rule has unexpected number of filters (got %d, expected %d)",
-						len(rules[i].Filters), len(filters))
-				}
-
-				for j, filter := range filters {
-					if filter != rules[i].Filters[j] {
-						t.Fatalf("got unexpected filter (got %q, expected %q)",
-							rules[i].Filters[j], filter)
-					}
-				}
-
-				body, ok := contents["body"].(map[string]interface{})
-				if !ok {
-					continue
-				}
-
-				if !reflect.DeepEqual(body, rules[i].ElasticsearchBody) {
-					t.Fatalf("rule 'body' is unexpected:\nGot:\n\t%+v\nExpected:\n\t%+v",
-						rules[i].ElasticsearchBody, body)
-				}
-
-				outputs, ok := contents["outputs"].([]interface{})
-				if !ok {
-					continue
-				}
-				if len(rules[i].Outputs) != len(outputs) {
-					t.Fatalf("rule 'outputs' is an unexpected length (got %d, expected %d)",
-						len(rules[i].Outputs), len(outputs))
-				}
+		{
+			"bad-alert-cooldown",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "query": {
+      "term": {
+        "hostname": "test"
+      }
+    }
+  },
+  "alert_cooldown": "thirty minutes",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"bad-first-run",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "query": {
+      "term": {
+        "hostname": "test"
+      }
+    }
+  },
+  "first_run": "ignore",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"expression",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "query": {
+      "term": {
+        "hostname": "test"
+      }
+    }
+  },
+  "values": {"errors": "aggregations.errors.doc_count", "total": "hits.total"},
+  "expression": "errors > 100 AND total > 0",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"expression-undefined-value",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "query": {
+      "term": {
+        "hostname": "test"
+      }
+    }
+  },
+  "values": {"errors": "aggregations.errors.doc_count"},
+  "expression": "errors > 100 AND total > 0",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"bad-expression",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "query": {
+      "term": {
+        "hostname": "test"
+      }
+    }
+  },
+  "values": {"errors": "aggregations.errors.doc_count"},
+  "expression": "errors >> 100",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"reminder-interval-not-shorter-than-cooldown",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "query": {
+      "term": {
+        "hostname": "test"
+      }
+    }
+  },
+  "alert_cooldown": "1h",
+  "reminder_interval": "2h",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-alert-cooldown",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "query": {
+      "term": {
+        "hostname": "test"
+      }
+    }
+  },
+  "alert_cooldown": "30m",
+  "reminder_interval": "10m",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"good-dedup-key-field",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "aggs": {
+      "hostname": {
+        "terms": {
+          "field": "hostname"
+        }
+      }
+    }
+  },
+  "filters": ["aggregations.hostname.buckets"],
+  "alert_cooldown": "1h",
+  "dedup_key_field": "aggregations.hostname.buckets",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"dedup-key-field-without-cooldown",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "aggs": {
+      "hostname": {
+        "terms": {
+          "field": "hostname"
+        }
+      }
+    }
+  },
+  "filters": ["aggregations.hostname.buckets"],
+  "dedup_key_field": "aggregations.hostname.buckets",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"dedup-key-field-with-reminder-interval",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "aggs": {
+      "hostname": {
+        "terms": {
+          "field": "hostname"
+        }
+      }
+    }
+  },
+  "filters": ["aggregations.hostname.buckets"],
+  "alert_cooldown": "1h",
+  "reminder_interval": "10m",
+  "dedup_key_field": "aggregations.hostname.buckets",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"dedup-key-field-with-reminder-interval-dedup-disabled",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "aggs": {
+      "hostname": {
+        "terms": {
+          "field": "hostname"
+        }
+      }
+    }
+  },
+  "filters": ["aggregations.hostname.buckets"],
+  "alert_cooldown": "1h",
+  "reminder_interval": "10m",
+  "dedup_key_field": "aggregations.hostname.buckets",
+  "disable_dedup": true,
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"dedup-key-field-not-a-filter",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {
+    "aggs": {
+      "hostname": {
+        "terms": {
+          "field": "hostname"
+        }
+      }
+    }
+  },
+  "filters": ["aggregations.hostname.buckets"],
+  "alert_cooldown": "1h",
+  "dedup_key_field": "aggregations.service.buckets",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-sql",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "sql": {"query": "SELECT host, COUNT(*) FROM \"logs-*\" GROUP BY host", "fetch_size": 100},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"sql-with-body",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "sql": {"query": "SELECT COUNT(*) FROM logs"},
+  "body": {"query": {"match_all": {}}},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"empty-sql-query",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "sql": {"query": " "},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"sql-sub-query-without-index",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "sql": {"query": "SELECT COUNT(*) FROM logs"},
+  "sub_queries": [{"name": "errors", "body": {"query": {"match_all": {}}}, "filters": ["hits.hits"]}],
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-output-match",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "outputs": [
+    {
+      "type": "file",
+      "match": "key == 'critical' AND count > 0",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"output-match-unknown-value",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "outputs": [
+    {
+      "type": "file",
+      "match": "severity == 'critical'",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"output-match-parse-error",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "outputs": [
+    {
+      "type": "file",
+      "match": "key = 'critical'",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-query-delay",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "index": "testindex",
+  "body": {"query": {"range": {"@timestamp": {"gte": "now-1m"}}}},
+  "query_delay": "1m",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"negative-query-delay",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "index": "testindex",
+  "body": {"query": {"match_all": {}}},
+  "query_delay": "-1m",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"query-delay-with-sql",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "sql": {"query": "SELECT COUNT(*) FROM logs WHERE \"@timestamp\" > NOW() - INTERVAL 1 MINUTE"},
+  "query_delay": "1m",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-max-runtime",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "index": "testindex",
+  "body": {"query": {"match_all": {}}},
+  "query_timeout": "30s",
+  "max_runtime": "5m",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"max-runtime-not-longer-than-query-timeout",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "schedule": "@every 1m",
+  "index": "testindex",
+  "body": {"query": {"match_all": {}}},
+  "query_timeout": "30s",
+  "max_runtime": "30s",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-min-severity",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "min_severity": {"field": "log.level", "minimum": "warn"},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"min-severity-unknown-level",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "min_severity": {"field": "log.level", "minimum": "fatal"},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"min-severity-no-field",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "min_severity": {"minimum": 3},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-value-format",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "filters": ["aggregations.hostname.buckets"],
+  "value_field": "latency.value",
+  "value_format": "%.2f ms",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"value-format-no-field",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "filters": ["aggregations.hostname.buckets"],
+  "value_format": "%.2f ms",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"value-format-bad-verb",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "filters": ["aggregations.hostname.buckets"],
+  "value_field": "latency.value",
+  "value_format": "%d %d",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-value-unit",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "filters": ["aggregations.hostname.buckets"],
+  "value_field": "latency.value",
+  "value_unit": "ms",
+  "value_threshold": 1500,
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"value-unit-no-field",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "filters": ["aggregations.hostname.buckets"],
+  "value_threshold": 1500,
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"value-unit-and-format",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "filters": ["aggregations.hostname.buckets"],
+  "value_field": "latency.value",
+  "value_unit": "ms",
+  "value_format": "%.2f ms",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"good-async",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "async": true,
+  "async_max_wait": "20m",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"async-max-wait-without-async",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "async_max_wait": "20m",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"async-with-count-only",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "async": true,
+  "count_only": true,
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"count-only-with-count-condition",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "count_only": true,
+  "conditions": [{"field": "count", "gt": 10}],
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"count-only-with-hits-condition",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "count_only": true,
+  "conditions": [{"field": "hits.total.value", "gt": 10}],
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"count-only-with-hits-value",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "count_only": true,
+  "values": {"total": "hits.total.value"},
+  "expression": "total > 10",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"count-only-ignored-with-hits-condition",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "count_only": true,
+  "filters": ["hits.hits._source"],
+  "conditions": [{"field": "hits.total.value", "gt": 10}],
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"heartbeat-rule-name",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "heartbeat",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"negative-min-matches",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "min_matches": -1,
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"negative-output-concurrency",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"match_all": {}}},
+  "output_concurrency": -1,
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"body-file",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body_file": "../queries/errors.json",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"body-file-does-not-exist",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body_file": "../queries/i-dont-exist.json",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"body-and-body-file",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "body_file": "../queries/errors.json",
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"sub-queries",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "sub_queries": [
+    {
+      "name": "Programs",
+      "body": {"aggs": {"program": {"terms": {"field": "program"}}}},
+      "filters": ["aggregations.program.buckets"]
+    }
+  ],
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"sub-query-no-name",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "sub_queries": [
+    {
+      "body": {"aggs": {"program": {"terms": {"field": "program"}}}},
+      "filters": ["aggregations.program.buckets"]
+    }
+  ],
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"sub-query-no-filters",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "sub_queries": [
+    {
+      "name": "Programs",
+      "body": {"aggs": {"program": {"terms": {"field": "program"}}}}
+    }
+  ],
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"sub-query-no-body",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "sub_queries": [
+    {
+      "name": "Programs",
+      "filters": ["aggregations.program.buckets"]
+    }
+  ],
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"query-params",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "query_params": {"request_cache": true, "routing": "user1"},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"bad-query-params",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "query_params": {"size": 10},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+		{
+			"sticky-preference",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "sticky_preference": true,
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			false,
+		},
+		{
+			"sticky-preference-conflict",
+			"testdata/rules",
+			[]*ruleFile{
+				{
+					"testrule-1.json",
+					`{
+  "name": "test-rule-1",
+  "index": "testindex",
+  "schedule": "@every 1m",
+  "body": {"query": {"term": {"hostname": "test"}}},
+  "sticky_preference": true,
+  "query_params": {"preference": "custom"},
+  "outputs": [
+    {
+      "type": "file",
+      "config": {
+        "file": "test.log"
+      }
+    }
+  ]
+}`,
+				},
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			os.Setenv(envRulesDir, tc.path)
+			defer os.Unsetenv(envRulesDir)
+
+			for _, file := range tc.files {
+				fname := filepath.Join(tc.path, file.filename)
+				if err := ioutil.WriteFile(fname, []byte(file.data), 0o666); err != nil {
+					t.Fatal(err)
+				}
+				defer os.Remove(fname)
+			}
+
+			rules, err := ParseRules(nil, nil)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rules) != len(tc.files) {
+				t.Fatalf("ParseRules() should have created one RuleConfig per rule file (got %d, expected %d)",
+					len(rules), len(tc.files))
+			}
+
+			for i, file := range tc.files {
+				var contents map[string]interface{}
+				if err := json.Unmarshal([]byte(file.data), &contents); err != nil {
+					t.Fatal(err)
+				}
+
+				name, ok := contents["name"].(string)
+				if !ok {
+					continue
+				}
+
+				if rules[i].Name != name {
+					t.Fatalf("unexpected rule name (got %q, expected %q)", rules[i].Name, name)
+				}
+
+				index, ok := contents["index"].(string)
+				if !ok {
+					continue
+				}
+
+				if rules[i].ElasticsearchIndex != index {
+					t.Fatalf("unexpected index value (got %q, expected %q)",
+						rules[i].ElasticsearchIndex, index)
+				}
+
+				schedule, ok := contents["schedule"].(string)
+				if !ok {
+					continue
+				}
+
+				if rules[i].CronSchedule != schedule {
+					t.Fatalf("unexpected schedule value (got %q, expected %q)",
+						rules[i].CronSchedule, schedule)
+				}
+
+				filters, ok := contents["filters"].([]string)
+				if !ok {
+					continue
+				}
+
+				if len(rules[i].Filters) != len(filters) {
+					t.Fatalf("returned rule has unexpected number of filters (got %d, expected %d)",
+						len(rules[i].Filters), len(filters))
+				}
+
+				for j, filter := range filters {
+					if filter != rules[i].Filters[j] {
+						t.Fatalf("got unexpected filter (got %q, expected %q)",
+							rules[i].Filters[j], filter)
+					}
+				}
+
+				body, ok := contents["body"].(map[string]interface{})
+				if !ok {
+					continue
+				}
+
+				if !reflect.DeepEqual(body, rules[i].ElasticsearchBody) {
+					t.Fatalf("rule 'body' is unexpected:\nGot:\n\t%+v\nExpected:\n\t%+v",
+						rules[i].ElasticsearchBody, body)
+				}
+
+				outputs, ok := contents["outputs"].([]interface{})
+				if !ok {
+					continue
+				}
+				if len(rules[i].Outputs) != len(outputs) {
+					t.Fatalf("rule 'outputs' is an unexpected length (got %d, expected %d)",
+						len(rules[i].Outputs), len(outputs))
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfig_ConfigDir(t *testing.T) {
+	const (
+		base = `{"elasticsearch":{"server":{"url":"http://127.0.0.1:9200"}}}`
+		rule = `{
+  "name": %q,
+  "index": "test-*",
+  "schedule": "@every 10m",
+  "body": {"query": {"match_all": {}}},
+  "outputs": [{"type": "file", "config": {"file": "test.log"}}]
+}`
+	)
+	newRule := func(name string) string {
+		return fmt.Sprintf(rule, name)
+	}
+
+	cases := []struct {
+		name  string
+		files map[string]string
+		rules []string
+		err   string
+	}{
+		{
+			"merge",
+			map[string]string{
+				"config.json":   base,
+				"team-b.json":   newRule("rule-b"),
+				"team-a.json":   "[" + newRule("rule-a1") + "," + newRule("rule-a2") + "]",
+				"not-json.yaml": "ignored",
+			},
+			[]string{"rule-a1", "rule-a2", "rule-b"},
+			"",
+		},
+		{
+			"duplicate-names",
+			map[string]string{
+				"config.json": base,
+				"team-a.json": newRule("rule-a"),
+				"team-b.json": "[" + newRule("rule-b") + "," + newRule("rule-a") + "]",
+			},
+			nil,
+			`a rule named "rule-a" is already defined in rule file`,
+		},
+		{
+			"no-rules",
+			map[string]string{
+				"config.json": base,
+			},
+			nil,
+			"at least one rule must be specified",
+		},
+		{
+			"empty-directory",
+			map[string]string{},
+			nil,
+			"config.json",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "config-dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			for name, data := range tc.files {
+				if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0o666); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The configuration directory takes precedence over these
+			os.Setenv(envConfigFile, "testdata/does-not-exist.json")
+			defer os.Unsetenv(envConfigFile)
+			os.Setenv(envRulesDir, "testdata/rules-main")
+			defer os.Unsetenv(envRulesDir)
+			os.Setenv(EnvConfigDir, dir)
+			defer os.Unsetenv(EnvConfigDir)
+
+			cfg, err := ParseConfig()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Elasticsearch.Server.ElasticsearchURL != "http://127.0.0.1:9200" {
+				t.Fatalf("got %q, expected \"http://127.0.0.1:9200\"", cfg.Elasticsearch.Server.ElasticsearchURL)
+			}
+			names := make([]string, 0, len(cfg.Rules))
+			for _, rule := range cfg.Rules {
+				names = append(names, rule.Name)
+			}
+			if !reflect.DeepEqual(names, tc.rules) {
+				t.Fatalf("unexpected rules (got %v, expected %v)", names, tc.rules)
+			}
+		})
+	}
+}
+
+func TestRuleConfig_OutputPriority(t *testing.T) {
+	output := func(file string, priority int) OutputConfig {
+		return OutputConfig{
+			Type:     "file",
+			Config:   map[string]interface{}{"file": file},
+			Priority: priority,
+		}
+	}
+	rule := &RuleConfig{
+		Name:               "test",
+		ElasticsearchIndex: "test-*",
+		CronSchedule:       "* * * * * *",
+		Outputs: []OutputConfig{
+			output("chat-1.log", 0),
+			output("page.log", 10),
+			output("chat-2.log", 0),
+			output("email.log", 5),
+		},
+	}
+	if err := rule.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"page.log", "email.log", "chat-1.log", "chat-2.log"}
+	for i, output := range rule.Outputs {
+		if file := output.Config["file"]; file != expected[i] {
+			t.Fatalf("unexpected output at position %d (got %v, expected %q)", i, file, expected[i])
+		}
+	}
+}
+
+func TestCompositeConfig_validate(t *testing.T) {
+	body := map[string]interface{}{
+		"aggs": map[string]interface{}{
+			"by_host": map[string]interface{}{
+				"composite": map[string]interface{}{"sources": []interface{}{}},
+			},
+			"by_status": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "status"},
+			},
+		},
+	}
+
+	cases := []struct {
+		name   string
+		config *CompositeConfig
+		err    bool
+	}{
+		{"valid", &CompositeConfig{Aggregation: "by_host", MaxBuckets: 500}, false},
+		{"no-aggregation", &CompositeConfig{}, true},
+		{"missing-aggregation", &CompositeConfig{Aggregation: "by_service"}, true},
+		{"not-composite", &CompositeConfig{Aggregation: "by_status"}, true},
+		{"negative-max-buckets", &CompositeConfig{Aggregation: "by_host", MaxBuckets: -1}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate(body)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestServerConfig_BaseURL(t *testing.T) {
+	cases := []struct {
+		name     string
+		url      string
+		prefix   string
+		expected string
+	}{
+		{"no-prefix", "http://127.0.0.1:9200", "", "http://127.0.0.1:9200"},
+		{"no-prefix-trailing-slash", "http://127.0.0.1:9200/", "", "http://127.0.0.1:9200"},
+		{"prefix", "http://127.0.0.1:9200", "es-proxy", "http://127.0.0.1:9200/es-proxy"},
+		{"slashes", "http://127.0.0.1:9200/", "/es-proxy/", "http://127.0.0.1:9200/es-proxy"},
+		{"nested-prefix", "https://proxy.example.com/api", "/es/v1", "https://proxy.example.com/api/es/v1"},
+		{"only-slash", "http://127.0.0.1:9200", "/", "http://127.0.0.1:9200"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := &ServerConfig{ElasticsearchURL: tc.url, PathPrefix: tc.prefix}
+			if got := s.BaseURL(); got != tc.expected {
+				t.Fatalf("unexpected base URL (got %q, expected %q)", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSendQueueConfig_validate(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *SendQueueConfig
+		policy string
+		err    bool
+	}{
+		{"default-policy", &SendQueueConfig{Size: 5}, SendQueueDropOldest, false},
+		{"drop-newest", &SendQueueConfig{Policy: SendQueueDropNewest}, SendQueueDropNewest, false},
+		{"block", &SendQueueConfig{Policy: SendQueueBlock}, SendQueueBlock, false},
+		{"negative-size", &SendQueueConfig{Size: -1}, "", true},
+		{"unknown-policy", &SendQueueConfig{Policy: "drop-all"}, "", true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate()
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.config.Policy != tc.policy {
+				t.Fatalf("unexpected policy (got %q, expected %q)", tc.config.Policy, tc.policy)
+			}
+		})
+	}
+}
+
+func TestRetryQueueConfig_validate(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   *RetryQueueConfig
+		interval time.Duration
+		err      bool
+	}{
+		{"defaults", &RetryQueueConfig{}, 0, false},
+		{"interval", &RetryQueueConfig{MaxAttempts: 3, RetryIntervalRaw: "30s"}, 30 * time.Second, false},
+		{"negative-attempts", &RetryQueueConfig{MaxAttempts: -1}, 0, true},
+		{"invalid-interval", &RetryQueueConfig{RetryIntervalRaw: "soon"}, 0, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate()
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.config.RetryInterval != tc.interval {
+				t.Fatalf("unexpected retry interval (got %v, expected %v)", tc.config.RetryInterval, tc.interval)
 			}
 		})
 	}
@@ -0,0 +1,136 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/httplog"
+)
+
+// secretFields are the names of the fields (and of the headers)
+// whose values are always redacted, wherever they appear.
+var secretFields = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"key":           true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"webhook":       true,
+	"x_api_key":     true,
+}
+
+// secretSuffixes are the suffixes of the names of fields whose
+// values are always redacted, e.g. 'proxy_password' or
+// 'consul_http_token'.
+var secretSuffixes = []string{"_password", "_secret", "_token", "_api_key"}
+
+// Redacted returns the effective configuration as indented JSON:
+// the main configuration file and the parsed rules, after their
+// fragments, secret files and named outputs have been resolved and
+// their defaults set. The values of secret fields (passwords,
+// tokens and webhooks) and the credentials of URLs are replaced by
+// httplog.Redacted. Object keys are sorted so that the output of
+// two configurations may be compared.
+func (c *Config) Redacted() ([]byte, error) {
+	doc, err := toObject(c)
+	if err != nil {
+		return nil, xerrors.Errorf("error JSON-encoding main configuration: %v", err)
+	}
+
+	rules := make([]interface{}, 0, len(c.Rules))
+	for i := range c.Rules {
+		rule, err := toObject(&c.Rules[i])
+		if err != nil {
+			return nil, xerrors.Errorf("error JSON-encoding rule %s: %v", c.Rules[i].Name, err)
+		}
+		// The body is only kept once parsed
+		if c.Rules[i].ElasticsearchBody != nil {
+			if rule["body"], err = toObject(c.Rules[i].ElasticsearchBody); err != nil {
+				return nil, xerrors.Errorf("error JSON-encoding body of rule %s: %v", c.Rules[i].Name, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	doc["rules"] = rules
+
+	data, err := json.MarshalIndent(redact("", doc), "", "  ")
+	if err != nil {
+		return nil, xerrors.Errorf("error JSON-encoding configuration: %v", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// toObject returns v JSON-encoded and decoded into a map so that its
+// fields may be redacted.
+func toObject(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err = dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// redact returns v, the value of the named field, with the values
+// of its secret fields and the credentials of its URLs redacted.
+func redact(name string, v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, elem := range value {
+			value[k] = redact(k, elem)
+		}
+		return value
+	case []interface{}:
+		for i, elem := range value {
+			value[i] = redact(name, elem)
+		}
+		return value
+	case string:
+		if value != "" && isSecretField(name) {
+			return httplog.Redacted
+		}
+		if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.Host != "" {
+			return httplog.RedactURL(u)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+func isSecretField(name string) bool {
+	name = strings.ToLower(strings.Replace(name, "-", "_", -1))
+	if secretFields[name] {
+		return true
+	}
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
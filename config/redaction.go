@@ -0,0 +1,169 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultRedactionMask is the text which replaces redacted values
+// if no mask is configured.
+const DefaultRedactionMask = "***"
+
+// RedactionConfig maps to the 'redact' field of a rule configuration
+// file.
+type RedactionConfig struct {
+	// Fields are the fields of the documents of the alerts whose
+	// values are masked. A name (e.g. 'email') matches the fields of
+	// that name at any depth of a document, while a path whose
+	// elements are separated by dots (e.g. 'user.email') matches
+	// from the root of the document. A path equal to a filter of the
+	// rule masks the keys of its buckets
+	Fields []string `json:"fields"`
+
+	// Patterns are regular expressions whose matches in the text of
+	// the alerts, in the string values of their documents and in the
+	// keys and values of their buckets are masked
+	Patterns []string `json:"patterns"`
+
+	// Mask replaces the redacted values. If empty,
+	// DefaultRedactionMask is used
+	Mask string `json:"mask"`
+
+	// Drop is whether the fields of the documents matching Fields
+	// are removed rather than masked
+	Drop bool `json:"drop"`
+}
+
+func (rc *RedactionConfig) validate() (*Redaction, error) {
+	return ParseRedaction(rc)
+}
+
+// ParseRedaction returns the redaction configured by rc, compiling
+// its patterns.
+func ParseRedaction(rc *RedactionConfig) (*Redaction, error) {
+	if len(rc.Fields) == 0 && len(rc.Patterns) == 0 {
+		return nil, xerrors.New("field 'redact' must have at least one of 'fields' or 'patterns'")
+	}
+	r := &Redaction{
+		names: make(map[string]bool),
+		paths: make(map[string]bool),
+		mask:  rc.Mask,
+		drop:  rc.Drop,
+	}
+	if r.mask == "" {
+		r.mask = DefaultRedactionMask
+	}
+	for _, field := range rc.Fields {
+		switch {
+		case field == "":
+			return nil, xerrors.New("field 'redact.fields' must not contain empty names")
+		case strings.Contains(field, "."):
+			r.paths[field] = true
+		default:
+			r.names[field] = true
+		}
+	}
+	for _, pattern := range rc.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, xerrors.Errorf("error compiling 'redact.patterns' pattern %q: %v", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Redaction masks the sensitive values of the documents and text of
+// the alerts of a rule. The values given to its methods are not
+// modified.
+type Redaction struct {
+	names    map[string]bool
+	paths    map[string]bool
+	patterns []*regexp.Regexp
+	mask     string
+	drop     bool
+}
+
+// Text returns the text with the matches of the patterns masked.
+func (r *Redaction) Text(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllLiteralString(s, r.mask)
+	}
+	return s
+}
+
+// MasksKeys returns true if the keys of the buckets of the filter
+// are masked, i.e. if the filter is one of the redacted paths.
+func (r *Redaction) MasksKeys(filter string) bool {
+	return r.paths[filter]
+}
+
+// Key returns the key of a bucket of the filter, masked if the
+// filter is one of the redacted paths and with the matches of the
+// patterns masked otherwise.
+func (r *Redaction) Key(filter, key string) string {
+	if r.MasksKeys(filter) {
+		return r.mask
+	}
+	return r.Text(key)
+}
+
+// Document returns a copy of the document in which the redacted
+// fields are masked (or dropped) and the matches of the patterns in
+// its string values are masked.
+func (r *Redaction) Document(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+	return r.object(doc, "")
+}
+
+func (r *Redaction) object(obj map[string]interface{}, prefix string) map[string]interface{} {
+	out := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if r.names[k] || r.paths[path] {
+			if !r.drop {
+				out[k] = r.mask
+			}
+			continue
+		}
+		out[k] = r.value(v, path)
+	}
+	return out
+}
+
+func (r *Redaction) value(v interface{}, path string) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return r.object(t, path)
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, elem := range t {
+			out[i] = r.value(elem, path)
+		}
+		return out
+	case string:
+		return r.Text(t)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRedactionConfig_validate(t *testing.T) {
+	cases := []struct {
+		name   string
+		config RedactionConfig
+		err    bool
+	}{
+		{"fields", RedactionConfig{Fields: []string{"email", "user.token"}}, false},
+		{"patterns", RedactionConfig{Patterns: []string{`\d{16}`}}, false},
+		{"empty", RedactionConfig{Mask: "[hidden]"}, true},
+		{"empty-field", RedactionConfig{Fields: []string{""}}, true},
+		{"bad-pattern", RedactionConfig{Patterns: []string{"("}}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.validate()
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRedactionDocument(t *testing.T) {
+	doc := map[string]interface{}{
+		"email":   "alice@example.com",
+		"message": "login by bob@example.com failed",
+		"status":  json.Number("401"),
+		"user": map[string]interface{}{
+			"name":  "alice",
+			"token": "s3cr3t",
+			"email": "alice@example.com",
+		},
+		"tags": []interface{}{"card 4111111111111111", json.Number("1")},
+	}
+
+	cases := []struct {
+		name     string
+		config   RedactionConfig
+		expected map[string]interface{}
+	}{
+		{
+			"mask",
+			RedactionConfig{
+				Fields:   []string{"email", "user.token"},
+				Patterns: []string{`[\w.+-]+@[\w-]+\.[\w.]+`, `\d{16}`},
+			},
+			map[string]interface{}{
+				"email":   "***",
+				"message": "login by *** failed",
+				"status":  json.Number("401"),
+				"user": map[string]interface{}{
+					"name":  "alice",
+					"token": "***",
+					"email": "***",
+				},
+				"tags": []interface{}{"card ***", json.Number("1")},
+			},
+		},
+		{
+			"drop",
+			RedactionConfig{Fields: []string{"user"}, Mask: "[hidden]", Drop: true},
+			map[string]interface{}{
+				"email":   "alice@example.com",
+				"message": "login by bob@example.com failed",
+				"status":  json.Number("401"),
+				"tags":    []interface{}{"card 4111111111111111", json.Number("1")},
+			},
+		},
+		{
+			"name-at-any-depth",
+			RedactionConfig{Fields: []string{"token"}, Patterns: []string{"alice"}, Mask: "[hidden]"},
+			map[string]interface{}{
+				"email":   "[hidden]@example.com",
+				"message": "login by bob@example.com failed",
+				"status":  json.Number("401"),
+				"user": map[string]interface{}{
+					"name":  "[hidden]",
+					"token": "[hidden]",
+					"email": "[hidden]@example.com",
+				},
+				"tags": []interface{}{"card 4111111111111111", json.Number("1")},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := tc.config.validate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Document(doc); !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("unexpected document:\nGot:\n\t%#v\nExpected:\n\t%#v", got, tc.expected)
+			}
+		})
+	}
+
+	// The document itself is not modified
+	if doc["email"] != "alice@example.com" || doc["user"].(map[string]interface{})["token"] != "s3cr3t" {
+		t.Fatalf("document was modified: %#v", doc)
+	}
+}
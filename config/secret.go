@@ -0,0 +1,74 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/xerrors"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+)
+
+// secretFileSuffix is appended to an output configuration field
+// to instead read the value of that field from a file, e.g.
+// 'webhook_file' for 'webhook'.
+const secretFileSuffix = "_file"
+
+// readSecretFiles replaces each field of the output configuration
+// whose name ends with secretFileSuffix with the field it names,
+// set to the contents of the file at the path it holds. Relative
+// paths are resolved against dir.
+func (o *OutputConfig) readSecretFiles(dir string) error {
+	names := make([]string, 0, len(o.Config))
+	for name := range o.Config {
+		if strings.HasSuffix(name, secretFileSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := strings.TrimSuffix(name, secretFileSuffix)
+		if field == "" {
+			continue
+		}
+		if _, ok := o.Config[field]; ok {
+			return xerrors.Errorf("only one of 'output.config.%s' and 'output.config.%s' may be set", field, name)
+		}
+
+		path, ok := o.Config[name].(string)
+		if !ok || path == "" {
+			return xerrors.Errorf("field 'output.config.%s' must be a path to a file", name)
+		}
+		path, err := homedir.Expand(path)
+		if err != nil {
+			return xerrors.Errorf("error reading field 'output.config.%s': %v", name, err)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		v, err := utils.ReadSecretFile(path)
+		if err != nil {
+			return xerrors.Errorf("error reading field 'output.config.%s': %v", name, err)
+		}
+		o.Config[field] = v
+		delete(o.Config, name)
+	}
+	return nil
+}
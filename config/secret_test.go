@@ -0,0 +1,123 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	webhook := filepath.Join(dir, "webhook")
+	if err = ioutil.WriteFile(webhook, []byte("https://hooks.slack.com/services/T0/B0/XXXX\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "token"), []byte("xoxb-1234\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		config map[string]interface{}
+		output map[string]interface{}
+		err    bool
+	}{
+		{
+			"absolute-path",
+			map[string]interface{}{
+				"webhook_file": webhook,
+				"channel":      "#alerts",
+			},
+			map[string]interface{}{
+				"webhook": "https://hooks.slack.com/services/T0/B0/XXXX",
+				"channel": "#alerts",
+			},
+			false,
+		},
+		{
+			"relative-path",
+			map[string]interface{}{
+				"bot_token_file": "token",
+			},
+			map[string]interface{}{
+				"bot_token": "xoxb-1234",
+			},
+			false,
+		},
+		{
+			"no-secret-files",
+			map[string]interface{}{
+				"file": "alerts.log",
+			},
+			map[string]interface{}{
+				"file": "alerts.log",
+			},
+			false,
+		},
+		{
+			"both-set",
+			map[string]interface{}{
+				"webhook":      "https://example.com",
+				"webhook_file": webhook,
+			},
+			nil,
+			true,
+		},
+		{
+			"missing-file",
+			map[string]interface{}{
+				"webhook_file": filepath.Join(dir, "missing"),
+			},
+			nil,
+			true,
+		},
+		{
+			"not-a-string",
+			map[string]interface{}{
+				"webhook_file": 1,
+			},
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			output := &OutputConfig{Type: "slack", Config: tc.config}
+			err := output.readSecretFiles(dir)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(output.Config, tc.output) {
+				t.Fatalf("Got:\n%+v\n\nExpected:\n%+v", output.Config, tc.output)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/xerrors"
+
+	"github.com/morningconsult/go-elasticsearch-alerts/utils"
+)
+
+// DefaultSeverityLevels are the severity levels, from lowest to
+// highest, used by a minimum severity which is not a number if no
+// levels are configured.
+var DefaultSeverityLevels = []string{"debug", "info", "warn", "error", "crit"}
+
+// SeverityConfig maps to the 'min_severity' field of a rule
+// configuration file.
+type SeverityConfig struct {
+	// Field is the field of the _source of each hit holding its
+	// severity. Nested fields are separated by dots
+	Field string `json:"field"`
+
+	// Minimum is the lowest severity of the hits which are kept,
+	// either a number or one of Levels
+	Minimum interface{} `json:"minimum"`
+
+	// Levels are the names of the severities from lowest to highest.
+	// If empty, DefaultSeverityLevels are used
+	Levels []string `json:"levels"`
+}
+
+func (sc *SeverityConfig) validate() (*SeverityFilter, error) {
+	if sc.Field == "" {
+		return nil, xerrors.New("field 'min_severity.field' must not be empty")
+	}
+	return ParseSeverityFilter(sc.Field, sc.Minimum, sc.Levels)
+}
+
+// SeverityFilter drops the hits of a response whose severity is
+// below a minimum. The severity is either compared numerically or,
+// if the minimum is not a number, by its rank in an ordered list of
+// level names, compared case-insensitively. Hits whose severity is
+// missing or cannot be compared are kept so that no alert is lost
+// to an unexpected value.
+type SeverityFilter struct {
+	field   string
+	levels  map[string]int
+	rank    int
+	minimum *decimal.Decimal
+}
+
+// ParseSeverityFilter returns the filter keeping the hits whose
+// severity, held in the given field of their _source, is at least
+// minimum. If minimum is a string which is not a number, it must
+// be one of levels (or of DefaultSeverityLevels if levels is
+// empty).
+func ParseSeverityFilter(field string, minimum interface{}, levels []string) (*SeverityFilter, error) {
+	f := &SeverityFilter{field: field}
+	if d, ok := severityNumber(minimum); ok {
+		f.minimum = &d
+		return f, nil
+	}
+
+	name, ok := minimum.(string)
+	if !ok || name == "" {
+		return nil, xerrors.New("field 'min_severity.minimum' must be a number or the name of a severity level")
+	}
+	if len(levels) == 0 {
+		levels = DefaultSeverityLevels
+	}
+	f.levels = make(map[string]int, len(levels))
+	for i, level := range levels {
+		level = strings.ToLower(level)
+		if _, ok := f.levels[level]; ok {
+			return nil, xerrors.Errorf("field 'min_severity.levels' lists %q more than once", level)
+		}
+		f.levels[level] = i
+	}
+	if f.rank, ok = f.levels[strings.ToLower(name)]; !ok {
+		return nil, xerrors.Errorf("field 'min_severity.minimum' (%q) must be one of %s", name,
+			strings.Join(levels, ", "))
+	}
+	return f, nil
+}
+
+// Passes returns false if v is a severity below the minimum.
+func (f *SeverityFilter) Passes(v interface{}) bool {
+	if f.minimum != nil {
+		d, ok := severityNumber(v)
+		return !ok || d.GreaterThanOrEqual(*f.minimum)
+	}
+	var name string
+	switch t := v.(type) {
+	case string:
+		name = t
+	case json.Number:
+		name = t.String()
+	default:
+		return true
+	}
+	rank, ok := f.levels[strings.ToLower(name)]
+	return !ok || rank >= f.rank
+}
+
+// Filter returns a copy of the response to a search without the
+// hits whose severity is below the minimum. The response itself is
+// not modified.
+func (f *SeverityFilter) Filter(respData map[string]interface{}) map[string]interface{} {
+	hits, ok := respData["hits"].(map[string]interface{})
+	if !ok {
+		return respData
+	}
+	docs, ok := hits["hits"].([]interface{})
+	if !ok {
+		return respData
+	}
+
+	kept := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		obj, ok := doc.(map[string]interface{})
+		if ok && !f.Passes(utils.Get(obj, "_source."+f.field)) {
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	if len(kept) == len(docs) {
+		return respData
+	}
+
+	filteredHits := make(map[string]interface{}, len(hits))
+	for k, v := range hits {
+		filteredHits[k] = v
+	}
+	filteredHits["hits"] = kept
+
+	filtered := make(map[string]interface{}, len(respData))
+	for k, v := range respData {
+		filtered[k] = v
+	}
+	filtered["hits"] = filteredHits
+	return filtered
+}
+
+// severityNumber returns v as a decimal if it is a number or a
+// string holding one.
+func severityNumber(v interface{}) (decimal.Decimal, bool) {
+	var s string
+	switch t := v.(type) {
+	case json.Number:
+		s = t.String()
+	case float64:
+		return decimal.NewFromFloat(t), true
+	case int:
+		return decimal.New(int64(t), 0), true
+	case string:
+		s = t
+	default:
+		return decimal.Decimal{}, false
+	}
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return decimal.Decimal{}, false
+	}
+	return d, true
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseSeverityFilter(t *testing.T) {
+	cases := []struct {
+		name    string
+		minimum interface{}
+		levels  []string
+		err     bool
+	}{
+		{"default-levels", "warn", nil, false},
+		{"case-insensitive", "ERROR", nil, false},
+		{"custom-levels", "p2", []string{"p4", "p3", "p2", "p1"}, false},
+		{"number", json.Number("3"), nil, false},
+		{"numeric-string", "3.5", nil, false},
+		{"unknown-level", "fatal", nil, true},
+		{"duplicate-level", "high", []string{"low", "high", "HIGH"}, true},
+		{"empty", "", nil, true},
+		{"missing", nil, nil, true},
+		{"boolean", true, nil, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseSeverityFilter("severity", tc.minimum, tc.levels)
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSeverityFilterPasses(t *testing.T) {
+	cases := []struct {
+		name    string
+		minimum interface{}
+		levels  []string
+		values  map[interface{}]bool
+	}{
+		{
+			"ordered-enum",
+			"warn",
+			nil,
+			map[interface{}]bool{
+				"debug": false,
+				"info":  false,
+				"warn":  true,
+				"error": true,
+				"crit":  true,
+				"CRIT":  true,
+				"Info":  false,
+			},
+		},
+		{
+			"custom-levels",
+			"medium",
+			[]string{"low", "medium", "high"},
+			map[interface{}]bool{
+				"low":    false,
+				"medium": true,
+				"high":   true,
+			},
+		},
+		{
+			"unknown-values-kept",
+			"error",
+			nil,
+			map[interface{}]bool{
+				"verbose":        true,
+				nil:              true,
+				json.Number("1"): true,
+			},
+		},
+		{
+			"numeric",
+			json.Number("3"),
+			nil,
+			map[interface{}]bool{
+				json.Number("2"):   false,
+				json.Number("2.9"): false,
+				json.Number("3"):   true,
+				json.Number("7"):   true,
+				"5":                true,
+				"error":            true,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := ParseSeverityFilter("severity", tc.minimum, tc.levels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for v, expected := range tc.values {
+				if got := f.Passes(v); got != expected {
+					t.Errorf("unexpected result for severity %v (got %t, expected %t)", v, got, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestSeverityFilterFilter(t *testing.T) {
+	f, err := ParseSeverityFilter("log.level", "warn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hit := func(level string) interface{} {
+		return map[string]interface{}{
+			"_source": map[string]interface{}{
+				"log": map[string]interface{}{"level": level},
+			},
+		}
+	}
+	resp := map[string]interface{}{
+		"took": json.Number("3"),
+		"hits": map[string]interface{}{
+			"total": json.Number("3"),
+			"hits":  []interface{}{hit("info"), hit("error"), hit("warn")},
+		},
+	}
+
+	filtered := f.Filter(resp)
+	hits := filtered["hits"].(map[string]interface{})["hits"].([]interface{})
+	if len(hits) != 2 {
+		t.Fatalf("expected 2 hits to be kept, got %d", len(hits))
+	}
+	if filtered["took"] != json.Number("3") {
+		t.Fatal("other fields of the response should be kept")
+	}
+	if n := len(resp["hits"].(map[string]interface{})["hits"].([]interface{})); n != 3 {
+		t.Fatalf("the original response should not be modified (it has %d hits)", n)
+	}
+}
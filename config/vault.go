@@ -0,0 +1,93 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	envVaultAddr = "VAULT_ADDR"
+
+	defaultVaultRenewBefore   = 5 * time.Minute
+	defaultVaultUsernameField = "username"
+	defaultVaultPasswordField = "password"
+)
+
+// VaultConfig represents the 'elasticsearch.vault' field of the
+// main configuration file. It configures where the credentials
+// used to authenticate to Elasticsearch are read from in Vault.
+type VaultConfig struct {
+	// Address is the address of the Vault server. If empty, the
+	// VAULT_ADDR environment variable will be used. This value
+	// should come from the 'elasticsearch.vault.address' field of
+	// the main configuration file
+	Address string `json:"address"`
+
+	// Path is the path of the secret holding the credentials, e.g.
+	// 'database/creds/go-elasticsearch-alerts'. This value should
+	// come from the 'elasticsearch.vault.path' field of the main
+	// configuration file
+	Path string `json:"path"`
+
+	// UsernameField and PasswordField are the paths (in dot
+	// notation) of the username and password within the 'data'
+	// field of the secret. They default to 'username' and
+	// 'password'. These values should come from the
+	// 'elasticsearch.vault.username_field' and
+	// 'elasticsearch.vault.password_field' fields of the main
+	// configuration file
+	UsernameField string `json:"username_field"`
+	PasswordField string `json:"password_field"`
+
+	// RenewBeforeRaw is how long before the lease of the
+	// credentials expires that new credentials are read. This
+	// value should come from the 'elasticsearch.vault.renew_before'
+	// field of the main configuration file
+	RenewBeforeRaw string `json:"renew_before"`
+
+	// RenewBefore is the parsed value of RenewBeforeRaw
+	RenewBefore time.Duration `json:"-"`
+}
+
+func (vc *VaultConfig) validate() error {
+	if vc.Address == "" {
+		vc.Address = os.Getenv(envVaultAddr)
+	}
+	if vc.Address == "" {
+		return xerrors.Errorf("field 'elasticsearch.vault.address' must not be empty unless %s is set", envVaultAddr)
+	}
+	if vc.Path == "" {
+		return errors.New("field 'elasticsearch.vault.path' must not be empty")
+	}
+	if vc.UsernameField == "" {
+		vc.UsernameField = defaultVaultUsernameField
+	}
+	if vc.PasswordField == "" {
+		vc.PasswordField = defaultVaultPasswordField
+	}
+
+	var err error
+	if vc.RenewBefore, err = parseDuration("elasticsearch.vault.renew_before", vc.RenewBeforeRaw); err != nil {
+		return err
+	}
+	if vc.RenewBefore == 0 {
+		vc.RenewBefore = defaultVaultRenewBefore
+	}
+	return nil
+}
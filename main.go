@@ -19,21 +19,58 @@ import (
 	"os"
 
 	cmd "github.com/morningconsult/go-elasticsearch-alerts/command"
+	"github.com/morningconsult/go-elasticsearch-alerts/config"
 	"github.com/morningconsult/go-elasticsearch-alerts/version"
 )
 
-const banner = "Go Elasticsearch Alerts version %v, commit %v, built %v\n"
-
 func main() {
-	var versionFlag bool
+	var versionFlag, onceFlag, noStateFlag, printConfigFlag bool
+	var configDir string
 	flag.BoolVar(&versionFlag, "version", false, "print version and exit")
+	flag.BoolVar(&onceFlag, "once", false, "run each rule once, send any alerts, and exit")
+	flag.BoolVar(&noStateFlag, "no-state", false, "with -once, neither read nor write the state indices")
+	flag.BoolVar(&printConfigFlag, "print-config", false,
+		"print the effective configuration as JSON (secrets are redacted) and exit")
+	flag.StringVar(&configDir, "config-dir", "", "load config.json and every other *.json rule file from this directory")
+	flag.BoolVar(&cmd.LogRequests, "log-requests", false,
+		"log every HTTP request to Elasticsearch and the outputs and its response in full (secrets are redacted)")
 	flag.Parse()
 
+	// The configuration is located through the environment so that
+	// the rules are reloaded from the same directory on SIGHUP
+	if configDir != "" {
+		os.Setenv(config.EnvConfigDir, configDir) // nolint: errcheck
+	}
+
 	// Exit safely when version is used
-	if versionFlag {
-		fmt.Printf(banner, version.Version, version.Commit, version.Date)
+	if versionFlag || flag.Arg(0) == "version" {
+		fmt.Printf("Go Elasticsearch Alerts %s\n", version.String())
 		os.Exit(0)
 	}
 
+	if flag.Arg(0) == "test-output" {
+		os.Exit(cmd.RunTestOutput(flag.Arg(1)))
+	}
+
+	if flag.Arg(0) == "backtest" {
+		os.Exit(cmd.RunBacktest(flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "status" {
+		os.Exit(cmd.RunStatus())
+	}
+
+	if flag.Arg(0) == "config-schema" {
+		os.Exit(cmd.RunConfigSchema(flag.Arg(1)))
+	}
+
+	if printConfigFlag {
+		os.Exit(cmd.RunPrintConfig())
+	}
+
+	if onceFlag {
+		os.Exit(cmd.RunOnce(!noStateFlag))
+	}
+
 	os.Exit(cmd.Run())
 }
@@ -0,0 +1,91 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	if !f.Now().Equal(start) {
+		t.Fatalf("unexpected time (got %s, expected %s)", f.Now(), start)
+	}
+
+	select {
+	case <-f.After(0):
+	default:
+		t.Fatal("After(0) should fire immediately")
+	}
+
+	short := f.After(time.Minute)
+	long := f.After(time.Hour)
+	f.BlockUntil(2)
+
+	f.Advance(30 * time.Second)
+	select {
+	case <-short:
+		t.Fatal("After(1m) fired before a minute passed")
+	default:
+	}
+
+	f.Advance(30 * time.Second)
+	select {
+	case now := <-short:
+		if expected := start.Add(time.Minute); !now.Equal(expected) {
+			t.Fatalf("unexpected time sent (got %s, expected %s)", now, expected)
+		}
+	default:
+		t.Fatal("After(1m) did not fire after a minute passed")
+	}
+
+	select {
+	case <-long:
+		t.Fatal("After(1h) fired before an hour passed")
+	default:
+	}
+
+	f.Advance(time.Hour)
+	select {
+	case <-long:
+	default:
+		t.Fatal("After(1h) did not fire after an hour passed")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Now())
+
+	done := make(chan struct{})
+	go func() {
+		f.BlockUntil(1)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("BlockUntil returned before anything was waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	f.After(time.Second)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("BlockUntil did not return once a caller was waiting")
+	}
+}
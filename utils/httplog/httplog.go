@@ -0,0 +1,197 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package httplog logs the full HTTP requests made by a client and
+// the responses it receives, with their secrets redacted, for use
+// when debugging.
+package httplog
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// Redacted replaces the secrets of the logged requests and responses.
+const Redacted = "[REDACTED]"
+
+// redactedHeaders are the headers whose values are never logged.
+var redactedHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"Set-Cookie":           true,
+	"X-Api-Key":            true,
+	"X-Vault-Token":        true,
+	"X-Amz-Security-Token": true,
+}
+
+// redactedParams are the query parameters whose values are never
+// logged.
+var redactedParams = map[string]bool{
+	"token":        true,
+	"access_token": true,
+	"api_key":      true,
+	"key":          true,
+	"password":     true,
+	"secret":       true,
+	"signature":    true,
+	"sig":          true,
+}
+
+// webhookPrefixes are the prefixes of the paths of webhook URLs, such
+// as those of Slack ("/services/T0/B0/secret") and Mattermost
+// ("/hooks/secret"), the rest of which is the secret of the webhook.
+var webhookPrefixes = []string{"/services/", "/hooks/"}
+
+// Transport is an http.RoundTripper which logs each request sent by
+// Base and the response to it.
+type Transport struct {
+	// Base sends the requests. If nil, http.DefaultTransport is used
+	Base http.RoundTripper
+
+	Logger hclog.Logger
+
+	// OmitBodies is whether the bodies of the requests and responses
+	// are left out of the logs, e.g. for a client whose responses
+	// carry secrets which Redact cannot find, such as that of Vault
+	OmitBodies bool
+}
+
+// Wrap returns a copy of client which logs its requests and
+// responses with the logger.
+func Wrap(client *http.Client, logger hclog.Logger) *http.Client {
+	wrapped := *client
+	wrapped.Transport = &Transport{Base: client.Transport, Logger: logger}
+	return &wrapped
+}
+
+// WrapHeaders is like Wrap except that the bodies of the requests
+// and responses are not logged.
+func WrapHeaders(client *http.Client, logger hclog.Logger) *http.Client {
+	wrapped := *client
+	wrapped.Transport = &Transport{Base: client.Transport, Logger: logger, OmitBodies: true}
+	return &wrapped
+}
+
+// RoundTrip logs the request, sends it, and logs the response.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	dump, err := httputil.DumpRequestOut(req, !t.OmitBodies)
+	if err != nil {
+		t.Logger.Warn("error dumping HTTP request", "url", RedactURL(req.URL), "error", err)
+	} else {
+		t.Logger.Info("HTTP request", "dump", Redact(dump))
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		t.Logger.Info("HTTP request failed", "url", RedactURL(req.URL), "error", err)
+		return nil, err
+	}
+
+	if dump, err = httputil.DumpResponse(resp, !t.OmitBodies); err != nil {
+		t.Logger.Warn("error dumping HTTP response", "url", RedactURL(req.URL), "error", err)
+	} else {
+		t.Logger.Info("HTTP response", "url", RedactURL(req.URL), "dump", Redact(dump))
+	}
+	return resp, nil
+}
+
+// Redact returns a dumped request or response with the values of
+// secret headers, the secret query parameters of the request line,
+// and the secrets of webhook paths replaced by Redacted. Lines are
+// separated by "\n" rather than "\r\n".
+func Redact(dump []byte) string {
+	var (
+		out     strings.Builder
+		scanner = bufio.NewScanner(bytes.NewReader(dump))
+		first   = true
+		headers = true
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), len(dump)+1)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case first:
+			line = redactRequestLine(line)
+			first = false
+		case headers && strings.TrimSpace(line) == "":
+			headers = false
+		case headers:
+			if i := strings.Index(line, ":"); i > 0 && redactedHeaders[http.CanonicalHeaderKey(line[:i])] {
+				line = line[:i+1] + " " + Redacted
+			}
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+	return strings.TrimRight(out.String(), "\n")
+}
+
+// redactRequestLine redacts the URL of the first line of a dumped
+// request (e.g. "POST /services/T0/B0/secret HTTP/1.1"). The status
+// line of a response is returned as-is.
+func redactRequestLine(line string) string {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || strings.HasPrefix(parts[0], "HTTP/") {
+		return line
+	}
+	u, err := url.ParseRequestURI(parts[1])
+	if err != nil {
+		return line
+	}
+	parts[1] = RedactURL(u)
+	return strings.Join(parts, " ")
+}
+
+// RedactURL returns the URL with its password, the values of its
+// secret query parameters, and the secret of a webhook path replaced
+// by Redacted.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	r := *u
+	if _, ok := r.User.Password(); r.User != nil && ok {
+		r.User = url.UserPassword(r.User.Username(), Redacted)
+	}
+	for _, prefix := range webhookPrefixes {
+		if strings.HasPrefix(r.Path, prefix) && len(r.Path) > len(prefix) {
+			r.Path = prefix + Redacted
+			r.RawPath = ""
+			break
+		}
+	}
+	if r.RawQuery != "" {
+		query := r.Query()
+		for name := range query {
+			if redactedParams[strings.ToLower(name)] {
+				query[name] = []string{Redacted}
+			}
+		}
+		r.RawQuery = query.Encode()
+	}
+	s := r.String()
+	// Keep the marker readable rather than percent-encoded
+	return strings.NewReplacer(url.PathEscape(Redacted), Redacted, url.QueryEscape(Redacted), Redacted).Replace(s)
+}
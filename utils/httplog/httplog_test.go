@@ -0,0 +1,180 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package httplog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "cookie-secret"})
+		w.Write([]byte(`{"hits":{"total":0}}`)) // nolint: errcheck
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	client := Wrap(ts.Client(), hclog.New(&hclog.LoggerOptions{Output: &buf}))
+
+	u := ts.URL + "/services/T000/B000/webhook-secret?token=query-secret&pretty=true"
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(`{"query":{"match_all":{}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer header-secret")
+	req.Header.Set("X-Api-Key", "key-secret")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The response body can still be read after being dumped
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"hits":{"total":0}}` {
+		t.Fatalf("unexpected response body %q", body)
+	}
+
+	logged := buf.String()
+	for _, secret := range []string{"header-secret", "key-secret", "query-secret", "webhook-secret", "cookie-secret"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("logged output contains %q:\n%s", secret, logged)
+		}
+	}
+	for _, expected := range []string{
+		"Authorization: " + Redacted,
+		"/services/" + Redacted,
+		"token=" + Redacted,
+		"pretty=true",
+		"application/json",
+		`{"query":{"match_all":{}}}`,
+		`{"hits":{"total":0}}`,
+	} {
+		if !strings.Contains(logged, expected) {
+			t.Errorf("logged output does not contain %q:\n%s", expected, logged)
+		}
+	}
+}
+
+func TestWrapHeaders(t *testing.T) {
+	const secret = `{"auth":{"client_token":"token-secret"},"data":{"username":"elastic","password":"password-secret"}}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(secret)) // nolint: errcheck
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	client := WrapHeaders(ts.Client(), hclog.New(&hclog.LoggerOptions{Output: &buf}))
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/v1/auth/userpass/login/elastic",
+		strings.NewReader(`{"password":"login-secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != secret {
+		t.Fatalf("unexpected response body %q", body)
+	}
+
+	logged := buf.String()
+	for _, secret := range []string{"token-secret", "password-secret", "login-secret"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("logged output contains %q:\n%s", secret, logged)
+		}
+	}
+	for _, expected := range []string{"PUT /v1/auth/userpass/login/elastic", "200 OK", "application/json"} {
+		if !strings.Contains(logged, expected) {
+			t.Errorf("logged output does not contain %q:\n%s", expected, logged)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	cases := []struct {
+		name     string
+		dump     string
+		expected string
+	}{
+		{
+			"request",
+			"GET /_search HTTP/1.1\r\nHost: es\r\nAuthorization: Basic dXNlcjpwYXNz\r\n\r\nAuthorization: body",
+			"GET /_search HTTP/1.1\nHost: es\nAuthorization: " + Redacted + "\n\nAuthorization: body",
+		},
+		{
+			"lowercase-header",
+			"GET / HTTP/1.1\r\nproxy-authorization: Basic dXNlcjpwYXNz\r\n",
+			"GET / HTTP/1.1\nproxy-authorization: " + Redacted,
+		},
+		{
+			"response",
+			"HTTP/1.1 200 OK\r\nSet-Cookie: session=secret\r\n\r\nok",
+			"HTTP/1.1 200 OK\nSet-Cookie: " + Redacted + "\n\nok",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Redact([]byte(tc.dump)); got != tc.expected {
+				t.Fatalf("unexpected redacted dump:\n%q\nexpected:\n%q", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	cases := []struct {
+		raw      string
+		expected string
+	}{
+		{"https://hooks.slack.com/services/T000/B000/XXXX", "https://hooks.slack.com/services/" + Redacted},
+		{"https://chat.example.com/hooks/abcdef", "https://chat.example.com/hooks/" + Redacted},
+		{"https://user:pass@es:9200/_search?pretty=true", "https://user:" + Redacted + "@es:9200/_search?pretty=true"},
+		{"https://api.example.com/v1?API_KEY=abc&q=1", "https://api.example.com/v1?API_KEY=" + Redacted + "&q=1"},
+		{"http://es:9200/logs-*/_search", "http://es:9200/logs-*/_search"},
+	}
+
+	for _, tc := range cases {
+		u, err := url.Parse(tc.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := RedactURL(u); got != tc.expected {
+			t.Errorf("unexpected redacted URL (got %q, expected %q)", got, tc.expected)
+		}
+	}
+}
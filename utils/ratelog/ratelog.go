@@ -0,0 +1,202 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package ratelog limits how often identical warnings and errors are
+// logged, so that a rule which fails on every run (e.g. because of a
+// bad mapping or an unreachable host) does not flood the logs.
+package ratelog
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+// DefaultWindow is how long identical messages are suppressed for
+// after being logged, unless another window is given to New.
+const DefaultWindow = 10 * time.Minute
+
+// Ensure Logger adheres to the hclog.Logger interface.
+var _ hclog.Logger = (*Logger)(nil)
+
+// Logger is an hclog.Logger which logs the first of identical
+// warnings and errors (those with the same level, message and
+// arguments, logged by loggers of the same name) and suppresses
+// those which follow within its window. Once the window has ended,
+// the number of suppressed messages is logged as a summary of the
+// message, e.g. "error executing query (repeated 9 more times within
+// 10m0s)". Messages below the warning level are always logged.
+type Logger struct {
+	hclog.Logger
+	limiter *limiter
+}
+
+// limiter tracks the identical messages of a Logger and of those
+// derived from it (e.g. with Named).
+type limiter struct {
+	window time.Duration
+	clk    clock.Clock
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// entry is a message which was logged at since and suppressed
+// repeated times since.
+type entry struct {
+	logger   hclog.Logger
+	level    hclog.Level
+	msg      string
+	args     []interface{}
+	since    time.Time
+	repeated int
+}
+
+// New returns a Logger which limits the warnings and errors logged
+// with logger. If window is not positive, DefaultWindow is used, and
+// if clk is nil, the real clock is used.
+func New(logger hclog.Logger, window time.Duration, clk clock.Clock) *Logger {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	if clk == nil {
+		clk = clock.Real()
+	}
+	return &Logger{
+		Logger: logger,
+		limiter: &limiter{
+			window:  window,
+			clk:     clk,
+			entries: make(map[string]*entry),
+		},
+	}
+}
+
+// Log logs the message unless it is an identical warning or error
+// logged within the window.
+func (l *Logger) Log(level hclog.Level, msg string, args ...interface{}) {
+	for _, e := range l.limiter.observe(l.Logger, level, msg, args) {
+		e.logger.Log(e.level, e.msg, e.args...)
+	}
+}
+
+// Trace logs the message at the trace level.
+func (l *Logger) Trace(msg string, args ...interface{}) {
+	l.Log(hclog.Trace, msg, args...)
+}
+
+// Debug logs the message at the debug level.
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.Log(hclog.Debug, msg, args...)
+}
+
+// Info logs the message at the info level.
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.Log(hclog.Info, msg, args...)
+}
+
+// Warn logs the message at the warning level unless it was logged
+// within the window.
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.Log(hclog.Warn, msg, args...)
+}
+
+// Error logs the message at the error level unless it was logged
+// within the window.
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.Log(hclog.Error, msg, args...)
+}
+
+// With returns a Logger which limits its messages along with l.
+func (l *Logger) With(args ...interface{}) hclog.Logger {
+	return &Logger{Logger: l.Logger.With(args...), limiter: l.limiter}
+}
+
+// Named returns a Logger which limits its messages along with l.
+func (l *Logger) Named(name string) hclog.Logger {
+	return &Logger{Logger: l.Logger.Named(name), limiter: l.limiter}
+}
+
+// ResetNamed returns a Logger which limits its messages along with
+// l.
+func (l *Logger) ResetNamed(name string) hclog.Logger {
+	return &Logger{Logger: l.Logger.ResetNamed(name), limiter: l.limiter}
+}
+
+// observe records the message logged with logger and returns the
+// messages to log: the summaries of the messages whose window has
+// ended, followed by the message itself unless it is suppressed. If
+// the message was suppressed and its window has ended, its summary
+// counts it and it starts a new window.
+func (lim *limiter) observe(logger hclog.Logger, level hclog.Level, msg string, args []interface{}) []*entry {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+
+	now := lim.clk.Now()
+	key := fmt.Sprintf("%s\x00%d\x00%s\x00%v", logger.Name(), level, msg, args)
+	if level >= hclog.Warn {
+		if e, ok := lim.entries[key]; ok {
+			if now.Sub(e.since) < lim.window {
+				e.repeated++
+				return lim.expired(now)
+			}
+			if e.repeated > 0 {
+				e.repeated++
+				summary := e.summary(lim.window)
+				e.since, e.repeated = now, 0
+				return append(lim.expired(now), summary)
+			}
+		}
+	}
+
+	// The message is logged in full
+	logged := &entry{logger: logger, level: level, msg: msg, args: args}
+	if level >= hclog.Warn {
+		lim.entries[key] = &entry{logger: logger, level: level, msg: msg, args: args, since: now}
+	}
+	return append(lim.expired(now), logged)
+}
+
+// expired forgets the messages whose window has ended and returns
+// the summaries of those which were suppressed, in the order in which
+// they were first logged.
+func (lim *limiter) expired(now time.Time) []*entry {
+	var summaries []*entry
+	for key, e := range lim.entries {
+		if now.Sub(e.since) < lim.window {
+			continue
+		}
+		delete(lim.entries, key)
+		if e.repeated > 0 {
+			summaries = append(summaries, e)
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].since.Before(summaries[j].since)
+	})
+	for i, e := range summaries {
+		summaries[i] = e.summary(lim.window)
+	}
+	return summaries
+}
+
+// summary returns the summary of the suppressed repetitions of the
+// message.
+func (e *entry) summary(window time.Duration) *entry {
+	msg := fmt.Sprintf("%s (repeated %d more times within %s)", e.msg, e.repeated, window)
+	return &entry{logger: e.logger, level: e.level, msg: msg, args: e.args}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ratelog
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/morningconsult/go-elasticsearch-alerts/utils/clock"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	fc := clock.NewFake(time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC))
+	logger := New(hclog.New(&hclog.LoggerOptions{
+		Output:      &buf,
+		Level:       hclog.Trace,
+		DisableTime: true,
+	}), 10*time.Minute, fc)
+	mapping := errors.New("bad mapping")
+	unreachable := errors.New("connection refused")
+
+	steps := []struct {
+		name     string
+		advance  time.Duration
+		log      func()
+		expected []string
+	}{
+		{
+			"first",
+			0,
+			func() { logger.Error(`[Rule: "a"] error executing query`, "error", mapping) },
+			[]string{`[ERROR] [Rule: "a"] error executing query: error="bad mapping"`},
+		},
+		{
+			"repeated",
+			time.Minute,
+			func() {
+				for i := 0; i < 3; i++ {
+					logger.Error(`[Rule: "a"] error executing query`, "error", mapping)
+				}
+			},
+			nil,
+		},
+		{
+			"other-error",
+			time.Minute,
+			func() { logger.Error(`[Rule: "a"] error executing query`, "error", unreachable) },
+			[]string{`[ERROR] [Rule: "a"] error executing query: error="connection refused"`},
+		},
+		{
+			"other-logger",
+			0,
+			func() { logger.Named("alert_handler").Error(`[Rule: "a"] error executing query`, "error", mapping) },
+			[]string{`[ERROR] alert_handler: [Rule: "a"] error executing query: error="bad mapping"`},
+		},
+		{
+			"info-not-limited",
+			0,
+			func() {
+				logger.Info(`[Rule: "b"] scheduling query now`)
+				logger.Info(`[Rule: "b"] scheduling query now`)
+			},
+			[]string{`[INFO]  [Rule: "b"] scheduling query now`, `[INFO]  [Rule: "b"] scheduling query now`},
+		},
+		{
+			// The window of the first error has ended, so this one
+			// is counted in its summary
+			"window-ended",
+			8 * time.Minute,
+			func() { logger.Error(`[Rule: "a"] error executing query`, "error", mapping) },
+			[]string{
+				`[ERROR] [Rule: "a"] error executing query (repeated 4 more times within 10m0s): error="bad mapping"`,
+			},
+		},
+		{
+			"suppressed-again",
+			time.Minute,
+			func() { logger.Error(`[Rule: "a"] error executing query`, "error", mapping) },
+			nil,
+		},
+		{
+			// The suppressed message is summarized by the next
+			// message logged once its window ended
+			"summary-of-quiet-message",
+			10 * time.Minute,
+			func() { logger.Info(`[Rule: "a"] query ran successfully`) },
+			[]string{
+				`[ERROR] [Rule: "a"] error executing query (repeated 1 more times within 10m0s): error="bad mapping"`,
+				`[INFO]  [Rule: "a"] query ran successfully`,
+			},
+		},
+		{
+			"logged-again",
+			0,
+			func() { logger.Error(`[Rule: "a"] error executing query`, "error", mapping) },
+			[]string{`[ERROR] [Rule: "a"] error executing query: error="bad mapping"`},
+		},
+	}
+
+	for _, step := range steps {
+		fc.Advance(step.advance)
+		buf.Reset()
+		step.log()
+
+		var lines []string
+		if out := strings.TrimSpace(buf.String()); out != "" {
+			lines = strings.Split(out, "\n")
+		}
+		if len(lines) != len(step.expected) {
+			t.Fatalf("%s: unexpected output (got %q, expected %q)", step.name, lines, step.expected)
+		}
+		for i := range lines {
+			if lines[i] != step.expected[i] {
+				t.Fatalf("%s: unexpected line %d (got %q, expected %q)", step.name, i+1, lines[i], step.expected[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package schema generates JSON Schema documents from Go types
+// using their struct tags, so that the schema of the
+// configuration files stays in sync with the code that
+// decodes them.
+package schema
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Draft is the JSON Schema draft of the generated documents.
+const Draft = "http://json-schema.org/draft-07/schema#"
+
+// Schemer is implemented by types whose schema cannot be derived
+// from their Go type alone (e.g. maps with well-known keys).
+type Schemer interface {
+	JSONSchema() map[string]interface{}
+}
+
+// Generator generates the schema of Go values.
+type Generator struct {
+	// Tag is the struct tag from which property names are read
+	// (e.g. "json" or "mapstructure"). Fields without this tag
+	// or whose name is "-" are omitted from the schema
+	Tag string
+
+	// Overrides replace the generated schema of the given types
+	Overrides map[reflect.Type]map[string]interface{}
+}
+
+// Document returns the schema of v as a standalone document
+// with the given title.
+func (g *Generator) Document(title string, v interface{}) map[string]interface{} {
+	s := g.Schema(v)
+	s["$schema"] = Draft
+	s["title"] = title
+	return s
+}
+
+// Schema returns the schema of v.
+func (g *Generator) Schema(v interface{}) map[string]interface{} {
+	s := g.schema(reflect.TypeOf(v))
+	if s == nil {
+		return map[string]interface{}{}
+	}
+	return s
+}
+
+var schemerType = reflect.TypeOf((*Schemer)(nil)).Elem()
+
+func (g *Generator) schema(t reflect.Type) map[string]interface{} { // nolint: gocyclo
+	if s, ok := g.Overrides[t]; ok {
+		return s
+	}
+
+	if t.Implements(schemerType) {
+		return reflect.Zero(t).Interface().(Schemer).JSONSchema()
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		g.properties(t, properties)
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string"}
+		}
+		s := map[string]interface{}{"type": "array"}
+		if items := g.schema(t.Elem()); len(items) > 0 {
+			s["items"] = items
+		}
+		return s
+	case reflect.Map:
+		s := map[string]interface{}{"type": "object"}
+		if values := g.schema(t.Elem()); len(values) > 0 {
+			s["additionalProperties"] = values
+		}
+		return s
+	case reflect.Interface:
+		// Any value is accepted
+		return map[string]interface{}{}
+	default:
+		// Functions, channels, etc. cannot be represented
+		return nil
+	}
+}
+
+// properties adds the schema of each tagged field of the struct
+// type t to properties. Embedded structs without a name, or
+// whose tag has the 'squash' option, are flattened into t.
+func (g *Generator) properties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup(g.Tag)
+		name, opts := splitTag(tag)
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && (name == "" || strings.Contains(opts, "squash")) {
+			g.properties(ft, properties)
+			continue
+		}
+
+		if !ok || name == "" || name == "-" || f.PkgPath != "" {
+			continue
+		}
+
+		if s := g.schema(f.Type); s != nil {
+			properties[name] = s
+		}
+	}
+}
+
+func splitTag(tag string) (string, string) {
+	if i := strings.Index(tag, ","); i != -1 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package schema
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type testInner struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+type testEmbedded struct {
+	Region string `json:"region" mapstructure:"region"`
+}
+
+type testConfig struct {
+	testEmbedded `mapstructure:",squash"`
+
+	Name     string            `json:"name" mapstructure:"name"`
+	Enabled  bool              `json:"enabled"`
+	Ratio    float64           `json:"ratio"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels"`
+	Body     interface{}       `json:"body"`
+	Inner    *testInner        `json:"inner"`
+	Ignored  string            `json:"-"`
+	Untagged string
+	Callback func()       `json:"callback"`
+	Client   *http.Client `json:"-"`
+	custom   testCustom
+	Custom   testCustom `json:"custom"`
+}
+
+type testCustom map[string]interface{}
+
+func (testCustom) JSONSchema() map[string]interface{} {
+	return map[string]interface{}{"required": []string{"field"}}
+}
+
+func TestSchema(t *testing.T) {
+	cases := []struct {
+		name      string
+		generator *Generator
+		expected  map[string]interface{}
+	}{
+		{
+			"json",
+			&Generator{Tag: "json"},
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"region":  map[string]interface{}{"type": "string"},
+					"name":    map[string]interface{}{"type": "string"},
+					"enabled": map[string]interface{}{"type": "boolean"},
+					"ratio":   map[string]interface{}{"type": "number"},
+					"tags": map[string]interface{}{
+						"type":  "array",
+						"items": map[string]interface{}{"type": "string"},
+					},
+					"labels": map[string]interface{}{
+						"type":                 "object",
+						"additionalProperties": map[string]interface{}{"type": "string"},
+					},
+					"body": map[string]interface{}{},
+					"inner": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"host": map[string]interface{}{"type": "string"},
+							"port": map[string]interface{}{"type": "integer"},
+						},
+					},
+					"custom": map[string]interface{}{"required": []string{"field"}},
+				},
+			},
+		},
+		{
+			"mapstructure",
+			&Generator{Tag: "mapstructure"},
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"region": map[string]interface{}{"type": "string"},
+					"name":   map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+		{
+			"override",
+			&Generator{
+				Tag: "mapstructure",
+				Overrides: map[reflect.Type]map[string]interface{}{
+					reflect.TypeOf(testConfig{}): {"type": "string"},
+				},
+			},
+			map[string]interface{}{"type": "string"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.generator.Schema(&testConfig{})
+			if !cmp.Equal(tc.expected, got) {
+				t.Errorf("Schemas differ:\n%v", cmp.Diff(tc.expected, got))
+			}
+		})
+	}
+}
+
+func TestDocument(t *testing.T) {
+	g := &Generator{Tag: "json"}
+	doc := g.Document("Test", testInner{})
+	if doc["$schema"] != Draft {
+		t.Errorf("unexpected $schema (got %v, expected %q)", doc["$schema"], Draft)
+	}
+	if doc["title"] != "Test" {
+		t.Errorf("unexpected title (got %v, expected %q)", doc["title"], "Test")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/xerrors"
+)
+
+// SecretFileEnvSuffix is appended to the name of an environment
+// variable holding a secret to get the name of the environment
+// variable holding the path to a file containing the secret.
+const SecretFileEnvSuffix = "_FILE"
+
+// ReadSecretFile returns the contents of the file at the given
+// path without its trailing newline (if any), as is common in
+// files created with echo or mounted as Docker or Kubernetes
+// secrets.
+func ReadSecretFile(path string) (string, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSuffix(string(data), "\n")
+	return strings.TrimSuffix(s, "\r"), nil
+}
+
+// Getenv returns the value of the environment variable named by
+// the key. If that variable is empty, it instead returns the
+// contents (per ReadSecretFile) of the file whose path is the
+// value of the variable named by the key and SecretFileEnvSuffix,
+// e.g. FOO_PASSWORD_FILE for FOO_PASSWORD. It returns an error if
+// both variables are set or the file cannot be read.
+func Getenv(key string) (string, error) {
+	v := os.Getenv(key)
+	path := os.Getenv(key + SecretFileEnvSuffix)
+	if path == "" {
+		return v, nil
+	}
+	if v != "" {
+		return "", xerrors.Errorf("only one of %s and %s%s may be set", key, key, SecretFileEnvSuffix)
+	}
+	v, err := ReadSecretFile(path)
+	if err != nil {
+		return "", xerrors.Errorf("error reading %s%s: %v", key, SecretFileEnvSuffix, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetenv(t *testing.T) {
+	const key = "GO_ELASTICSEARCH_ALERTS_TEST_SECRET"
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "secret")
+	if err = ioutil.WriteFile(secretFile, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		value  string
+		file   string
+		output string
+		err    bool
+	}{
+		{"unset", "", "", "", false},
+		{"value", "hunter2", "", "hunter2", false},
+		{"file", "", secretFile, "hunter2", false},
+		{"both", "hunter2", secretFile, "", true},
+		{"missing-file", "", filepath.Join(dir, "missing"), "", true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			os.Setenv(key, tc.value)
+			defer os.Unsetenv(key)
+			os.Setenv(key+SecretFileEnvSuffix, tc.file)
+			defer os.Unsetenv(key + SecretFileEnvSuffix)
+
+			v, err := Getenv(key)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tc.output {
+				t.Fatalf("got unexpected value (got %q, expected %q)", v, tc.output)
+			}
+		})
+	}
+}
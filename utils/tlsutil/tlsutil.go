@@ -0,0 +1,115 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package tlsutil builds the TLS configuration of the HTTP
+// clients used to communicate with Elasticsearch and the outputs.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"golang.org/x/xerrors"
+)
+
+// Config describes the certificates with which a client
+// connects to servers via TLS.
+type Config struct {
+	// CACert is the path to a PEM-encoded CA certificate file
+	// used to verify the certificates of servers. If empty, the
+	// system's CA certificates are used
+	CACert string
+
+	// ClientCert and ClientKey are the paths to a PEM-encoded
+	// client certificate and unencrypted private key presented
+	// to servers which require mutual TLS. Either both or
+	// neither must be set
+	ClientCert string
+	ClientKey  string
+
+	// ServerName is the name used as the SNI host and to verify
+	// the certificates of servers. If empty, the host of the
+	// request URL is used
+	ServerName string
+
+	// InsecureSkipVerify disables the verification of the
+	// certificates of servers. It should only be used for testing
+	InsecureSkipVerify bool
+}
+
+// Empty returns true if c changes nothing about the default
+// TLS configuration of a client.
+func (c *Config) Empty() bool {
+	return c == nil || *c == Config{}
+}
+
+// TLSConfig loads the certificates and creates a new *tls.Config.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ // nolint: gosec
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		return nil, xerrors.New("client certificate and client key must be set together")
+	}
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, xerrors.Errorf("error loading X509 key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CACert != "" {
+		caCert, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, xerrors.Errorf("error reading CA certificate file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// NewClient returns a copy of client whose transport uses the
+// TLS configuration described by c. The transport of client, if
+// any, must be an *http.Transport and is not modified.
+func NewClient(client *http.Client, c *Config) (*http.Client, error) {
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case *http.Transport:
+		transport = t.Clone()
+	case nil:
+		transport = cleanhttp.DefaultPooledTransport()
+	default:
+		return nil, xerrors.New("TLS settings require a client with an *http.Transport")
+	}
+
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 The Morning Consult, LLC or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//         https://www.apache.org/licenses/LICENSE-2.0
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+)
+
+func TestNewClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ts.Certificate().Raw)
+
+	clientCert, clientKey, clientDER := newClientCert(t, dir)
+	clientCA, err := x509.ParseCertificate(clientDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA)
+
+	mtls := httptest.NewUnstartedServer(ts.Config.Handler)
+	mtls.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	mtls.StartTLS()
+	defer mtls.Close()
+
+	cases := []struct {
+		name   string
+		url    string
+		config *Config
+		err    bool
+	}{
+		{
+			"unknown-ca",
+			ts.URL,
+			&Config{},
+			true,
+		},
+		{
+			"custom-ca",
+			ts.URL,
+			&Config{CACert: caFile},
+			false,
+		},
+		{
+			"insecure-skip-verify",
+			ts.URL,
+			&Config{InsecureSkipVerify: true},
+			false,
+		},
+		{
+			"mtls-without-client-cert",
+			mtls.URL,
+			&Config{CACert: caFile},
+			true,
+		},
+		{
+			"mtls",
+			mtls.URL,
+			&Config{CACert: caFile, ClientCert: clientCert, ClientKey: clientKey},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClient(cleanhttp.DefaultClient(), tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(tc.url)
+			if tc.err {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("expected an error but didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *Config
+		err    bool
+	}{
+		{"empty", &Config{}, false},
+		{"missing-ca-cert", &Config{CACert: "testdata/i-dont-exist.pem"}, true},
+		{"cert-without-key", &Config{ClientCert: "cert.pem"}, true},
+		{"key-without-cert", &Config{ClientKey: "key.pem"}, true},
+		{"missing-key-pair", &Config{ClientCert: "cert.pem", ClientKey: "key.pem"}, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.TLSConfig()
+			if tc.err && err == nil {
+				t.Fatal("expected an error but didn't receive one")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	var nilConfig *Config
+	if !nilConfig.Empty() || !(&Config{}).Empty() {
+		t.Fatal("expected an unset config to be empty")
+	}
+	if (&Config{InsecureSkipVerify: true}).Empty() {
+		t.Fatal("expected a config with InsecureSkipVerify set not to be empty")
+	}
+}
+
+// newClientCert creates a self-signed client certificate and
+// writes it and its key to dir. It returns the paths of the
+// certificate and key and the DER-encoded certificate.
+func newClientCert(t *testing.T, dir string) (string, string, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "go-elasticsearch-alerts"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile, der
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -14,7 +14,9 @@
 package utils
 
 import (
+	"encoding/json"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -77,8 +79,28 @@ func dequeue(is []string) []string {
 // GetAll recursively traverses the JSON via the provided path
 // and returns all elements matching the path. If no elements
 // are found, it will return [<nil>].
+//
+// If any element of the path ends with "[]" (e.g.
+// "aggregations.by_service.buckets[].by_status.buckets[]"), the
+// path is instead treated as a walk over nested aggregation
+// buckets. See GetBuckets for more information.
+//
+// The "key" of each bucket found within other buckets is prefixed
+// with the keys of those buckets, joined by " - ". Like GetBuckets,
+// buckets with a "key_as_string" are keyed by that value and
+// numeric and boolean keys (e.g. those of terms aggregations on
+// numeric or runtime fields) are converted to strings. Keyed buckets
+// (e.g. those of a filters aggregation) are treated like a list of
+// buckets keyed by their names, sorted by name.
 func GetAll(json map[string]interface{}, path string) []interface{} {
-	raw := getall(0, strings.Split(path, "."), json, "")
+	stack := strings.Split(path, ".")
+	for _, key := range stack {
+		if strings.HasSuffix(key, bucketsSuffix) {
+			return getbuckets(stack, json, "")
+		}
+	}
+
+	raw := getall(0, stack, json, "")
 	if v, ok := raw.([]interface{}); ok {
 		return v
 	}
@@ -107,6 +129,9 @@ func getall(i int, stack []string, elem interface{}, keychain string) interface{
 		if !ok {
 			return nil
 		}
+		if keyed, ok := v.(map[string]interface{}); ok && key == bucketsField {
+			v = keyedBuckets(keyed)
+		}
 		i++
 		return getall(i, stack, v, keychain)
 	}
@@ -120,7 +145,7 @@ func getall(i int, stack []string, elem interface{}, keychain string) interface{
 	for _, item := range buckets {
 		kc := keychain
 		if e, ok := item.(map[string]interface{}); ok {
-			if k, ok := e["key"].(string); ok {
+			if k := bucketKey(e); k != "" {
 				if kc == "" {
 					kc = k
 				} else {
@@ -143,20 +168,166 @@ func getall(i int, stack []string, elem interface{}, keychain string) interface{
 	return mod
 }
 
+// keyedBuckets returns the keyed buckets of an aggregation (e.g. a
+// filters aggregation, whose buckets are keyed by the names of the
+// filters) as a list, keyed with their names (see buckets).
+func keyedBuckets(keyed map[string]interface{}) []interface{} {
+	list := buckets(keyed)
+	elems := make([]interface{}, 0, len(list))
+	for _, b := range list {
+		elems = append(elems, b)
+	}
+	return elems
+}
+
+// addkey returns the bucket with its key (see bucketKey) prefixed
+// by the keys of the buckets it is nested within, if any.
 func addkey(i interface{}, keychain string) interface{} {
 	obj, ok := i.(map[string]interface{})
 	if !ok {
 		return i
 	}
-	key, ok := obj["key"].(string)
-	if !ok {
-		return obj
-	}
+	key := bucketKey(obj)
 	if key == "" {
 		return obj
 	}
 	if keychain != "" {
-		obj["key"] = keychain + " - " + key
+		key = keychain + " - " + key
 	}
+	if k, ok := obj["key"].(string); ok && k == key {
+		return obj
+	}
+	obj = copyBucket(obj)
+	obj["key"] = key
 	return obj
 }
+
+const (
+	// bucketsField is the field of an aggregation which holds its
+	// buckets, either as a list or keyed by their names
+	bucketsField = "buckets"
+
+	// bucketsSuffix marks an element of a path whose buckets
+	// should each be walked by GetBuckets
+	bucketsSuffix = "[]"
+
+	// BucketKeyDelimiter separates the keys of the buckets of
+	// each level of a nested aggregation in the composite keys
+	// returned by GetBuckets
+	BucketKeyDelimiter = "/"
+)
+
+// GetBuckets traverses the JSON via the provided path, walking
+// each bucket of every element of the path that ends with "[]",
+// and returns the buckets matching the last element of the path.
+// The "key" of each returned bucket is replaced with the keys of
+// the buckets it is nested within and its own key, joined by
+// BucketKeyDelimiter. For example, the path
+// "aggregations.by_service.buckets[].by_status.buckets[]" returns
+// every by_status bucket with keys such as "api/500". Both lists
+// of buckets and keyed buckets (e.g. those of a filters
+// aggregation, which are keyed by the names of the filters) are
+// supported. Buckets with a "key_as_string" (e.g. those of a
+// date_histogram aggregation) are keyed by that value.
+func GetBuckets(json map[string]interface{}, path string) []interface{} {
+	return getbuckets(strings.Split(path, "."), json, "")
+}
+
+func getbuckets(stack []string, elem interface{}, keychain string) []interface{} {
+	if len(stack) < 1 {
+		if m, ok := elem.(map[string]interface{}); ok && keychain != "" {
+			m = copyBucket(m)
+			m["key"] = keychain
+			return []interface{}{m}
+		}
+		if elem == nil {
+			return nil
+		}
+		return []interface{}{elem}
+	}
+
+	m, ok := elem.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	name := strings.TrimSuffix(stack[0], bucketsSuffix)
+	v, ok := m[name]
+	if !ok {
+		return nil
+	}
+	if name == stack[0] {
+		return getbuckets(stack[1:], v, keychain)
+	}
+
+	var mod []interface{}
+	for _, bucket := range buckets(v) {
+		kc := keychain
+		if k := bucketKey(bucket); k != "" {
+			if kc == "" {
+				kc = k
+			} else {
+				kc = kc + BucketKeyDelimiter + k
+			}
+		}
+		mod = append(mod, getbuckets(stack[1:], bucket, kc)...)
+	}
+	return mod
+}
+
+// buckets returns each of the buckets of an aggregation. Keyed
+// buckets are sorted by, and keyed with, their names.
+func buckets(elem interface{}) []map[string]interface{} {
+	var list []map[string]interface{}
+	switch v := elem.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if b, ok := item.(map[string]interface{}); ok {
+				list = append(list, b)
+			}
+		}
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			b, ok := v[name].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			b = copyBucket(b)
+			if _, ok := b["key"]; !ok {
+				b["key"] = name
+			}
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+func copyBucket(b map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(b))
+	for k, v := range b {
+		c[k] = v
+	}
+	return c
+}
+
+func bucketKey(bucket map[string]interface{}) string {
+	if k, ok := bucket["key_as_string"].(string); ok {
+		return k
+	}
+	switch k := bucket["key"].(type) {
+	case string:
+		return k
+	case json.Number:
+		return k.String()
+	case float64:
+		return strconv.FormatFloat(k, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(k)
+	}
+	return ""
+}
@@ -14,6 +14,7 @@
 package utils
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"testing"
@@ -230,6 +231,182 @@ func TestGetAll(t *testing.T) {
 				},
 			},
 		},
+		{
+			"non-string-keys",
+			map[string]interface{}{
+				"by_class": map[string]interface{}{
+					"buckets": []interface{}{
+						map[string]interface{}{
+							"key": "5xx",
+							"by_slow": map[string]interface{}{
+								"buckets": []interface{}{
+									map[string]interface{}{
+										"key":           json.Number("1"),
+										"key_as_string": "true",
+									},
+								},
+							},
+						},
+						map[string]interface{}{
+							"key": json.Number("404"),
+							"by_slow": map[string]interface{}{
+								"buckets": []interface{}{
+									map[string]interface{}{
+										"key": json.Number("0"),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			"by_class.buckets.by_slow.buckets",
+			[]interface{}{
+				map[string]interface{}{
+					"key":           "5xx - true",
+					"key_as_string": "true",
+				},
+				map[string]interface{}{
+					"key": "404 - 0",
+				},
+			},
+		},
+		{
+			"keyed-buckets",
+			map[string]interface{}{
+				"levels": map[string]interface{}{
+					"buckets": map[string]interface{}{
+						"warnings": map[string]interface{}{
+							"doc_count": json.Number("120"),
+						},
+						"errors": map[string]interface{}{
+							"doc_count": json.Number("34"),
+						},
+					},
+				},
+			},
+			"levels.buckets",
+			[]interface{}{
+				map[string]interface{}{
+					"key":       "errors",
+					"doc_count": json.Number("34"),
+				},
+				map[string]interface{}{
+					"key":       "warnings",
+					"doc_count": json.Number("120"),
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			out := GetAll(tc.json, tc.path)
+			if !reflect.DeepEqual(out, tc.output) {
+				t.Fatalf("Got:\n%+v\n\nExpected:\n%+v", out, tc.output)
+			}
+		})
+	}
+}
+
+func TestGetBuckets(t *testing.T) {
+	cases := []struct {
+		name   string
+		json   map[string]interface{}
+		path   string
+		output []interface{}
+	}{
+		{
+			"keyed-buckets",
+			map[string]interface{}{
+				"aggregations": map[string]interface{}{
+					"by_level": map[string]interface{}{
+						"buckets": map[string]interface{}{
+							"warnings": map[string]interface{}{
+								"doc_count": json.Number("2"),
+							},
+							"errors": map[string]interface{}{
+								"doc_count": json.Number("4"),
+							},
+						},
+					},
+				},
+			},
+			"aggregations.by_level.buckets[]",
+			[]interface{}{
+				map[string]interface{}{
+					"key":       "errors",
+					"doc_count": json.Number("4"),
+				},
+				map[string]interface{}{
+					"key":       "warnings",
+					"doc_count": json.Number("2"),
+				},
+			},
+		},
+		{
+			"key-as-string",
+			map[string]interface{}{
+				"aggregations": map[string]interface{}{
+					"by_hour": map[string]interface{}{
+						"buckets": []interface{}{
+							map[string]interface{}{
+								"key":           json.Number("1546300800000"),
+								"key_as_string": "2019-01-01T00:00:00.000Z",
+								"by_host": map[string]interface{}{
+									"buckets": []interface{}{
+										map[string]interface{}{
+											"key":       "foo",
+											"doc_count": json.Number("3"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			"aggregations.by_hour.buckets[].by_host.buckets[]",
+			[]interface{}{
+				map[string]interface{}{
+					"key":       "2019-01-01T00:00:00.000Z/foo",
+					"doc_count": json.Number("3"),
+				},
+			},
+		},
+		{
+			"not-leaf-bucket",
+			map[string]interface{}{
+				"aggregations": map[string]interface{}{
+					"by_host": map[string]interface{}{
+						"buckets": []interface{}{
+							map[string]interface{}{
+								"key": "foo",
+								"errors": map[string]interface{}{
+									"doc_count": json.Number("5"),
+								},
+							},
+						},
+					},
+				},
+			},
+			"aggregations.by_host.buckets[].errors",
+			[]interface{}{
+				map[string]interface{}{
+					"key":       "foo",
+					"doc_count": json.Number("5"),
+				},
+			},
+		},
+		{
+			"missing",
+			map[string]interface{}{
+				"aggregations": map[string]interface{}{},
+			},
+			"aggregations.by_host.buckets[]",
+			nil,
+		},
 	}
 
 	for _, tc := range cases {
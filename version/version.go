@@ -13,6 +13,11 @@
 
 package version
 
+import (
+	"fmt"
+	"runtime"
+)
+
 // Version indicates which version of the binary is running.
 var Version = "dev"
 
@@ -22,3 +27,26 @@ var Commit = "none"
 
 // Date is the date on which the binary was built.
 var Date = "unknown"
+
+// String returns a human-readable description of the
+// build, including the Go runtime version.
+func String() string {
+	return fmt.Sprintf("version %s, commit %s, built %s, %s", Version, Commit, Date, runtime.Version())
+}
+
+// UserAgent returns the default User-Agent header value
+// included in outbound HTTP requests.
+func UserAgent() string {
+	return "go-elasticsearch-alerts/" + Version
+}
+
+// UserAgentWith returns the default User-Agent header value
+// followed by the given product, if any (e.g.
+// "go-elasticsearch-alerts/1.0.0 my-team/2.0"), so that a custom
+// value still identifies this program.
+func UserAgentWith(product string) string {
+	if product == "" {
+		return UserAgent()
+	}
+	return UserAgent() + " " + product
+}